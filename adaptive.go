@@ -0,0 +1,160 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"fmt"
+	"image"
+)
+
+// DefaultAdaptiveThreshold is a Threshold for Adaptive that skips flat
+// areas and gentle gradients in most photos.
+const DefaultAdaptiveThreshold = 16
+
+// Adaptive stores the payload only in the pixels of textured regions, where
+// some channel of the 3x3 pixels around them spans at least Threshold, 1 to
+// 255, and skips the smooth gradients and flat areas where changed low bits
+// show the most, to the eye and to steganalysis. The texture is measured in
+// the bits above those that carry the payload, which encoding leaves alone,
+// so decoding finds the same pixels in the encoded image. It can not be
+// combined with Matching, which can change those bits too, and it holds
+// less the smoother the cover is.
+type Adaptive struct {
+	Threshold int
+}
+
+func (Adaptive) ID() byte { return 7 }
+
+func (p Adaptive) MarshalBinary() ([]byte, error) {
+	if p.Threshold < 1 || p.Threshold > 0xFF {
+		return nil, fmt.Errorf("adaptive threshold %d is not between 1 and 255", p.Threshold)
+	}
+	return []byte{byte(p.Threshold)}, nil
+}
+
+func (p Adaptive) Carrier(s Slots) Carrier {
+	c := &adaptiveCarrier{s: s, next: s.Start, textured: textured(s, p.Threshold)}
+	if c.textured == nil || s.Start >= s.Len() {
+		c.next = s.Len()
+		return c
+	}
+
+	first := s.Start / s.PerPixel
+	if c.textured[first] {
+		c.remaining = (first+1)*s.PerPixel - s.Start
+	}
+	for _, t := range c.textured[first+1:] {
+		if t {
+			c.remaining += s.PerPixel
+		}
+	}
+	return c
+}
+
+// adaptiveCarrier yields the slots of the textured pixels from next in
+// order. textured is indexed by the number of the pixel in the slot order.
+type adaptiveCarrier struct {
+	s               Slots
+	textured        []bool
+	next, remaining int
+}
+
+func (c *adaptiveCarrier) Next() (int, bool) {
+	for c.next < c.s.Len() {
+		if p := c.next / c.s.PerPixel; !c.textured[p] {
+			c.next = (p + 1) * c.s.PerPixel
+			continue
+		}
+		c.remaining--
+		c.next++
+		return c.next - 1, true
+	}
+	return 0, false
+}
+
+func (c *adaptiveCarrier) Remaining() int {
+	return c.remaining
+}
+
+// textured returns which pixels of s, in slot order, have a texture of at
+// least threshold, or nil if s has no pixels to measure.
+func textured(s Slots, threshold int) []bool {
+	img, l := s.img, s.layout
+	if img == nil || l == nil || s.PerPixel == 0 {
+		return nil
+	}
+	w, h := s.Width, s.Height
+	if w == 0 || h == 0 || len(img.Pix) < (h-1)*img.Stride+w*img.pixelSize() {
+		return nil
+	}
+
+	// Only the bits above those of the payload, which is all of them
+	// in channels without any, and the high byte of a 16 bit sample.
+	var values [3][]uint8
+	for c := range values {
+		if c >= img.colors() {
+			// A gray pixel measures the same sample in every channel.
+			values[c] = values[0]
+			continue
+		}
+		values[c] = make([]uint8, w*h)
+		mask := ^uint8(1<<l.channelDepth(c) - 1)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				o := img.sample(x, y, c)
+				if img.wide {
+					values[c][y*w+x] = img.Pix[o-1]
+				} else {
+					values[c][y*w+x] = img.Pix[o] & mask
+				}
+			}
+		}
+	}
+
+	t := make([]bool, w*h)
+	for q := range t {
+		p := s.Pixel(q * s.PerPixel)
+		t[q] = texture(&values, w, h, p) >= threshold
+	}
+	return t
+}
+
+// texture returns the widest span of values within the 3x3 pixels around p
+// in any channel.
+func texture(values *[3][]uint8, w, h int, p image.Point) int {
+	var widest int
+	for c := range values {
+		lo, hi := uint8(0xFF), uint8(0)
+		for y := p.Y - 1; y <= p.Y+1; y++ {
+			for x := p.X - 1; x <= p.X+1; x++ {
+				if x < 0 || y < 0 || x >= w || y >= h {
+					continue
+				}
+				v := values[c][y*w+x]
+				if v < lo {
+					lo = v
+				}
+				if v > hi {
+					hi = v
+				}
+			}
+		}
+		if int(hi-lo) > widest {
+			widest = int(hi - lo)
+		}
+	}
+	return widest
+}
@@ -0,0 +1,154 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// A payload encrypted to age recipients is stored as an age v1 file, which
+// the age tool decrypts too, see age-encryption.org/v1. It is written and
+// read by filippo.io/age, which draws the file key and the ephemeral shares
+// from crypto/rand, so Options.Rand and Deterministic do not apply. Only
+// X25519 recipients are supported.
+
+// ageChunk is the size of the plaintext chunks of an age payload.
+const ageChunk = 64 << 10
+
+// AgeRecipient is the X25519 public key of an age identity.
+type AgeRecipient struct {
+	key *age.X25519Recipient
+}
+
+// ParseAgeRecipient parses an age public key, like age1ql3z7hjy54pw3hyww5....
+func ParseAgeRecipient(s string) (*AgeRecipient, error) {
+	key, err := age.ParseX25519Recipient(s)
+	if err != nil {
+		return nil, err
+	}
+	return &AgeRecipient{key}, nil
+}
+
+func (r *AgeRecipient) String() string {
+	return r.key.String()
+}
+
+func (r *AgeRecipient) scheme() recipientScheme { return ageScheme{} }
+
+// AgeIdentity is an age X25519 private key.
+type AgeIdentity struct {
+	key *age.X25519Identity
+}
+
+// GenerateAgeIdentity returns a new age identity.
+func GenerateAgeIdentity() (*AgeIdentity, error) {
+	key, err := age.GenerateX25519Identity()
+	if err != nil {
+		return nil, err
+	}
+	return &AgeIdentity{key}, nil
+}
+
+// ParseAgeIdentity parses an age private key, like AGE-SECRET-KEY-1....
+func ParseAgeIdentity(s string) (*AgeIdentity, error) {
+	key, err := age.ParseX25519Identity(s)
+	if err != nil {
+		return nil, err
+	}
+	return &AgeIdentity{key}, nil
+}
+
+// String returns the private key as the age tool writes it.
+func (id *AgeIdentity) String() string {
+	return id.key.String()
+}
+
+func (id *AgeIdentity) Recipient() Recipient {
+	return &AgeRecipient{id.key.Recipient()}
+}
+
+func (id *AgeIdentity) scheme() recipientScheme { return ageScheme{} }
+
+// ageScheme stores payloads as age files.
+type ageScheme struct{}
+
+func (ageScheme) id() byte     { return 1 }
+func (ageScheme) name() string { return "age" }
+
+func (ageScheme) encrypt(recipients []Recipient, payload []byte, _ io.Reader) ([]byte, error) {
+	to := make([]age.Recipient, len(recipients))
+	for i, r := range recipients {
+		to[i] = r.(*AgeRecipient).key
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, to...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (ageScheme) decrypt(identities []Identity, payload []byte) ([]byte, error) {
+	keys := make([]age.Identity, len(identities))
+	for i, id := range identities {
+		keys[i] = id.(*AgeIdentity).key
+	}
+
+	r, err := age.Decrypt(bytes.NewReader(payload), keys...)
+	if errors.As(err, new(*age.NoIdentityMatchError)) {
+		return nil, ErrNoIdentity
+	} else if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		Wipe(plain)
+		return nil, ErrDecryptionFailed
+	}
+	return plain, nil
+}
+
+// capacity measures the header of an empty age file to recipients, which
+// has the same size for every payload, and the one chunk it holds.
+func (s ageScheme) capacity(recipients []Recipient, n int) int {
+	empty, err := s.encrypt(recipients, nil, nil)
+	if err != nil {
+		return 0
+	}
+	n -= len(empty) - chacha20poly1305.Overhead
+	if n <= 0 {
+		return 0
+	}
+	sealed := ageChunk + chacha20poly1305.Overhead
+	n, rest := n/sealed*ageChunk, n%sealed
+	if rest > chacha20poly1305.Overhead {
+		n += rest - chacha20poly1305.Overhead
+	}
+	return n
+}
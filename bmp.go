@@ -0,0 +1,482 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math/rand"
+)
+
+// EncodeBMP and DecodeBMP store a message in an uncompressed 24 or 32 bit BMP
+// exactly where Encode and Decode put it in the pixels of the image, so
+// either pair reads what the other wrote. The file is processed a row at a
+// time instead of as an image. EncodeBMP copies it in one pass, so a cover
+// of any size is encoded in bounded memory, and DecodeBMP seeks to the rows
+// that hold the message, which come last in a bottom-up file. With
+// Options.Matching the rows are changed in file order, so a sample may be
+// changed the other way than Encode would.
+
+// ErrBMPStream is returned by EncodeBMP and DecodeBMP for the options that
+// need the whole image: placements, channel depths, seals and copies.
+var ErrBMPStream = errors.New("placements, channel depths, seals and copies need the whole image, a BMP can not be streamed with them")
+
+// bmpFile is the layout of the pixels of an uncompressed BMP.
+type bmpFile struct {
+	width, height int
+	bpp           int // bytes per pixel, 3 or 4
+	offset        int64
+	stride        int
+	topDown       bool
+}
+
+// readBMPHeader reads the headers of a BMP from r, up to the pixels, and
+// returns them as read. Only what golang.org/x/image/bmp decodes without a
+// palette is accepted.
+func readBMPHeader(r io.Reader) ([]byte, *bmpFile, error) {
+	const (
+		fileHeaderLen = 14
+		infoHeaderLen = 40
+		v4HeaderLen   = 108
+		v5HeaderLen   = 124
+	)
+	head := make([]byte, fileHeaderLen+4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, nil, malformed("bmp", unexpected(err))
+	}
+	if string(head[:2]) != "BM" {
+		return nil, nil, &MalformedImageError{"bmp", errors.New("missing BM signature")}
+	}
+	infoLen := binary.LittleEndian.Uint32(head[14:18])
+	if infoLen != infoHeaderLen && infoLen != v4HeaderLen && infoLen != v5HeaderLen {
+		return nil, nil, &MalformedImageError{"bmp", fmt.Errorf("unsupported info header of %d bytes", infoLen)}
+	}
+	head = append(head, make([]byte, infoLen-4)...)
+	if _, err := io.ReadFull(r, head[fileHeaderLen+4:]); err != nil {
+		return nil, nil, malformed("bmp", unexpected(err))
+	}
+
+	f := &bmpFile{
+		offset: int64(binary.LittleEndian.Uint32(head[10:14])),
+		width:  int(int32(binary.LittleEndian.Uint32(head[18:22]))),
+		height: int(int32(binary.LittleEndian.Uint32(head[22:26]))),
+	}
+	if f.height < 0 {
+		f.height, f.topDown = -f.height, true
+	}
+	planes, bits := binary.LittleEndian.Uint16(head[26:28]), binary.LittleEndian.Uint16(head[28:30])
+	compression := binary.LittleEndian.Uint32(head[30:34])
+	if compression == 3 && infoLen > infoHeaderLen &&
+		binary.LittleEndian.Uint32(head[54:58]) == 0xff0000 && binary.LittleEndian.Uint32(head[58:62]) == 0xff00 &&
+		binary.LittleEndian.Uint32(head[62:66]) == 0xff && binary.LittleEndian.Uint32(head[66:70]) == 0xff000000 {
+		// Bit fields in the default order are plain pixels.
+		compression = 0
+	}
+	switch {
+	case planes != 1 || compression != 0:
+		return nil, nil, &MalformedImageError{"bmp", errors.New("only uncompressed images can be streamed")}
+	case bits != 24 && bits != 32:
+		return nil, nil, &MalformedImageError{"bmp", fmt.Errorf("%d bits per pixel, only 24 and 32 can be streamed", bits)}
+	case f.offset != int64(len(head)):
+		return nil, nil, &MalformedImageError{"bmp", errors.New("the pixels do not follow the header")}
+	case f.width <= 0 || f.height <= 0:
+		return nil, nil, &MalformedImageError{"bmp", fmt.Errorf("invalid dimensions %dx%d", f.width, f.height)}
+	}
+	if err := checkPixels(f.width, f.height, maxInt/3); err != nil {
+		return nil, nil, malformed("bmp", err)
+	}
+	f.bpp = int(bits) / 8
+	f.stride = (f.width*f.bpp + 3) &^ 3
+	return head, f, nil
+}
+
+// checkSize returns an error unless r, right after the header, holds as
+// many rows as the header claims, so nothing is allocated for pixels that
+// are not there. It leaves r at the first row.
+func (f *bmpFile) checkSize(r io.Seeker) error {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(f.offset, io.SeekStart); err != nil {
+		return err
+	}
+	if int64(f.height) > (end-f.offset)/int64(f.stride) {
+		return &MalformedImageError{"bmp", fmt.Errorf("pixel data ends at byte %d, the header claims %d rows of %d bytes", end, f.height, f.stride)}
+	}
+	return nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// row returns the image row stored as row i of the file, and the other way
+// around.
+func (f *bmpFile) row(i int) int {
+	if f.topDown {
+		return i
+	}
+	return f.height - 1 - i
+}
+
+// bits stores the bits of data, the container from byte base on, that fall
+// in image row y in the row of pixels px, by LSB matching with match, or
+// with read set loads them into data, which has to be zeroed.
+func (f *bmpFile) bits(px []byte, y int, data []byte, base int, read bool, match *rand.Rand) {
+	var (
+		perRow     = f.width * 3
+		start, end = y * perRow, (y + 1) * perRow
+	)
+	if lo := base * 8; start < lo {
+		start = lo
+	}
+	if hi := (base + len(data)) * 8; end > hi {
+		end = hi
+	}
+	for i := start; i < end; i++ {
+		within := i - y*perRow
+		// Samples are stored B, G, R, and channel 0 is R.
+		s := &px[within/3*f.bpp+2-within%3]
+		b, bit := &data[i/8-base], uint(7-i%8)
+		switch v := *b >> bit & 1; {
+		case read:
+			*b |= *s & 1 << bit
+		case match != nil && *s&1 != v:
+			if *s == 0 || (*s != 0xFF && match.Intn(2) == 1) {
+				*s++
+			} else {
+				*s--
+			}
+		default:
+			*s = *s&^1 | v
+		}
+	}
+}
+
+// EncodeBMP copies the uncompressed 24 or 32 bit BMP read from r to w with
+// payload hidden in its pixels. It fails with ErrMessageTooLarge, before
+// anything is written, if the payload does not fit.
+func EncodeBMP(w io.Writer, r io.Reader, payload []byte, opt *Options) error {
+	if opt.placement() != nil || opt.layout() != nil || opt.seal() || opt.copies() > 1 {
+		return ErrBMPStream
+	}
+	if opt.preserveHistogram() {
+		return ErrHistogramUnsupported
+	}
+	if opt.fill() {
+		return ErrFillUnsupported
+	}
+	header, payload, err := container(payload, opt)
+	if err != nil {
+		return err
+	}
+	data := append(header, payload...)
+	defer Wipe(data)
+	match, err := opt.matchRand(data)
+	if err != nil {
+		return err
+	}
+
+	head, f, err := readBMPHeader(r)
+	if err != nil {
+		return err
+	}
+	if len(data) > f.width*f.height*3/8 {
+		return ErrMessageTooLarge
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(head); err != nil {
+		return err
+	}
+	// r may not be able to seek, so the first row is read as it arrives.
+	// A header claiming rows larger than the file allocates no more than it
+	// holds, the rows after it reuse the buffer.
+	px, err := ioutil.ReadAll(io.LimitReader(r, int64(f.stride)))
+	if err == nil && len(px) < f.stride {
+		err = io.ErrUnexpectedEOF
+	}
+	for i := 0; i < f.height; i++ {
+		if i > 0 {
+			_, err = io.ReadFull(r, px)
+		}
+		if err != nil {
+			return &MalformedImageError{"bmp", unexpected(err)}
+		}
+		f.bits(px, f.row(i), data, 0, false, match)
+		if _, err := bw.Write(px); err != nil {
+			return err
+		}
+	}
+	// Whatever follows the pixels, like an ICC profile, is kept.
+	if _, err := io.Copy(bw, r); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// DecodeBMP extracts the payload hidden in the uncompressed 24 or 32 bit BMP
+// r, reading only the rows that hold it, and validates it like Decode.
+func DecodeBMP(r io.ReadSeeker, opt *Options) ([]byte, error) {
+	if opt.placement() != nil || opt.layout() != nil || opt.seal() {
+		return nil, ErrBMPStream
+	}
+	msg, h, err := extractBMP(r, opt.legacy())
+	if err != nil {
+		return nil, err
+	}
+	return h.open(msg, opt)
+}
+
+// DetectBMP is Detect for an uncompressed 24 or 32 bit BMP, read like
+// DecodeBMP.
+func DetectBMP(r io.ReadSeeker) (int, string, error) {
+	msg, h, err := extractBMP(r, false)
+	if err != nil {
+		return 0, "", err
+	}
+	return len(msg), detectFormat(msg, h), nil
+}
+
+// InspectBMP returns the header of the message hidden in the pixels of the
+// uncompressed 24 or 32 bit BMP r, reading only the rows at the top of the
+// image that hold it, so a large file is checked in a fraction of the time
+// Detect takes. Only a header that starts with the container magic is
+// found, not one of an Exclude placement below excluded rows, and the
+// payload is not read: its length is checked against what the image holds,
+// but not its checksum. Without a header the error is ErrNoHiddenMessage,
+// and a *TruncatedError if the header claims more than the image holds.
+func InspectBMP(r io.ReadSeeker) (*Header, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	_, f, err := readBMPHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.checkSize(r); err != nil {
+		return nil, err
+	}
+
+	// The magic takes the most rows in one channel.
+	rows := (len(containerMagic)*8 + f.width - 1) / f.width
+	for _, l := range append([]*layout{&defaultLayout}, bootstrapLayouts()...) {
+		if h, err := f.inspect(r, l, rows); err != ErrNoHiddenMessage {
+			return h, err
+		}
+	}
+	return nil, ErrNoHiddenMessage
+}
+
+// inspect reads the header of the BMP r in bootstrap layout l from the
+// first rows of the image, twice as many each time until they hold it all,
+// and validates it like readHeader.
+func (f *bmpFile) inspect(r io.ReadSeeker, l *layout, rows int) (*Header, error) {
+	for {
+		if rows > f.height {
+			rows = f.height
+		}
+		img, err := f.topRows(r, rows)
+		if err != nil {
+			return nil, err
+		}
+		var magic [len(containerMagic)]byte
+		if _, err := io.ReadFull(newLSBReader(img, l), magic[:]); err != nil || string(magic[:]) != containerMagic {
+			return nil, ErrNoHiddenMessage
+		}
+
+		lr := newLSBReader(img, l)
+		h := &Header{}
+		switch err := h.read(lr); {
+		case (err == io.EOF || err == io.ErrUnexpectedEOF) && rows < f.height:
+			rows *= 2
+			continue
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return nil, ErrNoHiddenMessage
+		case err != nil:
+			return nil, err
+		}
+
+		full := image.Rect(0, 0, f.width, f.height)
+		available := l.slots(full, 0).Len() - lr.used
+		dl, err := headerDepth(h)
+		switch {
+		case err != nil:
+			return nil, err
+		case dl != nil:
+			if dl.lsbFirst = l.lsbFirst; dl.bootstrap().String() != l.String() {
+				return nil, ErrNoHiddenMessage
+			}
+			s := dl.payloadSlots(full, lr.used)
+			available = s.Len() - s.Start
+		case l != &defaultLayout:
+			return nil, ErrNoHiddenMessage
+		}
+		if _, err := headerPlacement(h); err != nil {
+			return nil, err
+		}
+		if err := h.checkLength(available / 8); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+}
+
+// topRows reads the first n rows of the image as Decode sees them: opaque,
+// unless a 32 bit file has an alpha channel, which only the longer info
+// headers have.
+func (f *bmpFile) topRows(r io.ReadSeeker, n int) (*carrierImage, error) {
+	const fileHeaderLen, infoHeaderLen = 14, 40
+	alpha := f.bpp == 4 && f.offset > fileHeaderLen+infoHeaderLen
+
+	img := &carrierImage{Pix: make([]byte, f.width*n*4), Stride: f.width * 4, Rect: image.Rect(0, 0, f.width, n)}
+	s := &bmpReader{f: f, r: r, px: make([]byte, f.stride), y: -1}
+	for y := 0; y < n; y++ {
+		if err := s.load(y); err != nil {
+			return nil, err
+		}
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < f.width; x++ {
+			p, q := s.px[x*f.bpp:], row[x*4:]
+			q[0], q[1], q[2], q[3] = p[2], p[1], p[0], 0xff
+			if alpha {
+				q[3] = p[3]
+			}
+		}
+	}
+	return img, nil
+}
+
+func extractBMP(r io.ReadSeeker, legacy bool) ([]byte, *Header, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	_, f, err := readBMPHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := f.checkSize(r); err != nil {
+		return nil, nil, err
+	}
+	s := &bmpReader{f: f, r: r, px: make([]byte, f.stride), y: -1}
+
+	h := &Header{}
+	switch err := h.read(s); err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		return nil, nil, ErrNoHiddenMessage
+	default:
+		return nil, nil, err
+	}
+	if h.Version == 0 && !legacy {
+		return nil, nil, ErrNoHiddenMessage
+	}
+	// Anything but Sequential can only be read from the image.
+	if p, err := headerPlacement(h); err != nil || p != nil {
+		return nil, nil, ErrBMPStream
+	}
+	if l, err := headerDepth(h); err != nil || l != nil {
+		return nil, nil, ErrBMPStream
+	}
+	if _, ok := h.Field(FieldSeal); ok {
+		return nil, nil, ErrBMPStream
+	}
+	if err := h.checkLength(s.remaining()); err != nil {
+		return nil, nil, err
+	}
+
+	msg := make([]byte, h.Length)
+	if _, err := io.ReadFull(s, msg); err != nil {
+		return nil, nil, err
+	}
+	if msg, h.repaired, err = h.repair(msg); err != nil {
+		return nil, nil, err
+	}
+	if sum := h.sum(msg); !bytes.Equal(sum, h.Checksum) {
+		return nil, nil, &ChecksumError{msg, h.Length + s.remaining(), h.Checksum, sum}
+	}
+	if h.Flags&FlagResync != 0 {
+		if msg, err = unframe(msg); err != nil {
+			return nil, nil, err
+		}
+	}
+	return msg, h, nil
+}
+
+// bmpReader reads the message bytes of a BMP in order, loading the row that
+// holds them.
+type bmpReader struct {
+	f   *bmpFile
+	r   io.ReadSeeker
+	px  []byte
+	y   int
+	pos int
+}
+
+// remaining returns the number of whole bytes left to read.
+func (s *bmpReader) remaining() int {
+	return s.f.width*s.f.height*3/8 - s.pos
+}
+
+func (s *bmpReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if s.remaining() == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > s.remaining() {
+		p = p[:s.remaining()]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+
+	perRow := s.f.width * 3
+	for y := s.pos * 8 / perRow; y <= ((s.pos+len(p))*8-1)/perRow; y++ {
+		if err := s.load(y); err != nil {
+			return 0, err
+		}
+		s.f.bits(s.px, y, p, s.pos, true, nil)
+	}
+	s.pos += len(p)
+	return len(p), nil
+}
+
+// load reads image row y into px, unless it is already there.
+func (s *bmpReader) load(y int) error {
+	if s.y == y {
+		return nil
+	}
+	if _, err := s.r.Seek(s.f.offset+int64(s.f.row(y))*int64(s.f.stride), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(s.r, s.px); err != nil {
+		return &MalformedImageError{"bmp", unexpected(err)}
+	}
+	s.y = y
+	return nil
+}
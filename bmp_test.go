@@ -0,0 +1,132 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/image/bmp"
+)
+
+// TestBMPHugeRows streams a BMP whose header claims rows of 768 MB but that
+// holds 64 bytes of pixels. It fails without allocating for them.
+func TestBMPHugeRows(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "malformed", "bmp-huge-rows.bmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		f    func() error
+	}{
+		{"DecodeBMP", func() error { _, err := DecodeBMP(bytes.NewReader(data), nil); return err }},
+		{"DetectBMP", func() error { _, _, err := DetectBMP(bytes.NewReader(data)); return err }},
+		{"InspectBMP", func() error { _, err := InspectBMP(bytes.NewReader(data)); return err }},
+		{"DecodeFile", func() error { _, err := DecodeFile(bytes.NewReader(data), nil); return err }},
+		{"EncodeBMP", func() error { return EncodeBMP(ioutil.Discard, bytes.NewReader(data), []byte("x"), nil) }},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		err := c.f()
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("%s: accepted the file", c.name)
+		}
+		if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+			t.Errorf("%s: allocated %d bytes", c.name, n)
+		}
+	}
+}
+
+// TestBMP24 round trips messages through 24 bit BMPs, decoded into RGBA,
+// encoded and written as 24 bits again, and streamed with EncodeBMP. Widths
+// of 61, 2 and 1 pixels pad their rows, which must stay as they are.
+func TestBMP24(t *testing.T) {
+	for _, w := range []int{64, 61, 2, 1} {
+		t.Run(fmt.Sprint(w), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := bmp.Encode(&buf, testCover(w, 300/w+20, 161)); err != nil {
+				t.Fatal(err)
+			}
+			cover := buf.Bytes()
+			if bpp := binary.LittleEndian.Uint16(cover[28:]); bpp != 24 {
+				t.Fatalf("the cover has %d bits per pixel", bpp)
+			}
+			img, _, err := DecodeImage(bytes.NewReader(cover))
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload := testPayload(Capacity(img, nil), 161)
+
+			stego := roundTrip(t, img, payload, nil, nil)
+			buf.Reset()
+			if err := bmp.Encode(&buf, stego); err != nil {
+				t.Fatal(err)
+			}
+			checkBMP24(t, "Encode", cover, buf.Bytes(), payload)
+
+			buf.Reset()
+			if err := EncodeBMP(&buf, bytes.NewReader(cover), payload, nil); err != nil {
+				t.Fatal(err)
+			}
+			checkBMP24(t, "EncodeBMP", cover, buf.Bytes(), payload)
+			if got, err := DecodeBMP(bytes.NewReader(buf.Bytes()), nil); err != nil || !bytes.Equal(got, payload) {
+				t.Errorf("DecodeBMP: decoded %d bytes, %v", len(got), err)
+			}
+		})
+	}
+}
+
+// checkBMP24 checks that the 24 bit BMP stego holds payload and differs from
+// cover in nothing but the lowest bit of its samples, and not at all in its
+// headers and the padding of its rows.
+func checkBMP24(t *testing.T, name string, cover, stego, payload []byte) {
+	t.Helper()
+	if len(stego) != len(cover) {
+		t.Fatalf("%s: %d bytes, the cover %d", name, len(stego), len(cover))
+	}
+	offset := int(binary.LittleEndian.Uint32(cover[10:]))
+	width := int(binary.LittleEndian.Uint32(cover[18:]))
+	stride := (width*3 + 3) &^ 3
+	if !bytes.Equal(stego[:offset], cover[:offset]) {
+		t.Errorf("%s: the headers changed", name)
+	}
+	for i := offset; i < len(cover); i++ {
+		d := cover[i] ^ stego[i]
+		if (i-offset)%stride >= width*3 && d != 0 || d > 1 {
+			t.Fatalf("%s: byte %d changed from %#x to %#x", name, i, cover[i], stego[i])
+		}
+	}
+
+	img, _, err := DecodeImage(bytes.NewReader(stego))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := img.(*image.RGBA); !ok {
+		t.Errorf("%s: decoded as %T", name, img)
+	}
+	if got, err := Decode(img, nil); err != nil || !bytes.Equal(got, payload) {
+		t.Errorf("%s: decoded %d bytes, %v", name, len(got), err)
+	}
+}
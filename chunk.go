@@ -0,0 +1,721 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"image"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// A chunked payload, FlagChunked, is stored as frames, each a 32 bit length
+// followed by that many bytes. Without encryption every frame holds a chunk
+// of the payload. An encrypted payload starts with a frame of the cipher ID,
+// salt and nonce, and every frame after it is a chunk sealed on its own:
+//
+//	nonce  the stored nonce with its last 8 bytes XORed with the chunk number
+//	ad     cipher ID, salt, the chunk number as 8 bytes and 1 for the last
+//	       chunk or 0
+//
+// so chunks can not be reordered, dropped or cut off at a chunk boundary. The
+// header checksum covers the metadata followed by the checksum of every
+// frame, which lets EncodeStream compute it a frame at a time. The length in
+// the header is always 64 bits, so the header can be written last.
+
+// MaxChunkSize is the largest Options.ChunkSize.
+const MaxChunkSize = 64 << 20
+
+// DefaultChunkSize is the chunk size of EncodeStream when Options.ChunkSize
+// is zero.
+const DefaultChunkSize = 1 << 20
+
+// chunkQueue is how many frames EncodeStream keeps ready for embedding.
+const chunkQueue = 4
+
+var errChunks = errors.New("malformed chunked payload")
+
+// chunker cuts a payload read from r into frames, padding or encrypting
+// every chunk as it goes.
+type chunker struct {
+	r    *bufio.Reader
+	size int
+
+	cipher Cipher
+	key    []byte
+	nonce  []byte
+	ad     []byte
+
+	pad       *Pad
+	padOffset int
+
+	preamble []byte
+	n        uint64
+	done     bool
+}
+
+// newChunker returns a chunker for chunks of size bytes, encrypted with c if
+// it is not nil. Salt and nonce are read from rnd.
+func newChunker(r io.Reader, size int, c Cipher, passphrase []byte, rnd io.Reader) (*chunker, error) {
+	k := &chunker{r: bufio.NewReader(r), size: size, cipher: c}
+	if c == nil {
+		return k, nil
+	}
+	if rnd == nil {
+		rnd = rand.Reader
+	}
+
+	buf := make([]byte, 1+saltSize+c.NonceSize())
+	buf[0] = c.ID()
+	if _, err := io.ReadFull(rnd, buf[1:]); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(passphrase, buf[1:1+saltSize], scryptN, scryptR, scryptP, c.KeySize())
+	if err != nil {
+		return nil, err
+	}
+	k.key, k.ad, k.nonce, k.preamble = key, buf[:1+saltSize], buf[1+saltSize:], chunkFrame(buf)
+	return k, nil
+}
+
+// next returns the next frame, or io.EOF after the last one. There is
+// always at least one chunk, even for an empty payload.
+func (k *chunker) next() ([]byte, error) {
+	if p := k.preamble; p != nil {
+		k.preamble = nil
+		return p, nil
+	}
+	if k.done {
+		return nil, io.EOF
+	}
+
+	chunk := make([]byte, k.size)
+	n, err := io.ReadFull(k.r, chunk)
+	switch err {
+	case nil:
+		if _, err := k.r.Peek(1); err == io.EOF {
+			k.done = true
+		} else if err != nil {
+			return nil, err
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		k.done = true
+	default:
+		return nil, err
+	}
+	chunk = chunk[:n]
+	defer Wipe(chunk)
+
+	if k.pad != nil {
+		padded, err := k.pad.xor(chunk, k.padOffset)
+		if err != nil {
+			return nil, err
+		}
+		defer Wipe(padded)
+		copy(chunk, padded)
+		k.padOffset += n
+	}
+	if k.cipher == nil {
+		return chunkFrame(chunk), nil
+	}
+
+	nonce, ad := chunkNonce(k.nonce, k.ad, k.n, k.done)
+	k.n++
+	sealed, err := k.cipher.Seal(k.key, nonce, chunk, ad)
+	if err != nil {
+		return nil, err
+	}
+	return chunkFrame(sealed), nil
+}
+
+// wipe zeroes the key.
+func (k *chunker) wipe() {
+	Wipe(k.key)
+}
+
+// chunkNonce returns the nonce and additional data of chunk n.
+func chunkNonce(nonce, ad []byte, n uint64, last bool) ([]byte, []byte) {
+	nonce = append([]byte(nil), nonce...)
+	var c [8]byte
+	binary.BigEndian.PutUint64(c[:], n)
+	for i := range c {
+		nonce[len(nonce)-8+i] ^= c[i]
+	}
+
+	ad = append(append([]byte(nil), ad...), c[:]...)
+	if last {
+		return nonce, append(ad, 1)
+	}
+	return nonce, append(ad, 0)
+}
+
+// chunkFrame returns data behind its 32 bit length.
+func chunkFrame(data []byte) []byte {
+	f := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(f, uint32(len(data)))
+	copy(f[4:], data)
+	return f
+}
+
+// chunkFrames splits a chunked payload into its frames, with their lengths.
+func chunkFrames(payload []byte) ([][]byte, error) {
+	var fs [][]byte
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			return fs, errChunks
+		}
+		n := int64(binary.BigEndian.Uint32(payload))
+		if n > int64(len(payload)-4) {
+			return fs, errChunks
+		}
+		fs, payload = append(fs, payload[:4+n]), payload[4+n:]
+	}
+	return fs, nil
+}
+
+// collectChunks reads every frame of k into one chunked payload.
+func collectChunks(k *chunker) ([]byte, error) {
+	var out []byte
+	for {
+		f, err := k.next()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, f...)
+	}
+}
+
+// chunks stores payload as a chunked payload without encryption.
+func chunks(payload []byte, size int) []byte {
+	out, _ := collectChunks(&chunker{r: bufio.NewReader(bytes.NewReader(payload)), size: size})
+	return out
+}
+
+// sealChunks is seal for a chunked payload.
+func sealChunks(c Cipher, passphrase, payload []byte, size int, rnd io.Reader) ([]byte, error) {
+	k, err := newChunker(bytes.NewReader(payload), size, c, passphrase, rnd)
+	if err != nil {
+		return nil, err
+	}
+	defer k.wipe()
+	return collectChunks(k)
+}
+
+// unchunkedLen returns the largest payload that fits in n bytes as chunks of
+// size bytes, encrypted with c if it is not nil.
+func unchunkedLen(n, size int, c Cipher) int {
+	per := 4
+	if c != nil {
+		n -= 4 + 1 + saltSize + c.NonceSize()
+		per += c.Overhead()
+	}
+	if n < per {
+		return 0
+	}
+
+	full := n / (size + per)
+	rest := n - full*(size+per) - per
+	if rest < 0 {
+		rest = 0
+	}
+	return full*size + rest
+}
+
+// chunkedSum is Header.sum for a chunked payload. Whatever follows a
+// malformed frame is summed as if it was one.
+func (h *Header) chunkedSum(payload []byte) []byte {
+	var sums []byte
+	if h.Flags&FlagMetadata != 0 {
+		sums = h.metadata()
+	}
+	fs, err := chunkFrames(payload)
+	for _, f := range fs {
+		sums = append(sums, h.Integrity.Sum(f)...)
+		payload = payload[len(f):]
+	}
+	if err != nil {
+		sums = append(sums, h.Integrity.Sum(payload)...)
+	}
+	return h.Integrity.Sum(sums)
+}
+
+// openChunks is Header.open for a chunked payload.
+func (h *Header) openChunks(payload []byte, opt *Options) ([]byte, error) {
+	fs, err := chunkFrames(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	if h.Flags&FlagEncrypted != 0 {
+		if out, err = openSealedChunks(opt.passphrase(), fs); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, f := range fs {
+			out = append(out, f[4:]...)
+		}
+	}
+
+	if h.Flags&FlagPad != 0 {
+		v, _ := h.Field(FieldPad)
+		defer Wipe(out)
+		return openPad(opt.pad(), v, out)
+	}
+	return out, nil
+}
+
+// openSealedChunks decrypts the frames of an encrypted chunked payload.
+func openSealedChunks(passphrase []byte, fs [][]byte) ([]byte, error) {
+	if len(fs) < 2 {
+		return nil, ErrDecryptionFailed
+	}
+	o, err := newChunkOpener(passphrase, fs[0])
+	if err != nil {
+		return nil, err
+	}
+	defer o.wipe()
+
+	var out []byte
+	for i, f := range fs[1:] {
+		chunk, err := o.open(f, i == len(fs)-2)
+		if err != nil {
+			Wipe(out)
+			return nil, err
+		}
+		out = append(out, chunk...)
+		Wipe(chunk)
+	}
+	return out, nil
+}
+
+// chunkOpener decrypts the chunks of an encrypted chunked payload in order.
+type chunkOpener struct {
+	c              Cipher
+	key, ad, nonce []byte
+	n              uint64
+}
+
+// newChunkOpener derives the key of the chunks from passphrase and the
+// first frame of the payload, preamble.
+func newChunkOpener(passphrase, preamble []byte) (*chunkOpener, error) {
+	if len(preamble) < 5 {
+		return nil, ErrDecryptionFailed
+	}
+	preamble = preamble[4:]
+	c, err := cipherByID(preamble[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, ErrPassphraseRequired
+	}
+	if len(preamble) != 1+saltSize+c.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+	ad, salt, nonce := preamble[:1+saltSize], preamble[1:1+saltSize], preamble[1+saltSize:]
+
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, c.KeySize())
+	if err != nil {
+		return nil, err
+	}
+	return &chunkOpener{c: c, key: key, ad: ad, nonce: nonce}, nil
+}
+
+// open decrypts the next frame f, which is the last one if last is set.
+func (o *chunkOpener) open(f []byte, last bool) ([]byte, error) {
+	n, a := chunkNonce(o.nonce, o.ad, o.n, last)
+	chunk, err := o.c.Open(o.key, n, f[4:], a)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	o.n++
+	return chunk, nil
+}
+
+// wipe zeroes the key.
+func (o *chunkOpener) wipe() {
+	Wipe(o.key)
+}
+
+// EncodeStream is Encode for a payload read from r, stored in chunks of
+// Options.ChunkSize bytes, or DefaultChunkSize if it is zero. The payload is
+// padded, encrypted and checksummed a chunk at a time while the chunks before
+// it are embedded, so it never has to be held in memory as a whole. It can
+// not be combined with Deterministic, which derives the nonce from the whole
+// payload.
+func EncodeStream(cover image.Image, r io.Reader, opt *Options) (image.Image, error) {
+	o := Options{}
+	if opt != nil {
+		o = *opt
+	}
+	if o.ChunkSize == 0 {
+		o.ChunkSize = DefaultChunkSize
+	}
+	if o.Deterministic && o.cipher() != nil {
+		return nil, errors.New("deterministic encryption derives the nonce from the whole payload, it can not be streamed")
+	}
+	return encodeChunks(cover, r, o.Rand, &o)
+}
+
+// encodeChunks embeds the chunks of the payload read from r as they are
+// produced, and writes the header over its placeholder once the length and
+// checksum are known. Salts and nonces are read from rnd.
+func encodeChunks(cover image.Image, r io.Reader, rnd io.Reader, opt *Options) (image.Image, error) {
+	h, err := opt.header()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAlpha(cover, opt.layout()); err != nil {
+		return nil, err
+	}
+	dest, samples, err := copyCarrier(cover)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := newChunker(r, opt.ChunkSize, opt.cipher(), opt.Passphrase, rnd)
+	if err != nil {
+		return nil, err
+	}
+	k.pad = opt.pad()
+	if k.pad != nil {
+		k.padOffset = k.pad.Offset
+	}
+
+	h.Checksum = make([]byte, h.Integrity.Size())
+	header, err := h.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	l := opt.layout()
+	boot := &defaultLayout
+	if l != nil {
+		boot = l.bootstrap()
+	}
+	match, err := opt.matchRand(nil)
+	if err != nil {
+		return nil, err
+	}
+	// LSB matching has to start from the cover again when the header is
+	// written over its placeholder.
+	var saved map[int]byte
+	if match != nil {
+		saved = headerSamples(samples, boot, len(header)*8)
+	}
+	w := newLSBWriter(samples, boot)
+	w.match = match
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	if l != nil {
+		w.relayout(l)
+	}
+	if p := opt.placement(); p != nil {
+		w.place(p)
+	}
+
+	// The MAC salt is read before the chunker starts, which shares rnd.
+	var (
+		mac, signed hash.Hash
+		salt        []byte
+	)
+	if opt.SigningKey != nil {
+		signed = h.newSignedHash()
+	}
+	if _, ok := h.Field(FieldMAC); ok {
+		if salt, err = macSalt(rnd); err != nil {
+			return nil, err
+		}
+		if mac, err = h.newMAC(opt.Passphrase, salt); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		queue = make(chan []byte, chunkQueue)
+		errc  = make(chan error, 1)
+		done  = make(chan struct{})
+		wg    sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(queue)
+		for {
+			f, err := k.next()
+			if err != nil {
+				if err != io.EOF {
+					errc <- err
+				}
+				return
+			}
+			select {
+			case queue <- f:
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer k.wipe()
+	defer wg.Wait()
+	defer close(done)
+
+	var sums []byte
+	for f := range queue {
+		_, err := w.Write(f)
+		sums = append(sums, h.Integrity.Sum(f)...)
+		if mac != nil {
+			mac.Write(f)
+		}
+		if signed != nil {
+			signed.Write(f)
+		}
+		h.Length += len(f)
+		Wipe(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	select {
+	case err := <-errc:
+		return nil, err
+	default:
+	}
+
+	if mac != nil {
+		h.putMAC(salt, mac.Sum(nil))
+	}
+	if signed != nil {
+		h.putSignature(ed25519.Sign(opt.SigningKey, signed.Sum(nil)))
+	}
+	if h.Flags&FlagMetadata != 0 {
+		sums = append(h.metadata(), sums...)
+	}
+	h.Checksum = h.Integrity.Sum(sums)
+	if header, err = h.MarshalBinary(); err != nil {
+		return nil, err
+	}
+	for off, v := range saved {
+		samples.Pix[off] = v
+	}
+	w = newLSBWriter(samples, boot)
+	w.match = match
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return dest, nil
+}
+
+// headerSamples returns the bytes of the samples that hold the first n
+// carrier bits of img in layout l, by Pix offset.
+func headerSamples(img *carrierImage, l *layout, n int) map[int]byte {
+	var (
+		c     = newCarrierBits(img, l)
+		saved = make(map[int]byte)
+	)
+	for i := 0; i < n; i++ {
+		off, _, ok := c.next()
+		if !ok {
+			break
+		}
+		saved[off] = img.Pix[off]
+		if img.wide {
+			saved[off-1] = img.Pix[off-1]
+		}
+	}
+	return saved
+}
+
+// DecodeStream is Decode returning a reader of the payload. A chunked
+// payload, as EncodeStream stores it, is read from img and decrypted a
+// chunk at a time as the reader is read, so it never has to be held in
+// memory as a whole. Encrypted chunks are authenticated as they are read,
+// the checksum and the MAC over the metadata only after the last one: the
+// reader then returns a *ChecksumError, without its Payload, or
+// ErrDecryptionFailed instead of io.EOF if they do not match, and anything
+// read before has to be discarded. Any other payload, or one that needs the
+// whole of it to open, like one with a pad, a seal, error correction or a
+// signature to verify, is decoded with Decode first.
+func DecodeStream(img image.Image, opt *Options) (io.Reader, error) {
+	samples := carrierOf(img)
+	r := storedReader(samples, storedLayout(samples))
+	h, err := readHeader(r, opt.passphrase())
+	if err != nil {
+		return nil, err
+	}
+	if !h.streamed(opt) {
+		payload, err := Decode(img, opt)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(payload), nil
+	}
+
+	if isKeyed(r.carrier) && len(opt.passphrase()) == 0 {
+		return nil, ErrPassphraseRequired
+	}
+	if t, ok := h.Expires(); ok && !opt.ignoreExpiry() && time.Now().After(t) {
+		return nil, &ExpiredError{t}
+	}
+	c := &chunkReader{h: h, r: r, left: int64(h.Length)}
+	if h.Flags&FlagMetadata != 0 {
+		c.sums = h.metadata()
+	}
+	if v, ok := h.Field(FieldMAC); !ok && h.Flags&FlagEncrypted != 0 {
+		return nil, ErrDecryptionFailed
+	} else if ok {
+		if len(opt.passphrase()) == 0 {
+			return nil, ErrPassphraseRequired
+		}
+		if len(v) != saltSize+sha256.Size {
+			return nil, ErrDecryptionFailed
+		}
+		if c.mac, err = h.newMAC(opt.passphrase(), v[:saltSize]); err != nil {
+			return nil, err
+		}
+	}
+	if h.Flags&FlagEncrypted != 0 {
+		f, err := c.frame()
+		if err == io.EOF {
+			err = ErrDecryptionFailed
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c.opener, err = newChunkOpener(opt.passphrase(), f); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// streamed reports whether DecodeStream reads the payload of h a chunk at a
+// time with opt.
+func (h *Header) streamed(opt *Options) bool {
+	if h.Flags&FlagChunked == 0 || h.Flags&(FlagPad|FlagResync|FlagECC) != 0 || opt.verifyKey() != nil {
+		return false
+	}
+	for _, t := range []byte{FieldSeal, FieldSlots} {
+		if _, ok := h.Field(t); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// chunkReader reads the chunks of a chunked payload from r, checksumming
+// and decrypting them one frame at a time. mac is the FieldMAC of an
+// encrypted one.
+type chunkReader struct {
+	h      *Header
+	r      io.Reader
+	left   int64
+	opener *chunkOpener
+	mac    hash.Hash
+	sums   []byte
+	chunk  []byte
+	err    error
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 && c.err == nil {
+		c.err = c.next()
+	}
+	if len(c.chunk) == 0 {
+		return 0, c.err
+	}
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+// next reads the next chunk, or checks the checksum after the last one.
+func (c *chunkReader) next() error {
+	f, err := c.frame()
+	if err == io.EOF {
+		if c.opener != nil {
+			c.opener.wipe()
+			if c.opener.n == 0 {
+				return ErrDecryptionFailed
+			}
+		}
+		if sum := c.h.Integrity.Sum(c.sums); !bytes.Equal(sum, c.h.Checksum) {
+			return &ChecksumError{Capacity: c.h.Length, Stored: c.h.Checksum, Computed: sum}
+		}
+		if v, _ := c.h.Field(FieldMAC); c.mac != nil && !hmac.Equal(c.mac.Sum(nil), v[saltSize:]) {
+			return ErrDecryptionFailed
+		}
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.opener == nil {
+		c.chunk = f[4:]
+		return nil
+	}
+	if c.chunk, err = c.opener.open(f, c.left == 0); err != nil {
+		c.opener.wipe()
+	}
+	return err
+}
+
+// frame reads the next frame, with its length, and adds its checksum. It
+// returns io.EOF after the last one.
+func (c *chunkReader) frame() ([]byte, error) {
+	if c.left == 0 {
+		return nil, io.EOF
+	}
+	var n [4]byte
+	if c.left < 4 {
+		return nil, errChunks
+	}
+	if _, err := io.ReadFull(c.r, n[:]); err != nil {
+		return nil, ErrNoHiddenMessage
+	}
+	size := int64(binary.BigEndian.Uint32(n[:]))
+	if size > c.left-4 {
+		return nil, errChunks
+	}
+
+	f := make([]byte, 4+size)
+	copy(f, n[:])
+	if _, err := io.ReadFull(c.r, f[4:]); err != nil {
+		return nil, ErrNoHiddenMessage
+	}
+	c.left -= 4 + size
+	c.sums = append(c.sums, c.h.Integrity.Sum(f)...)
+	if c.mac != nil {
+		c.mac.Write(f)
+	}
+	return f, nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// benchPayload is the size of the payloads of the pipeline benchmarks, most
+// of what the 50 MP cover of benchStream holds.
+const benchPayload = 16 << 20
+
+// benchStream encodes a payload of benchPayload bytes into a synthetic 50 MP
+// cover with encode, once to check that it decodes and then b.N times.
+func benchStream(b *testing.B, opt *Options, encode func(cover image.Image, payload []byte, opt *Options) (image.Image, error)) {
+	cover := testCover(8660, 5774, 160)
+	payload := testPayload(benchPayload, 160)
+	stego, err := encode(cover, payload, opt)
+	if err != nil {
+		b.Fatal(err)
+	}
+	got, err := Decode(stego, opt)
+	if err != nil || !bytes.Equal(got, payload) {
+		b.Fatalf("decoded %d bytes, %v", len(got), err)
+	}
+	b.SetBytes(benchPayload)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := encode(cover, payload, opt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func encodeStream(cover image.Image, payload []byte, opt *Options) (image.Image, error) {
+	return EncodeStream(cover, bytes.NewReader(payload), opt)
+}
+
+// BenchmarkEncodeWhole is the baseline of BenchmarkEncodeStream, the payload
+// encrypted and checksummed as a whole before it is embedded.
+func BenchmarkEncodeWhole(b *testing.B) {
+	benchStream(b, nil, Encode)
+}
+
+// BenchmarkEncodeStream checksums chunks of the payload while the ones
+// before them are embedded.
+func BenchmarkEncodeStream(b *testing.B) {
+	benchStream(b, nil, encodeStream)
+}
+
+func BenchmarkEncodeWholeEncrypted(b *testing.B) {
+	benchStream(b, &Options{Passphrase: []byte("pass")}, Encode)
+}
+
+// BenchmarkEncodeStreamEncrypted seals chunks of the payload while the ones
+// before them are embedded.
+func BenchmarkEncodeStreamEncrypted(b *testing.B) {
+	benchStream(b, &Options{Passphrase: []byte("pass")}, encodeStream)
+}
+
+// TestDecodeStream reads chunked payloads back a chunk at a time, and any
+// other payload through Decode.
+func TestDecodeStream(t *testing.T) {
+	cover := testCover(160, 120, 318)
+	payload := testPayload(5000, 318)
+	pass := &Options{Passphrase: []byte("pass")}
+	for _, c := range []struct {
+		name   string
+		encode func(cover image.Image, payload []byte, opt *Options) (image.Image, error)
+		opt    *Options
+	}{
+		{"chunked", encodeStream, nil},
+		{"chunked encrypted", encodeStream, pass},
+		{"whole", Encode, nil},
+		{"whole encrypted", Encode, pass},
+	} {
+		stego, err := c.encode(cover, payload, c.opt)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		r, err := DecodeStream(stego, c.opt)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("%s: read %d bytes that are not the payload, %v", c.name, len(got), err)
+		}
+	}
+
+	stego, err := encodeStream(cover, payload, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeStream(stego, nil); err != ErrPassphraseRequired {
+		t.Errorf("without a passphrase: got %v, want ErrPassphraseRequired", err)
+	}
+	r, err := DecodeStream(stego, &Options{Passphrase: []byte("wrong")})
+	if err == nil {
+		_, err = ioutil.ReadAll(r)
+	}
+	if err != ErrDecryptionFailed {
+		t.Errorf("wrong passphrase: got %v, want ErrDecryptionFailed", err)
+	}
+}
+
+// BenchmarkDecodeStream reads a chunked, encrypted payload back.
+func BenchmarkDecodeStream(b *testing.B) {
+	opt := &Options{Passphrase: []byte("pass")}
+	stego, err := EncodeStream(testCover(8660, 5774, 160), bytes.NewReader(testPayload(benchPayload, 160)), opt)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(benchPayload)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r, err := DecodeStream(stego, opt)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n, err := io.Copy(ioutil.Discard, r); err != nil || n != benchPayload {
+			b.Fatalf("read %d bytes, %v", n, err)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	ErrPassphraseRequired = errors.New("message is encrypted, a passphrase is required")
+	ErrDecryptionFailed   = errors.New("decryption failed, wrong passphrase or damaged message")
+)
+
+// Cipher is an AEAD that encrypts payloads. The ID is stored in front of the
+// encrypted payload, so decoding picks the same cipher the image was encoded
+// with as long as it is registered.
+type Cipher interface {
+	// ID identifies the cipher in the encrypted payload. Zero is reserved.
+	ID() byte
+
+	// Name is how users select the cipher, like "aes-256-gcm".
+	Name() string
+
+	// KeySize is the length of the key in bytes, the key derivation
+	// function produces exactly that much.
+	KeySize() int
+
+	NonceSize() int
+
+	// Overhead is how much longer the ciphertext is than the plaintext.
+	Overhead() int
+
+	Seal(key, nonce, plaintext, additionalData []byte) ([]byte, error)
+	Open(key, nonce, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// The built-in ciphers. AESGCM is the default.
+var (
+	AESGCM           Cipher = &aeadCipher{1, "aes-256-gcm", 32, newAESGCM}
+	ChaCha20Poly1305 Cipher = &aeadCipher{2, "chacha20-poly1305", chacha20poly1305.KeySize, chacha20poly1305.New}
+)
+
+var (
+	cipherMu sync.RWMutex
+	ciphers  = map[byte]Cipher{}
+)
+
+func init() {
+	RegisterCipher(AESGCM)
+	RegisterCipher(ChaCha20Poly1305)
+}
+
+// RegisterCipher makes a cipher available for decoding and to LookupCipher.
+// It panics if the ID is zero or already taken.
+func RegisterCipher(c Cipher) {
+	cipherMu.Lock()
+	defer cipherMu.Unlock()
+
+	if c.ID() == 0 {
+		panic("hidden: cipher ID 0 is reserved")
+	}
+	if prev, ok := ciphers[c.ID()]; ok {
+		panic(fmt.Sprintf("hidden: cipher ID 0x%02x registered twice, by %s and %s", c.ID(), prev.Name(), c.Name()))
+	}
+	ciphers[c.ID()] = c
+}
+
+// LookupCipher returns the registered cipher with the given name, ignoring
+// case and hyphens, so "chacha20poly1305" finds "chacha20-poly1305".
+func LookupCipher(name string) (Cipher, bool) {
+	cipherMu.RLock()
+	defer cipherMu.RUnlock()
+
+	for _, c := range ciphers {
+		if cipherKey(c.Name()) == cipherKey(name) {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+func cipherKey(name string) string {
+	return strings.ToLower(strings.Replace(name, "-", "", -1))
+}
+
+// Ciphers returns the registered ciphers ordered by ID.
+func Ciphers() []Cipher {
+	cipherMu.RLock()
+	defer cipherMu.RUnlock()
+
+	all := make([]Cipher, 0, len(ciphers))
+	for _, c := range ciphers {
+		all = append(all, c)
+	}
+	sort.Slice(all, func(a, b int) bool { return all[a].ID() < all[b].ID() })
+	return all
+}
+
+func cipherByID(id byte) (Cipher, error) {
+	cipherMu.RLock()
+	defer cipherMu.RUnlock()
+
+	if c, ok := ciphers[id]; ok {
+		return c, nil
+	}
+	return nil, UnsupportedCipherError(id)
+}
+
+// UnsupportedCipherError is returned when a message was encrypted with a
+// cipher that is not registered.
+type UnsupportedCipherError byte
+
+func (e UnsupportedCipherError) Error() string {
+	return fmt.Sprintf("unsupported cipher 0x%02x", byte(e))
+}
+
+// An encrypted payload is stored as:
+//
+//	cipher      1 byte, ID of the Cipher
+//	salt        saltSize bytes for scrypt
+//	nonce       Cipher.NonceSize() bytes
+//	ciphertext  Cipher.Overhead() bytes more than the plaintext
+//
+// The cipher ID and salt are authenticated as additional data.
+const saltSize = 16
+
+// The scrypt parameters, as recommended for interactive use.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// sealedLen returns how much c adds to the size of a payload.
+func sealedLen(c Cipher) int {
+	return 1 + saltSize + c.NonceSize() + c.Overhead()
+}
+
+// seal encrypts payload with a key derived from passphrase. Salt and nonce
+// are read from rand.
+func seal(c Cipher, passphrase, payload []byte, rnd io.Reader) ([]byte, error) {
+	if rnd == nil {
+		rnd = rand.Reader
+	}
+
+	buf := make([]byte, 1+saltSize+c.NonceSize())
+	buf[0] = c.ID()
+	if _, err := io.ReadFull(rnd, buf[1:]); err != nil {
+		return nil, err
+	}
+	ad, salt, nonce := buf[:1+saltSize], buf[1:1+saltSize], buf[1+saltSize:]
+
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, c.KeySize())
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+
+	ciphertext, err := c.Seal(key, nonce, payload, ad)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, ciphertext...), nil
+}
+
+// derivedRand returns the salts and nonces of Options.Deterministic: an
+// HMAC-SHA256 of payload, keyed with 32 bytes from random or zeros, expanded
+// in counter mode. Wipe the stream when done with it.
+func derivedRand(random io.Reader, payload []byte) (*hmacStream, error) {
+	key := make([]byte, sha256.Size)
+	defer Wipe(key)
+	if random != nil {
+		if _, err := io.ReadFull(random, key); err != nil {
+			return nil, err
+		}
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return &hmacStream{key: mac.Sum(nil)}, nil
+}
+
+// hmacStream is an endless stream of HMAC-SHA256 blocks of a counter.
+type hmacStream struct {
+	key     []byte
+	counter uint32
+	buf     []byte
+}
+
+func (s *hmacStream) Read(p []byte) (int, error) {
+	for len(s.buf) < len(p) {
+		var c [4]byte
+		binary.BigEndian.PutUint32(c[:], s.counter)
+		s.counter++
+
+		mac := hmac.New(sha256.New, s.key)
+		mac.Write(c[:])
+		s.buf = mac.Sum(s.buf)
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// wipe zeroes the key. The blocks are salts and nonces, which are public.
+func (s *hmacStream) wipe() {
+	Wipe(s.key)
+}
+
+// open decrypts a payload produced by seal.
+func open(passphrase, sealed []byte) ([]byte, error) {
+	if len(sealed) == 0 {
+		return nil, ErrDecryptionFailed
+	}
+	c, err := cipherByID(sealed[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, ErrPassphraseRequired
+	}
+
+	n := 1 + saltSize + c.NonceSize()
+	if len(sealed) < n+c.Overhead() {
+		return nil, ErrDecryptionFailed
+	}
+	ad, salt, nonce := sealed[:1+saltSize], sealed[1:1+saltSize], sealed[1+saltSize:n]
+
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, c.KeySize())
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+
+	payload, err := c.Open(key, nonce, sealed[n:], ad)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return payload, nil
+}
+
+// aeadCipher adapts a cipher.AEAD constructor to Cipher.
+type aeadCipher struct {
+	id      byte
+	name    string
+	keySize int
+	new     func(key []byte) (cipher.AEAD, error)
+}
+
+func (c *aeadCipher) ID() byte       { return c.id }
+func (c *aeadCipher) Name() string   { return c.name }
+func (c *aeadCipher) KeySize() int   { return c.keySize }
+func (c *aeadCipher) NonceSize() int { return c.aead(make([]byte, c.keySize)).NonceSize() }
+func (c *aeadCipher) Overhead() int  { return c.aead(make([]byte, c.keySize)).Overhead() }
+
+func (c *aeadCipher) aead(key []byte) cipher.AEAD {
+	a, err := c.new(key)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func (c *aeadCipher) Seal(key, nonce, plaintext, additionalData []byte) ([]byte, error) {
+	a, err := c.new(key)
+	if err != nil {
+		return nil, err
+	}
+	return a.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+func (c *aeadCipher) Open(key, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	a, err := c.new(key)
+	if err != nil {
+		return nil, err
+	}
+	return a.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,126 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"testing"
+)
+
+// unregisteredCipher is AESGCM under an ID that is not registered.
+type unregisteredCipher struct{ Cipher }
+
+func (unregisteredCipher) ID() byte { return 0xf0 }
+
+// TestCiphers round trips a payload through every built-in cipher, and opens
+// what each sealed under the ID of the other.
+func TestCiphers(t *testing.T) {
+	cover := testCover(160, 120, 138)
+	payload := testPayload(1000, 138)
+	pass := []byte("pass")
+
+	for _, c := range []Cipher{AESGCM, ChaCha20Poly1305} {
+		roundTrip(t, cover, payload, &Options{Passphrase: pass, Cipher: c}, &Options{Passphrase: pass})
+
+		sealed, err := seal(c, pass, payload, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sealed[0] != c.ID() || len(sealed) != len(payload)+sealedLen(c) {
+			t.Errorf("%s: sealed %d bytes under ID 0x%02x, want %d under 0x%02x", c.Name(), len(sealed), sealed[0], len(payload)+sealedLen(c), c.ID())
+		}
+
+		for _, other := range []Cipher{AESGCM, ChaCha20Poly1305} {
+			if other == c {
+				continue
+			}
+			swapped := append([]byte{other.ID()}, sealed[1:]...)
+			if _, err := open(pass, swapped); err != ErrDecryptionFailed {
+				t.Errorf("%s opened as %s: got %v, want %v", c.Name(), other.Name(), err, ErrDecryptionFailed)
+			}
+		}
+		if _, err := open([]byte("wrong"), sealed); err != ErrDecryptionFailed {
+			t.Errorf("%s with the wrong passphrase: got %v, want %v", c.Name(), err, ErrDecryptionFailed)
+		}
+		if _, err := open(nil, sealed); err != ErrPassphraseRequired {
+			t.Errorf("%s without a passphrase: got %v, want %v", c.Name(), err, ErrPassphraseRequired)
+		}
+		if _, err := open(pass, sealed[:len(sealed)-1]); err != ErrDecryptionFailed {
+			t.Errorf("%s truncated: got %v, want %v", c.Name(), err, ErrDecryptionFailed)
+		}
+	}
+}
+
+// TestUnsupportedCipher decodes a payload sealed by a cipher that is not
+// registered.
+func TestUnsupportedCipher(t *testing.T) {
+	pass := []byte("pass")
+	stego, err := Encode(testCover(160, 120, 138), testPayload(1000, 138), &Options{Passphrase: pass, Cipher: unregisteredCipher{AESGCM}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decode(stego, &Options{Passphrase: pass}); err != UnsupportedCipherError(0xf0) {
+		t.Errorf("got %v, want %v", err, UnsupportedCipherError(0xf0))
+	}
+
+	sealed, err := seal(AESGCM, pass, []byte("payload"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed[0] = 0
+	if _, err := open(pass, sealed); err != UnsupportedCipherError(0) {
+		t.Errorf("reserved ID: got %v, want %v", err, UnsupportedCipherError(0))
+	}
+}
+
+func TestLookupCipher(t *testing.T) {
+	for name, want := range map[string]Cipher{
+		"aes-256-gcm":       AESGCM,
+		"AES-256-GCM":       AESGCM,
+		"aes256gcm":         AESGCM,
+		"chacha20-poly1305": ChaCha20Poly1305,
+		"chacha20poly1305":  ChaCha20Poly1305,
+		"ChaCha20-Poly1305": ChaCha20Poly1305,
+		"rot13":             nil,
+		"":                  nil,
+	} {
+		c, ok := LookupCipher(name)
+		if c != want || ok != (want != nil) {
+			t.Errorf("%q: got %v, %v", name, c, ok)
+		}
+	}
+
+	all := Ciphers()
+	if len(all) != 2 || all[0] != AESGCM || all[1] != ChaCha20Poly1305 {
+		t.Errorf("got ciphers %v, want AESGCM and ChaCha20Poly1305", all)
+	}
+}
+
+// TestSealDistinct seals the same payload twice, which must not give the same
+// salt and nonce.
+func TestSealDistinct(t *testing.T) {
+	a, err := seal(ChaCha20Poly1305, []byte("pass"), []byte("payload"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := seal(ChaCha20Poly1305, []byte("pass"), []byte("payload"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a, b) {
+		t.Error("sealed the same bytes twice")
+	}
+}
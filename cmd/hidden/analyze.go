@@ -0,0 +1,298 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+	"path"
+	"strconv"
+)
+
+// The chi-square attack from Westfeld and Pfitzmann, "Attacks on
+// Steganographic Systems" (1999). Replacing LSBs with message bits
+// equalizes the frequencies of each pair of values (2k, 2k+1), so the
+// closer the observed histogram is to having equal pairs, the more
+// likely it is that the samples carry an embedded message.
+//
+// A cover whose histogram is smooth to begin with, like a gradient or
+// noise, has even pairs without any message, and the plain attack calls it
+// stego. So the pairs are also tested shifted by one value, (2k+1, 2k+2),
+// which embedding does not equalize: the probability is that of the pairs
+// being even times that of the shifted pairs not being even. A smooth cover
+// reads as clean then, and so does a message in one, which the attack can
+// not tell from the smoothness. The fixtures in testdata/analyze calibrate
+// the thresholds.
+
+const (
+	// Pairs whose expected frequency is below this are left out of the
+	// statistic, the test is unreliable for sparse categories.
+	chiSquareMinExpected = 5
+
+	// Cumulative probability at which we consider a sample range to
+	// carry embedded data, and above which it likely does. The clean
+	// fixtures score below 0.05, the stego fixtures above 0.9.
+	chiSquareThreshold = 0.5
+	chiSquareLikely    = 0.95
+)
+
+type chiSquarePoint struct {
+	Row         int     `json:"row"`
+	Samples     int     `json:"samples"`
+	Probability float64 `json:"probability"`
+}
+
+type chiSquareReport struct {
+	Probability     float64          `json:"probability"`
+	Samples         int              `json:"samples"`
+	EmbeddedSamples int              `json:"embedded_samples"`
+	EstimatedBytes  int              `json:"estimated_bytes"`
+	Verdict         string           `json:"verdict"`
+	Curve           []chiSquarePoint `json:"curve"`
+
+	// Even is set if the pairs of values of the first rows are even, but
+	// the shifted pairs too, so the histogram is too smooth to tell.
+	Even bool `json:"even_histogram,omitempty"`
+}
+
+func analyzeCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	curve := fs.String("curve", "", "Write the per-row probability curve to file. (.json or .csv)")
+	window := fs.Int("window", 0, "Rows per sliding window for the curve, 0 accumulates from the top.")
+	asJSON := jsonFlag(fs, "Output in JSON format.")
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() != 1 || *window < 0 {
+			commandUsage(fs, "analyze [flags] <image>")
+		}
+
+		m, err := loadImage(fs.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+		img := toRGBA(m)
+		report := chiSquareAnalyze(img, *window)
+		if *curve != "" {
+			if err := writeChiSquareCurve(*curve, &report); err != nil {
+				fatal(err)
+			}
+		}
+		if *asJSON {
+			printJSON(&report)
+			return
+		}
+
+		fmt.Printf("Samples analyzed: %d\n", report.Samples)
+		fmt.Printf("Embedding probability: %.1f%%\n", report.Probability*100)
+		if report.EmbeddedSamples > 0 {
+			fmt.Printf("Estimated embedded length: ~%d bytes (%.1f%% of samples)\n",
+				report.EstimatedBytes, 100*float64(report.EmbeddedSamples)/float64(report.Samples))
+		}
+		fmt.Println("Verdict:", report.Verdict)
+	}
+}
+
+// toRGBA returns img as an *image.RGBA, converting it if needed.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgbaImg, ok := img.(*image.RGBA); ok {
+		return rgbaImg
+	}
+	rgbaImg := image.NewRGBA(img.Bounds())
+	draw.Draw(rgbaImg, rgbaImg.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgbaImg
+}
+
+// chiSquareAnalyze runs the attack over the color samples of img in the same
+// order the encoder writes them. The probability curve has one point per row,
+// computed either from the top of the image or over a sliding window of rows.
+func chiSquareAnalyze(img *image.RGBA, window int) chiSquareReport {
+	var (
+		report     chiSquareReport
+		cumulative [256]int
+		windowed   [256]int
+		rowHist    [][256]int
+
+		b     = img.Bounds()
+		first = -1
+	)
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		var hist [256]int
+		row := img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]
+		for i, v := range row {
+			if (i+1)%4 != 0 {
+				hist[v]++
+			}
+		}
+		report.Samples += len(row) / 4 * 3
+
+		for v, n := range hist {
+			cumulative[v] += n
+		}
+		p := chiSquareProbability(&cumulative)
+
+		// The first one percent of the image decides the overall verdict,
+		// sequential embedding always starts at the top left.
+		if first < 0 && report.Samples*100 >= b.Dx()*b.Dy()*3 {
+			first = report.Samples
+			report.Probability = p
+			report.Even = p < chiSquareThreshold && chiSquarePairs(&cumulative, 0) >= chiSquareThreshold
+		}
+		if report.Probability >= chiSquareThreshold && p >= chiSquareThreshold {
+			report.EmbeddedSamples = report.Samples
+		}
+
+		if window > 0 {
+			rowHist = append(rowHist, hist)
+			for v, n := range hist {
+				windowed[v] += n
+			}
+			if len(rowHist) > window {
+				for v, n := range rowHist[0] {
+					windowed[v] -= n
+				}
+				rowHist = rowHist[1:]
+			}
+			p = chiSquareProbability(&windowed)
+		}
+		report.Curve = append(report.Curve, chiSquarePoint{y - b.Min.Y, report.Samples, p})
+	}
+
+	report.EstimatedBytes = report.EmbeddedSamples / 8
+	switch {
+	case report.Probability >= chiSquareLikely:
+		report.Verdict = "likely contains sequential LSB embedding"
+	case report.Probability >= chiSquareThreshold:
+		report.Verdict = "possibly contains sequential LSB embedding"
+	case report.Even:
+		report.Verdict = "inconclusive, the histogram is too smooth for the chi-square attack"
+	default:
+		report.Verdict = "no evidence of sequential LSB embedding"
+	}
+	return report
+}
+
+// chiSquareProbability returns the probability that the value pairs of hist
+// are equalized, i.e. that the samples carry embedded data: that the pairs
+// are even, but not the pairs shifted by one value, which would be the
+// smoothness of the histogram instead.
+func chiSquareProbability(hist *[256]int) float64 {
+	return chiSquarePairs(hist, 0) * (1 - chiSquarePairs(hist, 1))
+}
+
+// chiSquarePairs returns the probability that the frequencies of the pairs
+// of values of hist from first on, (first+2k, first+2k+1), are equal.
+func chiSquarePairs(hist *[256]int, first int) float64 {
+	var (
+		chi2 float64
+		df   = -1
+	)
+
+	for i := first; i+1 < len(hist); i += 2 {
+		expected := float64(hist[i]+hist[i+1]) / 2
+		if expected < chiSquareMinExpected {
+			continue
+		}
+		d := float64(hist[i]) - expected
+		chi2 += d * d / expected
+		df++
+	}
+
+	if df < 1 {
+		return 0
+	}
+	return gammaQ(float64(df)/2, chi2/2)
+}
+
+// gammaQ is the regularized upper incomplete gamma function Q(a, x), which
+// gives the chi-square survival function as Q(df/2, chi2/2). The evaluation
+// follows Numerical Recipes: a series expansion below a+1 and a continued
+// fraction above it.
+func gammaQ(a, x float64) float64 {
+	const (
+		maxIterations = 1000
+		epsilon       = 3e-14
+		tiny          = 1e-300
+	)
+
+	if x <= 0 {
+		return 1
+	}
+
+	lg, _ := math.Lgamma(a)
+	if x < a+1 {
+		sum, del := 1/a, 1/a
+		for n := 1; n < maxIterations; n++ {
+			del *= x / (a + float64(n))
+			sum += del
+			if math.Abs(del) < math.Abs(sum)*epsilon {
+				break
+			}
+		}
+		return 1 - sum*math.Exp(-x+a*math.Log(x)-lg)
+	}
+
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for n := 1; n < maxIterations; n++ {
+		an := -float64(n) * (float64(n) - a)
+		b += 2
+		if d = an*d + b; math.Abs(d) < tiny {
+			d = tiny
+		}
+		if c = b + an/c; math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		del := d * c
+		h *= del
+		if math.Abs(del-1) < epsilon {
+			break
+		}
+	}
+	return math.Exp(-x+a*math.Log(x)-lg) * h
+}
+
+func writeChiSquareCurve(file string, report *chiSquareReport) error {
+	return writeAtomic(file, 0666, func(fp io.Writer) error {
+		if path.Ext(file) == ".json" {
+			enc := json.NewEncoder(fp)
+			enc.SetIndent("", "\t")
+			return enc.Encode(report)
+		}
+
+		w := csv.NewWriter(fp)
+		w.Write([]string{"row", "samples", "probability"})
+		for _, pt := range report.Curve {
+			w.Write([]string{
+				strconv.Itoa(pt.Row),
+				strconv.Itoa(pt.Samples),
+				strconv.FormatFloat(pt.Probability, 'f', 6, 64),
+			})
+		}
+		w.Flush()
+		return w.Error()
+	})
+}
@@ -0,0 +1,114 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fixtures in testdata/analyze are 320x240. The gradient, clouds and
+// noise covers are the -generate covers of seed 3, levels is a smooth scene
+// with noise whose levels were stretched by 1.35, which leaves every third
+// value empty like an edited photo. The stego images hold random bytes,
+// written by Encode from the top, filling all or 30% of the capacity.
+var analyzeFixtures = []struct {
+	file    string
+	payload int  // bytes of the payload, 0 for a clean cover
+	even    bool // the histogram is too smooth to tell
+}{
+	{"clean-gradient.png", 0, true},
+	{"clean-clouds.png", 0, false},
+	{"clean-noise.png", 0, true},
+	{"clean-levels.png", 0, false},
+	{"stego-clouds-30.png", 8631, false},
+	{"stego-levels.png", 28773, false},
+	{"stego-levels-30.png", 8631, false},
+
+	// A message in a smooth cover is out of reach of the attack.
+	{"stego-gradient.png", 28773, true},
+}
+
+func loadFixture(t *testing.T, file string) image.Image {
+	t.Helper()
+	fp, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	img, err := png.Decode(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestChiSquareFixtures(t *testing.T) {
+	for _, f := range analyzeFixtures {
+		t.Run(f.file, func(t *testing.T) {
+			img := loadFixture(t, filepath.Join("testdata", "analyze", f.file))
+			r := chiSquareAnalyze(toRGBA(img), 0)
+			if r.Even != f.even {
+				t.Errorf("even histogram %v, want %v", r.Even, f.even)
+			}
+
+			switch {
+			case f.payload == 0 || f.even:
+				if r.Probability >= chiSquareThreshold {
+					t.Errorf("probability %.4f, want below %v: %s", r.Probability, chiSquareThreshold, r.Verdict)
+				}
+				if f.payload == 0 && r.EmbeddedSamples != 0 {
+					t.Errorf("estimated %d embedded bytes in a clean cover", r.EstimatedBytes)
+				}
+			default:
+				if r.Probability < chiSquareLikely {
+					t.Errorf("probability %.4f, want at least %v: %s", r.Probability, chiSquareLikely, r.Verdict)
+				}
+				if d := r.EstimatedBytes - f.payload; d < -f.payload/4 || d > f.payload/4 {
+					t.Errorf("estimated %d embedded bytes, want about %d", r.EstimatedBytes, f.payload)
+				}
+			}
+		})
+	}
+}
+
+func TestChiSquarePairs(t *testing.T) {
+	var flat, pairs, uneven [256]int
+	for v := range flat {
+		flat[v] = 1000
+		pairs[v] = 1000 + 100*(v/2%2)
+		uneven[v] = 1000 + 100*(v%2)
+	}
+	for _, c := range []struct {
+		name string
+		hist *[256]int
+		want bool
+	}{
+		// A flat histogram has even pairs, shifted or not, as any smooth
+		// one does.
+		{"flat", &flat, false},
+		{"even pairs", &pairs, true},
+		{"uneven pairs", &uneven, false},
+	} {
+		if p := chiSquareProbability(c.hist); (p >= chiSquareThreshold) != c.want {
+			t.Errorf("%s: probability %.4f", c.name, p)
+		}
+	}
+}
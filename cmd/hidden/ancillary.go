@@ -0,0 +1,368 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// pngSignature starts every PNG file.
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// pngAncillary lists the ancillary PNG chunks carried over from the cover.
+// None of them depends on the pixel data or the color type, which encoding
+// may change.
+var pngAncillary = map[string]bool{
+	"iCCP": true, "sRGB": true, "gAMA": true, "cHRM": true, "pHYs": true,
+	"tEXt": true, "zTXt": true, "iTXt": true, "tIME": true, "eXIf": true,
+}
+
+// maxProfileSize is the largest ICC profile read from a PNG, it is zlib
+// compressed there.
+const maxProfileSize = 16 << 20
+
+// Sizes of the BMP file header and the info header versions.
+const (
+	bmpFileHeaderLen = 14
+	bmpInfoHeaderLen = 40
+	bmpV4HeaderLen   = 108
+	bmpV5HeaderLen   = 124
+)
+
+// Color space types of a BMP v5 header that point to profile data.
+const (
+	bmpProfileEmbedded = 0x4d424544 // 'MBED'
+	bmpProfileLinked   = 0x4c494e4b // 'LINK'
+	bmpIntentImages    = 4          // LCS_GM_IMAGES
+)
+
+// ancillary is what a cover file holds besides its pixels that the image
+// encoders drop: the ICC profile, the resolution, the ancillary PNG chunks,
+// the fields of a BMP v4 or v5 header and the fourth bytes of a 32 bit BMP.
+// Keeping it keeps the colors in color-managed viewers, and does not give
+// the encoded image away by its missing profile.
+type ancillary struct {
+	// profile is the embedded ICC profile, if any.
+	profile []byte
+
+	// chunks are the ancillary chunks of a PNG cover, whole and in order.
+	chunks [][]byte
+
+	// bmpHeader is the v4 or v5 info header of a BMP cover, bmpProfile the
+	// profile data it points to.
+	bmpHeader, bmpProfile []byte
+
+	// bmpBits is the bits per pixel of a BMP cover.
+	bmpBits int
+
+	// bmpAlpha holds the fourth byte of the pixels of every row, top to
+	// bottom, of a 32 bit BMP cover with a BITMAPINFOHEADER, unless they are
+	// all 0xff. Decoders read such pixels as opaque, so the image does not
+	// have them.
+	bmpAlpha [][]byte
+
+	// resolution is the horizontal and vertical pixels per metre of the
+	// cover, zero if it does not say.
+	resolution [2]uint32
+}
+
+// readAncillary returns what the image file in data holds besides its
+// pixels, nil if nothing.
+func readAncillary(data []byte) *ancillary {
+	switch {
+	case bytes.HasPrefix(data, []byte(pngSignature)):
+		return readPNGAncillary(data[len(pngSignature):])
+	case bytes.HasPrefix(data, []byte("BM")):
+		return readBMPAncillary(data)
+	}
+	return nil
+}
+
+func readPNGAncillary(p []byte) *ancillary {
+	a := &ancillary{}
+	for len(p) >= 12 {
+		n := uint64(binary.BigEndian.Uint32(p))
+		if n+12 > uint64(len(p)) {
+			break
+		}
+		chunk, typ := p[:n+12], string(p[4:8])
+		if typ == "IEND" {
+			break
+		}
+
+		if pngAncillary[typ] {
+			a.chunks = append(a.chunks, chunk)
+			switch typ {
+			case "iCCP":
+				a.profile = iccpProfile(chunk[8 : 8+n])
+			case "pHYs":
+				// Only a unit of 1, the metre, makes it a resolution.
+				if n == 9 && chunk[16] == 1 {
+					a.resolution = [2]uint32{binary.BigEndian.Uint32(chunk[8:]), binary.BigEndian.Uint32(chunk[12:])}
+				}
+			}
+		}
+		p = p[n+12:]
+	}
+
+	if len(a.chunks) == 0 {
+		return nil
+	}
+	return a
+}
+
+// iccpProfile returns the profile in the data of an iCCP chunk: a name, a
+// compression method and the zlib compressed profile.
+func iccpProfile(data []byte) []byte {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || i+2 > len(data) || data[i+1] != 0 {
+		return nil
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(data[i+2:]))
+	if err != nil {
+		return nil
+	}
+	profile, err := ioutil.ReadAll(io.LimitReader(zr, maxProfileSize+1))
+	if err != nil || len(profile) > maxProfileSize {
+		return nil
+	}
+	return profile
+}
+
+func readBMPAncillary(data []byte) *ancillary {
+	if len(data) < bmpFileHeaderLen+bmpInfoHeaderLen {
+		return nil
+	}
+	info := data[bmpFileHeaderLen:]
+	a := &ancillary{bmpBits: int(binary.LittleEndian.Uint16(info[14:]))}
+	a.resolution = [2]uint32{binary.LittleEndian.Uint32(info[24:]), binary.LittleEndian.Uint32(info[28:])}
+	a.bmpAlpha = fourthBytes(bmp32Rows(data))
+	size := binary.LittleEndian.Uint32(info)
+	if size != bmpV4HeaderLen && size != bmpV5HeaderLen || uint32(len(info)) < size {
+		return a
+	}
+
+	a.bmpHeader = info[:size]
+	if size == bmpV5HeaderLen {
+		cs := binary.LittleEndian.Uint32(info[56:])
+		offset, n := uint64(binary.LittleEndian.Uint32(info[112:])), uint64(binary.LittleEndian.Uint32(info[116:]))
+		if (cs == bmpProfileEmbedded || cs == bmpProfileLinked) && offset+n <= uint64(len(info)) {
+			a.bmpProfile = info[offset : offset+n]
+			if cs == bmpProfileEmbedded {
+				a.profile = a.bmpProfile
+			}
+		}
+	}
+	return a
+}
+
+// apply returns encoded, an image file in format, with a carried over into
+// it. A PNG gets the ancillary chunks of a PNG cover, a BMP the header of a
+// BMP cover, and either the ICC profile and resolution of the other.
+func (a *ancillary) apply(format string, encoded []byte) []byte {
+	if a == nil {
+		return encoded
+	}
+	switch format {
+	case "png":
+		return a.png(encoded)
+	case "bmp":
+		return a.bmp(a.keepBMPAlpha(encoded))
+	}
+	return encoded
+}
+
+// bmp32Rows returns the rows of pixels, top to bottom, of the uncompressed
+// 32 bit BMP in data if it has a BITMAPINFOHEADER, nil for any other.
+func bmp32Rows(data []byte) [][]byte {
+	const end = bmpFileHeaderLen + bmpInfoHeaderLen
+	if len(data) < end {
+		return nil
+	}
+	info := data[bmpFileHeaderLen:]
+	if binary.LittleEndian.Uint32(info) != bmpInfoHeaderLen || binary.LittleEndian.Uint16(info[14:]) != 32 || binary.LittleEndian.Uint32(info[16:]) != 0 {
+		return nil
+	}
+	offset := int64(binary.LittleEndian.Uint32(data[10:]))
+	width, height := int64(int32(binary.LittleEndian.Uint32(info[4:]))), int64(int32(binary.LittleEndian.Uint32(info[8:])))
+	topDown := height < 0
+	if topDown {
+		height = -height
+	}
+	if width <= 0 || offset < end || offset+width*height*4 > int64(len(data)) {
+		return nil
+	}
+
+	rows := make([][]byte, height)
+	for y := range rows {
+		i := int64(y)
+		if !topDown {
+			i = height - 1 - i
+		}
+		rows[y] = data[offset+i*width*4:][:width*4]
+	}
+	return rows
+}
+
+// fourthBytes returns the fourth byte of every pixel of rows, nil if they
+// are all 0xff.
+func fourthBytes(rows [][]byte) [][]byte {
+	var out [][]byte
+	opaque := true
+	for _, row := range rows {
+		b := make([]byte, len(row)/4)
+		for x := range b {
+			b[x] = row[4*x+3]
+			opaque = opaque && b[x] == 0xff
+		}
+		out = append(out, b)
+	}
+	if opaque {
+		return nil
+	}
+	return out
+}
+
+// keepBMPAlpha returns encoded with the fourth bytes of a 32 bit BMP cover
+// put back, if it is a 32 bit BMP of the same size.
+func (a *ancillary) keepBMPAlpha(encoded []byte) []byte {
+	if a.bmpAlpha == nil {
+		return encoded
+	}
+	out := append([]byte{}, encoded...)
+	rows := bmp32Rows(out)
+	if len(rows) != len(a.bmpAlpha) || len(rows[0]) != 4*len(a.bmpAlpha[0]) {
+		return encoded
+	}
+	for y, row := range rows {
+		for x, b := range a.bmpAlpha[y] {
+			row[4*x+3] = b
+		}
+	}
+	return out
+}
+
+// png inserts the chunks after the IHDR chunk, which image/png writes first.
+func (a *ancillary) png(encoded []byte) []byte {
+	const ihdrEnd = len(pngSignature) + 12 + 13
+	if len(encoded) < ihdrEnd || string(encoded[12:16]) != "IHDR" {
+		return encoded
+	}
+
+	chunks := a.chunks
+	if chunks == nil && a.profile != nil {
+		var data bytes.Buffer
+		data.WriteString("ICC profile\x00\x00")
+		zw := zlib.NewWriter(&data)
+		zw.Write(a.profile)
+		zw.Close()
+		chunks = [][]byte{pngChunk("iCCP", data.Bytes())}
+	}
+	if a.chunks == nil && a.resolution != [2]uint32{} {
+		phys := make([]byte, 9)
+		binary.BigEndian.PutUint32(phys, a.resolution[0])
+		binary.BigEndian.PutUint32(phys[4:], a.resolution[1])
+		phys[8] = 1
+		chunks = append(chunks, pngChunk("pHYs", phys))
+	}
+	if chunks == nil {
+		return encoded
+	}
+
+	out := append([]byte{}, encoded[:ihdrEnd]...)
+	for _, c := range chunks {
+		out = append(out, c...)
+	}
+	return append(out, encoded[ihdrEnd:]...)
+}
+
+// pngChunk returns a whole chunk of type typ holding data.
+func pngChunk(typ string, data []byte) []byte {
+	c := make([]byte, 8, len(data)+12)
+	binary.BigEndian.PutUint32(c, uint32(len(data)))
+	copy(c[4:], typ)
+	c = append(c, data...)
+	return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+}
+
+// bmp replaces the BITMAPINFOHEADER that x/image/bmp writes with the header
+// of the cover, or a v5 header pointing to the profile, which follows the
+// pixels. Either way, and in the BITMAPINFOHEADER otherwise, the resolution
+// is the cover's.
+func (a *ancillary) bmp(encoded []byte) []byte {
+	const end = bmpFileHeaderLen + bmpInfoHeaderLen
+	if len(encoded) < end || binary.LittleEndian.Uint32(encoded[bmpFileHeaderLen:]) != bmpInfoHeaderLen {
+		return encoded
+	}
+	info := encoded[bmpFileHeaderLen:end]
+
+	var header []byte
+	switch {
+	case a.bmpHeader != nil:
+		header = append([]byte{}, a.bmpHeader...)
+		// The resolution is the cover's, the rest describes the new pixels.
+		copy(header[4:24], info[4:24])
+		copy(header[32:40], info[32:40])
+	case a.profile != nil:
+		header = make([]byte, bmpV5HeaderLen)
+		copy(header, info)
+		binary.LittleEndian.PutUint32(header, bmpV5HeaderLen)
+		binary.LittleEndian.PutUint32(header[56:], bmpProfileEmbedded)
+		binary.LittleEndian.PutUint32(header[108:], bmpIntentImages)
+		a.putBMPResolution(header)
+	case a.resolution != [2]uint32{}:
+		out := append([]byte{}, encoded...)
+		a.putBMPResolution(out[bmpFileHeaderLen:])
+		return out
+	default:
+		return encoded
+	}
+
+	// The palette, if any, and the pixels.
+	rest := encoded[end:]
+	profile := a.bmpProfile
+	if a.bmpHeader == nil {
+		profile = a.profile
+	}
+	if len(header) == bmpV5HeaderLen && profile != nil {
+		binary.LittleEndian.PutUint32(header[112:], uint32(len(header)+len(rest)))
+		binary.LittleEndian.PutUint32(header[116:], uint32(len(profile)))
+	} else {
+		profile = nil
+	}
+
+	out := append([]byte{}, encoded[:bmpFileHeaderLen]...)
+	out = append(out, header...)
+	out = append(out, rest...)
+	out = append(out, profile...)
+
+	pixOffset := binary.LittleEndian.Uint32(encoded[10:]) - end + uint32(bmpFileHeaderLen+len(header))
+	binary.LittleEndian.PutUint32(out[2:], uint32(len(out)))
+	binary.LittleEndian.PutUint32(out[10:], pixOffset)
+	return out
+}
+
+// putBMPResolution stores the resolution in the info header of a BMP.
+func (a *ancillary) putBMPResolution(info []byte) {
+	binary.LittleEndian.PutUint32(info[24:], a.resolution[0])
+	binary.LittleEndian.PutUint32(info[28:], a.resolution[1])
+}
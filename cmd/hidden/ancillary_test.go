@@ -0,0 +1,122 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/bmp"
+)
+
+// TestAncillary encodes covers with an ICC profile and other ancillary data
+// into PNG and BMP files, which keep the profile and the resolution, and PNG
+// files from a PNG cover every chunk byte for byte.
+func TestAncillary(t *testing.T) {
+	dir := t.TempDir()
+	img := testCover(120, 80, 146)
+	profile := testMessage(3000, 146)
+
+	phys := make([]byte, 9)
+	binary.BigEndian.PutUint32(phys, 2835)
+	binary.BigEndian.PutUint32(phys[4:], 3780)
+	phys[8] = 1
+
+	var pngData, bmpData bytes.Buffer
+	if err := png.Encode(&pngData, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := bmp.Encode(&bmpData, img); err != nil {
+		t.Fatal(err)
+	}
+
+	// The iCCP chunk the PNG cover gets.
+	iccp := (&ancillary{profile: profile}).png(pngData.Bytes())
+	chunks := readPNGAncillary(iccp[len(pngSignature):]).chunks
+	chunks = append(chunks, pngChunk("pHYs", phys), pngChunk("tEXt", []byte("Comment\x00cover")))
+
+	covers := map[string][]byte{
+		"cover.png": (&ancillary{chunks: chunks}).png(pngData.Bytes()),
+		"cover.bmp": (&ancillary{profile: profile, resolution: [2]uint32{2835, 3780}}).bmp(bmpData.Bytes()),
+	}
+	for name, data := range covers {
+		a := readAncillary(data)
+		if a == nil || !bytes.Equal(a.profile, profile) || a.resolution != [2]uint32{2835, 3780} {
+			t.Fatalf("%s: the cover does not hold the profile and resolution", name)
+		}
+	}
+	msg := writeTestFile(t, dir, "msg.bin", testMessage(500, 146))
+
+	for cname, data := range covers {
+		cover := writeTestFile(t, dir, cname, data)
+		for _, ext := range []string{".png", ".bmp"} {
+			name := cname + ext
+			out := filepath.Join(dir, name)
+			if err := encode(cover, out, msg, encodeOptions{}); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if got := decodeTestImage(t, out, nil); !bytes.Equal(got, testMessage(500, 146)) {
+				t.Errorf("%s: decoded %d bytes that are not the message", name, len(got))
+			}
+
+			encoded, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := readAncillary(encoded)
+			switch {
+			case a == nil:
+				t.Errorf("%s: kept nothing of the cover", name)
+			case !bytes.Equal(a.profile, profile):
+				t.Errorf("%s: the profile is %d bytes that differ from the %d of the cover", name, len(a.profile), len(profile))
+			case a.resolution != [2]uint32{2835, 3780}:
+				t.Errorf("%s: the resolution is %v", name, a.resolution)
+			case cname == "cover.png" && ext == ".png" && !equalChunks(a.chunks, chunks):
+				t.Errorf("%s: the chunks differ from those of the cover", name)
+			}
+		}
+	}
+}
+
+func equalChunks(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// TestAncillaryNone encodes a cover without ancillary data, which adds none.
+func TestAncillaryNone(t *testing.T) {
+	var data bytes.Buffer
+	if err := png.Encode(&data, testCover(16, 16, 146)); err != nil {
+		t.Fatal(err)
+	}
+	if a := readAncillary(data.Bytes()); a != nil {
+		t.Errorf("a plain PNG holds %+v", a)
+	}
+	if out := (*ancillary)(nil).apply("png", data.Bytes()); !bytes.Equal(out, data.Bytes()) {
+		t.Error("nothing to carry over changed the file")
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+)
+
+// armorWidth is the line length of armored messages, the same as MIME uses.
+const armorWidth = 76
+
+// armor returns msg as standard base64, wrapped at armorWidth columns and
+// ending with a newline.
+func armor(msg []byte) []byte {
+	enc := make([]byte, base64.StdEncoding.EncodedLen(len(msg)))
+	base64.StdEncoding.Encode(enc, msg)
+
+	var buf bytes.Buffer
+	for len(enc) > armorWidth {
+		buf.Write(enc[:armorWidth])
+		buf.WriteByte('\n')
+		enc = enc[armorWidth:]
+	}
+	buf.Write(enc)
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// unarmor decodes standard base64, ignoring any whitespace.
+func unarmor(text []byte) ([]byte, error) {
+	enc := bytes.Join(bytes.Fields(text), nil)
+	msg := make([]byte, base64.StdEncoding.DecodedLen(len(enc)))
+	n, err := base64.StdEncoding.Decode(msg, enc)
+	if err != nil {
+		return nil, fmt.Errorf("message is not valid base64: %v", err)
+	}
+	return msg[:n], nil
+}
@@ -0,0 +1,180 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// force allows the encoded image or decoded message to replace an existing
+// file, see checkClobber.
+var force bool
+
+// checkClobber returns an error if file, or the archive of a zip entry,
+// exists and -force was not given.
+func checkClobber(file string) error {
+	if force || file == clipboardName {
+		return nil
+	}
+	if archive, _, ok := splitZipPath(file); ok {
+		file = archive
+	}
+	if _, err := os.Stat(file); err == nil {
+		return fmt.Errorf("%s exists, use -force to overwrite it", file)
+	}
+	return nil
+}
+
+// writeAtomic creates file with perm, or replaces it keeping its mode, with
+// what write writes. It writes to a temporary file in the same directory,
+// which is synced and renamed over file only if everything succeeded, so
+// file is either left as it was or complete. The temporary file is removed
+// on any error, and on Ctrl-C or SIGTERM.
+func writeAtomic(file string, perm os.FileMode, write func(w io.Writer) error) error {
+	if st, err := os.Stat(file); err == nil {
+		return writeTemp(file, st.Mode().Perm(), true, write)
+	}
+	return writeTemp(file, perm, false, write)
+}
+
+// writeAtomicMode is writeAtomic giving file exactly perm, whatever the
+// umask and the mode of a file it replaces.
+func writeAtomicMode(file string, perm os.FileMode, write func(w io.Writer) error) error {
+	return writeTemp(file, perm, true, write)
+}
+
+// writeTemp writes file through a temporary file created with perm, see
+// writeAtomic. With chmod the temporary file gets perm despite the umask
+// before it is renamed, so file never has any other mode.
+func writeTemp(file string, perm os.FileMode, chmod bool, write func(w io.Writer) error) error {
+	fp, err := createTemp(file, perm)
+	if err != nil {
+		return err
+	}
+	name := fp.Name()
+	defer untrackTemp(name)
+
+	err = write(fp)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && chmod {
+		err = os.Chmod(name, perm)
+	}
+	if err == nil {
+		err = os.Rename(name, file)
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+// writeFileAtomic is ioutil.WriteFile through writeAtomic.
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	return writeAtomic(file, perm, writeData(data))
+}
+
+// writeFileMode is ioutil.WriteFile through writeAtomicMode.
+func writeFileMode(file string, data []byte, perm os.FileMode) error {
+	return writeAtomicMode(file, perm, writeData(data))
+}
+
+func writeData(data []byte) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}
+}
+
+// createTemp creates a new, hidden, file next to file to write it through.
+// It is created with perm, so the umask applies.
+func createTemp(file string, perm os.FileMode) (*os.File, error) {
+	dir, base := filepath.Split(file)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(os.Getpid())))
+	for i := 0; ; i++ {
+		name := filepath.Join(dir, fmt.Sprintf(".%s.%08x.tmp", base, rnd.Uint32()))
+		trackTemp(name)
+		fp, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if err == nil {
+			return fp, nil
+		}
+		untrackTemp(name)
+		if !os.IsExist(err) || i == 100 {
+			return nil, err
+		}
+	}
+}
+
+var (
+	tempMu    sync.Mutex
+	tempFiles = make(map[string]bool)
+	tempOnce  sync.Once
+
+	// interruptHandlers counts the interruptContexts in use. While there
+	// are any, they decide what Ctrl-C and SIGTERM do.
+	interruptHandlers int32
+)
+
+// trackTemp registers a temporary file to be removed if the process is
+// interrupted before it is renamed into place.
+func trackTemp(name string) {
+	tempOnce.Do(func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		go removeTempsOnSignal(c)
+	})
+
+	tempMu.Lock()
+	tempFiles[name] = true
+	tempMu.Unlock()
+}
+
+func untrackTemp(name string) {
+	tempMu.Lock()
+	delete(tempFiles, name)
+	tempMu.Unlock()
+}
+
+// removeTempsOnSignal removes the temporary files, wipes the secrets and
+// exits on the signals from c, as the process would have without a handler, unless an
+// interruptContext handles them.
+func removeTempsOnSignal(c <-chan os.Signal) {
+	for range c {
+		if atomic.LoadInt32(&interruptHandlers) > 0 {
+			continue
+		}
+
+		tempMu.Lock()
+		for name := range tempFiles {
+			os.Remove(name)
+		}
+		wipeSecrets()
+		os.Exit(exitFailure)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// checkDir fails t unless dir holds nothing but file with want, and no
+// temporary files.
+func checkDir(t *testing.T, dir, file string, want []byte) {
+	t.Helper()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != filepath.Base(file) {
+			t.Errorf("%s was left behind", e.Name())
+		}
+	}
+	got, err := ioutil.ReadFile(file)
+	if want == nil {
+		if !os.IsNotExist(err) {
+			t.Errorf("%s exists", file)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("%s holds %q, want %q", file, got, want)
+	}
+}
+
+// TestWriteAtomicFailedWrite simulates writes that fail half way, which
+// have to leave the file as it was.
+func TestWriteAtomicFailedWrite(t *testing.T) {
+	for _, errWrite := range []error{errors.New("disk full"), io.ErrShortWrite} {
+		partial := func(w io.Writer) error {
+			w.Write([]byte("partial"))
+			return errWrite
+		}
+		for name, write := range map[string]func(string, os.FileMode, func(io.Writer) error) error{
+			"writeAtomic":     writeAtomic,
+			"writeAtomicMode": writeAtomicMode,
+		} {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "encoded.bmp")
+			if err := write(file, 0644, partial); err != errWrite {
+				t.Fatalf("%s: got %v, want %v", name, err, errWrite)
+			}
+			checkDir(t, dir, file, nil)
+
+			if err := ioutil.WriteFile(file, []byte("original"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := write(file, 0644, partial); err != errWrite {
+				t.Fatalf("%s: got %v, want %v", name, err, errWrite)
+			}
+			checkDir(t, dir, file, []byte("original"))
+		}
+	}
+}
+
+// TestWriteAtomicFailedRename writes over a directory, which the temporary
+// file can not be renamed over, and has to leave nothing behind.
+func TestWriteAtomicFailedRename(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "message.txt")
+	if err := os.Mkdir(file, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, file, "inside", []byte("inside"))
+
+	if err := writeFileAtomic(file, []byte("message"), 0600); err == nil {
+		t.Error("writeFileAtomic replaced a directory")
+	}
+	if err := writeMessage(file, []byte("message")); err == nil {
+		t.Error("writeMessage replaced a directory")
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !entries[0].IsDir() {
+		t.Errorf("%d files were left behind", len(entries)-1)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(file, "inside")); err != nil || string(data) != "inside" {
+		t.Errorf("the directory changed: %q, %v", data, err)
+	}
+}
+
+// TestWriteFileMode gives new and replaced files exactly the mode asked for,
+// where writeFileAtomic keeps the mode of the file it replaces.
+func TestWriteFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no permission bits")
+	}
+	dir := t.TempDir()
+	for _, c := range []struct {
+		existing os.FileMode
+		perm     os.FileMode
+		mode     os.FileMode
+		keep     os.FileMode
+	}{
+		{0, 0600, 0600, 0600},
+		{0, 0666, 0666, 0},
+		{0644, 0600, 0600, 0644},
+		{0600, 0640, 0640, 0600},
+		{0604, 0600, 0600, 0604},
+	} {
+		for _, exact := range []bool{true, false} {
+			file := filepath.Join(dir, "message.txt")
+			os.Remove(file)
+			if c.existing != 0 {
+				if err := ioutil.WriteFile(file, []byte("original"), c.existing); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chmod(file, c.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			write, want := writeFileAtomic, c.keep
+			if exact {
+				write, want = writeFileMode, c.mode
+			}
+			if err := write(file, []byte("message"), c.perm); err != nil {
+				t.Fatal(err)
+			}
+			checkDir(t, dir, file, []byte("message"))
+			st, err := os.Stat(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The umask applies to a new file writeFileAtomic creates.
+			if want != 0 && st.Mode().Perm() != want {
+				t.Errorf("%04o over %04o, exact %v: got mode %04o, want %04o", c.perm, c.existing, exact, st.Mode().Perm(), want)
+			}
+		}
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "message.txt")
+	if err := ioutil.WriteFile(file, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(file, []byte("replaced"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	checkDir(t, dir, file, []byte("replaced"))
+}
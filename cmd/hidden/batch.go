@@ -0,0 +1,524 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+const (
+	batchSucceeded = "succeeded"
+	batchFailed    = "failed"
+	batchSkipped   = "skipped"
+)
+
+type batchFile struct {
+	Input  string `json:"input"`
+	Output string `json:"output,omitempty"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// batchName is available to -name for every output.
+type batchName struct {
+	Dir     string
+	Name    string
+	Ext     string
+	Index   int
+	Message string
+}
+
+const defaultBatchName = "{{.Dir}}/{{.Name}}{{.Ext}}"
+
+type batchReport struct {
+	Succeeded int         `json:"succeeded"`
+	Failed    int         `json:"failed"`
+	Skipped   int         `json:"skipped"`
+	Files     []batchFile `json:"files"`
+}
+
+func batchEncodeCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("batch-encode", flag.ExitOnError)
+	fmsg := fs.String("msg", "", "Message or data to encode in every image, or clipboard: to use the system clipboard.")
+	msgDir := fs.String("msg-dir", "", "Directory of messages, or a file listing one per line, to encode one into each image instead of -msg. They are paired with the images in lexical order.")
+	outDir := fs.String("out-dir", "", "Directory to write encoded images to.")
+	name := fs.String("name", defaultBatchName, "Template for the path of every encoded image below -out-dir, with {{.Dir}}, {{.Name}} and {{.Ext}} of the image, {{.Index}} and the {{.Message}} name without extension from -msg-dir. The images in a zip archive keep their names in its copy.")
+	verify := verifyFlags(fs, "every encoded image")
+	overwrite := fs.Bool("overwrite-message", false, "Encode even if an image already contains a message.")
+	checksum := checksumFlag(fs)
+	encryption := defineEncryptionFlags(fs)
+	jobs := fs.Int("jobs", runtime.NumCPU(), "Number of images to encode concurrently.")
+	showBatch := fs.Bool("progress", false, "Report how many of the pixels of the images are done on stderr, as a bar on a terminal and as a line for every 10 percent otherwise.")
+	manifestFile := fs.String("manifest", "", "Write a manifest of what was embedded where to this file, as CSV if it is named .csv and as JSON otherwise: for every image the output, the SHA-256 of the message, how much of the capacity it used, the depth, the PSNR against the cover and the warnings.")
+	asJSON := jsonFlag(fs, "Output in JSON format.")
+	verbose := verbosityFlags(fs, "")
+	strictFlag(fs)
+	bmpDepthFlag(fs)
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+		verbose.apply()
+
+		if (*fmsg == "") == (*msgDir == "") || *outDir == "" || fs.NArg() == 0 {
+			commandUsage(fs, "batch-encode (-msg <file> | -msg-dir <dir|list>) -out-dir <dir> [flags] <dir|glob|zip>...")
+		}
+		tmpl, err := template.New("name").Parse(*name)
+		if err != nil {
+			fatal(usagef("-name: %v", err))
+		}
+
+		var (
+			msg  []byte
+			msgs []string
+		)
+		if *fmsg != "" {
+			if msg, err = readMessage(*fmsg, fetchMaxSize); err != nil {
+				fatal(err)
+			}
+		} else if msgs, err = batchMessages(*msgDir); err != nil {
+			fatal(err)
+		}
+
+		opt := encodeOptions{verify: verify(), overwrite: *overwrite, integrity: checksum.Integrity}
+		if err := encryption.apply(&opt); err != nil {
+			fatal(err)
+		}
+
+		inputs, err := batchInputs(fs.Args(), *outDir)
+		if err != nil {
+			fatal(err)
+		}
+		if msgs != nil && len(msgs) != len(inputs) {
+			fatal(usagef("%d messages in %s for %d images", len(msgs), *msgDir, len(inputs)))
+		}
+		outputs := make(map[string]string)
+		for i := range inputs {
+			data := batchName{Index: i}
+			if msgs != nil {
+				base := filepath.Base(msgs[i])
+				data.Message = strings.TrimSuffix(base, filepath.Ext(base))
+			}
+			out := inputs[i][1]
+			if _, _, inZip := splitZipPath(out); !inZip {
+				if out, err = batchOutput(tmpl, *outDir, out, data); err != nil {
+					fatal(err)
+				}
+			}
+			if prev, ok := outputs[out]; ok {
+				fatal(usagef("-name gives %s for both %s and %s", out, prev, inputs[i][0]))
+			}
+			outputs[out] = inputs[i][0]
+			inputs[i][1] = out
+		}
+
+		var report batchReport
+
+		stage, err := newZipStage()
+		if err != nil {
+			fatal(err)
+		}
+		defer stage.remove()
+
+		var m *batchManifest
+		if *manifestFile != "" {
+			m = newBatchManifest(len(inputs))
+		}
+
+		progress := newBatchProgress(inputs, *showBatch)
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		took := make([]time.Duration, len(inputs))
+		work := func(ctx context.Context, i int) error {
+			defer func(start time.Time) { took[i] = time.Since(start) }(time.Now())
+			in, out := inputs[i][0], inputs[i][1]
+			msg, opt := msg, opt
+			if msgs != nil {
+				var err error
+				if msg, err = ioutil.ReadFile(msgs[i]); err != nil {
+					return err
+				}
+			}
+			var entry *batchEntry
+			if m != nil {
+				entry = &m.Files[i]
+				if msgs != nil {
+					entry.Message = msgs[i]
+				}
+				d := digestPayload(msg)
+				entry.Payload, opt.warnings = &d, &entry.Warnings
+			}
+
+			archive, _, inZip := splitZipPath(out)
+			if inZip {
+				out = archive
+			}
+			if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+				return err
+			}
+			file := out
+			if inZip {
+				var err error
+				if file, err = stage.file(in, inputs[i][1]); err != nil {
+					return err
+				}
+			}
+			if err := encodeFile(in, file, msg, opt); err != nil {
+				if inZip {
+					stage.drop(inputs[i][1])
+				}
+				return err
+			}
+
+			if entry != nil {
+				if err := entry.measure(in, file, msg, opt); err != nil {
+					opt.warnf("%s could not be measured for the manifest: %v", inputs[i][1], err)
+				}
+			}
+			return nil
+		}
+
+		err = runJobs(ctx, len(inputs), *jobs, work, func(i int, err error) {
+			f := batchFile{Input: inputs[i][0], Output: inputs[i][1], Status: batchSucceeded}
+			switch {
+			case errors.Is(err, hidden.ErrMessageTooLarge):
+				f.Status, f.Reason, f.Output = batchSkipped, "image is too small for the message", ""
+				report.Skipped++
+			case err != nil:
+				f.Status, f.Reason, f.Output = batchFailed, err.Error(), ""
+				report.Failed++
+			default:
+				report.Succeeded++
+			}
+
+			progress.clear()
+			if !*asJSON {
+				logBatchFile(f, took[i])
+			}
+			report.Files = append(report.Files, f)
+			if m != nil {
+				m.Files[i].batchFile = f
+			}
+			progress.done(i)
+		})
+		if err == nil {
+			progress.finish()
+		}
+
+		if err == nil {
+			if err := stage.commit(); err != nil {
+				stage.remove()
+				fatal(err)
+			}
+		}
+		if err == nil && m != nil {
+			if err := writeBatchManifest(*manifestFile, m); err != nil {
+				fatal(err)
+			}
+		}
+
+		if *asJSON {
+			printJSON(&report)
+		} else {
+			logger.Info(fmt.Sprintf("%d succeeded, %d failed, %d skipped", report.Succeeded, report.Failed, report.Skipped))
+		}
+
+		if err != nil {
+			stage.remove()
+			fatal("interrupted:", err)
+		}
+		if report.Failed > 0 {
+			stage.remove()
+			os.Exit(exitFailure)
+		}
+	}
+}
+
+func batchDecodeCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("batch-decode", flag.ExitOnError)
+	outDir := fs.String("out-dir", "", "Directory to write decoded messages to.")
+	name := fs.String("name", defaultBatchName, "Template for the path of every message below -out-dir, with {{.Dir}} and {{.Name}} of the image, the {{.Ext}} guessed from the message and {{.Index}}. The images in a zip archive go in a directory named after it.")
+	passphrase := definePassphraseFlags(fs)
+	fs.BoolVar(&force, "force", false, "Overwrite messages that exist.")
+	jobs := fs.Int("jobs", runtime.NumCPU(), "Number of images to decode concurrently.")
+	showBatch := fs.Bool("progress", false, "Report how many of the pixels of the images are done on stderr, as a bar on a terminal and as a line for every 10 percent otherwise.")
+	asJSON := jsonFlag(fs, "Output in JSON format.")
+	verbose := verbosityFlags(fs, "")
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+		verbose.apply()
+
+		if *outDir == "" || fs.NArg() == 0 {
+			commandUsage(fs, "batch-decode -out-dir <dir> [flags] <dir|glob|zip>...")
+		}
+		tmpl, err := template.New("name").Parse(*name)
+		if err != nil {
+			fatal(usagef("-name: %v", err))
+		}
+
+		opt, err := decodeOptionsFrom(passphrase)
+		if err != nil {
+			fatal(err)
+		}
+
+		inputs, err := batchInputs(fs.Args(), *outDir)
+		if err != nil {
+			fatal(err)
+		}
+
+		var report batchReport
+
+		progress := newBatchProgress(inputs, *showBatch)
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		took := make([]time.Duration, len(inputs))
+		work := func(ctx context.Context, i int) error {
+			defer func(start time.Time) { took[i] = time.Since(start) }(time.Now())
+			msg, err := extractFile(inputs[i][0], opt)
+			if err != nil {
+				return err
+			}
+			defer hidden.Wipe(msg)
+
+			// A message is not an image, it can not go back into a zip
+			// archive.
+			out := inputs[i][1]
+			if archive, entry, ok := splitZipPath(out); ok {
+				out = filepath.Join(strings.TrimSuffix(archive, filepath.Ext(archive)), filepath.FromSlash(entry))
+			}
+			ext, _ := sniffExtension(msg)
+			if out, err = batchOutput(tmpl, *outDir, out, batchName{Ext: ext, Index: i}); err != nil {
+				return err
+			}
+			if err := checkClobber(out); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+				return err
+			}
+			inputs[i][1] = out
+			return writeFileMode(out, msg, os.FileMode(outputMode))
+		}
+
+		err = runJobs(ctx, len(inputs), *jobs, work, func(i int, err error) {
+			f := batchFile{Input: inputs[i][0], Output: inputs[i][1], Status: batchSucceeded}
+			switch {
+			case errors.Is(err, hidden.ErrNoHiddenMessage):
+				f.Status, f.Reason, f.Output = batchSkipped, "image does not contain a message", ""
+				report.Skipped++
+			case err != nil:
+				f.Status, f.Reason, f.Output = batchFailed, err.Error(), ""
+				report.Failed++
+			default:
+				report.Succeeded++
+			}
+
+			progress.clear()
+			if !*asJSON {
+				logBatchFile(f, took[i])
+			}
+			report.Files = append(report.Files, f)
+			progress.done(i)
+		})
+		if err == nil {
+			progress.finish()
+		}
+
+		if *asJSON {
+			printJSON(&report)
+		} else {
+			logger.Info(fmt.Sprintf("%d succeeded, %d failed, %d skipped", report.Succeeded, report.Failed, report.Skipped))
+		}
+
+		if err != nil {
+			fatal("interrupted:", err)
+		}
+		if report.Failed > 0 {
+			os.Exit(exitFailure)
+		}
+	}
+}
+
+// logBatchFile logs the result of a file of a batch that took as long as
+// took, a failure as an error.
+func logBatchFile(f batchFile, took time.Duration) {
+	switch f.Status {
+	case batchSucceeded:
+		logger.Info(f.Input+" -> "+f.Output, logTook(took)...)
+	case batchFailed:
+		logger.Error(fmt.Sprintf("%s %s: %s", f.Status, f.Input, f.Reason), logTook(took)...)
+	default:
+		logger.Info(fmt.Sprintf("%s %s: %s", f.Status, f.Input, f.Reason), logTook(took)...)
+	}
+}
+
+// batchMessages returns the messages of -msg-dir src: the files below it in
+// lexical order if it is a directory, or else the files named on its lines.
+func batchMessages(src string) ([]string, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []string
+	if fi.IsDir() {
+		err := filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() {
+				msgs = append(msgs, file)
+			}
+			return err
+		})
+		return msgs, err
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			msgs = append(msgs, line)
+		}
+	}
+	return msgs, s.Err()
+}
+
+// batchOutput renames out, an output of batchInputs below outDir, with the
+// -name template t. data is completed with the directory, name and
+// extension of out, unless it has an Ext.
+func batchOutput(t *template.Template, outDir, out string, data batchName) (string, error) {
+	rel, err := filepath.Rel(outDir, out)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(rel)
+
+	ext := path.Ext(rel)
+	data.Dir, data.Name = path.Dir(rel), strings.TrimSuffix(path.Base(rel), ext)
+	if data.Ext == "" {
+		data.Ext = ext
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("-name: %v", err)
+	}
+	name := path.Clean(filepath.ToSlash(buf.String()))
+	if name == "." || name == ".." || path.IsAbs(name) || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("-name gives %q for %s, which is not below %s", buf.String(), rel, outDir)
+	}
+	return filepath.Join(outDir, filepath.FromSlash(name)), nil
+}
+
+// batchInputs expands directories and glob patterns into pairs of input
+// and output files. Outputs mirror the directory structure below each
+// directory, or below the part of a pattern that has no wildcards. The
+// images in a zip archive are written into a copy of it.
+func batchInputs(patterns []string, outDir string) ([][2]string, error) {
+	var inputs [][2]string
+
+	add := func(base, file string) error {
+		rel, err := filepath.Rel(base, file)
+		if err != nil {
+			return err
+		}
+		if !isZipFile(file) {
+			inputs = append(inputs, [2]string{file, filepath.Join(outDir, rel)})
+			return nil
+		}
+
+		entries, err := zipEntries(file)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		for _, e := range entries {
+			if isImageFile(e.Name) {
+				inputs = append(inputs, [2]string{zipPath(file, e.Name), zipPath(filepath.Join(outDir, rel), e.Name)})
+			}
+		}
+		return nil
+	}
+
+	for _, pattern := range patterns {
+		if archive, entry, ok := splitZipPath(pattern); ok {
+			inputs = append(inputs, [2]string{pattern, zipPath(filepath.Join(outDir, filepath.Base(archive)), entry)})
+			continue
+		}
+		if fi, err := os.Stat(pattern); err == nil && fi.IsDir() {
+			err := filepath.Walk(pattern, func(file string, fi os.FileInfo, err error) error {
+				if err != nil || !fi.Mode().IsRegular() || !isImageFile(file) && !isZipFile(file) {
+					return err
+				}
+				return add(pattern, file)
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %s", pattern)
+		}
+
+		base := pattern
+		if i := strings.IndexAny(pattern, "*?["); i >= 0 {
+			base = pattern[:i]
+		}
+		base = filepath.Dir(base + "x")
+
+		for _, file := range matches {
+			if fi, err := os.Stat(file); err == nil && fi.Mode().IsRegular() {
+				if err := add(base, file); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return inputs, nil
+}
+
+// isImageFile reports whether file has the extension of a format we can
+// encode into.
+func isImageFile(file string) bool {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".bmp", ".png":
+		return true
+	}
+	return false
+}
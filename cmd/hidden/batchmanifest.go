@@ -0,0 +1,140 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// batchManifest records what batch-encode embedded in every image, for an
+// audit trail. Like the manifest of encode it never holds the passphrase.
+type batchManifest struct {
+	Version int          `json:"manifest_version"`
+	Tool    string       `json:"tool"`
+	Created time.Time    `json:"created"`
+	Files   []batchEntry `json:"files"`
+}
+
+// batchEntry is an image of a batchManifest.
+type batchEntry struct {
+	batchFile
+
+	// Message is the file of -msg-dir the payload was read from.
+	Message string         `json:"message,omitempty"`
+	Payload *payloadDigest `json:"payload,omitempty"`
+
+	// batchMeasures is only known for an image that was written.
+	*batchMeasures
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type batchMeasures struct {
+	// Capacity is how many bytes of message the cover holds, and Used the
+	// percentage of it the message takes.
+	Capacity int     `json:"capacity"`
+	Used     float64 `json:"capacity_used"`
+
+	Depth string   `json:"depth"`
+	PSNR  decibels `json:"psnr"`
+}
+
+func newBatchManifest(n int) *batchManifest {
+	return &batchManifest{
+		Version: manifestVersion,
+		Tool:    "hidden " + version,
+		Created: time.Now().UTC().Truncate(time.Second),
+		Files:   make([]batchEntry, n),
+	}
+}
+
+// measure fills in what e records of the image encoded from in into out,
+// with msg and the library options of opt.
+func (e *batchEntry) measure(in, out string, msg []byte, opt encodeOptions) error {
+	lib, err := opt.library()
+	if err != nil {
+		return err
+	}
+	cover, err := loadImage(in)
+	if err != nil {
+		return err
+	}
+	stego, err := loadImage(out)
+	if err != nil {
+		return err
+	}
+	diff, err := diffImages(toRGBA(cover), toRGBA(stego), nil)
+	if err != nil {
+		return err
+	}
+
+	capacity := hidden.Capacity(cover, lib)
+	depth := opt.depth
+	if depth == (hidden.ChannelDepth{}) {
+		depth = hidden.ChannelDepth{1, 1, 1}
+	}
+	e.batchMeasures = &batchMeasures{
+		Capacity: capacity,
+		Used:     math.Round(10000*float64(len(msg))/math.Max(1, float64(capacity))) / 100,
+		Depth:    depth.String(),
+		PSNR:     diff.quality().PSNR,
+	}
+	return nil
+}
+
+// writeBatchManifest writes m to file, as CSV if it is named like it and as
+// indented JSON otherwise. CSV has a row for every image, with the warnings
+// separated by newlines.
+func writeBatchManifest(file string, m *batchManifest) error {
+	return writeAtomic(file, 0666, func(fp io.Writer) error {
+		if strings.ToLower(path.Ext(file)) != ".csv" {
+			enc := json.NewEncoder(fp)
+			enc.SetIndent("", "\t")
+			return enc.Encode(m)
+		}
+
+		w := csv.NewWriter(fp)
+		w.Write([]string{"input", "output", "status", "reason", "message", "payload_size", "payload_sha256", "capacity", "capacity_used", "depth", "psnr", "warnings"})
+		for _, e := range m.Files {
+			var size, sum, capacity, used, depth, psnr string
+			if e.Payload != nil {
+				size, sum = strconv.Itoa(e.Payload.Size), e.Payload.SHA256
+			}
+			if m := e.batchMeasures; m != nil {
+				capacity, used, depth = strconv.Itoa(m.Capacity), strconv.FormatFloat(m.Used, 'f', 2, 64), m.Depth
+				psnr = "inf"
+				if !math.IsInf(float64(m.PSNR), 0) {
+					psnr = strconv.FormatFloat(float64(m.PSNR), 'f', 4, 64)
+				}
+			}
+			w.Write([]string{
+				e.Input, e.Output, e.Status, e.Reason, e.Message, size, sum,
+				capacity, used, depth, psnr,
+				strings.Join(e.Warnings, "\n"),
+			})
+		}
+		w.Flush()
+		return w.Error()
+	})
+}
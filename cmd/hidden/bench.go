@@ -0,0 +1,259 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// benchSetting is a set of options bench measures.
+type benchSetting struct {
+	name string
+	opt  hidden.Options
+}
+
+var benchSettings = []benchSetting{
+	{name: "default"},
+	{name: "depth-2", opt: hidden.Options{Depth: hidden.ChannelDepth{2, 2, 2}}},
+	{name: "permuted", opt: hidden.Options{Placement: hidden.Permuted{Seed: 7}}},
+	{name: "matching", opt: hidden.Options{Matching: true}},
+	{name: "encrypted", opt: hidden.Options{Passphrase: []byte("bench")}},
+	{name: "chunked", opt: hidden.Options{ChunkSize: hidden.DefaultChunkSize}},
+}
+
+// benchResult is the fastest encoding and decoding of a setting on a cover.
+type benchResult struct {
+	Size    string  `json:"size"`
+	Setting string  `json:"setting"`
+	Payload int     `json:"payload"`
+	Pixels  int     `json:"pixels"`
+	Encode  float64 `json:"encode_seconds"`
+	Decode  float64 `json:"decode_seconds"`
+
+	EncodeMBps  float64 `json:"encode_mb_per_second"`
+	DecodeMBps  float64 `json:"decode_mb_per_second"`
+	EncodeMpxps float64 `json:"encode_megapixels_per_second"`
+	DecodeMpxps float64 `json:"decode_megapixels_per_second"`
+}
+
+// benchCommand measures the throughput of Encode and Decode on generated
+// covers of a few sizes with a few settings, the payload filling a fraction
+// of the capacity.
+func benchCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	sizeList := fs.String("sizes", "640x480,1920x1080,3840x2160", "Comma separated dimensions of the covers to measure.")
+	settings := fs.String("settings", "", "Comma separated options to measure, out of "+strings.Join(benchSettingNames(), ", ")+". (default all of them)")
+	load := fs.Float64("load", 0.5, "Fraction of the capacity of every cover the message fills.")
+	count := fs.Int("count", 3, "Runs of every measurement, the fastest is reported.")
+	cpuProfile := fs.String("cpuprofile", "", "Write a pprof CPU profile of the runs to this file.")
+	memProfile := fs.String("memprofile", "", "Write a pprof heap profile, taken after the runs, to this file.")
+	asJSON := jsonFlag(fs, "Output in JSON format.")
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() != 0 {
+			commandUsage(fs, "bench [flags]")
+		}
+		if *load <= 0 || *load > 1 {
+			fatal(usagef("-load %v is not a fraction between 0 and 1", *load))
+		}
+		if *count < 1 {
+			fatal(usagef("-count %d is less than one run", *count))
+		}
+		var sizes []image.Point
+		for _, v := range strings.Split(*sizeList, ",") {
+			var size sizeFlag
+			if err := size.Set(strings.TrimSpace(v)); err != nil {
+				fatal(usagef("-sizes %q: %v", v, err))
+			}
+			sizes = append(sizes, image.Point(size))
+		}
+		selected, err := selectBenchSettings(*settings)
+		if err != nil {
+			fatal(usagef("%v", err))
+		}
+
+		if *cpuProfile != "" {
+			f, err := os.Create(*cpuProfile)
+			if err != nil {
+				fatal(err)
+			}
+			defer f.Close()
+			if err := pprof.StartCPUProfile(f); err != nil {
+				fatal(err)
+			}
+		}
+
+		// The progress of generating the covers would break up the table.
+		info = ioutil.Discard
+		var results []benchResult
+		for _, size := range sizes {
+			cover, err := generateCover("noise", size, 0, 7, nil)
+			if err != nil {
+				pprof.StopCPUProfile()
+				fatal(err)
+			}
+			for _, s := range selected {
+				res, err := bench(cover, s, *load, *count)
+				if err != nil {
+					pprof.StopCPUProfile()
+					fatal(fmt.Errorf("%dx%d %s: %v", size.X, size.Y, s.name, err))
+				}
+				if !*asJSON {
+					printBenchResult(res, len(results) == 0)
+				}
+				results = append(results, res)
+			}
+		}
+		pprof.StopCPUProfile()
+
+		if *memProfile != "" {
+			runtime.GC()
+			if err := writeHeapProfile(*memProfile); err != nil {
+				fatal(err)
+			}
+		}
+		if *asJSON {
+			printJSON(results)
+		}
+	}
+}
+
+// bench measures encoding and decoding a message of load times the
+// capacity of cover with s, the fastest of count runs each.
+func bench(cover *image.RGBA, s benchSetting, load float64, count int) (benchResult, error) {
+	opt := s.opt
+	b := cover.Bounds()
+	msg := make([]byte, int(load*float64(hidden.Capacity(cover, &opt))))
+	rand.New(rand.NewSource(7)).Read(msg)
+
+	res := benchResult{
+		Size:    fmt.Sprintf("%dx%d", b.Dx(), b.Dy()),
+		Setting: s.name,
+		Payload: len(msg),
+		Pixels:  b.Dx() * b.Dy(),
+	}
+	if len(msg) == 0 {
+		return res, errors.New("the cover holds no message")
+	}
+
+	var (
+		img  image.Image
+		err  error
+		best = func(d *float64, start time.Time) {
+			if t := time.Since(start).Seconds(); *d == 0 || t < *d {
+				*d = t
+			}
+		}
+	)
+	for i := 0; i < count; i++ {
+		start := time.Now()
+		if s.opt.ChunkSize > 0 {
+			img, err = hidden.EncodeStream(cover, bytes.NewReader(msg), &opt)
+		} else {
+			img, err = hidden.Encode(cover, msg, &opt)
+		}
+		if err != nil {
+			return res, err
+		}
+		best(&res.Encode, start)
+	}
+
+	dec := &hidden.Options{Passphrase: opt.Passphrase}
+	for i := 0; i < count; i++ {
+		start := time.Now()
+		var got []byte
+		if s.opt.ChunkSize > 0 {
+			r, err := hidden.DecodeStream(img, dec)
+			if err != nil {
+				return res, err
+			}
+			if got, err = ioutil.ReadAll(r); err != nil {
+				return res, err
+			}
+		} else if got, err = hidden.Decode(img, dec); err != nil {
+			return res, err
+		}
+		best(&res.Decode, start)
+		if !bytes.Equal(got, msg) {
+			return res, errors.New("the decoded message differs")
+		}
+	}
+
+	res.EncodeMBps, res.DecodeMBps = float64(len(msg))/1e6/res.Encode, float64(len(msg))/1e6/res.Decode
+	res.EncodeMpxps, res.DecodeMpxps = float64(res.Pixels)/1e6/res.Encode, float64(res.Pixels)/1e6/res.Decode
+	return res, nil
+}
+
+func printBenchResult(r benchResult, first bool) {
+	if first {
+		fmt.Printf("%-10s %-10s %10s %12s %12s %12s %12s\n", "Size", "Setting", "Payload", "Encode MB/s", "Encode Mpx/s", "Decode MB/s", "Decode Mpx/s")
+	}
+	fmt.Printf("%-10s %-10s %10d %12.2f %12.2f %12.2f %12.2f\n", r.Size, r.Setting, r.Payload, r.EncodeMBps, r.EncodeMpxps, r.DecodeMBps, r.DecodeMpxps)
+}
+
+func benchSettingNames() []string {
+	names := make([]string, len(benchSettings))
+	for i, s := range benchSettings {
+		names[i] = s.name
+	}
+	return names
+}
+
+// selectBenchSettings returns the settings named in the comma separated
+// list names, all of them if it is empty.
+func selectBenchSettings(names string) ([]benchSetting, error) {
+	if names == "" {
+		return benchSettings, nil
+	}
+	var selected []benchSetting
+next:
+	for _, name := range strings.Split(names, ",") {
+		for _, s := range benchSettings {
+			if s.name == strings.TrimSpace(name) {
+				selected = append(selected, s)
+				continue next
+			}
+		}
+		return nil, fmt.Errorf("unknown setting %q, expected one of %s", name, strings.Join(benchSettingNames(), ", "))
+	}
+	return selected, nil
+}
+
+func writeHeapProfile(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,221 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+	"golang.org/x/image/bmp"
+)
+
+// bmpDepth is the bits per pixel of encoded BMPs, 24 or 32, or 0 to follow
+// the cover.
+var bmpDepth depthValue
+
+// depthValue is a flag.Value for -bmp-depth.
+type depthValue int
+
+func (d *depthValue) String() string {
+	if *d == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(*d))
+}
+
+func (d *depthValue) Set(s string) error {
+	switch s {
+	case "24":
+		*d = 24
+	case "32":
+		*d = 32
+	default:
+		return errors.New("the BMP depth is 24 or 32")
+	}
+	return nil
+}
+
+// bmpDepthFlag defines the -bmp-depth flag in fs.
+func bmpDepthFlag(fs *flag.FlagSet) {
+	fs.Var(&bmpDepth, "bmp-depth", "Bits per pixel of a BMP output, 24 or 32.")
+}
+
+// outputBMPDepth returns the depth to write a BMP with, for a cover that
+// held extra besides the pixels: -bmp-depth, the depth of a 24 or 32 bit
+// BMP cover, or 0 to leave it to the encoder.
+func outputBMPDepth(extra *ancillary) int {
+	if bmpDepth != 0 {
+		return int(bmpDepth)
+	}
+	if extra != nil && (extra.bmpBits == 24 || extra.bmpBits == 32) {
+		return extra.bmpBits
+	}
+	return 0
+}
+
+// rgbImage hides the concrete type of an image from bmp.Encode, which then
+// writes 24 bits per pixel whatever the alpha.
+type rgbImage struct {
+	image.Image
+}
+
+// encodeBMP writes img as a BMP with bits per pixel, 24 or 32, or whatever
+// bmp.Encode picks for 0: 24 bits for opaque images and 32 for the rest.
+// At 24 bits the alpha is dropped. At 32 bits the samples are written as
+// they are, alpha included, behind an info header without an alpha mask, so
+// decoders read the pixels as opaque and the colors exactly as encoded. The
+// colors of an *image.NRGBA are written as they are, not premultiplied.
+func encodeBMP(w io.Writer, img image.Image, bits int) error {
+	if m, ok := img.(*image.NRGBA); ok && bits != 0 {
+		img = &image.RGBA{Pix: m.Pix, Stride: m.Stride, Rect: m.Rect}
+	}
+	switch bits {
+	case 0:
+		return bmp.Encode(w, img)
+	case 24:
+		if m, ok := img.(*image.RGBA); ok && m.Opaque() {
+			return bmp.Encode(w, m)
+		}
+		return bmp.Encode(w, rgbImage{img})
+	case 32:
+		return encodeBMP32(w, toRGBA(img))
+	}
+	return errors.New("the BMP depth is 24 or 32")
+}
+
+func encodeBMP32(w io.Writer, m *image.RGBA) error {
+	const headerLen = bmpFileHeaderLen + bmpInfoHeaderLen
+
+	width, height := m.Rect.Dx(), m.Rect.Dy()
+	size := width * height * 4
+
+	header := make([]byte, headerLen)
+	copy(header, "BM")
+	binary.LittleEndian.PutUint32(header[2:], uint32(headerLen+size))
+	binary.LittleEndian.PutUint32(header[10:], headerLen)
+
+	info := header[bmpFileHeaderLen:]
+	binary.LittleEndian.PutUint32(info, bmpInfoHeaderLen)
+	binary.LittleEndian.PutUint32(info[4:], uint32(width))
+	binary.LittleEndian.PutUint32(info[8:], uint32(height))
+	binary.LittleEndian.PutUint16(info[12:], 1)
+	binary.LittleEndian.PutUint16(info[14:], 32)
+	binary.LittleEndian.PutUint32(info[20:], uint32(size))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	row := make([]byte, width*4)
+	for y := height - 1; y >= 0; y-- {
+		p := m.Pix[y*m.Stride:][:width*4]
+		for x := 0; x < len(p); x += 4 {
+			row[x], row[x+1], row[x+2], row[x+3] = p[x+2], p[x+1], p[x], p[x+3]
+		}
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeBMPStream writes the BMP in fin to fout with msg hidden in it, a row
+// at a time, for -stream.
+func encodeBMPStream(fin, fout string, msg []byte, opt encodeOptions, lib *hidden.Options) error {
+	switch {
+	case opt.generate != "" || isURL(fin):
+		return errors.New("-stream reads the cover from a BMP file")
+	case opt.jpegQuality > 0 || opt.maxUpscale > 0 || opt.maxChanges > 0 || opt.debugMap != "":
+		return errors.New("-jpeg, -resize-to-fit, -max-changes and -debug-map need the whole image, they can not be combined with -stream")
+	case bmpDepth != 0:
+		return errors.New("-stream keeps the depth of the cover, it can not be combined with -bmp-depth")
+	case strings.ToLower(path.Ext(fout)) != ".bmp":
+		return fmt.Errorf("-stream writes a BMP, not %s", fout)
+	}
+
+	in, err := os.Open(fin)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if !opt.overwrite {
+		if size, _, err := hidden.DetectBMP(in); err == nil {
+			return fmt.Errorf("%s already contains a hidden message of %d bytes, use -overwrite-message to replace it", fin, size)
+		}
+		if _, err := in.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	encode := func(w io.Writer) error {
+		err := hidden.EncodeBMP(w, bufio.NewReader(in), msg, lib)
+		if err == hidden.ErrMessageTooLarge {
+			err = tooLarge(len(msg), lib)
+		}
+		return err
+	}
+	if opt.dryRun {
+		return encode(ioutil.Discard)
+	}
+	if err := writeAtomic(fout, 0666, encode); err != nil {
+		return err
+	}
+
+	if opt.verify {
+		if err := verifyBMPStream(fout, msg, lib); err != nil {
+			os.Remove(fout)
+			return fmt.Errorf("verification failed, removed %s: %v", fout, err)
+		}
+	}
+	return nil
+}
+
+// decodeBMPStream extracts the message from the BMP in file, reading only the
+// rows that hold it, for -stream.
+func decodeBMPStream(file string, opt *hidden.Options) ([]byte, error) {
+	if isURL(file) {
+		return nil, errors.New("-stream reads the image from a BMP file")
+	}
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return hidden.DecodeBMP(fp, opt)
+}
+
+func verifyBMPStream(file string, msg []byte, opt *hidden.Options) error {
+	got, err := decodeBMPStream(file, opt)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, msg) {
+		return fmt.Errorf("extracted %d bytes that differ from the %d byte message", len(got), len(msg))
+	}
+	return nil
+}
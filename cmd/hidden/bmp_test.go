@@ -0,0 +1,134 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// bmpAlphaBytes returns the fourth byte of every pixel of the 32 bit BMP in
+// data, top to bottom.
+func bmpAlphaBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	rows := bmp32Rows(data)
+	if rows == nil {
+		t.Fatal("not a 32 bit BMP")
+	}
+	var b []byte
+	for _, row := range rows {
+		b = append(b, alphaSamples(row)...)
+	}
+	return b
+}
+
+// alphaSamples returns every fourth byte of pix.
+func alphaSamples(pix []byte) []byte {
+	b := make([]byte, len(pix)/4)
+	for i := range b {
+		b[i] = pix[4*i+3]
+	}
+	return b
+}
+
+// TestEncodeBMPDepth encodes 24 and 32 bit BMP covers, and a PNG, into BMPs
+// of either depth. A width of 61 pads the rows of a 24 bit BMP.
+func TestEncodeBMPDepth(t *testing.T) {
+	saved := bmpDepth
+	t.Cleanup(func() { bmpDepth = saved })
+
+	dir := t.TempDir()
+	msg := writeTestFile(t, dir, "msg.bin", testMessage(600, 161))
+	cover24 := writeTestFile(t, dir, "cover24.bmp", bmpBytes(t, testCover(61, 40, 161)))
+
+	// The fourth bytes of a 32 bit BMP with a BITMAPINFOHEADER are not
+	// alpha to decoders, but are kept like it.
+	img := testCover(61, 40, 162)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = byte(i)
+	}
+	var buf bytes.Buffer
+	if err := encodeBMP32(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	cover32 := writeTestFile(t, dir, "cover32.bmp", buf.Bytes())
+	alpha := alphaSamples(img.Pix)
+
+	transparent := testCover(61, 40, 163)
+	transparent.Pix[3], transparent.Pix[7] = 0, 0x80
+	buf.Reset()
+	if err := png.Encode(&buf, &image.NRGBA{Pix: transparent.Pix, Stride: transparent.Stride, Rect: transparent.Rect}); err != nil {
+		t.Fatal(err)
+	}
+	coverPNG := writeTestFile(t, dir, "cover.png", buf.Bytes())
+
+	for _, c := range []struct {
+		name  string
+		cover string
+		depth depthValue
+		bpp   int
+		alpha []byte
+	}{
+		{"24 bit", cover24, 0, 24, nil},
+		{"24 bit as 32", cover24, 32, 32, bytes.Repeat([]byte{0xff}, 61*40)},
+		{"32 bit", cover32, 0, 32, alpha},
+		{"32 bit as 32", cover32, 32, 32, alpha},
+		{"32 bit as 24", cover32, 24, 24, nil},
+		{"transparent png", coverPNG, 0, 32, alphaSamples(transparent.Pix)},
+		{"transparent png as 24", coverPNG, 24, 24, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			bmpDepth = c.depth
+			out := filepath.Join(t.TempDir(), "out.bmp")
+			if err := encode(c.cover, out, msg, encodeOptions{verify: true}); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bpp := int(binary.LittleEndian.Uint16(data[28:])); bpp != c.bpp {
+				t.Errorf("written with %d bits per pixel, want %d", bpp, c.bpp)
+			}
+			if got := decodeTestImage(t, out, nil); !bytes.Equal(got, testMessage(600, 161)) {
+				t.Errorf("decoded %d bytes that are not the message", len(got))
+			}
+			if c.alpha != nil {
+				if got := bmpAlphaBytes(t, data); !bytes.Equal(got, c.alpha) {
+					t.Errorf("the fourth bytes start % x, want % x", got[:8], c.alpha[:8])
+				}
+			}
+		})
+	}
+
+	bmpDepth = 24
+	alphaDepth, err := hidden.ParseChannelDepth("r:1,a:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = encode(coverPNG, filepath.Join(dir, "alpha.bmp"), msg, encodeOptions{depth: alphaDepth})
+	if err == nil || !strings.Contains(err.Error(), "alpha channel, which bmp does not keep") {
+		t.Errorf("the alpha channel into a 24 bit BMP: got %v", err)
+	}
+}
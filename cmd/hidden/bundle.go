@@ -0,0 +1,219 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// A bundle is a tar archive of the files given as several -data flags, or as
+// a directory, so their names and permissions survive. Modification times
+// are not kept, they would tell when the files were made. The header marks
+// the message as a bundle, and decoding unpacks it into a directory, unless
+// it is told to write it to a file. A single file that is a tar archive is
+// written as it is.
+
+// dataFlag is a flag.Value collecting the -data flags.
+type dataFlag []string
+
+func (f *dataFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *dataFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// isBundle reports whether the files of -data are hidden as a bundle rather
+// than as the message on their own.
+func isBundle(files []string) bool {
+	if len(files) != 1 {
+		return len(files) > 1
+	}
+	fi, err := os.Stat(files[0])
+	return err == nil && fi.IsDir()
+}
+
+// bundle returns a tar archive of files, each stored under its base name,
+// with directories and everything in them.
+func bundle(files []string) ([]byte, error) {
+	var (
+		buf  bytes.Buffer
+		tw   = tar.NewWriter(&buf)
+		seen = make(map[string]string)
+	)
+	for _, file := range files {
+		root := filepath.Dir(filepath.Clean(file))
+		err := filepath.Walk(file, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(rel)
+
+			hdr := &tar.Header{Name: name, Mode: int64(fi.Mode().Perm())}
+			switch {
+			case fi.IsDir():
+				hdr.Typeflag, hdr.Name = tar.TypeDir, name+"/"
+			case fi.Mode().IsRegular():
+				hdr.Typeflag, hdr.Size = tar.TypeReg, fi.Size()
+			default:
+				warnf("%s is not a regular file, leaving it out.", p)
+				return nil
+			}
+			if prev, ok := seen[hdr.Name]; ok {
+				return fmt.Errorf("%s and %s are both stored as %s, rename one of them", prev, p, name)
+			}
+			seen[hdr.Name] = p
+
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				return nil
+			}
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			_, err = tw.Write(secret(data))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return secret(buf.Bytes()), nil
+}
+
+// isDirTarget reports whether a decoded message goes into the directory
+// file, rather than into the file, because it exists as one or ends with a
+// separator.
+func isDirTarget(file string) bool {
+	if strings.HasSuffix(file, "/") || strings.HasSuffix(file, string(filepath.Separator)) {
+		return true
+	}
+	fi, err := os.Stat(file)
+	return err == nil && fi.IsDir()
+}
+
+// unbundle unpacks the tar archive msg into dir, which is created if needed.
+// The files are secrets like a single message, so only the owner bits of
+// their permissions are kept, unless -keep-modes is given. Nothing is
+// written if an entry would land outside dir, or, without -force, on a file
+// that exists.
+func unbundle(msg []byte, dir string) (int, error) {
+	type entry struct {
+		name string
+		mode os.FileMode
+		data []byte
+		dir  bool
+	}
+
+	var entries []entry
+	tr := tar.NewReader(bytes.NewReader(msg))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") || strings.Contains(name, `\`) {
+			return 0, fmt.Errorf("the archive holds %s, which is outside of the directory", hdr.Name)
+		}
+		e := entry{name: filepath.Join(dir, filepath.FromSlash(name)), mode: os.FileMode(hdr.Mode).Perm()}
+		if !keepModes {
+			e.mode &= 0700
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			e.dir = true
+		case tar.TypeReg:
+			if e.data, err = ioutil.ReadAll(tr); err != nil {
+				return 0, err
+			}
+			secret(e.data)
+			if err := checkClobber(e.name); err != nil {
+				return 0, err
+			}
+		default:
+			warnf("%s is not a regular file, leaving it out.", hdr.Name)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return 0, errors.New("the archive is empty")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	var files int
+	for _, e := range entries {
+		if e.dir {
+			if err := os.MkdirAll(e.name, 0700|e.mode); err != nil {
+				return files, err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(e.name), 0700); err != nil {
+			return files, err
+		}
+		if err := writeFileAtomic(e.name, e.data, e.mode); err != nil {
+			return files, err
+		}
+		// As in writeMessage, the umask applies to a new file.
+		if runtime.GOOS != "windows" {
+			if err := os.Chmod(e.name, e.mode); err != nil {
+				return files, err
+			}
+		}
+		files++
+	}
+
+	// Directories get their own modes once everything is in them.
+	if runtime.GOOS != "windows" {
+		for _, e := range entries {
+			if e.dir {
+				if err := os.Chmod(e.name, e.mode); err != nil {
+					return files, err
+				}
+			}
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,186 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// dataCapacity returns the largest message the image file in data, read
+// with readImageFile, holds with lib, or written as a JPEG at jpegQuality
+// unless it is 0.
+func dataCapacity(data []byte, jpegQuality int, lib *hidden.Options) (int, error) {
+	switch {
+	case jpegQuality != 0:
+		img, _, err := hidden.DecodeImage(bytes.NewReader(data))
+		if err != nil {
+			return 0, err
+		}
+		return hidden.CapacityJPEG(img, jpegQuality, lib), nil
+	case isGIF(data):
+		return hidden.CapacityGIF(bytes.NewReader(data), lib)
+	case isTIFF(data):
+		return hidden.CapacityTIFF(bytes.NewReader(data), libraryPage(), lib)
+	case isICO(data):
+		return hidden.CapacityICO(bytes.NewReader(data), libraryEntry(), lib)
+	}
+	img, _, err := hidden.DecodeImage(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	return hidden.Capacity(img, lib), nil
+}
+
+// capacityReport has the smallest cover for the payload, if there is one,
+// and what the image holds, if there is one.
+type capacityReport struct {
+	Payload       *int `json:"payload,omitempty"`
+	MinPixels     *int `json:"min_pixels,omitempty"`
+	MinSide       *int `json:"min_side,omitempty"`
+	ImageCapacity *int `json:"image_capacity,omitempty"`
+}
+
+func capacityCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("capacity", flag.ExitOnError)
+	payload := fs.String("payload", "", "File with the message to size a cover for, or to check against the image.")
+	checksum := checksumFlag(fs)
+	var cipher cipherFlag
+	fs.Var(&cipher, "cipher", "Size for a message encrypted with this cipher.")
+	encrypt := fs.Bool("encrypt", false, "Size for an encrypted message.")
+	resync := fs.Int("resync", 0, "Size for a message stored in blocks of this many bytes behind resync markers.")
+	copies := fs.Int("copies", 0, "Size for this many copies of the resync blocks.")
+	chunkSize := fs.Int("chunk-size", 0, "Size for a message stored in chunks of this many bytes.")
+	ecc := eccFlag(fs, "Size for a message with this many parity bytes in every 255 bytes, or in Hamming codes with hamming.")
+	seal := fs.Bool("seal", false, "Size for a sealed message.")
+	jpegQuality := fs.Int("jpeg", 0, "Size for a message in the DCT coefficients of a JPEG at this quality.")
+	depth := depthFlag(fs)
+	asJSON := jsonFlag(fs, "Output in JSON format.")
+	pageFlag(fs)
+	entryFlag(fs)
+	limitFlags(fs)
+	metaFlags(fs)
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if (*payload == "" && fs.NArg() == 0) || fs.NArg() > 1 {
+			commandUsage(fs, "capacity [flags] [-payload <file>] [image]")
+		}
+		if *jpegQuality != 0 && *seal {
+			fatal(hidden.ErrSealUnsupported)
+		}
+
+		var (
+			msg []byte
+			err error
+		)
+		if *payload != "" {
+			if msg, err = ioutil.ReadFile(*payload); err != nil {
+				fatal(err)
+			}
+		}
+
+		// Capacity does not depend on the passphrase, only on the cipher.
+		opt := encodeOptions{integrity: checksum.Integrity, blockSize: *resync, copies: *copies, chunkSize: *chunkSize, ecc: ecc.parity, hamming: ecc.hamming, seal: *seal}
+		if *encrypt || cipher.Cipher != nil {
+			opt.passphrase, opt.cipher = []byte("capacity"), cipher.Cipher
+		}
+		if opt.depth, err = depth.depth(); err != nil {
+			fatal(err)
+		}
+		if opt.meta, err = userFields(); err != nil {
+			fatal(err)
+		}
+		lib, err := opt.library()
+		if err != nil {
+			fatal(err)
+		}
+
+		var report capacityReport
+		if *payload != "" {
+			size := len(msg)
+			pixels, side := hidden.MinCarrier(size, lib)
+			report.Payload, report.MinPixels, report.MinSide = &size, &pixels, &side
+		}
+		if fs.NArg() == 1 {
+			data, err := readImageFile(fs.Arg(0))
+			if err != nil {
+				fatal(err)
+			}
+
+			capacity, err := dataCapacity(data, *jpegQuality, lib)
+			if err != nil {
+				fatal(err)
+			}
+			report.ImageCapacity = &capacity
+		}
+
+		if *asJSON {
+			printJSON(&report)
+			return
+		}
+
+		if report.Payload != nil {
+			fmt.Printf("The %s byte message %s.\n", groupDigits(len(msg)), carrierHint(len(msg), lib))
+		}
+		if c := report.ImageCapacity; c != nil {
+			if report.Payload == nil {
+				fmt.Printf("%s holds %s bytes.\n", fs.Arg(0), groupDigits(*c))
+				return
+			}
+			fits := "fits"
+			if len(msg) > *c {
+				fits = "does not fit"
+			}
+			fmt.Printf("%s holds %s bytes, the message %s.\n", fs.Arg(0), groupDigits(*c), fits)
+		}
+	}
+}
+
+// carrierHint describes the smallest cover that holds a message of size
+// bytes with opt, like "needs at least 2,796,203 pixels, e.g. 1673x1673".
+func carrierHint(size int, opt *hidden.Options) string {
+	pixels, side := hidden.MinCarrier(size, opt)
+	switch {
+	case pixels == 0 && side == 0:
+		return fmt.Sprintf("does not fit in any image of up to %s pixels", groupDigits(hidden.MaxImagePixels))
+	case pixels == 0:
+		return fmt.Sprintf("needs at least a %dx%d image", side, side)
+	case side == 0:
+		return fmt.Sprintf("needs at least %s pixels", groupDigits(pixels))
+	}
+	return fmt.Sprintf("needs at least %s pixels, e.g. %dx%d", groupDigits(pixels), side, side)
+}
+
+// tooLarge is hidden.ErrMessageTooLarge with the smallest cover that would
+// hold the message.
+func tooLarge(size int, opt *hidden.Options) error {
+	return fmt.Errorf("%w, it %s", hidden.ErrMessageTooLarge, carrierHint(size, opt))
+}
+
+// groupDigits formats n with commas between groups of three digits.
+func groupDigits(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0 && s[i-1] != '-'; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
@@ -0,0 +1,95 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"unicode/utf8"
+
+	"github.com/atotto/clipboard"
+)
+
+// clipboardName can be given instead of a file name to -msg to read the
+// message from, or write it to, the system clipboard.
+const clipboardName = "clipboard:"
+
+// stdioName can be given instead of a file name to -msg to read the message
+// from stdin, or write it to stdout.
+const stdioName = "-"
+
+// maxClipboardSize is the largest message placed on the clipboard.
+const maxClipboardSize = 1 << 20
+
+// readMessage returns the contents of file, of stdin, of the clipboard, or
+// of an http(s) URL if it is at most limit bytes.
+func readMessage(file string, limit int64) ([]byte, error) {
+	if isURL(file) {
+		return fetchMessage(file, limit)
+	} else if file == stdioName {
+		return ioutil.ReadAll(os.Stdin)
+	} else if file != clipboardName {
+		return ioutil.ReadFile(file)
+	}
+
+	if err := clipboardAvailable(); err != nil {
+		return nil, err
+	}
+	text, err := clipboard.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if text == "" {
+		return nil, errors.New("the clipboard is empty")
+	}
+	return []byte(text), nil
+}
+
+// writeMessage writes msg to file with exactly outputMode, also when it
+// replaces a file, or places it on the clipboard.
+func writeMessage(file string, msg []byte) error {
+	if file != clipboardName {
+		return writeFileMode(file, msg, os.FileMode(outputMode))
+	}
+
+	if len(msg) > maxClipboardSize {
+		return fmt.Errorf("the message is %d bytes, too large for the clipboard, write it to a file instead", len(msg))
+	}
+	if !utf8.Valid(msg) || bytes.IndexByte(msg, 0) >= 0 {
+		warnf("the message is binary and may not survive the clipboard, consider writing it to a file.")
+	}
+
+	if err := clipboardAvailable(); err != nil {
+		return err
+	}
+	return clipboard.WriteAll(string(msg))
+}
+
+// clipboardAvailable explains why the clipboard can not be used, if it can
+// not.
+func clipboardAvailable() error {
+	if clipboard.Unsupported {
+		return errors.New("no clipboard tool found, install xclip, xsel or wl-clipboard")
+	}
+	if runtime.GOOS == "linux" && os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+		return errors.New("no display available, the clipboard can not be used in a headless session")
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+type region struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type compareReport struct {
+	Samples   int     `json:"samples"`
+	Differing int     `json:"differing"`
+	MaxDelta  int     `json:"max_delta"`
+	Changed   *region `json:"changed,omitempty"`
+}
+
+// heatColor maps the largest sample delta of a pixel to a color. The encoder
+// only ever changes samples by one, so anything brighter than red means
+// something else touched the image.
+func heatColor(delta int) color.RGBA {
+	switch {
+	case delta == 0:
+		return color.RGBA{0, 0, 0, 0xFF}
+	case delta == 1:
+		return color.RGBA{0xFF, 0, 0, 0xFF}
+	case delta < 4:
+		return color.RGBA{0xFF, 0x80, 0, 0xFF}
+	case delta < 16:
+		return color.RGBA{0xFF, 0xFF, 0, 0xFF}
+	default:
+		return color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}
+	}
+}
+
+func compareCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	maxDelta := fs.Int("max-delta", 255, "Exit with an error if any sample differs by more than this.")
+	heatmap := fs.String("heatmap", "", "Write a difference heat-map image to file.")
+	asJSON := jsonFlag(fs, "Output in JSON format.")
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() != 2 {
+			commandUsage(fs, "compare [flags] <image> <image>")
+		}
+
+		ma, err := loadImage(fs.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+		mb, err := loadImage(fs.Arg(1))
+		if err != nil {
+			fatal(err)
+		}
+		a, b := toRGBA(ma), toRGBA(mb)
+
+		var (
+			heat  *image.RGBA
+			pixel func(x, y, delta int)
+		)
+
+		if *heatmap != "" {
+			heat = image.NewRGBA(image.Rect(0, 0, a.Bounds().Dx(), a.Bounds().Dy()))
+			pixel = func(x, y, delta int) {
+				heat.SetRGBA(x, y, heatColor(delta))
+			}
+		}
+
+		diff, err := diffImages(a, b, pixel)
+		if err != nil {
+			fatal(err)
+		}
+
+		var report compareReport
+		for c := range diff.samples {
+			report.Samples += diff.samples[c]
+			report.Differing += diff.modified[c]
+			if diff.maxDelta[c] > report.MaxDelta {
+				report.MaxDelta = diff.maxDelta[c]
+			}
+		}
+
+		if r := diff.changed; !r.Empty() {
+			report.Changed = &region{r.Min.X, r.Min.Y, r.Dx(), r.Dy()}
+		}
+
+		if heat != nil {
+			if err := saveImage(*heatmap, heat, nil); err != nil {
+				fatal(err)
+			}
+		}
+
+		if *asJSON {
+			printJSON(&report)
+		} else {
+			fmt.Printf("Differing samples: %d of %d\n", report.Differing, report.Samples)
+			fmt.Println("Max delta:", report.MaxDelta)
+			if r := report.Changed; r != nil {
+				fmt.Printf("Changed region: %dx%d at (%d, %d)\n", r.Width, r.Height, r.X, r.Y)
+			}
+		}
+
+		if report.MaxDelta > *maxDelta {
+			fatal(fmt.Sprintf("max delta %d exceeds the limit of %d", report.MaxDelta, *maxDelta))
+		}
+	}
+}
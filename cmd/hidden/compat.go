@@ -0,0 +1,129 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// compatFlags are the flags of the order the message is stored in, and of
+// the formats of other tools.
+type compatFlags struct {
+	order  hidden.BitOrder
+	little bool
+	raw    bool
+}
+
+// defineCompatFlags defines -bit-order, -header-endian and -compat in fs.
+func defineCompatFlags(fs *flag.FlagSet) *compatFlags {
+	f := &compatFlags{}
+	fs.Var(bitOrderFlag{&f.order}, "bit-order", "Bit order of message bytes: msb or lsb. (default msb)")
+	fs.Var(endianFlag{&f.little}, "header-endian", "Byte order of header lengths: big or little. (default big)")
+	fs.Var(toolFlag{&f.raw}, "compat", "Format of another tool to use: lsb.")
+	return f
+}
+
+// options returns the library options of the flags. Decoding only needs
+// them for -compat, it finds the order of a message with a header.
+func (f *compatFlags) options() []hidden.Option {
+	var opts []hidden.Option
+	if f.order != hidden.MSBFirst {
+		opts = append(opts, hidden.WithBitOrder(f.order))
+	}
+	if f.little {
+		opts = append(opts, hidden.WithLittleEndian())
+	}
+	if f.raw {
+		opts = append(opts, hidden.WithRaw())
+	}
+	return opts
+}
+
+// bitOrderFlag is a flag.Value selecting a hidden.BitOrder by msb or lsb.
+type bitOrderFlag struct {
+	order *hidden.BitOrder
+}
+
+func (f bitOrderFlag) String() string {
+	if f.order == nil || *f.order == hidden.MSBFirst {
+		return "msb"
+	}
+	return "lsb"
+}
+
+func (f bitOrderFlag) Set(s string) error {
+	switch s {
+	case "msb":
+		*f.order = hidden.MSBFirst
+	case "lsb":
+		*f.order = hidden.LSBFirst
+	default:
+		return fmt.Errorf("unknown bit order %q, want msb or lsb", s)
+	}
+	return nil
+}
+
+// endianFlag is a flag.Value setting a bool by big or little.
+type endianFlag struct {
+	little *bool
+}
+
+func (f endianFlag) String() string {
+	if f.little == nil || !*f.little {
+		return "big"
+	}
+	return "little"
+}
+
+func (f endianFlag) Set(s string) error {
+	switch s {
+	case "big":
+		*f.little = false
+	case "little":
+		*f.little = true
+	default:
+		return fmt.Errorf("unknown byte order %q, want big or little", s)
+	}
+	return nil
+}
+
+// toolFlag is a flag.Value selecting the format of another tool.
+type toolFlag struct {
+	raw *bool
+}
+
+func (f toolFlag) String() string {
+	if f.raw == nil || !*f.raw {
+		return ""
+	}
+	return "lsb"
+}
+
+func (f toolFlag) Set(s string) error {
+	switch s {
+	case "lsb":
+		*f.raw = true
+	case "steghide":
+		return errors.New("the format of steghide is not supported, it scatters the message in an order drawn from the passphrase")
+	default:
+		return fmt.Errorf("unknown format %q, want lsb", s)
+	}
+	return nil
+}
@@ -0,0 +1,431 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The completion and docs commands describe the others, which refer back to
+// commands, so they are only added to it after it is initialized.
+func init() {
+	commands["completion"] = completionCommand
+	commands["docs"] = docsCommand
+}
+
+// commandSummaries is the line describing every command in the completion
+// scripts and man pages.
+var commandSummaries = map[string]string{
+	"analyze":      "Estimate the probability that an image carries a message by the chi-square attack",
+	"bench":        "Measure how fast messages are encoded and decoded",
+	"batch-decode": "Decode the messages of many images into a directory",
+	"batch-encode": "Encode messages into many images, written to a directory",
+	"capacity":     "Report how large a message an image, or a cover of some size, can hold",
+	"compare":      "Report how much two images differ, sample by sample",
+	"completion":   "Print a bash, zsh or fish completion script",
+	"decode":       "Decode the message in an image given by -in",
+	"detect":       "Estimate whether an image carries a message by RS analysis and the chi-square attack",
+	"docs":         "Write the man pages of hidden and its commands",
+	"encode":       "Encode the files given by -data into the image given by -in",
+	"gencover":     "Generate a cover large enough for a message",
+	"info":         "Print the header of the message in an image",
+	"inspect":      "Print the header of the message in an image, as info does",
+	"manifest":     "Verify an encoded image against the manifest written when it was encoded",
+	"quality":      "Measure the PSNR and SSIM of an encoded image against its cover",
+	"recover":      "Try every layout to recover a message from an image",
+	"scan":         "Find the images that carry a message in directories and zip archives",
+	"self-test":    "Encode and decode with every option to check this build",
+	"serve":        "Serve encoding and decoding over HTTP",
+	"simulate":     "Report which transformations of an image its message survives",
+	"stats":        "Compare the statistics of the top of an image with the rest of it",
+	"stress":       "Report how much of a message survives transformations of its image",
+	"transplant":   "Move the message of an encoded image into a new cover",
+	"tui":          "Encode and decode interactively in the terminal",
+	"verify":       "Check that an image carries a message whose checksum matches",
+	"visualize":    "Draw the bit planes of an image",
+	"watch":        "Encode the images that appear in a directory",
+	"watermark":    "Tile an identifier across images, or extract it",
+}
+
+// commandNames returns the names of all commands, encode and decode too, in
+// order.
+func commandNames() []string {
+	names := []string{"encode", "decode"}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commandArgs are the words the first argument of a command is one of.
+var commandArgs = map[string][]string{
+	"completion": {"bash", "zsh", "fish"},
+	"docs":       {"man"},
+	"manifest":   {"verify"},
+}
+
+// describe returns the flags of command, the classic flags for "", with
+// those of the config file every command reads.
+func describe(command string) *flag.FlagSet {
+	var fs *flag.FlagSet
+	if command == "" {
+		fs, _ = classicCommand("")
+	} else {
+		fs, _ = commands[command]()
+	}
+	defineConfigFlags(fs)
+	return fs
+}
+
+// commandFlag is a flag as the completion scripts and man pages show it.
+type commandFlag struct {
+	name, value, usage string
+}
+
+// describeFlags returns the flags of command in order, with the name of the
+// value they take, none for a boolean flag.
+func describeFlags(command string) []commandFlag {
+	if command == "encode" || command == "decode" {
+		command = ""
+	}
+	var flags []commandFlag
+	describe(command).VisitAll(func(f *flag.Flag) {
+		value, usage := flag.UnquoteUsage(f)
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			value = ""
+		}
+		if f.DefValue != "" && f.DefValue != "0" && f.DefValue != "false" && !strings.Contains(usage, "(default ") {
+			usage += fmt.Sprintf(" (default %s)", f.DefValue)
+		}
+		flags = append(flags, commandFlag{f.Name, value, usage})
+	})
+	return flags
+}
+
+// firstSentence returns the first sentence of a flag usage, without the
+// period, as the completion scripts show it.
+func firstSentence(usage string) string {
+	if i := strings.Index(usage, ". "); i >= 0 {
+		usage = usage[:i]
+	}
+	return strings.TrimSuffix(usage, ".")
+}
+
+func completionCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		const synopsis = "completion bash|zsh|fish\n\n" +
+			"Load it in bash with: source <(hidden completion bash)\n" +
+			"in zsh, as _hidden in a directory of $fpath: hidden completion zsh > _hidden\n" +
+			"and in fish: hidden completion fish > ~/.config/fish/completions/hidden.fish"
+		if fs.NArg() != 1 {
+			commandUsage(fs, synopsis)
+		}
+
+		var write func(w *bytes.Buffer)
+		switch fs.Arg(0) {
+		case "bash":
+			write = bashCompletion
+		case "zsh":
+			write = zshCompletion
+		case "fish":
+			write = fishCompletion
+		default:
+			commandUsage(fs, synopsis)
+		}
+		var buf bytes.Buffer
+		write(&buf)
+		if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+// bashCompletion writes the completion function of bash, which completes
+// the commands, their flags, and files for the rest.
+func bashCompletion(w *bytes.Buffer) {
+	names := commandNames()
+	fmt.Fprintln(w, "# bash completion for hidden, written by hidden completion bash.")
+	fmt.Fprintln(w, "_hidden() {")
+	fmt.Fprintln(w, "\tlocal cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}")
+	fmt.Fprintln(w, "\tlocal cmd= flags values words")
+	fmt.Fprintln(w, "\t[ \"$COMP_CWORD\" -gt 1 ] && cmd=${COMP_WORDS[1]}")
+	fmt.Fprintln(w, "\tcase $cmd in")
+	for _, name := range append(names, "") {
+		var flags, values []string
+		for _, f := range describeFlags(name) {
+			flags = append(flags, "-"+f.name)
+			if f.value != "" {
+				values = append(values, "-"+f.name)
+			}
+		}
+		if name == "" {
+			fmt.Fprintln(w, "\t*)")
+		} else {
+			fmt.Fprintf(w, "\t%s)\n", name)
+		}
+		fmt.Fprintf(w, "\t\tflags='%s'\n", strings.Join(flags, " "))
+		fmt.Fprintf(w, "\t\tvalues=' %s '\n", strings.Join(values, " "))
+		if words := commandArgs[name]; len(words) > 0 {
+			fmt.Fprintf(w, "\t\twords='%s'\n", strings.Join(words, " "))
+		}
+		fmt.Fprintln(w, "\t\t;;")
+	}
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintf(w, "\tif [ \"$COMP_CWORD\" -eq 1 ] && [[ $cur != -* ]]; then\n")
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W '%s' -- \"$cur\"))\n", strings.Join(names, " "))
+	fmt.Fprintln(w, "\telif [[ $values == *\" $prev \"* ]]; then")
+	fmt.Fprintln(w, "\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))")
+	fmt.Fprintln(w, "\telif [[ $cur == -* ]]; then")
+	fmt.Fprintln(w, "\t\tCOMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))")
+	fmt.Fprintln(w, "\telif [ -n \"$words\" ] && [ \"$COMP_CWORD\" -eq 2 ]; then")
+	fmt.Fprintln(w, "\t\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))")
+	fmt.Fprintln(w, "\telse")
+	fmt.Fprintln(w, "\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -o filenames -F _hidden hidden")
+}
+
+// zshCompletion writes the completion function of zsh, which describes the
+// commands and flags by their summaries.
+func zshCompletion(w *bytes.Buffer) {
+	quote := func(s string) string {
+		return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+	}
+	arguments := func(name, indent string) {
+		fmt.Fprintf(w, "%s_arguments \\\n", indent)
+		for _, f := range describeFlags(name) {
+			desc := strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(firstSentence(f.usage))
+			spec := fmt.Sprintf("*-%s[%s]", f.name, desc)
+			if f.value != "" {
+				spec += fmt.Sprintf(":%s:_files", f.value)
+			}
+			fmt.Fprintf(w, "%s\t%s \\\n", indent, quote(spec))
+		}
+		if words := commandArgs[name]; len(words) > 0 {
+			fmt.Fprintf(w, "%s\t%s \\\n", indent, quote(fmt.Sprintf("1:%s:(%s)", name, strings.Join(words, " "))))
+		}
+		fmt.Fprintf(w, "%s\t'*:file:_files'\n", indent)
+	}
+
+	fmt.Fprintln(w, "#compdef hidden")
+	fmt.Fprintln(w, "# zsh completion for hidden, written by hidden completion zsh.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "_hidden() {")
+	fmt.Fprintln(w, "\tlocal -a commands")
+	fmt.Fprintln(w, "\tcommands=(")
+	for _, name := range commandNames() {
+		fmt.Fprintf(w, "\t\t%s\n", quote(name+":"+commandSummaries[name]))
+	}
+	fmt.Fprintln(w, "\t)")
+	fmt.Fprintln(w, "\tif (( CURRENT == 2 )) && [[ $words[2] != -* ]]; then")
+	fmt.Fprintln(w, "\t\t_describe -t commands 'hidden command' commands")
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, "\tcase $words[2] in")
+	for _, name := range commandNames() {
+		fmt.Fprintf(w, "\t%s)\n", name)
+		fmt.Fprintln(w, "\t\tshift words")
+		fmt.Fprintln(w, "\t\t(( CURRENT-- ))")
+		arguments(name, "\t\t")
+		fmt.Fprintln(w, "\t\t;;")
+	}
+	fmt.Fprintln(w, "\t*)")
+	arguments("", "\t\t")
+	fmt.Fprintln(w, "\t\t;;")
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `_hidden "$@"`)
+}
+
+// fishCompletion writes the completions of fish, which describe the
+// commands and flags by their summaries.
+func fishCompletion(w *bytes.Buffer) {
+	quote := func(s string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+	}
+	complete := func(condition, name string) {
+		for _, f := range describeFlags(name) {
+			line := fmt.Sprintf("complete -c hidden -n %s -o %s", quote(condition), f.name)
+			if f.value != "" {
+				line += " -r"
+			}
+			fmt.Fprintf(w, "%s -d %s\n", line, quote(firstSentence(f.usage)))
+		}
+		if words := commandArgs[name]; len(words) > 0 {
+			fmt.Fprintf(w, "complete -c hidden -n %s -f -a %s\n", quote(condition), quote(strings.Join(words, " ")))
+		}
+	}
+
+	names := commandNames()
+	fmt.Fprintln(w, "# fish completion for hidden, written by hidden completion fish.")
+	none := "not __fish_seen_subcommand_from " + strings.Join(names, " ")
+	for _, name := range names {
+		fmt.Fprintf(w, "complete -c hidden -n %s -f -a %s -d %s\n", quote(none), name, quote(commandSummaries[name]))
+	}
+	var others []string
+	for _, name := range names {
+		if name != "encode" && name != "decode" {
+			others = append(others, name)
+		}
+	}
+	complete("not __fish_seen_subcommand_from "+strings.Join(others, " "), "")
+	for _, name := range others {
+		complete("__fish_seen_subcommand_from "+name, name)
+	}
+}
+
+func docsCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("docs man", flag.ExitOnError)
+	outDir := fs.String("out-dir", ".", "Directory to write the man pages to, hidden.1 and hidden-<command>.1 for every command.")
+
+	const synopsis = "docs man [flags]"
+	return fs, func(args []string) {
+		if len(args) == 0 || args[0] != "man" {
+			commandUsage(fs, synopsis)
+		}
+		parseFlags(fs, args[1:])
+		if fs.NArg() != 0 {
+			commandUsage(fs, synopsis)
+		}
+
+		if err := os.MkdirAll(*outDir, 0755); err != nil {
+			fatal(err)
+		}
+		date := time.Now().Format("January 2006")
+		pages := map[string]func(w io.Writer){
+			"hidden.1": func(w io.Writer) { mainPage(w, date) },
+		}
+		for name := range commands {
+			name := name
+			pages["hidden-"+name+".1"] = func(w io.Writer) { commandPage(w, name, date) }
+		}
+		for file, write := range pages {
+			var buf bytes.Buffer
+			write(&buf)
+			if err := writeFileAtomic(filepath.Join(*outDir, file), buf.Bytes(), 0644); err != nil {
+				fatal(err)
+			}
+		}
+	}
+}
+
+// roff escapes s for text in a man page.
+func roff(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+// mainPage writes hidden(1), of the classic flags the encode and decode
+// commands take too, and the list of commands.
+func mainPage(w io.Writer, date string) {
+	fmt.Fprintf(w, ".TH HIDDEN 1 %q hidden \"User Commands\"\n", date)
+	fmt.Fprintln(w, ".SH NAME")
+	fmt.Fprintln(w, `hidden \- hide messages in images`)
+	fmt.Fprintln(w, ".SH SYNOPSIS")
+	fmt.Fprintln(w, `\fBhidden\fR \fB\-encode\fR \fIcover\fR \fB\-msg\fR \fImessage\fR [\fIflags\fR]`)
+	fmt.Fprintln(w, ".br")
+	fmt.Fprintln(w, `\fBhidden\fR \fB\-decode\fR \fIimage\fR [\fIflags\fR]`)
+	for _, action := range []string{"encode", "decode"} {
+		fmt.Fprintln(w, ".br")
+		fmt.Fprintf(w, "\\fBhidden\\fR %s\n", roff(actionSynopsis[action]))
+	}
+	fmt.Fprintln(w, ".br")
+	fmt.Fprintln(w, `\fBhidden\fR \fIcommand\fR [\fIflags\fR] [\fIargs\fR]`)
+	fmt.Fprintln(w, ".SH DESCRIPTION")
+	fmt.Fprintln(w, roff("Hides a message in the pixels of an image, or decodes it, with the flags below."))
+	fmt.Fprintln(w, roff("The encode and decode commands take the same flags, with -in and -data instead of -encode, -decode and -msg."))
+	fmt.Fprintln(w, roff("The other commands have pages of their own."))
+	fmt.Fprintln(w, ".SH COMMANDS")
+	for _, name := range commandNames() {
+		fmt.Fprintln(w, ".TP")
+		fmt.Fprintf(w, ".B %s\n", roff(name))
+		fmt.Fprintf(w, "%s.\n", roff(commandSummaries[name]))
+	}
+	flagSection(w, "")
+	environmentSection(w)
+	fmt.Fprintln(w, ".SH SEE ALSO")
+	var pages []string
+	for _, name := range commandNames() {
+		if name != "encode" && name != "decode" {
+			pages = append(pages, fmt.Sprintf(".BR hidden\\-%s (1)", roff(name)))
+		}
+	}
+	fmt.Fprintln(w, strings.Join(pages, " ,\n"))
+}
+
+// commandPage writes hidden-<name>(1).
+func commandPage(w io.Writer, name, date string) {
+	fmt.Fprintf(w, ".TH HIDDEN-%s 1 %q hidden \"User Commands\"\n", roff(strings.ToUpper(name)), date)
+	fmt.Fprintln(w, ".SH NAME")
+	fmt.Fprintf(w, "hidden\\-%s \\- %s\n", roff(name), roff(strings.ToLower(commandSummaries[name][:1])+commandSummaries[name][1:]))
+	fmt.Fprintln(w, ".SH SYNOPSIS")
+	fmt.Fprintf(w, "\\fBhidden %s\\fR", roff(name))
+	if words := commandArgs[name]; len(words) > 0 {
+		fmt.Fprintf(w, " %s", roff(strings.Join(words, "|")))
+	}
+	fmt.Fprintln(w, ` [\fIflags\fR] [\fIargs\fR]`)
+	fmt.Fprintln(w, ".SH DESCRIPTION")
+	fmt.Fprintf(w, "%s.\n", roff(commandSummaries[name]))
+	fmt.Fprintf(w, "Run without arguments, hidden %s prints its usage.\n", roff(name))
+	flagSection(w, name)
+	environmentSection(w)
+	fmt.Fprintln(w, ".SH SEE ALSO")
+	fmt.Fprintln(w, ".BR hidden (1)")
+}
+
+// flagSection writes the OPTIONS of a man page, the flags of command.
+func flagSection(w io.Writer, command string) {
+	fmt.Fprintln(w, ".SH OPTIONS")
+	for _, f := range describeFlags(command) {
+		fmt.Fprintln(w, ".TP")
+		if f.value != "" {
+			fmt.Fprintf(w, ".BI %s \" %s\"\n", roff("-"+f.name), roff(f.value))
+		} else {
+			fmt.Fprintf(w, ".B %s\n", roff("-"+f.name))
+		}
+		fmt.Fprintln(w, roff(f.usage))
+	}
+}
+
+// environmentSection writes the ENVIRONMENT and FILES of a man page, where
+// the flags not given come from.
+func environmentSection(w io.Writer) {
+	fmt.Fprintln(w, ".SH ENVIRONMENT")
+	fmt.Fprintln(w, ".TP")
+	fmt.Fprintf(w, ".B %s\n", roff(envPrefix+"<FLAG>"))
+	fmt.Fprintf(w, "The value of a flag that is not given, like %s for \\-chunk\\-size.\n", roff(envPrefix+"CHUNK_SIZE"))
+	fmt.Fprintln(w, ".SH FILES")
+	fmt.Fprintln(w, ".TP")
+	fmt.Fprintf(w, ".I %s\n", roff(displayPath(defaultConfigFile())))
+	fmt.Fprintln(w, "Defaults of the flags neither given nor in the environment, see \\-config.")
+}
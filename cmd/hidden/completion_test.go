@@ -0,0 +1,65 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestDescribeFlags checks that the flags of every command are listed once,
+// with those of the config file, and that the classic flags can be listed
+// more than once.
+func TestDescribeFlags(t *testing.T) {
+	for _, name := range append(commandNames(), "", "") {
+		seen := map[string]bool{}
+		for _, f := range describeFlags(name) {
+			if seen[f.name] {
+				t.Errorf("%q: -%s is listed twice", name, f.name)
+			}
+			seen[f.name] = true
+		}
+		if !seen["config"] || !seen["no-config"] {
+			t.Errorf("%q: -config or -no-config is missing", name)
+		}
+	}
+	for name, want := range map[string]string{"": "encode", "docs": "out-dir", "serve": "token-file"} {
+		var found bool
+		for _, f := range describeFlags(name) {
+			found = found || f.name == want
+		}
+		if !found {
+			t.Errorf("%q: -%s is missing", name, want)
+		}
+	}
+}
+
+func TestManPages(t *testing.T) {
+	var buf bytes.Buffer
+	mainPage(&buf, "January 2017")
+	for _, name := range commandNames() {
+		if !strings.Contains(buf.String(), ".B "+roff(name)+"\n") {
+			t.Errorf("hidden.1 does not list %s", name)
+		}
+	}
+
+	buf.Reset()
+	commandPage(&buf, "docs", "January 2017")
+	if n := strings.Count(buf.String(), `.BI \-out\-dir`); n != 1 {
+		t.Errorf("hidden-docs.1 lists -out-dir %d times", n)
+	}
+}
@@ -0,0 +1,324 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// envPrefix starts the environment variable of every flag, like
+// HIDDEN_CHUNK_SIZE for -chunk-size.
+const envPrefix = "HIDDEN_"
+
+// configFlags are the flags of where the defaults of the other flags come
+// from.
+type configFlags struct {
+	file *string
+	none *bool
+}
+
+// defineConfigFlags defines -config and -no-config in fs.
+func defineConfigFlags(fs *flag.FlagSet) *configFlags {
+	return &configFlags{
+		file: fs.String("config", "", "TOML file of flag defaults. (default "+displayPath(defaultConfigFile())+")"),
+		none: fs.Bool("no-config", false, "Do not read the config file."),
+	}
+}
+
+// parseFlags parses args into fs, and sets the flags they leave out from the
+// environment and the config file in the table named like fs.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	cfg := defineConfigFlags(fs)
+	fs.Parse(args)
+	if err := cfg.apply(fs, fs.Name()); err != nil {
+		fatal(err)
+	}
+}
+
+// apply sets the flags of fs not given on the command line from their
+// environment variables, and then those still not set from the top level
+// keys of the config file and the keys of its table section. A key of the
+// table no flag of fs has is an error, one at the top level belongs to
+// another command.
+func (c *configFlags) apply(fs *flag.FlagSet, section string) error {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		env := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if v, ok := os.LookupEnv(env); ok {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("$%s: %v", env, e)
+			}
+			given[f.Name] = true
+		}
+	})
+	if err != nil || *c.none {
+		return err
+	}
+
+	name, required := *c.file, true
+	if name == "" {
+		name, required = defaultConfigFile(), false
+	}
+	if name == "" {
+		return nil
+	}
+	cfg, err := readConfig(name)
+	if os.IsNotExist(err) && !required {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return cfg.apply(fs, section, given)
+}
+
+// defaultConfigFile returns the config file read without -config,
+// hidden/config.toml in the user config directory, or nothing if there is
+// none.
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "hidden", "config.toml")
+}
+
+// displayPath returns file with the home directory as ~.
+func displayPath(file string) string {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" || !strings.HasPrefix(file, home+string(filepath.Separator)) {
+		return file
+	}
+	return "~" + file[len(home):]
+}
+
+// config is a parsed config file: the values of the top level keys, under
+// the table "", and of the keys of every table.
+type config struct {
+	file   string
+	tables map[string]map[string]configValue
+}
+
+// configValue is the value of a key as flag values, one for every element
+// of an array, and the line it is on.
+type configValue struct {
+	values []string
+	line   int
+}
+
+// apply sets the flags of fs that given does not hold from the top level
+// keys of c and, overriding those, from the keys of table section.
+func (c *config) apply(fs *flag.FlagSet, section string, given map[string]bool) error {
+	values := map[string]configValue{}
+	for key, v := range c.tables[""] {
+		if fs.Lookup(key) != nil {
+			values[key] = v
+		}
+	}
+	for key, v := range c.tables[section] {
+		if fs.Lookup(key) == nil {
+			return fmt.Errorf("%s:%d: hidden %s has no flag -%s", c.file, v.line, section, key)
+		}
+		values[key] = v
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if given[key] {
+			continue
+		}
+		v := values[key]
+		for _, s := range v.values {
+			if err := fs.Set(key, s); err != nil {
+				return fmt.Errorf("%s:%d: -%s: %v", c.file, v.line, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// readConfig reads the config file name.
+func readConfig(name string) (*config, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseConfig(name, f)
+}
+
+// parseConfig parses the subset of TOML a config file of flags needs: tables
+// of bare keys whose values are strings, numbers, booleans or arrays of
+// them on one line. A string starting with ~/ is relative to the home
+// directory.
+func parseConfig(file string, r io.Reader) (*config, error) {
+	c := &config{file: file, tables: map[string]map[string]configValue{"": {}}}
+	table := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fail := func(format string, v ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", file, n, fmt.Sprintf(format, v...))
+		}
+
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 || strings.HasPrefix(line, "[[") || !isComment(line[end+1:]) {
+				return nil, fail("invalid table header %s", line)
+			}
+			table = strings.TrimSpace(line[1:end])
+			if !isBareKey(table) {
+				return nil, fail("invalid table name %q", table)
+			}
+			if _, ok := c.tables[table]; ok {
+				return nil, fail("table [%s] is defined twice", table)
+			}
+			c.tables[table] = map[string]configValue{}
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fail("expected key = value")
+		}
+		key := strings.TrimSpace(line[:eq])
+		if !isBareKey(key) {
+			return nil, fail("invalid key %q", key)
+		}
+		if _, ok := c.tables[table][key]; ok {
+			return nil, fail("%s is defined twice", key)
+		}
+		values, rest, err := parseConfigValue(strings.TrimSpace(line[eq+1:]), true)
+		if err != nil {
+			return nil, fail("%s: %v", key, err)
+		}
+		if !isComment(rest) {
+			return nil, fail("%s: unexpected %s after the value", key, strings.TrimSpace(rest))
+		}
+		c.tables[table][key] = configValue{values, n}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseConfigValue parses the value at the start of s, an array only if
+// array is set, and returns it as flag values and the rest of s.
+func parseConfigValue(s string, array bool) ([]string, string, error) {
+	switch {
+	case s == "":
+		return nil, "", fmt.Errorf("missing value")
+	case s[0] == '[' && array:
+		var values []string
+		s = strings.TrimSpace(s[1:])
+		for !strings.HasPrefix(s, "]") {
+			v, rest, err := parseConfigValue(s, false)
+			if err != nil {
+				return nil, "", err
+			}
+			values = append(values, v...)
+			if s = strings.TrimSpace(rest); strings.HasPrefix(s, ",") {
+				s = strings.TrimSpace(s[1:])
+			} else if !strings.HasPrefix(s, "]") {
+				return nil, "", fmt.Errorf("unterminated array")
+			}
+		}
+		return values, s[1:], nil
+	case s[0] == '"':
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		v, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid string %s", s[:end+1])
+		}
+		return []string{expandHome(v)}, s[end+1:], nil
+	case s[0] == '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		return []string{expandHome(s[1 : end+1])}, s[end+2:], nil
+	}
+
+	end := strings.IndexAny(s, " \t,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	v := strings.Replace(s[:end], "_", "", -1)
+	if _, err := strconv.ParseFloat(v, 64); err != nil && v != "true" && v != "false" {
+		return nil, "", fmt.Errorf("invalid value %s, quote a string", s[:end])
+	}
+	return []string{v}, s[end:], nil
+}
+
+// expandHome returns s with a leading ~/ replaced by the home directory.
+func expandHome(s string) string {
+	if !strings.HasPrefix(s, "~/") {
+		return s
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return s
+	}
+	return filepath.Join(home, s[2:])
+}
+
+// isBareKey reports whether s is a bare TOML key, which flag names are.
+func isBareKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// isComment reports whether s is nothing but white space and a comment.
+func isComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
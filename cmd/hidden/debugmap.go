@@ -0,0 +1,71 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// debugMap returns a gray image the size of cover where every pixel is as
+// bright as the number of its samples, 0 to 4, that differ in stego. 16 bit
+// samples count as changed if either byte is.
+func debugMap(cover, stego image.Image) (*image.Gray, error) {
+	a, b := cover.Bounds(), stego.Bounds()
+	if a.Dx() != b.Dx() || a.Dy() != b.Dy() {
+		return nil, fmt.Errorf("image dimensions differ: %dx%d and %dx%d", a.Dx(), a.Dy(), b.Dx(), b.Dy())
+	}
+
+	m := image.NewGray(image.Rect(0, 0, a.Dx(), a.Dy()))
+	for y := 0; y < a.Dy(); y++ {
+		for x := 0; x < a.Dx(); x++ {
+			var (
+				ca = color.RGBA64Model.Convert(cover.At(a.Min.X+x, a.Min.Y+y)).(color.RGBA64)
+				cb = color.RGBA64Model.Convert(stego.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA64)
+				n  int
+			)
+			for _, d := range [4]bool{ca.R != cb.R, ca.G != cb.G, ca.B != cb.B, ca.A != cb.A} {
+				if d {
+					n++
+				}
+			}
+			m.Pix[y*m.Stride+x] = uint8(n * 255 / 4)
+		}
+	}
+	return m, nil
+}
+
+// writeDebugMap writes the debugMap of an encode to file as a PNG. It shows
+// where the message is, so it is only ever written when asked for.
+func writeDebugMap(file string, cover, stego image.Image) error {
+	m, err := debugMap(cover, stego)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, m); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(file, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	logger.Info("Wrote debug map to " + file)
+	return nil
+}
@@ -0,0 +1,191 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// TestDecodeMode checks the permissions decoded messages are written with:
+// 0600 unless -mode says otherwise, whatever those of the encoded file or
+// of the file replaced were.
+func TestDecodeMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no permission bits")
+	}
+
+	dir := t.TempDir()
+	msg := testMessage(1000, 1)
+	fmsg := writeTestFile(t, dir, "message.bin", msg)
+	if err := os.Chmod(fmsg, 0755); err != nil {
+		t.Fatal(err)
+	}
+	stego := filepath.Join(dir, "stego.png")
+	if err := encode(writeTestImage(t, "cover.png", testCover(100, 100, 1)), stego, fmsg, encodeOptions{fileInfo: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(mode fileMode, f bool) { outputMode, force = mode, f }(outputMode, force)
+	for _, c := range []struct {
+		name     string
+		mode     fileMode
+		existing os.FileMode
+	}{
+		{"default", 0600, 0},
+		{"mode", 0640, 0},
+		{"replaced", 0600, 0644},
+		{"replaced with mode", 0604, 0600},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "decoded.bin")
+			if c.existing != 0 {
+				if err := ioutil.WriteFile(out, nil, c.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+			outputMode, force = c.mode, c.existing != 0
+			if err := decode(stego, out, decodeOptions{library: &hidden.Options{}}); err != nil {
+				t.Fatal(err)
+			}
+
+			fi, err := os.Stat(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fi.Mode().Perm(); got != os.FileMode(c.mode) {
+				t.Errorf("decoded message has mode %#o, want %#o", got, c.mode)
+			}
+			if got, _ := ioutil.ReadFile(out); !bytes.Equal(got, msg) {
+				t.Error("decoded message differs")
+			}
+		})
+	}
+}
+
+// testTar returns a tar archive of one file, name, holding data.
+func testTar(t *testing.T, name string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestDecodeTar encodes a single file that is a tar archive, which decodes
+// to the file as it was, with or without its name, rather than being
+// unpacked like a bundle.
+func TestDecodeTar(t *testing.T) {
+	dir := t.TempDir()
+	archive := testTar(t, "d/a.txt", []byte("not a bundle\n"))
+	fmsg := writeTestFile(t, dir, "backup.tar", archive)
+
+	for _, c := range []struct {
+		name     string
+		fileInfo bool
+		want     string
+	}{
+		{"file info", true, "backup.tar"},
+		{"no file info", false, "message.tar"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			stego := filepath.Join(t.TempDir(), "stego.png")
+			if err := encode(writeTestImage(t, "cover.png", testCover(100, 100, 2)), stego, fmsg, encodeOptions{fileInfo: c.fileInfo}); err != nil {
+				t.Fatal(err)
+			}
+			if err := decode(stego, "", decodeOptions{library: &hidden.Options{}}); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, err := ioutil.ReadFile(filepath.Join(filepath.Dir(stego), c.want)); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(got, archive) {
+				t.Errorf("%s differs from the archive", c.want)
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(stego), "message")); !os.IsNotExist(err) {
+				t.Errorf("the archive was unpacked: %v", err)
+			}
+		})
+	}
+}
+
+// TestDecodeBundle encodes a directory as a bundle, which is unpacked with
+// only the owner bits of the permissions of its files, or all of them with
+// -keep-modes.
+func TestDecodeBundle(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no permission bits")
+	}
+
+	src := filepath.Join(t.TempDir(), "d")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fmsg := writeTestFile(t, src, "a.txt", []byte("the bundled file\n"))
+	if err := os.Chmod(fmsg, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stego := filepath.Join(t.TempDir(), "stego.png")
+	if err := encode(writeTestImage(t, "cover.png", testCover(100, 100, 3)), stego, "", encodeOptions{bundle: []string{src}}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(keep bool) { keepModes = keep }(keepModes)
+	for _, c := range []struct {
+		name      string
+		keep      bool
+		file, dir os.FileMode
+	}{
+		{"default", false, 0600, 0700},
+		{"keep modes", true, 0644, 0755},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			out := t.TempDir() + "/"
+			keepModes = c.keep
+			if err := decode(stego, out, decodeOptions{library: &hidden.Options{}}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, e := range []struct {
+				name string
+				want os.FileMode
+			}{{"d/a.txt", c.file}, {"d", c.dir}} {
+				fi, err := os.Stat(filepath.Join(out, e.name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := fi.Mode().Perm(); got != e.want {
+					t.Errorf("%s has mode %#o, want %#o", e.name, got, e.want)
+				}
+			}
+		})
+	}
+}
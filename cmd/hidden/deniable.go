@@ -0,0 +1,105 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/andreas-jonsson/hidden"
+	"golang.org/x/term"
+)
+
+// hiddenFlags name the second message of a deniable encode, which is found
+// with a passphrase of its own instead of the one of -msg.
+type hiddenFlags struct {
+	msg  *string
+	file *string
+	env  *string
+}
+
+// defineHiddenFlags defines -hidden, -hidden-passphrase-file and
+// -hidden-passphrase-env in fs.
+func defineHiddenFlags(fs *flag.FlagSet) *hiddenFlags {
+	return &hiddenFlags{
+		msg:  fs.String("hidden", "", "Second message, hidden behind -msg."),
+		file: fs.String("hidden-passphrase-file", "", "File holding the passphrase of -hidden."),
+		env:  fs.String("hidden-passphrase-env", "", "Environment variable holding the passphrase of -hidden."),
+	}
+}
+
+// apply reads the second message and its passphrase into opt, which stores
+// the first one in a Deniable placement then.
+func (f *hiddenFlags) apply(opt *encodeOptions) error {
+	if *f.msg == "" {
+		return nil
+	}
+	if len(opt.passphrase) == 0 {
+		return errors.New("-hidden needs -encrypt, the passphrase of the decoy message")
+	}
+	if opt.placement != nil {
+		return errors.New("-hidden decides where the messages go, it can not be combined with -permute or -adaptive")
+	}
+
+	msg, err := readMessage(*f.msg, fetchMaxSize)
+	if err != nil {
+		return err
+	}
+	passphrase, err := f.passphrase()
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(passphrase, opt.passphrase) {
+		return errors.New("the hidden message needs a passphrase of its own")
+	}
+	opt.hiddenPayload = &hidden.HiddenPayload{Passphrase: passphrase, Payload: secret(msg)}
+
+	var p hidden.Deniable
+	if p.Salt, err = salt(opt); err != nil {
+		return err
+	}
+	opt.placement = p
+	return nil
+}
+
+// passphrase returns the passphrase of the second message, from its flags
+// or the terminal.
+func (f *hiddenFlags) passphrase() ([]byte, error) {
+	src := &passphraseSource{file: f.file, env: f.env, fd: new(int)}
+	*src.fd = -1
+	if src.given() {
+		passphrase, err := src.read()
+		return secret(passphrase), err
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, errors.New("the hidden message needs a passphrase, use -hidden-passphrase-file or -hidden-passphrase-env")
+	}
+	passphrase, err := promptPassphrase("Hidden passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	again, err := promptPassphrase("Repeat hidden passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, again) {
+		return nil, errors.New("the passphrases do not match")
+	}
+	return passphrase, nil
+}
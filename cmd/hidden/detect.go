@@ -0,0 +1,245 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// RS analysis from Fridrich, Goljan and Du, "Reliable Detection of LSB
+// Steganography in Color and Grayscale Images" (2001). Groups of adjacent
+// samples of a channel are classified by whether flipping the LSBs under a
+// mask makes them noisier, regular, or smoother, singular. In a natural
+// image flipping does so with either sign of the flip alike, LSB embedding
+// tips the balance in proportion to how much of the image it covers, which
+// is what the estimate solves for. It also finds messages scattered over
+// the image, which the chi-square attack misses.
+var rsMask = [...]bool{false, true, true, false}
+
+// RS estimates of the embedded fraction of samples, and chi-square
+// probabilities, at which an image is reported as carrying a message.
+const (
+	rsLikely      = 0.1
+	rsPossibly    = 0.03
+	chiSquareSure = 0.95
+)
+
+type detectReport struct {
+	Samples int `json:"samples"`
+
+	ChiSquareProbability float64 `json:"chi_square_probability"`
+	ChiSquareBytes       int     `json:"chi_square_bytes"`
+
+	// RSRates are the estimated embedded fractions of the red, green and
+	// blue samples.
+	RSRates [3]float64 `json:"rs_rates"`
+	RSBytes int        `json:"rs_bytes"`
+
+	// Message is set if the image holds a header this tool wrote.
+	Message *detectMessage `json:"message,omitempty"`
+
+	Verdict string `json:"verdict"`
+}
+
+type detectMessage struct {
+	Size   int    `json:"size,omitempty"`
+	Format string `json:"format,omitempty"`
+	Keyed  bool   `json:"keyed,omitempty"`
+}
+
+func detectCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("detect", flag.ExitOnError)
+	asJSON := jsonFlag(fs, "Output in JSON format.")
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() != 1 {
+			commandUsage(fs, "detect [flags] <image>")
+		}
+
+		img, err := loadImage(fs.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+		report := detect(img)
+		if *asJSON {
+			printJSON(&report)
+			return
+		}
+
+		fmt.Printf("Samples analyzed: %d\n", report.Samples)
+		fmt.Printf("Chi-square probability: %.1f%%, ~%d bytes from the top\n", report.ChiSquareProbability*100, report.ChiSquareBytes)
+		fmt.Printf("RS estimate: %.1f%% of samples (r %.1f%%, g %.1f%%, b %.1f%%), ~%d bytes\n",
+			rsMean(report.RSRates)*100, report.RSRates[0]*100, report.RSRates[1]*100, report.RSRates[2]*100, report.RSBytes)
+		if m := report.Message; m != nil {
+			if m.Keyed {
+				fmt.Println("Message: header of a keyed message, the passphrase is needed to read it")
+			} else {
+				fmt.Printf("Message: %d bytes, %s\n", m.Size, m.Format)
+			}
+		}
+		fmt.Println("Verdict:", report.Verdict)
+	}
+}
+
+// detect runs the chi-square and RS attacks on img, and looks for a message
+// this tool wrote.
+func detect(img image.Image) detectReport {
+	samples := storedSamples(img)
+	chi := chiSquareAnalyze(samples, 0)
+
+	report := detectReport{
+		Samples:              chi.Samples,
+		ChiSquareProbability: chi.Probability,
+		ChiSquareBytes:       chi.EstimatedBytes,
+	}
+	for c := range report.RSRates {
+		report.RSRates[c] = rsEstimate(samples, c)
+	}
+	report.RSBytes = int(rsMean(report.RSRates) * float64(report.Samples) / 8)
+
+	switch size, format, err := hidden.Detect(img); err {
+	case nil:
+		report.Message = &detectMessage{Size: size, Format: format}
+	case hidden.ErrPassphraseRequired:
+		report.Message = &detectMessage{Keyed: true}
+	}
+
+	rs := rsMean(report.RSRates)
+	switch {
+	case report.Message != nil:
+		report.Verdict = "contains a message hidden by this tool"
+	case chi.Probability >= chiSquareSure || rs >= rsLikely:
+		report.Verdict = "likely contains LSB embedding"
+	case chi.Probability >= chiSquareThreshold || rs >= rsPossibly:
+		report.Verdict = "possibly contains LSB embedding"
+	default:
+		report.Verdict = "no evidence of LSB embedding"
+	}
+	return report
+}
+
+// storedSamples is toRGBA that keeps the samples of an *image.NRGBA as they
+// are, premultiplying would destroy their LSBs.
+func storedSamples(img image.Image) *image.RGBA {
+	if m, ok := img.(*image.NRGBA); ok {
+		return &image.RGBA{Pix: m.Pix, Stride: m.Stride, Rect: m.Rect}
+	}
+	return toRGBA(img)
+}
+
+func rsMean(rates [3]float64) float64 {
+	return (rates[0] + rates[1] + rates[2]) / 3
+}
+
+// rsEstimate returns the estimated fraction of the samples of channel c of
+// img that carry embedded bits, between 0 and 1.
+func rsEstimate(img *image.RGBA, c int) float64 {
+	rm, sm, rn, sn := rsCount(img, c, false)
+	rm1, sm1, rn1, sn1 := rsCount(img, c, true)
+
+	d0, d1 := rm-sm, rm1-sm1
+	n0, n1 := rn-sn, rn1-sn1
+	a, b, k := 2*(d1+d0), n0-n1-d1-3*d0, d0-n0
+
+	var x float64
+	switch {
+	case a == 0 && b == 0:
+		return 0
+	case a == 0:
+		x = -k / b
+	default:
+		disc := math.Sqrt(math.Max(b*b-4*a*k, 0))
+		x1, x2 := (-b+disc)/(2*a), (-b-disc)/(2*a)
+		x = x1
+		if math.Abs(x2) < math.Abs(x1) {
+			x = x2
+		}
+	}
+	p := x / (x - 0.5)
+	if math.IsNaN(p) || p < 0 {
+		return 0
+	}
+	return math.Min(p, 1)
+}
+
+// rsCount returns the fractions of regular and singular groups of channel c
+// under the mask and the negated mask, with every LSB flipped first if flip
+// is set.
+func rsCount(img *image.RGBA, c int, flip bool) (rm, sm, rn, sn float64) {
+	var (
+		g      [len(rsMask)]int
+		groups int
+		b      = img.Bounds()
+	)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x+len(g) <= b.Max.X; x += len(g) {
+			off := img.PixOffset(x, y) + c
+			for i := range g {
+				g[i] = int(img.Pix[off+4*i])
+				if flip {
+					g[i] ^= 1
+				}
+			}
+
+			f := smoothness(g[:])
+			pos, neg := g, g
+			for i, m := range rsMask {
+				if m {
+					pos[i] ^= 1
+					neg[i] = (neg[i] + 1) ^ 1 - 1
+				}
+			}
+			switch fp := smoothness(pos[:]); {
+			case fp > f:
+				rm++
+			case fp < f:
+				sm++
+			}
+			switch fn := smoothness(neg[:]); {
+			case fn > f:
+				rn++
+			case fn < f:
+				sn++
+			}
+			groups++
+		}
+	}
+	if groups == 0 {
+		return 0, 0, 0, 0
+	}
+	n := float64(groups)
+	return rm / n, sm / n, rn / n, sn / n
+}
+
+// smoothness is the discrimination function of RS analysis, the sum of the
+// differences between neighbors, larger for noisier groups.
+func smoothness(g []int) int {
+	var f int
+	for i := 1; i < len(g); i++ {
+		d := g[i] - g[i-1]
+		if d < 0 {
+			d = -d
+		}
+		f += d
+	}
+	return f
+}
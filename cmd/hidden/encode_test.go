@@ -0,0 +1,266 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// decodeTestImage decodes the message of the image in file.
+func decodeTestImage(t *testing.T, file string, opt *hidden.Options) []byte {
+	t.Helper()
+	img, err := loadImage(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := hidden.Decode(img, opt)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", file, err)
+	}
+	return msg
+}
+
+// TestEncodeStacked encodes into an image that already carries a message,
+// which is refused without -overwrite-message and replaces the message
+// whole with it.
+func TestEncodeStacked(t *testing.T) {
+	dir := t.TempDir()
+	cover := writeTestImage(t, "cover.bmp", testCover(200, 100, 3))
+	first := writeTestFile(t, dir, "first.bin", testMessage(3000, 3))
+	second := writeTestFile(t, dir, "second.bin", testMessage(1000, 4))
+
+	once := filepath.Join(dir, "once.bmp")
+	if err := encode(cover, once, first, encodeOptions{verify: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	twice := filepath.Join(dir, "twice.bmp")
+	err := encode(once, twice, second, encodeOptions{verify: true})
+	if err == nil || !strings.Contains(err.Error(), "already contains a hidden message of 3000 bytes") {
+		t.Fatalf("encoding over a message: got %v, want it refused with its size", err)
+	}
+	if got := decodeTestImage(t, once, nil); !bytes.Equal(got, testMessage(3000, 3)) {
+		t.Error("the refused encode changed the first image")
+	}
+
+	if err := encode(once, twice, second, encodeOptions{verify: true, overwrite: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := decodeTestImage(t, twice, nil); !bytes.Equal(got, testMessage(1000, 4)) {
+		t.Errorf("decoded %d bytes that are not the second message", len(got))
+	}
+}
+
+// TestEncodeSeed encodes an encrypted message twice with the same -seed and
+// -deterministic, which gives the same file, and with another seed or
+// without -deterministic, which does not.
+func TestEncodeSeed(t *testing.T) {
+	dir := t.TempDir()
+	cover := writeTestImage(t, "cover.bmp", testCover(120, 80, 137))
+	msg := writeTestFile(t, dir, "msg.bin", testMessage(500, 137))
+
+	encoded := func(name string, opt encodeOptions) []byte {
+		t.Helper()
+		out := filepath.Join(dir, name)
+		opt.passphrase = []byte("pass")
+		if err := encode(cover, out, msg, opt); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	a := encoded("a.bmp", encodeOptions{seed: 137, deterministic: true})
+	if b := encoded("b.bmp", encodeOptions{seed: 137, deterministic: true}); !bytes.Equal(a, b) {
+		t.Error("the same seed gave different files")
+	}
+	if b := encoded("c.bmp", encodeOptions{seed: 138, deterministic: true}); bytes.Equal(a, b) {
+		t.Error("another seed gave the same file")
+	}
+	if b := encoded("d.bmp", encodeOptions{seed: 137}); bytes.Equal(a, b) {
+		t.Error("the same seed without -deterministic gave the same file")
+	}
+	if got := decodeTestImage(t, filepath.Join(dir, "a.bmp"), &hidden.Options{Passphrase: []byte("pass")}); !bytes.Equal(got, testMessage(500, 137)) {
+		t.Errorf("decoded %d bytes that are not the message", len(got))
+	}
+}
+
+// TestEncodeWide encodes a 16 bit PNG cover into a PNG that is still 16 bit.
+func TestEncodeWide(t *testing.T) {
+	dir := t.TempDir()
+	wide := image.NewNRGBA64(image.Rect(0, 0, 120, 80))
+	copy(wide.Pix, testMessage(len(wide.Pix), 147))
+	cover := writeTestImage(t, "cover.png", wide)
+	msg := writeTestFile(t, dir, "msg.bin", testMessage(1000, 147))
+
+	out := filepath.Join(dir, "out.png")
+	if err := encode(cover, out, msg, encodeOptions{verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := loadImage(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := img.(*image.NRGBA64); !ok {
+		t.Errorf("encoded a 16 bit cover into a %T", img)
+	}
+	if got := decodeTestImage(t, out, nil); !bytes.Equal(got, testMessage(1000, 147)) {
+		t.Errorf("decoded %d bytes that are not the message", len(got))
+	}
+}
+
+// TestEncodeDepth encodes with -depth b:3, which must leave red and green
+// alone, and checks the dry run breaks the changes down by channel.
+func TestEncodeDepth(t *testing.T) {
+	dir := t.TempDir()
+	cover := writeTestImage(t, "cover.png", testCover(120, 80, 156))
+	msg := writeTestFile(t, dir, "msg.bin", testMessage(2500, 156))
+	depth, err := hidden.ParseChannelDepth("b:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "out.png")
+	if err := encode(cover, out, msg, encodeOptions{depth: depth, verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := decodeTestImage(t, out, nil); !bytes.Equal(got, testMessage(2500, 156)) {
+		t.Errorf("decoded %d bytes that are not the message", len(got))
+	}
+	src, err := loadImage(cover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stego, err := loadImage(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, samples, err := changedSamples(src, stego)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed[0] != 0 || changed[1] != 0 || changed[2] == 0 || samples != 3*120*80 {
+		t.Errorf("changed %v of %d samples, want only blue", changed, samples)
+	}
+
+	var buf bytes.Buffer
+	saved := info
+	info = &buf
+	defer func() { info = saved }()
+	dry := filepath.Join(dir, "dry.png")
+	if err := encode(cover, dry, msg, encodeOptions{depth: depth, dryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dry); !os.IsNotExist(err) {
+		t.Errorf("the dry run wrote %s", dry)
+	}
+	for _, want := range []string{"  R: 0 of 9600 (0.00%)", "  G: 0 of 9600 (0.00%)", fmt.Sprintf("  B: %d of 9600", changed[2])} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("dry run output %q has no %q", buf.String(), want)
+		}
+	}
+}
+
+// TestCompressFlag checks that -compress takes the registered methods, and
+// only those, and that decoding finds the method in the header.
+func TestCompressFlag(t *testing.T) {
+	fs := flag.NewFlagSet("encode", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	f := compressFlag(fs)
+	if usage := fs.Lookup("compress").Usage; !strings.HasSuffix(usage, ": deflate, gzip, zstd.") {
+		t.Errorf("usage %q does not list deflate, gzip and zstd", usage)
+	}
+	err := fs.Parse([]string{"-compress", "brotli"})
+	if err == nil || !strings.Contains(err.Error(), `unknown compression "brotli", expected one of deflate, gzip, zstd`) {
+		t.Errorf("-compress brotli: got %v", err)
+	}
+
+	dir := t.TempDir()
+	cover := writeTestImage(t, "cover.png", testCover(120, 80, 259))
+	text := bytes.Repeat([]byte("a message that compresses well. "), 100)
+	msg := writeTestFile(t, dir, "msg.txt", text)
+	for _, name := range []string{"deflate", "gzip", "zstd"} {
+		if err := fs.Parse([]string{"-compress", name}); err != nil {
+			t.Fatal(err)
+		}
+		out := filepath.Join(dir, name+".png")
+		if err := encode(cover, out, msg, encodeOptions{compression: f.Compression}); err != nil {
+			t.Fatal(err)
+		}
+		if got := decodeTestImage(t, out, nil); !bytes.Equal(got, text) {
+			t.Errorf("%s: decoded %d bytes that are not the message", name, len(got))
+		}
+		img, err := loadImage(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := hidden.DecodeHeader(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, ok := h.Field(hidden.FieldCompression)
+		if c, _ := hidden.LookupCompression(name); !ok || len(v) == 0 || v[0] != c.ID() || h.Length >= len(text)/3 {
+			t.Errorf("%s: stored %d bytes, compression field % x", name, h.Length, v)
+		}
+	}
+}
+
+// TestEncodeFetchedMessage encodes messages fetched from a URL, which are
+// read no further than the capacity of the cover, except for an adaptive
+// placement whose capacity depends on the pixels.
+func TestEncodeFetchedMessage(t *testing.T) {
+	text := testMessage(500, 280)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(text)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cover := writeTestImage(t, "cover.png", testCover(120, 80, 280))
+	for name, opt := range map[string]encodeOptions{
+		"sequential": {},
+		"adaptive":   {placement: hidden.Adaptive{Threshold: 4}},
+	} {
+		out := filepath.Join(dir, name+".png")
+		if err := encode(cover, out, srv.URL+"/msg.txt", opt); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := decodeTestImage(t, out, nil); !bytes.Equal(got, text) {
+			t.Errorf("%s: decoded %d bytes that are not the message", name, len(got))
+		}
+	}
+
+	small := writeTestImage(t, "small.png", testCover(20, 20, 280))
+	err := encode(small, filepath.Join(dir, "small-out.png"), srv.URL+"/msg.txt", encodeOptions{})
+	if err == nil || !strings.Contains(err.Error(), "byte limit") {
+		t.Errorf("fetching more than the cover holds: got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// excludeFlags are the rectangles of -region and -skip-rows, in the order
+// they were given.
+type excludeFlags []image.Rectangle
+
+// regionFlag is a flag.Value for -region: a rectangle like 10,20,100,50,
+// the x and y of its top left pixel, its width and its height.
+type regionFlag struct{ rects *excludeFlags }
+
+func (f regionFlag) String() string {
+	if f.rects == nil {
+		return ""
+	}
+	var s []string
+	for _, r := range *f.rects {
+		if r.Max.X != math.MaxInt32 {
+			s = append(s, fmt.Sprintf("%d,%d,%d,%d", r.Min.X, r.Min.Y, r.Dx(), r.Dy()))
+		}
+	}
+	return strings.Join(s, " ")
+}
+
+func (f regionFlag) Set(s string) error {
+	var v [4]int
+	parts := strings.Split(s, ",")
+	if len(parts) != len(v) {
+		return fmt.Errorf("expected a region like 10,20,100,50")
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || n < 0 || n > math.MaxInt32/2 || i >= 2 && n == 0 {
+			return fmt.Errorf("expected a region like 10,20,100,50")
+		}
+		v[i] = n
+	}
+	*f.rects = append(*f.rects, image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]))
+	return nil
+}
+
+// skipRowsFlag is a flag.Value for -skip-rows: the rows from the first up
+// to the last, which is not skipped, like 0:50. Each is a rectangle as wide
+// as any image.
+type skipRowsFlag struct{ rects *excludeFlags }
+
+func (f skipRowsFlag) String() string {
+	if f.rects == nil {
+		return ""
+	}
+	var s []string
+	for _, r := range *f.rects {
+		if r.Max.X == math.MaxInt32 {
+			s = append(s, fmt.Sprintf("%d:%d", r.Min.Y, r.Max.Y))
+		}
+	}
+	return strings.Join(s, " ")
+}
+
+func (f skipRowsFlag) Set(s string) error {
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 {
+		from, ferr := strconv.Atoi(parts[0])
+		to, terr := strconv.Atoi(parts[1])
+		if ferr == nil && terr == nil && from >= 0 && to > from && to <= math.MaxInt32 {
+			*f.rects = append(*f.rects, image.Rect(0, from, math.MaxInt32, to))
+			return nil
+		}
+	}
+	return fmt.Errorf("expected rows like 0:50")
+}
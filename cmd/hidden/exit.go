@@ -0,0 +1,67 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// Exit codes, so scripts can tell why hidden failed. Bad flags exit with
+// exitUsage like the flag package does.
+const (
+	exitFailure   = 1 // anything not listed below
+	exitUsage     = 2 // bad or conflicting flags and arguments
+	exitNoMessage = 3 // the image holds no message
+	exitIO        = 4 // reading or writing a file, or fetching a URL, failed
+	exitCorrupt   = 5 // the message is damaged, tampered with or the passphrase is wrong
+)
+
+// usageError is an error in how hidden was called.
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+// usagef returns a usageError, formatted like fmt.Sprintf.
+func usagef(format string, args ...interface{}) error {
+	return &usageError{fmt.Sprintf(format, args...)}
+}
+
+// exitCode returns the exit code hidden fails with for err.
+func exitCode(err error) int {
+	switch {
+	case errors.As(err, new(*usageError)):
+		return exitUsage
+	case errors.Is(err, hidden.ErrNoHiddenMessage), errors.Is(err, hidden.ErrNoSlot), errors.Is(err, hidden.ErrNoSlots):
+		return exitNoMessage
+	case errors.As(err, new(*hidden.ChecksumError)), errors.As(err, new(*hidden.TruncatedError)), errors.As(err, new(*hidden.FramesMissingError)), errors.Is(err, hidden.ErrDecryptionFailed),
+		errors.Is(err, hidden.ErrBadSignature), errors.Is(err, hidden.ErrModified), errors.Is(err, hidden.ErrWrongPad):
+		return exitCorrupt
+	case errors.As(err, new(*os.PathError)), errors.As(err, new(*os.LinkError)), errors.As(err, new(*os.SyscallError)),
+		errors.As(err, new(*url.Error)), errors.As(err, new(*net.OpError)):
+		return exitIO
+	}
+	return exitFailure
+}
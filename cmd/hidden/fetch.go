@@ -0,0 +1,147 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+var (
+	fetchTimeout        = 30 * time.Second
+	fetchMaxSize  int64 = 64 << 20
+	fetchInsecure bool
+)
+
+// isURL reports whether name should be fetched over HTTP instead of opened
+// as a file.
+func isURL(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// fetch gets url, following redirects, and returns the body limited to
+// limit bytes together with its media type. The whole exchange, reading the
+// body included, has to complete within fetchTimeout.
+func fetch(url string, limit int64) (io.ReadCloser, string, error) {
+	client := &http.Client{Timeout: fetchTimeout}
+	if fetchInsecure {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		client.Transport = t
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	if resp.ContentLength > limit {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("%s is %d bytes, more than the %d byte limit", url, resp.ContentLength, limit)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return &limitedBody{resp.Body, url, limit, limit}, mediaType, nil
+}
+
+// fetchImage fetches an image, refusing responses that are declared as
+// something else.
+func fetchImage(url string) (io.ReadCloser, error) {
+	body, mediaType, err := fetch(url, fetchMaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case mediaType == "", strings.HasPrefix(mediaType, "image/"):
+	case mediaType == "application/octet-stream", mediaType == "binary/octet-stream":
+	default:
+		body.Close()
+		return nil, fmt.Errorf("%s is %s, not an image", url, mediaType)
+	}
+	return body, nil
+}
+
+// fetchMessage fetches a message of at most limit bytes.
+func fetchMessage(url string, limit int64) ([]byte, error) {
+	body, _, err := fetch(url, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// coverCapacity returns the capacity of the image in file from its header
+// alone, so that an oversized message fails before the image is decoded.
+// It is wrong for placements that depend on the pixels, like Adaptive.
+func coverCapacity(file string, opt *hidden.Options) (int, error) {
+	var (
+		fp  io.ReadCloser
+		err error
+	)
+
+	if isURL(file) {
+		fp, err = fetchImage(file)
+	} else {
+		fp, err = os.Open(file)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+
+	cfg, _, err := image.DecodeConfig(fp)
+	if err != nil {
+		return 0, err
+	}
+	// Capacity only depends on the bounds for the other placements.
+	return hidden.Capacity(&image.RGBA{Rect: image.Rect(0, 0, cfg.Width, cfg.Height)}, opt), nil
+}
+
+// limitedBody fails reads once more than n bytes have been read, unlike
+// io.LimitReader which silently truncates.
+type limitedBody struct {
+	io.ReadCloser
+	url      string
+	limit, n int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.n -= int64(n); b.n < 0 {
+		return 0, fmt.Errorf("%s is larger than the %d byte limit", b.url, b.limit)
+	}
+	return n, err
+}
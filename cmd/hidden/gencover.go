@@ -0,0 +1,132 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+func gencoverCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("gencover", flag.ExitOnError)
+	payload := fs.String("payload", "", "File with the message to size the cover for.")
+	size := fs.Int("bytes", 0, "Size the cover for a message of this many bytes, instead of -payload.")
+	kind := fs.String("kind", "clouds", "What to draw: "+strings.Join(generatorNames(), ", ")+".")
+	headroom := fs.Float64("headroom", 1, "Give the cover this many times the pixels the message needs.")
+	out := fs.String("out", "cover.png", "File to write the cover to, as a BMP or PNG by its extension.")
+	fs.BoolVar(&force, "force", false, "Overwrite -out if it exists.")
+	seed := fs.Int64("seed", 0, "Seed of the drawing, the same seed gives the same cover.")
+	checksum := checksumFlag(fs)
+	compression := compressFlag(fs)
+	var cipher cipherFlag
+	fs.Var(&cipher, "cipher", "Size for a message encrypted with this cipher.")
+	encrypt := fs.Bool("encrypt", false, "Size for an encrypted message.")
+	resync := fs.Int("resync", 0, "Size for a message stored in blocks of this many bytes behind resync markers.")
+	copies := fs.Int("copies", 0, "Size for this many copies of the resync blocks.")
+	chunkSize := fs.Int("chunk-size", 0, "Size for a message stored in chunks of this many bytes.")
+	ecc := eccFlag(fs, "Size for a message with this many parity bytes in every 255 bytes, or in Hamming codes with hamming.")
+	seal := fs.Bool("seal", false, "Size for a sealed message.")
+	depth := depthFlag(fs)
+	fileInfo := fs.Bool("file-info", true, "Size for the attributes of the -payload file stored with it, as encoding does unless given -file-info=false.")
+	metaFlags(fs)
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() != 0 || (*payload == "") == (*size == 0) || *size < 0 || *headroom < 1 {
+			commandUsage(fs, "gencover [flags] (-payload <file> | -bytes <n>) [-out <image>]")
+		}
+		if compression.Compression != nil && *payload == "" {
+			fatal(usagef("-compress needs the message in -payload, how much it shrinks depends on it"))
+		}
+
+		opt := encodeOptions{integrity: checksum.Integrity, compression: compression.Compression, blockSize: *resync, copies: *copies, chunkSize: *chunkSize, ecc: ecc.parity, hamming: ecc.hamming, seal: *seal}
+		n := *size
+		if *payload != "" {
+			msg, err := ioutil.ReadFile(*payload)
+			if err != nil {
+				fatal(err)
+			}
+			if n, err = storedSize(msg, compression.Compression); err != nil {
+				fatal(err)
+			}
+			if *fileInfo {
+				if opt.file, err = messageFile(*payload, msg); err != nil {
+					fatal(err)
+				}
+			}
+		}
+
+		if *encrypt || cipher.Cipher != nil {
+			opt.passphrase, opt.cipher = []byte("gencover"), cipher.Cipher
+		}
+		var err error
+		if opt.depth, err = depth.depth(); err != nil {
+			fatal(err)
+		}
+		if opt.meta, err = userFields(); err != nil {
+			fatal(err)
+		}
+		lib, err := opt.library()
+		if err != nil {
+			fatal(err)
+		}
+
+		dim, err := coverSize(n, *headroom, lib)
+		if err != nil {
+			fatal(err)
+		}
+		if err := checkClobber(*out); err != nil {
+			fatal(err)
+		}
+		img, err := generateCover(*kind, dim, n, *seed, lib)
+		if err != nil {
+			fatal(err)
+		}
+		if err := saveImage(*out, img, nil); err != nil {
+			fatal(err)
+		}
+		fmt.Printf("%s is %dx%d and holds %s bytes.\n", *out, dim.X, dim.Y, groupDigits(hidden.Capacity(img, lib)))
+	}
+}
+
+// storedSize returns the size of msg as Encode stores it with compression c,
+// which leaves it as it is unless that makes it smaller. The cover is sized
+// for that, with the compression field in the header.
+func storedSize(msg []byte, c hidden.Compression) (int, error) {
+	if c == nil {
+		return len(msg), nil
+	}
+	var buf bytes.Buffer
+	w, err := c.NewWriter(&buf)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	if buf.Len() < len(msg) {
+		return buf.Len(), nil
+	}
+	return len(msg), nil
+}
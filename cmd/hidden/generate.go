@@ -0,0 +1,207 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// generators synthesize covers for -generate. Each adds per-pixel noise to
+// what it draws, so the low bits are already random before a message is
+// embedded and the payload does not stand out in them.
+var generators = map[string]func(img *image.RGBA, rnd *rand.Rand){
+	"gradient": generateGradient,
+	"clouds":   generateClouds,
+	"noise":    generateNoise,
+}
+
+// generatorNames returns the names of the generators, sorted.
+func generatorNames() []string {
+	var names []string
+	for name := range generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// generateHeadroom is how much larger than needed an automatically sized
+// cover is.
+const generateHeadroom = 1.2
+
+// generateCover returns a cover drawn by the generator kind, seeded with
+// seed. Unless size is given it is a 4:3 image with generateHeadroom over
+// what a message of msgSize bytes needs with opt.
+func generateCover(kind string, size image.Point, msgSize int, seed int64, opt *hidden.Options) (*image.RGBA, error) {
+	gen, ok := generators[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown generator %q, expected one of %s", kind, strings.Join(generatorNames(), ", "))
+	}
+
+	if size == (image.Point{}) {
+		var err error
+		if size, err = coverSize(msgSize, generateHeadroom, opt); err != nil {
+			return nil, err
+		}
+	}
+	logger.Info(fmt.Sprintf("Generating a %dx%d %s cover.", size.X, size.Y, kind))
+
+	img := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	gen(img, rand.New(rand.NewSource(seed)))
+	return img, nil
+}
+
+// coverSize returns the dimensions of the smallest 4:3 image that holds a
+// message of msgSize bytes with opt, with headroom times as many pixels.
+func coverSize(msgSize int, headroom float64, opt *hidden.Options) (image.Point, error) {
+	pixels, _ := hidden.MinCarrier(msgSize, opt)
+	if pixels == 0 {
+		return image.Point{}, tooLarge(msgSize, opt)
+	}
+	w := int(math.Ceil(math.Sqrt(float64(pixels) * headroom * 4 / 3)))
+	// MinCarrier counts pixels, a 4:3 image may lose some to rounding. Like
+	// MinCarrier, count an adaptive placement as if the image were all
+	// texture, a blank image has none.
+	if _, ok := opt.Placement.(hidden.Adaptive); ok {
+		o := *opt
+		o.Placement = nil
+		opt = &o
+	}
+	for hidden.Capacity(&image.RGBA{Rect: image.Rect(0, 0, w, (w*3+3)/4)}, opt) < msgSize {
+		w++
+	}
+	return image.Pt(w, (w*3+3)/4), nil
+}
+
+// setNoisy sets the pixel at x, y to c with gaussian noise of deviation
+// sigma added to every channel.
+func setNoisy(img *image.RGBA, x, y int, c [3]float64, sigma float64, rnd *rand.Rand) {
+	i := img.PixOffset(x, y)
+	for k := 0; k < 3; k++ {
+		v := math.Round(c[k] + rnd.NormFloat64()*sigma)
+		img.Pix[i+k] = uint8(math.Max(0, math.Min(255, v)))
+	}
+	img.Pix[i+3] = 0xFF
+}
+
+func randomColor(rnd *rand.Rand) [3]float64 {
+	return [3]float64{rnd.Float64() * 255, rnd.Float64() * 255, rnd.Float64() * 255}
+}
+
+func mix(a, b [3]float64, t float64) [3]float64 {
+	return [3]float64{a[0] + (b[0]-a[0])*t, a[1] + (b[1]-a[1])*t, a[2] + (b[2]-a[2])*t}
+}
+
+// generateGradient blends four random corner colors with mild noise.
+func generateGradient(img *image.RGBA, rnd *rand.Rand) {
+	var (
+		b              = img.Bounds()
+		tl, tr, bl, br = randomColor(rnd), randomColor(rnd), randomColor(rnd), randomColor(rnd)
+	)
+	for y := 0; y < b.Dy(); y++ {
+		v := float64(y) / float64(b.Dy())
+		for x := 0; x < b.Dx(); x++ {
+			u := float64(x) / float64(b.Dx())
+			setNoisy(img, x, y, mix(mix(tl, tr, u), mix(bl, br, u), v), 2, rnd)
+		}
+	}
+}
+
+// generateClouds blends two random colors by fractal value noise with five
+// octaves, which looks like clouds or a blurry photo.
+func generateClouds(img *image.RGBA, rnd *rand.Rand) {
+	const octaves = 5
+
+	var (
+		b          = img.Bounds()
+		lo, hi     = randomColor(rnd), randomColor(rnd)
+		field      = make([]float64, b.Dx()*b.Dy())
+		cell       = math.Max(float64(b.Dx()), float64(b.Dy())) / 3
+		amplitude  = 1.0
+		total      float64
+		smoothstep = func(t float64) float64 { return t * t * (3 - 2*t) }
+	)
+	for o := 0; o < octaves; o++ {
+		gw, gh := int(float64(b.Dx())/cell)+2, int(float64(b.Dy())/cell)+2
+		grid := make([]float64, gw*gh)
+		for i := range grid {
+			grid[i] = rnd.Float64()
+		}
+
+		for y := 0; y < b.Dy(); y++ {
+			fy := float64(y) / cell
+			gy, ty := int(fy), smoothstep(fy-math.Floor(fy))
+			for x := 0; x < b.Dx(); x++ {
+				fx := float64(x) / cell
+				gx, tx := int(fx), smoothstep(fx-math.Floor(fx))
+				top := grid[gy*gw+gx] + (grid[gy*gw+gx+1]-grid[gy*gw+gx])*tx
+				bottom := grid[(gy+1)*gw+gx] + (grid[(gy+1)*gw+gx+1]-grid[(gy+1)*gw+gx])*tx
+				field[y*b.Dx()+x] += amplitude * (top + (bottom-top)*ty)
+			}
+		}
+
+		total += amplitude
+		amplitude /= 2
+		cell = math.Max(cell/2, 1)
+	}
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			setNoisy(img, x, y, mix(lo, hi, field[y*b.Dx()+x]/total), 2, rnd)
+		}
+	}
+}
+
+// generateNoise is gaussian noise around mid gray.
+func generateNoise(img *image.RGBA, rnd *rand.Rand) {
+	b := img.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			setNoisy(img, x, y, [3]float64{128, 128, 128}, 40, rnd)
+		}
+	}
+}
+
+// sizeFlag is a flag.Value for image dimensions like 800x600.
+type sizeFlag image.Point
+
+func (f *sizeFlag) String() string {
+	if *f == (sizeFlag{}) {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", f.X, f.Y)
+}
+
+func (f *sizeFlag) Set(s string) error {
+	parts := strings.Split(strings.ToLower(s), "x")
+	if len(parts) == 2 {
+		w, werr := strconv.Atoi(parts[0])
+		h, herr := strconv.Atoi(parts[1])
+		if werr == nil && herr == nil && w > 0 && h > 0 && w <= hidden.MaxImagePixels/h {
+			*f = sizeFlag{w, h}
+			return nil
+		}
+	}
+	return fmt.Errorf("expected dimensions like 800x600")
+}
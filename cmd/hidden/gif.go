@@ -0,0 +1,89 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// isGIF reports whether data starts with a GIF signature. Messages in GIFs
+// are stored in the palette indices of all frames, not in decoded pixels.
+func isGIF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("GIF8"))
+}
+
+// isGIFFile reports whether file is a local GIF.
+func isGIFFile(file string) bool {
+	if isURL(file) {
+		return false
+	}
+	fp, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+
+	magic := make([]byte, 4)
+	_, err = fp.Read(magic)
+	return err == nil && isGIF(magic)
+}
+
+// encodeGIF writes the GIF in data, read from fin, to fout with msg hidden
+// in its frames.
+func encodeGIF(fin string, data []byte, fout string, msg []byte, opt encodeOptions, lib *hidden.Options) error {
+	switch {
+	case opt.maxChanges > 0:
+		return errors.New("-max-changes only applies to the pixels of an image, not to GIF frames")
+	case opt.debugMap != "":
+		return errors.New("-debug-map only applies to the pixels of an image, not to GIF frames")
+	case opt.maxUpscale > 0:
+		return errors.New("-resize-to-fit can not scale a GIF")
+	case formatFor(fout).name != "gif" && !noStrict:
+		return fmt.Errorf("a GIF cover is written as a GIF, but %s is not named like one (use -no-strict to write it anyway)", fout)
+	}
+
+	if !opt.overwrite {
+		if size, _, err := hidden.DetectGIF(bytes.NewReader(data)); err == nil {
+			return fmt.Errorf("%s already contains a hidden message of %d bytes, use -overwrite-message to replace it", fin, size)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := hidden.EncodeGIF(&buf, bytes.NewReader(data), msg, lib)
+	if err == hidden.ErrMessageTooLarge {
+		capacity, _ := hidden.CapacityGIF(bytes.NewReader(data), lib)
+		err = fmt.Errorf("%w, the GIF holds %d bytes", hidden.ErrMessageTooLarge, capacity)
+	}
+	if err != nil || opt.dryRun {
+		return err
+	}
+
+	if err := writeFileAtomic(fout, buf.Bytes(), 0666); err != nil {
+		return err
+	}
+	if opt.verify {
+		if err := verifyImage(fout, msg, lib); err != nil {
+			os.Remove(fout)
+			return fmt.Errorf("verification failed, removed %s: %v", fout, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// TestEncodeGIF encodes a message across the frames of an animated GIF and
+// decodes it again.
+func TestEncodeGIF(t *testing.T) {
+	dir := t.TempDir()
+	g := &gif.GIF{Delay: []int{10, 10}, Disposal: []byte{gif.DisposalNone, gif.DisposalNone}}
+	for i, m := range []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 100, 80), palette.Plan9), image.NewPaletted(image.Rect(0, 0, 100, 80), palette.Plan9)} {
+		copy(m.Pix, testMessage(len(m.Pix), int64(148+i)))
+		g.Image = append(g.Image, m)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	cover := writeTestFile(t, dir, "cover.gif", buf.Bytes())
+
+	// More than one frame holds.
+	msg := testMessage(1200, 148)
+	out := filepath.Join(dir, "out.gif")
+	if err := encode(cover, out, writeTestFile(t, dir, "msg.bin", msg), encodeOptions{verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	decoded := filepath.Join(dir, "decoded.bin")
+	if err := decode(out, decoded, decodeOptions{library: &hidden.Options{}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(decoded); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("decoded %d bytes that are not the message, %v", len(got), err)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stego, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stego.Image) != 2 {
+		t.Errorf("encoded into %d frames, want 2", len(stego.Image))
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// icoEntry is the image of an ICO to encode into or decode from, counting
+// from 1, or 0 for the 32 bit image with the most capacity.
+var icoEntry int
+
+// entryFlag defines the -entry flag in fs.
+func entryFlag(fs *flag.FlagSet) {
+	fs.IntVar(&icoEntry, "entry", 0, "Image of an ICO, 0 for the largest.")
+}
+
+// libraryEntry returns icoEntry as the entry argument of the ICO functions.
+func libraryEntry() int {
+	if icoEntry == 0 {
+		return hidden.AutoEntry
+	}
+	return icoEntry - 1
+}
+
+// isICO reports whether data starts with the header of an icon or cursor.
+// Messages in ICOs are stored in one of their images.
+func isICO(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0, 0, 1, 0}) || bytes.HasPrefix(data, []byte{0, 0, 2, 0})
+}
+
+// isICOFile reports whether file is a local ICO.
+func isICOFile(file string) bool {
+	if isURL(file) {
+		return false
+	}
+	fp, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+
+	magic := make([]byte, 4)
+	_, err = fp.Read(magic)
+	return err == nil && isICO(magic)
+}
+
+// encodeICO writes the ICO in data, read from fin, to fout with msg hidden
+// in -entry.
+func encodeICO(fin string, data []byte, fout string, msg []byte, opt encodeOptions, lib *hidden.Options) error {
+	switch ext := strings.ToLower(filepath.Ext(fout)); {
+	case opt.maxChanges > 0:
+		return errors.New("-max-changes only applies to BMP and PNG images, not to ICO entries")
+	case opt.debugMap != "":
+		return errors.New("-debug-map only applies to BMP and PNG images, not to ICO entries")
+	case opt.maxUpscale > 0:
+		return errors.New("-resize-to-fit can not scale an ICO")
+	case ext != ".ico" && ext != ".cur" && !noStrict:
+		return fmt.Errorf("an ICO cover is written as an ICO, but %s is not named like one (use -no-strict to write it anyway)", fout)
+	}
+
+	if !opt.overwrite {
+		if size, _, err := hidden.DetectICO(bytes.NewReader(data), libraryEntry()); err == nil {
+			return fmt.Errorf("%s already contains a hidden message of %d bytes, use -overwrite-message to replace it", fin, size)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := hidden.EncodeICO(&buf, bytes.NewReader(data), libraryEntry(), msg, lib)
+	if err == hidden.ErrMessageTooLarge {
+		capacity, _ := hidden.CapacityICO(bytes.NewReader(data), libraryEntry(), lib)
+		err = fmt.Errorf("%w, the ICO holds %d bytes", hidden.ErrMessageTooLarge, capacity)
+	}
+	if err != nil || opt.dryRun {
+		return err
+	}
+
+	if err := writeFileAtomic(fout, buf.Bytes(), 0666); err != nil {
+		return err
+	}
+	if opt.verify {
+		if err := verifyImage(fout, msg, lib); err != nil {
+			os.Remove(fout)
+			return fmt.Errorf("verification failed, removed %s: %v", fout, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,397 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+type infoReport struct {
+	Format      string      `json:"format"`
+	Size        int         `json:"size"`
+	Checksum    string      `json:"checksum"`
+	Expires     *time.Time  `json:"expires,omitempty"`
+	Expired     bool        `json:"expired,omitempty"`
+	Seal        string      `json:"seal,omitempty"`
+	Depth       string      `json:"depth,omitempty"`
+	Preset      string      `json:"preset,omitempty"`
+	Placement   string      `json:"placement,omitempty"`
+	Compression string      `json:"compression,omitempty"`
+	ECC         string      `json:"ecc,omitempty"`
+	MAC         string      `json:"mac,omitempty"`
+	Signature   string      `json:"signature,omitempty"`
+	Recipients  string      `json:"recipients,omitempty"`
+	Pad         string      `json:"pad,omitempty"`
+	Pages       []int       `json:"pages,omitempty"`
+	Bundle      bool        `json:"bundle,omitempty"`
+	File        *infoFile   `json:"file,omitempty"`
+	Shard       *infoShard  `json:"shard,omitempty"`
+	Metadata    []infoField `json:"metadata,omitempty"`
+	Meta        []infoMeta  `json:"meta,omitempty"`
+	Slots       []infoSlot  `json:"slots,omitempty"`
+}
+
+type infoField struct {
+	Type int `json:"type"`
+	Size int `json:"size"`
+}
+
+// infoFile is the file a message was encoded from.
+type infoFile struct {
+	Name        string     `json:"name,omitempty"`
+	ModTime     *time.Time `json:"mod_time,omitempty"`
+	ContentType string     `json:"content_type,omitempty"`
+}
+
+// infoShard is the part of a message split across several images.
+type infoShard struct {
+	Set   string `json:"set"`
+	Index int    `json:"index"`
+	Count int    `json:"count"`
+}
+
+// infoMeta is a -meta key and value.
+type infoMeta struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func infoCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := jsonFlag(fs, "Output in JSON format.")
+	pageFlag(fs)
+	entryFlag(fs)
+	limitFlags(fs)
+	metaGetFlag(fs)
+	quick := quickFlag(fs, "read")
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() != 1 {
+			commandUsage(fs, "info [flags] <image>")
+		}
+		if metaGet != "" {
+			if err := printUserValue(fs.Arg(0)); err != nil {
+				fatal(err)
+			}
+			return
+		}
+
+		var report infoReport
+		if h, ok, err := quickHeader(fs.Arg(0), *quick); ok {
+			if err != nil {
+				fatal(err)
+			}
+			report = headerReport(h, h.Length, h.Format())
+			if _, ok := h.Field(hidden.FieldSeal); ok {
+				report.Seal = "not checked with -quick"
+			}
+		} else {
+			data, err := readImageFile(fs.Arg(0))
+			if err != nil {
+				fatal(err)
+			}
+			size, format, err := detectData(data)
+			if err != nil {
+				fatal(err)
+			}
+			h, err := headerData(data)
+			if err != nil {
+				fatal(err)
+			}
+			report = headerReport(h, size, format)
+			report.Seal = sealState(data, h)
+			if _, ok := h.Field(hidden.FieldSlots); ok {
+				report.Slots = slotsData(data)
+			}
+		}
+
+		if *asJSON {
+			printJSON(&report)
+			return
+		}
+		printInfo(&report)
+	}
+}
+
+// headerReport is the report on the message with header h, of the given
+// size and format, with what can be told from the header alone.
+func headerReport(h *hidden.Header, size int, format string) infoReport {
+	report := infoReport{Format: format, Size: size, Checksum: hex.EncodeToString(h.Checksum)}
+	if t, ok := h.Expires(); ok {
+		report.Expires, report.Expired = &t, time.Now().After(t)
+	}
+	if d, ok := h.Depth(); ok {
+		report.Depth = d.String()
+	}
+	if p, ok := h.Preset(); ok {
+		report.Preset = p.String()
+	}
+	if f, ok := h.File(); ok {
+		report.File = &infoFile{Name: f.Name, ContentType: f.ContentType}
+		if !f.ModTime.IsZero() {
+			report.File.ModTime = &f.ModTime
+		}
+	}
+	if s, ok := h.Shard(); ok {
+		report.Shard = &infoShard{fmt.Sprintf("%016x", s.Set), s.Index + 1, s.Count}
+	}
+	for _, f := range h.Metadata {
+		v := f.Value
+		switch f.Type {
+		case hidden.FieldUser, hidden.FieldFile, hidden.FieldShard, hidden.FieldDepth, hidden.FieldSlots, hidden.FieldPreset, hidden.FieldExpiry, hidden.FieldSeal:
+		case hidden.FieldPlacement:
+			report.Placement = placementName(h)
+		case hidden.FieldCompression:
+			report.Compression = compressionName(v)
+		case hidden.FieldECC:
+			report.ECC = eccName(v)
+		case hidden.FieldMAC:
+			report.MAC = "HMAC-SHA256 (keyed)"
+		case hidden.FieldSignature:
+			report.Signature = "Ed25519"
+		case hidden.FieldRecipients:
+			report.Recipients = recipientsName(v)
+		case hidden.FieldPad:
+			report.Pad = "one-time pad"
+			if len(v) >= 8 {
+				report.Pad += fmt.Sprintf(", offset %d", binary.BigEndian.Uint64(v))
+			}
+		case hidden.FieldSpan:
+			for ; len(v) >= 4; v = v[4:] {
+				report.Pages = append(report.Pages, int(binary.BigEndian.Uint32(v)))
+			}
+		case hidden.FieldBundle:
+			report.Bundle = true
+		default:
+			report.Metadata = append(report.Metadata, infoField{int(f.Type), len(f.Value)})
+		}
+	}
+	for _, e := range h.User() {
+		report.Meta = append(report.Meta, infoMeta{e.Key, string(e.Value)})
+	}
+	return report
+}
+
+// printInfo prints report as info does without -json.
+func printInfo(report *infoReport) {
+	fmt.Println("Format:  ", report.Format)
+	fmt.Println("Size:    ", report.Size, "bytes")
+	fmt.Println("Checksum:", report.Checksum)
+	if t := report.Expires; t != nil {
+		state := "not expired"
+		if report.Expired {
+			state = "expired"
+		}
+		fmt.Printf("Expires:  %s (%s)\n", t.Format(time.RFC3339), state)
+	}
+	if report.Seal != "" {
+		fmt.Println("Seal:    ", report.Seal)
+	}
+	if report.Depth != "" {
+		fmt.Println("Depth:   ", report.Depth)
+	}
+	if report.Preset != "" {
+		fmt.Println("Preset:  ", report.Preset)
+	}
+	if report.Placement != "" {
+		fmt.Println("Placement:", report.Placement)
+	}
+	if report.Compression != "" {
+		fmt.Println("Compression:", report.Compression)
+	}
+	if report.ECC != "" {
+		fmt.Println("ECC:     ", report.ECC)
+	}
+	if report.MAC != "" {
+		fmt.Println("MAC:     ", report.MAC)
+	}
+	if report.Signature != "" {
+		fmt.Println("Signature:", report.Signature)
+	}
+	if report.Recipients != "" {
+		fmt.Println("Recipients:", report.Recipients)
+	}
+	if report.Pad != "" {
+		fmt.Println("Pad:     ", report.Pad)
+	}
+	if len(report.Pages) > 0 {
+		fmt.Printf("Pages:    %d, of %v carrier bits\n", len(report.Pages), report.Pages)
+	}
+	if report.Bundle {
+		fmt.Println("Bundle:   tar archive of several files")
+	}
+	if f := report.File; f != nil {
+		fmt.Println("File:    ", f.Name)
+		if f.ModTime != nil {
+			fmt.Println("Modified:", f.ModTime.Format(time.RFC3339))
+		}
+		if f.ContentType != "" {
+			fmt.Println("Type:    ", f.ContentType)
+		}
+	}
+	if s := report.Shard; s != nil {
+		fmt.Printf("Shard:    %d of %d, set %s\n", s.Index, s.Count, s.Set)
+	}
+	for _, f := range report.Metadata {
+		fmt.Printf("Metadata: field 0x%02x, %d bytes\n", f.Type, f.Size)
+	}
+	for _, m := range report.Meta {
+		fmt.Printf("Meta:     %s=%s\n", m.Key, m.Value)
+	}
+	for _, s := range report.Slots {
+		fmt.Printf("Slot:     %s, %d bytes at %d\n", s.Label, s.Length, s.Offset)
+	}
+}
+
+// placementName describes the placement of the message with header h.
+func placementName(h *hidden.Header) string {
+	p, err := h.Placement()
+	if err != nil {
+		return err.Error()
+	}
+	switch p := p.(type) {
+	case hidden.Strided:
+		return fmt.Sprintf("spread, every %d carrier bits", p.Stride)
+	case hidden.Region:
+		return fmt.Sprintf("region %v", p.Rect)
+	case hidden.Permuted:
+		return fmt.Sprintf("permuted, seed %d", p.Seed)
+	case hidden.Keyed:
+		return "permuted by the passphrase"
+	case hidden.Adaptive:
+		return fmt.Sprintf("adaptive, threshold %d", p.Threshold)
+	case hidden.Exclude:
+		return fmt.Sprintf("excluding %d rectangles", len(p.Rects))
+	case nil, hidden.Sequential:
+		return "sequential"
+	}
+	return fmt.Sprintf("placement 0x%02x", p.ID())
+}
+
+// compressionName describes the FieldCompression value v.
+func compressionName(v []byte) string {
+	if len(v) != 9 {
+		return "malformed"
+	}
+	name := fmt.Sprintf("method 0x%02x", v[0])
+	for _, c := range hidden.Compressions() {
+		if c.ID() == v[0] {
+			name = c.Name()
+		}
+	}
+	return fmt.Sprintf("%s, %d bytes uncompressed", name, binary.BigEndian.Uint64(v[1:]))
+}
+
+// eccName describes the FieldECC value v.
+func eccName(v []byte) string {
+	switch {
+	case len(v) == 1:
+		return fmt.Sprintf("%s, %d parity bytes in 255", hidden.ReedSolomon, v[0])
+	case len(v) == 2 && v[0] == 0:
+		return hidden.ECCScheme(v[1]).String()
+	}
+	return "malformed"
+}
+
+// recipientsName describes the FieldRecipients value v.
+func recipientsName(v []byte) string {
+	if len(v) == 1 {
+		switch v[0] {
+		case 1:
+			return "age"
+		case 2:
+			return "OpenPGP"
+		}
+	}
+	return "unsupported format"
+}
+
+// sealState describes the seal of the message with header h in the image
+// file data: intact, modified, or why it could not be checked. It is empty
+// if the message is not sealed.
+func sealState(data []byte, h *hidden.Header) string {
+	if _, ok := h.Field(hidden.FieldSeal); !ok {
+		return ""
+	}
+	img, _, err := hidden.DecodeImage(bytes.NewReader(data))
+	if err != nil {
+		return err.Error()
+	}
+	switch err := hidden.CheckSeal(img); err {
+	case nil:
+		return "intact"
+	case hidden.ErrModified:
+		return "modified"
+	default:
+		return err.Error()
+	}
+}
+
+// headerData is hidden.DecodeHeader for an image file read with
+// readImageFile.
+func headerData(data []byte) (*hidden.Header, error) {
+	if isJPEG(data) {
+		return hidden.DecodeHeaderJPEG(bytes.NewReader(data))
+	} else if isGIF(data) {
+		return hidden.DecodeHeaderGIF(bytes.NewReader(data))
+	} else if isTIFF(data) {
+		return hidden.DecodeHeaderTIFF(bytes.NewReader(data), libraryPage())
+	} else if isICO(data) {
+		return hidden.DecodeHeaderICO(bytes.NewReader(data), libraryEntry())
+	}
+	img, _, err := hidden.DecodeImage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return hidden.DecodeHeader(img)
+}
+
+// expiryFlag is a flag.Value for an expiry, given as an RFC 3339 time or a
+// duration from now.
+type expiryFlag struct {
+	time.Time
+}
+
+func (f *expiryFlag) String() string {
+	if f.IsZero() {
+		return ""
+	}
+	return f.Format(time.RFC3339)
+}
+
+func (f *expiryFlag) Set(s string) error {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		d, derr := time.ParseDuration(s)
+		if derr != nil {
+			return fmt.Errorf("expected an RFC 3339 time like 2006-01-02T15:04:05Z or a duration like 72h")
+		}
+		t = time.Now().Add(d)
+	}
+	if !t.After(time.Now()) {
+		return fmt.Errorf("%s is in the past", t.Format(time.RFC3339))
+	}
+	f.Time = t
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// TestHeaderReport checks that info names the metadata fields it knows,
+// and only reports the size of the others.
+func TestHeaderReport(t *testing.T) {
+	text := bytes.Repeat([]byte("a message that compresses well. "), 20)
+	stego, err := hidden.Encode(testCover(200, 100, 266), text, &hidden.Options{
+		Passphrase:  []byte("pass"),
+		Compression: hidden.Zstd,
+		ECC:         16,
+		Placement:   hidden.Permuted{Seed: 3},
+		Metadata:    []hidden.Field{{Type: 0x7f, Value: []byte("unknown")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := hidden.DecodeHeader(stego)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := headerReport(h, h.Length, h.Format())
+	for _, c := range []struct{ name, got, want string }{
+		{"placement", r.Placement, "permuted, seed 3"},
+		{"compression", r.Compression, "zstd, 640 bytes uncompressed"},
+		{"ecc", r.ECC, "reed-solomon, 16 parity bytes in 255"},
+		{"mac", r.MAC, "HMAC-SHA256 (keyed)"},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, c.got, c.want)
+		}
+	}
+	if len(r.Metadata) != 1 || r.Metadata[0] != (infoField{0x7f, 7}) {
+		t.Errorf("unknown fields: got %+v, want only field 0x7f of 7 bytes", r.Metadata)
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// limits bound the image files readImageFile accepts.
+var limits = hidden.Limits{MaxPixels: hidden.MaxImagePixels, MaxFileSize: 256 << 20}
+
+// limitFlags defines the -max-pixels and -max-file-size flags in fs.
+func limitFlags(fs *flag.FlagSet) {
+	fs.IntVar(&limits.MaxPixels, "max-pixels", limits.MaxPixels, "Refuse images with more pixels than this.")
+	fs.Int64Var(&limits.MaxFileSize, "max-file-size", limits.MaxFileSize, "Refuse image files larger than this many bytes, 0 for no limit.")
+}
+
+// readImageFile returns the contents of the image in file, which can also
+// be an http(s) URL. It fails with hidden.ErrImageTooLarge for a file
+// beyond limits.
+func readImageFile(file string) ([]byte, error) {
+	var (
+		fp  io.ReadCloser
+		err error
+	)
+
+	if archive, entry, ok := splitZipPath(file); ok {
+		data, err := readZipEntry(archive, entry)
+		if err != nil {
+			return nil, err
+		}
+		if err := limits.Check(data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	} else if isURL(file) {
+		fp, err = fetchImage(file)
+	} else if fp, err = os.Open(file); err == nil {
+		fi, err := os.Stat(file)
+		if err == nil && limits.MaxFileSize > 0 && fi.Size() > limits.MaxFileSize {
+			fp.Close()
+			return nil, fmt.Errorf("%w, it is %d bytes, more than %d", hidden.ErrImageTooLarge, fi.Size(), limits.MaxFileSize)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var r io.Reader = fp
+	if showProgress && !isURL(file) {
+		if fi, err := os.Stat(file); err == nil {
+			p := newProgress("Reading "+file, fi.Size())
+			defer p.finish()
+			r = progressReader{fp, p}
+		}
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := limits.Check(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// isJPEG reports whether data starts with a JPEG SOI marker. Messages in
+// JPEG images are stored in the DCT coefficients, not in the pixels.
+func isJPEG(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0xFF, 0xD8})
+}
+
+// decodeData extracts the message from an image file read with
+// readImageFile.
+func decodeData(data []byte, opt *hidden.Options) ([]byte, error) {
+	if slotLabel != "" && (isJPEG(data) || isGIF(data) || isTIFF(data) || isICO(data)) {
+		return nil, errSlotPixels
+	}
+	if hasMetadata(data) {
+		if msg, err := hidden.DecodeMetadata(bytes.NewReader(data), opt); err != hidden.ErrNoHiddenMessage {
+			return msg, err
+		}
+	}
+	if isJPEG(data) {
+		return hidden.DecodeJPEG(bytes.NewReader(data), opt)
+	} else if isGIF(data) {
+		return hidden.DecodeGIF(bytes.NewReader(data), opt)
+	} else if isTIFF(data) {
+		return hidden.DecodeTIFF(bytes.NewReader(data), libraryPage(), opt)
+	} else if isICO(data) {
+		return hidden.DecodeICO(bytes.NewReader(data), libraryEntry(), opt)
+	}
+	img, _, err := hidden.DecodeImage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	msg, _, err := decodeSlot(img, opt)
+	return msg, err
+}
+
+// detectData is hidden.Detect for an image file read with readImageFile.
+func detectData(data []byte) (int, string, error) {
+	if hasMetadata(data) {
+		if size, format, err := hidden.DetectMetadata(bytes.NewReader(data)); err != hidden.ErrNoHiddenMessage {
+			return size, format, err
+		}
+	}
+	if isJPEG(data) {
+		return hidden.DetectJPEG(bytes.NewReader(data))
+	} else if isGIF(data) {
+		return hidden.DetectGIF(bytes.NewReader(data))
+	} else if isTIFF(data) {
+		return hidden.DetectTIFF(bytes.NewReader(data), libraryPage())
+	} else if isICO(data) {
+		return hidden.DetectICO(bytes.NewReader(data), libraryEntry())
+	}
+	img, _, err := hidden.DecodeImage(bytes.NewReader(data))
+	if err != nil {
+		return 0, "", err
+	}
+	return hidden.Detect(img)
+}
+
+// encodeJPEG writes srcImg with msg hidden in it to fout as a JPEG at
+// opt.jpegQuality.
+func encodeJPEG(srcImg image.Image, fout string, msg []byte, opt encodeOptions, lib *hidden.Options) error {
+	quality := opt.jpegQuality
+	capacity := hidden.CapacityJPEG(srcImg, quality, lib)
+	logger.Info(fmt.Sprintf("JPEG capacity at quality %d: %d bytes", quality, capacity))
+	if len(msg) > capacity {
+		return fmt.Errorf("message is %d bytes, a JPEG at quality %d can hold %d, try a lower quality", len(msg), quality, capacity)
+	}
+
+	if opt.dryRun {
+		return hidden.EncodeJPEG(ioutil.Discard, srcImg, msg, quality, lib)
+	}
+
+	return writeAtomic(fout, 0666, func(w io.Writer) error {
+		return hidden.EncodeJPEG(w, srcImg, msg, quality, lib)
+	})
+}
@@ -0,0 +1,96 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// bombBMP returns the header of a 24 bit BMP that declares w x h pixels,
+// with no pixels behind it.
+func bombBMP(w, h int) []byte {
+	data := make([]byte, 54)
+	copy(data, "BM")
+	binary.LittleEndian.PutUint32(data[2:], 54)
+	binary.LittleEndian.PutUint32(data[10:], 54)
+	binary.LittleEndian.PutUint32(data[14:], 40)
+	binary.LittleEndian.PutUint32(data[18:], uint32(w))
+	binary.LittleEndian.PutUint32(data[22:], uint32(h))
+	binary.LittleEndian.PutUint16(data[26:], 1)
+	binary.LittleEndian.PutUint16(data[28:], 24)
+	return data
+}
+
+func TestReadImageLimits(t *testing.T) {
+	saved := limits
+	t.Cleanup(func() { limits = saved })
+
+	file := writeTestImage(t, "cover.png", testCover(64, 48, 155))
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(data))
+
+	dir := t.TempDir()
+	bomb := writeTestFile(t, dir, "bomb.bmp", bombBMP(60000, 60000))
+	archive := filepath.Join(dir, "bundle.zip")
+	fp, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(fp)
+	w, _ := zw.Create("cover.png")
+	w.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	for _, c := range []struct {
+		name   string
+		file   string
+		limits hidden.Limits
+		ok     bool
+	}{
+		{"defaults", file, saved, true},
+		{"bomb", bomb, saved, false},
+		{"bomb without size limit", bomb, hidden.Limits{}, false},
+		{"pixels at limit", file, hidden.Limits{MaxPixels: 64 * 48}, true},
+		{"pixels over limit", file, hidden.Limits{MaxPixels: 64*48 - 1}, false},
+		{"size at limit", file, hidden.Limits{MaxFileSize: size}, true},
+		{"size over limit", file, hidden.Limits{MaxFileSize: size - 1}, false},
+		{"zip pixels over limit", zipPath(archive, "cover.png"), hidden.Limits{MaxPixels: 64*48 - 1}, false},
+		{"zip size at limit", zipPath(archive, "cover.png"), hidden.Limits{MaxFileSize: size}, true},
+		{"zip size over limit", zipPath(archive, "cover.png"), hidden.Limits{MaxFileSize: size - 1}, false},
+	} {
+		limits = c.limits
+		_, err := readImageFile(c.file)
+		if c.ok && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !c.ok && !errors.Is(err, hidden.ErrImageTooLarge) {
+			t.Errorf("%s: got %v, want hidden.ErrImageTooLarge", c.name, err)
+		}
+	}
+}
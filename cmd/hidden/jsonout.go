@@ -0,0 +1,65 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+)
+
+// jsonOutput is set by the -json flag of any command. Results are then
+// printed as JSON on stdout, errors too, see fatal.
+var jsonOutput bool
+
+// jsonFlag defines the -json flag in fs.
+func jsonFlag(fs *flag.FlagSet, usage string) *bool {
+	fs.BoolVar(&jsonOutput, "json", false, usage)
+	return &jsonOutput
+}
+
+// jsonError is what fatal prints with -json.
+type jsonError struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Code   int    `json:"code"`
+}
+
+var (
+	warningMu sync.Mutex
+	warnings  []string
+)
+
+// warnf logs a warning, and records it for the JSON output of
+// the command.
+func warnf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+
+	warningMu.Lock()
+	warnings = append(warnings, msg)
+	warningMu.Unlock()
+	logger.Warn(msg)
+}
+
+// takeWarnings returns the warnings recorded so far and forgets them.
+func takeWarnings() []string {
+	warningMu.Lock()
+	defer warningMu.Unlock()
+
+	w := warnings
+	warnings = nil
+	return w
+}
@@ -0,0 +1,141 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// levelTrace is the level of -vv, the time every step takes.
+const levelTrace = slog.LevelDebug - 4
+
+// logLevel is the least level logger prints, set by -v, -vv and -quiet.
+var logLevel = new(slog.LevelVar)
+
+// logger receives progress, warnings and, with -v and -vv, the details of
+// what a command does. It prints a line for every record: the message and
+// its attributes as key=value. Errors go to stderr, anything else to info.
+var logger = slog.New(&lineHandler{mu: new(sync.Mutex)})
+
+type lineHandler struct {
+	mu     *sync.Mutex
+	attrs  []slog.Attr
+	prefix string
+}
+
+func (h *lineHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *lineHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	if r.Level == slog.LevelWarn {
+		b.WriteString("Warning: ")
+	}
+	b.WriteString(r.Message)
+	write := func(a slog.Attr) bool {
+		b.WriteString(" " + h.prefix + a.Key + "=" + a.Value.String())
+		return true
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(write)
+	b.WriteByte('\n')
+
+	var w io.Writer = info
+	if r.Level >= slog.LevelError {
+		w = os.Stderr
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (h *lineHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append(c.attrs[:len(c.attrs):len(c.attrs)], attrs...)
+	return &c
+}
+
+func (h *lineHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.prefix += name + "."
+	return &c
+}
+
+// verbosity holds the -v, -vv and -quiet flags of a command.
+type verbosity struct {
+	verbose, trace, quiet *bool
+}
+
+// verbosityFlags defines the -v, -vv and -quiet flags in fs. options says
+// what -v prints apart from the details of the work.
+func verbosityFlags(fs *flag.FlagSet, options string) *verbosity {
+	return &verbosity{
+		verbose: fs.Bool("v", false, "Print "+options+"timings and capacity used."),
+		trace:   fs.Bool("vv", false, "Print what -v does and the time every step takes."),
+		quiet:   fs.Bool("quiet", false, "Print only errors."),
+	}
+}
+
+// apply sets the level of logger from the flags.
+func (v *verbosity) apply() {
+	switch {
+	case (*v.verbose || *v.trace) && *v.quiet:
+		fatal(usagef("-quiet prints nothing, it can not be combined with -v or -vv"))
+	case *v.trace:
+		logLevel.Set(levelTrace)
+	case *v.verbose:
+		logLevel.Set(slog.LevelDebug)
+	case *v.quiet:
+		logLevel.Set(slog.LevelError)
+	}
+}
+
+// trace logs the step msg of -vv with the time since start.
+func trace(msg string, start time.Time, args ...interface{}) {
+	logger.Log(context.Background(), levelTrace, msg, append(args, "took", time.Since(start).Round(time.Microsecond))...)
+}
+
+// logCapacity logs, for -v, how much of the capacity a message of n bytes
+// uses. capacity is only called then.
+func logCapacity(n int, capacity func() int) {
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	c := capacity()
+	logger.Debug("Capacity used", "message", n, "capacity", c, "percent", fmt.Sprintf("%.1f", 100*float64(n)/math.Max(1, float64(c))))
+}
+
+// logTook returns the attribute of the time something took for a record,
+// which only -v shows.
+func logTook(took time.Duration) []interface{} {
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return nil
+	}
+	return []interface{}{"took", took.Round(time.Millisecond)}
+}
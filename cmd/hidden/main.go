@@ -0,0 +1,1585 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andreas-jonsson/hidden"
+	"golang.org/x/term"
+)
+
+func main() {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			_, run := cmd()
+			run(args[1:])
+			return
+		}
+		if args[0] == "encode" || args[0] == "decode" {
+			_, run := classicCommand(args[0])
+			run(args[1:])
+			return
+		}
+	}
+	_, run := classicCommand("")
+	run(args)
+}
+
+// classicCommand encodes or decodes as the -encode and -decode flags say, or
+// as action, encode or decode, does with -in and -data.
+func classicCommand(action string) (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	enc := fs.String("encode", "", "Image or URL to hide message in.")
+	dec := fs.String("decode", "", "Decode message in image.")
+	msg := fs.String("msg", "", "Message or data to encode/decode.")
+	in := fs.String("in", "", "Image of the encode and decode commands.")
+	text := fs.String("text", "", "Message to encode, given as text.")
+	var data dataFlag
+	fs.Var(&data, "data", "Files to encode, or to decode into.")
+	fs.StringVar(&outDir, "out-dir", "", "Directory to write the output to.")
+	out := fs.String("out", "", "File to write the output to.")
+	fs.BoolVar(&force, "force", false, "Overwrite the encoded image or decoded message if the file exists.")
+	verify := verifyFlags(fs, "the encoded image")
+	auto := fs.Bool("auto", false, "Try every supported layout when decoding.")
+	ignoreChecksum := fs.Bool("ignore-checksum", false, "Write the decoded message even if it is damaged.")
+	overwrite := fs.Bool("overwrite-message", false, "Encode even if the image already contains a message.")
+	jpegQuality := fs.Int("jpeg", 0, "Hide message in a JPEG of this quality.")
+	resync := fs.Int("resync", 0, "Store message in blocks of this many bytes, for -recover.")
+	copies := fs.Int("copies", 0, "Copies of the -resync blocks to store.")
+	chunkSize := fs.Int("chunk-size", 0, "Encrypt message in chunks of this many bytes.")
+	ecc := eccFlag(fs, "Reed-Solomon parity bytes in every 255, or hamming.")
+	recoverMsg := fs.Bool("recover", false, "Recover what is left of a damaged message.")
+	checksum := checksumFlag(fs)
+	compression := compressFlag(fs)
+	encryption := defineEncryptionFlags(fs)
+	pads := definePadFlags(fs)
+	keys := defineRecipientFlags(fs)
+	compat := defineCompatFlags(fs)
+	stdout := fs.Bool("stdout", false, "Write the decoded message to stdout instead of -msg.")
+	armored := fs.Bool("armor", false, "Decode to, or encode from, base64 text.")
+	jsonOut := jsonFlag(fs, "Output in JSON format.")
+	manifestFile := fs.String("manifest", "", "File to write a JSON manifest of the encode to.")
+	fs.Var(&outputMode, "mode", "Permissions of the decoded message file, in octal.")
+	fs.BoolVar(&keepModes, "keep-modes", false, "Keep the stored permissions of unpacked files.")
+	fs.DurationVar(&fetchTimeout, "fetch-timeout", fetchTimeout, "Time limit for fetching an image given as an http(s) URL.")
+	fs.Int64Var(&fetchMaxSize, "fetch-max-size", fetchMaxSize, "Largest image in bytes fetched from an http(s) URL.")
+	fs.BoolVar(&fetchInsecure, "insecure", false, "Do not verify TLS certificates when fetching URLs.")
+	strictFlag(fs)
+	fs.BoolVar(&showProgress, "progress", false, "Report progress on stderr.")
+	bmpDepthFlag(fs)
+	pageFlag(fs)
+	entryFlag(fs)
+	slotFlag(fs)
+	limitFlags(fs)
+	var expires expiryFlag
+	fs.Var(&expires, "expires", "Refuse to decode the message after this time.")
+	ignoreExpiry := fs.Bool("ignore-expiry", false, "Decode the message even if it has expired.")
+	legacy := fs.Bool("legacy", false, "Also decode messages of old versions.")
+	generate := fs.String("generate", "", "Synthetic cover to encode into: "+strings.Join(generatorNames(), ", ")+".")
+	var size sizeFlag
+	resizeToFit := fs.Bool("resize-to-fit", false, "Scale the cover up if the message does not fit.")
+	maxUpscale := fs.Float64("max-upscale", 2, "Largest scale factor -resize-to-fit may use.")
+	fs.Var(&size, "size", "Size of the -generate cover, like 800x600. (default 20% more than the message needs)")
+	maxChanges := fs.Float64("max-changes", 0, "Largest fraction of samples to change, 0 for no limit.")
+	report := fs.Bool("report", false, "Print the PSNR and SSIM of the encoded image.")
+	dryRun := fs.Bool("dry-run", false, "Encode without writing anything.")
+	debugMapFile := fs.String("debug-map", "", "File to write a PNG of the changed pixels to.")
+	depth := depthFlag(fs)
+	autoDepth := fs.Bool("auto-depth", false, "Use the lowest depth the message fits in.")
+	permute := fs.Bool("permute", false, "Scatter message over the image.")
+	method := fs.String("method", "pixels", "Where to store message: pixels or metadata.")
+	spread := fs.Bool("spread", false, "Spread message evenly over the image.")
+	adaptive := fs.Int("adaptive", 0, "Only use pixels this textured, 1 to 255.")
+	var exclude excludeFlags
+	fs.Var(regionFlag{&exclude}, "region", "Rectangle x,y,width,height to leave untouched.")
+	fs.Var(skipRowsFlag{&exclude}, "skip-rows", "Rows first:last to leave untouched.")
+	signKey := fs.String("sign", "", "Ed25519 private key to sign message with.")
+	verifyKey := fs.String("verify-key", "", "Ed25519 public key message must be signed with.")
+	seal := fs.Bool("seal", false, "Detect changes to the image after encoding.")
+	fileInfo := fs.Bool("file-info", true, "Store the name of the message file, unless encrypting.")
+	hiddenMsg := defineHiddenFlags(fs)
+	matching := fs.Bool("matching", false, "Embed by LSB matching.")
+	fill := fs.Bool("fill", false, "Randomize the carrier bits message leaves unused.")
+	preserveHistogram := fs.Bool("preserve-histogram", false, "Keep the histogram of the cover.")
+	profileName := fs.String("preset", "", "Preset of options: "+strings.Join(profileNames(), ", ")+".")
+	fs.StringVar(profileName, "profile", "", "Old name of -preset.")
+	stream := fs.Bool("stream", false, "Encode or decode a BMP a row at a time.")
+	verbose := verbosityFlags(fs, "the effective options, ")
+	metaFlags(fs)
+	metaGetFlag(fs)
+
+	return fs, func(args []string) {
+		cfg := defineConfigFlags(fs)
+		fs.Parse(args)
+		section := action
+		if section == "" && *enc != "" {
+			section = "encode"
+		} else if section == "" && *dec != "" {
+			section = "decode"
+		}
+		if err := cfg.apply(fs, section); err != nil {
+			fatal(err)
+		}
+		files, err := commandFlags(action, enc, dec, msg, *in, data)
+		if err != nil {
+			fatal(err)
+		}
+		preset, err := applyProfile(fs, *profileName)
+		if err != nil {
+			fatal(err)
+		}
+
+		// Keep stdout clean for the message.
+		if *dec != "" && (*msg == "" || *out == "") && (*msg == stdioName || *out == stdioName) {
+			*stdout, *msg, *out = true, "", ""
+		}
+		if *stdout || *jsonOut || metaGet != "" {
+			info = os.Stderr
+		}
+
+		verbose.apply()
+		logger.Debug("Hidden Message, Copyright (C) 2017 Andreas T Jonsson")
+		if logger.Enabled(context.Background(), slog.LevelDebug) {
+			fmt.Fprintln(info, "Options:")
+			printFlags(info, fs)
+		}
+		start := time.Now()
+
+		if *dec != "" && metaGet != "" {
+			if err := printUserValue(*dec); err != nil {
+				fatal(err)
+			}
+			return
+		} else if *dec != "" {
+			pad, err := pads.pad()
+			if err != nil {
+				fatal(err)
+			}
+			opts := []hidden.Option{hidden.WithIgnoreExpiry(*ignoreExpiry), hidden.WithLegacy(*legacy)}
+			if pad != nil {
+				opts = append(opts, hidden.WithPad(pad))
+			}
+			if *verifyKey != "" {
+				pub, err := readVerifyKey(*verifyKey)
+				if err != nil {
+					fatal(err)
+				}
+				opts = append(opts, hidden.WithVerifyKey(pub))
+			}
+			ids, err := keys.identities(encryption.source)
+			if err != nil {
+				fatal(err)
+			}
+			if len(ids) > 0 {
+				opts = append(opts, hidden.WithIdentities(ids...))
+			}
+			if compat.raw {
+				opts = append(opts, compat.options()...)
+			}
+			lib, err := encryption.decodeOptions(opts...)
+			if err != nil {
+				fatal(err)
+			}
+
+			fout := *msg
+			if *out != "" {
+				if fout != "" {
+					fatal(usagef("-out and -msg, or -data, both name the decoded message, give one of them"))
+				}
+				fout = *out
+			}
+			err = decode(*dec, fout, decodeOptions{
+				library:        lib,
+				auto:           *auto,
+				ignoreChecksum: *ignoreChecksum,
+				recover:        *recoverMsg,
+				stdout:         *stdout || *jsonOut,
+				armor:          *armored,
+				json:           *jsonOut,
+				stream:         *stream,
+			})
+			if err != nil {
+				fatal(err)
+			}
+			if *verifyKey != "" {
+				logger.Info("Signed with the key of " + *verifyKey)
+			}
+			logger.Debug("Decoded", "took", time.Since(start).Round(time.Millisecond))
+			logger.Info("Done!")
+			return
+		} else if (*enc != "") != (*generate != "") && (*msg != "" || *text != "" || len(files) > 0) {
+			if *text != "" && (*msg != "" || len(files) > 0) {
+				fatal(usagef("-text and -msg, or -data, both give the message, give one of them"))
+			}
+			name := "encoded.bmp"
+			if *jpegQuality > 0 || *method == "metadata" && !isPNGFile(*enc) {
+				name = "encoded.jpg"
+			} else if isY4M(*enc) {
+				name = "encoded.y4m"
+			} else if wideFile(*enc) || isPNGFile(*enc) {
+				name = "encoded.png"
+			} else if isGIFFile(*enc) {
+				name = "encoded.gif"
+			} else if isTIFFFile(*enc) {
+				name = "encoded.tif"
+			} else if isICOFile(*enc) {
+				name = "encoded.ico"
+			}
+			dest := path.Join(outputDir(*enc), name)
+			if _, entry, ok := splitZipPath(*enc); ok {
+				dest = zipPath(path.Join(outputDir(*enc), "encoded.zip"), entry)
+			}
+			fins, sharded := shardFiles(*enc)
+			if sharded {
+				dest = shardOutputs(fins)
+			}
+			if *out != "" {
+				dest = *out
+			}
+			if !*dryRun {
+				outs := []string{dest}
+				if sharded {
+					outs = strings.Split(dest, ",")
+				}
+				for _, fout := range outs {
+					if err := checkClobber(fout); err != nil {
+						fatal(err)
+					}
+				}
+			}
+			opt := encodeOptions{text: *text, bundle: files, verify: verify(), overwrite: *overwrite, armor: *armored, integrity: checksum.Integrity, compression: compression.Compression, blockSize: *resync, copies: *copies, chunkSize: *chunkSize, ecc: ecc.parity, hamming: ecc.hamming, jpegQuality: *jpegQuality, expires: expires.Time, generate: *generate, size: image.Point(size), maxChanges: *maxChanges, dryRun: *dryRun, report: *report, debugMap: *debugMapFile, seal: *seal, matching: *matching, preserveHistogram: *preserveHistogram, fill: *fill, preset: preset, stream: *stream, fileInfo: *fileInfo}
+			if opt.depth, err = depth.depth(); err != nil {
+				fatal(err)
+			}
+			opt.bitOrder, opt.littleEndian, opt.raw = compat.order, compat.little, compat.raw
+			if opt.autoDepth = *autoDepth; opt.autoDepth && opt.depth != (hidden.ChannelDepth{}) {
+				fatal(usagef("-auto-depth chooses the depth, it can not be combined with -depth or -channels"))
+			}
+			if *resizeToFit {
+				opt.maxUpscale = *maxUpscale
+			}
+			if opt.recipients, err = keys.recipients(); err != nil {
+				fatal(err)
+			}
+			if len(opt.recipients) > 0 && encryption.wanted() {
+				fatal(usagef("-recipient encrypts the message to public keys instead of a passphrase, it can not be combined with -encrypt"))
+			}
+			if err := encryption.apply(&opt); err != nil {
+				fatal(err)
+			}
+			if opt.raw || len(opt.passphrase) > 0 || len(opt.recipients) > 0 {
+				// There is no header to store the file attributes in, or it
+				// would give away the name of an encrypted message, so they
+				// are only stored when asked for.
+				explicit := false
+				fs.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "file-info" })
+				opt.fileInfo = opt.fileInfo && explicit
+			}
+			if *adaptive != 0 {
+				if *permute {
+					fatal(usagef("-adaptive and -permute both decide where the message goes, give one of them"))
+				}
+				opt.placement = hidden.Adaptive{Threshold: *adaptive}
+			}
+			if *spread {
+				if *permute || *adaptive != 0 {
+					fatal(usagef("-spread decides where the message goes like -permute and -adaptive, give one of them"))
+				}
+				opt.placement = hidden.Spread{}
+			}
+			if len(exclude) > 0 {
+				if opt.placement != nil || *permute {
+					fatal(usagef("-region and -skip-rows decide where the message goes like -permute, -spread and -adaptive, give one of them"))
+				}
+				opt.placement = hidden.Exclude{Rects: exclude}
+			}
+			switch *method {
+			case "pixels":
+			case "metadata":
+				opt.metadata = true
+			default:
+				fatal(usagef("unknown -method %q, want pixels or metadata", *method))
+			}
+			if *permute {
+				opt.placement = hidden.Permuted{Seed: uint64(opt.seed)}
+				if len(opt.passphrase) > 0 {
+					var p hidden.Keyed
+					if p.Salt, err = salt(&opt); err != nil {
+						fatal(err)
+					}
+					opt.placement = p
+				}
+			}
+			if err := hiddenMsg.apply(&opt); err != nil {
+				fatal(err)
+			}
+			if *signKey != "" {
+				if opt.signingKey, err = readSigningKey(*signKey); err != nil {
+					fatal(err)
+				}
+			}
+			pad, err := pads.pad()
+			if err != nil {
+				fatal(err)
+			}
+			opt.pad, opt.padTracking = pad, *pads.tracking
+			opt.manifest, opt.json = *manifestFile, *jsonOut
+			if opt.meta, err = userFields(); err != nil {
+				fatal(err)
+			}
+			if err := encode(*enc, dest, *msg, opt); err != nil {
+				fatal(err)
+			}
+			logger.Debug("Encoded", "took", time.Since(start).Round(time.Millisecond))
+			logger.Info("Done!")
+			return
+		}
+
+		if action != "" {
+			commandUsage(fs, actionSynopsis[action])
+		}
+		fs.PrintDefaults()
+		fatal()
+	}
+}
+
+// actionSynopsis is the usage line of the encode and decode commands, which
+// take the classic flags, with -in and -data instead of -encode, -decode and
+// -msg.
+var actionSynopsis = map[string]string{
+	"encode": "encode [flags] -in <cover> -data <message> [-data <file>]... [-out <image>]",
+	"decode": "decode [flags] -in <image> [-out <message>]",
+}
+
+// commandFlags sets the classic -encode, -decode and -msg flags from -in and
+// -data for the encode or decode command, and refuses the mix of both. It
+// returns the files to encode as a bundle, if -data names more than one
+// file or a directory.
+func commandFlags(action string, enc, dec, msg *string, in string, data []string) ([]string, error) {
+	if action == "" {
+		if in != "" || len(data) > 0 {
+			return nil, errors.New("-in and -data are for the encode and decode commands, like hidden encode -in cover.bmp -data secret.txt")
+		}
+		return nil, nil
+	}
+	if *enc != "" || *dec != "" || *msg != "" {
+		return nil, fmt.Errorf("hidden %s takes -in and -data, not -encode, -decode or -msg", action)
+	}
+
+	switch {
+	case action == "decode" && len(data) > 1:
+		return nil, errors.New("hidden decode writes the message to one -data, a directory unpacks an archive into it")
+	case action == "decode":
+		*dec = in
+	case isBundle(data):
+		*enc = in
+		for _, f := range data {
+			if f == stdioName || f == clipboardName || isURL(f) {
+				return nil, fmt.Errorf("-data %s can not be part of a bundle, only files and directories can", f)
+			}
+		}
+		return data, nil
+	default:
+		*enc = in
+	}
+	if len(data) > 0 {
+		*msg = data[0]
+	}
+	return nil, nil
+}
+
+// commands maps subcommand names to their entry points. Anything not
+// listed here falls through to the classic -encode/-decode flags, as do
+// the encode and decode commands.
+var commands = map[string]command{
+	"analyze":      analyzeCommand,
+	"bench":        benchCommand,
+	"batch-decode": batchDecodeCommand,
+	"batch-encode": batchEncodeCommand,
+	"capacity":     capacityCommand,
+	"compare":      compareCommand,
+	"detect":       detectCommand,
+	"gencover":     gencoverCommand,
+	"info":         infoCommand,
+	"inspect":      infoCommand,
+	"manifest":     manifestCommand,
+	"quality":      qualityCommand,
+	"recover":      recoverCommand,
+	"scan":         scanCommand,
+	"self-test":    selfTestCommand,
+	"serve":        serveCommand,
+	"simulate":     simulateCommand,
+	"stats":        statsCommand,
+	"stress":       stressCommand,
+	"transplant":   transplantCommand,
+	"tui":          tuiCommand,
+	"verify":       verifyCommand,
+	"visualize":    visualizeCommand,
+	"watch":        watchCommand,
+	"watermark":    watermarkCommand,
+}
+
+// A command defines its flags and returns them, with the function that
+// parses its arguments and runs it, so the completion scripts and man pages
+// list the flags of a command without running it.
+type command func() (*flag.FlagSet, func(args []string))
+
+// commandUsage prints the synopsis and flags of a subcommand and exits.
+func commandUsage(fs *flag.FlagSet, synopsis string) {
+	fmt.Fprintln(os.Stderr, "usage: hidden", synopsis)
+	fs.PrintDefaults()
+	fatal()
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		fatal(err)
+	}
+}
+
+// info receives progress and warnings, it is switched to stderr when stdout
+// carries the message.
+var info io.Writer = os.Stdout
+
+// outputMode is the permissions decoded messages are written with. They are
+// secrets, so only the owner gets access by default.
+var outputMode fileMode = 0600
+
+// keepModes unpacks the files of a bundle with the permissions they were
+// stored with, rather than only their owner bits.
+var keepModes bool
+
+// outDir is the directory outputs named after the input are written to,
+// instead of the directory of the input, unless it is empty.
+var outDir string
+
+// fileMode is a flag.Value for octal file permissions.
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%04o", uint32(*m))
+}
+
+func (m *fileMode) Set(s string) error {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 0777 {
+		return fmt.Errorf("expected octal permissions like 0600")
+	}
+	*m = fileMode(v)
+	return nil
+}
+
+// fatal prints msg, as a JSON object with -json, wipes the secrets and
+// exits with the exit code of the last error in msg, see exitCode. Without
+// msg it exits with exitUsage, after the usage was printed.
+func fatal(msg ...interface{}) {
+	code := exitUsage
+	if len(msg) > 0 {
+		code = exitFailure
+	}
+	for _, m := range msg {
+		if err, ok := m.(error); ok {
+			code = exitCode(err)
+		}
+	}
+
+	if jsonOutput && len(msg) > 0 {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(jsonError{"error", strings.TrimSuffix(fmt.Sprintln(msg...), "\n"), code})
+	} else {
+		fmt.Fprintln(os.Stderr, msg...)
+	}
+	wipeSecrets()
+	os.Exit(code)
+}
+
+// loadImage decodes the image in file, which can also be an http(s) URL.
+func loadImage(file string) (image.Image, error) {
+	img, _, err := loadCover(file)
+	return img, err
+}
+
+// loadCover is loadImage that also returns what the file holds besides the
+// pixels, for saveImage to keep.
+func loadCover(file string) (image.Image, *ancillary, error) {
+	data, err := readImageFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decodeCover(data)
+}
+
+// decodeCover is loadCover for a file read with readImageFile. Opaque 8 bit
+// images written as color, like 32 bit BMPs and gray or paletted PNGs, are
+// converted to *image.RGBA, which keeps every color exactly. 16 bit gray
+// PNGs are kept as they are, Encode takes them. Paletted
+// images with transparent colors become an *image.NRGBA, which keeps them
+// too.
+func decodeCover(data []byte) (image.Image, *ancillary, error) {
+	img, _, err := hidden.DecodeImage(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	switch img.(type) {
+	case *image.NRGBA, *image.Gray, *image.Paletted:
+		if opaque(img) {
+			img = toRGBA(img)
+		} else if _, ok := img.(*image.Paletted); ok {
+			m := image.NewNRGBA(img.Bounds())
+			draw.Draw(m, m.Rect, img, img.Bounds().Min, draw.Src)
+			img = m
+		}
+	}
+	return img, readAncillary(data), nil
+}
+
+// straightAlpha returns img with alpha samples the encoder can change on
+// their own, as an *image.NRGBA, or an *image.NRGBA64 for 16 bit samples.
+// Every color is kept exactly.
+func straightAlpha(img image.Image) image.Image {
+	var m draw.Image
+	switch img.(type) {
+	case *image.NRGBA, *image.NRGBA64:
+		return img
+	case *image.RGBA64, *image.Gray16:
+		m = image.NewNRGBA64(img.Bounds())
+	default:
+		m = image.NewNRGBA(img.Bounds())
+	}
+	draw.Draw(m, m.Bounds(), img, img.Bounds().Min, draw.Src)
+	return m
+}
+
+// saveImage saves img to file in the format its extension names, see
+// formatFor, with extra from the cover written into the file if it is not
+// nil.
+func saveImage(file string, img image.Image, extra *ancillary) error {
+	format := formatFor(file)
+
+	var buf bytes.Buffer
+	encode := format.encode
+	if format.name == "bmp" {
+		encode = func(w io.Writer, img image.Image) error {
+			return encodeBMP(w, img, outputBMPDepth(extra))
+		}
+	}
+	if err := encode(&buf, img); err != nil {
+		return err
+	}
+	return writeFileAtomic(file, extra.apply(format.name, buf.Bytes()), 0666)
+}
+
+type decodeOptions struct {
+	// library holds the passphrase, if one was given up front.
+	library *hidden.Options
+
+	// auto tries every supported layout.
+	auto bool
+
+	// ignoreChecksum writes the message even if it is damaged.
+	ignoreChecksum bool
+
+	// recover writes what is left of a message with resync markers.
+	recover bool
+
+	// stdout writes the message to stdout instead of a file.
+	stdout bool
+
+	// armor writes the message as wrapped base64 text.
+	armor bool
+
+	// json writes the message as base64 in a JSON object, to stdout.
+	json bool
+
+	// stream reads the message from a BMP a row at a time.
+	stream bool
+}
+
+func decode(fin, fout string, opt decodeOptions) error {
+	defer wipeSecrets()
+	var (
+		img      image.Image
+		data     []byte
+		msg      []byte
+		layout   string
+		repaired int
+		err      error
+	)
+
+	shards, sharded := shardFiles(fin)
+	video := isY4M(fin)
+	if opt.stream && (opt.auto || opt.recover) {
+		return usagef("-auto and -recover need the whole image, they can not be combined with -stream")
+	}
+	if sharded && (opt.auto || opt.recover || opt.stream) {
+		return usagef("-auto, -recover and -stream can not be combined with several images")
+	}
+	if sharded {
+		// The first image names the directory and holds the file
+		// attributes of the message, like a single one would.
+		fin = shards[0]
+	}
+	start := time.Now()
+	if !video && !opt.stream {
+		data, err = readImageFile(fin)
+		if err != nil {
+			return err
+		}
+	}
+	if !sharded {
+		if err := checkNotShard(fin, data); err != nil {
+			return err
+		}
+	}
+	if !video && !opt.stream && !sharded && !isJPEG(data) && !isGIF(data) && !isTIFF(data) && !isICO(data) && !inMetadata(data) {
+		if img, _, err = hidden.DecodeImage(bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+	if data != nil {
+		trace("Read the image", start, "file", fin)
+	}
+
+	if slotLabel != "" && (img == nil || opt.recover || opt.auto) {
+		return errSlotPixels
+	}
+	if opt.library.Raw && (img == nil || opt.recover || opt.auto) {
+		return usagef("-compat only reads the pixels of a BMP or PNG image, it can not be combined with -auto, -recover or -stream")
+	}
+
+	start = time.Now()
+	err = withPassphrase(opt.library, func(lib *hidden.Options) (err error) {
+		if sharded {
+			msg, err = decodeShards(shards, lib)
+		} else if video {
+			msg, err = decodeY4M(fin, lib)
+		} else if opt.stream {
+			msg, err = decodeBMPStream(fin, lib)
+		} else if img == nil {
+			msg, err = decodeData(data, lib)
+		} else if opt.recover {
+			msg, err = recoverMessage(img, lib)
+		} else if opt.auto {
+			msg, layout, err = hidden.DecodeAuto(img, lib)
+		} else {
+			msg, repaired, err = decodeSlot(img, lib)
+		}
+		secret(msg)
+		return err
+	})
+	trace("Extracted the message", start, "size", len(msg))
+	if err == nil && repaired > 0 {
+		logger.Info(fmt.Sprintf("Repaired %d damaged bytes.", repaired))
+	}
+	if err == nil && opt.auto {
+		logger.Info(fmt.Sprint("Found message with ", layout))
+	}
+
+	if e, ok := err.(*hidden.ChecksumError); ok {
+		if !opt.ignoreChecksum {
+			return fmt.Errorf("%w\n%s", e, damageReport(e))
+		}
+		warnf("writing message with invalid checksum.")
+		msg, err = secret(e.Payload), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if opt.json {
+		var (
+			format, checksum string
+			h                *hidden.Header
+		)
+		// The header of an image with slots is that of their table.
+		if img != nil && slotLabel == "" {
+			h, err = hidden.DecodeHeader(img)
+		} else if data != nil && slotLabel == "" {
+			h, err = headerData(data)
+		}
+		if err == nil && h != nil {
+			format, checksum = h.Format(), hex.EncodeToString(h.Checksum)
+		}
+		printJSON(struct {
+			Status   string   `json:"status"`
+			Size     int      `json:"size"`
+			Format   string   `json:"format,omitempty"`
+			Checksum string   `json:"checksum,omitempty"`
+			Layout   string   `json:"layout,omitempty"`
+			Warnings []string `json:"warnings,omitempty"`
+			Payload  string   `json:"payload"`
+		}{"ok", len(msg), format, checksum, layout, takeWarnings(), base64.StdEncoding.EncodeToString(msg)})
+		return nil
+	}
+
+	h := storedHeader(data)
+	if h.Bundle() && !opt.stdout && !opt.armor && (fout == "" || isDirTarget(fout)) {
+		dir := fout
+		if dir == "" {
+			dir = path.Join(outputDir(fin), "message")
+		}
+		n, err := unbundle(msg, dir)
+		if err != nil {
+			return err
+		}
+		files := "files"
+		if n == 1 {
+			files = "file"
+		}
+		logger.Info(fmt.Sprintf("Unpacked %d %s of the archive into %s", n, files, dir))
+		return nil
+	}
+	file, _ := h.File()
+	if fout == "" && !opt.stdout {
+		fout = defaultOutput(fin, msg, file, opt.armor)
+	}
+	if opt.armor {
+		msg = secret(armor(msg))
+	}
+
+	if !opt.stdout {
+		if err := checkClobber(fout); err != nil {
+			return err
+		}
+	}
+	if opt.stdout {
+		_, err = os.Stdout.Write(msg)
+		if ext, _ := sniffExtension(msg); err == nil && ext == ".txt" && !bytes.HasSuffix(msg, []byte("\n")) && term.IsTerminal(int(os.Stdout.Fd())) {
+			// Keep the shell prompt off the last line of the text.
+			fmt.Println()
+		}
+	} else {
+		err = writeMessage(fout, msg)
+	}
+	if err == nil && !opt.stdout {
+		err = restoreModTime(fout, file)
+	}
+	return err
+}
+
+// recoverMessage returns what Recover finds of the message in img, and
+// reports the ranges that were lost.
+func recoverMessage(img image.Image, opt *hidden.Options) ([]byte, error) {
+	rec, err := hidden.Recover(img, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rec.Missing) == 0 {
+		return rec.Payload, nil
+	}
+	for _, r := range rec.Missing {
+		first, last := r.Start/rec.BlockSize, (r.End-1)/rec.BlockSize
+		if first == last {
+			warnf("block %d, bytes %d to %d of %d, is damaged or missing.", first+1, r.Start, r.End, len(rec.Payload))
+		} else {
+			warnf("blocks %d to %d, bytes %d to %d of %d, are damaged or missing.", first+1, last+1, r.Start, r.End, len(rec.Payload))
+		}
+	}
+	total, missing := rec.Blocks()
+	logger.Info(fmt.Sprintf("Recovered %d of %d blocks.", total-len(missing), total))
+	return rec.Payload, nil
+}
+
+// defaultOutput names the file a message decoded from fin is written to when
+// none is given: the name of the file it was encoded from, if file has one,
+// or else message with an extension guessed from the contents.
+func defaultOutput(fin string, msg []byte, file hidden.FileInfo, armored bool) string {
+	var suffix string
+	if armored {
+		suffix = ".b64"
+	}
+
+	if isFileName(file.Name) {
+		fout := path.Join(outputDir(fin), file.Name+suffix)
+		logger.Info(fmt.Sprintf("Message was encoded from %s, writing %s", file.Name, fout))
+		return fout
+	}
+
+	ext, desc := sniffExtension(msg)
+	fout := path.Join(outputDir(fin), "message"+ext+suffix)
+	logger.Info(fmt.Sprintf("Detected %s, writing %s", desc, fout))
+	return fout
+}
+
+// outputDir is the directory of what is encoded into or decoded from fin
+// when no output is given, -out-dir if it is set.
+func outputDir(fin string) string {
+	if outDir != "" {
+		return outDir
+	} else if isURL(fin) {
+		return "."
+	} else if archive, _, ok := splitZipPath(fin); ok {
+		return path.Dir(archive)
+	}
+	return path.Dir(fin)
+}
+
+// damageReport describes how plausible a damaged message is and what to try.
+func damageReport(e *hidden.ChecksumError) string {
+	return fmt.Sprintf(
+		"The header claims %d bytes, %.1f%% of the %d bytes the image can hold.\n"+
+			"Stored checksum %x, computed %x.\n"+
+			"%.1f%% of the message bytes are printable text.\n"+
+			"Use -ignore-checksum to write the message anyway.",
+		len(e.Payload), 100*float64(len(e.Payload))/float64(e.Capacity), e.Capacity,
+		e.Stored, e.Computed, 100*e.Printable())
+}
+
+type encodeOptions struct {
+	// text is the message, instead of the contents of the message file,
+	// unless it is empty.
+	text string
+
+	// bundle is the files and directories to encode as a tar archive,
+	// instead of the message file, unless it is empty.
+	bundle []string
+
+	// verify decodes the written image and compares it with the message.
+	verify bool
+
+	// overwrite allows encoding into a cover that already carries a message.
+	overwrite bool
+
+	// armor decodes the message from base64 text before encoding it.
+	armor bool
+
+	// integrity validates the message, the library default if nil.
+	integrity hidden.Integrity
+
+	// passphrase encrypts the message with cipher, unless it is empty.
+	passphrase []byte
+	cipher     hidden.Cipher
+
+	// seed seeds the random choices that need not be secret, and with
+	// deterministic the salt and nonce of an encrypted message.
+	seed          int64
+	deterministic bool
+
+	// recipients encrypt the message to their public keys instead of a
+	// passphrase, unless there are none.
+	recipients []hidden.Recipient
+
+	// blockSize stores the message behind resync markers, unless it is 0,
+	// copies times if it is more than 1.
+	blockSize int
+	copies    int
+
+	// chunkSize stores the message in chunks, unless it is 0.
+	chunkSize int
+
+	// compression compresses the message before it is encrypted, unless it
+	// is nil.
+	compression hidden.Compression
+
+	// ecc is the number of Reed-Solomon parity bytes in every codeword of
+	// the message, none if it is 0.
+	ecc int
+
+	// hamming stores the message in Hamming codes instead of ecc.
+	hamming bool
+
+	// depth is the number of low bits of every channel that carry the
+	// message, the library default if zero.
+	depth hidden.ChannelDepth
+
+	// autoDepth chooses the least depth the message fits in instead.
+	autoDepth bool
+
+	// bitOrder is the order the bits of every byte are stored in, and
+	// littleEndian stores the lengths of the header little endian.
+	bitOrder     hidden.BitOrder
+	littleEndian bool
+
+	// raw stores the message behind nothing but its length, as simple LSB
+	// tools do.
+	raw bool
+
+	// metadata stores the message in the metadata of a PNG or JPEG cover
+	// instead of its pixels.
+	metadata bool
+
+	// jpegQuality writes a JPEG with the message in its DCT coefficients,
+	// unless it is 0.
+	jpegQuality int
+
+	// expires is when decoding starts refusing the message, unless it is
+	// zero.
+	expires time.Time
+
+	// meta is the user metadata stored in the header.
+	meta []hidden.Field
+
+	// seal stores a hash of the image outside the message in the header.
+	seal bool
+
+	// matching embeds by stepping samples instead of replacing their
+	// lowest bit.
+	matching bool
+
+	// preserveHistogram restores the histogram of the cover after the
+	// message is stored.
+	preserveHistogram bool
+
+	// fill sets the unused carrier bits to random bits.
+	fill bool
+
+	// preset is recorded in the header, unless it is 0.
+	preset hidden.Preset
+
+	// fileInfo stores the attributes of the message file in the header,
+	// file is them once the message was read from one.
+	fileInfo bool
+	file     *hidden.FileInfo
+
+	// signingKey signs the message, unless it is nil.
+	signingKey ed25519.PrivateKey
+
+	// stream encodes a BMP cover a row at a time.
+	stream bool
+
+	// generate names the generator that draws the cover instead of reading
+	// it, size is its dimensions unless zero.
+	generate string
+	size     image.Point
+
+	// placement decides where the payload goes, the library default if
+	// nil.
+	placement hidden.Placement
+
+	// hiddenPayload is a second message behind this one, found with a
+	// passphrase of its own, unless it is nil. It needs a Deniable
+	// placement.
+	hiddenPayload *hidden.HiddenPayload
+
+	// pad XORs the message with a one-time pad, unless it is nil. The
+	// bytes used are recorded in padTracking, if set.
+	pad         *hidden.Pad
+	padTracking string
+
+	// maxChanges is the largest fraction of the color samples encoding may
+	// change, unless it is 0.
+	maxChanges float64
+
+	// dryRun encodes without writing the result.
+	dryRun bool
+
+	// report prints the PSNR and SSIM of the encoded image.
+	report bool
+
+	// debugMap names the file the map of the changed pixels is written to,
+	// unless it is empty.
+	debugMap string
+
+	// maxUpscale allows scaling the cover up by at most this much if the
+	// message does not fit, unless it is 0.
+	maxUpscale float64
+
+	// manifest names the file the manifest of the encode is written to,
+	// unless it is empty, json prints it on stdout.
+	manifest string
+	json     bool
+
+	// warnings collects the warnings about the encode besides logging
+	// them, unless it is nil.
+	warnings *[]string
+}
+
+// warnf logs a warning about the encode with warnf, and adds it to
+// opt.warnings.
+func (opt encodeOptions) warnf(format string, args ...interface{}) {
+	if opt.warnings != nil {
+		*opt.warnings = append(*opt.warnings, fmt.Sprintf(format, args...))
+	}
+	warnf(format, args...)
+}
+
+// library translates opt into library options. This is the only place the
+// command line does that for encoding, so it behaves like the library.
+func (opt *encodeOptions) library() (*hidden.Options, error) {
+	var opts []hidden.Option
+	if opt.integrity != nil {
+		opts = append(opts, hidden.WithIntegrity(opt.integrity))
+	}
+	if len(opt.passphrase) > 0 {
+		opts = append(opts, hidden.WithPassphrase(opt.passphrase), hidden.WithCipher(opt.cipher))
+	}
+	if len(opt.recipients) > 0 {
+		opts = append(opts, hidden.WithRecipients(opt.recipients...))
+	}
+	if opt.blockSize != 0 {
+		opts = append(opts, hidden.WithBlockSize(opt.blockSize))
+	}
+	if opt.copies > 1 {
+		opts = append(opts, hidden.WithCopies(opt.copies))
+	}
+	if opt.chunkSize != 0 {
+		opts = append(opts, hidden.WithChunkSize(opt.chunkSize))
+	}
+	if opt.ecc != 0 {
+		opts = append(opts, hidden.WithECC(opt.ecc))
+	}
+	if opt.hamming {
+		opts = append(opts, hidden.WithHamming())
+	}
+	if opt.compression != nil {
+		opts = append(opts, hidden.WithCompression(opt.compression))
+	}
+	if opt.placement != nil {
+		opts = append(opts, hidden.WithPlacement(opt.placement))
+	}
+	if opt.hiddenPayload != nil {
+		opts = append(opts, hidden.WithHidden(opt.hiddenPayload.Passphrase, opt.hiddenPayload.Payload))
+	}
+	if opt.depth != (hidden.ChannelDepth{}) {
+		opts = append(opts, hidden.WithDepth(opt.depth))
+	}
+	if opt.bitOrder != hidden.MSBFirst {
+		opts = append(opts, hidden.WithBitOrder(opt.bitOrder))
+	}
+	if opt.littleEndian {
+		opts = append(opts, hidden.WithLittleEndian())
+	}
+	if opt.raw {
+		opts = append(opts, hidden.WithRaw())
+	}
+	if !opt.expires.IsZero() {
+		opts = append(opts, hidden.WithExpiry(opt.expires))
+	}
+	if len(opt.meta) > 0 {
+		opts = append(opts, hidden.WithMetadata(opt.meta...))
+	}
+	opts = append(opts, hidden.WithRandom(rand.New(rand.NewSource(opt.seed))))
+	if opt.deterministic {
+		opts = append(opts, hidden.WithDeterministic())
+	}
+	if opt.pad != nil {
+		opts = append(opts, hidden.WithPad(opt.pad))
+	}
+	if opt.seal {
+		opts = append(opts, hidden.WithSeal())
+	}
+	if opt.matching {
+		opts = append(opts, hidden.WithMatching())
+	}
+	if opt.preserveHistogram {
+		opts = append(opts, hidden.WithPreserveHistogram())
+	}
+	if opt.fill {
+		opts = append(opts, hidden.WithFill())
+	}
+	if opt.preset != 0 {
+		opts = append(opts, hidden.WithPreset(opt.preset))
+	}
+	if opt.file != nil {
+		opts = append(opts, hidden.WithFile(*opt.file))
+	}
+	if len(opt.bundle) > 0 {
+		opts = append(opts, hidden.WithBundle())
+	}
+	if opt.signingKey != nil {
+		opts = append(opts, hidden.WithSigningKey(opt.signingKey))
+	}
+	return hidden.NewOptions(opts...)
+}
+
+// integrityFlag is a flag.Value selecting a registered integrity algorithm.
+type integrityFlag struct {
+	hidden.Integrity
+}
+
+// eccValue is a flag.Value of the error correction of -ecc: a number of
+// Reed-Solomon parity bytes, or hamming.
+type eccValue struct {
+	parity  int
+	hamming bool
+}
+
+// eccFlag defines the -ecc flag in fs.
+func eccFlag(fs *flag.FlagSet, usage string) *eccValue {
+	f := &eccValue{}
+	fs.Var(f, "ecc", usage)
+	return f
+}
+
+func (f *eccValue) String() string {
+	if f.hamming {
+		return "hamming"
+	}
+	return strconv.Itoa(f.parity)
+}
+
+func (f *eccValue) Set(s string) error {
+	if s == "hamming" {
+		f.parity, f.hamming = 0, true
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid error correction %q, want a number of parity bytes or hamming", s)
+	}
+	f.parity, f.hamming = n, false
+	return nil
+}
+
+// checksumFlag defines the -checksum flag in fs.
+func checksumFlag(fs *flag.FlagSet) *integrityFlag {
+	var names []string
+	for _, i := range hidden.Integrities() {
+		names = append(names, i.Name())
+	}
+
+	f := &integrityFlag{}
+	fs.Var(f, "checksum", "Checksum of the message: "+strings.Join(names, ", ")+". (default blake2b-128)")
+	return f
+}
+
+func (f *integrityFlag) String() string {
+	if f.Integrity == nil {
+		return ""
+	}
+	return f.Name()
+}
+
+func (f *integrityFlag) Set(name string) error {
+	i, ok := hidden.LookupIntegrity(name)
+	if !ok {
+		return fmt.Errorf("unknown checksum %q", name)
+	}
+	f.Integrity = i
+	return nil
+}
+
+// compressionFlag is a flag.Value selecting a registered compression
+// method.
+type compressionFlag struct {
+	hidden.Compression
+}
+
+// compressFlag defines the -compress flag in fs.
+func compressFlag(fs *flag.FlagSet) *compressionFlag {
+	f := &compressionFlag{}
+	fs.Var(f, "compress", "Compress message with: "+compressionNames()+".")
+	return f
+}
+
+// compressionNames lists the registered compression methods, the only ones
+// -compress accepts.
+func compressionNames() string {
+	var names []string
+	for _, c := range hidden.Compressions() {
+		names = append(names, c.Name())
+	}
+	return strings.Join(names, ", ")
+}
+
+func (f *compressionFlag) String() string {
+	if f.Compression == nil {
+		return ""
+	}
+	return f.Name()
+}
+
+func (f *compressionFlag) Set(name string) error {
+	c, ok := hidden.LookupCompression(name)
+	if !ok {
+		return fmt.Errorf("unknown compression %q, expected one of %s", name, compressionNames())
+	}
+	f.Compression = c
+	return nil
+}
+
+// channelDepthFlag is a flag.Value holding a hidden.ChannelDepth, the
+// channels of -channels it is limited to, and whether -alpha adds the alpha
+// channel.
+type channelDepthFlag struct {
+	hidden.ChannelDepth
+	channels string
+	alpha    bool
+}
+
+// depthFlag defines the -depth, -channels and -alpha flags in fs.
+func depthFlag(fs *flag.FlagSet) *channelDepthFlag {
+	f := &channelDepthFlag{}
+	fs.Var(f, "depth", "Low bits of each channel to use, like 2 or r:1,g:1,b:3. (default 1)")
+	fs.StringVar(&f.channels, "channels", "", "Channels to use, like b or gb. (default rgb)")
+	fs.BoolVar(&f.alpha, "alpha", false, "Also use the alpha channel.")
+	return f
+}
+
+// depth returns the depths of -depth in the channels of -channels, with the
+// alpha channel of -alpha.
+func (f *channelDepthFlag) depth() (hidden.ChannelDepth, error) {
+	d, err := f.channelDepth()
+	if err != nil || !f.alpha {
+		return d, err
+	}
+	if d[3] > 0 {
+		return d, errors.New("-alpha adds the alpha channel, which -depth or -channels already gives")
+	}
+	if d == (hidden.ChannelDepth{}) {
+		d = hidden.ChannelDepth{1, 1, 1}
+	}
+	d[3] = 1
+	return d, nil
+}
+
+// channelDepth returns the depths of -depth in the channels of -channels.
+func (f *channelDepthFlag) channelDepth() (hidden.ChannelDepth, error) {
+	if f.channels == "" {
+		return f.ChannelDepth, nil
+	}
+	d, err := hidden.ParseChannels(f.channels)
+	if err != nil {
+		return d, err
+	}
+
+	n := 1
+	if f.ChannelDepth != (hidden.ChannelDepth{}) {
+		n = f.ChannelDepth[0]
+		if f.ChannelDepth[1] != n || f.ChannelDepth[2] != n {
+			return d, errors.New("-channels needs -depth as one number, or give the channels in -depth instead")
+		}
+	}
+	for c := range d {
+		d[c] *= n
+	}
+	return d, nil
+}
+
+func (f *channelDepthFlag) String() string {
+	if f.ChannelDepth == (hidden.ChannelDepth{}) {
+		return ""
+	}
+	return f.ChannelDepth.String()
+}
+
+func (f *channelDepthFlag) Set(s string) error {
+	d, err := hidden.ParseChannelDepth(s)
+	if err != nil {
+		return err
+	}
+	f.ChannelDepth = d
+	return nil
+}
+
+// encode hides the contents of fmsg in the cover image fin and writes the
+// result to fout.
+func encode(fin, fout, fmsg string, opt encodeOptions) error {
+	defer wipeSecrets()
+	lib, err := opt.library()
+	if err != nil {
+		return err
+	}
+
+	// A compressed message may well be larger than the cover holds, and
+	// the capacity of an adaptive placement depends on the pixels, which
+	// coverCapacity does not read.
+	limit := fetchMaxSize
+	_, adaptive := opt.placement.(hidden.Adaptive)
+	if isURL(fmsg) && opt.generate == "" && opt.compression == nil && !adaptive {
+		capacity, err := coverCapacity(fin, lib)
+		if err != nil {
+			return err
+		}
+		limit = int64(capacity)
+	}
+
+	msg := []byte(opt.text)
+	switch {
+	case len(opt.bundle) > 0:
+		if msg, err = bundle(opt.bundle); err != nil {
+			return err
+		}
+	case opt.text == "":
+		if msg, err = readMessage(fmsg, limit); err != nil {
+			return err
+		}
+		if opt.fileInfo && !opt.armor {
+			if opt.file, err = messageFile(fmsg, msg); err != nil {
+				return err
+			}
+		}
+	}
+	secret(msg)
+	if opt.armor {
+		if msg, err = unarmor(msg); err != nil {
+			return err
+		}
+		secret(msg)
+	}
+
+	if fins, ok := shardFiles(fin); ok {
+		err = encodeShards(fins, strings.Split(fout, ","), msg, opt)
+	} else {
+		err = encodeFile(fin, fout, msg, opt)
+	}
+	if err != nil {
+		return err
+	}
+	if err := commitPad(opt.padTracking, opt.pad, len(msg)); err != nil {
+		return err
+	}
+
+	if (opt.manifest != "" || opt.json) && !opt.dryRun {
+		m, err := newManifest(fin, fout, msg, opt)
+		if err != nil {
+			return err
+		}
+		if opt.manifest != "" {
+			if err := writeManifest(opt.manifest, m); err != nil {
+				return err
+			}
+		}
+		if opt.json {
+			res := encodeResult{Status: "ok", manifest: m, Warnings: takeWarnings()}
+			if _, sharded := shardFiles(fin); opt.generate == "" && !sharded && !opt.stream && !isY4M(fin) {
+				if data, err := readImageFile(fin); err == nil {
+					res.Capacity, _ = dataCapacity(data, opt.jpegQuality, lib)
+				}
+			}
+			printJSON(res)
+		}
+	}
+	return nil
+}
+
+// encodeResult is what encode prints with -json: the manifest, and how
+// much the cover could have held.
+type encodeResult struct {
+	Status string `json:"status"`
+	*manifest
+	Capacity int      `json:"capacity,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// errAutoDepthPixels is returned for -auto-depth with a cover whose message
+// is not stored in its pixels.
+var errAutoDepthPixels = usagef("-auto-depth only applies to the pixels of a BMP or PNG")
+
+func encodeFile(fin, fout string, msg []byte, opt encodeOptions) error {
+	if _, _, ok := splitZipPath(fout); ok {
+		return encodeZipEntry(fin, fout, msg, opt)
+	}
+
+	lib, err := opt.library()
+	if err != nil {
+		return err
+	}
+
+	if opt.maxChanges < 0 || opt.maxChanges > 1 {
+		return fmt.Errorf("-max-changes %v is not a fraction between 0 and 1", opt.maxChanges)
+	}
+	if opt.metadata {
+		return encodeMetadata(fin, fout, msg, opt, lib)
+	}
+
+	if opt.generate == "" && isY4M(fin) && opt.jpegQuality == 0 {
+		if opt.maxChanges > 0 {
+			return errors.New("-max-changes only applies to images, not video streams")
+		}
+		if opt.debugMap != "" {
+			return errors.New("-debug-map only applies to images, not video streams")
+		}
+		if opt.report {
+			return errors.New("-report only applies to images, not video streams")
+		}
+		err = encodeY4M(fin, fout, msg, opt, lib)
+		if err == nil && opt.verify && !opt.dryRun {
+			err = verifyImage(fout, msg, lib)
+		}
+		return err
+	}
+	if slotLabel != "" && (opt.stream || opt.jpegQuality > 0 || opt.generate == "" && isY4M(fin)) {
+		return errSlotPixels
+	}
+	if opt.autoDepth && (opt.stream || opt.jpegQuality > 0 || opt.generate == "" && isY4M(fin)) {
+		return errAutoDepthPixels
+	}
+	if opt.stream {
+		if opt.report {
+			return errors.New("-report needs the whole image, it can not be combined with -stream")
+		}
+		return encodeBMPStream(fin, fout, msg, opt, lib)
+	}
+
+	var (
+		srcImg image.Image
+		extra  *ancillary
+		start  = time.Now()
+	)
+	if opt.generate != "" {
+		srcImg, err = generateCover(opt.generate, opt.size, len(msg), opt.seed, lib)
+	} else {
+		var data []byte
+		data, err = readImageFile(fin)
+		if err == nil && opt.report && opt.jpegQuality == 0 && (isGIF(data) || isTIFF(data) || isICO(data)) {
+			return errors.New("-report only applies to BMP, PNG and JPEG images")
+		}
+		if err == nil && slotLabel != "" && (isGIF(data) || isTIFF(data) || isICO(data) || isJPEG(data)) {
+			return errSlotPixels
+		}
+		if err == nil && opt.autoDepth && (isGIF(data) || isTIFF(data) || isICO(data) || isJPEG(data)) {
+			return errAutoDepthPixels
+		}
+		if err == nil && isGIF(data) && opt.jpegQuality == 0 {
+			return encodeGIF(fin, data, fout, msg, opt, lib)
+		} else if err == nil && isTIFF(data) && opt.jpegQuality == 0 && !convertTIFF(fout) {
+			return encodeTIFF(fin, data, fout, msg, opt, lib)
+		} else if err == nil && isTIFF(data) && opt.jpegQuality == 0 {
+			srcImg, err = tiffCover(data)
+		} else if err == nil && isICO(data) && opt.jpegQuality == 0 {
+			return encodeICO(fin, data, fout, msg, opt, lib)
+		} else if err == nil && isJPEG(data) && opt.jpegQuality == 0 {
+			return fmt.Errorf("%s is a JPEG, use -jpeg to hide the message in its DCT coefficients", fin)
+		} else if err == nil {
+			srcImg, extra, err = decodeCover(data)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	trace("Read the cover", start, "file", fin)
+	if opt.depth[3] > 0 {
+		srcImg = straightAlpha(srcImg)
+	}
+	if formatFor(fout).name == "tiff" && opt.jpegQuality == 0 {
+		srcImg = tiffImage(srcImg)
+	}
+
+	// Another slot goes next to the others.
+	if !opt.overwrite && opt.generate == "" && !(slotLabel != "" && hasSlots(srcImg)) {
+		if size, _, err := hidden.Detect(srcImg); err == nil {
+			return fmt.Errorf("%s already contains a hidden message of %d bytes, use -overwrite-message to replace it", fin, size)
+		}
+	}
+
+	if opt.autoDepth {
+		d, err := hidden.AutoDepth(srcImg, msg, lib)
+		switch {
+		case err == hidden.ErrMessageTooLarge && opt.maxUpscale > 0:
+			// -resize-to-fit scales the cover up for the deepest.
+			d = hidden.ChannelDepth{hidden.MaxDepth, hidden.MaxDepth, hidden.MaxDepth}
+		case err == hidden.ErrMessageTooLarge:
+			return tooLarge(len(msg), lib)
+		case err != nil:
+			return err
+		}
+		lib.Depth = d
+		if d == (hidden.ChannelDepth{}) {
+			d = hidden.ChannelDepth{1, 1, 1}
+		}
+		logger.Info(fmt.Sprint("Storing the message at depth ", d))
+	}
+
+	if opt.maxUpscale > 0 {
+		capacity := func(img image.Image) int { return hidden.Capacity(img, lib) }
+		if opt.jpegQuality > 0 {
+			capacity = func(img image.Image) int { return hidden.CapacityJPEG(img, opt.jpegQuality, lib) }
+		}
+		if srcImg, err = fitCover(srcImg, len(msg), opt.maxUpscale, capacity); err != nil {
+			return err
+		}
+	}
+
+	if err := checkOutput(fout, srcImg, opt); err != nil {
+		return err
+	}
+
+	if opt.jpegQuality > 0 {
+		if opt.maxChanges > 0 {
+			return errors.New("-max-changes only applies to the pixels of an image, not to -jpeg")
+		}
+		if opt.debugMap != "" {
+			return errors.New("-debug-map only applies to the pixels of an image, not to -jpeg")
+		}
+		if opt.report && opt.dryRun {
+			return errors.New("-report measures the written JPEG, it can not be combined with -dry-run")
+		}
+		err = encodeJPEG(srcImg, fout, msg, opt, lib)
+		if err == nil && opt.report {
+			var stego image.Image
+			if stego, err = loadImage(fout); err == nil {
+				err = reportQuality(srcImg, stego)
+			}
+		}
+	} else {
+		var destImg image.Image
+		start = time.Now()
+		if slotLabel != "" {
+			destImg, err = hidden.EncodeSlot(srcImg, slotLabel, msg, lib)
+		} else {
+			destImg, err = hidden.Encode(srcImg, msg, lib)
+		}
+		if err == hidden.ErrMessageTooLarge {
+			err = tooLarge(len(msg), lib)
+		}
+		if err == nil {
+			trace("Hid the message", start, "size", len(msg))
+			logCapacity(len(msg), func() int { return hidden.Capacity(srcImg, lib) })
+			err = checkChanges(srcImg, destImg, len(msg), opt)
+		}
+		if err == nil && opt.debugMap != "" {
+			err = writeDebugMap(opt.debugMap, srcImg, destImg)
+		}
+		if err == nil && !opt.dryRun {
+			start = time.Now()
+			if err = saveImage(fout, destImg, extra); err == nil {
+				trace("Wrote the image", start, "file", fout)
+			}
+		}
+		if err == nil && opt.report {
+			err = reportQuality(srcImg, destImg)
+		}
+	}
+	if err != nil || opt.dryRun {
+		return err
+	}
+
+	if opt.verify {
+		start = time.Now()
+		if err := verifyImage(fout, msg, lib); err != nil {
+			os.Remove(fout)
+			return fmt.Errorf("verification failed, removed %s: %v", fout, err)
+		}
+		trace("Verified the image", start, "file", fout)
+	}
+	return nil
+}
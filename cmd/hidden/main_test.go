@@ -0,0 +1,62 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"image"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// testCover returns a w by h opaque cover of random pixels drawn from seed.
+func testCover(w, h int, seed int64) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	rand.New(rand.NewSource(seed)).Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	return img
+}
+
+// testMessage returns n random bytes drawn from seed.
+func testMessage(n int, seed int64) []byte {
+	msg := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(msg)
+	return msg
+}
+
+// writeTestImage saves img as name in a temporary directory of t, in the
+// format of its extension, and returns the path.
+func writeTestImage(t testing.TB, name string, img image.Image) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := saveImage(file, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// writeTestFile writes data as name in dir and returns the path.
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
@@ -0,0 +1,353 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// version is the version of the tool, set with
+// -ldflags "-X main.version=...".
+var version = "devel"
+
+// manifestVersion is the version of the manifest schema. It changes when a
+// field is removed or changes meaning, not when one is added.
+const manifestVersion = 1
+
+// manifest records what an encode embedded where, for chain of custody. It
+// never holds the passphrase, or anything derived from it.
+type manifest struct {
+	Version int       `json:"manifest_version"`
+	Tool    string    `json:"tool"`
+	Created time.Time `json:"created"`
+
+	// Cover is absent for a -generate cover.
+	Cover   *fileDigest     `json:"cover,omitempty"`
+	Stego   fileDigest      `json:"stego"`
+	Payload payloadDigest   `json:"payload"`
+	Options manifestOptions `json:"options"`
+}
+
+type fileDigest struct {
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// payloadDigest describes the message as given, before it is encrypted or
+// padded.
+type payloadDigest struct {
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type manifestOptions struct {
+	// Format is the container format as info reports it.
+	Format string `json:"format"`
+
+	// Carrier is what holds the message: pixels, jpeg, gif, tiff or y4m.
+	Carrier string `json:"carrier"`
+
+	// Depth and Channels are the layout of a pixels carrier, ChannelDepth
+	// replaces them if -depth was given.
+	Depth        int    `json:"depth,omitempty"`
+	Channels     string `json:"channels,omitempty"`
+	ChannelDepth string `json:"channel_depth,omitempty"`
+
+	Checksum    string     `json:"checksum"`
+	Cipher      string     `json:"cipher,omitempty"`
+	Recipients  []string   `json:"recipients,omitempty"`
+	Compression string     `json:"compression,omitempty"`
+	OneTimePad  bool       `json:"one_time_pad,omitempty"`
+	Seal        bool       `json:"seal,omitempty"`
+	Matching    bool       `json:"matching,omitempty"`
+	BitOrder    string     `json:"bit_order,omitempty"`
+	Little      bool       `json:"little_endian,omitempty"`
+	Histogram   bool       `json:"preserve_histogram,omitempty"`
+	Fill        bool       `json:"fill,omitempty"`
+	Preset      string     `json:"preset,omitempty"`
+	Signed      bool       `json:"signed,omitempty"`
+	Placement   string     `json:"placement,omitempty"`
+	Resync      int        `json:"resync,omitempty"`
+	Copies      int        `json:"copies,omitempty"`
+	ChunkSize   int        `json:"chunk_size,omitempty"`
+	ECC         int        `json:"ecc,omitempty"`
+	ECCScheme   string     `json:"ecc_scheme,omitempty"`
+	JPEGQuality int        `json:"jpeg_quality,omitempty"`
+	Page        int        `json:"page,omitempty"`
+	Entry       int        `json:"entry,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+}
+
+// newManifest describes encoding msg from fin, or a generated cover, into
+// fout with opt.
+func newManifest(fin, fout string, msg []byte, opt encodeOptions) (*manifest, error) {
+	stego, err := digestFile(fout)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readImageFile(fout)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{
+		Version: manifestVersion,
+		Tool:    "hidden " + version,
+		Created: time.Now().UTC().Truncate(time.Second),
+		Stego:   *stego,
+		Payload: digestPayload(msg),
+	}
+	if opt.generate == "" {
+		if m.Cover, err = digestFile(fin); err != nil {
+			return nil, err
+		}
+	}
+
+	o := &m.Options
+	if opt.raw {
+		o.Format = "raw"
+	} else if isY4M(fout) {
+		_, o.Format, err = hidden.DetectY4M(bytes.NewReader(data))
+	} else {
+		_, o.Format, err = detectData(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case opt.jpegQuality > 0:
+		o.Carrier, o.JPEGQuality = "jpeg", opt.jpegQuality
+	case isY4M(fout):
+		o.Carrier = "y4m"
+	case isGIF(data):
+		o.Carrier = "gif"
+	case isTIFF(data):
+		o.Carrier, o.Page = "tiff", tiffPage
+	case isICO(data):
+		o.Carrier, o.Entry = "ico", icoEntry
+	case opt.depth == (hidden.ChannelDepth{}):
+		o.Carrier, o.Depth, o.Channels = "pixels", 1, "rgb"
+	default:
+		o.Carrier, o.ChannelDepth = "pixels", opt.depth.String()
+	}
+
+	o.Checksum = hidden.BLAKE2b128.Name()
+	if opt.integrity != nil {
+		o.Checksum = opt.integrity.Name()
+	}
+	if opt.raw {
+		o.Checksum = "none"
+	}
+	if len(opt.passphrase) > 0 {
+		o.Cipher = hidden.AESGCM.Name()
+		if opt.cipher != nil {
+			o.Cipher = opt.cipher.Name()
+		}
+	}
+	for _, r := range opt.recipients {
+		o.Recipients = append(o.Recipients, r.String())
+	}
+	o.OneTimePad = opt.pad != nil
+	if opt.compression != nil {
+		o.Compression = opt.compression.Name()
+	}
+	o.Seal = opt.seal
+	o.Matching = opt.matching
+	if opt.bitOrder != hidden.MSBFirst {
+		o.BitOrder = opt.bitOrder.String()
+	}
+	o.Little = opt.littleEndian
+	o.Histogram = opt.preserveHistogram
+	o.Fill = opt.fill
+	if opt.preset != 0 {
+		o.Preset = opt.preset.String()
+	}
+	o.Signed = opt.signingKey != nil
+	switch opt.placement.(type) {
+	case hidden.Keyed, hidden.Deniable:
+		// A deniable placement stores the header of a keyed one, and
+		// the manifest tells no more.
+		o.Placement = "keyed"
+	case hidden.Adaptive:
+		o.Placement = "adaptive"
+	case hidden.Spread:
+		o.Placement = "spread"
+	case hidden.Exclude:
+		o.Placement = "exclude"
+	case nil:
+	default:
+		o.Placement = "permuted"
+	}
+	o.Resync = opt.blockSize
+	if opt.copies > 1 {
+		o.Copies = opt.copies
+	}
+	o.ChunkSize = opt.chunkSize
+	o.ECC = opt.ecc
+	if opt.hamming {
+		o.ECCScheme = hidden.Hamming.String()
+	}
+	if !opt.expires.IsZero() {
+		t := opt.expires.UTC()
+		o.Expires = &t
+	}
+	return m, nil
+}
+
+// digestFile returns the size and SHA-256 of file, which can also be an
+// http(s) URL.
+func digestFile(file string) (*fileDigest, error) {
+	data, err := readImageFile(file)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return &fileDigest{file, int64(len(data)), hex.EncodeToString(sum[:])}, nil
+}
+
+func digestPayload(msg []byte) payloadDigest {
+	sum := sha256.Sum256(msg)
+	return payloadDigest{len(msg), hex.EncodeToString(sum[:])}
+}
+
+// writeManifest writes m to file as indented JSON.
+func writeManifest(file string, m *manifest) error {
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, append(data, '\n'), 0666)
+}
+
+// readManifest reads the manifest in file, refusing schema versions it does
+// not know.
+func readManifest(file string) (*manifest, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s is not a manifest: %v", file, err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("%s has manifest version %d, this tool reads version %d", file, m.Version, manifestVersion)
+	}
+	return m, nil
+}
+
+func manifestCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("manifest verify", flag.ExitOnError)
+	passphrase := definePassphraseFlags(fs)
+	pageFlag(fs)
+	entryFlag(fs)
+	asJSON := jsonFlag(fs, "Output in JSON format.")
+
+	return fs, func(args []string) {
+		if len(args) == 0 || args[0] != "verify" {
+			commandUsage(fs, "manifest verify [flags] <stego> <manifest>")
+		}
+		parseFlags(fs, args[1:])
+
+		if fs.NArg() != 2 {
+			commandUsage(fs, "manifest verify [flags] <stego> <manifest>")
+		}
+
+		m, err := readManifest(fs.Arg(1))
+		if err != nil {
+			fatal(err)
+		}
+		opt, err := decodeOptionsFrom(passphrase)
+		if err != nil {
+			fatal(err)
+		}
+
+		report := verifyManifest(fs.Arg(0), m, opt)
+		if *asJSON {
+			printJSON(report)
+		} else {
+			printManifestReport(os.Stdout, report)
+		}
+		if !report.OK {
+			os.Exit(exitFailure)
+		}
+	}
+}
+
+// manifestReport is the result of checking a stego file against a
+// manifest.
+type manifestReport struct {
+	OK bool `json:"ok"`
+
+	// Stego is whether the file hashes to the recorded stego hash, Payload
+	// whether the message extracted from it hashes to the recorded payload
+	// hash.
+	Stego   bool `json:"stego"`
+	Payload bool `json:"payload"`
+
+	// Error is why the message could not be extracted.
+	Error string `json:"error,omitempty"`
+}
+
+// verifyManifest re-hashes file and the message extracted from it with
+// opt, and compares both with m.
+func verifyManifest(file string, m *manifest, opt *hidden.Options) *manifestReport {
+	report := &manifestReport{}
+	d, err := digestFile(file)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Stego = d.Size == m.Stego.Size && d.SHA256 == m.Stego.SHA256
+
+	err = withPassphrase(opt, func(opt *hidden.Options) error {
+		msg, err := extractFile(file, opt)
+		if err == nil {
+			report.Payload = digestPayload(msg) == m.Payload
+		}
+		return err
+	})
+	if err != nil {
+		report.Error = err.Error()
+	}
+	report.OK = report.Stego && report.Payload
+	return report
+}
+
+func printManifestReport(w io.Writer, r *manifestReport) {
+	state := map[bool]string{true: "matches", false: "DOES NOT MATCH"}
+	fmt.Fprintln(w, "Stego file:", state[r.Stego])
+	if r.Error != "" {
+		fmt.Fprintln(w, "Payload:    could not be extracted,", r.Error)
+	} else {
+		fmt.Fprintln(w, "Payload:   ", state[r.Payload])
+	}
+	if r.OK {
+		fmt.Fprintln(w, "OK")
+	}
+}
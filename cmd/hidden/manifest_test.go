@@ -0,0 +1,228 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// jsonSchema returns the dotted paths of the fields in the JSON data with
+// their types: string, number, bool, object or array.
+func jsonSchema(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	var v map[string]interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	schema := map[string]string{}
+	var walk func(prefix string, v map[string]interface{})
+	walk = func(prefix string, v map[string]interface{}) {
+		for k, f := range v {
+			switch f := f.(type) {
+			case string:
+				schema[prefix+k] = "string"
+			case float64:
+				schema[prefix+k] = "number"
+			case bool:
+				schema[prefix+k] = "bool"
+			case []interface{}:
+				schema[prefix+k] = "array"
+			case map[string]interface{}:
+				schema[prefix+k] = "object"
+				walk(prefix+k+".", f)
+			}
+		}
+	}
+	walk("", v)
+	return schema
+}
+
+// checkSchema fails t unless got and want hold the same fields and types.
+func checkSchema(t *testing.T, name string, got, want map[string]string) {
+	t.Helper()
+	var paths []string
+	for p := range want {
+		paths = append(paths, p)
+	}
+	for p := range got {
+		if _, ok := want[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if got[p] != want[p] {
+			t.Errorf("%s: %s is %q, want %q", name, p, got[p], want[p])
+		}
+	}
+}
+
+// manifestRequired are the fields every manifest has.
+var manifestRequired = map[string]string{
+	"manifest_version": "number",
+	"tool":             "string",
+	"created":          "string",
+	"stego":            "object",
+	"stego.file":       "string",
+	"stego.size":       "number",
+	"stego.sha256":     "string",
+	"payload":          "object",
+	"payload.size":     "number",
+	"payload.sha256":   "string",
+	"options":          "object",
+	"options.format":   "string",
+	"options.carrier":  "string",
+	"options.checksum": "string",
+}
+
+// TestManifestSchema pins the names and types of the fields of a manifest
+// of schema version 1, which tools reading them depend on.
+func TestManifestSchema(t *testing.T) {
+	data, err := json.Marshal(&manifest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSchema(t, "empty", jsonSchema(t, data), manifestRequired)
+
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	full := &manifest{
+		Version: manifestVersion,
+		Tool:    "hidden test",
+		Created: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Cover:   &fileDigest{"cover.png", 1, "00"},
+		Stego:   fileDigest{"stego.png", 2, "11"},
+		Payload: payloadDigest{3, "22"},
+		Options: manifestOptions{
+			Format: "v1", Carrier: "pixels", Depth: 1, Channels: "rgb", ChannelDepth: "r:1,g:1,b:2",
+			Checksum: "sha256", Cipher: "aes-256-gcm", Recipients: []string{"key"}, Compression: "deflate",
+			OneTimePad: true, Seal: true, Matching: true, BitOrder: "lsb-first", Little: true,
+			Histogram: true, Fill: true, Preset: "robust", Signed: true, Placement: "keyed",
+			Resync: 256, Copies: 2, ChunkSize: 4096, ECC: 16, ECCScheme: "hamming",
+			JPEGQuality: 90, Page: 1, Entry: 2, Expires: &expires,
+		},
+	}
+	if data, err = json.Marshal(full); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"cover":                      "object",
+		"cover.file":                 "string",
+		"cover.size":                 "number",
+		"cover.sha256":               "string",
+		"options.depth":              "number",
+		"options.channels":           "string",
+		"options.channel_depth":      "string",
+		"options.cipher":             "string",
+		"options.recipients":         "array",
+		"options.compression":        "string",
+		"options.one_time_pad":       "bool",
+		"options.seal":               "bool",
+		"options.matching":           "bool",
+		"options.bit_order":          "string",
+		"options.little_endian":      "bool",
+		"options.preserve_histogram": "bool",
+		"options.fill":               "bool",
+		"options.preset":             "string",
+		"options.signed":             "bool",
+		"options.placement":          "string",
+		"options.resync":             "number",
+		"options.copies":             "number",
+		"options.chunk_size":         "number",
+		"options.ecc":                "number",
+		"options.ecc_scheme":         "string",
+		"options.jpeg_quality":       "number",
+		"options.page":               "number",
+		"options.entry":              "number",
+		"options.expires":            "string",
+	}
+	for p, typ := range manifestRequired {
+		want[p] = typ
+	}
+	checkSchema(t, "full", jsonSchema(t, data), want)
+
+	var back manifest
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := json.Marshal(&back); !bytes.Equal(again, data) {
+		t.Errorf("a manifest does not survive a round trip:\n%s\n%s", data, again)
+	}
+}
+
+// TestManifestEncode writes the manifest of an encrypted encode, which holds
+// no trace of the passphrase, and verifies the encoded image against it.
+func TestManifestEncode(t *testing.T) {
+	dir := t.TempDir()
+	cover := writeTestImage(t, "cover.png", testCover(160, 120, 151))
+	msg := testMessage(1000, 151)
+	fmsg := writeTestFile(t, dir, "msg.bin", msg)
+	out, file := filepath.Join(dir, "out.png"), filepath.Join(dir, "manifest.json")
+
+	pass := "manifest passphrase"
+	if err := encode(cover, out, fmsg, encodeOptions{manifest: file, passphrase: []byte(pass), compression: hidden.Deflate}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), pass) {
+		t.Error("the manifest holds the passphrase")
+	}
+	schema := jsonSchema(t, data)
+	for p, typ := range manifestRequired {
+		if schema[p] != typ {
+			t.Errorf("%s is %q, want %q", p, schema[p], typ)
+		}
+	}
+
+	m, err := readManifest(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := m.Options
+	if m.Cover == nil || m.Cover.File != cover || m.Stego.File != out || m.Payload != digestPayload(msg) ||
+		o.Carrier != "pixels" || o.Cipher != hidden.AESGCM.Name() || o.Compression != "deflate" || o.Checksum != hidden.BLAKE2b128.Name() {
+		t.Errorf("the manifest does not describe the encode: %s", data)
+	}
+
+	lib := &hidden.Options{Passphrase: []byte(pass)}
+	if r := verifyManifest(out, m, lib); !r.OK {
+		t.Errorf("the encoded image does not match: %+v", r)
+	}
+	if r := verifyManifest(cover, m, lib); r.OK || r.Stego {
+		t.Errorf("the cover matches: %+v", r)
+	}
+	other := *m
+	other.Payload = digestPayload([]byte("another message"))
+	if r := verifyManifest(out, &other, lib); r.OK || !r.Stego || r.Payload {
+		t.Errorf("another message matches: %+v", r)
+	}
+
+	future := bytes.Replace(data, []byte(`"manifest_version": 1`), []byte(`"manifest_version": 2`), 1)
+	if _, err := readManifest(writeTestFile(t, dir, "future.json", future)); err == nil || !strings.Contains(err.Error(), "manifest version 2") {
+		t.Errorf("version 2: got %v", err)
+	}
+}
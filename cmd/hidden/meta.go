@@ -0,0 +1,111 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// userMeta holds the -meta flags, stored in the header when encoding, and
+// metaMax the size of the largest value they may have.
+var (
+	userMeta metaFlag
+	metaMax  = 1024
+)
+
+// metaFlags defines the -meta and -meta-max flags in fs.
+func metaFlags(fs *flag.FlagSet) {
+	fs.Var(&userMeta, "meta", "Store key=value in the header, can be repeated.")
+	fs.IntVar(&metaMax, "meta-max", metaMax, "Largest -meta value in bytes.")
+}
+
+// metaFlag is a flag.Value collecting key=value pairs, each key once.
+type metaFlag []hidden.UserEntry
+
+func (f *metaFlag) String() string {
+	var pairs []string
+	for _, e := range *f {
+		pairs = append(pairs, e.Key+"="+string(e.Value))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f *metaFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return errors.New("expected key=value")
+	}
+	key := s[:i]
+	if _, err := hidden.UserField(key, nil); err != nil {
+		return err
+	}
+	for _, e := range *f {
+		if e.Key == key {
+			return fmt.Errorf("metadata key %q is given more than once", key)
+		}
+	}
+	*f = append(*f, hidden.UserEntry{Key: key, Value: []byte(s[i+1:])})
+	return nil
+}
+
+// userFields returns the -meta flags as header fields.
+func userFields() ([]hidden.Field, error) {
+	var fields []hidden.Field
+	for _, e := range userMeta {
+		if len(e.Value) > metaMax {
+			return nil, fmt.Errorf("-meta %s is %d bytes, -meta-max allows %d", e.Key, len(e.Value), metaMax)
+		}
+		f, err := hidden.UserField(e.Key, e.Value)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// metaGet is the -meta key whose value is printed instead of decoding,
+// unless it is empty.
+var metaGet string
+
+// metaGetFlag defines the -meta-get flag in fs.
+func metaGetFlag(fs *flag.FlagSet) {
+	fs.StringVar(&metaGet, "meta-get", "", "Only print the -meta value of this key.")
+}
+
+// printUserValue prints the value stored under metaGet in the header of
+// the message in file.
+func printUserValue(file string) error {
+	data, err := readImageFile(file)
+	if err != nil {
+		return err
+	}
+	h, err := headerData(data)
+	if err != nil {
+		return err
+	}
+	v, ok := h.UserValue(metaGet)
+	if !ok {
+		return fmt.Errorf("%s has no metadata key %q", file, metaGet)
+	}
+	fmt.Println(string(v))
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// isPNG reports whether data starts with a PNG signature.
+func isPNG(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(pngSignature))
+}
+
+// hasMetadata reports whether data is a file that may carry a message in
+// its metadata, see -method.
+func hasMetadata(data []byte) bool {
+	return slotLabel == "" && (isPNG(data) || isJPEG(data))
+}
+
+// inMetadata reports whether data carries a message in its metadata, which
+// is decoded instead of its pixels.
+func inMetadata(data []byte) bool {
+	if !hasMetadata(data) {
+		return false
+	}
+	_, _, err := hidden.DetectMetadata(bytes.NewReader(data))
+	return err != hidden.ErrNoHiddenMessage
+}
+
+// encodeMetadata writes the PNG or JPEG fin to fout with msg in its
+// metadata, for -method metadata. The pixels are copied as they are.
+func encodeMetadata(fin, fout string, msg []byte, opt encodeOptions, lib *hidden.Options) error {
+	switch {
+	case opt.generate != "":
+		return errors.New("-method metadata needs a PNG or JPEG cover, it can not be combined with -generate")
+	case opt.stream || opt.jpegQuality > 0:
+		return errors.New("-method metadata keeps the pixels, it can not be combined with -stream or -jpeg")
+	case slotLabel != "" || opt.autoDepth || opt.maxChanges > 0 || opt.maxUpscale > 0 || opt.report || opt.debugMap != "":
+		return errors.New("-slot, -auto-depth, -max-changes, -resize-to-fit, -report and -debug-map only apply to the pixels, not to -method metadata")
+	}
+
+	data, err := readImageFile(fin)
+	if err != nil {
+		return err
+	}
+	if !isPNG(data) && !isJPEG(data) {
+		return fmt.Errorf("%s: %w", fin, hidden.ErrMetadataFormat)
+	}
+	if !opt.overwrite {
+		if size, _, err := hidden.DetectMetadata(bytes.NewReader(data)); err == nil {
+			return fmt.Errorf("%s already contains a hidden message of %d bytes, use -overwrite-message to replace it", fin, size)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := hidden.EncodeMetadata(&buf, bytes.NewReader(data), msg, lib); err != nil || opt.dryRun {
+		return err
+	}
+	if err := writeFileAtomic(fout, buf.Bytes(), 0666); err != nil {
+		return err
+	}
+	if opt.verify {
+		if err := verifyImage(fout, msg, lib); err != nil {
+			os.Remove(fout)
+			return fmt.Errorf("verification failed, removed %s: %v", fout, err)
+		}
+	}
+	return nil
+}
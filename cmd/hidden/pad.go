@@ -0,0 +1,102 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// padFlags are the flags of the one-time pad mode.
+type padFlags struct {
+	file     *string
+	tracking *string
+	idSize   *int
+}
+
+// definePadFlags defines -otp, -pad-offset and -pad-id-len in fs.
+func definePadFlags(fs *flag.FlagSet) *padFlags {
+	return &padFlags{
+		file:     fs.String("otp", "", "One-time pad file to XOR message with."),
+		tracking: fs.String("pad-offset", "", "File recording how much of the -otp pad is used."),
+		idSize:   fs.Int("pad-id-len", 8, "Bytes of the pad hash stored in the header."),
+	}
+}
+
+// pad returns the pad from -otp, with the offset from -pad-offset, or nil
+// without -otp.
+func (f *padFlags) pad() (*hidden.Pad, error) {
+	if *f.file == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(*f.file)
+	if err != nil {
+		return nil, err
+	}
+	p := &hidden.Pad{Data: data, IDSize: *f.idSize}
+
+	if *f.tracking != "" {
+		if p.Offset, err = readPadOffset(*f.tracking, p); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// readPadOffset returns the offset recorded in the tracking file for p, 0 if
+// the file does not exist yet. The file holds the hex ID of the pad and the
+// offset of its first unused byte.
+func readPadOffset(file string, p *hidden.Pad) (int, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("%s is not a pad offset file", file)
+	}
+	id, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a pad offset file", file)
+	}
+	if !bytes.Equal(id, p.ID()[:min(len(id), len(p.ID()))]) {
+		return 0, fmt.Errorf("%s tracks a different pad", file)
+	}
+	offset, err := strconv.Atoi(fields[1])
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("%s is not a pad offset file", file)
+	}
+	return offset, nil
+}
+
+// commitPad records in the tracking file that n bytes of p were used.
+func commitPad(file string, p *hidden.Pad, n int) error {
+	if file == "" || p == nil {
+		return nil
+	}
+	return writeFileAtomic(file, []byte(fmt.Sprintf("%x %d\n", p.ID(), p.Offset+n)), 0600)
+}
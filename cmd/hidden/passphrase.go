@@ -0,0 +1,293 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+	"golang.org/x/term"
+)
+
+// passphraseEnv can hold the passphrase for scripted use.
+const passphraseEnv = "HIDDEN_PASSPHRASE"
+
+// passphraseSource is where a passphrase is read from when it is not typed
+// on the terminal. At most one of its flags can be given; without any, the
+// passphrase comes from $HIDDEN_PASSPHRASE, and then the terminal.
+type passphraseSource struct {
+	file *string
+	env  *string
+	fd   *int
+}
+
+// definePassphraseFlags defines -passphrase-file, -passphrase-env and
+// -passphrase-fd in fs.
+func definePassphraseFlags(fs *flag.FlagSet) *passphraseSource {
+	return &passphraseSource{
+		file: fs.String("passphrase-file", "", "File holding the passphrase."),
+		env:  fs.String("passphrase-env", "", "Environment variable holding the passphrase."),
+		fd:   fs.Int("passphrase-fd", -1, "File descriptor to read the passphrase from."),
+	}
+}
+
+// given reports whether a source flag was given.
+func (s *passphraseSource) given() bool {
+	return s != nil && (*s.file != "" || *s.env != "" || *s.fd >= 0)
+}
+
+// read returns the passphrase from the source flag that was given.
+func (s *passphraseSource) read() ([]byte, error) {
+	var n int
+	for _, given := range []bool{*s.file != "", *s.env != "", *s.fd >= 0} {
+		if given {
+			n++
+		}
+	}
+	if n > 1 {
+		return nil, errors.New("give only one of -passphrase-file, -passphrase-env and -passphrase-fd")
+	}
+
+	switch {
+	case *s.file != "":
+		fp, err := os.Open(*s.file)
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		return firstLine(fp)
+	case *s.env != "":
+		env, ok := os.LookupEnv(*s.env)
+		if !ok {
+			return nil, fmt.Errorf("$%s is not set", *s.env)
+		}
+		return nonEmpty([]byte(env))
+	default:
+		fp := os.NewFile(uintptr(*s.fd), fmt.Sprintf("fd %d", *s.fd))
+		if fp == nil {
+			return nil, fmt.Errorf("invalid file descriptor %d", *s.fd)
+		}
+		defer fp.Close()
+		return firstLine(fp)
+	}
+}
+
+// firstLine returns the first line of r. Editors and echo add a newline,
+// nobody means it to be part of the passphrase. It reads a byte at a time,
+// so that no buffer is left holding the passphrase and nothing after the
+// newline is consumed, and wipes the line as it outgrows it.
+func firstLine(r io.Reader) ([]byte, error) {
+	var (
+		line []byte
+		b    [1]byte
+	)
+	for {
+		if _, err := io.ReadFull(r, b[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			hidden.Wipe(line)
+			return nil, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) == cap(line) {
+			grown := make([]byte, len(line), 2*cap(line)+64)
+			copy(grown, line)
+			hidden.Wipe(line)
+			line = grown
+		}
+		line = append(line, b[0])
+	}
+	hidden.Wipe(b[:])
+	return nonEmpty(bytes.TrimRight(line, "\r"))
+}
+
+// encryptionFlags are the flags that control payload encryption.
+type encryptionFlags struct {
+	encrypt       *bool
+	source        *passphraseSource
+	cipher        cipherFlag
+	seed          *int64
+	deterministic *bool
+}
+
+// defineEncryptionFlags defines -encrypt, the passphrase source flags,
+// -cipher, -seed and -deterministic in fs.
+func defineEncryptionFlags(fs *flag.FlagSet) *encryptionFlags {
+	var names []string
+	for _, c := range hidden.Ciphers() {
+		names = append(names, c.Name())
+	}
+
+	f := &encryptionFlags{}
+	f.encrypt = fs.Bool("encrypt", false, "Encrypt message with a passphrase.")
+	f.source = definePassphraseFlags(fs)
+	fs.Var(&f.cipher, "cipher", "Cipher to encrypt with: "+strings.Join(names, ", ")+". (default aes-256-gcm)")
+	f.seed = fs.Int64("seed", 0, "Seed of the random choices.")
+	f.deterministic = fs.Bool("deterministic", false, "Make encrypted output reproducible from -seed.")
+	return f
+}
+
+// apply sets up encryption in opt if it was asked for.
+func (f *encryptionFlags) apply(opt *encodeOptions) error {
+	opt.seed, opt.deterministic = *f.seed, *f.deterministic
+	if !f.wanted() {
+		return nil
+	}
+
+	passphrase, err := readPassphrase(f.source, true)
+	if err != nil {
+		return err
+	}
+	opt.passphrase, opt.cipher = passphrase, f.cipher.Cipher
+	return nil
+}
+
+// wanted reports whether a flag asks for the message to be encrypted with a
+// passphrase.
+func (f *encryptionFlags) wanted() bool {
+	return *f.encrypt || f.source.given() || f.cipher.Cipher != nil
+}
+
+// salt returns a fresh salt for a placement keyed by the passphrase, from
+// crypto/rand unless opt asks for deterministic output, when it is drawn
+// from -seed instead.
+func salt(opt *encodeOptions) ([16]byte, error) {
+	var s [16]byte
+	if opt.deterministic {
+		rand.New(rand.NewSource(opt.seed)).Read(s[:])
+		return s, nil
+	}
+	_, err := crand.Read(s[:])
+	return s, err
+}
+
+// decodeOptions returns library options for decoding, with the passphrase
+// if one was given by a source flag or the environment.
+func (f *encryptionFlags) decodeOptions(opts ...hidden.Option) (*hidden.Options, error) {
+	return decodeOptionsFrom(f.source, opts...)
+}
+
+// decodeOptionsFrom returns library options for decoding with opts, and the
+// passphrase from src or the environment, if any. This is the only place the
+// command line builds them.
+func decodeOptionsFrom(src *passphraseSource, opts ...hidden.Option) (*hidden.Options, error) {
+	if src.given() || os.Getenv(passphraseEnv) != "" {
+		passphrase, err := readPassphrase(src, false)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, hidden.WithPassphrase(passphrase))
+	}
+	return hidden.NewOptions(opts...)
+}
+
+// readPassphrase returns the passphrase from src, from $HIDDEN_PASSPHRASE,
+// or prompts for it on the terminal, twice if confirm is set. src can be
+// nil.
+func readPassphrase(src *passphraseSource, confirm bool) ([]byte, error) {
+	if src.given() {
+		passphrase, err := src.read()
+		return secret(passphrase), err
+	}
+	if env := os.Getenv(passphraseEnv); env != "" {
+		return secret([]byte(env)), nil
+	}
+
+	passphrase, err := promptPassphrase("Passphrase: ")
+	if err != nil || !confirm {
+		return passphrase, err
+	}
+	again, err := promptPassphrase("Repeat passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, again) {
+		return nil, errors.New("the passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// promptPassphrase reads a passphrase from the terminal without echoing it.
+// The prompt goes to stderr to keep stdout clean.
+func promptPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("a passphrase is required, use -passphrase-file, -passphrase-env, -passphrase-fd or $%s", passphraseEnv)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	return nonEmpty(secret(passphrase))
+}
+
+func nonEmpty(passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("the passphrase is empty")
+	}
+	return passphrase, nil
+}
+
+// cipherFlag is a flag.Value selecting a registered cipher.
+type cipherFlag struct {
+	hidden.Cipher
+}
+
+func (f *cipherFlag) String() string {
+	if f.Cipher == nil {
+		return ""
+	}
+	return f.Name()
+}
+
+func (f *cipherFlag) Set(name string) error {
+	c, ok := hidden.LookupCipher(name)
+	if !ok {
+		return fmt.Errorf("unknown cipher %q", name)
+	}
+	f.Cipher = c
+	return nil
+}
+
+// withPassphrase calls decode, and calls it again with a passphrase from the
+// terminal if the message turns out to be encrypted and opt has none.
+func withPassphrase(opt *hidden.Options, decode func(opt *hidden.Options) error) error {
+	err := decode(opt)
+	if !errors.Is(err, hidden.ErrPassphraseRequired) || len(opt.Passphrase) != 0 {
+		return err
+	}
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		if opt.Passphrase, err = promptPassphrase("Passphrase: "); err != nil {
+			return err
+		}
+		return decode(opt)
+	}
+	return fmt.Errorf("%v, use -passphrase-file, -passphrase-env, -passphrase-fd or $%s", err, passphraseEnv)
+}
@@ -0,0 +1,175 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// passphraseFlags returns the passphrase source flags parsed from args.
+func passphraseFlags(t *testing.T, args ...string) *passphraseSource {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	src := definePassphraseFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return src
+}
+
+func TestPassphraseSources(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(passphraseEnv, "")
+	t.Setenv("TEST_PASSPHRASE", "from env")
+	t.Setenv("TEST_EMPTY", "")
+
+	// Without a source, the passphrase would be prompted for.
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	stdin := os.Stdin
+	os.Stdin = null
+	defer func() { os.Stdin = stdin }()
+
+	pipe := func(data string) string {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteString(data)
+		w.Close()
+		// read closes the descriptor.
+		return strconv.Itoa(int(r.Fd()))
+	}
+
+	for _, c := range []struct {
+		name string
+		args []string
+		want string
+		err  string
+	}{
+		{"file", []string{"-passphrase-file", writeTestFile(t, dir, "a", []byte("from file"))}, "from file", ""},
+		{"file with newline", []string{"-passphrase-file", writeTestFile(t, dir, "b", []byte("from file\n"))}, "from file", ""},
+		{"file with crlf", []string{"-passphrase-file", writeTestFile(t, dir, "c", []byte("from file\r\nsecond line\n"))}, "from file", ""},
+		{"file with spaces", []string{"-passphrase-file", writeTestFile(t, dir, "d", []byte(" two words \n"))}, " two words ", ""},
+		{"empty file", []string{"-passphrase-file", writeTestFile(t, dir, "e", nil)}, "", "the passphrase is empty"},
+		{"empty line", []string{"-passphrase-file", writeTestFile(t, dir, "f", []byte("\nsecond line\n"))}, "", "the passphrase is empty"},
+		{"missing file", []string{"-passphrase-file", filepath.Join(dir, "missing")}, "", "no such file"},
+		{"env", []string{"-passphrase-env", "TEST_PASSPHRASE"}, "from env", ""},
+		{"unset env", []string{"-passphrase-env", "TEST_UNSET_PASSPHRASE"}, "", "$TEST_UNSET_PASSPHRASE is not set"},
+		{"empty env", []string{"-passphrase-env", "TEST_EMPTY"}, "", "the passphrase is empty"},
+		{"fd", []string{"-passphrase-fd", pipe("from fd\nnot this")}, "from fd", ""},
+		{"fd without newline", []string{"-passphrase-fd", pipe("from fd")}, "from fd", ""},
+		{"two sources", []string{"-passphrase-env", "TEST_PASSPHRASE", "-passphrase-file", filepath.Join(dir, "a")}, "", "give only one of"},
+		{"none", nil, "", "a passphrase is required"},
+	} {
+		got, err := readPassphrase(passphraseFlags(t, c.args...), false)
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: got %v, want an error with %q", c.name, err, c.err)
+		case string(got) != c.want:
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	t.Setenv(passphraseEnv, "from default env")
+	if got, err := readPassphrase(passphraseFlags(t), true); err != nil || string(got) != "from default env" {
+		t.Errorf("$%s: got %q, %v", passphraseEnv, got, err)
+	}
+	if got, err := readPassphrase(nil, false); err != nil || string(got) != "from default env" {
+		t.Errorf("$%s without flags: got %q, %v", passphraseEnv, got, err)
+	}
+	if got, err := readPassphrase(passphraseFlags(t, "-passphrase-env", "TEST_PASSPHRASE"), false); err != nil || string(got) != "from env" {
+		t.Errorf("a flag and $%s: got %q, %v, want the flag to win", passphraseEnv, got, err)
+	}
+}
+
+// TestPassphraseRoundTrip encrypts a message with the passphrase of one
+// source and decrypts it with the same passphrase from another.
+func TestPassphraseRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(passphraseEnv, "")
+	t.Setenv("TEST_PASSPHRASE", "correct horse")
+	cover := writeTestImage(t, "cover.png", testCover(200, 150, 144))
+	msg := writeTestFile(t, dir, "msg.bin", testMessage(1000, 144))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	enc := defineEncryptionFlags(fs)
+	if err := fs.Parse([]string{"-passphrase-file", writeTestFile(t, dir, "pass", []byte("correct horse\n"))}); err != nil {
+		t.Fatal(err)
+	}
+	var opt encodeOptions
+	if err := enc.apply(&opt); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out.png")
+	if err := encode(cover, out, msg, opt); err != nil {
+		t.Fatal(err)
+	}
+
+	lib, err := decodeOptionsFrom(passphraseFlags(t, "-passphrase-env", "TEST_PASSPHRASE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decodeTestImage(t, out, lib); !bytes.Equal(got, testMessage(1000, 144)) {
+		t.Errorf("decoded %d bytes that are not the message", len(got))
+	}
+
+	lib, err = decodeOptionsFrom(passphraseFlags(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := loadImage(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hidden.Decode(img, lib); err != hidden.ErrPassphraseRequired {
+		t.Errorf("without a passphrase: got %v, want %v", err, hidden.ErrPassphraseRequired)
+	}
+}
+
+// TestSalt checks that keyed placements get a fresh salt for every encode
+// with the default seed, and the same one for the same -seed only with
+// -deterministic.
+func TestSalt(t *testing.T) {
+	get := func(opt encodeOptions) [16]byte {
+		t.Helper()
+		s, err := salt(&opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	if get(encodeOptions{}) == get(encodeOptions{}) {
+		t.Error("two encodes with the default seed got the same salt")
+	}
+	if get(encodeOptions{seed: 7, deterministic: true}) != get(encodeOptions{seed: 7, deterministic: true}) {
+		t.Error("-deterministic with the same seed gave different salts")
+	}
+}
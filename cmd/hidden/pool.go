@@ -0,0 +1,120 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// interruptContext returns a context that is canceled on Ctrl-C or SIGTERM.
+// Until it is canceled the signals no longer end the process, so writes in
+// progress can finish or clean up after themselves.
+func interruptContext() (context.Context, context.CancelFunc) {
+	atomic.AddInt32(&interruptHandlers, 1)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	var once sync.Once
+	return ctx, func() {
+		stop()
+		once.Do(func() { atomic.AddInt32(&interruptHandlers, -1) })
+	}
+}
+
+// runJobs calls work for the indices 0 to n-1 on at most jobs goroutines,
+// and done with the result of every job in index order, so output stays
+// stable no matter how the work was scheduled. A panic in work is reported
+// as an error for that job only. When ctx is canceled no new jobs are
+// started and runJobs returns ctx.Err() once the running ones finish.
+func runJobs(ctx context.Context, n, jobs int, work func(ctx context.Context, i int) error, done func(i int, err error)) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	type result struct {
+		i   int
+		err error
+	}
+
+	var (
+		indices = make(chan int)
+		results = make(chan result)
+		wg      sync.WaitGroup
+	)
+
+	run := func(i int) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return work(ctx, i)
+	}
+
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				results <- result{i, run(i)}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(indices)
+		for i := 0; i < n; i++ {
+			select {
+			case indices <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var (
+		pending = make(map[int]error)
+		next    int
+	)
+
+	for r := range results {
+		pending[r.i] = r.err
+		for {
+			err, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			done(next, err)
+			next++
+		}
+	}
+
+	if next < n {
+		return ctx.Err()
+	}
+	return nil
+}
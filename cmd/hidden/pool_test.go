@@ -0,0 +1,88 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// poolFiles are the number of images the pool benchmarks process per
+// iteration, enough to keep every worker busy.
+const poolFiles = 32
+
+// benchmarkJobs runs bench on 1, 2, 4 and 8 workers, so they can be compared
+// with each other and with GOMAXPROCS.
+func benchmarkJobs(b *testing.B, bench func(b *testing.B, jobs int)) {
+	for _, jobs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) { bench(b, jobs) })
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	files := make([]string, poolFiles)
+	for i := range files {
+		stego, err := hidden.Encode(testCover(320, 240, int64(i)), testMessage(4000, int64(i)), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		files[i] = writeTestImage(b, fmt.Sprintf("stego%d.png", i), stego)
+	}
+
+	benchmarkJobs(b, func(b *testing.B, jobs int) {
+		for n := 0; n < b.N; n++ {
+			err := runJobs(context.Background(), len(files), jobs, func(ctx context.Context, i int) error {
+				_, _, err := scanFile(files[i], false)
+				return err
+			}, func(i int, err error) {
+				if err != nil {
+					b.Errorf("%s: %v", files[i], err)
+				}
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkBatchEncode(b *testing.B) {
+	dir := b.TempDir()
+	covers := make([]string, poolFiles)
+	for i := range covers {
+		covers[i] = writeTestImage(b, fmt.Sprintf("cover%d.png", i), testCover(320, 240, int64(i)))
+	}
+	msg := testMessage(4000, 1)
+
+	benchmarkJobs(b, func(b *testing.B, jobs int) {
+		for n := 0; n < b.N; n++ {
+			err := runJobs(context.Background(), len(covers), jobs, func(ctx context.Context, i int) error {
+				return encodeFile(covers[i], filepath.Join(dir, fmt.Sprintf("out%d.png", i)), msg, encodeOptions{overwrite: true})
+			}, func(i int, err error) {
+				if err != nil {
+					b.Errorf("%s: %v", covers[i], err)
+				}
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,117 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// profile is a set of flag values for a common use, named after the
+// preset it is recorded as in the header.
+type profile struct {
+	preset hidden.Preset
+	flags  [][2]string
+}
+
+// profiles are the presets of -preset. They only use flags, so each is
+// exactly what typing them out would give.
+var profiles = []profile{
+	// stealth spreads the changed samples over the whole image instead of
+	// concentrating them at the top, where statistics find them, in an
+	// order only the passphrase gives if there is one, changes them like
+	// noise would and makes the bits it leaves alone look the same.
+	{hidden.PresetStealth, [][2]string{{"permute", "true"}, {"matching", "true"}, {"fill", "true"}, {"compress", "deflate"}}},
+
+	// capacity leaves room for as much of the message as possible, with
+	// the smallest checksum and no resync markers, in as many low bits as
+	// it takes.
+	{hidden.PresetCapacity, [][2]string{{"checksum", "adler32"}, {"resync", "0"}, {"auto-depth", "true"}, {"compress", "deflate"}}},
+
+	// robust survives cropping and edits to part of the image and catches
+	// any damage, and reads the image back before reporting success.
+	{hidden.PresetRobust, [][2]string{{"checksum", "sha256"}, {"resync", "256"}, {"copies", "2"}, {"verify", "true"}}},
+}
+
+// profileConflicts lists, for the flags of the profiles, the flags that
+// rule them out. A profile leaves a flag alone if one of those is given.
+var profileConflicts = map[string][]string{
+	"permute":    {"adaptive", "spread"},
+	"matching":   {"depth", "channels", "auto-depth", "preserve-histogram"},
+	"fill":       {"preserve-histogram", "chunk-size"},
+	"auto-depth": {"depth", "channels"},
+	"resync":     {"ecc", "chunk-size"},
+	"copies":     {"ecc", "chunk-size", "permute", "adaptive", "spread"},
+}
+
+// profileNames returns the names of the profiles.
+func profileNames() []string {
+	var names []string
+	for _, p := range profiles {
+		names = append(names, p.preset.String())
+	}
+	return names
+}
+
+// applyProfile sets the flags of the named profile in fs, except those given
+// on the command line or ruled out by them, so explicit flags win, and
+// returns its preset. An empty name is no profile.
+func applyProfile(fs *flag.FlagSet, name string) (hidden.Preset, error) {
+	if name == "" {
+		return 0, nil
+	}
+
+	for _, p := range profiles {
+		if p.preset.String() != name {
+			continue
+		}
+
+		explicit := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) {
+			explicit[f.Name] = true
+		})
+	flags:
+		for _, kv := range p.flags {
+			if explicit[kv[0]] {
+				continue
+			}
+			for _, c := range profileConflicts[kv[0]] {
+				if explicit[c] {
+					continue flags
+				}
+			}
+			if err := fs.Set(kv[0], kv[1]); err != nil {
+				return 0, fmt.Errorf("preset %s: -%s: %v", name, kv[0], err)
+			}
+		}
+		return p.preset, nil
+	}
+	return 0, fmt.Errorf("unknown preset %q, use one of %s", name, strings.Join(profileNames(), ", "))
+}
+
+// printFlags writes the flags of fs that differ from their defaults to w.
+func printFlags(w io.Writer, fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if v := f.Value.String(); v != f.DefValue {
+			fmt.Fprintf(w, "  -%s=%s\n", f.Name, v)
+		}
+	})
+	fmt.Fprintln(w)
+}
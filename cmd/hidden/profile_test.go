@@ -0,0 +1,144 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// profileFlags returns a flag set with the flags of the profiles and those
+// that conflict with them, parsed from args.
+func profileFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, name := range []string{"permute", "matching", "fill", "auto-depth", "verify", "adaptive", "spread", "preserve-histogram"} {
+		fs.Bool(name, false, "")
+	}
+	for _, name := range []string{"compress", "checksum", "resync", "copies", "depth", "channels", "chunk-size", "ecc"} {
+		fs.String(name, "", "")
+	}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestApplyProfile(t *testing.T) {
+	for _, p := range profiles {
+		fs := profileFlags(t)
+		preset, err := applyProfile(fs, p.preset.String())
+		if err != nil || preset != p.preset {
+			t.Fatalf("%v: got %v, %v", p.preset, preset, err)
+		}
+		for _, kv := range p.flags {
+			if v := fs.Lookup(kv[0]).Value.String(); v != kv[1] {
+				t.Errorf("%v: -%s=%s, want %s", p.preset, kv[0], v, kv[1])
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		preset string
+		args   []string
+		flag   string
+		want   string
+	}{
+		{"robust", []string{"-checksum=crc32"}, "checksum", "crc32"},
+		{"robust", []string{"-checksum=crc32"}, "resync", "256"},
+		{"robust", []string{"-ecc=8"}, "resync", ""},
+		{"robust", []string{"-permute"}, "copies", ""},
+		{"capacity", []string{"-depth=2"}, "auto-depth", "false"},
+		{"capacity", []string{"-depth=2"}, "checksum", "adler32"},
+		{"stealth", []string{"-compress=gzip"}, "compress", "gzip"},
+		{"stealth", []string{"-chunk-size=256"}, "fill", "false"},
+		{"stealth", []string{"-chunk-size=256"}, "matching", "true"},
+		{"stealth", []string{"-spread"}, "permute", "false"},
+		{"stealth", []string{"-channels=b"}, "matching", "false"},
+	} {
+		fs := profileFlags(t, c.args...)
+		if _, err := applyProfile(fs, c.preset); err != nil {
+			t.Fatal(err)
+		}
+		if v := fs.Lookup(c.flag).Value.String(); v != c.want {
+			t.Errorf("%s %s: -%s=%s, want %s", c.preset, strings.Join(c.args, " "), c.flag, v, c.want)
+		}
+	}
+
+	if preset, err := applyProfile(profileFlags(t), ""); preset != 0 || err != nil {
+		t.Errorf("no preset: got %v, %v", preset, err)
+	}
+	if _, err := applyProfile(profileFlags(t), "sneaky"); err == nil || !strings.Contains(err.Error(), "stealth, capacity, robust") {
+		t.Errorf("unknown preset: got %v, want the names listed", err)
+	}
+}
+
+// TestPresetRoundTrip encodes with the options each preset sets, which
+// records it in the header, and decodes the message again.
+func TestPresetRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	cover := writeTestImage(t, "cover.png", testCover(200, 150, 143))
+	msg := testMessage(2000, 143)
+	fmsg := writeTestFile(t, dir, "msg.bin", msg)
+
+	for _, c := range []struct {
+		name string
+		opt  encodeOptions
+		pass bool
+	}{
+		{"stealth", encodeOptions{preset: hidden.PresetStealth, placement: hidden.Permuted{}, matching: true, fill: true, compression: hidden.Deflate}, false},
+		{"capacity", encodeOptions{preset: hidden.PresetCapacity, integrity: hidden.Adler32, autoDepth: true, compression: hidden.Deflate}, false},
+		{"robust", encodeOptions{preset: hidden.PresetRobust, integrity: hidden.SHA256, blockSize: 256, copies: 2, verify: true}, false},
+		{"stealth with passphrase", encodeOptions{preset: hidden.PresetStealth, placement: hidden.Keyed{}, matching: true, fill: true, compression: hidden.Deflate, passphrase: []byte("pass")}, true},
+	} {
+		name := c.name
+		out := filepath.Join(dir, name+".png")
+		if err := encode(cover, out, fmsg, c.opt); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		// The preset of an encrypted message is encrypted with it.
+		if !c.pass {
+			img, err := loadImage(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h, err := hidden.DecodeHeader(img); err != nil {
+				t.Errorf("%s: %v", name, err)
+			} else if p, ok := h.Field(hidden.FieldPreset); !ok || len(p) != 1 || hidden.Preset(p[0]) != c.opt.preset {
+				t.Errorf("%s: the header records preset %v", name, p)
+			}
+		}
+
+		lib := &hidden.Options{}
+		if c.pass {
+			lib.Passphrase = []byte("pass")
+		}
+		decoded := filepath.Join(dir, name+".bin")
+		if err := decode(out, decoded, decodeOptions{library: lib}); err != nil {
+			t.Fatalf("%s: decoding: %v", name, err)
+		}
+		if got, err := ioutil.ReadFile(decoded); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("%s: decoded %d bytes that are not the message, %v", name, len(got), err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// showProgress reports how far reading an image has come, for -progress.
+var showProgress bool
+
+// progressWidth is the number of characters in a progress bar.
+const progressWidth = 30
+
+// progress reports done out of total units of work on stderr, as a bar that
+// is redrawn at most every tenth of a second on a terminal, or else as a
+// line whenever another 10 percent are done. A nil *progress reports
+// nothing.
+type progress struct {
+	label       string
+	done, total int64
+	bar         bool
+	drawn       time.Time
+	step        int64
+	suffix      func() string
+}
+
+// newProgress returns a progress for total units of work, or nil if there
+// is nothing to report.
+func newProgress(label string, total int64) *progress {
+	if total <= 0 {
+		return nil
+	}
+	return &progress{label: label, total: total, bar: term.IsTerminal(int(os.Stderr.Fd()))}
+}
+
+// add counts n more units of work as done.
+func (p *progress) add(n int64) {
+	if p == nil || n == 0 {
+		return
+	}
+	if p.done += n; p.done > p.total {
+		p.done = p.total
+	}
+	if p.bar {
+		if time.Since(p.drawn) >= 100*time.Millisecond || p.done == p.total {
+			p.draw()
+		}
+		return
+	}
+	if step := p.done * 10 / p.total; step > p.step {
+		p.step = step
+		fmt.Fprintf(os.Stderr, "%s: %d%%%s\n", p.label, p.percent(), p.extra())
+	}
+}
+
+// clear erases the bar, so other output can be written on its line. The
+// next add draws it again.
+func (p *progress) clear() {
+	if p != nil && p.bar && !p.drawn.IsZero() {
+		fmt.Fprintf(os.Stderr, "\r\033[K")
+		p.drawn = time.Time{}
+	}
+}
+
+// finish counts the rest of the work as done and ends the bar.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	if p.done < p.total {
+		p.add(p.total - p.done)
+	}
+	if p.bar {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func (p *progress) draw() {
+	n := int(p.done * progressWidth / p.total)
+	fmt.Fprintf(os.Stderr, "\r\033[K%s [%s%s] %3d%%%s", p.label, strings.Repeat("#", n), strings.Repeat(".", progressWidth-n), p.percent(), p.extra())
+	p.drawn = time.Now()
+}
+
+func (p *progress) percent() int64 {
+	return p.done * 100 / p.total
+}
+
+func (p *progress) extra() string {
+	if p.suffix == nil {
+		return ""
+	}
+	return " " + p.suffix()
+}
+
+// progressReader counts what is read from r in p.
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (pr progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.p.add(int64(n))
+	return n, err
+}
+
+// batchProgress reports the images of a batch done, weighted by their
+// pixels. A nil *batchProgress reports nothing.
+type batchProgress struct {
+	*progress
+	pixels []int64
+	images int
+}
+
+// newBatchProgress returns a batchProgress for the images in the files of
+// inputs if show is set. An image whose dimensions can not be read without
+// decoding it, like an entry of a zip archive, counts as many pixels as the
+// others on average.
+func newBatchProgress(inputs [][2]string, show bool) *batchProgress {
+	if !show || len(inputs) == 0 {
+		return nil
+	}
+
+	b := &batchProgress{pixels: make([]int64, len(inputs))}
+	var known, sum int64
+	for i, in := range inputs {
+		if b.pixels[i] = imagePixels(in[0]); b.pixels[i] > 0 {
+			known++
+			sum += b.pixels[i]
+		}
+	}
+	mean := int64(1)
+	if known > 0 {
+		mean = sum / known
+	}
+	var total int64
+	for i := range b.pixels {
+		if b.pixels[i] == 0 {
+			b.pixels[i] = mean
+		}
+		total += b.pixels[i]
+	}
+
+	b.progress = newProgress("Images", total)
+	b.suffix = func() string { return fmt.Sprintf("(%d of %d)", b.images, len(inputs)) }
+	return b
+}
+
+// done counts the image of inputs[i] as done.
+func (b *batchProgress) done(i int) {
+	if b == nil {
+		return
+	}
+	b.images++
+	b.add(b.pixels[i])
+}
+
+// clear is progress.clear.
+func (b *batchProgress) clear() {
+	if b != nil {
+		b.progress.clear()
+	}
+}
+
+// finish is progress.finish.
+func (b *batchProgress) finish() {
+	if b != nil {
+		b.progress.finish()
+	}
+}
+
+// imagePixels returns the number of pixels of the image in file, or zero if
+// that can not be told from the start of the file.
+func imagePixels(file string) int64 {
+	if isURL(file) {
+		return 0
+	}
+	if _, _, ok := splitZipPath(file); ok {
+		return 0
+	}
+	fp, err := os.Open(file)
+	if err != nil {
+		return 0
+	}
+	defer fp.Close()
+
+	cfg, _, err := image.DecodeConfig(fp)
+	if err != nil {
+		return 0
+	}
+	return int64(cfg.Width) * int64(cfg.Height)
+}
@@ -0,0 +1,364 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+	"os"
+	"strconv"
+)
+
+// decibels is a PSNR value. Identical images have an infinite PSNR, which
+// JSON can not represent, so it is encoded as null.
+type decibels float64
+
+func (db decibels) MarshalJSON() ([]byte, error) {
+	if math.IsInf(float64(db), 0) {
+		return []byte("null"), nil
+	}
+	return strconv.AppendFloat(nil, float64(db), 'f', 4, 64), nil
+}
+
+func (db decibels) String() string {
+	if math.IsInf(float64(db), 0) {
+		return "inf"
+	}
+	return strconv.FormatFloat(float64(db), 'f', 2, 64) + " dB"
+}
+
+// sampleDiff accumulates the sample-wise differences between two images of
+// equal size, indexed by channel in RGBA order.
+type sampleDiff struct {
+	samples  [4]int
+	modified [4]int
+	absSum   [4]int64
+	sqSum    [4]int64
+	maxDelta [4]int
+
+	// Bounding box of the modified pixels, relative to the image origin.
+	changed image.Rectangle
+}
+
+// diffImages compares the samples of a and b. Both images are expected to
+// come from the same normalization, i.e. toRGBA. If pixel is not nil it is
+// called for every pixel with the largest delta among its samples.
+func diffImages(a, b *image.RGBA, pixel func(x, y, delta int)) (*sampleDiff, error) {
+	ba, bb := a.Bounds(), b.Bounds()
+	if ba.Dx() != bb.Dx() || ba.Dy() != bb.Dy() {
+		return nil, fmt.Errorf("image dimensions differ: %dx%d and %dx%d", ba.Dx(), ba.Dy(), bb.Dx(), bb.Dy())
+	}
+
+	var diff sampleDiff
+	for y := 0; y < ba.Dy(); y++ {
+		ra := a.Pix[a.PixOffset(ba.Min.X, ba.Min.Y+y):a.PixOffset(ba.Max.X, ba.Min.Y+y)]
+		rb := b.Pix[b.PixOffset(bb.Min.X, bb.Min.Y+y):b.PixOffset(bb.Max.X, bb.Min.Y+y)]
+		for x := 0; x < ba.Dx(); x++ {
+			var pixelDelta int
+			for c := 0; c < 4; c++ {
+				d := int(ra[x*4+c]) - int(rb[x*4+c])
+				if d < 0 {
+					d = -d
+				}
+
+				diff.samples[c]++
+				diff.absSum[c] += int64(d)
+				diff.sqSum[c] += int64(d * d)
+				if d != 0 {
+					diff.modified[c]++
+				}
+				if d > diff.maxDelta[c] {
+					diff.maxDelta[c] = d
+				}
+				if d > pixelDelta {
+					pixelDelta = d
+				}
+			}
+
+			if pixelDelta != 0 {
+				diff.changed = diff.changed.Union(image.Rect(x, y, x+1, y+1))
+			}
+			if pixel != nil {
+				pixel(x, y, pixelDelta)
+			}
+		}
+	}
+	return &diff, nil
+}
+
+// changedSamples returns how many of the color samples of cover differ in
+// stego, by channel, and how many there are, counted the way the quality
+// command counts them.
+func changedSamples(cover, stego image.Image) (changed [3]int, samples int, err error) {
+	if wide(cover) && wide(stego) {
+		return changedWide(cover, stego)
+	}
+
+	diff, err := diffImages(toRGBA(cover), toRGBA(stego), nil)
+	if err != nil {
+		return changed, 0, err
+	}
+	report := diff.quality()
+	for c, q := range report.Channels {
+		changed[c] = q.Modified
+	}
+	return changed, report.Samples, nil
+}
+
+// changedWide is changedSamples for 16 bit images, which would hide the
+// changes in their low bytes when converted to 8 bits. A gray sample counts
+// in every channel.
+func changedWide(cover, stego image.Image) (changed [3]int, samples int, err error) {
+	pix := func(img image.Image) ([]byte, int) {
+		switch m := img.(type) {
+		case *image.RGBA64:
+			return m.Pix, m.Stride
+		case *image.NRGBA64:
+			return m.Pix, m.Stride
+		}
+		m := image.NewNRGBA64(img.Bounds())
+		draw.Draw(m, m.Rect, img, img.Bounds().Min, draw.Src)
+		return m.Pix, m.Stride
+	}
+
+	a, b := cover.Bounds(), stego.Bounds()
+	if a.Dx() != b.Dx() || a.Dy() != b.Dy() {
+		return changed, 0, fmt.Errorf("image dimensions differ: %dx%d and %dx%d", a.Dx(), a.Dy(), b.Dx(), b.Dy())
+	}
+	pa, sa := pix(cover)
+	pb, sb := pix(stego)
+	for y := 0; y < a.Dy(); y++ {
+		for i := 0; i < a.Dx()*8; i += 2 {
+			if i%8 == 6 {
+				continue // alpha
+			}
+			samples++
+			if pa[y*sa+i] != pb[y*sb+i] || pa[y*sa+i+1] != pb[y*sb+i+1] {
+				changed[i%8/2]++
+			}
+		}
+	}
+	return changed, samples, nil
+}
+
+// checkChanges returns an error if encoding a message of size bytes changed
+// more samples between cover and stego than opt.maxChanges allows. A dry run
+// reports them.
+func checkChanges(cover, stego image.Image, size int, opt encodeOptions) error {
+	if opt.maxChanges == 0 && !opt.dryRun {
+		return nil
+	}
+
+	channels, samples, err := changedSamples(cover, stego)
+	if err != nil {
+		return err
+	}
+	changed := channels[0] + channels[1] + channels[2]
+	percent := 100 * float64(changed) / math.Max(1, float64(samples))
+	if opt.dryRun {
+		fmt.Fprintf(info, "Dry run, the message changes %d of %d samples (%.2f%%)\n", changed, samples, percent)
+		for c, name := range channelNames {
+			fmt.Fprintf(info, "  %s: %d of %d (%.2f%%)\n", name, channels[c], samples/3, 300*float64(channels[c])/math.Max(1, float64(samples)))
+		}
+	}
+
+	limit := int(opt.maxChanges * float64(samples))
+	if opt.maxChanges == 0 || changed <= limit {
+		return nil
+	}
+	// Every message bit changes a sample half of the time, so the changes
+	// shrink with the message.
+	return fmt.Errorf("the message changes %d of %d samples (%.2f%%), -max-changes allows %d, shorten it by about %d bytes",
+		changed, samples, percent, limit, size-size*limit/changed)
+}
+
+type channelQuality struct {
+	Channel     string   `json:"channel"`
+	PSNR        decibels `json:"psnr"`
+	SSIM        float64  `json:"ssim"`
+	MeanAbsDiff float64  `json:"mean_abs_diff"`
+	Modified    int      `json:"modified"`
+}
+
+type qualityReport struct {
+	Samples     int              `json:"samples"`
+	Modified    int              `json:"modified"`
+	PSNR        decibels         `json:"psnr"`
+	SSIM        float64          `json:"ssim"`
+	MeanAbsDiff float64          `json:"mean_abs_diff"`
+	Channels    []channelQuality `json:"channels"`
+}
+
+// quality reports PSNR and mean absolute difference over the color channels.
+// Alpha is left out since the encoder never touches it.
+func (diff *sampleDiff) quality() qualityReport {
+	measure := func(samples int, absSum, sqSum int64) (decibels, float64) {
+		if samples == 0 {
+			return decibels(math.Inf(1)), 0
+		}
+		n := float64(samples)
+		psnr := math.Inf(1)
+		if sqSum > 0 {
+			psnr = 10 * math.Log10(255*255/(float64(sqSum)/n))
+		}
+		return decibels(psnr), float64(absSum) / n
+	}
+
+	var (
+		report        qualityReport
+		absSum, sqSum int64
+	)
+
+	for c, name := range channelNames {
+		q := channelQuality{Channel: name, Modified: diff.modified[c]}
+		q.PSNR, q.MeanAbsDiff = measure(diff.samples[c], diff.absSum[c], diff.sqSum[c])
+		report.Channels = append(report.Channels, q)
+
+		report.Samples += diff.samples[c]
+		report.Modified += diff.modified[c]
+		absSum += diff.absSum[c]
+		sqSum += diff.sqSum[c]
+	}
+
+	report.PSNR, report.MeanAbsDiff = measure(report.Samples, absSum, sqSum)
+	return report
+}
+
+// ssimWindow is the side of the square windows SSIM compares, ssimStep the
+// distance between them.
+const ssimWindow, ssimStep = 8, 4
+
+// ssim returns the mean structural similarity of channel c of a and b,
+// which are the same size, over windows of ssimWindow pixels. It is 1 for
+// identical images.
+func ssim(a, b *image.RGBA, c int) float64 {
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+	ba, bb := a.Bounds(), b.Bounds()
+	w, h := ba.Dx(), ba.Dy()
+	win := ssimWindow
+	if w < win {
+		win = w
+	}
+	if h < win {
+		win = h
+	}
+	if win == 0 {
+		return 1
+	}
+
+	var (
+		sum float64
+		n   int
+		m   = float64(win * win)
+	)
+	for y0 := 0; y0+win <= h; y0 += ssimStep {
+		for x0 := 0; x0+win <= w; x0 += ssimStep {
+			var sa, sb, saa, sbb, sab float64
+			for y := y0; y < y0+win; y++ {
+				ra := a.Pix[a.PixOffset(ba.Min.X+x0, ba.Min.Y+y):]
+				rb := b.Pix[b.PixOffset(bb.Min.X+x0, bb.Min.Y+y):]
+				for x := 0; x < win; x++ {
+					va, vb := float64(ra[x*4+c]), float64(rb[x*4+c])
+					sa, sb = sa+va, sb+vb
+					saa, sbb, sab = saa+va*va, sbb+vb*vb, sab+va*vb
+				}
+			}
+			ma, mb := sa/m, sb/m
+			varA, varB, cov := saa/m-ma*ma, sbb/m-mb*mb, sab/m-ma*mb
+			sum += (2*ma*mb + c1) * (2*cov + c2) / ((ma*ma + mb*mb + c1) * (varA + varB + c2))
+			n++
+		}
+	}
+	return sum / float64(n)
+}
+
+// measureQuality compares the color samples of cover and stego, with the
+// SSIM of every channel and their mean. 16 bit images are compared at 8
+// bits.
+func measureQuality(cover, stego image.Image) (qualityReport, error) {
+	a, b := toRGBA(cover), toRGBA(stego)
+	diff, err := diffImages(a, b, nil)
+	if err != nil {
+		return qualityReport{}, err
+	}
+	report := diff.quality()
+	for c := range report.Channels {
+		report.Channels[c].SSIM = ssim(a, b, c)
+		report.SSIM += report.Channels[c].SSIM / float64(len(report.Channels))
+	}
+	return report, nil
+}
+
+// printQuality writes report to w as a table.
+func printQuality(w io.Writer, report qualityReport) {
+	fmt.Fprintf(w, "%-8s %12s %10s %14s %10s\n", "Channel", "PSNR", "SSIM", "Mean abs diff", "Modified")
+	for _, q := range report.Channels {
+		fmt.Fprintf(w, "%-8s %12v %10.6f %14.6f %10d\n", q.Channel, q.PSNR, q.SSIM, q.MeanAbsDiff, q.Modified)
+	}
+	fmt.Fprintf(w, "%-8s %12v %10.6f %14.6f %10d\n", "RGB", report.PSNR, report.SSIM, report.MeanAbsDiff, report.Modified)
+	fmt.Fprintf(w, "\n%d of %d samples modified (%.2f%%)\n", report.Modified, report.Samples,
+		100*float64(report.Modified)/math.Max(1, float64(report.Samples)))
+}
+
+// reportQuality prints the quality of stego, the image written from cover,
+// for -report.
+func reportQuality(cover, stego image.Image) error {
+	report, err := measureQuality(cover, stego)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(info, "Quality of the encoded image:")
+	printQuality(info, report)
+	return nil
+}
+
+func qualityCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("quality", flag.ExitOnError)
+	asJSON := jsonFlag(fs, "Output in JSON format.")
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() != 2 {
+			commandUsage(fs, "quality [flags] <cover> <stego>")
+		}
+
+		cover, err := loadImage(fs.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+		stego, err := loadImage(fs.Arg(1))
+		if err != nil {
+			fatal(err)
+		}
+		report, err := measureQuality(cover, stego)
+		if err != nil {
+			fatal(err)
+		}
+
+		if *asJSON {
+			printJSON(&report)
+			return
+		}
+		printQuality(os.Stdout, report)
+	}
+}
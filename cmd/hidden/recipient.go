@@ -0,0 +1,149 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// keyFlag is a flag.Value collecting the keys or key files of a repeated
+// flag.
+type keyFlag []string
+
+func (f *keyFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *keyFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// recipientFlags are the flags of public key encryption.
+type recipientFlags struct {
+	public, private keyFlag
+}
+
+// defineRecipientFlags defines -recipient and -identity in fs.
+func defineRecipientFlags(fs *flag.FlagSet) *recipientFlags {
+	f := &recipientFlags{}
+	fs.Var(&f.public, "recipient", "age or OpenPGP public key to encrypt to, can be repeated.")
+	fs.Var(&f.private, "identity", "age or OpenPGP private key file to decrypt with, can be repeated.")
+	return f
+}
+
+// recipients returns the public keys of -recipient, none without it.
+func (f *recipientFlags) recipients() ([]hidden.Recipient, error) {
+	var all []hidden.Recipient
+	for _, key := range f.public {
+		if strings.HasPrefix(key, "age1") {
+			r, err := hidden.ParseAgeRecipient(key)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, r)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(key)
+		if err != nil {
+			return nil, err
+		}
+		if isPGPKey(data) {
+			rs, err := hidden.ReadPGPRecipients(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			all = append(all, rs...)
+			continue
+		}
+		for _, line := range keyLines(data) {
+			r, err := hidden.ParseAgeRecipient(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			all = append(all, r)
+		}
+	}
+	return all, nil
+}
+
+// identities returns the private keys of -identity, none without it. A
+// protected OpenPGP key is unlocked with the passphrase from src, the
+// environment or the terminal.
+func (f *recipientFlags) identities(src *passphraseSource) ([]hidden.Identity, error) {
+	var all []hidden.Identity
+	for _, file := range f.private {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		secret(data)
+
+		if isPGPKey(data) {
+			ids, err := hidden.ReadPGPIdentities(bytes.NewReader(data), nil)
+			if errors.Is(err, hidden.ErrKeyLocked) {
+				var passphrase []byte
+				if passphrase, err = readPassphrase(src, false); err == nil {
+					ids, err = hidden.ReadPGPIdentities(bytes.NewReader(data), passphrase)
+				}
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+			all = append(all, ids...)
+			continue
+		}
+		lines := keyLines(data)
+		if len(lines) == 0 {
+			return nil, fmt.Errorf("%s holds no age identities", file)
+		}
+		for _, line := range lines {
+			id, err := hidden.ParseAgeIdentity(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			all = append(all, id)
+		}
+	}
+	return all, nil
+}
+
+// isPGPKey reports whether data is an OpenPGP key, armored or starting with
+// the tag of a binary packet, rather than lines of age keys.
+func isPGPKey(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return bytes.HasPrefix(data, []byte("-----BEGIN PGP")) || len(data) > 0 && data[0]&0x80 != 0
+}
+
+// keyLines returns the keys of an age key file, one per line, without blank
+// lines and # comments.
+func keyLines(data []byte) []string {
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
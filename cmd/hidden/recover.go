@@ -0,0 +1,103 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// recoverCandidate is a layout the recover command found a header in.
+type recoverCandidate struct {
+	Layout string `json:"layout"`
+	Size   int    `json:"size,omitempty"`
+	Format string `json:"format,omitempty"`
+	Valid  bool   `json:"valid"`
+	Error  string `json:"error,omitempty"`
+}
+
+func recoverCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("recover", flag.ExitOnError)
+	out := fs.String("out", "", "Write the message of the first layout whose payload matched its checksum to this file.")
+	passphrase := definePassphraseFlags(fs)
+	fs.BoolVar(&force, "force", false, "Overwrite -out if it exists.")
+	asJSON := jsonFlag(fs, "Output in JSON format.")
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() != 1 {
+			commandUsage(fs, "recover [flags] <image>")
+		}
+		opt, err := decodeOptionsFrom(passphrase)
+		if err != nil {
+			fatal(err)
+		}
+		img, err := loadImage(fs.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+
+		found := hidden.Search(img, opt)
+		report := make([]recoverCandidate, len(found))
+		for i, c := range found {
+			report[i] = recoverCandidate{Layout: c.Layout, Valid: c.Valid}
+			if c.Header != nil {
+				report[i].Size, report[i].Format = c.Header.Length, c.Header.Format()
+			}
+			if c.Err != nil {
+				report[i].Error = c.Err.Error()
+			}
+		}
+
+		if *asJSON {
+			printJSON(report)
+		} else {
+			fmt.Println("Layouts with a header:", len(report))
+			for _, c := range report {
+				switch {
+				case c.Valid && c.Error == "":
+					fmt.Printf("  %s: %d bytes, %s\n", c.Layout, c.Size, c.Format)
+				case c.Valid:
+					fmt.Printf("  %s: %d bytes, %s, %s\n", c.Layout, c.Size, c.Format, c.Error)
+				default:
+					fmt.Printf("  %s: damaged, %s\n", c.Layout, c.Error)
+				}
+			}
+		}
+
+		if len(found) == 0 {
+			fatal(hidden.ErrNoHiddenMessage)
+		}
+		if *out == "" {
+			return
+		}
+		for _, c := range found {
+			if c.Payload != nil {
+				if err := checkClobber(*out); err != nil {
+					fatal(err)
+				}
+				if err := writeFileMode(*out, c.Payload, os.FileMode(outputMode)); err != nil {
+					fatal(err)
+				}
+				return
+			}
+		}
+		fatal(fmt.Errorf("no layout holds a message that could be opened, %s was not written", *out))
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// fitCover scales img up, keeping its aspect ratio, just enough for
+// capacity to reach size bytes, or returns it as it is if it already does.
+// It fails if that takes more than maxScale. capacity may only depend on the
+// dimensions of the image it is given.
+func fitCover(img image.Image, size int, maxScale float64, capacity func(image.Image) int) (image.Image, error) {
+	b := img.Bounds()
+	if capacity(img) >= size {
+		return img, nil
+	}
+
+	fits := func(scale float64) (image.Rectangle, bool) {
+		r := image.Rect(0, 0, int(math.Ceil(float64(b.Dx())*scale)), int(math.Ceil(float64(b.Dy())*scale)))
+		return r, capacity(&image.RGBA{Rect: r}) >= size
+	}
+
+	// Capacity grows with the area, so that is where to start. Rounding
+	// and the header can take a few more steps.
+	scale := math.Sqrt(float64(size) / math.Max(float64(capacity(img)), 1))
+	r, ok := fits(scale)
+	for ; !ok && scale <= maxScale; r, ok = fits(scale) {
+		scale *= 1.01
+	}
+	if !ok || scale > maxScale {
+		return nil, fmt.Errorf("the cover would have to be scaled up more than %gx to hold the message", maxScale)
+	}
+
+	var dst xdraw.Image = image.NewRGBA(r)
+	if wide(img) {
+		dst = image.NewRGBA64(r)
+	}
+	xdraw.CatmullRom.Scale(dst, r, img, b, xdraw.Src, nil)
+	logger.Info(fmt.Sprintf("Resized the cover from %dx%d to %dx%d to fit the message.", b.Dx(), b.Dy(), r.Dx(), r.Dy()))
+	return dst, nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+func TestFitCover(t *testing.T) {
+	capacity := func(img image.Image) int { return hidden.Capacity(img, nil) }
+	cover := testCover(400, 300, 141)
+	size := capacity(cover)
+
+	if img, err := fitCover(cover, size, 2, capacity); err != nil || img != image.Image(cover) {
+		t.Errorf("a message that fits: got %v, %v, want the cover as it is", img.Bounds(), err)
+	}
+
+	for _, c := range []struct {
+		scale float64
+		w, h  int
+	}{
+		{1.05, 410, 308},
+		{2.2, 594, 446},
+	} {
+		img, err := fitCover(cover, int(float64(size)*c.scale), 2, capacity)
+		if err != nil {
+			t.Fatalf("%gx the capacity: %v", c.scale, err)
+		}
+		b := img.Bounds()
+		if capacity(img) < int(float64(size)*c.scale) {
+			t.Errorf("%gx the capacity: %dx%d holds %d bytes, too few", c.scale, b.Dx(), b.Dy(), capacity(img))
+		}
+		if b.Dx() < c.w-3 || b.Dx() > c.w+3 || b.Dy() < c.h-3 || b.Dy() > c.h+3 {
+			t.Errorf("%gx the capacity: resized to %dx%d, want about %dx%d", c.scale, b.Dx(), b.Dy(), c.w, c.h)
+		}
+		if d := float64(b.Dx())/float64(b.Dy()) - 4.0/3; d < -0.01 || d > 0.01 {
+			t.Errorf("%gx the capacity: %dx%d does not keep the aspect ratio", c.scale, b.Dx(), b.Dy())
+		}
+	}
+
+	if _, err := fitCover(cover, size*5, 2, capacity); err == nil {
+		t.Error("scaled up more than 2x")
+	}
+
+	wide := image.NewRGBA64(image.Rect(0, 0, 40, 30))
+	if img, err := fitCover(wide, capacity(wide)*2, 2, capacity); err != nil {
+		t.Error(err)
+	} else if _, ok := img.(*image.RGBA64); !ok {
+		t.Errorf("a 16 bit cover was resized to a %T", img)
+	}
+}
+
+// TestEncodeResizeToFit encodes messages larger than the cover holds, which
+// scales it up, also for JPEG, and decodes them again.
+func TestEncodeResizeToFit(t *testing.T) {
+	dir := t.TempDir()
+	cover := writeTestImage(t, "cover.png", testCover(400, 300, 141))
+	size := hidden.Capacity(testCover(400, 300, 141), nil)
+
+	for _, c := range []struct {
+		name string
+		size int
+		opt  encodeOptions
+	}{
+		{"small.png", size + size/20, encodeOptions{}},
+		{"large.png", size * 2, encodeOptions{}},
+		{"large.jpg", hidden.CapacityJPEG(testCover(400, 300, 141), 90, nil) * 3 / 2, encodeOptions{jpegQuality: 90}},
+	} {
+		msg := testMessage(c.size, 141)
+		out := filepath.Join(dir, c.name)
+
+		c.opt.maxUpscale = 2
+		if err := encode(cover, out, writeTestFile(t, dir, "msg.bin", msg), c.opt); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		decoded := filepath.Join(dir, c.name+".bin")
+		if err := decode(out, decoded, decodeOptions{library: &hidden.Options{}}); err != nil {
+			t.Fatalf("%s: decoding: %v", c.name, err)
+		}
+		if got, err := ioutil.ReadFile(decoded); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("%s: decoded %d bytes that are not the message, %v", c.name, len(got), err)
+		}
+
+		if err := encode(cover, out, writeTestFile(t, dir, "msg.bin", msg), encodeOptions{jpegQuality: c.opt.jpegQuality}); err == nil {
+			t.Errorf("%s: encoded without -resize-to-fit", c.name)
+		}
+	}
+
+	err := encode(cover, filepath.Join(dir, "huge.png"), writeTestFile(t, dir, "msg.bin", testMessage(size*5, 141)), encodeOptions{maxUpscale: 2})
+	if err == nil {
+		t.Error("encoded a message that needs more than 2x")
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+type scanMatch struct {
+	Path   string `json:"path"`
+	Size   int    `json:"size"`
+	Format string `json:"format"`
+}
+
+func scanCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	maxSize := fs.Int64("max-size", 0, "Skip files larger than this many bytes, 0 for no limit.")
+	jobs := fs.Int("jobs", runtime.NumCPU(), "Number of files to scan concurrently.")
+	quick := quickFlag(fs, "scanned")
+	asJSON := jsonFlag(fs, "Output in JSON format instead of CSV.")
+	limitFlags(fs)
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() == 0 {
+			commandUsage(fs, "scan [flags] <dir|zip>...")
+		}
+
+		var (
+			files   []string
+			sizes   []int
+			formats []string
+			matches []scanMatch
+			w       = csv.NewWriter(os.Stdout)
+		)
+
+		for _, root := range fs.Args() {
+			if _, _, ok := splitZipPath(root); ok {
+				files = append(files, root)
+				continue
+			}
+			err := filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return nil
+				}
+				if !fi.Mode().IsRegular() {
+					return nil
+				}
+				if !isZipFile(file) {
+					if *maxSize <= 0 || fi.Size() <= *maxSize {
+						files = append(files, file)
+					}
+					return nil
+				}
+
+				entries, err := zipEntries(file)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+					return nil
+				}
+				for _, e := range entries {
+					if *maxSize <= 0 || e.UncompressedSize64 <= uint64(*maxSize) {
+						files = append(files, zipPath(file, e.Name))
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+
+		if !*asJSON {
+			w.Write([]string{"path", "size", "format"})
+		}
+
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		sizes = make([]int, len(files))
+		formats = make([]string, len(files))
+		work := func(ctx context.Context, i int) (err error) {
+			sizes[i], formats[i], err = scanFile(files[i], *quick)
+			return err
+		}
+
+		err := runJobs(ctx, len(files), *jobs, work, func(i int, err error) {
+			switch err {
+			case nil:
+				m := scanMatch{files[i], sizes[i], formats[i]}
+				if *asJSON {
+					matches = append(matches, m)
+				} else {
+					w.Write([]string{m.Path, strconv.Itoa(m.Size), m.Format})
+					w.Flush()
+				}
+			case hidden.ErrNoHiddenMessage, image.ErrFormat:
+			default:
+				fmt.Fprintf(os.Stderr, "%s: %v\n", files[i], err)
+			}
+		})
+
+		if *asJSON {
+			if matches == nil {
+				matches = []scanMatch{}
+			}
+			printJSON(matches)
+		} else if w.Flush(); w.Error() != nil {
+			fatal(w.Error())
+		}
+
+		if err != nil {
+			fatal("interrupted:", err)
+		}
+	}
+}
+
+// scanFile checks whether file is an image carrying a message. Files in
+// formats we can not decode return image.ErrFormat. With quick a BMP on disk
+// is only inspected, see hidden.InspectBMP.
+func scanFile(file string, quick bool) (int, string, error) {
+	if h, ok, err := quickHeader(file, quick); ok {
+		if err != nil {
+			return 0, "", err
+		}
+		return h.Length, h.Format(), nil
+	}
+	data, err := readImageFile(file)
+	if err != nil {
+		return 0, "", err
+	}
+	return detectData(data)
+}
+
+// quickFlag defines the -quick flag in fs. otherwise is what the command
+// does with the files -quick does not apply to, such as "scanned".
+func quickFlag(fs *flag.FlagSet, otherwise string) *bool {
+	return fs.Bool("quick", false, "Only read the rows at the top of an uncompressed BMP that hold the header, not the whole image, which is much faster for large files. The size is then that of the message as it is stored, its checksum is not validated and only a header with the magic of the current format is found. Other files are "+otherwise+" in full.")
+}
+
+// quickHeader returns the header of the message in file read with
+// inspectBMP, if quick is set and file is an uncompressed BMP on disk. ok is
+// false for any other file, which has to be read in full.
+func quickHeader(file string, quick bool) (h *hidden.Header, ok bool, err error) {
+	if _, _, inZip := splitZipPath(file); !quick || inZip || isURL(file) {
+		return nil, false, nil
+	}
+	h, err = inspectBMP(file)
+	if errors.As(err, new(*hidden.MalformedImageError)) {
+		return nil, false, nil
+	}
+	return h, true, err
+}
+
+// inspectBMP is hidden.InspectBMP for file, which returns a
+// *hidden.MalformedImageError if it is not an uncompressed BMP.
+func inspectBMP(file string) (*hidden.Header, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return hidden.InspectBMP(f)
+}
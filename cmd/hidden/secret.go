@@ -0,0 +1,46 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"sync"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// secrets are the passphrases and messages this process has read. They are
+// wiped when a command is done with them, and by fatal and the interrupt
+// handler, which exit without running deferred calls.
+var secrets struct {
+	sync.Mutex
+	bufs [][]byte
+}
+
+// secret registers b to be wiped by wipeSecrets and returns it.
+func secret(b []byte) []byte {
+	secrets.Lock()
+	defer secrets.Unlock()
+	secrets.bufs = append(secrets.bufs, b)
+	return b
+}
+
+// wipeSecrets zeroes every buffer registered by secret.
+func wipeSecrets() {
+	secrets.Lock()
+	defer secrets.Unlock()
+	hidden.Wipe(secrets.bufs...)
+	secrets.bufs = nil
+}
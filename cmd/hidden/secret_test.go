@@ -0,0 +1,71 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// zeroed reports whether every byte of b is zero.
+func zeroed(b []byte) bool {
+	return len(bytes.Trim(b, "\x00")) == 0
+}
+
+func TestWipeSecrets(t *testing.T) {
+	a, b := secret([]byte("passphrase")), secret([]byte("message"))
+	wipeSecrets()
+	if !zeroed(a) || !zeroed(b) {
+		t.Errorf("got %q and %q, want zeros", a, b)
+	}
+	c := secret([]byte("later"))
+	if string(c) != "later" {
+		t.Errorf("a secret registered after wiping is %q", c)
+	}
+	wipeSecrets()
+}
+
+// TestEncodeDecodeWipe encodes and decodes with a passphrase read like the
+// command reads it, which both wipe when they return.
+func TestEncodeDecodeWipe(t *testing.T) {
+	dir := t.TempDir()
+	cover := writeTestImage(t, "cover.png", testCover(160, 120, 154))
+	msg := writeTestFile(t, dir, "msg.bin", testMessage(500, 154))
+	out, decoded := filepath.Join(dir, "out.png"), filepath.Join(dir, "decoded.bin")
+
+	pass := secret([]byte("pass"))
+	if err := encode(cover, out, msg, encodeOptions{passphrase: pass}); err != nil {
+		t.Fatal(err)
+	}
+	if !zeroed(pass) {
+		t.Errorf("encode left the passphrase %q", pass)
+	}
+
+	pass = secret([]byte("pass"))
+	if err := decode(out, decoded, decodeOptions{library: &hidden.Options{Passphrase: pass}}); err != nil {
+		t.Fatal(err)
+	}
+	if !zeroed(pass) {
+		t.Errorf("decode left the passphrase %q", pass)
+	}
+	if got, err := ioutil.ReadFile(decoded); err != nil || !bytes.Equal(got, testMessage(500, 154)) {
+		t.Errorf("decoded %d bytes that are not the message, %v", len(got), err)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// selfTestCase is an encode and decode round trip of self-test.
+type selfTestCase struct {
+	name string
+
+	// out is the name of the encoded file, its extension picks the format.
+	out string
+	opt encodeOptions
+
+	// decode is the passphrase or pad decoding uses, if they differ from
+	// what encoding used.
+	decode func(opt *encodeOptions)
+
+	// damage changes the encoded file before it is decoded.
+	damage func(data []byte)
+
+	// want is the error decoding has to fail with, nil to succeed.
+	want error
+}
+
+var selfTestPad = &hidden.Pad{Data: bytes.Repeat([]byte("one-time pad "), 200)}
+
+var selfTests = []selfTestCase{
+	{name: "plain", out: "plain.bmp"},
+	{name: "png", out: "plain.png"},
+	{name: "adler32", out: "adler32.bmp", opt: encodeOptions{integrity: hidden.Adler32}},
+	{name: "crc32", out: "crc32.bmp", opt: encodeOptions{integrity: hidden.CRC32}},
+	{name: "aes-256-gcm", out: "aes.bmp", opt: encodeOptions{passphrase: []byte("self-test"), cipher: hidden.AESGCM}},
+	{name: "chacha20-poly1305", out: "chacha.bmp", opt: encodeOptions{passphrase: []byte("self-test"), cipher: hidden.ChaCha20Poly1305}},
+	{name: "deterministic", out: "deterministic.bmp", opt: encodeOptions{passphrase: []byte("self-test"), cipher: hidden.AESGCM, seed: 7, deterministic: true}},
+	{name: "permuted", out: "permuted.bmp", opt: encodeOptions{placement: hidden.Permuted{Seed: 7}}},
+	{name: "keyed", out: "keyed.bmp", opt: encodeOptions{passphrase: []byte("self-test"), placement: hidden.Keyed{Salt: [16]byte{7}}}},
+	{name: "adaptive", out: "adaptive.bmp", opt: encodeOptions{placement: hidden.Adaptive{Threshold: hidden.DefaultAdaptiveThreshold}}},
+	{name: "resync", out: "resync.bmp", opt: encodeOptions{blockSize: 64}},
+	{name: "copies", out: "copies.bmp", opt: encodeOptions{blockSize: 64, copies: 3}},
+	{name: "one-time pad", out: "pad.bmp", opt: encodeOptions{pad: selfTestPad}},
+	{name: "jpeg", out: "plain.jpg", opt: encodeOptions{jpegQuality: 50, size: image.Pt(800, 600)}},
+	{name: "verify", out: "verify.bmp", opt: encodeOptions{verify: true}},
+	{
+		name: "wrong passphrase", out: "wrong.bmp",
+		opt:    encodeOptions{passphrase: []byte("self-test"), cipher: hidden.AESGCM},
+		decode: func(opt *encodeOptions) { opt.passphrase = []byte("wrong") },
+		want:   hidden.ErrDecryptionFailed,
+	},
+	{
+		name: "missing passphrase", out: "missing.bmp",
+		opt:    encodeOptions{passphrase: []byte("self-test"), cipher: hidden.AESGCM},
+		decode: func(opt *encodeOptions) { opt.passphrase = nil },
+		want:   hidden.ErrPassphraseRequired,
+	},
+	{
+		name: "wrong pad", out: "wrongpad.bmp",
+		opt:    encodeOptions{pad: selfTestPad},
+		decode: func(opt *encodeOptions) { opt.pad = &hidden.Pad{Data: bytes.Repeat([]byte("other pad "), 200)} },
+		want:   hidden.ErrWrongPad,
+	},
+	{
+		name: "damaged", out: "damaged.bmp",
+		damage: func(data []byte) { data[len(data)/2] ^= 1 },
+		want:   &hidden.ChecksumError{},
+	},
+}
+
+func selfTestCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("self-test", flag.ExitOnError)
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+		if fs.NArg() != 0 {
+			commandUsage(fs, "self-test")
+		}
+
+		start := time.Now()
+		failed, err := runSelfTests()
+		if err != nil {
+			fatal(err)
+		}
+		if failed > 0 {
+			fmt.Printf("%d of %d cases failed\n", failed, len(selfTests))
+			os.Exit(exitFailure)
+		}
+		fmt.Printf("All %d cases passed in %v\n", len(selfTests), time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// runSelfTests runs every case in a temporary directory, printing the
+// result of each, and returns how many failed.
+func runSelfTests() (int, error) {
+	dir, err := ioutil.TempDir("", "hidden-self-test")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	// The encoder reports what it does, which is just noise here.
+	out := info
+	info = ioutil.Discard
+	defer func() { info = out }()
+
+	var failed int
+	for i := range selfTests {
+		c := &selfTests[i]
+		start := time.Now()
+		if err := c.run(dir); err != nil {
+			failed++
+			fmt.Printf("FAIL %-20s %v\n", c.name, err)
+			continue
+		}
+		fmt.Printf("PASS %-20s %v\n", c.name, time.Since(start).Round(time.Millisecond))
+	}
+	return failed, nil
+}
+
+// run encodes a message into a generated cover with the command line code,
+// and decodes it back from the file.
+func (c *selfTestCase) run(dir string) error {
+	msg := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(msg)
+
+	fout := filepath.Join(dir, c.out)
+	opt := c.opt
+	opt.generate = "noise"
+	if err := encodeFile("", fout, msg, opt); err != nil {
+		return fmt.Errorf("encoding: %v", err)
+	}
+
+	if c.damage != nil {
+		data, err := ioutil.ReadFile(fout)
+		if err != nil {
+			return err
+		}
+		c.damage(data)
+		if err := ioutil.WriteFile(fout, data, 0600); err != nil {
+			return err
+		}
+	}
+
+	if c.decode != nil {
+		c.decode(&opt)
+	}
+	lib, err := opt.library()
+	if err != nil {
+		return err
+	}
+	got, err := extractFile(fout, lib)
+
+	switch want := c.want.(type) {
+	case nil:
+		if err != nil {
+			return fmt.Errorf("decoding: %v", err)
+		}
+		if !bytes.Equal(got, msg) {
+			return fmt.Errorf("decoded %d bytes that differ from the %d byte message", len(got), len(msg))
+		}
+	case *hidden.ChecksumError:
+		if !errors.As(err, &want) {
+			return fmt.Errorf("decoding did not fail with a checksum error, but with: %v", err)
+		}
+	default:
+		if err != want {
+			return fmt.Errorf("decoding did not fail with %q, but with: %v", want, err)
+		}
+	}
+	return nil
+}
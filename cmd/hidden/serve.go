@@ -0,0 +1,368 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andreas-jonsson/hidden"
+	"golang.org/x/image/bmp"
+)
+
+// Size limit for the small option fields of multipart requests.
+const maxFieldSize = 64
+
+type server struct {
+	maxRequestSize int64
+	limits         hidden.Limits
+	token          []byte
+}
+
+func serveCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "Address to listen on.")
+	fs.Var(fs.Lookup("listen").Value, "addr", "Same as -listen.")
+	maxRequestSize := fs.Int64("max-request-size", 64<<20, "Largest accepted request body in bytes.")
+	timeout := fs.Duration("timeout", 30*time.Second, "Time limit for handling a request.")
+	tokenFile := fs.String("token-file", "", "Require a bearer token, read from file. The HIDDEN_TOKEN environment variable works too.")
+	limitFlags(fs)
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() != 0 {
+			commandUsage(fs, "serve [flags]")
+		}
+
+		s := &server{maxRequestSize: *maxRequestSize, limits: limits}
+		token, err := serverToken(*tokenFile)
+		if err != nil {
+			fatal(err)
+		}
+		s.token = token
+
+		srv := &http.Server{
+			Addr:         *listen,
+			Handler:      http.TimeoutHandler(s.handler(), *timeout, "request timed out"),
+			ReadTimeout:  *timeout,
+			WriteTimeout: *timeout + 5*time.Second,
+		}
+
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		go func() {
+			<-ctx.Done()
+			srv.Close()
+		}()
+
+		log.Println("listening on", *listen)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			fatal(err)
+		}
+	}
+}
+
+// serverToken returns the bearer token in file, or in $HIDDEN_TOKEN without
+// one, and nil if neither is given. A file without a token is an error, not
+// a server open to anyone.
+func serverToken(file string) ([]byte, error) {
+	if file == "" {
+		if token := os.Getenv("HIDDEN_TOKEN"); token != "" {
+			return []byte(token), nil
+		}
+		return nil, nil
+	}
+	token, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if token = bytes.TrimSpace(token); len(token) == 0 {
+		return nil, fmt.Errorf("-token-file %s holds no token", file)
+	}
+	return token, nil
+}
+
+func (s *server) handler() http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("/encode", s.post(s.encode))
+	api.HandleFunc("/decode", s.post(s.decode))
+	api.HandleFunc("/capacity", s.post(s.capacity))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+	mux.Handle("/", s.auth(api))
+	return mux
+}
+
+// auth rejects requests without the bearer token, if one is configured.
+func (s *server) auth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token != nil {
+			auth := r.Header.Get("Authorization")
+			token := strings.TrimPrefix(auth, "Bearer ")
+			if len(token) == len(auth) || subtle.ConstantTimeCompare([]byte(token), s.token) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// post only lets POST requests through and limits the size of the body.
+func (s *server) post(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.ContentLength > s.maxRequestSize {
+			s.fail(w, &http.MaxBytesError{Limit: s.maxRequestSize})
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxRequestSize)
+		h(w, r)
+	}
+}
+
+// fail maps err to a status code and writes it as the response.
+func (s *server) fail(w http.ResponseWriter, err error) {
+	var (
+		tooLarge *http.MaxBytesError
+		damaged  *hidden.ChecksumError
+		expired  *hidden.ExpiredError
+		code     = http.StatusBadRequest
+	)
+
+	switch {
+	case errors.As(err, &tooLarge):
+		code, err = http.StatusRequestEntityTooLarge, fmt.Errorf("request is larger than %d bytes", s.maxRequestSize)
+	case err == image.ErrFormat, err == hidden.ErrUnsupportedImage:
+		code = http.StatusUnsupportedMediaType
+	case err == hidden.ErrMessageTooLarge, errors.Is(err, hidden.ErrImageTooLarge):
+		code = http.StatusRequestEntityTooLarge
+	case errors.As(err, &expired):
+		code = http.StatusGone
+	case err == hidden.ErrNoHiddenMessage, err == hidden.ErrPassphraseRequired, err == hidden.ErrDecryptionFailed,
+		errors.As(err, &damaged), errors.As(err, new(*hidden.TruncatedError)), errors.As(err, new(hidden.UnsupportedIntegrityError)), errors.As(err, new(hidden.UnsupportedCipherError)):
+		code = http.StatusUnprocessableEntity
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// encode expects a multipart form with the cover image in "cover" and the
+// payload in "payload". The optional "format" field selects bmp (default)
+// or png output, "overwrite" set to true allows replacing a message already
+// in the cover, and "passphrase" encrypts the payload with the cipher named
+// in "cipher".
+func (s *server) encode(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		s.fail(w, errors.New("expected a multipart/form-data request"))
+		return
+	}
+
+	var (
+		cover     image.Image
+		payload   []byte
+		format    = "bmp"
+		overwrite bool
+		opt       hidden.Options
+	)
+	defer func() { hidden.Wipe(opt.Passphrase, payload) }()
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			s.fail(w, err)
+			return
+		}
+
+		switch part.FormName() {
+		case "cover":
+			cover, _, err = hidden.DecodeImageLimits(part, &s.limits)
+		case "payload":
+			payload, err = ioutil.ReadAll(part)
+		case "format":
+			format, err = formValue(part)
+		case "overwrite":
+			var v string
+			if v, err = formValue(part); err == nil {
+				overwrite, err = strconv.ParseBool(v)
+			}
+		case "passphrase":
+			opt.Passphrase, err = formBytes(part)
+		case "cipher":
+			var v string
+			if v, err = formValue(part); err == nil {
+				var ok bool
+				if opt.Cipher, ok = hidden.LookupCipher(v); !ok {
+					err = fmt.Errorf("unknown cipher %q", v)
+				}
+			}
+		}
+		if err != nil {
+			s.fail(w, err)
+			return
+		}
+	}
+
+	if cover == nil || payload == nil {
+		s.fail(w, errors.New("the cover and payload fields are required"))
+		return
+	}
+	if format != "bmp" && format != "png" {
+		s.fail(w, fmt.Errorf("unsupported output format %q", format))
+		return
+	}
+
+	if !overwrite {
+		if size, _, err := hidden.Detect(cover); err == nil {
+			http.Error(w, fmt.Sprintf("cover already contains a hidden message of %d bytes", size), http.StatusConflict)
+			return
+		}
+	}
+
+	stego, err := hidden.Encode(cover, payload, &opt)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", mime.TypeByExtension("."+format))
+	if format == "png" {
+		err = png.Encode(w, stego)
+	} else {
+		err = bmp.Encode(w, stego)
+	}
+	if err != nil {
+		log.Println("encode:", err)
+	}
+}
+
+// decode expects the image as the request body, or in the "image" field of
+// a multipart form, and responds with the payload. An encrypted payload is
+// decrypted with the passphrase in the X-Hidden-Passphrase header.
+func (s *server) decode(w http.ResponseWriter, r *http.Request) {
+	img, err := requestImage(r, &s.limits)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	passphrase := []byte(r.Header.Get("X-Hidden-Passphrase"))
+	defer hidden.Wipe(passphrase)
+	payload, err := hidden.Decode(img, &hidden.Options{Passphrase: passphrase})
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+	_, format, _ := hidden.Detect(img)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+	w.Header().Set("X-Hidden-Format", format)
+	w.Write(payload)
+	hidden.Wipe(payload)
+}
+
+// capacity expects an image like decode and responds with its dimensions and
+// the largest payload it can hold.
+func (s *server) capacity(w http.ResponseWriter, r *http.Request) {
+	img, err := requestImage(r, &s.limits)
+	if err != nil {
+		s.fail(w, err)
+		return
+	}
+
+	b := img.Bounds()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Width    int `json:"width"`
+		Height   int `json:"height"`
+		Capacity int `json:"capacity"`
+	}{b.Dx(), b.Dy(), hidden.Capacity(img, nil)})
+}
+
+func requestImage(r *http.Request, l *hidden.Limits) (image.Image, error) {
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "multipart/form-data" {
+		img, _, err := hidden.DecodeImageLimits(r.Body, l)
+		return img, err
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("the image field is required")
+			}
+			return nil, err
+		}
+		if part.FormName() == "image" {
+			img, _, err := hidden.DecodeImageLimits(part, l)
+			return img, err
+		}
+	}
+}
+
+// formValue reads a small multipart form field.
+func formValue(part *multipart.Part) (string, error) {
+	v, err := formBytes(part)
+	return string(v), err
+}
+
+// formBytes is formValue for fields that should not end up in a string, like
+// the passphrase. The field is read into a buffer that does not grow, so it
+// leaves no copies behind.
+func formBytes(part *multipart.Part) ([]byte, error) {
+	v := make([]byte, maxFieldSize+1)
+	n, err := io.ReadFull(part, v)
+	switch {
+	case err == io.EOF, err == io.ErrUnexpectedEOF:
+		err = nil
+	case err == nil:
+		hidden.Wipe(v)
+		return nil, fmt.Errorf("the %s field is too long", part.FormName())
+	}
+	return v[:n], err
+}
@@ -0,0 +1,236 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andreas-jonsson/hidden"
+	"golang.org/x/image/bmp"
+)
+
+// testServer starts s on a local port until t is done.
+func testServer(t *testing.T, s *server) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(s.handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// bmpBytes returns img encoded as a BMP file.
+func bmpBytes(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := bmp.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// post sends body to the server and returns the response status and body.
+func post(t *testing.T, url, contentType string, header http.Header, body io.Reader) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+func TestServeDecode(t *testing.T) {
+	msg := testMessage(1000, 1)
+	plain, err := hidden.Encode(testCover(64, 64, 1), msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := hidden.Encode(testCover(64, 64, 2), msg, &hidden.Options{Passphrase: []byte("right")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainBMP, sealedBMP := bmpBytes(t, plain), bmpBytes(t, sealed)
+
+	srv := testServer(t, &server{maxRequestSize: int64(len(plainBMP)) + 1024})
+	large := bmpBytes(t, testCover(128, 128, 3))
+
+	for _, c := range []struct {
+		name       string
+		body       []byte
+		passphrase string
+		chunked    bool
+		code       int
+	}{
+		{"plain", plainBMP, "", false, http.StatusOK},
+		{"passphrase", sealedBMP, "right", false, http.StatusOK},
+		{"oversized", large, "", false, http.StatusRequestEntityTooLarge},
+		{"oversized chunked", large, "", true, http.StatusRequestEntityTooLarge},
+		{"too many pixels", bombBMP(60000, 60000), "", false, http.StatusRequestEntityTooLarge},
+		{"not an image", []byte("just some text, not an image"), "", false, http.StatusUnsupportedMediaType},
+		{"wrong passphrase", sealedBMP, "wrong", false, http.StatusUnprocessableEntity},
+		{"no passphrase", sealedBMP, "", false, http.StatusUnprocessableEntity},
+		{"no message", bmpBytes(t, testCover(64, 64, 4)), "", false, http.StatusUnprocessableEntity},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			header := http.Header{}
+			if c.passphrase != "" {
+				header.Set("X-Hidden-Passphrase", c.passphrase)
+			}
+			var r io.Reader = bytes.NewReader(c.body)
+			if c.chunked {
+				// Hide the length, so the limit applies while reading.
+				r = io.MultiReader(r)
+			}
+			code, body := post(t, srv.URL+"/decode", "image/bmp", header, r)
+			if code != c.code {
+				t.Fatalf("got status %d, %q, want %d", code, body, c.code)
+			}
+			if code == http.StatusOK && !bytes.Equal(body, msg) {
+				t.Errorf("decoded %d bytes that differ from the message", len(body))
+			}
+		})
+	}
+}
+
+func TestServeEncode(t *testing.T) {
+	msg := testMessage(1000, 1)
+	srv := testServer(t, &server{maxRequestSize: 1 << 20})
+
+	form := func(cover []byte, fields ...string) (string, io.Reader) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		w, _ := mw.CreateFormFile("cover", "cover.bmp")
+		w.Write(cover)
+		w, _ = mw.CreateFormFile("payload", "payload")
+		w.Write(msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			mw.WriteField(fields[i], fields[i+1])
+		}
+		mw.Close()
+		return mw.FormDataContentType(), &buf
+	}
+
+	ct, body := form(bmpBytes(t, testCover(64, 64, 1)), "passphrase", "right", "format", "png")
+	code, stego := post(t, srv.URL+"/encode", ct, nil, body)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d, %q", code, stego)
+	}
+	header := http.Header{"X-Hidden-Passphrase": {"right"}}
+	if code, got := post(t, srv.URL+"/decode", "image/png", header, bytes.NewReader(stego)); code != http.StatusOK || !bytes.Equal(got, msg) {
+		t.Errorf("decoding the encoded image: status %d, %d bytes", code, len(got))
+	}
+
+	ct, body = form(stego)
+	if code, resp := post(t, srv.URL+"/encode", ct, nil, body); code != http.StatusConflict {
+		t.Errorf("encoding into a stego image: got status %d, %q", code, resp)
+	}
+	ct, body = form([]byte("not an image"))
+	if code, resp := post(t, srv.URL+"/encode", ct, nil, body); code != http.StatusUnsupportedMediaType {
+		t.Errorf("encoding into text: got status %d, %q", code, resp)
+	}
+	ct, body = form(bmpBytes(t, testCover(8, 8, 1)))
+	if code, resp := post(t, srv.URL+"/encode", ct, nil, body); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("encoding into a small cover: got status %d, %q", code, resp)
+	}
+	if code, resp := post(t, srv.URL+"/encode", "text/plain", nil, strings.NewReader("hello")); code != http.StatusBadRequest {
+		t.Errorf("encoding without a form: got status %d, %q", code, resp)
+	}
+}
+
+func TestServeAuth(t *testing.T) {
+	srv := testServer(t, &server{maxRequestSize: 1 << 20, token: []byte("secret")})
+	img := bmpBytes(t, testCover(16, 16, 1))
+
+	for _, c := range []struct {
+		auth string
+		code int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer ", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		header := http.Header{}
+		if c.auth != "" {
+			header.Set("Authorization", c.auth)
+		}
+		if code, body := post(t, srv.URL+"/capacity", "image/bmp", header, bytes.NewReader(img)); code != c.code {
+			t.Errorf("authorization %q: got status %d, %q, want %d", c.auth, code, body, c.code)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("healthz without a token: got status %d", resp.StatusCode)
+	}
+}
+
+func TestServerToken(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	t.Setenv("HIDDEN_TOKEN", "")
+	if token, err := serverToken(""); token != nil || err != nil {
+		t.Errorf("no token: got %q, %v", token, err)
+	}
+	t.Setenv("HIDDEN_TOKEN", "from env")
+	if token, err := serverToken(""); string(token) != "from env" || err != nil {
+		t.Errorf("$HIDDEN_TOKEN: got %q, %v", token, err)
+	}
+	if token, err := serverToken(write("token", "secret\n")); string(token) != "secret" || err != nil {
+		t.Errorf("token file: got %q, %v", token, err)
+	}
+	for name, content := range map[string]string{"empty": "", "blank": " \n\t\n"} {
+		if token, err := serverToken(write(name, content)); err == nil {
+			t.Errorf("%s token file: got %q, want an error", name, token)
+		}
+	}
+	if _, err := serverToken(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing token file: no error")
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// shardFiles splits the -encode or -decode argument arg into the images a
+// message is split across, if it lists more than one separated by commas
+// and is not the name of a file itself.
+func shardFiles(arg string) ([]string, bool) {
+	if !strings.Contains(arg, ",") {
+		return nil, false
+	}
+	if _, err := os.Stat(arg); err == nil {
+		return nil, false
+	}
+	return strings.Split(arg, ","), true
+}
+
+// shardOutputs names the images the covers fins are written to, encoded-1,
+// encoded-2 and so on next to each of them, as a BMP or PNG like encoding
+// into one cover does.
+func shardOutputs(fins []string) string {
+	outs := make([]string, len(fins))
+	for i, fin := range fins {
+		ext := ".bmp"
+		if wideFile(fin) || isPNGFile(fin) {
+			ext = ".png"
+		}
+		outs[i] = path.Join(outputDir(fin), fmt.Sprintf("encoded-%d%s", i+1, ext))
+	}
+	return strings.Join(outs, ",")
+}
+
+// encodeShards hides msg split across the BMP or PNG covers fins, see
+// hidden.EncodeShards, and writes them to fouts.
+func encodeShards(fins, fouts []string, msg []byte, opt encodeOptions) error {
+	switch {
+	case len(fins) != len(fouts):
+		return fmt.Errorf("%d images are encoded into %d outputs, -out has to name one for each", len(fins), len(fouts))
+	case opt.generate != "" || opt.jpegQuality > 0 || opt.stream || opt.maxUpscale > 0 || opt.debugMap != "":
+		return errors.New("-generate, -jpeg, -stream, -resize-to-fit and -debug-map can not be combined with several covers")
+	}
+	lib, err := opt.library()
+	if err != nil {
+		return err
+	}
+
+	var (
+		covers = make([]image.Image, len(fins))
+		extras = make([]*ancillary, len(fins))
+	)
+	for i, fin := range fins {
+		data, err := readImageFile(fin)
+		if err != nil {
+			return err
+		}
+		if isJPEG(data) || isGIF(data) || isTIFF(data) || isICO(data) {
+			return fmt.Errorf("%s: a message is only split across the pixels of BMP and PNG images", fin)
+		}
+		if covers[i], extras[i], err = decodeCover(data); err != nil {
+			return fmt.Errorf("%s: %v", fin, err)
+		}
+		if !opt.overwrite {
+			if size, _, err := hidden.Detect(covers[i]); err == nil {
+				return fmt.Errorf("%s already contains a hidden message of %d bytes, use -overwrite-message to replace it", fin, size)
+			}
+		}
+		if err := checkOutput(fouts[i], covers[i], opt); err != nil {
+			return err
+		}
+	}
+
+	imgs, err := hidden.EncodeShards(covers, msg, lib)
+	if err == hidden.ErrMessageTooLarge {
+		var total int
+		for _, cover := range covers {
+			total += hidden.Capacity(cover, lib)
+		}
+		return fmt.Errorf("%w, it is %d bytes and the images hold about %d together", err, len(msg), total)
+	} else if err != nil {
+		return err
+	}
+	for i, img := range imgs {
+		if err := checkChanges(covers[i], img, len(msg), opt); err != nil {
+			return fmt.Errorf("%s: %v", fins[i], err)
+		}
+	}
+	if opt.dryRun {
+		return nil
+	}
+
+	for i, img := range imgs {
+		if err := saveImage(fouts[i], img, extras[i]); err != nil {
+			return err
+		}
+	}
+	if opt.verify {
+		got, err := decodeShards(fouts, lib)
+		if err == nil && !bytes.Equal(got, msg) {
+			err = fmt.Errorf("decoded %d bytes that differ from the %d byte message", len(got), len(msg))
+		}
+		if err != nil {
+			for _, fout := range fouts {
+				os.Remove(fout)
+			}
+			return fmt.Errorf("verification failed, removed %s: %v", strings.Join(fouts, ", "), err)
+		}
+	}
+	logger.Info(fmt.Sprintf("Split the message across %d images", len(imgs)))
+	return nil
+}
+
+// decodeShards reassembles the message split across the images in files,
+// given in any order.
+func decodeShards(files []string, opt *hidden.Options) ([]byte, error) {
+	imgs := make([]image.Image, len(files))
+	for i, file := range files {
+		data, err := readImageFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if imgs[i], _, err = hidden.DecodeImage(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return hidden.DecodeShards(imgs, opt)
+}
+
+// checkNotShard returns an error if the image file data holds one shard of
+// a message, which decoding on its own would only give a part of.
+func checkNotShard(fin string, data []byte) error {
+	if data == nil {
+		return nil
+	}
+	h, err := headerData(data)
+	if err != nil {
+		return nil
+	}
+	if s, ok := h.Shard(); ok {
+		return fmt.Errorf("%s holds part %d of %d of a message, give all of the images separated by commas", fin, s.Index+1, s.Count)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/bmp"
+	xdraw "golang.org/x/image/draw"
+)
+
+const defaultTransforms = "png,bmp,jpeg-95,jpeg-90,jpeg-75,jpeg-50,crop-1,resize-99,brighten-4"
+
+type simulation struct {
+	File    string             `json:"file"`
+	Results []simulationResult `json:"results"`
+}
+
+type simulationResult struct {
+	Transform string `json:"transform"`
+	Survived  bool   `json:"survived"`
+	Error     string `json:"error,omitempty"`
+}
+
+// transformNames lists the transformations parseTransform knows.
+const transformNames = "png, bmp, jpeg-<quality>, crop-<pixels>, crop-<percent>%, resize-<percent>, noise-<percent>, brighten-<delta> and darken-<delta>"
+
+// transform returns an image as it could arrive after passing through
+// some other program, encoded as a file.
+type transform func(img image.Image) ([]byte, error)
+
+func simulateCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	list := fs.String("transforms", defaultTransforms, "Comma separated transformations to try: "+transformNames+".")
+	asJSON := jsonFlag(fs, "Output in JSON format.")
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() == 0 {
+			commandUsage(fs, "simulate [flags] <stego>...")
+		}
+
+		var (
+			names      = strings.Split(*list, ",")
+			transforms = make([]transform, len(names))
+			err        error
+		)
+		for i, name := range names {
+			if transforms[i], err = parseTransform(name); err != nil {
+				fatal(err)
+			}
+		}
+
+		var sims []simulation
+		for _, file := range fs.Args() {
+			data, err := readImageFile(file)
+			if err != nil {
+				fatal(err)
+			}
+			size, format, err := detectData(data)
+			if err != nil {
+				fatal(fmt.Errorf("%s: %w", file, err))
+			}
+			img, _, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				fatal(err)
+			}
+
+			sim := simulation{File: file}
+			for i, t := range transforms {
+				sim.Results = append(sim.Results, simulate(img, t, names[i], size, format))
+			}
+			sims = append(sims, sim)
+		}
+
+		if *asJSON {
+			printJSON(sims)
+			return
+		}
+		printSimulations(names, sims)
+	}
+}
+
+// simulate applies t to img and checks that the message found in it is
+// still there, with the original size and format.
+func simulate(img image.Image, t transform, name string, size int, format string) simulationResult {
+	res := simulationResult{Transform: name}
+	data, err := t(img)
+	if err == nil {
+		var n int
+		var f string
+		if n, f, err = detectData(data); err == nil && (n != size || f != format) {
+			err = fmt.Errorf("found a %d byte %s message instead", n, f)
+		}
+	}
+
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Survived = true
+	}
+	return res
+}
+
+// printSimulations prints a matrix with a row per transformation and a
+// column per file.
+func printSimulations(names []string, sims []simulation) {
+	width := len("transform")
+	for _, name := range names {
+		if len(name) > width {
+			width = len(name)
+		}
+	}
+
+	columns := make([]int, len(sims))
+	row := []string{fmt.Sprintf("%-*s", width, "transform")}
+	for i, sim := range sims {
+		if columns[i] = len(sim.File); columns[i] < len("pass") {
+			columns[i] = len("pass")
+		}
+		row = append(row, fmt.Sprintf("%-*s", columns[i], sim.File))
+	}
+	fmt.Println(strings.TrimRight(strings.Join(row, "  "), " "))
+
+	for i, name := range names {
+		row = []string{fmt.Sprintf("%-*s", width, name)}
+		for j, sim := range sims {
+			result := "pass"
+			if !sim.Results[i].Survived {
+				result = "FAIL"
+			}
+			row = append(row, fmt.Sprintf("%-*s", columns[j], result))
+		}
+		fmt.Println(strings.TrimRight(strings.Join(row, "  "), " "))
+	}
+}
+
+// parseTransform returns the transformation with the given name.
+func parseTransform(name string) (transform, error) {
+	name = strings.TrimSpace(name)
+	switch name {
+	case "png":
+		return encodePNG, nil
+	case "bmp":
+		return func(img image.Image) ([]byte, error) {
+			var buf bytes.Buffer
+			err := bmp.Encode(&buf, img)
+			return buf.Bytes(), err
+		}, nil
+	}
+
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return nil, fmt.Errorf("unknown transformation %q", name)
+	}
+	arg := name[i+1:]
+	percent := strings.HasSuffix(arg, "%")
+	n, err := strconv.Atoi(strings.TrimSuffix(arg, "%"))
+	if err != nil {
+		return nil, fmt.Errorf("expected a number in transformation %q", name)
+	}
+	if percent && name[:i] != "crop" {
+		return nil, fmt.Errorf("only crop takes a percentage, not %q", name)
+	}
+
+	switch name[:i] {
+	case "jpeg":
+		if n < 1 || n > 100 {
+			return nil, fmt.Errorf("JPEG quality in %q is not between 1 and 100", name)
+		}
+		return func(img image.Image) ([]byte, error) {
+			var buf bytes.Buffer
+			err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: n})
+			return buf.Bytes(), err
+		}, nil
+	case "crop":
+		if percent && (n < 1 || n > 99) {
+			return nil, fmt.Errorf("crop percentage in %q is not between 1 and 99", name)
+		}
+		return func(img image.Image) ([]byte, error) {
+			b := img.Bounds()
+			dx, dy := n, n
+			if percent {
+				dx, dy = b.Dx()*n/100, b.Dy()*n/100
+			}
+			if b.Dx() <= dx || b.Dy() <= dy {
+				return nil, fmt.Errorf("image is too small to crop %d pixels", dx)
+			}
+			return encodePNG(toRGBA(img).SubImage(image.Rect(b.Min.X+dx, b.Min.Y+dy, b.Max.X, b.Max.Y)))
+		}, nil
+	case "resize":
+		if n < 1 {
+			return nil, fmt.Errorf("resize percentage in %q is not positive", name)
+		}
+		return func(img image.Image) ([]byte, error) {
+			b := img.Bounds()
+			w, h := (b.Dx()*n+50)/100, (b.Dy()*n+50)/100
+			if w < 1 || h < 1 {
+				return nil, fmt.Errorf("image is too small to resize to %d%%", n)
+			}
+			dst := image.NewRGBA(image.Rect(0, 0, w, h))
+			xdraw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, b, xdraw.Src, nil)
+			return encodePNG(dst)
+		}, nil
+	case "noise":
+		if n < 1 || n > 100 {
+			return nil, fmt.Errorf("noise percentage in %q is not between 1 and 100", name)
+		}
+		return func(img image.Image) ([]byte, error) {
+			return encodePNG(flipBits(toRGBA(img), n))
+		}, nil
+	case "brighten", "darken":
+		if name[:i] == "darken" {
+			n = -n
+		}
+		return func(img image.Image) ([]byte, error) {
+			return encodePNG(brighten(toRGBA(img), n))
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown transformation %q", name)
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+// brighten returns a copy of img with delta added to every color sample.
+func brighten(img *image.RGBA, delta int) *image.RGBA {
+	dst := image.NewRGBA(img.Bounds())
+	copy(dst.Pix, img.Pix)
+	for i := range dst.Pix {
+		if i%4 == 3 {
+			continue
+		}
+		v := int(dst.Pix[i]) + delta
+		if v < 0 {
+			v = 0
+		} else if v > 255 {
+			v = 255
+		}
+		dst.Pix[i] = uint8(v)
+	}
+	return dst
+}
+
+// flipBits returns a copy of img with the least significant bit of percent
+// percent of the color samples flipped, the same ones every time.
+func flipBits(img *image.RGBA, percent int) *image.RGBA {
+	dst := image.NewRGBA(img.Bounds())
+	copy(dst.Pix, img.Pix)
+	rnd := rand.New(rand.NewSource(1))
+	for i := range dst.Pix {
+		if i%4 != 3 && rnd.Intn(100) < percent {
+			dst.Pix[i] ^= 1
+		}
+	}
+	return dst
+}
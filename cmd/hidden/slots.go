@@ -0,0 +1,98 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// slotLabel is the named slot of an image to encode into or decode from,
+// or empty for the message of the image.
+var slotLabel string
+
+// slotFlag defines the -slot flag in fs.
+func slotFlag(fs *flag.FlagSet) {
+	fs.StringVar(&slotLabel, "slot", "", "Named slot to encode into or decode from.")
+}
+
+// infoSlot is a named slot of an image.
+type infoSlot struct {
+	Label  string `json:"label"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+}
+
+// slotsData returns the named slots of the image file in data, nil if it
+// holds none.
+func slotsData(data []byte) []infoSlot {
+	if isJPEG(data) || isGIF(data) || isTIFF(data) || isICO(data) {
+		return nil
+	}
+	img, _, err := hidden.DecodeImage(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	slots, err := hidden.ListSlots(img)
+	if err != nil {
+		return nil
+	}
+	infos := make([]infoSlot, len(slots))
+	for i, s := range slots {
+		infos[i] = infoSlot{s.Label, s.Offset, s.Length}
+	}
+	return infos
+}
+
+// hasSlots reports whether img holds named slots.
+func hasSlots(img image.Image) bool {
+	_, err := hidden.ListSlots(img)
+	return err == nil
+}
+
+// decodeSlot is hidden.Decode, or hidden.DecodeSlot with -slot. Without it
+// an image with named slots fails with their labels.
+func decodeSlot(img image.Image, opt *hidden.Options) ([]byte, int, error) {
+	if slotLabel != "" {
+		msg, err := hidden.DecodeSlot(img, slotLabel, opt)
+		if err == hidden.ErrNoSlot {
+			err = fmt.Errorf("%w: %s", err, slotLabel)
+		}
+		return msg, 0, err
+	}
+
+	msg, repaired, err := hidden.DecodeRepaired(img, opt)
+	if errors.Is(err, hidden.ErrSlotted) {
+		var labels []string
+		if slots, err := hidden.ListSlots(img); err == nil {
+			for _, s := range slots {
+				labels = append(labels, s.Label)
+			}
+		}
+		err = usagef("%v, choose one of %s with -slot", err, strings.Join(labels, ", "))
+	}
+	return msg, repaired, err
+}
+
+// errSlotPixels is returned for -slot with an image whose message is not
+// stored in its pixels.
+var errSlotPixels = usagef("-slot stores messages in the pixels of a BMP or PNG")
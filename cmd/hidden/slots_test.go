@@ -0,0 +1,77 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// TestSlotFlag encodes three slots with -slot, one of them twice, and
+// decodes each of them, a missing one and the image without -slot.
+func TestSlotFlag(t *testing.T) {
+	defer func(label string) { slotLabel = label }(slotLabel)
+	dir := t.TempDir()
+	img := writeTestImage(t, "cover.png", testCover(120, 80, 295))
+
+	msgs := map[string][]byte{}
+	for i, s := range []struct {
+		label string
+		size  int
+	}{
+		{"one", 500},
+		{"two", 300},
+		{"three", 800},
+		{"one", 700},
+	} {
+		msgs[s.label] = testMessage(s.size, int64(i))
+		slotLabel = s.label
+		out := filepath.Join(dir, strings.Repeat("x", i+1)+".png")
+		if err := encode(img, out, writeTestFile(t, dir, s.label+".bin", msgs[s.label]), encodeOptions{verify: true}); err != nil {
+			t.Fatalf("-slot %s: %v", s.label, err)
+		}
+		img = out
+	}
+
+	for label, want := range msgs {
+		slotLabel = label
+		out := filepath.Join(dir, label+".out")
+		if err := decode(img, out, decodeOptions{library: &hidden.Options{}}); err != nil {
+			t.Fatalf("-slot %s: %v", label, err)
+		}
+		if got, _ := ioutil.ReadFile(out); !bytes.Equal(got, want) {
+			t.Errorf("-slot %s: decoded %d bytes that are not its message", label, len(got))
+		}
+	}
+
+	slotLabel = "four"
+	err := decode(img, filepath.Join(dir, "four.out"), decodeOptions{library: &hidden.Options{}})
+	if !errors.Is(err, hidden.ErrNoSlot) || !strings.Contains(err.Error(), "four") {
+		t.Errorf("-slot four: got %v, want ErrNoSlot naming it", err)
+	}
+
+	slotLabel = ""
+	err = decode(img, filepath.Join(dir, "none.out"), decodeOptions{library: &hidden.Options{}})
+	if err == nil || !strings.Contains(err.Error(), "choose one of one, two, three with -slot") {
+		t.Errorf("without -slot: got %v, want the labels listed", err)
+	}
+}
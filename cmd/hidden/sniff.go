@@ -0,0 +1,130 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// magics are signatures checked before http.DetectContentType, which does
+// not know about all of them.
+var magics = []struct {
+	offset    int
+	signature string
+	ext, desc string
+}{
+	{0, "PK\x03\x04", ".zip", "zip archive"},
+	{0, "%PDF-", ".pdf", "PDF document"},
+	{0, "\x89PNG\r\n\x1a\n", ".png", "PNG image"},
+	{0, "\x1f\x8b", ".gz", "gzip data"},
+	{257, "ustar", ".tar", "tar archive"},
+}
+
+// contentTypes maps media types reported by http.DetectContentType to
+// extensions.
+var contentTypes = map[string]string{
+	"application/ogg":               ".ogg",
+	"application/pdf":               ".pdf",
+	"application/vnd.ms-fontobject": ".eot",
+	"application/wasm":              ".wasm",
+	"application/x-7z-compressed":   ".7z",
+	"application/x-rar-compressed":  ".rar",
+	"audio/mpeg":                    ".mp3",
+	"audio/wave":                    ".wav",
+	"font/ttf":                      ".ttf",
+	"font/woff":                     ".woff",
+	"font/woff2":                    ".woff2",
+	"image/bmp":                     ".bmp",
+	"image/gif":                     ".gif",
+	"image/jpeg":                    ".jpg",
+	"image/webp":                    ".webp",
+	"text/html":                     ".html",
+	"text/plain":                    ".txt",
+	"text/xml":                      ".xml",
+	"video/mp4":                     ".mp4",
+	"video/webm":                    ".webm",
+}
+
+// sniffExtension guesses the type of msg from its first 512 bytes and
+// returns a file extension and a description. Unknown data is .bin.
+func sniffExtension(msg []byte) (string, string) {
+	for _, m := range magics {
+		if len(msg) >= m.offset+len(m.signature) && bytes.HasPrefix(msg[m.offset:], []byte(m.signature)) {
+			return m.ext, m.desc
+		}
+	}
+
+	mediaType := http.DetectContentType(msg)
+	if ext, ok := contentTypes[strings.SplitN(mediaType, ";", 2)[0]]; ok {
+		return ext, mediaType
+	}
+	return ".bin", "unknown data"
+}
+
+// messageFile returns the attributes of the file fmsg the message msg was
+// read from, with its type from the extension or else the contents, or nil
+// if it was not read from a local file.
+func messageFile(fmsg string, msg []byte) (*hidden.FileInfo, error) {
+	if fmsg == stdioName || fmsg == clipboardName || isURL(fmsg) {
+		return nil, nil
+	}
+	fi, err := os.Stat(fmsg)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &hidden.FileInfo{Name: fi.Name(), ModTime: fi.ModTime(), ContentType: mime.TypeByExtension(filepath.Ext(fmsg))}
+	if f.ContentType == "" {
+		f.ContentType = http.DetectContentType(msg)
+	}
+	return f, nil
+}
+
+// storedHeader returns the header of the message in the image file data,
+// read with readImageFile, or an empty one.
+func storedHeader(data []byte) *hidden.Header {
+	if data == nil {
+		return &hidden.Header{}
+	}
+	h, err := headerData(data)
+	if err != nil {
+		return &hidden.Header{}
+	}
+	return h
+}
+
+// restoreModTime sets the modification time of the decoded message file to
+// that of the file it was encoded from, if f has one.
+func restoreModTime(file string, f hidden.FileInfo) error {
+	if f.ModTime.IsZero() || file == clipboardName {
+		return nil
+	}
+	return os.Chtimes(file, f.ModTime, f.ModTime)
+}
+
+// isFileName reports whether name names a file in the current directory,
+// so a decoded message can be written to it without escaping the directory
+// it is decoded into.
+func isFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00") && filepath.Base(name) == name
+}
@@ -0,0 +1,137 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// gzipped returns data compressed with gzip.
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSniffExtension(t *testing.T) {
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	w, _ := zw.Create("a.txt")
+	w.Write([]byte("hello"))
+	zw.Close()
+
+	var tarred bytes.Buffer
+	tw := tar.NewWriter(&tarred)
+	tw.WriteHeader(&tar.Header{Name: "a.txt", Mode: 0600, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.Close()
+
+	for _, c := range []struct {
+		name string
+		msg  []byte
+		ext  string
+	}{
+		{"text", []byte("Meet me at the usual place at noon.\n"), ".txt"},
+		{"binary", testMessage(1000, 1), ".bin"},
+		{"empty", nil, ".txt"},
+		{"gzip", gzipped(t, []byte("compressed text")), ".gz"},
+		{"zip", zipped.Bytes(), ".zip"},
+		{"tar", tarred.Bytes(), ".tar"},
+		{"pdf", []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n"), ".pdf"},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), ".png"},
+		{"html", []byte("<!DOCTYPE html><html><body>hi</body></html>"), ".html"},
+		{"short magic", []byte("PK\x03"), ".bin"},
+	} {
+		if ext, _ := sniffExtension(c.msg); ext != c.ext {
+			t.Errorf("%s: got %s, want %s", c.name, ext, c.ext)
+		}
+	}
+}
+
+// TestDecodeSniffed decodes messages without -out, which are written next
+// to the image as message with the sniffed extension, or under the name of
+// the file they were encoded from if it is stored with them.
+func TestDecodeSniffed(t *testing.T) {
+	modTime := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		name string
+		msg  []byte
+		file *hidden.FileInfo
+		out  string
+	}{
+		{"text", []byte("Meet me at the usual place at noon.\n"), nil, "message.txt"},
+		{"binary", testMessage(1000, 1), nil, "message.bin"},
+		{"empty", []byte{}, nil, "message.txt"},
+		{"compressed", gzipped(t, testMessage(1000, 2)), nil, "message.gz"},
+		{"file", testMessage(1000, 3), &hidden.FileInfo{Name: "notes.dat", ModTime: modTime}, "notes.dat"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			stego, err := hidden.Encode(testCover(100, 100, 1), c.msg, &hidden.Options{File: c.file})
+			if err != nil {
+				t.Fatal(err)
+			}
+			fin := writeTestImage(t, "stego.png", stego)
+			if err := decode(fin, "", decodeOptions{library: &hidden.Options{}}); err != nil {
+				t.Fatal(err)
+			}
+
+			out := filepath.Join(filepath.Dir(fin), c.out)
+			got, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, c.msg) {
+				t.Errorf("%s holds %d bytes that differ from the message", c.out, len(got))
+			}
+		})
+	}
+}
+
+// TestDefaultOutput checks the names defaultOutput picks, an explicit
+// output is used as it is and does not get here.
+func TestDefaultOutput(t *testing.T) {
+	text := []byte("plain text")
+	for _, c := range []struct {
+		name    string
+		file    hidden.FileInfo
+		armored bool
+		want    string
+	}{
+		{"sniffed", hidden.FileInfo{}, false, "dir/message.txt"},
+		{"armored", hidden.FileInfo{}, true, "dir/message.txt.b64"},
+		{"stored", hidden.FileInfo{Name: "report.pdf"}, false, "dir/report.pdf"},
+		{"stored armored", hidden.FileInfo{Name: "report.pdf"}, true, "dir/report.pdf.b64"},
+		{"stored path", hidden.FileInfo{Name: "../escape.txt"}, false, "dir/message.txt"},
+	} {
+		if got := defaultOutput("dir/stego.png", text, c.file, c.armored); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
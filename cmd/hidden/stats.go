@@ -0,0 +1,217 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"math"
+)
+
+// A packed sequential message makes the head of the LSB plane look like
+// random data while the rest keeps the structure of the cover. Entropy close
+// to 1 bit per LSB, half ones and no serial correlation is what random data
+// looks like; if only the first part of the image looks like that, something
+// was probably embedded there.
+
+// Entropy difference between head and tail that we report as suspicious.
+const lsbDiscontinuityThreshold = 0.02
+
+var channelNames = [3]string{"R", "G", "B"}
+
+type lsbStats struct {
+	Samples     int     `json:"samples"`
+	Ones        float64 `json:"ones"`
+	Entropy     float64 `json:"entropy"`
+	Correlation float64 `json:"correlation"`
+}
+
+type lsbChannelStats struct {
+	Channel string   `json:"channel"`
+	All     lsbStats `json:"all"`
+	Head    lsbStats `json:"head"`
+	Tail    lsbStats `json:"tail"`
+}
+
+type lsbReport struct {
+	HeadPercent   float64           `json:"head_percent"`
+	Combined      lsbChannelStats   `json:"combined"`
+	Channels      []lsbChannelStats `json:"channels"`
+	Discontinuity bool              `json:"discontinuity"`
+}
+
+// lsbAccumulator collects the statistics of a sequence of least significant
+// bits. Entropy is measured over 8-bit symbols of consecutive LSBs and
+// normalized to bits per LSB, so it also catches structure a plain count of
+// ones would miss.
+type lsbAccumulator struct {
+	n, ones, pairs int
+	first, prev    byte
+	symbol         byte
+	symbols        [256]int
+}
+
+func (acc *lsbAccumulator) add(bit byte) {
+	if acc.n == 0 {
+		acc.first = bit
+	} else {
+		acc.pairs += int(acc.prev & bit)
+	}
+	acc.prev = bit
+	acc.ones += int(bit)
+
+	acc.symbol = acc.symbol<<1 | bit
+	acc.n++
+	if acc.n%8 == 0 {
+		acc.symbols[acc.symbol]++
+	}
+}
+
+func (acc *lsbAccumulator) stats() lsbStats {
+	st := lsbStats{Samples: acc.n}
+	if acc.n == 0 {
+		return st
+	}
+
+	n := float64(acc.n)
+	st.Ones = float64(acc.ones) / n
+
+	// The Miller-Madow correction removes most of the bias of estimating
+	// entropy from few symbols, so a short head can be compared to a long
+	// tail.
+	if numSymbols := acc.n / 8; numSymbols > 0 {
+		var seen int
+		for _, c := range acc.symbols {
+			if c > 0 {
+				p := float64(c) / float64(numSymbols)
+				st.Entropy -= p * math.Log2(p)
+				seen++
+			}
+		}
+		st.Entropy += float64(seen-1) / (2 * float64(numSymbols) * math.Ln2)
+		st.Entropy = math.Min(st.Entropy/8, 1)
+	}
+
+	// Serial correlation coefficient of the bit sequence, wrapping around
+	// from the last bit to the first. Since bits are 0 or 1 the sum of
+	// squares equals the sum.
+	sum := float64(acc.ones)
+	pairs := float64(acc.pairs + int(acc.prev&acc.first))
+	if d := n*sum - sum*sum; d != 0 {
+		st.Correlation = (n*pairs - sum*sum) / d
+	}
+	return st
+}
+
+func statsCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	head := fs.Float64("head", 10, "Percentage of the image, from the top, compared against the rest.")
+	asJSON := jsonFlag(fs, "Output in JSON format.")
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() != 1 || *head <= 0 || *head >= 100 {
+			commandUsage(fs, "stats [flags] <image>")
+		}
+
+		img, err := loadImage(fs.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+		report := lsbAnalyze(toRGBA(img), *head)
+		if *asJSON {
+			printJSON(&report)
+			return
+		}
+		printLSBReport(&report)
+	}
+}
+
+// lsbAnalyze gathers LSB statistics for each color channel of img, and for
+// all channels combined in the order the encoder writes them. The first
+// headPercent of the samples are also measured separately from the rest.
+func lsbAnalyze(img *image.RGBA, headPercent float64) lsbReport {
+	var (
+		all, head, tail [4]lsbAccumulator
+
+		b        = img.Bounds()
+		numHead  = int(float64(b.Dx()*b.Dy()*3) * headPercent / 100)
+		numSeen  int
+		combined = len(channelNames)
+	)
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]
+		for i, v := range row {
+			c := i % 4
+			if c == 3 {
+				continue
+			}
+
+			bit := v & 1
+			part := &tail
+			if numSeen < numHead {
+				part = &head
+			}
+			numSeen++
+
+			for _, acc := range [...]*lsbAccumulator{&all[c], &part[c], &all[combined], &part[combined]} {
+				acc.add(bit)
+			}
+		}
+	}
+
+	report := lsbReport{HeadPercent: headPercent}
+	for c := range all {
+		st := lsbChannelStats{
+			All:  all[c].stats(),
+			Head: head[c].stats(),
+			Tail: tail[c].stats(),
+		}
+		if c == combined {
+			st.Channel = "RGB"
+			report.Combined = st
+		} else {
+			st.Channel = channelNames[c]
+			report.Channels = append(report.Channels, st)
+		}
+	}
+
+	report.Discontinuity = report.Combined.Head.Entropy-report.Combined.Tail.Entropy > lsbDiscontinuityThreshold
+	return report
+}
+
+func printLSBReport(report *lsbReport) {
+	row := func(name string, st *lsbStats) {
+		fmt.Printf("%-10s %10d %8.4f %8.4f %12.4f\n", name, st.Samples, st.Ones, st.Entropy, st.Correlation)
+	}
+
+	fmt.Printf("%-10s %10s %8s %8s %12s\n", "Channel", "Samples", "Ones", "Entropy", "Correlation")
+	for i := range report.Channels {
+		st := &report.Channels[i]
+		row(st.Channel, &st.All)
+	}
+	row(report.Combined.Channel, &report.Combined.All)
+
+	fmt.Println()
+	row(fmt.Sprintf("First %g%%", report.HeadPercent), &report.Combined.Head)
+	row("Rest", &report.Combined.Tail)
+
+	if report.Discontinuity {
+		fmt.Println("\nThe LSB entropy drops after the first part of the image, which suggests a packed sequential message.")
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+const defaultStress = "png,jpeg-95,jpeg-85,jpeg-75,resize-90,crop-2%,crop-10%,noise-1,noise-5,jpeg-90+crop-2%"
+
+// stressResult is how much of the message survived a transformation.
+type stressResult struct {
+	Transform string `json:"transform"`
+
+	// Result is intact, repaired when ECC fixed damaged bytes, partial when
+	// only some resync blocks were found, or lost.
+	Result   string `json:"result"`
+	Repaired int    `json:"repaired,omitempty"`
+	Blocks   int    `json:"blocks,omitempty"`
+	Found    int    `json:"found,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func stressCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("stress", flag.ExitOnError)
+	list := fs.String("transforms", defaultStress, "Comma separated transformations to try, out of "+transformNames+". Join several with + to apply them in turn, like jpeg-90+crop-2%.")
+	passphrase := definePassphraseFlags(fs)
+	asJSON := jsonFlag(fs, "Output in JSON format.")
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() != 1 {
+			commandUsage(fs, "stress [flags] <stego>")
+		}
+
+		var (
+			names      = strings.Split(*list, ",")
+			transforms = make([]transform, len(names))
+			err        error
+		)
+		for i, name := range names {
+			if transforms[i], err = parseChain(name); err != nil {
+				fatal(err)
+			}
+			names[i] = strings.TrimSpace(name)
+		}
+
+		opt, err := decodeOptionsFrom(passphrase)
+		if err != nil {
+			fatal(err)
+		}
+		img, err := loadImage(fs.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+		var want []byte
+		if err := withPassphrase(opt, func(opt *hidden.Options) (err error) {
+			want, err = hidden.Decode(img, opt)
+			return err
+		}); err != nil {
+			fatal(fmt.Errorf("%s: %w", fs.Arg(0), err))
+		}
+		secret(want)
+
+		results := make([]stressResult, len(transforms))
+		for i, t := range transforms {
+			results[i] = stress(img, t, names[i], want, opt)
+		}
+
+		if *asJSON {
+			printJSON(results)
+			return
+		}
+		var survived int
+		for _, r := range results {
+			switch r.Result {
+			case "intact":
+				survived++
+				fmt.Printf("%-20s intact\n", r.Transform)
+			case "repaired":
+				survived++
+				fmt.Printf("%-20s repaired %d bytes\n", r.Transform, r.Repaired)
+			case "partial":
+				fmt.Printf("%-20s partial, found %d of %d blocks\n", r.Transform, r.Found, r.Blocks)
+			default:
+				fmt.Printf("%-20s lost, %s\n", r.Transform, r.Error)
+			}
+		}
+		fmt.Printf("The message survived %d of %d transformations.\n", survived, len(results))
+	}
+}
+
+// stress applies t to img and decodes the result, and failing that recovers
+// what it can of resync blocks, to see how much of the message want is left.
+func stress(img image.Image, t transform, name string, want []byte, opt *hidden.Options) stressResult {
+	res := stressResult{Transform: name, Result: "lost"}
+	data, err := t(img)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	damaged, _, err := hidden.DecodeImage(bytes.NewReader(data))
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	msg, repaired, err := hidden.DecodeRepaired(damaged, opt)
+	secret(msg)
+	switch {
+	case err == nil && !bytes.Equal(msg, want):
+		res.Error = "decoded a different message"
+		return res
+	case err == nil && repaired > 0:
+		res.Result, res.Repaired = "repaired", repaired
+		return res
+	case err == nil:
+		res.Result = "intact"
+		return res
+	}
+	res.Error = err.Error()
+
+	rec, rerr := hidden.Recover(damaged, opt)
+	if rerr != nil || rec.BlockSize == 0 {
+		return res
+	}
+	secret(rec.Payload)
+	total, missing := rec.Blocks()
+	if len(missing) == 0 && bytes.Equal(rec.Payload, want) {
+		res.Result, res.Error = "intact", ""
+	} else if len(missing) < total {
+		res.Result, res.Blocks, res.Found = "partial", total, total-len(missing)
+	}
+	return res
+}
+
+// parseChain returns the transformations joined by + in name, each applied
+// to the image the one before it produced.
+func parseChain(name string) (transform, error) {
+	var chain []transform
+	for _, part := range strings.Split(name, "+") {
+		t, err := parseTransform(part)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, t)
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+
+	return func(img image.Image) ([]byte, error) {
+		var (
+			data []byte
+			err  error
+		)
+		for i, t := range chain {
+			if i > 0 {
+				if img, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+					return nil, err
+				}
+			}
+			if data, err = t(img); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	}, nil
+}
@@ -0,0 +1,202 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// imageFormat is a format encoded images can be written in.
+type imageFormat struct {
+	name       string
+	extensions []string
+
+	// hazard says how the format damages a message hidden in the pixels,
+	// it is empty only if every sample is stored exactly. Every format has
+	// to declare it, checkOutput relies on it.
+	hazard string
+
+	// wide is set if the format stores 16 bit samples as they are.
+	wide bool
+
+	encode func(w io.Writer, img image.Image) error
+}
+
+var imageFormats = []*imageFormat{
+	{"bmp", []string{".bmp"}, "", false, bmp.Encode},
+	{"png", []string{".png"}, "", true, png.Encode},
+	{"tiff", []string{".tif", ".tiff"}, "", true, func(w io.Writer, img image.Image) error {
+		return tiff.Encode(w, img, nil)
+	}},
+	{"jpeg", []string{".jpg", ".jpeg"}, "is lossy", false, func(w io.Writer, img image.Image) error {
+		return jpeg.Encode(w, img, nil)
+	}},
+	{"gif", []string{".gif"}, "re-quantizes the pixels to a palette", false, func(w io.Writer, img image.Image) error {
+		return gif.Encode(w, img, nil)
+	}},
+}
+
+// formatFor returns the format file is written in, by extension. Anything
+// unknown is written as BMP.
+func formatFor(file string) *imageFormat {
+	ext := strings.ToLower(filepath.Ext(file))
+	for _, f := range imageFormats {
+		for _, e := range f.extensions {
+			if e == ext {
+				return f
+			}
+		}
+	}
+	return imageFormats[0]
+}
+
+// noStrict disables checkOutput.
+var noStrict bool
+
+// strictFlag defines the -no-strict flag in fs.
+func strictFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&noStrict, "no-strict", false, "Write the encoded image even if the message will not survive it.")
+}
+
+// checkOutput returns an error if cover, encoded with opt and written to
+// file, would not give the message back. This is the one place that knows
+// which outputs and option combinations destroy a message.
+func checkOutput(file string, cover image.Image, opt encodeOptions) error {
+	if noStrict {
+		return nil
+	}
+
+	format := formatFor(file)
+	if opt.jpegQuality > 0 {
+		switch {
+		case format.name != "jpeg":
+			return fmt.Errorf("-jpeg writes a JPEG, but %s is not named like one (use -no-strict to write it anyway)", file)
+		case hidden.CapacityJPEG(cover, opt.jpegQuality, nil) == 0:
+			return fmt.Errorf("no DCT coefficient at JPEG quality %d is coarse enough to keep the message, use a lower quality", opt.jpegQuality)
+		}
+		return nil
+	}
+
+	if format.hazard != "" {
+		return fmt.Errorf("%s output %s, which destroys the message in %s (use -no-strict to write it anyway)", format.name, format.hazard, file)
+	}
+	if opt.depth[3] > 0 && format.name != "png" {
+		return fmt.Errorf("the message is stored in the alpha channel, which %s does not keep (write a PNG, or use -no-strict to write it anyway)", format.name)
+	}
+	if wide(cover) && !format.wide {
+		return fmt.Errorf("the cover has 16 bit samples, %s stores 8 bits, which destroys the message (write a PNG, or use -no-strict to write it anyway)", format.name)
+	}
+	if opaque(cover) {
+		return nil
+	}
+	// PNG stores non-premultiplied samples as they are, and so does a BMP,
+	// without the alpha. TIFF stores either.
+	switch cover.(type) {
+	case *image.RGBA, *image.RGBA64:
+		if format.name == "tiff" {
+			return nil
+		}
+	case *image.NRGBA64:
+		if format.wide {
+			return nil
+		}
+	case *image.NRGBA:
+		switch format.name {
+		case "png":
+			return nil
+		case "bmp":
+			opt.warnf("the cover has transparent pixels, %s is written without them, write a PNG to keep them.", file)
+			return nil
+		}
+	}
+	return fmt.Errorf("the cover has transparent pixels, %s stores them in a way that destroys the message (use -no-strict to write it anyway)", format.name)
+}
+
+// wide reports whether img has 16 bit samples, which the encoder keeps.
+func wide(img image.Image) bool {
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+// wideFile reports whether the image in file has 16 bit samples. It is false
+// for URLs and anything that can not be read.
+func wideFile(file string) bool {
+	if isURL(file) {
+		return false
+	}
+	fp, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+
+	cfg, _, err := image.DecodeConfig(fp)
+	return err == nil && (cfg.ColorModel == color.RGBA64Model || cfg.ColorModel == color.NRGBA64Model || cfg.ColorModel == color.Gray16Model)
+}
+
+// isPNGFile reports whether file is a PNG, by its signature or, for a URL
+// or anything that can not be read, its extension. PNG covers are written
+// as PNG.
+func isPNGFile(file string) bool {
+	ext := filepath.Ext(file)
+	if isURL(file) {
+		if u, err := url.Parse(file); err == nil {
+			ext = path.Ext(u.Path)
+		}
+	} else if fp, err := os.Open(file); err == nil {
+		defer fp.Close()
+		magic := make([]byte, 8)
+		if _, err := io.ReadFull(fp, magic); err == nil {
+			return string(magic) == "\x89PNG\r\n\x1a\n"
+		}
+	}
+	return strings.EqualFold(ext, ".png")
+}
+
+// opaque reports whether every pixel of img is fully opaque.
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xFFFF {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// transparent returns m with its first pixel made transparent.
+func transparent(m interface {
+	image.Image
+	Set(x, y int, c color.Color)
+}) image.Image {
+	m.Set(0, 0, color.Transparent)
+	return m
+}
+
+func TestCheckOutput(t *testing.T) {
+	var (
+		rect   = image.Rect(0, 0, 64, 64)
+		opaque = testCover(64, 64, 1)
+		wide   = image.NewRGBA64(rect)
+		nrgba  = transparent(image.NewNRGBA(rect))
+		rgba   = transparent(image.NewRGBA(rect))
+		nrgba6 = transparent(image.NewNRGBA64(rect))
+		gray16 = image.NewGray16(rect)
+		alpha  = hidden.ChannelDepth{1, 1, 1, 1}
+	)
+	for i := 6; i < len(wide.Pix); i += 8 {
+		wide.Pix[i], wide.Pix[i+1] = 0xff, 0xff
+	}
+
+	for _, c := range []struct {
+		name     string
+		file     string
+		cover    image.Image
+		opt      encodeOptions
+		noStrict bool
+		err      string
+		warns    bool
+	}{
+		{"bmp", "out.bmp", opaque, encodeOptions{}, false, "", false},
+		{"png", "out.png", opaque, encodeOptions{}, false, "", false},
+		{"tiff", "out.tif", opaque, encodeOptions{}, false, "", false},
+		{"unknown extension", "out.dat", opaque, encodeOptions{}, false, "", false},
+		{"jpeg", "out.jpg", opaque, encodeOptions{}, false, "jpeg output is lossy", false},
+		{"jpeg upper case", "OUT.JPEG", opaque, encodeOptions{}, false, "jpeg output is lossy", false},
+		{"gif", "out.gif", opaque, encodeOptions{}, false, "re-quantizes the pixels", false},
+		{"jpeg without strict", "out.jpg", opaque, encodeOptions{}, true, "", false},
+		{"gif without strict", "out.gif", nrgba, encodeOptions{}, true, "", false},
+
+		{"dct jpeg", "out.jpg", opaque, encodeOptions{jpegQuality: 75}, false, "", false},
+		{"dct png", "out.png", opaque, encodeOptions{jpegQuality: 75}, false, "is not named like one", false},
+		{"dct png without strict", "out.png", opaque, encodeOptions{jpegQuality: 75}, true, "", false},
+		{"dct quality 100", "out.jpg", opaque, encodeOptions{jpegQuality: 100}, false, "use a lower quality", false},
+
+		{"alpha png", "out.png", nrgba, encodeOptions{depth: alpha}, false, "", false},
+		{"alpha bmp", "out.bmp", opaque, encodeOptions{depth: alpha}, false, "alpha channel, which bmp does not keep", false},
+		{"alpha tiff", "out.tiff", opaque, encodeOptions{depth: alpha}, false, "alpha channel, which tiff does not keep", false},
+
+		{"16 bit png", "out.png", wide, encodeOptions{}, false, "", false},
+		{"16 bit tiff", "out.tiff", wide, encodeOptions{}, false, "", false},
+		{"16 bit bmp", "out.bmp", wide, encodeOptions{}, false, "16 bit samples, bmp stores 8 bits", false},
+		{"16 bit bmp without strict", "out.bmp", wide, encodeOptions{}, true, "", false},
+		{"16 bit gray png", "out.png", gray16, encodeOptions{}, false, "", false},
+		{"16 bit gray bmp", "out.bmp", gray16, encodeOptions{}, false, "16 bit samples, bmp stores 8 bits", false},
+
+		{"straight alpha png", "out.png", nrgba, encodeOptions{}, false, "", false},
+		{"straight alpha bmp", "out.bmp", nrgba, encodeOptions{}, false, "", true},
+		{"straight alpha tiff", "out.tiff", nrgba, encodeOptions{}, false, "transparent pixels, tiff stores them", false},
+		{"premultiplied tiff", "out.tiff", rgba, encodeOptions{}, false, "", false},
+		{"premultiplied png", "out.png", rgba, encodeOptions{}, false, "transparent pixels, png stores them", false},
+		{"premultiplied bmp", "out.bmp", rgba, encodeOptions{}, false, "transparent pixels, bmp stores them", false},
+		{"16 bit straight alpha png", "out.png", nrgba6, encodeOptions{}, false, "", false},
+		{"16 bit straight alpha tiff", "out.tiff", nrgba6, encodeOptions{}, false, "", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			defer func(v bool) { noStrict = v }(noStrict)
+			noStrict = c.noStrict
+
+			var warnings []string
+			c.opt.warnings = &warnings
+			err := checkOutput(c.file, c.cover, c.opt)
+			switch {
+			case c.err == "" && err != nil:
+				t.Errorf("got %v, want it accepted", err)
+			case c.err != "" && err == nil:
+				t.Errorf("accepted, want an error containing %q", c.err)
+			case c.err != "" && !strings.Contains(err.Error(), c.err):
+				t.Errorf("got %v, want an error containing %q", err, c.err)
+			}
+			if c.warns != (len(warnings) > 0) {
+				t.Errorf("got warnings %q", warnings)
+			}
+		})
+	}
+}
+
+// TestImageFormatsHazard writes an encoded image in every format and checks
+// the hazard each declares: the message survives exactly the formats that
+// have none.
+func TestImageFormatsHazard(t *testing.T) {
+	msg := testMessage(500, 1)
+	stego, err := hidden.Encode(testCover(64, 64, 1), msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range imageFormats {
+		file := writeTestImage(t, "stego"+f.extensions[0], stego)
+		if got := formatFor(file); got != f {
+			t.Errorf("%s: file %s is written as %s", f.name, file, got.name)
+		}
+		img, err := loadImage(file)
+		if err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		got, err := hidden.Decode(img, nil)
+		survived := err == nil && bytes.Equal(got, msg)
+		if survived != (f.hazard == "") {
+			t.Errorf("%s declares hazard %q, but the message survived: %v, %v", f.name, f.hazard, survived, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// tiffPage is the page of a TIFF to encode into or decode from, counting
+// from 1, or 0 for all of them.
+var tiffPage int
+
+// pageFlag defines the -page flag in fs.
+func pageFlag(fs *flag.FlagSet) {
+	fs.IntVar(&tiffPage, "page", 0, "Page of a TIFF, 0 for all pages.")
+}
+
+// libraryPage returns tiffPage as the page argument of the TIFF functions.
+func libraryPage() int {
+	if tiffPage == 0 {
+		return hidden.SpanPages
+	}
+	return tiffPage - 1
+}
+
+// convertTIFF reports whether a TIFF cover is written to fout as a BMP or
+// PNG, with the message in a single page, instead of as a TIFF.
+func convertTIFF(fout string) bool {
+	switch strings.ToLower(filepath.Ext(fout)) {
+	case ".bmp", ".png":
+		return true
+	}
+	return false
+}
+
+// tiffCover decodes the page of the TIFF data that -page names, to be
+// written as another format. A TIFF of one page needs no -page.
+func tiffCover(data []byte) (image.Image, error) {
+	page := libraryPage()
+	if page == hidden.SpanPages {
+		n, err := hidden.TIFFPages(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if n > 1 {
+			return nil, fmt.Errorf("the TIFF has %d pages, choose the one to write as a single image with -page", n)
+		}
+		page = 0
+	}
+	return hidden.TIFFPage(bytes.NewReader(data), page)
+}
+
+// tiffImage returns img as an image a TIFF stores exactly and decodes to
+// again, see hidden.TIFFPage: 16 bit samples stay 16 bit and transparent
+// pixels keep their colors.
+func tiffImage(img image.Image) image.Image {
+	var m draw.Image
+	switch img.(type) {
+	case *image.RGBA, *image.RGBA64, *image.NRGBA64:
+		return img
+	case *image.Gray16:
+		m = image.NewRGBA64(img.Bounds())
+	default:
+		if opaque(img) {
+			return toRGBA(img)
+		}
+		m = image.NewNRGBA64(img.Bounds())
+	}
+	draw.Draw(m, m.Bounds(), img, img.Bounds().Min, draw.Src)
+	return m
+}
+
+// isTIFF reports whether data starts with a TIFF byte order mark. Messages
+// in TIFFs are stored in one page, or across all of them.
+func isTIFF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*"))
+}
+
+// isTIFFFile reports whether file is a local TIFF.
+func isTIFFFile(file string) bool {
+	if isURL(file) {
+		return false
+	}
+	fp, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+
+	magic := make([]byte, 4)
+	_, err = fp.Read(magic)
+	return err == nil && isTIFF(magic)
+}
+
+// encodeTIFF writes the TIFF in data, read from fin, to fout with msg hidden
+// in -page.
+func encodeTIFF(fin string, data []byte, fout string, msg []byte, opt encodeOptions, lib *hidden.Options) error {
+	switch ext := strings.ToLower(filepath.Ext(fout)); {
+	case opt.maxChanges > 0:
+		return errors.New("-max-changes only applies to a single image, not to TIFF pages")
+	case opt.debugMap != "":
+		return errors.New("-debug-map only applies to a single image, not to TIFF pages")
+	case opt.maxUpscale > 0:
+		return errors.New("-resize-to-fit can not scale a TIFF")
+	case ext != ".tif" && ext != ".tiff" && !noStrict:
+		return fmt.Errorf("a TIFF cover is written as a TIFF, or converted to a BMP or PNG, but %s is named like neither (use -no-strict to write a TIFF anyway)", fout)
+	}
+
+	if !opt.overwrite {
+		if size, _, err := hidden.DetectTIFF(bytes.NewReader(data), libraryPage()); err == nil {
+			return fmt.Errorf("%s already contains a hidden message of %d bytes, use -overwrite-message to replace it", fin, size)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := hidden.EncodeTIFF(&buf, bytes.NewReader(data), libraryPage(), msg, lib)
+	if err == hidden.ErrMessageTooLarge {
+		capacity, _ := hidden.CapacityTIFF(bytes.NewReader(data), libraryPage(), lib)
+		err = fmt.Errorf("%w, the TIFF holds %d bytes", hidden.ErrMessageTooLarge, capacity)
+	}
+	if err != nil || opt.dryRun {
+		return err
+	}
+
+	if err := writeFileAtomic(fout, buf.Bytes(), 0666); err != nil {
+		return err
+	}
+	if opt.verify {
+		if err := verifyImage(fout, msg, lib); err != nil {
+			os.Remove(fout)
+			return fmt.Errorf("verification failed, removed %s: %v", fout, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+func transplantCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("transplant", flag.ExitOnError)
+	out := fs.String("out", "", "File to write the new cover with the message to, its extension picks the format.")
+	overwrite := fs.Bool("overwrite-message", false, "Transplant even if the new cover already contains a message.")
+	strictFlag(fs)
+	bmpDepthFlag(fs)
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() != 2 || *out == "" {
+			commandUsage(fs, "transplant [flags] -out <new-stego> <old-stego> <new-cover>")
+		}
+		if err := transplant(fs.Arg(0), fs.Arg(1), *out, *overwrite); err != nil {
+			fatal(err)
+		}
+		fmt.Println("Done!")
+	}
+}
+
+// transplant moves the message in the image from to the cover, writing the
+// result to fout. The container is copied as it is stored, so an encrypted
+// message is never decrypted and needs no passphrase.
+func transplant(from, cover, fout string, overwrite bool) error {
+	old, err := loadImage(from)
+	if err != nil {
+		return err
+	}
+	c, err := hidden.ExtractContainer(old)
+	if err != nil {
+		return fmt.Errorf("%s: %v", from, err)
+	}
+
+	img, extra, err := loadCover(cover)
+	if err != nil {
+		return err
+	}
+	if !overwrite {
+		if size, _, err := hidden.Detect(img); err == nil {
+			return fmt.Errorf("%s already contains a hidden message of %d bytes, use -overwrite-message to replace it", cover, size)
+		}
+	}
+	if err := checkOutput(fout, img, encodeOptions{}); err != nil {
+		return err
+	}
+
+	stego, err := hidden.EncodeContainer(img, c)
+	if err == hidden.ErrMessageTooLarge {
+		b := img.Bounds()
+		return fmt.Errorf("%w, the stored message is %d bytes and %s holds %d including the header", err, c.Header.Length, cover, b.Dx()*b.Dy()*3/8)
+	} else if err != nil {
+		return err
+	}
+	if err := saveImage(fout, stego, extra); err != nil {
+		return err
+	}
+
+	// The stored payload is compared by its hash, the plaintext is never
+	// needed.
+	if err := verifyContainer(fout, c); err != nil {
+		os.Remove(fout)
+		return fmt.Errorf("verification failed, removed %s: %v", fout, err)
+	}
+	return nil
+}
+
+// verifyContainer extracts the container from the image in file and
+// compares it with c.
+func verifyContainer(file string, c *hidden.Container) error {
+	img, err := loadImage(file)
+	if err != nil {
+		return err
+	}
+	got, err := hidden.ExtractContainer(img)
+	if err != nil {
+		return err
+	}
+
+	want, err := c.Header.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	header, err := got.Header.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(header, want) || sha256.Sum256(got.Payload) != sha256.Sum256(c.Payload) {
+		return fmt.Errorf("extracted a container that differs from the one in the old image")
+	}
+	return nil
+}
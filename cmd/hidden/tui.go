@@ -0,0 +1,502 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// errQuit is returned by the prompts when input ends.
+var errQuit = errors.New("quit")
+
+// tui walks the user through encoding and decoding with prompts on the
+// terminal. Everything it does maps to a classic -encode/-decode invocation,
+// which is printed when an operation completes.
+type tui struct {
+	in  *bufio.Scanner
+	out io.Writer
+	dir string
+}
+
+func tuiCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("tui", flag.ExitOnError)
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() != 0 {
+			commandUsage(fs, "tui")
+		}
+
+		dir, err := os.Getwd()
+		if err != nil {
+			fatal(err)
+		}
+
+		t := &tui{in: bufio.NewScanner(os.Stdin), out: os.Stdout, dir: dir}
+		t.run()
+	}
+}
+
+func (t *tui) run() {
+	fmt.Fprintln(t.out, "Hidden Message")
+	for {
+		fmt.Fprintln(t.out)
+		choice, err := t.menu("What do you want to do?", "Encode a message", "Decode a message", "Quit")
+		switch {
+		case err == nil && choice == 0:
+			err = t.encode()
+		case err == nil && choice == 1:
+			err = t.decode()
+		case err == nil:
+			return
+		}
+
+		if err == errQuit {
+			fmt.Fprintln(t.out)
+			return
+		} else if err != nil {
+			fmt.Fprintln(t.out, "Error:", err)
+		}
+	}
+}
+
+func (t *tui) encode() error {
+	cover, err := t.browse("Pick a cover image", isImageFile)
+	if err != nil {
+		return err
+	}
+
+	img, extra, err := loadCover(cover)
+	if err != nil {
+		return err
+	}
+	b := img.Bounds()
+	capacity := hidden.Capacity(img, nil)
+	fmt.Fprintf(t.out, "%dx%d image, room for %d bytes\n", b.Dx(), b.Dy(), capacity)
+
+	msg, cmd, err := t.message(cover)
+	if err != nil {
+		return err
+	}
+	opt := encodeOptions{}
+
+	encrypt, err := t.confirm("Encrypt it with a passphrase?", false)
+	if err != nil {
+		return err
+	}
+	if encrypt {
+		if opt.passphrase, err = readPassphrase(nil, true); err != nil {
+			return err
+		}
+		cmd = append(cmd, "-encrypt")
+	}
+
+	var lib *hidden.Options
+	for {
+		depth, err := t.depth()
+		if err != nil {
+			return err
+		}
+		if opt.depth = depth; opt.depth[3] > 0 {
+			img = straightAlpha(img)
+		}
+		if lib, err = opt.library(); err != nil {
+			return err
+		}
+		capacity = hidden.Capacity(img, lib)
+
+		fmt.Fprintf(t.out, "%s %d of %d bytes\n", bar(float64(len(msg))/float64(capacity)), len(msg), capacity)
+		if len(msg) <= capacity {
+			if depth != (hidden.ChannelDepth{}) {
+				cmd = append(cmd, "-depth", depth.String())
+			}
+			break
+		}
+		fmt.Fprintf(t.out, "The message is %d bytes too large for this image, it %s.\n", len(msg)-capacity, carrierHint(len(msg), lib))
+		if retry, err := t.confirm("Store more bits in every pixel?", true); err != nil || !retry {
+			if err == nil {
+				err = errors.New("the message does not fit in the image")
+			}
+			return err
+		}
+	}
+
+	if size, _, err := hidden.Detect(img); err == nil {
+		fmt.Fprintf(t.out, "The image already contains a hidden message of %d bytes.\n", size)
+		if opt.overwrite, err = t.confirm("Replace it?", false); err != nil || !opt.overwrite {
+			return err
+		}
+		cmd = append(cmd, "-overwrite-message")
+	}
+
+	if opt.verify, err = t.confirm("Verify the result?", true); err != nil {
+		return err
+	}
+	if opt.verify {
+		cmd = append(cmd, "-verify")
+	}
+
+	name := "encoded.bmp"
+	if isPNGFile(cover) {
+		name = "encoded.png"
+	}
+	dest := filepath.Join(filepath.Dir(cover), name)
+	if _, err := os.Stat(dest); err == nil {
+		if ok, err := t.confirm(dest+" exists, overwrite it?", false); err != nil || !ok {
+			return err
+		}
+		cmd = append(cmd, "-force")
+	}
+
+	steps := []string{"encoding", "saving", "verifying"}
+	if !opt.verify {
+		steps = steps[:2]
+	}
+
+	if err := checkOutput(dest, img, opt); err != nil {
+		return err
+	}
+
+	t.progress(0, steps)
+	stego, err := hidden.Encode(img, msg, lib)
+	if err != nil {
+		return err
+	}
+	t.progress(1, steps)
+	if err := saveImage(dest, stego, extra); err != nil {
+		return err
+	}
+	if opt.verify {
+		t.progress(2, steps)
+		if err := verifyImage(dest, msg, lib); err != nil {
+			os.Remove(dest)
+			return fmt.Errorf("verification failed, removed %s: %v", dest, err)
+		}
+	}
+	t.progress(len(steps), steps)
+
+	fmt.Fprintln(t.out, "Wrote", dest)
+	t.equivalent(cmd)
+	return nil
+}
+
+// message asks for the file to hide, or for a message typed in, and returns
+// it with the start of the equivalent command.
+func (t *tui) message(cover string) ([]byte, []string, error) {
+	choice, err := t.menu("What do you want to hide?", "A file", "A message I type")
+	if err != nil {
+		return nil, nil, err
+	}
+	if choice == 1 {
+		fmt.Fprintln(t.out, "Type the message, and end it with a line holding only a dot.")
+		var lines []string
+		for {
+			if !t.in.Scan() {
+				return nil, nil, errQuit
+			}
+			if line := t.in.Text(); line != "." {
+				lines = append(lines, line)
+				continue
+			}
+			text := strings.Join(lines, "\n")
+			if text == "" {
+				return nil, nil, errors.New("the message is empty")
+			}
+			return []byte(text), []string{"hidden", "-encode", cover, "-text", text}, nil
+		}
+	}
+
+	payload, err := t.browse("Pick the file to hide", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := ioutil.ReadFile(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, []string{"hidden", "-encode", cover, "-msg", payload}, nil
+}
+
+// depth asks for the low bits of every channel that carry the message, the
+// default of one bit in each color being the least visible.
+func (t *tui) depth() (hidden.ChannelDepth, error) {
+	for {
+		answer, err := t.prompt("Bits per color that carry the message, 1 to 4 or like r:1,g:1,b:3", "1")
+		if err != nil {
+			return hidden.ChannelDepth{}, err
+		}
+		d, err := hidden.ParseChannelDepth(answer)
+		if err != nil {
+			fmt.Fprintln(t.out, "Error:", err)
+			continue
+		}
+		if d == (hidden.ChannelDepth{1, 1, 1}) {
+			d = hidden.ChannelDepth{}
+		}
+		return d, nil
+	}
+}
+
+func (t *tui) decode() error {
+	file, err := t.browse("Pick the image to decode", isImageFile)
+	if err != nil {
+		return err
+	}
+	img, err := loadImage(file)
+	if err != nil {
+		return err
+	}
+
+	auto, err := t.confirm("Try every supported layout?", false)
+	if err != nil {
+		return err
+	}
+
+	cmd := []string{"hidden", "-decode", file}
+
+	var (
+		msg    []byte
+		layout string
+	)
+	err = withPassphrase(&hidden.Options{}, func(opt *hidden.Options) (err error) {
+		if auto {
+			msg, layout, err = hidden.DecodeAuto(img, opt)
+		} else {
+			msg, err = hidden.Decode(img, opt)
+		}
+		return err
+	})
+	if auto {
+		if err == nil {
+			fmt.Fprintln(t.out, "Found message with", layout)
+		}
+		cmd = append(cmd, "-auto")
+	}
+
+	if e, ok := err.(*hidden.ChecksumError); ok {
+		fmt.Fprintln(t.out, e.Error()+"\n"+damageReport(e))
+		if ok, err := t.confirm("Write the damaged message anyway?", false); err != nil || !ok {
+			return err
+		}
+		msg, err = e.Payload, nil
+		cmd = append(cmd, "-ignore-checksum")
+	}
+	if err != nil {
+		return err
+	}
+
+	var stored hidden.FileInfo
+	if h, err := hidden.DecodeHeader(img); err == nil {
+		stored, _ = h.File()
+	}
+	def := defaultOutput(file, msg, stored, false)
+	dest, err := t.prompt("Write the message to", def)
+	if err != nil {
+		return err
+	}
+	if dest != def {
+		cmd = append(cmd, "-msg", dest)
+	}
+	if _, err := os.Stat(dest); err == nil {
+		if ok, err := t.confirm(dest+" exists, overwrite it?", false); err != nil || !ok {
+			return err
+		}
+		cmd = append(cmd, "-force")
+	}
+
+	if err := writeMessage(dest, msg); err != nil {
+		return err
+	}
+	if err := restoreModTime(dest, stored); err != nil {
+		return err
+	}
+	fmt.Fprintf(t.out, "Wrote %d bytes to %s\n", len(msg), dest)
+	t.equivalent(cmd)
+	return nil
+}
+
+// prompt reads a line, returning def if it is empty.
+func (t *tui) prompt(label, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(t.out, "%s [%s]: ", label, def)
+	} else {
+		fmt.Fprintf(t.out, "%s: ", label)
+	}
+
+	if !t.in.Scan() {
+		return "", errQuit
+	}
+	if line := strings.TrimSpace(t.in.Text()); line != "" {
+		return line, nil
+	}
+	return def, nil
+}
+
+func (t *tui) confirm(label string, def bool) (bool, error) {
+	yn := "y/N"
+	if def {
+		yn = "Y/n"
+	}
+
+	for {
+		answer, err := t.prompt(label+" ("+yn+")", "")
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+}
+
+// menu lists the options and returns the index of the one picked.
+func (t *tui) menu(title string, options ...string) (int, error) {
+	fmt.Fprintln(t.out, title)
+	for i, o := range options {
+		fmt.Fprintf(t.out, "  %d) %s\n", i+1, o)
+	}
+
+	for {
+		answer, err := t.prompt("Choice", "")
+		if err != nil {
+			return 0, err
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(options) {
+			return n - 1, nil
+		}
+	}
+}
+
+// browse lets the user navigate from the current directory and pick a file
+// accepted by filter, or any file if filter is nil. A path can also be typed
+// directly.
+func (t *tui) browse(title string, filter func(string) bool) (string, error) {
+	for {
+		infos, err := ioutil.ReadDir(t.dir)
+		if err != nil {
+			return "", err
+		}
+
+		var dirs, files []string
+		for _, fi := range infos {
+			if strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			if fi.IsDir() {
+				dirs = append(dirs, fi.Name()+string(filepath.Separator))
+			} else if filter == nil || filter(fi.Name()) {
+				files = append(files, fi.Name())
+			}
+		}
+		sort.Strings(dirs)
+		sort.Strings(files)
+		entries := append(append([]string{".." + string(filepath.Separator)}, dirs...), files...)
+
+		fmt.Fprintf(t.out, "\n%s in %s\n", title, t.dir)
+		for i, e := range entries {
+			fmt.Fprintf(t.out, "  %3d) %s\n", i+1, e)
+		}
+
+		answer, err := t.prompt("Number or path", "")
+		if err != nil {
+			return "", err
+		}
+
+		file := answer
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(entries) {
+			file = entries[n-1]
+		} else if answer == "" {
+			continue
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(t.dir, file)
+		}
+
+		fi, err := os.Stat(file)
+		switch {
+		case err != nil:
+			fmt.Fprintln(t.out, "Error:", err)
+		case fi.IsDir():
+			t.dir = filepath.Clean(file)
+		default:
+			return t.relative(file), nil
+		}
+	}
+}
+
+// relative shortens file to a path relative to the working directory, if it
+// is below it, to keep the equivalent command readable.
+func (t *tui) relative(file string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return file
+	}
+	if rel, err := filepath.Rel(wd, file); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return file
+}
+
+// progress draws a bar for the steps completed so far.
+func (t *tui) progress(done int, steps []string) {
+	label := "done"
+	if done < len(steps) {
+		label = steps[done] + "..."
+	}
+	fmt.Fprintf(t.out, "\r%s %-12s", bar(float64(done)/float64(len(steps))), label)
+	if done == len(steps) {
+		fmt.Fprintln(t.out)
+	}
+}
+
+// equivalent prints the command line that does the same as the TUI did.
+func (t *tui) equivalent(cmd []string) {
+	for i, arg := range cmd {
+		if strings.ContainsAny(arg, " \t\n'\"\\$`*?&;|<>()") {
+			cmd[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+	}
+	fmt.Fprintln(t.out, "Same as:", strings.Join(cmd, " "))
+}
+
+// bar renders frac, clamped to [0, 1], as a 30 column bar.
+func bar(frac float64) string {
+	const width = 30
+	n := int(frac*width + 0.5)
+	if n > width {
+		n = width
+	} else if n < 0 {
+		n = 0
+	}
+	return "[" + strings.Repeat("#", n) + strings.Repeat("-", width-n) + "]"
+}
@@ -0,0 +1,213 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+func verifyCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	passphrase := definePassphraseFlags(fs)
+	asJSON := jsonFlag(fs, "Output in JSON format.")
+	quick := quickFlag(fs, "checked")
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() != 1 && fs.NArg() != 2 {
+			commandUsage(fs, "verify <stego> [<payload>]")
+		}
+		if *quick && fs.NArg() == 2 {
+			fatal(usagef("-quick only reads the header, it can not compare the message with <payload>"))
+		}
+
+		opt, err := decodeOptionsFrom(passphrase)
+		if err != nil {
+			fatal(err)
+		}
+
+		if h, ok, err := quickHeader(fs.Arg(0), *quick); ok {
+			if err != nil {
+				fatal("verification failed:", err)
+			}
+			if *asJSON {
+				printJSON(&verifyResult{Status: "ok", Size: h.Length, Format: h.Format(), HeaderOnly: true})
+			} else {
+				fmt.Printf("OK, %d bytes, %s, only the header was checked\n", h.Length, h.Format())
+			}
+			return
+		}
+
+		if fs.NArg() == 1 {
+			size, format, unopened, err := checkFile(fs.Arg(0), opt)
+			if err != nil {
+				fatal("verification failed:", err)
+			}
+			if *asJSON {
+				res := verifyResult{Status: "ok", Size: size, Format: format}
+				if unopened != nil {
+					res.Unopened = unopened.Error()
+				}
+				printJSON(&res)
+			} else if unopened != nil {
+				fmt.Printf("OK, %d bytes, %s, not opened: %v\n", size, format, unopened)
+			} else {
+				fmt.Printf("OK, %d bytes, %s\n", size, format)
+			}
+			return
+		}
+
+		msg, err := ioutil.ReadFile(fs.Arg(1))
+		if err != nil {
+			fatal(err)
+		}
+
+		err = withPassphrase(opt, func(opt *hidden.Options) error {
+			return verifyImage(fs.Arg(0), msg, opt)
+		})
+		if err != nil {
+			fatal("verification failed:", err)
+		}
+		if *asJSON {
+			printJSON(&verifyResult{Status: "ok", Size: len(msg)})
+			return
+		}
+		fmt.Println("OK")
+	}
+}
+
+// verifyResult is what verify prints with -json. Unopened is why the
+// message could not be decrypted, if it was not. HeaderOnly is set for
+// -quick, which does not validate the checksum.
+type verifyResult struct {
+	Status     string `json:"status"`
+	Size       int    `json:"size"`
+	Format     string `json:"format,omitempty"`
+	Unopened   string `json:"unopened,omitempty"`
+	HeaderOnly bool   `json:"header_only,omitempty"`
+}
+
+// verifyFlags defines -verify, which is on, and -no-verify in fs, and returns
+// a function that reports after parsing whether what was encoded should be
+// decoded and compared with the message. -no-strict turns the check off unless
+// -verify is given, as it asks for images that may not keep the message.
+func verifyFlags(fs *flag.FlagSet, what string) func() bool {
+	verify := fs.Bool("verify", true, "Check that "+what+" decodes to the message.")
+	noVerify := fs.Bool("no-verify", false, "Do not check "+what+".")
+	return func() bool {
+		if *noVerify || !*verify {
+			return false
+		}
+		if noStrict {
+			explicit := false
+			fs.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "verify" })
+			return explicit
+		}
+		return true
+	}
+}
+
+// verifyImage extracts the message from the image in file and compares it
+// byte for byte with msg. A message encrypted to recipients can only be
+// checked up to its checksum, as the private keys to open it are not at hand.
+func verifyImage(file string, msg []byte, opt *hidden.Options) error {
+	got, err := extractFile(file, opt)
+	if errors.Is(err, hidden.ErrIdentityRequired) && opt != nil && len(opt.Recipients) > 0 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, msg) {
+		return fmt.Errorf("extracted %d bytes that differ from the %d byte message", len(got), len(msg))
+	}
+	return nil
+}
+
+// extractFile extracts the message from the image or stream in file.
+func extractFile(file string, opt *hidden.Options) ([]byte, error) {
+	if isY4M(file) {
+		return decodeY4M(file, opt)
+	}
+	data, err := readImageFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return decodeData(data, opt)
+}
+
+// checkFile checks that the image or stream in file holds a message whose
+// checksum matches, without writing it anywhere, and returns its size as
+// stored and its format. If the message could not be opened after its
+// checksum matched, without the passphrase or pad opt needs or because it
+// expired, unopened says why.
+func checkFile(file string, opt *hidden.Options) (size int, format string, unopened, err error) {
+	if isY4M(file) {
+		msg, unopened := decodeY4M(file, opt)
+		if !verified(unopened, false) {
+			return 0, "", nil, unopened
+		}
+		hidden.Wipe(msg)
+
+		f, err := os.Open(file)
+		if err != nil {
+			return 0, "", nil, err
+		}
+		defer f.Close()
+		size, format, err = hidden.DetectY4M(f)
+		return size, format, unopened, err
+	}
+
+	data, err := readImageFile(file)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	h, err := headerData(data)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	v, ok := h.Field(hidden.FieldPlacement)
+	keyed := ok && len(v) > 0 && v[0] == hidden.Keyed{}.ID()
+
+	msg, unopened := decodeData(data, opt)
+	if !verified(unopened, keyed) {
+		return 0, "", nil, unopened
+	}
+	hidden.Wipe(msg)
+	size, format, err = detectData(data)
+	return size, format, unopened, err
+}
+
+// verified reports whether decoding a message failed with err only after
+// its checksum was found to match: because it expired, or because the
+// passphrase, pad or private key it needs was not given. A keyed placement needs the
+// passphrase to find the message at all.
+func verified(err error, keyed bool) bool {
+	var expired *hidden.ExpiredError
+	switch {
+	case err == nil, err == hidden.ErrPadRequired, err == hidden.ErrIdentityRequired, err == hidden.ErrNoIdentity, errors.As(err, &expired):
+		return true
+	case err == hidden.ErrPassphraseRequired:
+		return !keyed
+	}
+	return false
+}
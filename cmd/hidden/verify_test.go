@@ -0,0 +1,99 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+func TestVerifyImage(t *testing.T) {
+	msg := testMessage(2000, 1)
+	stego, err := hidden.Encode(testCover(200, 100, 1), msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := writeTestImage(t, "encoded.bmp", stego)
+	if err := verifyImage(file, msg, nil); err != nil {
+		t.Fatalf("verifying the encoded image: %v", err)
+	}
+
+	other := append([]byte(nil), msg...)
+	other[len(other)-1] ^= 1
+	if err := verifyImage(file, other, nil); err == nil {
+		t.Error("verified an image against a different message")
+	}
+}
+
+// TestVerifyTruncatedImage simulates a write of the encoded image that was
+// cut short, which verification has to catch.
+func TestVerifyTruncatedImage(t *testing.T) {
+	msg := testMessage(2000, 2)
+	stego, err := hidden.Encode(testCover(200, 100, 2), msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := writeTestImage(t, "encoded.bmp", stego)
+	st, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int64{0, 54, st.Size() / 2, st.Size() - 1} {
+		if err := os.Truncate(file, size); err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyImage(file, msg, nil); err == nil {
+			t.Errorf("verified the image truncated to %d of %d bytes", size, st.Size())
+		}
+	}
+}
+
+// TestQuickHeader checks that -quick finds the same message in a BMP as
+// reading it in full does, and that other files are still read in full.
+func TestQuickHeader(t *testing.T) {
+	msg := testMessage(2000, 3)
+	stego, err := hidden.Encode(testCover(200, 100, 3), msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"encoded.bmp", "encoded.png"} {
+		file := writeTestImage(t, name, stego)
+		size, format, err := scanFile(file, false)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		h, ok, err := quickHeader(file, true)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if bmp := name == "encoded.bmp"; ok != bmp {
+			t.Fatalf("%s: quickHeader returned ok %v, expected %v", name, ok, bmp)
+		}
+		if !ok {
+			continue
+		}
+		if h.Length != size || h.Format() != format {
+			t.Errorf("%s: -quick found %d bytes, %s, expected %d bytes, %s", name, h.Length, h.Format(), size, format)
+		}
+		if _, ok, _ := quickHeader(file, false); ok {
+			t.Errorf("%s: quickHeader returned ok without -quick", name)
+		}
+	}
+}
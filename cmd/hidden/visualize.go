@@ -0,0 +1,126 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+func visualizeCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("visualize", flag.ExitOnError)
+	bit := fs.Int("bit", 0, "Bit plane to extract, 0 for the least significant bit up to 7.")
+	channels := fs.String("channels", "rgb", "Channels to extract the bit plane of, each drawn in black and white, side by side in this order.")
+	out := fs.String("out", "bitplane.png", "File to write the bit planes to.")
+	cover := fs.String("diff", "", "Cover the image was encoded from, to also write the difference between them to -diff-out.")
+	diffOut := fs.String("diff-out", "difference.png", "File to write the difference to.")
+	amplify := fs.Int("amplify", 255, "Factor the differences are multiplied with, so changes of one show.")
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		if fs.NArg() != 1 || *bit < 0 || *bit > 7 || *amplify < 1 {
+			commandUsage(fs, "visualize [flags] [-diff <cover>] <image>")
+		}
+		if _, err := hidden.ParseChannels(*channels); err != nil || *channels == "" {
+			fatal(usagef("-channels %q: expected some of r, g and b", *channels))
+		}
+		var order []int
+		for _, r := range strings.ToLower(*channels) {
+			order = append(order, strings.IndexRune("rgb", r))
+		}
+
+		m, err := loadImage(fs.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+		img := toRGBA(m)
+		if err := saveImage(*out, bitPlanes(img, uint(*bit), order), nil); err != nil {
+			fatal(err)
+		}
+		fmt.Println(*out)
+
+		if *cover == "" {
+			return
+		}
+		c, err := loadImage(*cover)
+		if err != nil {
+			fatal(err)
+		}
+		diff, err := amplifiedDiff(toRGBA(c), img, *amplify)
+		if err != nil {
+			fatal(err)
+		}
+		if err := saveImage(*diffOut, diff, nil); err != nil {
+			fatal(err)
+		}
+		fmt.Println(*diffOut)
+	}
+}
+
+// bitPlanes draws bit of the channels of img in black and white, white
+// where it is set, one image of the size of img for each channel side by
+// side. A message in the lowest bits looks like noise, where the rest of
+// the plane shows the outlines of the image.
+func bitPlanes(img *image.RGBA, bit uint, channels []int) *image.Gray {
+	b := img.Bounds()
+	planes := image.NewGray(image.Rect(0, 0, b.Dx()*len(channels), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+		for i, c := range channels {
+			dst := planes.Pix[planes.PixOffset(i*b.Dx(), y):]
+			for x := 0; x < b.Dx(); x++ {
+				if row[x*4+c]>>bit&1 != 0 {
+					dst[x] = 0xFF
+				}
+			}
+		}
+	}
+	return planes
+}
+
+// amplifiedDiff returns the difference of every color sample of a and b,
+// multiplied by gain and clipped to white.
+func amplifiedDiff(a, b *image.RGBA, gain int) (*image.RGBA, error) {
+	ba, bb := a.Bounds(), b.Bounds()
+	if ba.Dx() != bb.Dx() || ba.Dy() != bb.Dy() {
+		return nil, fmt.Errorf("image dimensions differ: %dx%d and %dx%d", ba.Dx(), ba.Dy(), bb.Dx(), bb.Dy())
+	}
+
+	diff := image.NewRGBA(image.Rect(0, 0, ba.Dx(), ba.Dy()))
+	for y := 0; y < ba.Dy(); y++ {
+		ra := a.Pix[a.PixOffset(ba.Min.X, ba.Min.Y+y):]
+		rb := b.Pix[b.PixOffset(bb.Min.X, bb.Min.Y+y):]
+		dst := diff.Pix[diff.PixOffset(0, y):]
+		for x := 0; x < ba.Dx(); x++ {
+			for c := 0; c < 3; c++ {
+				d := int(ra[x*4+c]) - int(rb[x*4+c])
+				if d < 0 {
+					d = -d
+				}
+				if d *= gain; d > 0xFF {
+					d = 0xFF
+				}
+				dst[x*4+c] = uint8(d)
+			}
+			dst[x*4+3] = 0xFF
+		}
+	}
+	return diff, nil
+}
@@ -0,0 +1,329 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/andreas-jonsson/hidden"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchTemplateData is available to -msg-template for every encoded file.
+type watchTemplateData struct {
+	Name    string
+	Path    string
+	Size    int64
+	ModTime string
+	Time    string
+}
+
+type watcher struct {
+	inDir, outDir, failedDir string
+
+	msg  []byte
+	tmpl *template.Template
+	opt  encodeOptions
+
+	settle time.Duration
+	dryRun bool
+	log    *slog.Logger
+
+	queue   chan string
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+func watchCommand() (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	fmsg := fs.String("msg", "", "Message or data to encode in every image.")
+	fs.StringVar(fmsg, "data", "", "Message or data to encode in every image, as -msg.")
+	inDir := fs.String("in", "", "Directory to watch for new images, instead of <in-dir>.")
+	outDir := fs.String("out", "", "Directory the encoded images are written to, instead of <out-dir>.")
+	msgTemplate := fs.String("msg-template", "", "Template for a per-file message, with {{.Name}}, {{.Path}}, {{.Size}}, {{.ModTime}} and {{.Time}}.")
+	failedDir := fs.String("failed-dir", "", "Directory failed inputs are moved to. (default <in-dir>/failed)")
+	settle := fs.Duration("settle", time.Second, "How long a file must stop growing before it is encoded.")
+	once := fs.Bool("once", false, "Process the existing files and exit.")
+	dryRun := fs.Bool("dry-run", false, "Log what would be done without writing anything.")
+	verify := verifyFlags(fs, "every encoded image")
+	checksum := checksumFlag(fs)
+	encryption := defineEncryptionFlags(fs)
+	logJSON := fs.Bool("log-json", false, "Log in JSON format.")
+	strictFlag(fs)
+	bmpDepthFlag(fs)
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		dirs := fs.Args()
+		if *inDir != "" && *outDir != "" {
+			dirs = append([]string{*inDir, *outDir}, dirs...)
+		} else if *inDir != "" || *outDir != "" {
+			dirs = nil
+		}
+		if len(dirs) != 2 || (*fmsg == "") == (*msgTemplate == "") {
+			commandUsage(fs, "watch (-msg <file> | -msg-template <template>) [flags] (<in-dir> <out-dir> | -in <dir> -out <dir>)")
+		}
+
+		w := &watcher{
+			inDir:     dirs[0],
+			outDir:    dirs[1],
+			failedDir: *failedDir,
+			opt:       encodeOptions{verify: verify(), integrity: checksum.Integrity},
+			settle:    *settle,
+			dryRun:    *dryRun,
+			queue:     make(chan string, 64),
+			pending:   make(map[string]bool),
+		}
+
+		if err := encryption.apply(&w.opt); err != nil {
+			fatal(err)
+		}
+
+		if w.failedDir == "" {
+			w.failedDir = filepath.Join(w.inDir, "failed")
+		}
+
+		if *logJSON {
+			w.log = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+		} else {
+			w.log = slog.New(slog.NewTextHandler(os.Stderr, nil))
+		}
+
+		var err error
+		if *fmsg != "" {
+			w.msg, err = ioutil.ReadFile(*fmsg)
+		} else {
+			w.tmpl, err = template.New("msg").Parse(*msgTemplate)
+		}
+		if err != nil {
+			fatal(err)
+		}
+
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		if err := w.run(ctx, *once); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+// run encodes the images already in the input directory and, unless once is
+// set, every image added to it until ctx is canceled.
+func (w *watcher) run(ctx context.Context, once bool) error {
+	if !w.dryRun {
+		if err := os.MkdirAll(w.outDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	var fsw *fsnotify.Watcher
+	if !once {
+		var err error
+		if fsw, err = fsnotify.NewWatcher(); err != nil {
+			return err
+		}
+		defer fsw.Close()
+
+		if err := fsw.Add(w.inDir); err != nil {
+			return err
+		}
+	}
+
+	existing, err := ioutil.ReadDir(w.inDir)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for file := range w.queue {
+			w.process(file)
+		}
+	}()
+
+	var settling sync.WaitGroup
+	for _, fi := range existing {
+		w.schedule(ctx, &settling, filepath.Join(w.inDir, fi.Name()))
+	}
+
+	if fsw != nil {
+		w.log.Info("watching", "dir", w.inDir)
+	loop:
+		for {
+			select {
+			case ev, ok := <-fsw.Events:
+				if !ok {
+					break loop
+				}
+				if ev.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+					w.schedule(ctx, &settling, ev.Name)
+				}
+			case err, ok := <-fsw.Errors:
+				if !ok {
+					break loop
+				}
+				w.log.Error("watch error", "err", err)
+			case <-ctx.Done():
+				break loop
+			}
+		}
+		w.log.Info("shutting down")
+	}
+
+	settling.Wait()
+	close(w.queue)
+	wg.Wait()
+	return nil
+}
+
+// schedule queues file for encoding once it has stopped growing. Files that
+// are already waiting are ignored.
+func (w *watcher) schedule(ctx context.Context, wg *sync.WaitGroup, file string) {
+	if !isImageFile(file) {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pending[file] {
+		return
+	}
+	w.pending[file] = true
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if w.waitStable(ctx, file) {
+			w.queue <- file
+		} else {
+			w.done(file)
+		}
+	}()
+}
+
+func (w *watcher) done(file string) {
+	w.mu.Lock()
+	delete(w.pending, file)
+	w.mu.Unlock()
+}
+
+// waitStable polls the size of file until it stays the same for the settle
+// duration. It returns false if the file disappeared or ctx was canceled.
+func (w *watcher) waitStable(ctx context.Context, file string) bool {
+	last := int64(-1)
+	for {
+		fi, err := os.Stat(file)
+		if err != nil || !fi.Mode().IsRegular() {
+			return false
+		}
+		if fi.Size() == last {
+			return true
+		}
+		last = fi.Size()
+
+		select {
+		case <-time.After(w.settle):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (w *watcher) process(file string) {
+	defer w.done(file)
+
+	out := filepath.Join(w.outDir, filepath.Base(file))
+	if _, err := os.Stat(out); err == nil {
+		w.log.Info("skipped", "file", file, "reason", "output exists")
+		return
+	}
+
+	msg, err := w.message(file)
+	if w.tmpl != nil {
+		defer hidden.Wipe(msg)
+	}
+	if err == nil && w.dryRun {
+		w.log.Info("would encode", "file", file, "out", out, "size", len(msg))
+		return
+	}
+	if err == nil {
+		err = encodeFile(file, out, msg, w.opt)
+	}
+
+	if err == nil {
+		w.log.Info("encoded", "file", file, "out", out, "size", len(msg))
+		return
+	}
+
+	if os.IsNotExist(err) {
+		w.log.Warn("file disappeared", "file", file)
+		return
+	}
+
+	w.log.Error("failed", "file", file, "err", err)
+	if !w.dryRun {
+		w.fail(file, err)
+	}
+}
+
+// fail moves file to the failed directory next to a .error file describing
+// what went wrong.
+func (w *watcher) fail(file string, reason error) {
+	dest := filepath.Join(w.failedDir, filepath.Base(file))
+	err := os.MkdirAll(w.failedDir, 0755)
+	if err == nil {
+		err = os.Rename(file, dest)
+	}
+	if err == nil {
+		err = writeFileAtomic(dest+".error", []byte(reason.Error()+"\n"), 0644)
+	}
+	if err != nil {
+		w.log.Error("could not move failed file", "file", file, "err", err)
+	}
+}
+
+func (w *watcher) message(file string) ([]byte, error) {
+	if w.tmpl == nil {
+		return w.msg, nil
+	}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = w.tmpl.Execute(&buf, watchTemplateData{
+		Name:    fi.Name(),
+		Path:    file,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UTC().Format(time.RFC3339),
+		Time:    time.Now().UTC().Format(time.RFC3339),
+	})
+	return buf.Bytes(), err
+}
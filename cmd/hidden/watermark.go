@@ -0,0 +1,410 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+type watermarkMatch struct {
+	ID     string            `json:"id"`
+	Copies int               `json:"copies"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// watermarkReport is what extracting finds in one of several images.
+type watermarkReport struct {
+	Image   string           `json:"image"`
+	Matches []watermarkMatch `json:"matches"`
+	Error   string           `json:"error,omitempty"`
+}
+
+func watermarkCommand() (*flag.FlagSet, func(args []string)) {
+	var fields fieldFlag
+	fs := flag.NewFlagSet("watermark", flag.ExitOnError)
+	id := fs.String("id", "", "Identifier to tile across the image, in hex or as a UUID.")
+	tmpl := fs.String("template", "", "Tile this text/template across the image instead of -id, like {{.Recipient}}|{{.Timestamp}}|{{.Serial}}, filled in from -field and -fields. Timestamp is the time of the run and Serial counts the images written from -serial, unless they are given. With -extract the identifiers found are parsed back into the fields.")
+	fs.Var(&fields, "field", "Set key=value for -template, can be repeated. It applies to every record of -fields that does not set the key itself.")
+	fieldsFile := fs.String("fields", "", "JSON file with the fields for -template, an object or an array of objects. Every object, like one for each recipient, watermarks its own copy of every cover.")
+	serial := fs.Int("serial", 1, "Serial of the first image -template writes.")
+	out := fs.String("out", "", "Watermarked image, watermarked.bmp or .png next to the cover by default.")
+	outDir := fs.String("out-dir", "", "Directory to write several watermarked images to, as <cover>-<serial>.bmp or .png, next to their covers by default.")
+	extract := fs.Bool("extract", false, "Report the identifiers found in the images instead.")
+	asJSON := jsonFlag(fs, "Output extracted identifiers in JSON format.")
+	strictFlag(fs)
+	bmpDepthFlag(fs)
+	return fs, func(args []string) {
+		parseFlags(fs, args)
+
+		const synopsis = "watermark -id <hex|uuid> [-out <image>] <cover>\n" +
+			"       hidden watermark -template <text> [-field key=value]... [-fields <json>] [-out <image> | -out-dir <dir>] <cover>...\n" +
+			"       hidden watermark -extract [-template <text>] [-json] <image>..."
+		switch {
+		case fs.NArg() == 0, *id != "" && *tmpl != "", *extract && *id != "", !*extract && *id == "" && *tmpl == "":
+			commandUsage(fs, synopsis)
+		case *id != "" && fs.NArg() != 1:
+			commandUsage(fs, synopsis)
+		}
+
+		if *extract {
+			var p *watermarkParser
+			if *tmpl != "" {
+				var err error
+				if p, err = newWatermarkParser(*tmpl); err != nil {
+					fatal(usagef("-template: %v", err))
+				}
+			}
+			if err := extractWatermarks(fs.Args(), p, *asJSON); err != nil {
+				fatal(err)
+			}
+			return
+		}
+
+		if *id != "" {
+			buf, err := hex.DecodeString(strings.Replace(*id, "-", "", -1))
+			if err != nil {
+				fatal(usagef("expected the identifier in hex or as a UUID: %v", err))
+			}
+			if err := watermarkFile(fs.Arg(0), *out, buf); err != nil {
+				fatal(err)
+			}
+			return
+		}
+
+		t, err := template.New("watermark").Option("missingkey=error").Parse(*tmpl)
+		if err != nil {
+			fatal(usagef("-template: %v", err))
+		}
+		records, err := watermarkRecords(*fieldsFile, fields)
+		if err != nil {
+			fatal(err)
+		}
+		if *out != "" && fs.NArg()*len(records) > 1 {
+			fatal(usagef("-out names one image, use -out-dir for %d", fs.NArg()*len(records)))
+		}
+
+		now := time.Now().UTC().Format(time.RFC3339)
+		for _, cover := range fs.Args() {
+			for _, r := range records {
+				data := map[string]string{"Timestamp": now, "Serial": strconv.Itoa(*serial)}
+				for k, v := range r {
+					data[k] = v
+				}
+				var buf bytes.Buffer
+				if err := t.Execute(&buf, data); err != nil {
+					fatal(usagef("-template: %v", err))
+				}
+
+				dest := *out
+				if dest == "" && fs.NArg()*len(records) > 1 {
+					dest = serialName(cover, *outDir, data["Serial"])
+				}
+				if err := watermarkFile(cover, dest, buf.Bytes()); err != nil {
+					fatal(fmt.Errorf("%s: %v", cover, err))
+				}
+				*serial++
+			}
+		}
+	}
+}
+
+// watermarkFile tiles id across the image in the file cover and writes it to
+// dest, or watermarked.bmp or .png next to cover if dest is empty. It prints
+// the name of the file written.
+func watermarkFile(cover, dest string, id []byte) error {
+	img, err := loadImage(cover)
+	if err != nil {
+		return err
+	}
+	if dest == "" {
+		dest = filepath.Join(filepath.Dir(cover), "watermarked.bmp")
+		if isURL(cover) {
+			dest = "watermarked.bmp"
+		}
+		if strings.EqualFold(filepath.Ext(cover), ".png") {
+			dest = strings.TrimSuffix(dest, ".bmp") + ".png"
+		}
+	}
+	if err := checkOutput(dest, img, encodeOptions{}); err != nil {
+		return err
+	}
+
+	img, err = hidden.Watermark(img, id)
+	if err != nil {
+		return err
+	}
+	if err := saveImage(dest, img, nil); err != nil {
+		return err
+	}
+	fmt.Println(dest)
+	return nil
+}
+
+// serialName returns the file the watermarked copy of cover with the serial
+// is written to, in dir or next to cover.
+func serialName(cover, dir, serial string) string {
+	ext := ".bmp"
+	if strings.EqualFold(filepath.Ext(cover), ".png") {
+		ext = ".png"
+	}
+	base := filepath.Base(cover)
+	name := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(base, filepath.Ext(base)), serial, ext)
+	if dir == "" && !isURL(cover) {
+		dir = filepath.Dir(cover)
+	}
+	return filepath.Join(dir, name)
+}
+
+// watermarkRecords returns the fields of every copy of a cover: the records
+// of the JSON file, or a single empty one without it, with fields for the
+// keys they do not set.
+func watermarkRecords(file string, fields fieldFlag) ([]map[string]string, error) {
+	var raw []map[string]interface{}
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+			err = dec.Decode(&raw)
+		} else {
+			raw = make([]map[string]interface{}, 1)
+			err = dec.Decode(&raw[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if len(raw) == 0 {
+			return nil, fmt.Errorf("%s holds no records", file)
+		}
+	} else {
+		raw = make([]map[string]interface{}, 1)
+	}
+
+	records := make([]map[string]string, len(raw))
+	for i, r := range raw {
+		records[i] = make(map[string]string)
+		for k, v := range fields {
+			records[i][k] = v
+		}
+		for k, v := range r {
+			records[i][k] = fmt.Sprint(v)
+		}
+	}
+	return records, nil
+}
+
+// fieldFlag is a flag.Value collecting key=value pairs into a map.
+type fieldFlag map[string]string
+
+func (f fieldFlag) String() string {
+	var pairs []string
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f *fieldFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i < 1 {
+		return errors.New("expected key=value")
+	}
+	if *f == nil {
+		*f = make(fieldFlag)
+	}
+	(*f)[s[:i]] = s[i+1:]
+	return nil
+}
+
+// watermarkParser splits an identifier written from a template back into
+// the fields the template filled in.
+type watermarkParser struct {
+	re     *regexp.Regexp
+	fields []string
+}
+
+// newWatermarkParser returns the parser of identifiers written from tmpl,
+// which may only hold text and plain fields, like {{.Recipient}}.
+func newWatermarkParser(tmpl string) (*watermarkParser, error) {
+	trees, err := parse.Parse("watermark", tmpl, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &watermarkParser{}
+	expr := "^"
+	for _, n := range trees["watermark"].Root.Nodes {
+		switch n := n.(type) {
+		case *parse.TextNode:
+			expr += regexp.QuoteMeta(string(n.Text))
+			continue
+		case *parse.ActionNode:
+			if len(n.Pipe.Decl) == 0 && len(n.Pipe.Cmds) == 1 && len(n.Pipe.Cmds[0].Args) == 1 {
+				if f, ok := n.Pipe.Cmds[0].Args[0].(*parse.FieldNode); ok && len(f.Ident) == 1 {
+					expr += "(.*?)"
+					p.fields = append(p.fields, f.Ident[0])
+					continue
+				}
+			}
+		}
+		return nil, fmt.Errorf("%s can not be parsed back, only text and fields like {{.Recipient}} can", n)
+	}
+	p.re = regexp.MustCompile("(?s)" + expr + "$")
+	return p, nil
+}
+
+// parse returns the fields of id, or nil if the template did not write it.
+func (p *watermarkParser) parse(id []byte) map[string]string {
+	m := p.re.FindSubmatch(id)
+	if m == nil {
+		return nil
+	}
+	fields := make(map[string]string)
+	for i, name := range p.fields {
+		if v, ok := fields[name]; ok && v != string(m[i+1]) {
+			return nil
+		}
+		fields[name] = string(m[i+1])
+	}
+	return fields
+}
+
+// extractWatermarks prints the identifiers found in every image, with the
+// number of copies of each one as a measure of confidence. With p they are
+// parsed into the fields of its template. Several images are reported one
+// per line, or object, and those without a watermark do not stop the others.
+func extractWatermarks(files []string, p *watermarkParser, asJSON bool) error {
+	if len(files) == 1 && p == nil {
+		img, err := loadImage(files[0])
+		if err != nil {
+			return err
+		}
+		return extractWatermark(img, asJSON)
+	}
+
+	var reports []watermarkReport
+	for _, file := range files {
+		r := watermarkReport{Image: file, Matches: []watermarkMatch{}}
+		img, err := loadImage(file)
+		if err == nil {
+			r.Matches, err = watermarkMatches(img, p)
+		}
+		if err != nil && len(files) == 1 {
+			return err
+		} else if err != nil {
+			r.Error = err.Error()
+		}
+		reports = append(reports, r)
+		if asJSON {
+			continue
+		}
+
+		if err != nil {
+			fmt.Printf("%s\t%v\n", file, err)
+		}
+		for _, m := range r.Matches {
+			fmt.Printf("%s\t%s\t%d copies\n", file, p.format(m), m.Copies)
+		}
+	}
+	if asJSON {
+		printJSON(reports)
+	}
+	return nil
+}
+
+// format returns the fields of m in the order of the template, or the
+// identifier if it has none.
+func (p *watermarkParser) format(m watermarkMatch) string {
+	if p == nil || m.Fields == nil {
+		return m.ID
+	}
+	var (
+		pairs []string
+		seen  = make(map[string]bool)
+	)
+	for _, name := range p.fields {
+		if !seen[name] {
+			seen[name] = true
+			pairs = append(pairs, name+"="+m.Fields[name])
+		}
+	}
+	return strings.Join(pairs, " ")
+}
+
+// watermarkMatches returns the identifiers found in img. With p they are
+// shown as text, and parsed into fields where the template matches.
+func watermarkMatches(img image.Image, p *watermarkParser) ([]watermarkMatch, error) {
+	found, err := hidden.ExtractWatermark(img)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]watermarkMatch, len(found))
+	for i, m := range found {
+		matches[i] = watermarkMatch{formatWatermarkID(m.ID), m.Copies, nil}
+		if p != nil {
+			matches[i].ID, matches[i].Fields = string(m.ID), p.parse(m.ID)
+		}
+	}
+	return matches, nil
+}
+
+// extractWatermark prints the identifiers found in img, with the number of
+// copies of each one as a measure of confidence.
+func extractWatermark(img image.Image, asJSON bool) error {
+	matches, err := watermarkMatches(img, nil)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		printJSON(matches)
+		return nil
+	}
+	for _, m := range matches {
+		fmt.Printf("%s\t%d copies\n", m.ID, m.Copies)
+	}
+	return nil
+}
+
+// formatWatermarkID formats a 16 byte identifier as a UUID and anything else
+// as hex.
+func formatWatermarkID(id []byte) string {
+	s := hex.EncodeToString(id)
+	if len(id) != 16 {
+		return s
+	}
+	return strings.Join([]string{s[:8], s[8:12], s[12:16], s[16:20], s[20:]}, "-")
+}
@@ -0,0 +1,80 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// isY4M reports whether file is a local YUV4MPEG2 stream. Those are
+// streamed a frame at a time instead of read into memory like images.
+func isY4M(file string) bool {
+	if isURL(file) {
+		return false
+	}
+	fp, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+
+	magic := make([]byte, len("YUV4MPEG2 "))
+	_, err = io.ReadFull(fp, magic)
+	return err == nil && string(magic) == "YUV4MPEG2 "
+}
+
+// encodeY4M writes the stream in fin to fout with msg hidden in its luma
+// samples.
+func encodeY4M(fin, fout string, msg []byte, opt encodeOptions, lib *hidden.Options) error {
+	in, err := os.Open(fin)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if !opt.overwrite {
+		if size, _, err := hidden.DetectY4M(in); err == nil {
+			return fmt.Errorf("%s already contains a hidden message of %d bytes, use -overwrite-message to replace it", fin, size)
+		}
+		if _, err := in.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	if opt.dryRun {
+		return hidden.EncodeY4M(ioutil.Discard, in, msg, lib)
+	}
+
+	// The stream is only known to be long enough once it is written.
+	return writeAtomic(fout, 0666, func(w io.Writer) error {
+		return hidden.EncodeY4M(w, in, msg, lib)
+	})
+}
+
+// decodeY4M extracts the message from the stream in file.
+func decodeY4M(file string, opt *hidden.Options) ([]byte, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return hidden.DecodeY4M(fp, opt)
+}
@@ -0,0 +1,269 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/andreas-jonsson/hidden"
+)
+
+// zipEncrypted is the general purpose flag bit of an encrypted zip entry.
+const zipEncrypted = 0x1
+
+// isZipFile reports whether file names a local zip archive.
+func isZipFile(file string) bool {
+	return !isURL(file) && strings.EqualFold(filepath.Ext(file), ".zip")
+}
+
+// splitZipPath splits a path like bundle.zip!images/cover.png into the
+// archive and the name of the entry in it. ok is false for anything else.
+func splitZipPath(file string) (archive, entry string, ok bool) {
+	if isURL(file) {
+		return "", "", false
+	}
+	i := strings.Index(strings.ToLower(file), ".zip!")
+	if i < 0 {
+		return "", "", false
+	}
+	return file[:i+4], file[i+5:], true
+}
+
+// zipPath joins an archive and an entry in it into a path splitZipPath
+// understands.
+func zipPath(archive, entry string) string {
+	return archive + "!" + entry
+}
+
+// checkZipEntry refuses entries we can not read the contents of.
+func checkZipEntry(archive string, f *zip.File) error {
+	if f.Flags&zipEncrypted != 0 {
+		return fmt.Errorf("%s in %s is encrypted, encrypted zip archives are not supported", f.Name, archive)
+	}
+	return nil
+}
+
+// readZipEntry reads entry from the zip archive, with the same size limit as
+// readImageFile.
+func readZipEntry(archive, entry string) ([]byte, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if f.Name != entry {
+			continue
+		}
+		if err := checkZipEntry(archive, f); err != nil {
+			return nil, err
+		}
+		if limits.MaxFileSize > 0 && f.UncompressedSize64 > uint64(limits.MaxFileSize) {
+			return nil, fmt.Errorf("%w, it is %d bytes, more than %d", hidden.ErrImageTooLarge, f.UncompressedSize64, limits.MaxFileSize)
+		}
+		fp, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		return ioutil.ReadAll(fp)
+	}
+	return nil, fmt.Errorf("%s has no entry %s", archive, entry)
+}
+
+// zipEntries lists the files in the zip archive, skipping directories and
+// nested archives.
+func zipEntries(archive string) ([]zip.FileHeader, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var entries []zip.FileHeader
+	for _, f := range zr.File {
+		if !f.Mode().IsDir() && !isZipFile(f.Name) {
+			entries = append(entries, f.FileHeader)
+		}
+	}
+	return entries, nil
+}
+
+// rewriteZip writes a copy of the zip archive src to dst with the entries in
+// replace given the contents of the files they map to. Every other entry is
+// copied as it is stored, compressed, with its timestamps and extra fields.
+func rewriteZip(src, dst string, replace map[string]string) error {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	return writeAtomic(dst, 0666, func(w io.Writer) error {
+		zw := zip.NewWriter(w)
+		for _, f := range zr.File {
+			file, ok := replace[f.Name]
+			if !ok {
+				if err := zw.Copy(f); err != nil {
+					return err
+				}
+				continue
+			}
+
+			hdr := &zip.FileHeader{
+				Name:           f.Name,
+				Comment:        f.Comment,
+				Method:         f.Method,
+				Modified:       f.Modified,
+				CreatorVersion: f.CreatorVersion,
+				ExternalAttrs:  f.ExternalAttrs,
+			}
+			ew, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return err
+			}
+			if err := copyFile(ew, file); err != nil {
+				return err
+			}
+		}
+		if err := zw.SetComment(zr.Comment); err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+}
+
+func copyFile(w io.Writer, file string) error {
+	fp, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	_, err = io.Copy(w, fp)
+	return err
+}
+
+// zipStage collects encoded entries in a temporary directory until they are
+// written into copies of the archives they came from.
+type zipStage struct {
+	dir string
+
+	mu       sync.Mutex
+	n        int
+	archives map[[2]string]map[string]string
+}
+
+func newZipStage() (*zipStage, error) {
+	dir, err := ioutil.TempDir("", "hidden-zip")
+	if err != nil {
+		return nil, err
+	}
+	return &zipStage{dir: dir, archives: make(map[[2]string]map[string]string)}, nil
+}
+
+// file returns the file to encode fin into, for the entry in the archive
+// fout. It carries the name of the entry, so the output format follows it.
+func (s *zipStage) file(fin, fout string) (string, error) {
+	src, _, ok := splitZipPath(fin)
+	dst, entry, ok2 := splitZipPath(fout)
+	if !ok || !ok2 {
+		return "", fmt.Errorf("%s can only be written from an entry of a zip archive", fout)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.n++
+	dir := filepath.Join(s.dir, fmt.Sprint(s.n))
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", err
+	}
+	file := filepath.Join(dir, path.Base(entry))
+
+	key := [2]string{src, dst}
+	if s.archives[key] == nil {
+		s.archives[key] = make(map[string]string)
+	}
+	s.archives[key][entry] = file
+	return file, nil
+}
+
+// drop forgets the entry in fout, for an encode that failed. Its archive is
+// still written if other entries of it were encoded.
+func (s *zipStage) drop(fout string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dst, entry, _ := splitZipPath(fout)
+	for key, entries := range s.archives {
+		if key[1] == dst {
+			delete(entries, entry)
+		}
+	}
+}
+
+// commit writes every archive with the entries staged for it.
+func (s *zipStage) commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, entries := range s.archives {
+		if err := rewriteZip(key[0], key[1], entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes the staged files.
+func (s *zipStage) remove() {
+	os.RemoveAll(s.dir)
+}
+
+// encodeZipEntry encodes the entry fin into a copy of its archive, written
+// as fout with the entry replaced.
+func encodeZipEntry(fin, fout string, msg []byte, opt encodeOptions) error {
+	if _, entry, _ := splitZipPath(fin); isY4M(entry) {
+		return fmt.Errorf("%s is a video stream, they can not be encoded inside zip archives", fin)
+	}
+
+	stage, err := newZipStage()
+	if err != nil {
+		return err
+	}
+	defer stage.remove()
+
+	file, err := stage.file(fin, fout)
+	if err != nil {
+		return err
+	}
+	if err := encodeFile(fin, file, msg, opt); err != nil {
+		return err
+	}
+	if opt.dryRun {
+		return nil
+	}
+	return stage.commit()
+}
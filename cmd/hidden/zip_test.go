@@ -0,0 +1,262 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testZipEntry is an entry of the archive writeTestZip writes.
+type testZipEntry struct {
+	name   string
+	data   []byte
+	method uint16
+	flags  uint16
+}
+
+// writeTestZip writes entries into an archive in dir. Every entry gets its
+// own timestamp and an extra field, which a copy has to keep.
+func writeTestZip(t *testing.T, dir, name string, entries ...testZipEntry) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	fp, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	zw := zip.NewWriter(fp)
+	for i, e := range entries {
+		// An extended timestamp field, with only the modification time.
+		extra := []byte{0x55, 0x54, 5, 0, 1}
+		modified := time.Date(2019, 3, 1+i, 12, 30, 2*i, 0, time.UTC)
+		extra = binary.LittleEndian.AppendUint32(extra, uint32(modified.Unix()))
+		hdr := &zip.FileHeader{Name: e.name, Method: e.method, Modified: modified, Extra: extra, Comment: "entry " + e.name}
+
+		if e.flags == 0 {
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(e.data)
+			continue
+		}
+		// Entries with flags, like encrypted ones, are written raw.
+		hdr.Method, hdr.Flags = zip.Store, e.flags
+		hdr.CompressedSize64, hdr.UncompressedSize64 = uint64(len(e.data)), uint64(len(e.data))
+		w, err := zw.CreateRaw(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.data)
+	}
+	if err := zw.SetComment("test archive"); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// rawEntries returns the headers and the stored, still compressed, bytes of
+// the entries of archive.
+func rawEntries(t *testing.T, archive string) (map[string]zip.FileHeader, map[string][]byte) {
+	t.Helper()
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	headers, raw := make(map[string]zip.FileHeader), make(map[string][]byte)
+	for _, f := range zr.File {
+		r, err := f.OpenRaw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[f.Name], raw[f.Name] = f.FileHeader, data
+	}
+	return headers, raw
+}
+
+// checkUntouched checks that the entries of src but those in changed are in
+// dst as they are stored in src, byte for byte and with the same headers.
+func checkUntouched(t *testing.T, src, dst string, changed ...string) {
+	t.Helper()
+	srcHeaders, srcRaw := rawEntries(t, src)
+	dstHeaders, dstRaw := rawEntries(t, dst)
+	if len(dstHeaders) != len(srcHeaders) {
+		t.Errorf("%d entries, %d in the original", len(dstHeaders), len(srcHeaders))
+	}
+	for name, hdr := range srcHeaders {
+		if _, ok := dstHeaders[name]; !ok {
+			t.Errorf("%s is missing", name)
+			continue
+		}
+		skip := false
+		for _, c := range changed {
+			skip = skip || c == name
+		}
+		if skip {
+			continue
+		}
+		if !bytes.Equal(dstRaw[name], srcRaw[name]) {
+			t.Errorf("%s: stored bytes differ", name)
+		}
+		if got := dstHeaders[name]; !reflect.DeepEqual(got, hdr) {
+			t.Errorf("%s: header %+v, originally %+v", name, got, hdr)
+		}
+	}
+
+	zr, err := zip.OpenReader(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	if zr.Comment != "test archive" {
+		t.Errorf("archive comment %q", zr.Comment)
+	}
+}
+
+func testZipEntries(t *testing.T) []testZipEntry {
+	png := func(seed int64) []byte {
+		data, err := ioutil.ReadFile(writeTestImage(t, "cover.png", testCover(80, 60, seed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	return []testZipEntry{
+		{name: "images/cover.png", data: png(1), method: zip.Deflate},
+		{name: "images/other.png", data: png(2), method: zip.Store},
+		{name: "images/third.bmp", data: bmpBytes(t, testCover(40, 30, 3)), method: zip.Deflate},
+		{name: "readme.txt", data: []byte(strings.Repeat("the assets of the test bundle\n", 20)), method: zip.Deflate},
+		{name: "nested.zip", data: []byte("PK\x05\x06" + strings.Repeat("\x00", 18)), method: zip.Store},
+	}
+}
+
+func TestEncodeZipEntry(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeTestZip(t, dir, "bundle.zip", testZipEntries(t)...)
+	msg := writeTestFile(t, dir, "msg.bin", testMessage(500, 158))
+
+	out := filepath.Join(dir, "out.zip")
+	if err := encode(zipPath(archive, "images/cover.png"), zipPath(out, "images/cover.png"), msg, encodeOptions{verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkUntouched(t, archive, out, "images/cover.png")
+	if got := decodeTestImage(t, zipPath(out, "images/cover.png"), nil); !bytes.Equal(got, testMessage(500, 158)) {
+		t.Errorf("decoded %d bytes that are not the message", len(got))
+	}
+
+	hdr, _ := rawEntries(t, out)
+	if h := hdr["images/cover.png"]; h.Method != zip.Deflate || !h.Modified.Equal(time.Date(2019, 3, 1, 12, 30, 0, 0, time.UTC)) || h.Comment != "entry images/cover.png" {
+		t.Errorf("encoded entry lost its method, time or comment: %+v", h)
+	}
+}
+
+// TestZipStage encodes two entries of an archive the way the batch command
+// does, into one copy of it.
+func TestZipStage(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeTestZip(t, dir, "bundle.zip", testZipEntries(t)...)
+
+	inputs, err := batchInputs([]string{archive}, filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out", "bundle.zip")
+	want := [][2]string{
+		{zipPath(archive, "images/cover.png"), zipPath(out, "images/cover.png")},
+		{zipPath(archive, "images/other.png"), zipPath(out, "images/other.png")},
+		{zipPath(archive, "images/third.bmp"), zipPath(out, "images/third.bmp")},
+	}
+	if !reflect.DeepEqual(inputs, want) {
+		t.Fatalf("batch inputs %q, want %q", inputs, want)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "out"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	stage, err := newZipStage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stage.remove()
+	for _, in := range inputs[:2] {
+		file, err := stage.file(in[0], in[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := encodeFile(in[0], file, testMessage(300, 158), encodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A failed encode is dropped, its entry copied as it was.
+	if _, err := stage.file(inputs[2][0], inputs[2][1]); err != nil {
+		t.Fatal(err)
+	}
+	stage.drop(inputs[2][1])
+	if err := stage.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkUntouched(t, archive, out, "images/cover.png", "images/other.png")
+	for _, in := range inputs[:2] {
+		if got := decodeTestImage(t, in[1], nil); !bytes.Equal(got, testMessage(300, 158)) {
+			t.Errorf("%s: decoded %d bytes that are not the message", in[1], len(got))
+		}
+	}
+}
+
+func TestZipRejected(t *testing.T) {
+	dir := t.TempDir()
+	entries := append(testZipEntries(t), testZipEntry{name: "secret.png", data: []byte("not really encrypted"), flags: zipEncrypted})
+	archive := writeTestZip(t, dir, "bundle.zip", entries...)
+	msg := writeTestFile(t, dir, "msg.bin", testMessage(100, 158))
+
+	for _, c := range []struct {
+		entry, err string
+	}{
+		{"secret.png", "secret.png in " + archive + " is encrypted"},
+		{"missing.png", archive + " has no entry missing.png"},
+	} {
+		if _, err := readImageFile(zipPath(archive, c.entry)); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("reading %s: got %v, want %q", c.entry, err, c.err)
+		}
+		out := filepath.Join(dir, "out.zip")
+		if err := encode(zipPath(archive, c.entry), zipPath(out, c.entry), msg, encodeOptions{}); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("encoding %s: got %v, want %q", c.entry, err, c.err)
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("encoding %s wrote %s", c.entry, out)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression shrinks the payload before it is encrypted. The ID is stored
+// in the header, so decoding picks the same method the image was encoded
+// with as long as it is registered.
+type Compression interface {
+	// ID identifies the method in the header. Zero is reserved.
+	ID() byte
+
+	// Name is how users select the method, like "gzip".
+	Name() string
+
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// The built-in compression methods. Deflate has the least overhead, Gzip
+// adds a header and a CRC-32 that other tools expect, and Zstd compresses
+// text best at the cost of a larger frame header.
+var (
+	Deflate Compression = &stdCompression{1, "deflate",
+		func(w io.Writer) (io.WriteCloser, error) { return flate.NewWriter(w, flate.BestCompression) },
+		func(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil }}
+	Gzip Compression = &stdCompression{2, "gzip",
+		func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriterLevel(w, gzip.BestCompression) },
+		func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }}
+	Zstd Compression = &stdCompression{3, "zstd",
+		func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderConcurrency(1))
+		},
+		func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		}}
+)
+
+var (
+	compressionMu sync.RWMutex
+	compressions  = map[byte]Compression{}
+)
+
+func init() {
+	RegisterCompression(Deflate)
+	RegisterCompression(Gzip)
+	RegisterCompression(Zstd)
+}
+
+// RegisterCompression makes a compression method available for decoding and
+// to LookupCompression. It panics if the ID is zero or already taken.
+func RegisterCompression(c Compression) {
+	compressionMu.Lock()
+	defer compressionMu.Unlock()
+
+	if c.ID() == 0 {
+		panic("hidden: compression ID 0 is reserved")
+	}
+	if prev, ok := compressions[c.ID()]; ok {
+		panic(fmt.Sprintf("hidden: compression ID 0x%02x registered twice, by %s and %s", c.ID(), prev.Name(), c.Name()))
+	}
+	compressions[c.ID()] = c
+}
+
+// LookupCompression returns the registered compression method with the
+// given name.
+func LookupCompression(name string) (Compression, bool) {
+	compressionMu.RLock()
+	defer compressionMu.RUnlock()
+
+	for _, c := range compressions {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// Compressions returns the registered compression methods ordered by ID.
+func Compressions() []Compression {
+	compressionMu.RLock()
+	defer compressionMu.RUnlock()
+
+	all := make([]Compression, 0, len(compressions))
+	for _, c := range compressions {
+		all = append(all, c)
+	}
+	sort.Slice(all, func(a, b int) bool { return all[a].ID() < all[b].ID() })
+	return all
+}
+
+func compressionByID(id byte) (Compression, error) {
+	compressionMu.RLock()
+	defer compressionMu.RUnlock()
+
+	if c, ok := compressions[id]; ok {
+		return c, nil
+	}
+	return nil, UnsupportedCompressionError(id)
+}
+
+// UnsupportedCompressionError is returned when a payload was compressed
+// with a method that is not registered.
+type UnsupportedCompressionError byte
+
+func (e UnsupportedCompressionError) Error() string {
+	return fmt.Sprintf("unsupported compression method 0x%02x", byte(e))
+}
+
+// stdCompression adapts the constructors of a compress package to
+// Compression.
+type stdCompression struct {
+	id        byte
+	name      string
+	newWriter func(io.Writer) (io.WriteCloser, error)
+	newReader func(io.Reader) (io.ReadCloser, error)
+}
+
+func (c *stdCompression) ID() byte     { return c.id }
+func (c *stdCompression) Name() string { return c.name }
+
+func (c *stdCompression) NewWriter(w io.Writer) (io.WriteCloser, error) { return c.newWriter(w) }
+func (c *stdCompression) NewReader(r io.Reader) (io.ReadCloser, error)  { return c.newReader(r) }
+
+// compressionField returns a placeholder for the FieldCompression that
+// compress fills in, so Capacity accounts for it.
+func compressionField() Field {
+	return Field{FieldCompression, make([]byte, 9)}
+}
+
+// compress returns payload compressed with c, and the FieldCompression that
+// describes it. It returns payload as it is, and false, if compressing does
+// not make it any smaller.
+func compress(c Compression, payload []byte) ([]byte, Field, bool, error) {
+	var buf bytes.Buffer
+	w, err := c.NewWriter(&buf)
+	if err != nil {
+		return nil, Field{}, false, err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return nil, Field{}, false, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, Field{}, false, err
+	}
+
+	v := make([]byte, 9)
+	v[0] = c.ID()
+	binary.BigEndian.PutUint64(v[1:], uint64(len(payload)))
+	if buf.Len()+len(v)+3 >= len(payload) {
+		Wipe(buf.Bytes())
+		return payload, Field{}, false, nil
+	}
+	return buf.Bytes(), Field{FieldCompression, v}, true, nil
+}
+
+// decompress reverses compress for the value v of its FieldCompression. It
+// never produces more than the size v holds, however the data claims to
+// expand.
+func decompress(v, data []byte) ([]byte, error) {
+	if len(v) != 9 {
+		return nil, errors.New("malformed compression field")
+	}
+	c, err := compressionByID(v[0])
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint64(v[1:])
+	if size > uint64(maxInt-1) {
+		return nil, fmt.Errorf("decompressed payload of %d bytes is too large for this platform", size)
+	}
+
+	r, err := c.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing payload: %v", err)
+	}
+	defer r.Close()
+	payload, err := ioutil.ReadAll(io.LimitReader(r, int64(size)+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing payload: %v", err)
+	}
+	if uint64(len(payload)) != size {
+		Wipe(payload)
+		return nil, fmt.Errorf("payload does not decompress to the %d bytes the header claims", size)
+	}
+	return payload, nil
+}
@@ -0,0 +1,158 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	mrand "math/rand"
+)
+
+// HiddenPayload is the second payload of a Deniable placement. Decode
+// returns it instead of the first one when given its passphrase, and
+// without the passphrase nothing tells it apart from the random bytes a
+// Deniable placement fills its slots with otherwise.
+type HiddenPayload struct {
+	Passphrase []byte
+	Payload    []byte
+}
+
+// hiddenSlotCost is what the hidden payload needs besides itself: its
+// length, and the overhead of AESGCM.
+func hiddenSlotCost() int {
+	return 4 + sealedLen(AESGCM)
+}
+
+// hiddenSlots places the hidden payload in the slots between those of a
+// Deniable placement, in an order derived from its passphrase and the salt
+// of the placement, or in order without a passphrase, which is as good for
+// random bytes. It is never stored in a header.
+type hiddenSlots struct {
+	key  []byte
+	salt [16]byte
+}
+
+func (hiddenSlots) ID() byte                       { return 0 }
+func (hiddenSlots) MarshalBinary() ([]byte, error) { return nil, nil }
+
+func (p hiddenSlots) Carrier(s Slots) Carrier {
+	if len(p.key) == 0 {
+		return &stridedCarrier{s.Start + 1, s.Len(), 2}
+	}
+	return interleaved(s, 1, p.key, p.salt, "hidden/deniable")
+}
+
+// embedHidden fills the slots a Deniable placement leaves after header,
+// which is written again, with the hidden payload of opt, or with random
+// bytes without one. All of them are taken by a single AESGCM ciphertext of
+// the length of the payload, the payload and zeros, so only its passphrase
+// can tell how much of it there is.
+func embedHidden(img *carrierImage, header []byte, opt *Options, match *mrand.Rand) error {
+	d, ok := opt.placement().(Deniable)
+	if !ok {
+		return nil
+	}
+
+	l, boot := opt.layout(), &defaultLayout
+	if l != nil {
+		boot = l.bootstrap()
+	}
+	w := newLSBWriter(img, boot)
+	w.match = match
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if l != nil {
+		w.relayout(l)
+	}
+	var key []byte
+	if opt.Hidden != nil {
+		key = opt.Hidden.Passphrase
+	}
+	w.place(hiddenSlots{key, d.Salt})
+
+	rnd := opt.Rand
+	if rnd == nil {
+		rnd = rand.Reader
+	}
+	n := w.remaining() / 8
+	if opt.Hidden == nil {
+		fill := make([]byte, n)
+		if _, err := io.ReadFull(rnd, fill); err != nil {
+			return err
+		}
+		_, err := w.Write(fill)
+		return err
+	}
+
+	payload := opt.Hidden.Payload
+	if n-hiddenSlotCost() < len(payload) {
+		return ErrMessageTooLarge
+	}
+	plain := make([]byte, n-sealedLen(AESGCM))
+	defer Wipe(plain)
+	binary.BigEndian.PutUint32(plain, uint32(len(payload)))
+	copy(plain[4:], payload)
+
+	sealed, err := seal(AESGCM, key, plain, rnd)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+// decodeHidden returns the hidden payload of a Deniable placement in img,
+// whose header names Keyed, found with key. It fails with
+// ErrDecryptionFailed if key is not its passphrase or there is none.
+func decodeHidden(img *carrierImage, key []byte) ([]byte, error) {
+	r := newLSBReader(img, storedLayout(img))
+	h, err := readHeader(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	p, err := headerPlacement(h)
+	if err != nil {
+		return nil, err
+	}
+	k, ok := p.(Keyed)
+	if !ok || len(key) == 0 {
+		return nil, ErrDecryptionFailed
+	}
+	r.place(hiddenSlots{key, k.Salt})
+
+	sealed := make([]byte, r.remaining())
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	plain, err := open(key, sealed)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	if len(plain) < 4 {
+		return nil, ErrDecryptionFailed
+	}
+	n := binary.BigEndian.Uint32(plain)
+	if uint64(n) > uint64(len(plain)-4) {
+		Wipe(plain)
+		return nil, errors.New("hidden payload is longer than its slots")
+	}
+	payload := append([]byte(nil), plain[4:4+n]...)
+	Wipe(plain)
+	return payload, nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"image"
+	"math/rand"
+	"testing"
+)
+
+var (
+	decoyPassphrase  = []byte("decoy passphrase")
+	hiddenPassphrase = []byte("hidden passphrase")
+)
+
+// storedHeader returns the header of the message in img as it is stored,
+// without reading the payload.
+func storedHeader(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	samples := carrierOf(img)
+	h, err := readHeader(newLSBReader(samples, storedLayout(samples)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDeniableRoundTrip(t *testing.T) {
+	decoy, secret := []byte("the decoy"), []byte("the hidden message")
+	stego, err := Encode(testCover(64, 64, 1), decoy, &Options{
+		Passphrase: decoyPassphrase,
+		Placement:  Deniable{Salt: [16]byte{1}},
+		Hidden:     &HiddenPayload{Passphrase: hiddenPassphrase, Payload: secret},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		passphrase, want []byte
+	}{
+		{decoyPassphrase, decoy},
+		{hiddenPassphrase, secret},
+	} {
+		got, err := Decode(stego, &Options{Passphrase: c.passphrase})
+		if err != nil {
+			t.Fatalf("%s: %v", c.passphrase, err)
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("%s: got %q, want %q", c.passphrase, got, c.want)
+		}
+	}
+	if _, err := Decode(stego, &Options{Passphrase: []byte("wrong")}); err != ErrDecryptionFailed {
+		t.Errorf("wrong passphrase: got %v, want ErrDecryptionFailed", err)
+	}
+}
+
+// TestDeniableHeader checks that a message with a hidden one behind it
+// stores the header a keyed message without one does, so nothing but the
+// passphrases tells them apart.
+func TestDeniableHeader(t *testing.T) {
+	msg, salt := []byte("the decoy"), [16]byte{1, 2, 3}
+	encode := func(opt *Options) image.Image {
+		opt.Passphrase = decoyPassphrase
+		opt.Rand = rand.New(rand.NewSource(1))
+		stego, err := Encode(testCover(64, 64, 1), msg, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stego
+	}
+
+	keyed := encode(&Options{Placement: Keyed{Salt: salt}})
+	decoy := encode(&Options{Placement: Deniable{Salt: salt}})
+	both := encode(&Options{
+		Placement: Deniable{Salt: salt},
+		Hidden:    &HiddenPayload{Passphrase: hiddenPassphrase, Payload: []byte("the hidden message")},
+	})
+
+	want := storedHeader(t, keyed)
+	for name, img := range map[string]image.Image{"decoy only": decoy, "decoy and hidden": both} {
+		if got := storedHeader(t, img); !bytes.Equal(got, want) {
+			t.Errorf("%s: header %x, a keyed message stores %x", name, got, want)
+		}
+	}
+
+	got, err := Decode(keyed, &Options{Passphrase: decoyPassphrase})
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("keyed: got %q, %v", got, err)
+	}
+	if _, err := Decode(keyed, &Options{Passphrase: hiddenPassphrase}); err != ErrDecryptionFailed {
+		t.Errorf("keyed with the hidden passphrase: got %v, want ErrDecryptionFailed", err)
+	}
+}
@@ -0,0 +1,377 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"errors"
+	"fmt"
+)
+
+// With Options.ECC the payload, after encryption, is split into as few
+// Reed-Solomon codewords of at most 255 bytes as it takes, as equal in size
+// as they can be, each ending in ECC parity bytes over GF(2^8) with the
+// polynomial 0x11d. The codewords are interleaved byte by byte, so damage to
+// a run of carrier bits is shared between them. A codeword with up to half
+// as many damaged bytes as it has parity is repaired before the checksum is
+// validated, which is why the checksum leaves the parity out. The header is
+// not protected.
+const eccBlock = 255
+
+// ECCScheme is the error correcting code of a payload, see
+// Options.ECCScheme. The header records it.
+type ECCScheme byte
+
+const (
+	// ReedSolomon stores the payload as Reed-Solomon codewords with
+	// Options.ECC parity bytes each, the default.
+	ReedSolomon ECCScheme = iota
+
+	// Hamming stores every half byte of the payload as an extended
+	// Hamming(8,4) codeword, see hamming.go.
+	Hamming
+)
+
+func (s ECCScheme) String() string {
+	switch s {
+	case ReedSolomon:
+		return "reed-solomon"
+	case Hamming:
+		return "hamming"
+	}
+	return fmt.Sprintf("ecc-0x%02x", byte(s))
+}
+
+// eccCode is the error correcting code a payload with FlagECC is stored in.
+type eccCode interface {
+	// encode returns payload as it is stored.
+	encode(payload []byte) []byte
+
+	// decode returns the payload stored, and the number of stored bytes
+	// it repaired. What it can not repair is returned as it is, for the
+	// checksum to reject.
+	decode(stored []byte) ([]byte, int)
+
+	// capacity returns the size of the largest payload that fits in n
+	// bytes.
+	capacity(n int) int
+
+	// field returns the value of its FieldECC.
+	field() []byte
+}
+
+// reedSolomon is the Reed-Solomon code with this many parity bytes in
+// every codeword.
+type reedSolomon int
+
+func (p reedSolomon) encode(payload []byte) []byte { return addParity(payload, int(p)) }
+
+func (p reedSolomon) decode(stored []byte) ([]byte, int) { return removeParity(stored, int(p)) }
+
+func (p reedSolomon) capacity(n int) int { return uneccLen(n, int(p)) }
+
+func (p reedSolomon) field() []byte { return []byte{byte(p)} }
+
+// parseECCField returns the code of the value of a FieldECC: one byte, the
+// parity of Reed-Solomon, or a zero byte and the ECCScheme of another code.
+func parseECCField(v []byte) (eccCode, bool) {
+	switch {
+	case len(v) == 1 && v[0] > 0 && v[0] < eccBlock:
+		return reedSolomon(v[0]), true
+	case len(v) == 2 && v[0] == 0 && ECCScheme(v[1]) == Hamming:
+		return hamming{}, true
+	}
+	return nil, false
+}
+
+var (
+	gfExp [2 * eccBlock]byte
+	gfLog [eccBlock + 1]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < eccBlock; i++ {
+		gfExp[i], gfExp[i+eccBlock] = byte(x), byte(x)
+		gfLog[x] = byte(i)
+		if x <<= 1; x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+eccBlock-int(gfLog[b])]
+}
+
+// gfPow returns α to the power of n.
+func gfPow(n int) byte {
+	if n %= eccBlock; n < 0 {
+		n += eccBlock
+	}
+	return gfExp[n]
+}
+
+// polyEval evaluates p, lowest power first, at x.
+func polyEval(p []byte, x byte) byte {
+	var y byte
+	for i := len(p) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ p[i]
+	}
+	return y
+}
+
+// eccCodewords returns the number of codewords and the size of the largest,
+// for a payload of n bytes with parity bytes in each.
+func eccCodewords(n, parity int) (blocks, size int) {
+	blocks = (n + eccBlock - parity - 1) / (eccBlock - parity)
+	if blocks == 0 {
+		return 0, 0
+	}
+	return blocks, (n+blocks-1)/blocks + parity
+}
+
+// eccLen returns the size of n bytes stored with parity.
+func eccLen(n, parity int) int {
+	blocks, _ := eccCodewords(n, parity)
+	return n + blocks*parity
+}
+
+// uneccLen returns the size of the largest payload that fits in n bytes
+// with parity.
+func uneccLen(n, parity int) int {
+	full, rest := n/eccBlock, n%eccBlock-parity
+	if rest < 0 {
+		rest = 0
+	}
+	return full*(eccBlock-parity) + rest
+}
+
+// eccOrder returns, for every codeword, the offsets of its bytes in the
+// interleaved payload of n bytes as it is stored.
+func eccOrder(n, parity int) [][]int {
+	blocks := (n + eccBlock - 1) / eccBlock
+	data := n - blocks*parity
+	if data <= 0 {
+		return nil
+	}
+	words := make([][]int, blocks)
+	for i := range words {
+		size := data/blocks + parity
+		if i < data%blocks {
+			size++
+		}
+		words[i] = make([]int, 0, size)
+	}
+
+	var off int
+	for j := 0; off < n; j++ {
+		for i := range words {
+			if j < cap(words[i]) {
+				words[i] = append(words[i], off)
+				off++
+			}
+		}
+	}
+	return words
+}
+
+// generator returns the generator polynomial of a code with parity bytes,
+// highest power first.
+func generator(parity int) []byte {
+	g := []byte{1}
+	for i := 0; i < parity; i++ {
+		next := make([]byte, len(g)+1)
+		root := gfPow(i)
+		for j, c := range g {
+			next[j] ^= c
+			next[j+1] ^= gfMul(c, root)
+		}
+		g = next
+	}
+	return g
+}
+
+// addParity returns payload as it is stored with parity bytes in every
+// codeword.
+func addParity(payload []byte, parity int) []byte {
+	n := eccLen(len(payload), parity)
+	out := make([]byte, n)
+	g := generator(parity)
+
+	var next int
+	for _, word := range eccOrder(n, parity) {
+		data := payload[next : next+len(word)-parity]
+		next += len(data)
+
+		rem := make([]byte, parity)
+		for _, b := range data {
+			f := b ^ rem[0]
+			copy(rem, rem[1:])
+			rem[parity-1] = 0
+			for j := range rem {
+				rem[j] ^= gfMul(g[j+1], f)
+			}
+		}
+		for j, b := range data {
+			out[word[j]] = b
+		}
+		for j, b := range rem {
+			out[word[len(data)+j]] = b
+		}
+	}
+	return out
+}
+
+// errUncorrectable is returned for a codeword with more damage than its
+// parity can repair.
+var errUncorrectable = errors.New("too many damaged bytes to repair")
+
+// removeParity returns the payload stored with parity bytes in every
+// codeword, and the number of bytes it repaired. Codewords that can not be
+// repaired are returned as they are, for the checksum to reject.
+func removeParity(stored []byte, parity int) ([]byte, int) {
+	var (
+		payload  []byte
+		repaired int
+	)
+	for _, word := range eccOrder(len(stored), parity) {
+		cw := make([]byte, len(word))
+		for j, off := range word {
+			cw[j] = stored[off]
+		}
+		if n, err := correct(cw, parity); err == nil {
+			repaired += n
+		}
+		payload = append(payload, cw[:len(cw)-parity]...)
+	}
+	return payload, repaired
+}
+
+// syndromes returns the syndromes of codeword cw, lowest power first, and
+// whether they are all zero.
+func syndromes(cw []byte, parity int) ([]byte, bool) {
+	s := make([]byte, parity)
+	clean := true
+	for i := range s {
+		x := gfPow(i)
+		for _, b := range cw {
+			s[i] = gfMul(s[i], x) ^ b
+		}
+		clean = clean && s[i] == 0
+	}
+	return s, clean
+}
+
+// correct repairs codeword cw in place and returns the number of bytes it
+// changed. It leaves cw as it is if it can not be repaired.
+func correct(cw []byte, parity int) (int, error) {
+	s, clean := syndromes(cw, parity)
+	if clean {
+		return 0, nil
+	}
+
+	// Berlekamp-Massey finds the error locator, lowest power first.
+	loc, prev := []byte{1}, []byte{1}
+	errs, shift, last := 0, 1, byte(1)
+	for n := 0; n < parity; n++ {
+		d := s[n]
+		for i := 1; i <= errs && i < len(loc); i++ {
+			d ^= gfMul(loc[i], s[n-i])
+		}
+		if d == 0 {
+			shift++
+			continue
+		}
+
+		size := len(prev) + shift
+		if size < len(loc) {
+			size = len(loc)
+		}
+		next := make([]byte, size)
+		copy(next, loc)
+		f := gfDiv(d, last)
+		for i, c := range prev {
+			next[i+shift] ^= gfMul(f, c)
+		}
+		if 2*errs <= n {
+			errs, prev, last, shift = n+1-errs, loc, d, 1
+		} else {
+			shift++
+		}
+		loc = next
+	}
+	if 2*errs > parity {
+		return 0, errUncorrectable
+	}
+
+	// The evaluator is the syndromes times the locator, modulo x^parity,
+	// and the formal derivative of the locator keeps its odd powers.
+	eval := make([]byte, parity)
+	for i, a := range s {
+		for j, b := range loc {
+			if i+j < parity {
+				eval[i+j] ^= gfMul(a, b)
+			}
+		}
+	}
+	deriv := make([]byte, len(loc))
+	for i := 1; i < len(loc); i += 2 {
+		deriv[i-1] = loc[i]
+	}
+
+	// A Chien search finds the damaged bytes, and Forney's algorithm what
+	// they should be.
+	type fix struct {
+		at  int
+		val byte
+	}
+	var fixes []fix
+	for i := range cw {
+		x := gfPow(len(cw) - 1 - i)
+		xinv := gfPow(-(len(cw) - 1 - i))
+		if polyEval(loc, xinv) != 0 {
+			continue
+		}
+		den := polyEval(deriv, xinv)
+		if den == 0 {
+			return 0, errUncorrectable
+		}
+		fixes = append(fixes, fix{i, gfMul(x, gfDiv(polyEval(eval, xinv), den))})
+	}
+	if len(fixes) != errs {
+		return 0, errUncorrectable
+	}
+
+	fixed := append([]byte(nil), cw...)
+	for _, f := range fixes {
+		fixed[f.at] ^= f.val
+	}
+	if _, clean := syndromes(fixed, parity); !clean {
+		return 0, errUncorrectable
+	}
+	copy(cw, fixed)
+	return len(fixes), nil
+}
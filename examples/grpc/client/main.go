@@ -0,0 +1,195 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Command client calls the gRPC service of the grpc command, streaming the
+// files it is given to it and the answer to a file:
+//
+//	client [flags] encode cover message out
+//	client [flags] decode image out
+//
+// An out of - writes to stdout.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/andreas-jonsson/hidden/examples/grpc/hiddenpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// chunkSize is the most bytes of a file in one request.
+const chunkSize = 64 << 10
+
+func main() {
+	addr := flag.String("addr", "localhost:8081", "Address of the server.")
+	passphraseEnv := flag.String("passphrase-env", "", "Environment variable holding the passphrase that encrypts or decrypts the message.")
+	format := flag.String("format", "", "Format of the encoded image: same, png or bmp. (default same)")
+	slot := flag.String("slot", "", "Named slot of a BMP or PNG to encode into or decode from.")
+	overwrite := flag.Bool("overwrite", false, "Encode even if the cover already contains a message.")
+	auto := flag.Bool("auto", false, "Try every supported layout when decoding.")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: client [flags] encode cover message out")
+		fmt.Fprintln(os.Stderr, "       client [flags] decode image out")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var passphrase []byte
+	if *passphraseEnv != "" {
+		passphrase = []byte(os.Getenv(*passphraseEnv))
+	}
+
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	if token := os.Getenv("HIDDEN_TOKEN"); token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+	c := hiddenpb.NewHiddenClient(conn)
+
+	args := flag.Args()
+	switch {
+	case len(args) == 4 && args[0] == "encode":
+		err = encode(ctx, c, args[1], args[2], args[3], &hiddenpb.EncodeOptions{
+			Format:     *format,
+			Passphrase: passphrase,
+			Slot:       *slot,
+			Overwrite:  *overwrite,
+		})
+	case len(args) == 3 && args[0] == "decode":
+		err = decode(ctx, c, args[1], args[2], &hiddenpb.DecodeOptions{
+			Passphrase: passphrase,
+			Slot:       *slot,
+			Auto:       *auto,
+		})
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func encode(ctx context.Context, c hiddenpb.HiddenClient, cover, message, out string, opt *hiddenpb.EncodeOptions) error {
+	stream, err := c.Encode(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&hiddenpb.EncodeRequest{Part: &hiddenpb.EncodeRequest_Options{Options: opt}}); err != nil {
+		return err
+	}
+	err = upload(cover, func(b []byte) error {
+		return stream.Send(&hiddenpb.EncodeRequest{Part: &hiddenpb.EncodeRequest_Cover{Cover: b}})
+	})
+	if err == nil {
+		err = upload(message, func(b []byte) error {
+			return stream.Send(&hiddenpb.EncodeRequest{Part: &hiddenpb.EncodeRequest_Message{Message: b}})
+		})
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	return download(out, stream.Recv)
+}
+
+func decode(ctx context.Context, c hiddenpb.HiddenClient, img, out string, opt *hiddenpb.DecodeOptions) error {
+	stream, err := c.Decode(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&hiddenpb.DecodeRequest{Part: &hiddenpb.DecodeRequest_Options{Options: opt}}); err != nil {
+		return err
+	}
+	err = upload(img, func(b []byte) error {
+		return stream.Send(&hiddenpb.DecodeRequest{Part: &hiddenpb.DecodeRequest_Image{Image: b}})
+	})
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	if err := download(out, stream.Recv); err != nil {
+		return err
+	}
+	if md, err := stream.Header(); err == nil {
+		if format := md.Get("hidden-format"); len(format) > 0 {
+			log.Println("format:", format[0])
+		}
+	}
+	return nil
+}
+
+// upload sends the file in chunks of up to chunkSize bytes, at least one. A
+// failed Send returns io.EOF, the status is returned by Recv.
+func upload(file string, send func([]byte) error) error {
+	fp, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	buf := make([]byte, chunkSize)
+	for sent := false; ; sent = true {
+		n, err := io.ReadFull(fp, buf)
+		if err == io.EOF && sent {
+			return nil
+		} else if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		if err := send(buf[:n]); err != nil {
+			return err
+		}
+		if n < len(buf) {
+			return nil
+		}
+	}
+}
+
+// download writes the chunks recv returns to the file out, or stdout for -.
+// Nothing is written if the call fails.
+func download(out string, recv func() (*hiddenpb.Chunk, error)) error {
+	var data []byte
+	for {
+		chunk, err := recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		data = append(data, chunk.Data...)
+	}
+	if out == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(out, data, 0644)
+}
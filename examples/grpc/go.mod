@@ -0,0 +1,25 @@
+module github.com/andreas-jonsson/hidden/examples/grpc
+
+go 1.26.0
+
+require (
+	github.com/andreas-jonsson/hidden v0.0.0
+	golang.org/x/image v0.46.0
+	google.golang.org/grpc v1.84.0
+	google.golang.org/protobuf v1.36.12
+)
+
+require (
+	filippo.io/age v1.3.2 // indirect
+	filippo.io/hpke v0.4.0 // indirect
+	github.com/ProtonMail/go-crypto v1.5.1 // indirect
+	github.com/cloudflare/circl v1.6.3 // indirect
+	github.com/klauspost/compress v1.20.1 // indirect
+	golang.org/x/crypto v0.57.0 // indirect
+	golang.org/x/net v0.58.0 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+	golang.org/x/text v0.42.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260706201446-f0a921348800 // indirect
+)
+
+replace github.com/andreas-jonsson/hidden => ../..
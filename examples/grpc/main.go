@@ -0,0 +1,344 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Command grpc serves the hidden package as the gRPC service in
+// hiddenpb/hidden.proto, for other services to encode and decode large
+// images without a multipart HTTP request. Covers, messages and encoded
+// images are streamed in chunks, and held in memory up to
+// -max-request-size. hiddenpb holds the generated client, the client
+// directory a command line client built on it.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/andreas-jonsson/hidden"
+	"github.com/andreas-jonsson/hidden/examples/grpc/hiddenpb"
+	"golang.org/x/image/bmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// chunkSize is the most bytes of an image or message in one response.
+const chunkSize = 64 << 10
+
+type server struct {
+	hiddenpb.UnimplementedHiddenServer
+	maxRequestSize int64
+	token          []byte
+}
+
+func main() {
+	listen := flag.String("listen", ":8081", "Address to listen on.")
+	maxRequestSize := flag.Int64("max-request-size", 64<<20, "Largest accepted cover and message, or image, in bytes together.")
+	tokenFile := flag.String("token-file", "", "Require a bearer token in the authorization metadata, read from file. The HIDDEN_TOKEN environment variable works too.")
+	flag.Parse()
+
+	s := &server{maxRequestSize: *maxRequestSize}
+	if *tokenFile != "" {
+		token, err := ioutil.ReadFile(*tokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.token = bytes.TrimSpace(token)
+	} else if token := os.Getenv("HIDDEN_TOKEN"); token != "" {
+		s.token = []byte(token)
+	}
+
+	lis, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.StreamInterceptor(s.auth))
+	hiddenpb.RegisterHiddenServer(srv, s)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+
+	log.Println("listening on", lis.Addr())
+	if err := srv.Serve(lis); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// auth rejects calls without the bearer token, if one is configured.
+func (s *server) auth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if s.token != nil {
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		var token string
+		if v := md.Get("authorization"); len(v) > 0 {
+			token = strings.TrimPrefix(v[0], "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), s.token) != 1 {
+			return status.Error(codes.Unauthenticated, "unauthorized")
+		}
+	}
+	return handler(srv, ss)
+}
+
+func (s *server) Encode(stream hiddenpb.Hidden_EncodeServer) error {
+	var (
+		opts           *hiddenpb.EncodeOptions
+		cover, payload []byte
+		size           int64
+	)
+	defer func() { hidden.Wipe(payload) }()
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch part := req.Part.(type) {
+		case *hiddenpb.EncodeRequest_Options:
+			if opts != nil || cover != nil || payload != nil {
+				return status.Error(codes.InvalidArgument, "the options go in the first request")
+			}
+			opts = part.Options
+		case *hiddenpb.EncodeRequest_Cover:
+			cover = append(cover, part.Cover...)
+			size += int64(len(part.Cover))
+		case *hiddenpb.EncodeRequest_Message:
+			if payload == nil {
+				payload = make([]byte, 0, len(part.Message))
+			}
+			payload = append(payload, part.Message...)
+			size += int64(len(part.Message))
+		}
+		if size > s.maxRequestSize {
+			return s.tooLarge()
+		}
+	}
+	if opts == nil {
+		opts = &hiddenpb.EncodeOptions{}
+	}
+	defer hidden.Wipe(opts.Passphrase)
+	if cover == nil || payload == nil {
+		return status.Error(codes.InvalidArgument, "the cover and message are required")
+	}
+
+	opt, err := options(opts.Passphrase, opts.Cipher, opts.Checksum, opts.Compress)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	f := hidden.MatchFormat(cover)
+	if f == nil {
+		return fail(image.ErrFormat)
+	}
+	if !opts.Overwrite && opts.Slot == "" {
+		if size, _, err := f.Detect(bytes.NewReader(cover)); err == nil {
+			return status.Errorf(codes.AlreadyExists, "cover already contains a hidden message of %d bytes", size)
+		}
+	}
+
+	var buf bytes.Buffer
+	switch format := opts.Format; format {
+	case "", "same":
+		if opts.Slot != "" {
+			err = encodeImage(&buf, cover, opts.Slot, payload, opt, f.Name())
+			break
+		}
+		err = f.Encode(&buf, bytes.NewReader(cover), payload, opt)
+	case "png", "bmp":
+		err = encodeImage(&buf, cover, opts.Slot, payload, opt, format)
+	default:
+		return status.Errorf(codes.InvalidArgument, "unsupported output format %q", format)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return send(stream, buf.Bytes())
+}
+
+// encodeImage encodes payload into the pixels of cover, in the named slot
+// if slot is not empty, and writes the encoded image to w as a PNG or BMP.
+func encodeImage(w io.Writer, cover []byte, slot string, payload []byte, opt *hidden.Options, format string) error {
+	img, _, err := hidden.DecodeImage(bytes.NewReader(cover))
+	if err != nil {
+		return err
+	}
+	if slot != "" {
+		img, err = hidden.EncodeSlot(img, slot, payload, opt)
+	} else {
+		img, err = hidden.Encode(img, payload, opt)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "png":
+		return png.Encode(w, img)
+	case "bmp":
+		return bmp.Encode(w, img)
+	}
+	return fmt.Errorf("a slot can only be stored in a BMP or PNG, not %s", format)
+}
+
+func (s *server) Decode(stream hiddenpb.Hidden_DecodeServer) error {
+	var (
+		opts *hiddenpb.DecodeOptions
+		data []byte
+	)
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch part := req.Part.(type) {
+		case *hiddenpb.DecodeRequest_Options:
+			if opts != nil || data != nil {
+				return status.Error(codes.InvalidArgument, "the options go in the first request")
+			}
+			opts = part.Options
+		case *hiddenpb.DecodeRequest_Image:
+			data = append(data, part.Image...)
+		}
+		if int64(len(data)) > s.maxRequestSize {
+			return s.tooLarge()
+		}
+	}
+	if opts == nil {
+		opts = &hiddenpb.DecodeOptions{}
+	}
+	defer hidden.Wipe(opts.Passphrase)
+	if data == nil {
+		return status.Error(codes.InvalidArgument, "the image is required")
+	}
+
+	var (
+		opt     = &hidden.Options{Passphrase: opts.Passphrase}
+		payload []byte
+		format  string
+		err     error
+	)
+	f := hidden.MatchFormat(data)
+	if f == nil {
+		return fail(image.ErrFormat)
+	}
+	if !opts.Auto && opts.Slot == "" {
+		payload, err = f.Decode(bytes.NewReader(data), opt)
+		_, format, _ = f.Detect(bytes.NewReader(data))
+	} else if img, _, derr := hidden.DecodeImage(bytes.NewReader(data)); derr != nil {
+		err = derr
+	} else if opts.Auto {
+		payload, format, err = hidden.DecodeAuto(img, opt)
+	} else {
+		payload, err = hidden.DecodeSlot(img, opts.Slot, opt)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	defer hidden.Wipe(payload)
+
+	if format != "" {
+		stream.SetHeader(metadata.Pairs("hidden-format", format))
+	}
+	return send(stream, payload)
+}
+
+// send streams data in chunks of at most chunkSize bytes, at least one even
+// if data is empty.
+func send(stream interface{ Send(*hiddenpb.Chunk) error }, data []byte) error {
+	for {
+		n := len(data)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		if err := stream.Send(&hiddenpb.Chunk{Data: data[:n]}); err != nil {
+			return err
+		}
+		if data = data[n:]; len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+func (s *server) tooLarge() error {
+	return status.Errorf(codes.ResourceExhausted, "request is larger than %d bytes", s.maxRequestSize)
+}
+
+// options returns the library options from the fields of a request.
+func options(passphrase []byte, cipher, checksum, compress string) (*hidden.Options, error) {
+	opt := &hidden.Options{Passphrase: passphrase}
+	var ok bool
+	if cipher != "" {
+		if opt.Cipher, ok = hidden.LookupCipher(cipher); !ok {
+			return nil, fmt.Errorf("unknown cipher %q", cipher)
+		}
+	}
+	if checksum != "" {
+		if opt.Integrity, ok = hidden.LookupIntegrity(checksum); !ok {
+			return nil, fmt.Errorf("unknown checksum %q", checksum)
+		}
+	}
+	if compress != "" {
+		if opt.Compression, ok = hidden.LookupCompression(compress); !ok {
+			return nil, fmt.Errorf("unknown compression %q", compress)
+		}
+	}
+	return opt, nil
+}
+
+// fail maps err to the status code a client can act on.
+func fail(err error) error {
+	var (
+		damaged *hidden.ChecksumError
+		expired *hidden.ExpiredError
+		code    = codes.InvalidArgument
+	)
+
+	switch {
+	case errors.Is(err, hidden.ErrMessageTooLarge), errors.Is(err, hidden.ErrImageTooLarge):
+		code = codes.ResourceExhausted
+	case errors.Is(err, hidden.ErrNoHiddenMessage), errors.Is(err, hidden.ErrNoSlot), errors.Is(err, hidden.ErrNoSlots):
+		code = codes.NotFound
+	case errors.Is(err, hidden.ErrPassphraseRequired), errors.Is(err, hidden.ErrDecryptionFailed):
+		code = codes.PermissionDenied
+	case errors.As(err, &damaged), errors.As(err, new(*hidden.TruncatedError)):
+		code = codes.DataLoss
+	case errors.As(err, &expired), errors.Is(err, hidden.ErrSlotted):
+		code = codes.FailedPrecondition
+	case errors.As(err, new(hidden.UnsupportedIntegrityError)), errors.As(err, new(hidden.UnsupportedCipherError)):
+		code = codes.Unimplemented
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,23 @@
+// Wraps the functions registered by hidden.wasm so that errors are thrown
+// instead of returned. Load wasm_exec.js first.
+const hidden = (() => {
+	const call = (name, ...args) => {
+		const res = hiddenGo[name](...args);
+		if (res instanceof Error) {
+			throw res;
+		}
+		return res;
+	};
+
+	return {
+		async load(url = "hidden.wasm") {
+			const go = new Go();
+			const { instance } = await WebAssembly.instantiateStreaming(fetch(url), go.importObject);
+			go.run(instance);
+		},
+		encode: (cover, payload, options = {}) => call("encode", cover, payload, options),
+		decode: (image, options = {}) => call("decode", image, options),
+		capacity: (image, options = {}) => call("capacity", image, options),
+		detect: (image) => call("detect", image),
+	};
+})();
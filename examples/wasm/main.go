@@ -0,0 +1,248 @@
+//go:build js && wasm
+
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Command wasm exposes the hidden package to JavaScript. It registers a
+// global hiddenGo object with encode, decode, capacity and detect functions
+// that take and return Uint8Arrays; hidden.js wraps them to throw on errors.
+// Everything happens in memory, in any of the formats hidden.Formats lists.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"syscall/js"
+
+	"github.com/andreas-jonsson/hidden"
+	"golang.org/x/image/bmp"
+)
+
+func main() {
+	js.Global().Set("hiddenGo", js.ValueOf(map[string]interface{}{
+		"encode":   js.FuncOf(encode),
+		"decode":   js.FuncOf(decode),
+		"capacity": js.FuncOf(capacity),
+		"detect":   js.FuncOf(detect),
+	}))
+	select {}
+}
+
+// encode(cover, payload, {format, slot, passphrase, cipher, checksum,
+// compress}) returns the stego image, as PNG unless format is "bmp", or in
+// the format of the cover if it is "same". The payload is encrypted if a
+// passphrase is given, and stored in the named slot next to the others of
+// the cover with slot.
+func encode(this js.Value, args []js.Value) interface{} {
+	opt, err := options(args, 2)
+	if err != nil {
+		return jsError(err)
+	}
+	data, payload := copyBytes(args[0]), copyBytes(args[1])
+
+	var buf bytes.Buffer
+	if option(args, 2, "format").String() == "same" && option(args, 2, "slot").Type() != js.TypeString {
+		if err := hidden.EncodeFile(&buf, bytes.NewReader(data), payload, opt); err != nil {
+			return jsError(err)
+		}
+		return uint8Array(buf.Bytes())
+	}
+
+	cover, err := decodeImage(data)
+	if err != nil {
+		return jsError(err)
+	}
+	var stego image.Image
+	if slot := option(args, 2, "slot"); slot.Type() == js.TypeString {
+		stego, err = hidden.EncodeSlot(cover, slot.String(), payload, opt)
+	} else {
+		stego, err = hidden.Encode(cover, payload, opt)
+	}
+	if err != nil {
+		return jsError(err)
+	}
+
+	if option(args, 2, "format").String() == "bmp" {
+		err = bmp.Encode(&buf, stego)
+	} else {
+		err = png.Encode(&buf, stego)
+	}
+	if err != nil {
+		return jsError(err)
+	}
+	return uint8Array(buf.Bytes())
+}
+
+// decode(image, {auto, slot, passphrase}) returns the hidden payload. With
+// auto set every supported layout of the pixels is tried, with slot the
+// named slot is decoded.
+func decode(this js.Value, args []js.Value) interface{} {
+	opt, err := options(args, 1)
+	if err != nil {
+		return jsError(err)
+	}
+	data := copyBytes(args[0])
+
+	var payload []byte
+	auto, slot := option(args, 1, "auto").Truthy(), option(args, 1, "slot")
+	if !auto && slot.Type() != js.TypeString {
+		payload, err = hidden.DecodeFile(bytes.NewReader(data), opt)
+	} else if img, derr := decodeImage(data); derr != nil {
+		err = derr
+	} else if auto {
+		payload, _, err = hidden.DecodeAuto(img, opt)
+	} else {
+		payload, err = hidden.DecodeSlot(img, slot.String(), opt)
+	}
+	if err != nil {
+		return jsError(err)
+	}
+	return uint8Array(payload)
+}
+
+// capacity(image, options) returns the largest payload in bytes the image can
+// hold with the options of encode.
+func capacity(this js.Value, args []js.Value) interface{} {
+	opt, err := options(args, 1)
+	if err != nil {
+		return jsError(err)
+	}
+	data := copyBytes(args[0])
+	f := hidden.MatchFormat(data)
+	if f == nil {
+		return jsError(image.ErrFormat)
+	}
+	n, err := f.Capacity(bytes.NewReader(data), opt)
+	if err != nil {
+		return jsError(err)
+	}
+	return n
+}
+
+// detect(image) returns {size, format} of the message in the image without
+// decrypting it.
+func detect(this js.Value, args []js.Value) interface{} {
+	data := copyBytes(args[0])
+	f := hidden.MatchFormat(data)
+	if f == nil {
+		return jsError(image.ErrFormat)
+	}
+	size, format, err := f.Detect(bytes.NewReader(data))
+	if err != nil {
+		return jsError(err)
+	}
+	return js.ValueOf(map[string]interface{}{"size": size, "format": format})
+}
+
+// options returns the library options from the options object at args[i].
+func options(args []js.Value, i int) (*hidden.Options, error) {
+	opt := &hidden.Options{}
+	if p := option(args, i, "passphrase"); p.Type() == js.TypeString {
+		opt.Passphrase = []byte(p.String())
+	}
+	if name := option(args, i, "cipher"); name.Type() == js.TypeString {
+		var ok bool
+		if opt.Cipher, ok = hidden.LookupCipher(name.String()); !ok {
+			return nil, fmt.Errorf("unknown cipher %q", name.String())
+		}
+	}
+	if name := option(args, i, "checksum"); name.Type() == js.TypeString {
+		var ok bool
+		if opt.Integrity, ok = hidden.LookupIntegrity(name.String()); !ok {
+			return nil, fmt.Errorf("unknown checksum %q", name.String())
+		}
+	}
+	if name := option(args, i, "compress"); name.Type() == js.TypeString {
+		var ok bool
+		if opt.Compression, ok = hidden.LookupCompression(name.String()); !ok {
+			return nil, fmt.Errorf("unknown compression %q", name.String())
+		}
+	}
+	return opt, nil
+}
+
+// option returns the named field of the options object at args[i], or
+// undefined.
+func option(args []js.Value, i int, name string) js.Value {
+	if i >= len(args) || args[i].Type() != js.TypeObject {
+		return js.Undefined()
+	}
+	return args[i].Get(name)
+}
+
+func decodeImage(data []byte) (image.Image, error) {
+	img, _, err := hidden.DecodeImage(bytes.NewReader(data))
+	return img, err
+}
+
+// copyBytes copies a Uint8Array into Go memory in one call, so the pixel
+// loops never cross the JS boundary.
+func copyBytes(v js.Value) []byte {
+	buf := make([]byte, v.Get("length").Int())
+	js.CopyBytesToGo(buf, v)
+	return buf
+}
+
+func uint8Array(b []byte) js.Value {
+	v := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(v, b)
+	return v
+}
+
+// jsError converts err to a JavaScript Error named after the Go error value
+// or type, which hidden.js throws.
+func jsError(err error) js.Value {
+	name := "Error"
+	switch err.(type) {
+	case *hidden.ChecksumError:
+		name = "ChecksumError"
+	case *hidden.TruncatedError:
+		name = "TruncatedError"
+	case hidden.UnsupportedIntegrityError:
+		name = "UnsupportedIntegrityError"
+	case hidden.UnsupportedCipherError:
+		name = "UnsupportedCipherError"
+	}
+	for _, e := range []struct {
+		err  error
+		name string
+	}{
+		{hidden.ErrNoHiddenMessage, "ErrNoHiddenMessage"},
+		{hidden.ErrUnsupportedImage, "ErrUnsupportedImage"},
+		{hidden.ErrMessageTooLarge, "ErrMessageTooLarge"},
+		{hidden.ErrPassphraseRequired, "ErrPassphraseRequired"},
+		{hidden.ErrDecryptionFailed, "ErrDecryptionFailed"},
+		{hidden.ErrImageTooLarge, "ErrImageTooLarge"},
+		{hidden.ErrBadSignature, "ErrBadSignature"},
+		{hidden.ErrNotSigned, "ErrNotSigned"},
+		{hidden.ErrModified, "ErrModified"},
+		{hidden.ErrSlotted, "ErrSlotted"},
+		{hidden.ErrNoSlot, "ErrNoSlot"},
+		{hidden.ErrNoSlots, "ErrNoSlots"},
+		{image.ErrFormat, "ErrFormat"},
+	} {
+		if errors.Is(err, e.err) {
+			name = e.name
+			break
+		}
+	}
+
+	e := js.Global().Get("Error").New(err.Error())
+	e.Set("name", name)
+	return e
+}
@@ -0,0 +1,218 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// ErrNoHeaderRow is returned by Encode with an Exclude placement when no row
+// of the image starts with enough pixels outside the rectangles to hold the
+// header.
+var ErrNoHeaderRow = errors.New("every row starts in an excluded region, there is no room for the header")
+
+// Exclude stores the payload in the pixels outside Rects, relative to the
+// image origin, and never touches the pixels inside them, like a logo, a
+// transparent area or a border likely to be cropped. The header goes at the
+// start of the first row whose leading pixels are outside Rects, the
+// payload in the free pixels after it. The rectangles are stored in the
+// header, which the decoder finds by trying the start of every row. It
+// needs the header in the red, green and blue channels, like the default
+// layout.
+type Exclude struct {
+	Rects []image.Rectangle
+}
+
+func (Exclude) ID() byte { return 8 }
+
+func (p Exclude) MarshalBinary() ([]byte, error) {
+	if len(p.Rects) == 0 {
+		return nil, errors.New("no regions to exclude")
+	}
+	b := make([]byte, 0, len(p.Rects)*16)
+	for _, r := range p.Rects {
+		v, err := Region{r}.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, v...)
+	}
+	return b, nil
+}
+
+func unmarshalExclude(params []byte) (Placement, error) {
+	if len(params) == 0 || len(params)%16 != 0 {
+		return nil, errors.New("invalid exclude placement")
+	}
+	p := Exclude{make([]image.Rectangle, len(params)/16)}
+	for i := range p.Rects {
+		var c [4]int
+		for j := range c {
+			c[j] = int(int32(binary.BigEndian.Uint32(params[i*16+j*4:])))
+		}
+		p.Rects[i] = image.Rect(c[0], c[1], c[2], c[3])
+	}
+	return p, nil
+}
+
+// excluded reports whether the pixel at pt is in one of the rectangles.
+func (p Exclude) excluded(pt image.Point) bool {
+	for _, r := range p.Rects {
+		if pt.In(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Exclude) Carrier(s Slots) Carrier {
+	c := &excludeCarrier{s: s, next: s.Start, free: make([]bool, s.Width*s.Height)}
+	for i := range c.free {
+		c.free[i] = !p.excluded(s.Pixel(i * s.PerPixel))
+	}
+	if s.Start >= s.Len() {
+		c.next = s.Len()
+		return c
+	}
+
+	first := s.Start / s.PerPixel
+	if c.free[first] {
+		c.remaining = (first+1)*s.PerPixel - s.Start
+	}
+	for _, f := range c.free[first+1:] {
+		if f {
+			c.remaining += s.PerPixel
+		}
+	}
+	return c
+}
+
+// excludeCarrier yields the slots of the free pixels from next in order.
+// free is indexed by the number of the pixel in the slot order.
+type excludeCarrier struct {
+	s               Slots
+	free            []bool
+	next, remaining int
+}
+
+func (c *excludeCarrier) Next() (int, bool) {
+	for c.next < c.s.Len() {
+		if p := c.next / c.s.PerPixel; !c.free[p] {
+			c.next = (p + 1) * c.s.PerPixel
+			continue
+		}
+		c.remaining--
+		c.next++
+		return c.next - 1, true
+	}
+	return 0, false
+}
+
+func (c *excludeCarrier) Remaining() int {
+	return c.remaining
+}
+
+// headerSlot returns the first slot of the first row of s whose leading
+// pixels hold a header of bits carrier bits outside the rectangles.
+func (p Exclude) headerSlot(s Slots, bits int) (int, bool) {
+	pixels := (bits + s.PerPixel - 1) / s.PerPixel
+	for y := 0; y < s.Height; y++ {
+		start := s.Slot(image.Pt(0, y))
+		if start+bits > s.Len() {
+			break
+		}
+		free := true
+		for i := 0; i < pixels && free; i++ {
+			free = !p.excluded(s.Pixel(start + i*s.PerPixel))
+		}
+		if free {
+			return start, true
+		}
+	}
+	return 0, false
+}
+
+// reserve marks the samples of the pixels in the rectangles as used in
+// img, so that PreserveHistogram and Fill leave them alone too.
+func (p Exclude) reserve(img *carrierImage) {
+	size := img.pixelSize()
+	for _, r := range p.Rects {
+		r = r.Intersect(image.Rect(0, 0, img.Rect.Dx(), img.Rect.Dy()))
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			o := y*img.Stride + r.Min.X*size
+			for i := o; i < o+r.Dx()*size; i++ {
+				img.used[i] = true
+			}
+		}
+	}
+}
+
+// excludedHeader returns a reader of img in the bootstrap layout l at the
+// header of an Exclude placement that does not start at the first slot,
+// which embed puts in the first row it fits in, or nil if there is none.
+func excludedHeader(img *carrierImage, l *layout) *lsbReader {
+	r := newLSBReader(img, l)
+	for y := 1; y < r.slots.Height; y++ {
+		start := r.slots.Slot(image.Pt(0, y))
+		r.seek(start)
+		var magic [len(containerMagic)]byte
+		if n, _ := r.read(magic[:]); n < len(magic) || string(magic[:]) != containerMagic {
+			continue
+		}
+
+		r.seek(start)
+		h := &Header{}
+		if h.read(r) != nil {
+			continue
+		}
+		p, err := headerPlacement(h)
+		if e, ok := p.(Exclude); err == nil && ok {
+			if i, ok := e.headerSlot(r.slots, h.Len()*8); ok && i == start {
+				r := newLSBReader(img, l)
+				r.seek(start)
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// checkExclude rejects a depth d that does not keep the header in the red,
+// green and blue channels, where excludedHeader looks for it.
+func checkExclude(d ChannelDepth) error {
+	if d != (ChannelDepth{}) && (d[0] == 0 || d[1] == 0 || d[2] == 0 || d[3] != 0) {
+		return fmt.Errorf("an excluded region needs the header in the red, green and blue channels, not a depth of %v", d)
+	}
+	return nil
+}
+
+// seekHeader moves w to where a header of n bytes goes in placement p: the
+// first row it fits in for Exclude, the first slot for anything else.
+func (w *lsbWriter) seekHeader(p Placement, n int) error {
+	e, ok := p.(Exclude)
+	if !ok {
+		return nil
+	}
+	i, ok := e.headerSlot(w.slots, n*8)
+	if !ok {
+		return ErrNoHeaderRow
+	}
+	w.seek(i)
+	return nil
+}
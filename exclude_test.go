@@ -0,0 +1,78 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"image"
+	"testing"
+)
+
+func TestExcludeRoundTrip(t *testing.T) {
+	rects := []image.Rectangle{
+		image.Rect(0, 0, 20, 12),   // the top left corner, where the header would go
+		image.Rect(40, 20, 64, 30), // a band across the right edge
+		image.Rect(60, 40, 80, 60), // partly outside the image
+	}
+	cover := testCover(64, 48, 315)
+	for name, opt := range map[string]*Options{
+		"plain":     {Placement: Exclude{rects}},
+		"encrypted": {Placement: Exclude{rects}, Passphrase: []byte("pass")},
+		"filled":    {Placement: Exclude{rects}, Fill: true},
+		"histogram": {Placement: Exclude{rects}, PreserveHistogram: true},
+		"depth":     {Placement: Exclude{rects}, Depth: ChannelDepth{2, 2, 2, 0}},
+		"lsb first": {Placement: Exclude{rects}, BitOrder: LSBFirst},
+	} {
+		stego := roundTrip(t, cover, testPayload(400, 315), opt, &Options{Passphrase: opt.Passphrase})
+		got := pixels(t, stego)
+		var changed bool
+		for y := 0; y < 48; y++ {
+			for x := 0; x < 64; x++ {
+				o := cover.PixOffset(x, y)
+				same := string(got[o:o+4]) == string(cover.Pix[o:o+4])
+				in := false
+				for _, r := range rects {
+					in = in || image.Pt(x, y).In(r)
+				}
+				if in && !same {
+					t.Fatalf("%s: excluded pixel %d,%d changed", name, x, y)
+				}
+				changed = changed || !same
+			}
+		}
+		if !changed {
+			t.Errorf("%s: no pixel changed", name)
+		}
+
+		h, err := DecodeHeader(stego)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, err := h.Placement(); err != nil || len(p.(Exclude).Rects) != len(rects) {
+			t.Errorf("%s: header holds placement %v, %v", name, p, err)
+		}
+	}
+}
+
+func TestExcludeNoHeaderRow(t *testing.T) {
+	opt := &Options{Placement: Exclude{[]image.Rectangle{image.Rect(0, 0, 4, 48)}}}
+	if _, err := Encode(testCover(64, 48, 315), []byte("message"), opt); err != ErrNoHeaderRow {
+		t.Errorf("got %v, want ErrNoHeaderRow", err)
+	}
+	opt.Placement = Exclude{[]image.Rectangle{image.Rect(0, 0, 64, 40)}}
+	if _, err := Encode(testCover(64, 48, 315), testPayload(600, 315), opt); err != ErrMessageTooLarge {
+		t.Errorf("got %v, want ErrMessageTooLarge", err)
+	}
+}
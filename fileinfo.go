@@ -0,0 +1,97 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"encoding/binary"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MaxFileName is the size in bytes of the longest FileInfo name.
+const MaxFileName = 255
+
+// FileInfo describes the file a payload was read from, see Options.File.
+// The permissions of the file are not stored, whoever decodes the payload
+// picks the ones to write it with.
+type FileInfo struct {
+	// Name is the name of the file without its directory, UTF-8 text of at
+	// most MaxFileName bytes.
+	Name string
+
+	// ModTime is the modification time of the file, in whole seconds. It
+	// is not stored if it is zero.
+	ModTime time.Time
+
+	// ContentType is the MIME type of the payload, like "text/plain", or
+	// empty if it is not known.
+	ContentType string
+}
+
+func (f *FileInfo) validate() error {
+	switch {
+	case len(f.Name) > MaxFileName:
+		return fmt.Errorf("file name %q is %d bytes, at most %d fit", f.Name, len(f.Name), MaxFileName)
+	case !utf8.ValidString(f.Name):
+		return fmt.Errorf("file name %q is not UTF-8", f.Name)
+	case strings.ContainsAny(f.Name, "/\\\x00") || f.Name == "." || f.Name == "..":
+		return fmt.Errorf("file name %q is not the name of a file in a directory", f.Name)
+	}
+	if f.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(f.ContentType); err != nil {
+			return fmt.Errorf("content type %q: %v", f.ContentType, err)
+		}
+	}
+	return nil
+}
+
+// field returns the FieldFile field holding f.
+func (f *FileInfo) field() Field {
+	v := make([]byte, 9, 9+len(f.Name)+len(f.ContentType))
+	if !f.ModTime.IsZero() {
+		binary.BigEndian.PutUint64(v, uint64(f.ModTime.Unix()))
+	}
+	v[8] = byte(len(f.Name))
+	v = append(v, f.Name...)
+	return Field{FieldFile, append(v, f.ContentType...)}
+}
+
+// Bundle reports whether the payload is a tar archive of several files,
+// marked by a FieldBundle metadata field.
+func (h *Header) Bundle() bool {
+	_, ok := h.Field(FieldBundle)
+	return ok
+}
+
+// File returns the file attributes stored in the FieldFile metadata field.
+func (h *Header) File() (FileInfo, bool) {
+	v, ok := h.Field(FieldFile)
+	if !ok || len(v) < 9 || 9+int(v[8]) > len(v) {
+		return FileInfo{}, false
+	}
+
+	var (
+		n = 9 + int(v[8])
+		f = FileInfo{Name: string(v[9:n]), ContentType: string(v[n:])}
+	)
+	if t := int64(binary.BigEndian.Uint64(v)); t != 0 {
+		f.ModTime = time.Unix(t, 0)
+	}
+	return f, true
+}
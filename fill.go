@@ -0,0 +1,83 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	mrand "math/rand"
+)
+
+// ErrFillUnsupported is returned for the Fill option when encoding anything
+// but the pixels of an image.
+var ErrFillUnsupported = errors.New("filling the unused capacity is only supported in the pixels of an image")
+
+// fillRand returns the source of the bits of Fill for an encode of data:
+// Rand, crypto/rand if nil, or a stream derived from Random and data with
+// Deterministic.
+func (o *Options) fillRand(data []byte) (io.Reader, error) {
+	if o.Deterministic {
+		return derivedRand(o.Random, data)
+	}
+	if o.Rand != nil {
+		return o.Rand, nil
+	}
+	return rand.Reader, nil
+}
+
+// fill sets the carrier bits of l in img whose samples the message left
+// alone, as marked in img.used, to bits read from rnd. With match the
+// lowest bit of a sample is changed like Matching does.
+func fill(img *carrierImage, l *layout, rnd io.Reader, match *mrand.Rand) error {
+	l = l.restrict(img.gray)
+	free := func(f func(o int, depth uint)) {
+		for y := 0; y < img.Rect.Dy(); y++ {
+			for x := 0; x < img.Rect.Dx(); x++ {
+				for _, c := range l.channels {
+					if o := img.sample(x, y, c); !img.used[o] {
+						f(o, l.channelDepth(c))
+					}
+				}
+			}
+		}
+	}
+
+	var n uint
+	free(func(_ int, depth uint) { n += depth })
+	bits := make([]byte, (n+7)/8)
+	if _, err := io.ReadFull(rnd, bits); err != nil {
+		return err
+	}
+
+	w := newLSBWriter(img, l)
+	w.match = match
+	var i uint
+	free(func(o int, depth uint) {
+		for plane := uint(0); plane < depth; plane, i = plane+1, i+1 {
+			bit := bits[i/8] >> (i % 8) & 1
+			if match != nil && plane == 0 {
+				if img.Pix[o]&1 != bit {
+					w.step(o)
+				}
+				continue
+			}
+			img.Pix[o] = img.Pix[o]&^(1<<plane) | bit<<plane
+		}
+	})
+	img.used = nil
+	return nil
+}
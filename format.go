@@ -0,0 +1,293 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// FormatHeadSize is how many bytes of a file Format.Match is given to
+// recognize it by.
+const FormatHeadSize = 16
+
+// Format is a file format that carries a payload, read and written as a
+// whole file rather than as a decoded image. BMP, PNG, GIF, TIFF and ICO
+// are built in, TIFFs and ICOs in their first page and image. Other formats
+// can be added with RegisterFormat, EncodeFile and DecodeFile find them by
+// their first bytes.
+type Format interface {
+	// Name is how users select the format, like "bmp".
+	Name() string
+
+	// Match reports whether a file that starts with head is in the format.
+	// Head is FormatHeadSize bytes, or all of a shorter file.
+	Match(head []byte) bool
+
+	// Capacity returns the largest payload, in bytes, that Encode can hide
+	// in the file read from r with the given options.
+	Capacity(r io.Reader, opt *Options) (int, error)
+
+	// Encode writes the file read from r to w with payload hidden in it.
+	Encode(w io.Writer, r io.Reader, payload []byte, opt *Options) error
+
+	// Decode extracts the payload hidden in the file read from r and
+	// validates it like Decode.
+	Decode(r io.Reader, opt *Options) ([]byte, error)
+
+	// Detect is Detect for the file read from r.
+	Detect(r io.Reader) (int, string, error)
+}
+
+// The built-in formats. BMP is streamed a row at a time like EncodeBMP, so
+// it does not take placements, channel depths or seals. PNG is decoded and
+// encoded as an image and takes all options.
+var (
+	BMP  Format = &fileFormat{"bmp", []string{"BM"}, capacityBMP, EncodeBMP, decodeBMP, detectBMP}
+	PNG  Format = &fileFormat{"png", []string{"\x89PNG\r\n\x1a\n"}, capacityPNG, encodePNG, decodePNG, detectPNG}
+	GIF  Format = &fileFormat{"gif", []string{"GIF8"}, CapacityGIF, EncodeGIF, DecodeGIF, DetectGIF}
+	TIFF Format = &fileFormat{"tiff", []string{"II*\x00", "MM\x00*"},
+		func(r io.Reader, opt *Options) (int, error) { return CapacityTIFF(r, 0, opt) },
+		func(w io.Writer, r io.Reader, payload []byte, opt *Options) error {
+			return EncodeTIFF(w, r, 0, payload, opt)
+		},
+		func(r io.Reader, opt *Options) ([]byte, error) { return DecodeTIFF(r, 0, opt) },
+		func(r io.Reader) (int, string, error) { return DetectTIFF(r, 0) }}
+	ICO Format = &fileFormat{"ico", []string{"\x00\x00\x01\x00", "\x00\x00\x02\x00"},
+		func(r io.Reader, opt *Options) (int, error) { return CapacityICO(r, 0, opt) },
+		func(w io.Writer, r io.Reader, payload []byte, opt *Options) error {
+			return EncodeICO(w, r, 0, payload, opt)
+		},
+		func(r io.Reader, opt *Options) ([]byte, error) { return DecodeICO(r, 0, opt) },
+		func(r io.Reader) (int, string, error) { return DetectICO(r, 0) }}
+)
+
+var (
+	formatMu sync.RWMutex
+	formats  []Format
+)
+
+func init() {
+	RegisterFormat(BMP)
+	RegisterFormat(PNG)
+	RegisterFormat(GIF)
+	RegisterFormat(TIFF)
+	RegisterFormat(ICO)
+}
+
+// RegisterFormat makes a format available to EncodeFile, DecodeFile and
+// LookupFormat. Formats are matched in the order they were registered. It
+// panics if the name is already taken.
+func RegisterFormat(f Format) {
+	formatMu.Lock()
+	defer formatMu.Unlock()
+
+	for _, prev := range formats {
+		if prev.Name() == f.Name() {
+			panic(fmt.Sprintf("hidden: format %s registered twice", f.Name()))
+		}
+	}
+	formats = append(formats, f)
+}
+
+// LookupFormat returns the registered format with the given name.
+func LookupFormat(name string) (Format, bool) {
+	formatMu.RLock()
+	defer formatMu.RUnlock()
+
+	for _, f := range formats {
+		if f.Name() == name {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// Formats returns the registered formats in the order they are matched.
+func Formats() []Format {
+	formatMu.RLock()
+	defer formatMu.RUnlock()
+
+	return append([]Format(nil), formats...)
+}
+
+// MatchFormat returns the first registered format that recognizes head, the
+// start of a file, or nil if none does.
+func MatchFormat(head []byte) Format {
+	if len(head) > FormatHeadSize {
+		head = head[:FormatHeadSize]
+	}
+
+	formatMu.RLock()
+	defer formatMu.RUnlock()
+
+	for _, f := range formats {
+		if f.Match(head) {
+			return f
+		}
+	}
+	return nil
+}
+
+// EncodeFile writes the file read from r to w, in the same format, with
+// payload hidden in it. A file in no registered format fails with
+// image.ErrFormat, like DecodeImage.
+func EncodeFile(w io.Writer, r io.Reader, payload []byte, opt *Options) error {
+	f, r, err := sniffFormat(r)
+	if err != nil {
+		return err
+	}
+	return f.Encode(w, r, payload, opt)
+}
+
+// DecodeFile extracts the payload hidden in the file read from r by
+// EncodeFile, or by the function of its format, and validates it like
+// Decode.
+func DecodeFile(r io.Reader, opt *Options) ([]byte, error) {
+	f, r, err := sniffFormat(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.Decode(r, opt)
+}
+
+// sniffFormat finds the format of the file read from r, and returns a
+// reader that starts over at its first byte.
+func sniffFormat(r io.Reader) (Format, io.Reader, error) {
+	head := make([]byte, FormatHeadSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, err
+	}
+	f := MatchFormat(head[:n])
+	if f == nil {
+		return nil, nil, image.ErrFormat
+	}
+	return f, io.MultiReader(bytes.NewReader(head[:n]), r), nil
+}
+
+// fileFormat is a Format made of the functions of a built-in format.
+type fileFormat struct {
+	name     string
+	magic    []string // any of them starts a file
+	capacity func(r io.Reader, opt *Options) (int, error)
+	encode   func(w io.Writer, r io.Reader, payload []byte, opt *Options) error
+	decode   func(r io.Reader, opt *Options) ([]byte, error)
+	detect   func(r io.Reader) (int, string, error)
+}
+
+func (f *fileFormat) Name() string { return f.name }
+
+func (f *fileFormat) Match(head []byte) bool {
+	for _, m := range f.magic {
+		if bytes.HasPrefix(head, []byte(m)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fileFormat) Capacity(r io.Reader, opt *Options) (int, error) { return f.capacity(r, opt) }
+
+func (f *fileFormat) Encode(w io.Writer, r io.Reader, payload []byte, opt *Options) error {
+	return f.encode(w, r, payload, opt)
+}
+
+func (f *fileFormat) Decode(r io.Reader, opt *Options) ([]byte, error) { return f.decode(r, opt) }
+
+func (f *fileFormat) Detect(r io.Reader) (int, string, error) { return f.detect(r) }
+
+// capacityBMP is Capacity for the rows EncodeBMP writes.
+func capacityBMP(r io.Reader, opt *Options) (int, error) {
+	if opt.placement() != nil || opt.layout() != nil || opt.seal() || opt.copies() > 1 {
+		return 0, ErrBMPStream
+	}
+	h, err := opt.header()
+	if err != nil {
+		return 0, err
+	}
+	_, f, err := readBMPHeader(r)
+	if err != nil {
+		return 0, err
+	}
+	return opt.payloadCapacity(&h, f.width*f.height*3/8-h.Len()), nil
+}
+
+func decodeBMP(r io.Reader, opt *Options) ([]byte, error) {
+	rs, err := seeker(r)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeBMP(rs, opt)
+}
+
+func detectBMP(r io.Reader) (int, string, error) {
+	rs, err := seeker(r)
+	if err != nil {
+		return 0, "", err
+	}
+	return DetectBMP(rs)
+}
+
+// seeker returns r if it can seek, or else all of it read into memory.
+func seeker(r io.Reader) (io.ReadSeeker, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+	data, err := ioutil.ReadAll(r)
+	return bytes.NewReader(data), err
+}
+
+func capacityPNG(r io.Reader, opt *Options) (int, error) {
+	img, _, err := DecodeImage(r)
+	if err != nil {
+		return 0, err
+	}
+	return Capacity(img, opt), nil
+}
+
+func encodePNG(w io.Writer, r io.Reader, payload []byte, opt *Options) error {
+	img, _, err := DecodeImage(r)
+	if err != nil {
+		return err
+	}
+	stego, err := Encode(img, payload, opt)
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, stego)
+}
+
+func decodePNG(r io.Reader, opt *Options) ([]byte, error) {
+	img, _, err := DecodeImage(r)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(img, opt)
+}
+
+func detectPNG(r io.Reader) (int, string, error) {
+	img, _, err := DecodeImage(r)
+	if err != nil {
+		return 0, "", err
+	}
+	return Detect(img)
+}
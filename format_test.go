@@ -0,0 +1,97 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"testing"
+
+	"golang.org/x/image/bmp"
+)
+
+// TestEncodeFile round trips a message through every built-in format,
+// found by the first bytes of the file alone.
+func TestEncodeFile(t *testing.T) {
+	cover := testCover(60, 40, 284)
+	encode := func(enc func(*bytes.Buffer, image.Image) error) []byte {
+		var buf bytes.Buffer
+		if err := enc(&buf, cover); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	files := map[string][]byte{
+		"bmp":  encode(func(b *bytes.Buffer, m image.Image) error { return bmp.Encode(b, m) }),
+		"png":  encode(func(b *bytes.Buffer, m image.Image) error { return png.Encode(b, m) }),
+		"gif":  testGIF(t, 284),
+		"tiff": testTIFF(t, false, cover),
+		"ico":  icoOf(dibEntry(32, 32, 32, 284)),
+	}
+
+	payload := testPayload(64, 284)
+	for name, data := range files {
+		t.Run(name, func(t *testing.T) {
+			f := MatchFormat(data)
+			if f == nil || f.Name() != name {
+				t.Fatalf("matched %v", f)
+			}
+			if g, ok := LookupFormat(name); !ok || g != f {
+				t.Errorf("LookupFormat: got %v, %v", g, ok)
+			}
+
+			var stego bytes.Buffer
+			if err := EncodeFile(&stego, bytes.NewReader(data), payload, nil); err != nil {
+				t.Fatal(err)
+			}
+			if f := MatchFormat(stego.Bytes()); f == nil || f.Name() != name {
+				t.Errorf("encoded into %v", f)
+			}
+			got, err := DecodeFile(bytes.NewReader(stego.Bytes()), nil)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Fatalf("DecodeFile: %v", err)
+			}
+			if n, _, err := f.Detect(bytes.NewReader(stego.Bytes())); err != nil || n != len(payload) {
+				t.Errorf("Detect: %d bytes, %v", n, err)
+			}
+		})
+	}
+
+	if err := EncodeFile(new(bytes.Buffer), bytes.NewReader([]byte("not an image")), payload, nil); err != image.ErrFormat {
+		t.Errorf("unknown format: got %v, want image.ErrFormat", err)
+	}
+}
+
+// icoOf is an ICO with a single 32x32, 32 bit entry holding data.
+func icoOf(data []byte) []byte {
+	out := []byte{0, 0, 1, 0, 1, 0, 32, 32, 0, 0, 1, 0, 32, 0}
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(data)))
+	out = binary.LittleEndian.AppendUint32(out, icoHeaderLen+icoEntryLen)
+	return append(out, data...)
+}
+
+// TestRegisterFormatTwice registers a second format named like a built-in
+// one, which panics rather than shadowing it.
+func TestRegisterFormatTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering png twice did not panic")
+		}
+	}()
+	RegisterFormat(&fileFormat{name: "png"})
+}
@@ -0,0 +1,205 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/bmp"
+)
+
+// The files in testdata/malformed are damaged or hostile: truncated, with
+// absurd dimensions, or pixel data shorter than their header claims.
+// header-*.bin are damaged container headers, the rest image files.
+
+// malformedFiles returns the names and contents of the fixtures whose names
+// match pattern.
+func malformedFiles(t testing.TB, pattern string) map[string][]byte {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join("testdata", "malformed", pattern))
+	if err != nil || len(names) == 0 {
+		t.Fatalf("no fixtures match %s: %v", pattern, err)
+	}
+	files := make(map[string][]byte)
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[filepath.Base(name)] = data
+	}
+	return files
+}
+
+// fuzzPad is the one-time pad the fuzzer decodes with, so it reaches the
+// pad field of the header.
+var fuzzPad = testPad(64, 1)
+
+// fuzzLimits keep the fuzzer from spending its time on large allocations.
+var fuzzLimits = &Limits{MaxPixels: 1 << 20, MaxFileSize: 1 << 20}
+
+// checkImageError fails t unless err is one of the errors DecodeImage
+// documents.
+func checkImageError(t *testing.T, err error) {
+	t.Helper()
+	if err == nil || err == image.ErrFormat || errors.Is(err, ErrImageTooLarge) || errors.As(err, new(*MalformedImageError)) {
+		return
+	}
+	t.Errorf("untyped error %T: %v", err, err)
+}
+
+func TestMalformedImages(t *testing.T) {
+	want := map[string]string{
+		"bmp-bad-depth.bmp":        "malformed",
+		"bmp-bad-offset.bmp":       "malformed",
+		"bmp-huge-dimensions.bmp":  "too large",
+		"bmp-huge-rows.bmp":        "too large",
+		"bmp-negative-width.bmp":   "malformed",
+		"bmp-short-pixels.bmp":     "malformed",
+		"bmp-truncated-header.bmp": "malformed",
+		"empty":                    "unknown format",
+		"gif-huge-dimensions.gif":  "too large",
+		"gif-truncated.gif":        "malformed",
+		"jpeg-huge-dimensions.jpg": "too large",
+		"jpeg-truncated.jpg":       "malformed",
+		"png-bad-crc.png":          "malformed",
+		"png-bad-zlib.png":         "malformed",
+		"png-huge-dimensions.png":  "too large",
+		"png-truncated.png":        "malformed",
+		"text.txt":                 "unknown format",
+		"tiff-bad-offset.tif":      "malformed",
+		"tiff-truncated.tif":       "malformed",
+	}
+	files := malformedFiles(t, "*")
+	for name := range files {
+		if strings.HasPrefix(name, "header-") {
+			continue
+		}
+		if _, ok := want[name]; !ok {
+			t.Errorf("%s: no expected error", name)
+		}
+	}
+
+	for name, kind := range want {
+		data, ok := files[name]
+		if !ok {
+			t.Errorf("%s: fixture is missing", name)
+			continue
+		}
+		img, _, err := DecodeImage(bytes.NewReader(data))
+		var got string
+		switch {
+		case err == nil:
+			t.Errorf("%s: decoded a %v image", name, img.Bounds())
+			continue
+		case err == image.ErrFormat:
+			got = "unknown format"
+		case errors.Is(err, ErrImageTooLarge):
+			got = "too large"
+		case errors.As(err, new(*MalformedImageError)):
+			got = "malformed"
+		default:
+			got = "untyped"
+		}
+		if got != kind {
+			t.Errorf("%s: got %v, %s, want %s", name, err, got, kind)
+		}
+
+		if _, err := DecodeFile(bytes.NewReader(data), nil); err == nil {
+			t.Errorf("%s: DecodeFile found a message", name)
+		}
+	}
+}
+
+func TestMalformedHeaders(t *testing.T) {
+	for name, data := range malformedFiles(t, "header-*.bin") {
+		if err := new(Header).UnmarshalBinary(data); err == nil {
+			t.Errorf("%s: unmarshaled", name)
+		}
+	}
+}
+
+// FuzzDecode opens arbitrary files as images, the way every decoding
+// command does, and decodes what opens. Run it with
+// go test -fuzz FuzzDecode -race.
+func FuzzDecode(f *testing.F) {
+	for _, data := range malformedFiles(f, "*") {
+		f.Add(data)
+	}
+	stego, err := Encode(testCover(16, 16, 1), []byte("hello"), &Options{Compression: Deflate, ECC: 4})
+	if err != nil {
+		f.Fatal(err)
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, stego)
+	f.Add(append([]byte(nil), buf.Bytes()...))
+	buf.Reset()
+	bmp.Encode(&buf, stego)
+	f.Add(append([]byte(nil), buf.Bytes()...))
+	buf.Reset()
+	png.Encode(&buf, padImage(f, fuzzPad, make([]byte, 54)))
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		img, _, err := DecodeImageLimits(bytes.NewReader(data), fuzzLimits)
+		checkImageError(t, err)
+		if err == nil {
+			Decode(img, nil)
+			Decode(img, &Options{Pad: fuzzPad})
+			Detect(img)
+		}
+		if fuzzLimits.Check(data) == nil {
+			DecodeFile(bytes.NewReader(data), nil)
+		}
+	})
+}
+
+// FuzzHeaderUnmarshal parses arbitrary bytes as a container header. Whatever
+// it accepts has to marshal back to exactly the same bytes.
+func FuzzHeaderUnmarshal(f *testing.F) {
+	for _, data := range malformedFiles(f, "header-*.bin") {
+		f.Add(data)
+	}
+	for _, h := range testHeaders(f) {
+		data, err := h.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var h Header
+		if err := h.UnmarshalBinary(data); err != nil {
+			return
+		}
+		again, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatalf("unmarshaled %x, which does not marshal: %v", data, err)
+		}
+		if !bytes.Equal(again, data) {
+			t.Fatalf("unmarshaled %x, which marshals to %x", data, again)
+		}
+	})
+}
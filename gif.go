@@ -0,0 +1,361 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/color"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// EncodeGIF and DecodeGIF store a message in the palette indices of all the
+// frames of a GIF, used as one carrier in frame order. Every palette is
+// reordered so that similar colors are in pairs, entries 2k and 2k+1, and a
+// pixel carries a bit in the lowest bit of its index, which swaps its color
+// for the other one of the pair. Pixels whose pair includes the transparent
+// color are left alone, so what every frame covers stays the same. The frame
+// geometry, delays, disposal methods and loop count are kept as they are.
+
+// ErrGIFPlacement is returned for options with a Placement other than
+// Sequential, they only apply to pixels.
+var ErrGIFPlacement = errors.New("placements are not supported in GIF images")
+
+// readGIF decodes every frame of the GIF read from r, returning what the
+// decoder gets wrong as a *MalformedImageError.
+func readGIF(r io.Reader) (g *gif.GIF, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, &MalformedImageError{"gif", err}
+	}
+	if err := checkDimensions(cfg.Width, cfg.Height); err != nil {
+		return nil, malformed("gif", err)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			g, err = nil, &MalformedImageError{"gif", fmt.Errorf("decoder panic: %v", r)}
+		}
+	}()
+	if g, err = gif.DecodeAll(bytes.NewReader(data)); err != nil {
+		return nil, &MalformedImageError{"gif", err}
+	}
+	return g, nil
+}
+
+func transparent(c color.Color) bool {
+	_, _, _, a := c.RGBA()
+	return a == 0
+}
+
+// pairColors returns an order of the entries of p that puts similar colors
+// in pairs: entry i of the reordered palette is p[order[i]]. The closest two
+// colors are paired first, then the closest two of the rest, and so on.
+// Transparent entries go last, paired with what is left over.
+func pairColors(p color.Palette) []int {
+	type pair struct {
+		i, j int
+		dist int64
+	}
+
+	var (
+		pairs  []pair
+		opaque []int
+		rgb    = make([][3]int64, len(p))
+	)
+	for i, c := range p {
+		r, g, b, _ := c.RGBA()
+		rgb[i] = [3]int64{int64(r >> 8), int64(g >> 8), int64(b >> 8)}
+		if !transparent(c) {
+			opaque = append(opaque, i)
+		}
+	}
+	for n, i := range opaque {
+		for _, j := range opaque[n+1:] {
+			var d int64
+			for k := range rgb[i] {
+				d += (rgb[i][k] - rgb[j][k]) * (rgb[i][k] - rgb[j][k])
+			}
+			pairs = append(pairs, pair{i, j, d})
+		}
+	}
+	sort.SliceStable(pairs, func(a, b int) bool { return pairs[a].dist < pairs[b].dist })
+
+	var (
+		order = make([]int, 0, len(p))
+		used  = make([]bool, len(p))
+	)
+	for _, pr := range pairs {
+		if !used[pr.i] && !used[pr.j] {
+			used[pr.i], used[pr.j] = true, true
+			order = append(order, pr.i, pr.j)
+		}
+	}
+	for _, i := range opaque {
+		if !used[i] {
+			order = append(order, i)
+		}
+	}
+	for i, c := range p {
+		if transparent(c) {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// pairPalettes reorders the palettes of g with pairColors, and the pixels
+// and background index with them. A frame with a copy of the global palette,
+// which the decoder makes to mark a transparent color, is reordered like the
+// global palette so that the encoder can still leave its table out.
+func pairPalettes(g *gif.GIF) {
+	var (
+		global, _   = g.Config.ColorModel.(color.Palette)
+		original    = append(color.Palette{}, global...)
+		globalOrder []int
+		inverses    = map[*color.Color][]int{}
+	)
+	if len(global) > 0 {
+		globalOrder = pairColors(global)
+	}
+
+	reorder := func(p color.Palette, order []int) []int {
+		if inv, ok := inverses[&p[0]]; ok {
+			return inv
+		}
+		inv := make([]int, len(p))
+		sorted := make(color.Palette, len(p))
+		for i, o := range order {
+			sorted[i], inv[o] = p[o], i
+		}
+		copy(p, sorted)
+		inverses[&p[0]] = inv
+		return inv
+	}
+
+	if len(global) > 0 {
+		if inv := reorder(global, globalOrder); int(g.BackgroundIndex) < len(inv) {
+			g.BackgroundIndex = byte(inv[g.BackgroundIndex])
+		}
+	}
+
+	for _, m := range g.Image {
+		p := m.Palette
+		if len(p) == 0 {
+			continue
+		}
+
+		order := globalOrder
+		if _, done := inverses[&p[0]]; !done && !derivedPalette(p, original) {
+			order = pairColors(p)
+		}
+		inv := reorder(p, order)
+
+		w := m.Rect.Dx()
+		for y := 0; y < m.Rect.Dy(); y++ {
+			row := m.Pix[y*m.Stride : y*m.Stride+w]
+			for x, v := range row {
+				if int(v) < len(inv) {
+					row[x] = byte(inv[v])
+				}
+			}
+		}
+	}
+}
+
+// derivedPalette reports whether p is global with some colors made
+// transparent.
+func derivedPalette(p, global color.Palette) bool {
+	if len(p) != len(global) {
+		return false
+	}
+	for i := range p {
+		if p[i] != global[i] && !transparent(p[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// gifPixels calls f with every pixel of the frames of g that carries a bit,
+// in order, until it returns false.
+func gifPixels(g *gif.GIF, f func(index *uint8) bool) {
+	for _, m := range g.Image {
+		var carries [256]bool
+		for i := range m.Palette {
+			j := i ^ 1
+			carries[i] = j < len(m.Palette) && !transparent(m.Palette[i]) && !transparent(m.Palette[j])
+		}
+
+		w := m.Rect.Dx()
+		for y := 0; y < m.Rect.Dy(); y++ {
+			row := m.Pix[y*m.Stride : y*m.Stride+w]
+			for x := range row {
+				if carries[row[x]] && !f(&row[x]) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// EncodeGIF copies the GIF read from r to w with payload hidden in the
+// frames, see CapacityGIF for how much fits.
+func EncodeGIF(w io.Writer, r io.Reader, payload []byte, opt *Options) error {
+	if opt.placement() != nil {
+		return ErrGIFPlacement
+	}
+	if opt.lsbFirst() {
+		return ErrBitOrderUnsupported
+	}
+	if opt.layout() != nil {
+		return ErrDepthUnsupported
+	}
+	if opt.seal() {
+		return ErrSealUnsupported
+	}
+	if opt.copies() > 1 {
+		return ErrCopiesUnsupported
+	}
+	if opt.matching() {
+		return ErrMatchingUnsupported
+	}
+	if opt.preserveHistogram() {
+		return ErrHistogramUnsupported
+	}
+	if opt.fill() {
+		return ErrFillUnsupported
+	}
+	header, payload, err := container(payload, opt)
+	if err != nil {
+		return err
+	}
+
+	g, err := readGIF(r)
+	if err != nil {
+		return err
+	}
+	pairPalettes(g)
+
+	var (
+		data = append(header, payload...)
+		bits = unpackBits(data)
+		n    int
+	)
+	defer Wipe(data, bits)
+	gifPixels(g, func(index *uint8) bool {
+		*index = *index&^1 | bits[n]
+		n++
+		return n < len(bits)
+	})
+	if n < len(bits) {
+		return ErrMessageTooLarge
+	}
+	return gif.EncodeAll(w, g)
+}
+
+// DecodeGIF extracts the payload EncodeGIF hid in the GIF read from r, and
+// validates it like Decode.
+func DecodeGIF(r io.Reader, opt *Options) ([]byte, error) {
+	msg, h, err := extractGIF(r)
+	if err != nil {
+		return nil, err
+	}
+	return h.open(msg, opt)
+}
+
+// DetectGIF is Detect for the GIF read from r, the format is prefixed with
+// "gif/".
+func DetectGIF(r io.Reader) (int, string, error) {
+	msg, h, err := extractGIF(r)
+	if err != nil {
+		return 0, "", err
+	}
+	return len(msg), "gif/" + detectFormat(msg, h), nil
+}
+
+// DecodeHeaderGIF is DecodeHeader for the GIF read from r, see DecodeGIF.
+func DecodeHeaderGIF(r io.Reader) (*Header, error) {
+	_, h, err := extractGIF(r)
+	return h, err
+}
+
+func extractGIF(r io.Reader) ([]byte, *Header, error) {
+	g, err := readGIF(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var bits []byte
+	gifPixels(g, func(index *uint8) bool {
+		bits = append(bits, *index&1)
+		return true
+	})
+	defer Wipe(bits)
+	return readContainer(packBits(bits))
+}
+
+// CapacityGIF returns the largest payload, in bytes, that EncodeGIF can hide
+// in the GIF read from r with the given options.
+func CapacityGIF(r io.Reader, opt *Options) (int, error) {
+	h, err := opt.header()
+	if err != nil {
+		return 0, err
+	}
+	if opt.placement() != nil {
+		return 0, ErrGIFPlacement
+	}
+	if opt.lsbFirst() {
+		return 0, ErrBitOrderUnsupported
+	}
+	if opt.layout() != nil {
+		return 0, ErrDepthUnsupported
+	}
+	if opt.seal() {
+		return 0, ErrSealUnsupported
+	}
+	if opt.matching() {
+		return 0, ErrMatchingUnsupported
+	}
+	if opt.preserveHistogram() {
+		return 0, ErrHistogramUnsupported
+	}
+	if opt.fill() {
+		return 0, ErrFillUnsupported
+	}
+
+	g, err := readGIF(r)
+	if err != nil {
+		return 0, err
+	}
+	pairPalettes(g)
+
+	var n int
+	gifPixels(g, func(*uint8) bool {
+		n++
+		return true
+	})
+	return opt.payloadCapacity(&h, n/8-h.Len()), nil
+}
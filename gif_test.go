@@ -0,0 +1,178 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"math/rand"
+	"testing"
+)
+
+// testGIF returns an animation of three 40x30 frames drawn from seed: one
+// in the global palette, a smaller one in a copy of it with a transparent
+// color, and one in a local palette.
+func testGIF(t testing.TB, seed int64) []byte {
+	t.Helper()
+	rnd := rand.New(rand.NewSource(seed))
+	palette := func(n int) color.Palette {
+		p := make(color.Palette, n)
+		for i := range p {
+			p[i] = color.RGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 0xff}
+		}
+		return p
+	}
+	frame := func(r image.Rectangle, p color.Palette) *image.Paletted {
+		m := image.NewPaletted(r, p)
+		for i := range m.Pix {
+			m.Pix[i] = uint8(rnd.Intn(len(p)))
+		}
+		return m
+	}
+
+	global := palette(16)
+	withAlpha := append(color.Palette{}, global...)
+	withAlpha[3] = color.RGBA{}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 40, 30), global),
+			frame(image.Rect(5, 4, 35, 24), withAlpha),
+			frame(image.Rect(0, 0, 40, 30), palette(8)),
+		},
+		Delay:           []int{10, 20, 30},
+		Disposal:        []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious},
+		LoopCount:       3,
+		BackgroundIndex: 5,
+		Config:          image.Config{ColorModel: global, Width: 40, Height: 30},
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestGIF round trips payloads through the frames of an animation, which
+// keeps its geometry and timing, and what is transparent.
+func TestGIF(t *testing.T) {
+	data := testGIF(t, 148)
+	cover, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	capacity, err := CapacityGIF(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := cover.Image[0].Rect.Dx() * cover.Image[0].Rect.Dy() / 8
+	if capacity <= first {
+		t.Fatalf("capacity %d, want more than the %d bytes of the first frame", capacity, first)
+	}
+
+	for _, size := range []int{0, 10, first + 10, capacity} {
+		payload := testPayload(size, 148)
+		var buf bytes.Buffer
+		if err := EncodeGIF(&buf, bytes.NewReader(data), payload, nil); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if got, err := DecodeGIF(bytes.NewReader(buf.Bytes()), nil); err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("%d bytes: decoded %d bytes that are not the payload, %v", size, len(got), err)
+		}
+		if n, format, err := DetectGIF(bytes.NewReader(buf.Bytes())); err != nil || n != size || format[:4] != "gif/" {
+			t.Errorf("%d bytes: detected %d bytes as %q, %v", size, n, format, err)
+		}
+
+		stego, err := gif.DecodeAll(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stego.Image) != len(cover.Image) || stego.LoopCount != cover.LoopCount ||
+			!bytes.Equal(stego.Disposal, cover.Disposal) || stego.Config.Width != cover.Config.Width {
+			t.Fatalf("%d bytes: the animation changed", size)
+		}
+		for i, m := range stego.Image {
+			c := cover.Image[i]
+			if m.Rect != c.Rect || stego.Delay[i] != cover.Delay[i] {
+				t.Errorf("%d bytes: frame %d is %v for %d, want %v for %d", size, i, m.Rect, stego.Delay[i], c.Rect, cover.Delay[i])
+			}
+			for y := m.Rect.Min.Y; y < m.Rect.Max.Y; y++ {
+				for x := m.Rect.Min.X; x < m.Rect.Max.X; x++ {
+					if transparent(m.At(x, y)) != transparent(c.At(x, y)) {
+						t.Fatalf("%d bytes: pixel %d,%d of frame %d changed its transparency", size, x, y, i)
+					}
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeGIF(&buf, bytes.NewReader(data), testPayload(capacity+1, 148), nil); err != ErrMessageTooLarge {
+		t.Errorf("one byte too many: got %v, want %v", err, ErrMessageTooLarge)
+	}
+	for _, c := range []struct {
+		opt  *Options
+		want error
+	}{
+		{&Options{Placement: Permuted{}}, ErrGIFPlacement},
+		{&Options{Matching: true}, ErrMatchingUnsupported},
+		{&Options{Seal: true}, ErrSealUnsupported},
+	} {
+		if err := EncodeGIF(&buf, bytes.NewReader(data), []byte("x"), c.opt); err != c.want {
+			t.Errorf("got %v, want %v", err, c.want)
+		}
+	}
+}
+
+// TestPairPalettes reorders the palettes of an animation, which leaves every
+// frame looking the same and puts the closest colors in pairs.
+func TestPairPalettes(t *testing.T) {
+	data := testGIF(t, 148)
+	cover, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paired, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairPalettes(paired)
+
+	for i, m := range paired.Image {
+		c := cover.Image[i]
+		for y := m.Rect.Min.Y; y < m.Rect.Max.Y; y++ {
+			for x := m.Rect.Min.X; x < m.Rect.Max.X; x++ {
+				if m.At(x, y) != c.At(x, y) {
+					t.Fatalf("frame %d: pixel %d,%d changed color", i, x, y)
+				}
+			}
+		}
+	}
+	if got, want := paired.Config.ColorModel.(color.Palette)[paired.BackgroundIndex], cover.Config.ColorModel.(color.Palette)[cover.BackgroundIndex]; got != want {
+		t.Errorf("the background color changed from %v to %v", want, got)
+	}
+
+	p := color.Palette{
+		color.RGBA{0, 0, 0, 0xff}, color.RGBA{200, 0, 0, 0xff}, color.RGBA{0, 0, 0, 0},
+		color.RGBA{2, 2, 2, 0xff}, color.RGBA{201, 1, 0, 0xff},
+	}
+	if order := pairColors(p); fmt.Sprint(order) != "[1 4 0 3 2]" {
+		t.Errorf("got order %v, want the closest pair 1 and 4, then 0 and 3, and the transparent 2 last", order)
+	}
+}
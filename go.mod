@@ -0,0 +1,20 @@
+module github.com/andreas-jonsson/hidden
+
+go 1.26.0
+
+require (
+	filippo.io/age v1.3.2
+	github.com/ProtonMail/go-crypto v1.5.1
+	github.com/atotto/clipboard v0.1.4
+	github.com/fsnotify/fsnotify v1.10.1
+	github.com/klauspost/compress v1.20.1
+	golang.org/x/crypto v0.57.0
+	golang.org/x/image v0.46.0
+	golang.org/x/term v0.46.0
+)
+
+require (
+	filippo.io/hpke v0.4.0 // indirect
+	github.com/cloudflare/circl v1.6.3 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+)
@@ -0,0 +1,88 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+// With the Hamming ECCScheme every byte of the payload, after encryption,
+// is stored as two bytes, the high half byte first, each an extended
+// Hamming(8,4) codeword: bit i, from the lowest, is bit i of the Hamming(7,4)
+// codeword for i from 1 to 7, with the parity bits at 1, 2 and 4, and bit 0
+// the parity of all of them. Decoding repairs one flipped bit in every
+// codeword and detects two, which CPU and capacity pay far less for than
+// Reed-Solomon, but a run of damaged bits is beyond it.
+var (
+	hammingCode [16]byte
+
+	// hammingData holds, for every byte as it is read, the half byte it
+	// decodes to, and hammingRepaired if that repaired it. A byte with two
+	// flipped bits decodes to its data bits as they are.
+	hammingData [256]byte
+)
+
+const hammingRepaired = 1 << 4
+
+func init() {
+	for i := range hammingData {
+		c := byte(i)
+		hammingData[i] = c>>3&1 | c>>4&0xe
+	}
+	for d := byte(0); d < 16; d++ {
+		d1, d2, d3, d4 := d&1, d>>1&1, d>>2&1, d>>3&1
+		c := (d1^d2^d4)<<1 | (d1^d3^d4)<<2 | d1<<3 | (d2^d3^d4)<<4 | d2<<5 | d3<<6 | d4<<7
+		if oddParity(c) {
+			c |= 1
+		}
+		hammingCode[d] = c
+
+		hammingData[c] = d
+		for bit := uint(0); bit < 8; bit++ {
+			hammingData[c^1<<bit] = d | hammingRepaired
+		}
+	}
+}
+
+// oddParity reports whether an odd number of the bits of b are set.
+func oddParity(b byte) bool {
+	b ^= b >> 4
+	b ^= b >> 2
+	b ^= b >> 1
+	return b&1 != 0
+}
+
+// hamming is the Hamming ECCScheme.
+type hamming struct{}
+
+func (hamming) encode(payload []byte) []byte {
+	out := make([]byte, 2*len(payload))
+	for i, b := range payload {
+		out[2*i], out[2*i+1] = hammingCode[b>>4], hammingCode[b&0xf]
+	}
+	return out
+}
+
+func (hamming) decode(stored []byte) ([]byte, int) {
+	payload := make([]byte, len(stored)/2)
+	var repaired int
+	for i := range payload {
+		hi, lo := hammingData[stored[2*i]], hammingData[stored[2*i+1]]
+		payload[i] = hi<<4 | lo&0xf
+		repaired += int(hi>>4&1 + lo>>4&1)
+	}
+	return payload, repaired
+}
+
+func (hamming) capacity(n int) int { return n / 2 }
+
+func (hamming) field() []byte { return []byte{0, byte(Hamming)} }
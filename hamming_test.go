@@ -0,0 +1,90 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"testing"
+)
+
+func TestHammingCodewords(t *testing.T) {
+	var code hamming
+	for d := 0; d < 256; d++ {
+		stored := code.encode([]byte{byte(d)})
+		for i := range stored {
+			for bit := uint(0); bit < 8; bit++ {
+				damaged := append([]byte(nil), stored...)
+				damaged[i] ^= 1 << bit
+				got, repaired := code.decode(damaged)
+				if got[0] != byte(d) || repaired != 1 {
+					t.Fatalf("%#02x with bit %d of byte %d flipped: decoded %#02x, %d repaired", d, bit, i, got[0], repaired)
+				}
+			}
+		}
+		if got, repaired := code.decode(stored); got[0] != byte(d) || repaired != 0 {
+			t.Fatalf("%#02x: decoded %#02x, %d repaired", d, got[0], repaired)
+		}
+	}
+}
+
+// damagedHamming returns stego with the Hamming codewords of its payload
+// damaged by damage.
+func damagedHamming(t *testing.T, stego image.Image, damage func(payload []byte)) image.Image {
+	t.Helper()
+	c, err := ExtractContainer(stego)
+	if err != nil {
+		t.Fatal(err)
+	}
+	damage(c.Payload)
+	img, err := EncodeContainer(testCover(64, 64, 1), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestHammingRepair(t *testing.T) {
+	msg := testPayload(500, 1)
+	stego, err := Encode(testCover(64, 64, 1), msg, &Options{ECCScheme: Hamming})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One bit of every codeword, a different one each time.
+	img := damagedHamming(t, stego, func(p []byte) {
+		for i := range p {
+			p[i] ^= 1 << uint(i%8)
+		}
+	})
+	got, repaired, err := DecodeRepaired(img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Error("the repaired message differs")
+	}
+	if repaired != 2*len(msg) {
+		t.Errorf("repaired %d codewords, want %d", repaired, 2*len(msg))
+	}
+
+	// Two data bits of one codeword.
+	img = damagedHamming(t, stego, func(p []byte) { p[100] ^= 1<<3 | 1<<5 })
+	if _, err := Decode(img, nil); !errors.As(err, new(*ChecksumError)) {
+		t.Errorf("two flipped bits in a codeword: got %v, want a ChecksumError", err)
+	}
+}
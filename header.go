@@ -0,0 +1,678 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// The container header comes in two formats, both big endian unless
+// FlagLittleEndian is set. The legacy header, version 0, is a 32 bit length
+// followed by the Adler-32 checksum. Without a magic it is as likely to be
+// noise, so images are only decoded with it with Options.Legacy.
+// The current one starts with containerMagic, which is too large to be a
+// legacy length in any image, followed by:
+//
+//	version    1 byte, containerVersion
+//	flags      1 byte
+//	integrity  1 byte, ID of the Integrity algorithm
+//	length     4 bytes, 8 with FlagLength64
+//	checksum   Integrity.Size() bytes
+//	metadata   only with FlagMetadata: a 16 bit length and the fields,
+//	           each a type byte, a 16 bit length and the value
+//
+// The checksum covers the metadata and the payload as stored, encrypted or
+// not, but without the parity of FlagECC.
+const (
+	containerMagic   = "HIDN"
+	containerVersion = 1
+
+	maxInt = int(^uint(0) >> 1)
+)
+
+// Header flags.
+const (
+	// FlagEncrypted marks an encrypted payload.
+	FlagEncrypted = 1 << iota
+
+	// FlagMetadata marks a header with metadata fields.
+	FlagMetadata
+
+	// FlagResync marks a payload stored as blocks behind resync markers,
+	// see Options.BlockSize.
+	FlagResync
+
+	// FlagLength64 marks a header with a 64 bit length, for payloads that
+	// do not fit in 32 bits. Encode sets it when needed.
+	FlagLength64
+
+	// FlagPad marks a payload XORed with a one-time pad, described by a
+	// FieldPad field, see Options.Pad.
+	FlagPad
+
+	// FlagChunked marks a payload stored as length prefixed chunks, see
+	// Options.ChunkSize. The checksum covers the checksums of the chunks.
+	FlagChunked
+
+	// FlagECC marks a payload stored as codewords of an error correcting
+	// code, described by a FieldECC field, see Options.ECC.
+	FlagECC
+
+	// FlagLittleEndian marks a header whose length and metadata lengths
+	// are little endian, see Options.LittleEndian. The fields themselves
+	// are not affected.
+	FlagLittleEndian
+
+	knownFlags = FlagEncrypted | FlagMetadata | FlagResync | FlagLength64 | FlagPad | FlagChunked | FlagECC | FlagLittleEndian
+)
+
+// Header is the container header stored in front of the payload. Encode
+// and Decode use it, so MarshalBinary and UnmarshalBinary produce and accept
+// exactly what is embedded in an image.
+type Header struct {
+	// Version is 0 for the legacy format, which only has Length and an
+	// Adler-32 Checksum.
+	Version byte
+	Flags   byte
+
+	Integrity Integrity
+
+	// Length is the size of the payload as stored, including resync
+	// blocks and parity.
+	Length   int
+	Checksum []byte
+
+	// Metadata is only stored if FlagMetadata is set.
+	Metadata []Field
+
+	// repaired is the number of payload bytes the parity repaired, when
+	// the payload was read from an image.
+	repaired int
+}
+
+// Field is a metadata entry in the header.
+type Field struct {
+	Type  byte
+	Value []byte
+}
+
+// Metadata field types.
+const (
+	// FieldPlacement holds the ID and parameters of the Placement of the
+	// payload, unless it is Sequential.
+	FieldPlacement = 1
+
+	// FieldExpiry holds the time, in Unix seconds as 64 bits, after which
+	// the payload is not decoded, see Options.Expires.
+	FieldExpiry = 2
+
+	// FieldPad marks a payload XORed with a one-time pad. It holds the
+	// offset into the pad as 64 bits, followed by the pad ID, see Pad.
+	FieldPad = 3
+
+	// FieldSpan holds the number of carrier bits of every page of a
+	// document a payload is stored across, as 32 bits each, see SpanPages.
+	FieldSpan = 4
+
+	// FieldDepth holds the depth of the R, G and B channels, a byte each,
+	// when the payload is stored in a ChannelDepth other than one bit of
+	// every channel.
+	FieldDepth = 5
+
+	// FieldUser holds a key and value given by the user: the size of the
+	// key as a byte, the key as UTF-8 and the value, see UserField. Every
+	// key is stored once.
+	FieldUser = 6
+
+	// FieldSeal holds the SHA-256 of everything in the image but the
+	// container, see Options.Seal.
+	FieldSeal = 7
+
+	// FieldECC holds the number of parity bytes in every Reed-Solomon
+	// codeword of a payload with FlagECC, as a byte, or a zero byte and the
+	// ECCScheme of another code.
+	FieldECC = 8
+
+	// FieldCompression holds the ID of the Compression of the payload,
+	// followed by its size before compression as 64 bits.
+	FieldCompression = 9
+
+	// FieldMAC holds the salt and HMAC-SHA256 that authenticate an
+	// encrypted payload and the metadata with the passphrase, see macField.
+	FieldMAC = 10
+
+	// FieldFile holds the name, modification time and content type of the
+	// file the payload was read from: the time in Unix seconds as 64 bits,
+	// or 0, the size of the name as a byte, the name and the content type,
+	// see FileInfo. The file mode is not stored.
+	FieldFile = 11
+
+	// FieldShard holds the set, index and count of a payload stored across
+	// several images, as 64, 16 and 16 bits, see EncodeShards.
+	FieldShard = 12
+
+	// FieldSignature holds the Ed25519 signature of the payload and the
+	// metadata, see signatureField.
+	FieldSignature = 13
+
+	// FieldSlots marks a payload that is the table of the named slots of
+	// an image, see EncodeSlot. It holds nothing.
+	FieldSlots = 14
+
+	// FieldPreset holds the Preset the options were chosen by, as a byte,
+	// see Options.Preset.
+	FieldPreset = 15
+
+	// FieldRecipients marks a payload encrypted to Options.Recipients. It
+	// holds the format it is stored in as a byte, 1 for an age file and 2
+	// for an OpenPGP message.
+	FieldRecipients = 16
+
+	// FieldBundle marks a payload that is a tar archive of several files,
+	// to be unpacked rather than written as one, see Options.Bundle. It
+	// holds nothing.
+	FieldBundle = 17
+)
+
+// MaxUserKey is the size in bytes of the longest key of a FieldUser field.
+const MaxUserKey = 64
+
+// Len returns the size of the marshaled header.
+func (h *Header) Len() int {
+	if h.Version == 0 {
+		return 8
+	}
+	n := len(containerMagic) + 3 + 4 + h.Integrity.Size()
+	if h.Flags&FlagLength64 != 0 {
+		n += 4
+	}
+	if h.Flags&FlagMetadata != 0 {
+		n += 2 + len(h.metadata())
+	}
+	return n
+}
+
+// Format describes the container format, like "legacy", "v1/sha256" or
+// "v1/adler32/resync".
+func (h *Header) Format() string {
+	if h.Version == 0 {
+		return "legacy"
+	}
+	format := fmt.Sprintf("v%d/%s", h.Version, h.Integrity.Name())
+	if h.Flags&FlagResync != 0 {
+		format += "/resync"
+	}
+	if h.Flags&FlagPad != 0 {
+		format += "/otp"
+	}
+	if h.Flags&FlagChunked != 0 {
+		format += "/chunked"
+	}
+	if c, _ := h.code(); c == (hamming{}) {
+		format += "/hamming"
+	} else if h.Flags&FlagECC != 0 {
+		format += "/ecc"
+	}
+	if h.Flags&FlagLittleEndian != 0 {
+		format += "/le"
+	}
+	if v, ok := h.Field(FieldCompression); ok && len(v) > 0 {
+		if c, err := compressionByID(v[0]); err == nil {
+			format += "/" + c.Name()
+		} else {
+			format += fmt.Sprintf("/compression-0x%02x", v[0])
+		}
+	}
+	if v, ok := h.Field(FieldRecipients); ok && len(v) == 1 {
+		if s, ok := recipientSchemes[v[0]]; ok {
+			format += "/" + s.name()
+		} else {
+			format += fmt.Sprintf("/recipients-0x%02x", v[0])
+		}
+	}
+	if _, ok := h.Field(FieldMAC); ok {
+		format += "/hmac"
+	}
+	if _, ok := h.Field(FieldSignature); ok {
+		format += "/ed25519"
+	}
+	if _, ok := h.Field(FieldSeal); ok {
+		format += "/sealed"
+	}
+	if _, ok := h.Field(FieldSlots); ok {
+		format += "/slots"
+	}
+	return format
+}
+
+// Field returns the value of the first metadata field of type t.
+func (h *Header) Field(t byte) ([]byte, bool) {
+	for _, f := range h.Metadata {
+		if f.Type == t {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Expires returns the expiry stored in the FieldExpiry metadata field.
+func (h *Header) Expires() (time.Time, bool) {
+	v, ok := h.Field(FieldExpiry)
+	if !ok || len(v) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(v)), 0), true
+}
+
+// UserEntry is the key and value of a FieldUser field.
+type UserEntry struct {
+	Key   string
+	Value []byte
+}
+
+// UserField returns the FieldUser field holding key and value. The key is
+// UTF-8 text of 1 to MaxUserKey bytes.
+func UserField(key string, value []byte) (Field, error) {
+	if err := checkUserKey(key); err != nil {
+		return Field{}, err
+	}
+	v := append([]byte{byte(len(key))}, key...)
+	return Field{FieldUser, append(v, value...)}, nil
+}
+
+func checkUserKey(key string) error {
+	switch {
+	case key == "":
+		return errors.New("metadata key is empty")
+	case len(key) > MaxUserKey:
+		return fmt.Errorf("metadata key %q is %d bytes, at most %d fit", key, len(key), MaxUserKey)
+	case !utf8.ValidString(key):
+		return fmt.Errorf("metadata key %q is not UTF-8", key)
+	}
+	return nil
+}
+
+// userEntry splits the value of a FieldUser field.
+func userEntry(v []byte) (UserEntry, bool) {
+	if len(v) == 0 || 1+int(v[0]) > len(v) {
+		return UserEntry{}, false
+	}
+	n := 1 + int(v[0])
+	return UserEntry{string(v[1:n]), v[n:]}, true
+}
+
+// User returns the FieldUser fields of the header in the order they are
+// stored, skipping any that are malformed.
+func (h *Header) User() []UserEntry {
+	var entries []UserEntry
+	for _, f := range h.Metadata {
+		if f.Type != FieldUser {
+			continue
+		}
+		if e, ok := userEntry(f.Value); ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// UserValue returns the value stored under key in a FieldUser field.
+func (h *Header) UserValue(key string) ([]byte, bool) {
+	for _, e := range h.User() {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// MarshalBinary encodes the header. The legacy format is only possible
+// without flags, with Adler-32.
+func (h *Header) MarshalBinary() ([]byte, error) {
+	if h.Integrity == nil {
+		return nil, errors.New("header has no integrity algorithm")
+	}
+	if len(h.Checksum) != h.Integrity.Size() {
+		return nil, fmt.Errorf("checksum is %d bytes, %s needs %d", len(h.Checksum), h.Integrity.Name(), h.Integrity.Size())
+	}
+	if h.Length < 0 || (h.Flags&FlagLength64 == 0 && int64(h.Length) > 1<<32-1) {
+		return nil, fmt.Errorf("payload length %d does not fit in 32 bits", h.Length)
+	}
+
+	var buf bytes.Buffer
+	switch h.Version {
+	case 0:
+		if h.Flags != 0 || h.Integrity.ID() != Adler32.ID() {
+			return nil, errors.New("the legacy header only supports adler32 and no flags")
+		}
+	case containerVersion:
+		if h.Flags&^knownFlags != 0 {
+			return nil, fmt.Errorf("unsupported container flags 0x%02x", h.Flags)
+		}
+		buf.WriteString(containerMagic)
+		buf.Write([]byte{h.Version, h.Flags, h.Integrity.ID()})
+	default:
+		return nil, fmt.Errorf("unsupported container version %d", h.Version)
+	}
+
+	order := h.byteOrder()
+	if h.Flags&FlagLength64 != 0 {
+		binary.Write(&buf, order, uint64(h.Length))
+	} else {
+		binary.Write(&buf, order, uint32(h.Length))
+	}
+	buf.Write(h.Checksum)
+
+	if h.Flags&FlagMetadata != 0 {
+		for _, f := range h.Metadata {
+			if len(f.Value) > 0xFFFF {
+				return nil, fmt.Errorf("metadata field 0x%02x is %d bytes, at most 65535 fit", f.Type, len(f.Value))
+			}
+		}
+		meta := h.metadata()
+		if len(meta) > 0xFFFF {
+			return nil, fmt.Errorf("metadata is %d bytes, at most 65535 fit", len(meta))
+		}
+		binary.Write(&buf, order, uint16(len(meta)))
+		buf.Write(meta)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a header in either format. The data must hold
+// exactly one header.
+func (h *Header) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if err := h.read(r); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%d bytes of trailing data after the header", r.Len())
+	}
+	return nil
+}
+
+// read decodes a header from r. Short input is reported as io.EOF or
+// io.ErrUnexpectedEOF.
+func (h *Header) read(r io.Reader) error {
+	var start [4]byte
+	if _, err := io.ReadFull(r, start[:]); err != nil {
+		return err
+	}
+
+	*h = Header{Integrity: Adler32}
+	if string(start[:]) == containerMagic {
+		var fields [3]byte
+		if _, err := io.ReadFull(r, fields[:]); err != nil {
+			return err
+		}
+		if fields[0] != containerVersion {
+			return fmt.Errorf("unsupported container version %d", fields[0])
+		}
+		if fields[1]&^knownFlags != 0 {
+			return fmt.Errorf("unsupported container flags 0x%02x", fields[1])
+		}
+
+		var err error
+		if h.Integrity, err = integrityByID(fields[2]); err != nil {
+			return err
+		}
+		h.Version, h.Flags = fields[0], fields[1]
+
+		if _, err := io.ReadFull(r, start[:]); err != nil {
+			return err
+		}
+	}
+
+	order := h.byteOrder()
+	h.Length = int(order.Uint32(start[:]))
+	if h.Flags&FlagLength64 != 0 {
+		var rest [4]byte
+		if _, err := io.ReadFull(r, rest[:]); err != nil {
+			return err
+		}
+		n := order.Uint64(append(start[:], rest[:]...))
+		if n > uint64(maxInt) {
+			return fmt.Errorf("payload length %d is too large for this platform", n)
+		}
+		h.Length = int(n)
+	}
+	h.Checksum = make([]byte, h.Integrity.Size())
+	if _, err := io.ReadFull(r, h.Checksum); err != nil {
+		return err
+	}
+
+	if h.Flags&FlagMetadata == 0 {
+		return nil
+	}
+
+	var n uint16
+	if err := binary.Read(r, order, &n); err != nil {
+		return err
+	}
+	meta := make([]byte, n)
+	if _, err := io.ReadFull(r, meta); err != nil {
+		return err
+	}
+
+	for len(meta) > 0 {
+		if len(meta) < 3 {
+			return errors.New("truncated metadata field")
+		}
+		t, size := meta[0], int(order.Uint16(meta[1:3]))
+		if len(meta) < 3+size {
+			return errors.New("truncated metadata field")
+		}
+		h.Metadata = append(h.Metadata, Field{t, meta[3 : 3+size]})
+		meta = meta[3+size:]
+	}
+	return nil
+}
+
+// metadata encodes the metadata fields.
+func (h *Header) metadata() []byte {
+	var buf bytes.Buffer
+	for _, f := range h.Metadata {
+		buf.WriteByte(f.Type)
+		binary.Write(&buf, h.byteOrder(), uint16(len(f.Value)))
+		buf.Write(f.Value)
+	}
+	return buf.Bytes()
+}
+
+// byteOrder returns the byte order of the lengths in the header.
+func (h *Header) byteOrder() binary.ByteOrder {
+	if h.Flags&FlagLittleEndian != 0 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// sum returns the checksum over the metadata and payload.
+func (h *Header) sum(payload []byte) []byte {
+	if h.Flags&FlagChunked != 0 {
+		return h.chunkedSum(payload)
+	}
+	if h.Flags&FlagMetadata == 0 {
+		return h.Integrity.Sum(payload)
+	}
+	return h.Integrity.Sum(append(h.metadata(), payload...))
+}
+
+// setCompression replaces the FieldCompression placeholder with field, or
+// removes it if the payload is not compressed.
+func (h *Header) setCompression(field Field, compressed bool) {
+	meta := h.Metadata[:0]
+	for _, f := range h.Metadata {
+		if f.Type != FieldCompression {
+			meta = append(meta, f)
+		} else if compressed {
+			meta = append(meta, field)
+		}
+	}
+	if h.Metadata = meta; len(meta) == 0 {
+		h.Flags &^= FlagMetadata
+		h.Metadata = nil
+	}
+}
+
+// code returns the error correcting code of the payload, or nil without
+// FlagECC.
+func (h *Header) code() (eccCode, error) {
+	if h.Flags&FlagECC == 0 {
+		return nil, nil
+	}
+	v, _ := h.Field(FieldECC)
+	c, ok := parseECCField(v)
+	if !ok {
+		return nil, errors.New("error correcting payload without valid parity")
+	}
+	return c, nil
+}
+
+// repair returns the payload as it is stored without its parity, and the
+// number of bytes the parity repaired.
+func (h *Header) repair(stored []byte) ([]byte, int, error) {
+	c, err := h.code()
+	if err != nil || c == nil {
+		return stored, 0, err
+	}
+	payload, repaired := c.decode(stored)
+	return payload, repaired, nil
+}
+
+// ExpiredError is returned when decoding a payload after its expiry.
+type ExpiredError struct {
+	Expires time.Time
+}
+
+func (e *ExpiredError) Error() string {
+	return "payload expired on " + e.Expires.Format(time.RFC3339)
+}
+
+// open returns the payload as it was given to Encode, decrypting it,
+// removing the pad and decompressing it if needed. An expired payload is
+// refused before it is decrypted.
+func (h *Header) open(payload []byte, opt *Options) ([]byte, error) {
+	if t, ok := h.Expires(); ok && !opt.ignoreExpiry() && time.Now().After(t) {
+		return nil, &ExpiredError{t}
+	}
+	if err := h.checkSignature(opt.verifyKey(), payload); err != nil {
+		return nil, err
+	}
+	if err := h.checkMAC(opt.passphrase(), payload); err != nil {
+		return nil, err
+	}
+	if h.Flags&FlagChunked != 0 {
+		return h.openChunks(payload, opt)
+	}
+
+	var err error
+	recipients, toRecipients := h.Field(FieldRecipients)
+	switch {
+	case h.Flags&FlagPad != 0:
+		v, _ := h.Field(FieldPad)
+		payload, err = openPad(opt.pad(), v, payload)
+	case h.Flags&FlagEncrypted != 0:
+		payload, err = open(opt.passphrase(), payload)
+	case toRecipients:
+		payload, err = openRecipients(opt.identities(), recipients, payload)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v, ok := h.Field(FieldCompression)
+	if !ok {
+		return payload, nil
+	}
+	plain, err := decompress(v, payload)
+	if h.Flags&(FlagPad|FlagEncrypted) != 0 || toRecipients {
+		Wipe(payload)
+	}
+	return plain, err
+}
+
+// readHeader reads the header from the image, and rejects lengths that the
+// rest of it can not hold. A length of 0 is an empty message in the current
+// format, the length of a legacy header is as likely to be noise.
+func readHeader(r *lsbReader, key []byte) (*Header, error) {
+	h := &Header{}
+	switch err := h.read(r); err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		return nil, ErrNoHiddenMessage
+	default:
+		return nil, err
+	}
+
+	if h.Version == 0 && !r.img.legacy {
+		return nil, ErrNoHiddenMessage
+	}
+
+	l, err := headerDepth(h)
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		l.lsbFirst = r.layout.lsbFirst
+		if l.bootstrap().restrict(r.img.gray).String() != r.layout.String() {
+			return nil, ErrNoHiddenMessage
+		}
+		r.relayout(l)
+	}
+
+	p, err := headerPlacement(h)
+	if err != nil {
+		return nil, err
+	}
+	if k, ok := p.(Keyed); ok && r.img.deniable {
+		p = Deniable{Salt: k.Salt}
+	}
+	if p != nil {
+		r.place(withKey(p, key))
+	}
+
+	if err := h.checkLength(r.remaining()); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// checkLength rejects a header whose payload is longer than the available
+// bytes after it. Only a header that starts with the container magic is a
+// message that was cut short, or an empty one, the length of a legacy header
+// is as likely to be noise.
+func (h *Header) checkLength(available int) error {
+	switch {
+	case h.Version == 0 && h.Length == 0:
+		return ErrNoHiddenMessage
+	case h.Length <= available:
+		return nil
+	case h.Version == 0:
+		return ErrNoHiddenMessage
+	}
+	return &TruncatedError{h.Length, available}
+}
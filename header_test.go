@@ -0,0 +1,223 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// testHeaders are headers of every shape MarshalBinary produces.
+func testHeaders(t testing.TB) map[string]*Header {
+	t.Helper()
+	payload := []byte("payload")
+	user, err := UserField("key", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string]*Header{
+		"legacy":   {Version: 0, Integrity: Adler32, Length: len(payload)},
+		"v1":       {Version: containerVersion, Integrity: Adler32, Length: len(payload)},
+		"sha256":   {Version: containerVersion, Integrity: SHA256, Length: len(payload)},
+		"length64": {Version: containerVersion, Flags: FlagLength64, Integrity: CRC32, Length: 1 << 33},
+		"metadata": {Version: containerVersion, Flags: FlagMetadata, Integrity: BLAKE2b128, Length: len(payload),
+			Metadata: []Field{user, {FieldExpiry, []byte{0, 0, 0, 0, 0x60, 0, 0, 0}}, {FieldPad, []byte{}}}},
+		"little endian": {Version: containerVersion, Flags: FlagMetadata | FlagLittleEndian | FlagLength64, Integrity: CRC32, Length: 300,
+			Metadata: []Field{user}},
+	}
+	for _, h := range headers {
+		h.Checksum = h.sum(payload)
+	}
+	return headers
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	for name, h := range testHeaders(t) {
+		data, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(data) != h.Len() {
+			t.Errorf("%s: marshaled %d bytes, Len says %d", name, len(data), h.Len())
+		}
+		var got Header
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(&got, h) {
+			t.Errorf("%s: got %+v, want %+v", name, &got, h)
+		}
+	}
+}
+
+// TestHeaderLegacy pins the legacy layout, a 32 bit big endian length and
+// the Adler-32 checksum, and decodes a legacy message from an image only
+// with Options.Legacy.
+func TestHeaderLegacy(t *testing.T) {
+	payload := []byte("legacy payload")
+	h := &Header{Integrity: Adler32, Length: len(payload), Checksum: Adler32.Sum(payload)}
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0000000e" + hex.EncodeToString(Adler32.Sum(payload)); hex.EncodeToString(data) != want {
+		t.Fatalf("got %x, want %s", data, want)
+	}
+
+	dest, samples, err := copyCarrier(testCover(64, 64, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := embed(samples, data, payload, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decode(dest, nil); err != ErrNoHiddenMessage {
+		t.Errorf("without Legacy: got %v, want %v", err, ErrNoHiddenMessage)
+	}
+	if _, _, err := Detect(dest); err != ErrNoHiddenMessage {
+		t.Errorf("detect: got %v, want %v", err, ErrNoHiddenMessage)
+	}
+	got, err := Decode(dest, &Options{Legacy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("decoded %q, want %q", got, payload)
+	}
+
+	for _, bad := range []*Header{
+		{Integrity: CRC32, Length: 1, Checksum: make([]byte, 4)},
+		{Flags: FlagMetadata, Integrity: Adler32, Length: 1, Checksum: make([]byte, 4)},
+	} {
+		if _, err := bad.MarshalBinary(); err == nil {
+			t.Errorf("marshaled a legacy header with %s and flags 0x%02x", bad.Integrity.Name(), bad.Flags)
+		}
+	}
+}
+
+// TestHeaderLegacyNoise decodes a random image whose first bits read as a
+// legacy header with a length that fits, which is no message rather than a
+// damaged one.
+func TestHeaderLegacyNoise(t *testing.T) {
+	noise := testPayload(100, 2)
+	h := &Header{Integrity: Adler32, Length: len(noise), Checksum: testPayload(4, 3)}
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, samples, err := copyCarrier(testCover(64, 64, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := embed(samples, data, noise, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Decode(dest, &Options{Legacy: true}); err != ErrNoHiddenMessage {
+		t.Errorf("got %v, want %v", err, ErrNoHiddenMessage)
+	}
+}
+
+// TestHeaderPrefixes unmarshals every prefix of every header, which are all
+// cut short, and the header followed by a byte too many.
+func TestHeaderPrefixes(t *testing.T) {
+	for name, h := range testHeaders(t) {
+		data, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < len(data); n++ {
+			if err := new(Header).UnmarshalBinary(data[:n]); err != io.ErrUnexpectedEOF {
+				t.Errorf("%s: %d of %d bytes: got %v, want %v", name, n, len(data), err, io.ErrUnexpectedEOF)
+			}
+		}
+		if err := new(Header).UnmarshalBinary(append(data, 0)); err == nil {
+			t.Errorf("%s: accepted trailing data", name)
+		}
+	}
+}
+
+// TestHeaderFlippedBytes flips every byte of every header in turn. The
+// result is rejected or decodes to a different header that marshals to
+// exactly the flipped bytes, nothing is silently dropped or panics.
+func TestHeaderFlippedBytes(t *testing.T) {
+	for name, h := range testHeaders(t) {
+		data, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range data {
+			flipped := append([]byte(nil), data...)
+			flipped[i] ^= 0xff
+
+			var got Header
+			if err := got.UnmarshalBinary(flipped); err != nil {
+				continue
+			}
+			if reflect.DeepEqual(&got, h) {
+				t.Errorf("%s: flipping byte %d went unnoticed", name, i)
+				continue
+			}
+			again, err := got.MarshalBinary()
+			if err != nil {
+				t.Errorf("%s: flipping byte %d: header does not marshal: %v", name, i, err)
+			} else if !bytes.Equal(again, flipped) {
+				t.Errorf("%s: flipping byte %d: marshals to %x, not %x", name, i, again, flipped)
+			}
+		}
+	}
+}
+
+func TestHeaderRejected(t *testing.T) {
+	sum := make([]byte, 4)
+	for _, c := range []struct {
+		name string
+		data string
+	}{
+		{"version 0", containerMagic + "\x00\x00\x01"},
+		{"version 2", containerMagic + "\x02\x00\x01"},
+		{"unknown integrity", containerMagic + "\x01\x00\xee"},
+		{"truncated field", containerMagic + "\x01\x02\x01\x00\x00\x00\x01" + string(sum) + "\x00\x02\x06\x00"},
+		{"field too long", containerMagic + "\x01\x02\x01\x00\x00\x00\x01" + string(sum) + "\x00\x04\x06\x00\x05x"},
+	} {
+		data := []byte(c.data)
+		if len(data) == 7 {
+			data = append(data, "\x00\x00\x00\x01"+string(sum)...)
+		}
+		if err := new(Header).UnmarshalBinary(data); err == nil || err == io.ErrUnexpectedEOF {
+			t.Errorf("%s: got %v, want it rejected", c.name, err)
+		}
+	}
+	if err := new(Header).UnmarshalBinary([]byte(containerMagic + "\x01\x00\xee\x00\x00\x00\x01\x00\x00\x00\x00")); err != UnsupportedIntegrityError(0xee) {
+		t.Errorf("unknown integrity: got %v, want %v", err, UnsupportedIntegrityError(0xee))
+	}
+
+	for _, h := range []*Header{
+		{Version: 2, Integrity: Adler32, Checksum: sum},
+		{Version: containerVersion, Integrity: Adler32, Checksum: sum[:2]},
+		{Version: containerVersion, Integrity: Adler32, Checksum: sum, Length: 1 << 32},
+		{Version: containerVersion, Integrity: Adler32, Checksum: sum, Length: -1},
+		{Version: containerVersion, Checksum: sum},
+		{Version: containerVersion, Flags: FlagMetadata, Integrity: Adler32, Checksum: sum, Metadata: []Field{{FieldUser, make([]byte, 0x10000)}}},
+	} {
+		if _, err := h.MarshalBinary(); err == nil {
+			t.Errorf("marshaled %+v", h)
+		}
+	}
+}
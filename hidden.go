@@ -13,185 +13,1122 @@ You should have received a copy of the GNU General Public License
 along with this program.  If not, see <http://www.gnu.org/licenses/>.
 */
 
-package main
+// Package hidden hides messages in the least significant bits of the color
+// samples of an image. A message is stored behind a header with its size and
+// checksum, so it can be found and validated without any other information
+// than the image itself.
+//
+// The command in cmd/hidden is built on this package, which never exits or
+// prints, every failure is returned as an error. A nil *Options means the
+// defaults:
+//
+//	stego, err := hidden.Encode(cover, payload, nil)
+//	...
+//	payload, err := hidden.Decode(stego, nil)
+package hidden
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/binary"
-	"flag"
+	"errors"
 	"fmt"
-	"hash/adler32"
 	"image"
+	"image/draw"
 	"io"
-	"io/ioutil"
-	"os"
-	"path"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
 
-	"golang.org/x/image/bmp"
+var (
+	ErrNoHiddenMessage  = errors.New("image did not contain a hidden message")
+	ErrUnsupportedImage = errors.New("unsupported image, expected RGB or gray pixels")
+	ErrMessageTooLarge  = errors.New("message is too large for the cover")
 )
 
-func main() {
-	fmt.Println("Hidden Message")
-	fmt.Println("Copyright (C) 2017 Andreas T Jonsson\n")
+// Options are the parameters used when encoding and decoding. A nil
+// *Options means the defaults.
+type Options struct {
+	// Integrity validates the payload, BLAKE2b128 if nil. Decoding uses the
+	// algorithm stored in the image.
+	Integrity Integrity
+
+	// Passphrase encrypts the payload when encoding, and decrypts it when
+	// decoding. It also keys an HMAC of the payload and the metadata, so
+	// decoding fails with ErrDecryptionFailed for a modified message, see
+	// FieldMAC. The payload is not encrypted if it is empty.
+	Passphrase []byte
+
+	// Recipients encrypt the payload to their public keys instead of with a
+	// Passphrase, so only the holder of one of the private keys can decode
+	// it and no secret has to be shared. They are all age or all OpenPGP
+	// keys, and the payload is stored as an age file or an OpenPGP message
+	// for all of them. It can not be combined with a Passphrase, a Pad or
+	// ChunkSize.
+	Recipients []Recipient
+
+	// Identities are the private keys that decrypt a payload encrypted to
+	// Recipients when decoding.
+	Identities []Identity
+
+	// Cipher encrypts the payload, AESGCM if nil. Decoding uses the cipher
+	// stored in the image.
+	Cipher Cipher
+
+	// Rand is the source of salts and nonces, crypto/rand if nil. A
+	// deterministic reader makes encrypted encoding reproducible.
+	Rand io.Reader
+
+	// Compression compresses the payload before it is encrypted, unless it
+	// does not get any smaller. It is not compressed if Compression is nil.
+	// Decoding uses the method stored in the image. It can not be combined
+	// with ChunkSize.
+	Compression Compression
+
+	// Metadata is stored in the header when encoding. It is not encrypted.
+	Metadata []Field
+
+	// Placement decides which carrier bits after the header hold the
+	// payload, Sequential if nil. Decoding uses the placement stored in
+	// the image.
+	Placement Placement
+
+	// Hidden is a second payload, stored with a Deniable placement where
+	// only its own passphrase finds it. Only Encode supports it.
+	Hidden *HiddenPayload
+
+	// BlockSize splits the payload into blocks of this many bytes, each
+	// behind a resync marker with its sequence number and a CRC-32, so
+	// Recover can find what is left of it in a cropped image. Every block
+	// costs 17 bytes. Zero stores the payload as it is.
+	BlockSize int
+
+	// Copies stores the blocks of the payload this many times, each copy
+	// at the start of its own equal part of the image, so Recover finds
+	// every block in one of them after rows at the top or bottom were
+	// cropped or parts of the image were edited. It needs BlockSize, and
+	// the default placement and depth, and the payload only gets a
+	// Copies-th of the capacity. Zero stores one copy, like one.
+	Copies int
+
+	// ChunkSize stores the payload in chunks of this many bytes, each
+	// encrypted on its own, which EncodeStream needs to work through a
+	// payload without holding all of it. Every chunk costs 4 bytes and the
+	// overhead of the cipher. Zero stores the payload in one piece.
+	ChunkSize int
+
+	// ECC adds this many Reed-Solomon parity bytes to every codeword of up
+	// to 255 bytes of the payload, and decoding repairs up to half as many
+	// damaged bytes in each. Zero adds none. It can not be combined with
+	// BlockSize or ChunkSize.
+	ECC int
+
+	// ECCScheme is the error correcting code, ReedSolomon with ECC parity
+	// bytes by default. Hamming stores every byte as two and needs no ECC,
+	// decoding repairs one flipped bit in each, for far less CPU. It can not
+	// be combined with BlockSize or ChunkSize either.
+	ECCScheme ECCScheme
+
+	// Expires is stored in the header when encoding, unless it is zero, and
+	// decoding refuses the payload after it with an *ExpiredError. This is
+	// advisory, nothing but this package enforces it.
+	Expires time.Time
+
+	// IgnoreExpiry decodes expired payloads.
+	IgnoreExpiry bool
+
+	// Legacy also decodes payloads behind the legacy header of versions
+	// before the container format. It has no magic, so about one image in
+	// four billion reads as one by chance.
+	Legacy bool
+
+	// File is stored in the header when encoding, unless it is nil, so
+	// decoding can restore the name, modification time and type of the
+	// file the payload came from with Header.File. The header is not
+	// encrypted, anyone who finds the message can read them.
+	File *FileInfo
+
+	// Bundle marks the payload as a tar archive of several files when
+	// encoding, so decoding can tell it from a single file that happens to
+	// be one with Header.Bundle.
+	Bundle bool
+
+	// SigningKey signs the payload and the metadata with Ed25519 when
+	// encoding, so decoding with the public key as VerifyKey proves who
+	// encoded them. The signature does not need the passphrase to check.
+	SigningKey ed25519.PrivateKey
+
+	// VerifyKey makes decoding fail with ErrBadSignature unless the
+	// payload was signed with its private key, and with ErrNotSigned if it
+	// is not signed at all.
+	VerifyKey ed25519.PublicKey
+
+	// shard is stored in the header by EncodeShards.
+	shard *Shard
+
+	// slotTable marks the table of slots stored by EncodeSlot.
+	slotTable bool
+
+	// Random is the source of the random choices that need not be secret,
+	// so a *rand.Rand with a fixed seed makes them reproducible. Salts and
+	// nonces only use it with Deterministic.
+	Random io.Reader
+
+	// Pad XORs the payload with a one-time pad instead of encrypting it,
+	// and removes the pad when decoding. It can not be combined with a
+	// Passphrase.
+	Pad *Pad
+
+	// Depth is the number of low bits of every channel that carry the
+	// payload, one bit of each if it is zero. Decoding uses the depths
+	// stored in the image. Only Encode and EncodeContainer support it.
+	Depth ChannelDepth
+
+	// BitOrder is the order the bits of every byte of the header and the
+	// payload are stored in. Decoding finds it on its own. Only Encode and
+	// EncodeContainer support LSBFirst, and not with Copies.
+	BitOrder BitOrder
+
+	// LittleEndian stores the length and the metadata lengths of the
+	// header little endian instead of big endian, with FlagLittleEndian
+	// set so decoding reads them either way.
+	LittleEndian bool
+
+	// Raw stores the payload behind nothing but its length, 32 bits in the
+	// byte order of LittleEndian, from the first carrier bit on in the
+	// layout of Depth and BitOrder, the way simple LSB tools do. Without a
+	// magic or checksum decoding can not tell a raw payload from noise, so
+	// it only reads one with Raw set. Only Encode, Decode and Capacity
+	// support it, and nothing that needs the header.
+	Raw bool
+
+	// Deterministic derives the salt and nonce of an encrypted payload from
+	// the payload and 32 bytes of Random, or zeros without it, instead of
+	// reading them from Rand. The same inputs then always produce the same
+	// image, which also means the same payload always encrypts the same.
+	Deterministic bool
+
+	// Matching embeds with LSB matching: a sample whose lowest bit has to
+	// change is made one larger or smaller at random instead, which leaves
+	// none of the pairs of values that give LSB replacement away to the
+	// chi-square attack. The choices are drawn from Random, or derived from
+	// the payload without it, so encoding stays deterministic. Decoding
+	// does not change. It needs a Depth of one bit, and only the pixels of
+	// an image support it.
+	Matching bool
+
+	// PreserveHistogram keeps the histogram of every carrier channel as
+	// it was in the cover, which a first order histogram attack, like the
+	// chi-square attack, measures: for the pairs of values LSB
+	// replacement evens out, the lowest bit of samples the payload leaves
+	// alone is flipped back. A payload of up to about half of Capacity
+	// leaves enough of them. Decoding does not change. Only the pixels of
+	// an image support it, and not with Matching, ChunkSize, a Hidden
+	// payload or slots.
+	PreserveHistogram bool
+
+	// Fill sets the carrier bits the payload leaves unused to random bits,
+	// so the low bits look alike all over the image instead of changing
+	// where the payload ends, which is what steganalysis finds it by. The
+	// bits are read from Rand, or derived from Random and the payload with
+	// Deterministic. Decoding does not change. Only the pixels of an image
+	// support it, and not with ChunkSize, PreserveHistogram or slots.
+	Fill bool
+
+	// Preset records the threat model the options were chosen for in the
+	// header, see Preset. Nothing else depends on it.
+	Preset Preset
+
+	// Seal stores a SHA-256 of every bit of the image that does not hold
+	// the container in the header, and decoding fails with ErrModified if
+	// the image no longer matches it. Only Encode and Decode support it,
+	// and not with ChunkSize.
+	Seal bool
+}
+
+func (o *Options) integrity() Integrity {
+	if o == nil || o.Integrity == nil {
+		return BLAKE2b128
+	}
+	return o.Integrity
+}
+
+// cipher returns the cipher to encrypt with, or nil if there is no
+// passphrase.
+func (o *Options) cipher() Cipher {
+	switch {
+	case o == nil || len(o.Passphrase) == 0:
+		return nil
+	case o.Cipher == nil:
+		return AESGCM
+	}
+	return o.Cipher
+}
+
+// header returns the header Encode writes for o, without length and
+// checksum.
+func (o *Options) header() (Header, error) {
+	h := Header{Version: containerVersion, Integrity: o.integrity()}
+	if o == nil {
+		return h, nil
+	}
+	if err := o.Validate(); err != nil {
+		return h, err
+	}
+	if o.Raw {
+		return h, ErrRawUnsupported
+	}
+
+	if o.cipher() != nil {
+		h.Flags |= FlagEncrypted
+		h.Metadata = append(h.Metadata, macField())
+	}
+	if o.BlockSize > 0 {
+		h.Flags |= FlagResync
+	}
+	if o.ChunkSize > 0 {
+		h.Flags |= FlagChunked | FlagLength64
+	}
+	if c := o.code(); c != nil {
+		h.Flags |= FlagECC
+		h.Metadata = append(h.Metadata, Field{FieldECC, c.field()})
+	}
+
+	field, ok, err := placementField(o.Placement)
+	if err != nil {
+		return h, err
+	}
+	if ok {
+		h.Metadata = append(h.Metadata, field)
+	}
+	if o.Pad != nil {
+		h.Flags |= FlagPad
+		h.Metadata = append(h.Metadata, o.Pad.field())
+	}
+	if s := o.recipientScheme(); s != nil {
+		h.Metadata = append(h.Metadata, Field{FieldRecipients, []byte{s.id()}})
+	}
+	if o.layout() != nil {
+		h.Metadata = append(h.Metadata, o.depth().depthField())
+	}
+	if o.LittleEndian {
+		h.Flags |= FlagLittleEndian
+	}
+	if !o.Expires.IsZero() {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(o.Expires.Unix()))
+		h.Metadata = append(h.Metadata, Field{FieldExpiry, v})
+	}
+	if o.File != nil {
+		h.Metadata = append(h.Metadata, o.File.field())
+	}
+	if o.shard != nil {
+		h.Metadata = append(h.Metadata, o.shard.field())
+	}
+	if o.slotTable {
+		h.Metadata = append(h.Metadata, Field{FieldSlots, nil})
+	}
+	if o.Bundle {
+		h.Metadata = append(h.Metadata, Field{FieldBundle, nil})
+	}
+	if o.SigningKey != nil {
+		h.Metadata = append(h.Metadata, signatureField())
+	}
+	if o.Seal {
+		h.Metadata = append(h.Metadata, sealField())
+	}
+	if o.Compression != nil {
+		h.Metadata = append(h.Metadata, compressionField())
+	}
+	if o.Preset != 0 {
+		h.Metadata = append(h.Metadata, Field{FieldPreset, []byte{byte(o.Preset)}})
+	}
+	h.Metadata = append(h.Metadata, o.Metadata...)
+	if len(h.Metadata) > 0 {
+		h.Flags |= FlagMetadata
+	}
+	return h, nil
+}
+
+// placement returns the placement of the payload, with the passphrase as
+// the key of a Keyed one.
+func (o *Options) placement() Placement {
+	if o == nil {
+		return nil
+	}
+	return withKey(o.Placement, o.Passphrase)
+}
+
+// layout returns the layout of the payload, or nil for the default. A
+// layout that is not stores its depths in the header, LSBFirst one bit of
+// every color channel.
+func (o *Options) layout() *layout {
+	if o == nil || o.BitOrder == MSBFirst && (o.Depth == (ChannelDepth{}) || o.Depth == (ChannelDepth{1, 1, 1})) {
+		return nil
+	}
+	l := o.depth().layout()
+	l.lsbFirst = o.BitOrder == LSBFirst
+	return l
+}
+
+// depth returns the channel depths of the payload, one bit of every color
+// channel if Depth is zero.
+func (o *Options) depth() ChannelDepth {
+	if o.Depth == (ChannelDepth{}) {
+		return ChannelDepth{1, 1, 1}
+	}
+	return o.Depth
+}
+
+func (o *Options) lsbFirst() bool {
+	return o != nil && o.BitOrder == LSBFirst
+}
+
+// code returns the error correcting code of ECC and ECCScheme, or nil for
+// none.
+func (o *Options) code() eccCode {
+	switch {
+	case o == nil:
+		return nil
+	case o.ECCScheme == Hamming:
+		return hamming{}
+	case o.ECC > 0:
+		return reedSolomon(o.ECC)
+	}
+	return nil
+}
+
+func (o *Options) pad() *Pad {
+	if o == nil {
+		return nil
+	}
+	return o.Pad
+}
 
-	enc := flag.String("encode", "", "BMP image to hide message in.")
-	dec := flag.String("decode", "", "Decode message in BMP image.")
-	msg := flag.String("msg", "", "Message or data to encode/decode.")
+func (o *Options) ignoreExpiry() bool {
+	return o != nil && o.IgnoreExpiry
+}
 
-	flag.Parse()
-	if *msg != "" {
-		if *dec != "" {
-			decode(*dec, *msg)
-			fmt.Println("Done!")
-			return
-		} else if *enc != "" {
-			dest := path.Join(path.Dir(*enc), "encoded.bmp")
-			encode(*enc, dest, *msg)
-			fmt.Println("Done!")
-			return
+func (o *Options) legacy() bool {
+	return o != nil && o.Legacy
+}
+
+func (o *Options) copies() int {
+	if o == nil || o.Copies < 1 {
+		return 1
+	}
+	return o.Copies
+}
+
+func (o *Options) seal() bool {
+	return o != nil && o.Seal
+}
+
+func (o *Options) matching() bool {
+	return o != nil && o.Matching
+}
+
+func (o *Options) preserveHistogram() bool {
+	return o != nil && o.PreserveHistogram
+}
+
+func (o *Options) fill() bool {
+	return o != nil && o.Fill
+}
+
+// matchRand returns the source of the choices of Matching for an encode of
+// data, nil without it. The seed is read from Random, or derived from data
+// without it.
+func (o *Options) matchRand(data []byte) (*rand.Rand, error) {
+	if !o.matching() {
+		return nil, nil
+	}
+	seed := sha256.Sum256(data)
+	if o.Random != nil {
+		if _, err := io.ReadFull(o.Random, seed[:8]); err != nil {
+			return nil, err
 		}
 	}
+	return rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seed[:8])))), nil
+}
 
-	flag.PrintDefaults()
-	fatal()
+func (o *Options) verifyKey() ed25519.PublicKey {
+	if o == nil {
+		return nil
+	}
+	return o.VerifyKey
 }
 
-func fatal(msg ...interface{}) {
-	fmt.Println(msg...)
-	os.Exit(-1)
+func (o *Options) passphrase() []byte {
+	if o == nil {
+		return nil
+	}
+	return o.Passphrase
 }
 
-func openImage(file string) *image.RGBA {
-	fp, err := os.Open(file)
+// Encode returns a copy of cover with payload hidden in it. The cover must
+// be an *image.RGBA, which is what 24bpp BMP images decode to, an
+// *image.NRGBA, like 32bpp BMP and PNG images with transparency, whose
+// colors are not premultiplied and so keep every bit, or an *image.RGBA64
+// or *image.NRGBA64, like 16 bit PNG images. Those keep their depth, and the
+// payload goes in the low byte of every sample. An *image.Gray or
+// *image.Gray16 is used as it is too, its one sample standing in for the
+// first channel of the layout.
+//
+// Without a Passphrase, Recipients, Fill or a Deniable placement encoding is
+// deterministic, the same cover, payload and options produce an identical
+// image. Those read salts, nonces and random bits from Rand, crypto/rand by
+// default, so every run differs, unless Deterministic derives them from
+// Random instead. A Deniable placement always reads Rand, and age
+// recipients always read crypto/rand.
+func Encode(cover image.Image, payload []byte, opt *Options) (image.Image, error) {
+	if opt.raw() {
+		return encodeRaw(cover, payload, opt)
+	}
+	if opt != nil && opt.ChunkSize > 0 {
+		rnd := opt.Rand
+		if opt.Deterministic && opt.cipher() != nil {
+			s, err := derivedRand(opt.Random, payload)
+			if err != nil {
+				return nil, err
+			}
+			defer s.wipe()
+			rnd = s
+		}
+		return encodeChunks(cover, bytes.NewReader(payload), rnd, opt)
+	}
+
+	if err := checkAlpha(cover, opt.layout()); err != nil {
+		return nil, err
+	}
+	dest, samples, err := copyCarrier(cover)
 	if err != nil {
-		fatal(err)
+		return nil, err
+	}
+	if _, ok := opt.placement().(Spread); ok {
+		if opt, err = opt.spread(samples, payload); err != nil {
+			return nil, err
+		}
 	}
-	defer fp.Close()
 
-	img, err := bmp.Decode(fp)
+	data, payload, err := container(payload, opt)
 	if err != nil {
-		fatal(err)
+		return nil, err
+	}
+	match, err := opt.matchRand(append(data, payload...))
+	if err != nil {
+		return nil, err
+	}
+	l := opt.layout()
+	if l == nil {
+		l = &defaultLayout
+	}
+	var hist *histogram
+	if opt.preserveHistogram() {
+		hist = newHistogram(samples, l)
 	}
+	if opt.fill() {
+		samples.used = make([]bool, len(samples.Pix))
+	}
+	if e, ok := opt.placement().(Exclude); ok && samples.used != nil {
+		e.reserve(samples)
+	}
+	if err := embed(samples, data, payload, opt.placement(), opt.layout(), match); err != nil {
+		return nil, err
+	}
+	if err := embedCopies(samples, data, payload, opt.copies(), match); err != nil {
+		return nil, err
+	}
+	if err := embedHidden(samples, data, opt, match); err != nil {
+		return nil, err
+	}
+	if hist != nil {
+		hist.restore(samples)
+	}
+	if opt.fill() {
+		rnd, err := opt.fillRand(append(data, payload...))
+		if err != nil {
+			return nil, err
+		}
+		if err := fill(samples, l, rnd, match); err != nil {
+			return nil, err
+		}
+	}
+	if opt.seal() {
+		if err := sealImage(samples, data, payload, opt.placement(), opt.layout()); err != nil {
+			return nil, err
+		}
+	}
+	return dest, nil
+}
 
-	rgbaImg, ok := img.(*image.RGBA)
-	if !ok {
-		fatal("expected 24bpp bmp image")
+// spread returns a copy of opt with the Strided placement that spreads the
+// payload as it is stored over img, see Spread.
+func (o *Options) spread(img *carrierImage, payload []byte) (*Options, error) {
+	s := *o
+	data, stored, err := container(payload, &s)
+	if err != nil {
+		return nil, err
 	}
-	return rgbaImg
+	slots := defaultLayout.restrict(img.gray).slots(img.Rect, len(data)*8)
+	if l := o.layout(); l != nil {
+		slots = l.restrict(img.gray).payloadSlots(img.Rect, len(data)*8)
+	}
+	s.Placement = Strided{spread(slots, len(stored)*8)}
+	return &s, nil
 }
 
-func decode(fin, fout string) {
-	var (
-		img = openImage(fin)
-		buf bytes.Buffer
-		res byte
-		j   uint32
-	)
+// container returns the marshaled header and the payload as it is stored,
+// compressed, encrypted, split into resync blocks and with parity as opt
+// asks for.
+func container(payload []byte, opt *Options) ([]byte, []byte, error) {
+	h, err := opt.header()
+	if err != nil {
+		return nil, nil, err
+	}
+	if opt != nil && opt.Compression != nil {
+		compressed, field, ok, err := compress(opt.Compression, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.setCompression(field, ok)
+		if ok && (opt.pad() != nil || opt.cipher() != nil || opt.recipientScheme() != nil) {
+			// Only the pad or the ciphertext is stored, the
+			// compressed plaintext is not.
+			defer Wipe(compressed)
+		}
+		payload = compressed
+	}
+	if p := opt.pad(); p != nil {
+		if payload, err = p.xor(payload, p.Offset); err != nil {
+			return nil, nil, err
+		}
+	}
+	if s := opt.recipientScheme(); s != nil {
+		rnd := opt.Rand
+		if opt.Deterministic {
+			d, err := derivedRand(opt.Random, payload)
+			if err != nil {
+				return nil, nil, err
+			}
+			defer d.wipe()
+			rnd = d
+		}
+		if payload, err = s.encrypt(opt.Recipients, payload, rnd); err != nil {
+			return nil, nil, err
+		}
+	}
+	if c := opt.cipher(); c != nil {
+		rnd := opt.Rand
+		if opt.Deterministic {
+			s, err := derivedRand(opt.Random, payload)
+			if err != nil {
+				return nil, nil, err
+			}
+			defer s.wipe()
+			rnd = s
+		}
+		if h.Flags&FlagChunked != 0 {
+			payload, err = sealChunks(c, opt.Passphrase, payload, opt.ChunkSize, rnd)
+		} else {
+			payload, err = seal(c, opt.Passphrase, payload, rnd)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := h.setMAC(opt.Passphrase, payload, rnd); err != nil {
+			return nil, nil, err
+		}
+	} else if h.Flags&FlagChunked != 0 {
+		payload = chunks(payload, opt.ChunkSize)
+	}
+	if opt != nil && opt.SigningKey != nil {
+		h.sign(opt.SigningKey, payload)
+	}
+	if h.Flags&FlagResync != 0 {
+		payload = frame(payload, opt.BlockSize, h.Flags)
+	}
+	h.Checksum = h.sum(payload)
+	if h.Flags&FlagECC != 0 {
+		payload = opt.code().encode(payload)
+	}
+	if int64(len(payload)) > 1<<32-1 {
+		h.Flags |= FlagLength64
+	}
 
-	for i, b := range img.Pix {
-		if (i+1)%4 == 0 {
-			continue
+	h.Length = len(payload)
+	data, err := h.MarshalBinary()
+	return data, payload, err
+}
+
+// Decode extracts the payload hidden in img and validates it against the
+// embedded size and checksum. Without a header the error is
+// ErrNoHiddenMessage, and a *TruncatedError if the header claims more than
+// the image holds. If the header is plausible but the checksum does not
+// match, the error is a *ChecksumError, and ErrModified if the payload is
+// intact but the image does not match its seal. An encrypted
+// payload is decrypted with the passphrase in opt. With the passphrase of
+// the HiddenPayload of a Deniable placement it returns that instead.
+func Decode(img image.Image, opt *Options) ([]byte, error) {
+	payload, _, err := DecodeRepaired(img, opt)
+	return payload, err
+}
+
+// DecodeRepaired is Decode that also returns the number of bytes of a
+// payload stored with Options.ECC that were damaged and repaired.
+func DecodeRepaired(img image.Image, opt *Options) ([]byte, int, error) {
+	payload, h, err := decode(img, opt)
+	if err != nil {
+		return nil, 0, err
+	}
+	return payload, h.repaired, nil
+}
+
+// decode is Decode that also returns the header.
+func decode(img image.Image, opt *Options) ([]byte, *Header, error) {
+	samples := carrierOf(img)
+	samples.legacy = opt.legacy()
+	if opt.raw() {
+		return decodeRaw(samples, opt)
+	}
+	msg, h, err := extractLayout(samples, storedLayout(samples), opt.passphrase())
+	if err == ErrDecryptionFailed {
+		// A Deniable placement stores the header of a Keyed one.
+		samples.deniable = true
+		msg, h, err = extractLayout(samples, storedLayout(samples), opt.passphrase())
+	}
+	if err == ErrDecryptionFailed {
+		if payload, err := decodeHidden(samples, opt.passphrase()); err == nil {
+			if opt.verifyKey() != nil {
+				Wipe(payload)
+				return nil, nil, ErrNotSigned
+			}
+			return payload, &Header{Version: containerVersion, Length: len(payload)}, nil
 		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := h.Field(FieldSlots); ok {
+		return nil, nil, ErrSlotted
+	}
+	if err := h.checkSeal(samples, opt.passphrase()); err != nil {
+		return nil, nil, err
+	}
+	payload, err := h.open(msg, opt)
+	return payload, h, err
+}
 
-		bit := b % 2
-		res |= bit << (7 - j%8)
-		j++
+// Detect validates the payload hidden in img without decrypting it, and
+// returns its stored size and a description of the container format, like
+// "v1/blake2b-128" or "v1/adler32/aes-256-gcm". A legacy header is not
+// detected, see Options.Legacy.
+func Detect(img image.Image) (int, string, error) {
+	samples := carrierOf(img)
+	msg, h, err := extractLayout(samples, storedLayout(samples), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	return len(msg), detectFormat(msg, h), nil
+}
 
-		if j%8 == 0 {
-			buf.WriteByte(res)
-			res = 0
+// detectFormat describes the container format of msg, including the cipher
+// of an encrypted payload.
+func detectFormat(msg []byte, h *Header) string {
+	format := h.Format()
+	if h.Flags&FlagEncrypted != 0 {
+		id := msg[0]
+		if h.Flags&FlagChunked != 0 && len(msg) > 4 {
+			id = msg[4]
+		}
+		if c, err := cipherByID(id); err == nil {
+			format += "/" + c.Name()
+		} else {
+			format += "/" + err.Error()
 		}
 	}
+	return format
+}
 
-	var (
-		size, hash uint32
-	)
+// DecodeHeader returns the header of the message hidden in img, after
+// validating the checksum.
+func DecodeHeader(img image.Image) (*Header, error) {
+	samples := carrierOf(img)
+	_, h, err := extractLayout(samples, storedLayout(samples), nil)
+	return h, err
+}
 
-	binary.Read(&buf, binary.BigEndian, &size)
-	binary.Read(&buf, binary.BigEndian, &hash)
+// Capacity returns the largest payload, in bytes, that can be hidden in img
+// with the given options.
+func Capacity(img image.Image, opt *Options) int {
+	if opt.raw() {
+		return capacityRaw(img, opt)
+	}
+	h, err := opt.header()
+	if err != nil {
+		return 0
+	}
+	p := opt.placement()
+	if p == nil {
+		p = Sequential{}
+	}
 
-	const noHiddenMessage = "image did not contain a hidden message"
+	b, gray := img.Bounds(), isGray(img)
+	l, s := opt.layout(), defaultLayout.restrict(gray).slots(b, h.Len()*8)
+	if checkAlpha(img, l) != nil {
+		return 0
+	}
+	if l != nil {
+		l = l.restrict(gray)
+		s = l.payloadSlots(b, h.Len()*8)
+	} else {
+		l = defaultLayout.restrict(gray)
+	}
+	if _, ok := p.(Adaptive); ok {
+		// Only Adaptive looks at the pixels, which may need converting.
+		s.img, s.layout = carrierOf(img), l
+	}
+	if s.Start > s.Len() {
+		return 0
+	}
 
-	msg := buf.Bytes()
-	if len(msg) < int(size) {
-		fatal(noHiddenMessage)
+	c := p.Carrier(s)
+	n := s.Len() - s.Start
+	if r, ok := c.(interface{ Remaining() int }); ok {
+		n = r.Remaining()
+	}
+	if copies := opt.copies(); copies > 1 {
+		n = s.Len()/copies - s.Start
 	}
-	msg = msg[:size]
+	return opt.payloadCapacity(&h, n/8)
+}
 
-	if adler32.Checksum(msg) != hash {
-		fatal(noHiddenMessage)
+// MinCarrier returns the fewest pixels an image needs for Capacity to allow a
+// payload of size bytes with opt, and the side of the smallest square image
+// that does. Either is 0 if no image of up to MaxImagePixels does. With an
+// Adaptive placement, which depends on the pixels, they are for an image
+// that is textured all over.
+func MinCarrier(size int, opt *Options) (pixels, side int) {
+	if _, ok := opt.placement().(Adaptive); ok {
+		o := *opt
+		o.Placement = nil
+		opt = &o
+	}
+	fits := func(w, h int) bool {
+		return Capacity(&image.NRGBA{Rect: image.Rect(0, 0, w, h)}, opt) >= size
 	}
 
-	if err := ioutil.WriteFile(fout, msg, 0777); err != nil {
-		fatal(err)
+	pixels = sort.Search(MaxImagePixels+1, func(n int) bool { return n > 0 && fits(n, 1) })
+	if pixels > MaxImagePixels {
+		pixels = 0
 	}
+	maxSide := int(math.Sqrt(MaxImagePixels))
+	side = sort.Search(maxSide+1, func(n int) bool { return n > 0 && fits(n, n) })
+	if side > maxSide {
+		side = 0
+	}
+	return pixels, side
 }
 
-func encode(fin, fout, fmsg string) {
-	srcImg := openImage(fin)
-	destImg := image.NewRGBA(srcImg.Bounds())
-	r := newBitReader(fmsg)
+// payloadCapacity returns the largest payload that fits in n bytes after the
+// header.
+func (o *Options) payloadCapacity(h *Header, n int) int {
+	if h.Flags&FlagECC != 0 {
+		n = o.code().capacity(n)
+	}
+	if h.Flags&FlagResync != 0 {
+		n = unframedLen(n, o.BlockSize)
+	}
+	if h.Flags&FlagChunked != 0 {
+		n = unchunkedLen(n, o.ChunkSize, o.cipher())
+	} else if c := o.cipher(); c != nil {
+		n -= sealedLen(c)
+	} else if s := o.recipientScheme(); s != nil {
+		n = s.capacity(o.Recipients, n)
+	}
+	if n > 0 {
+		return n
+	}
+	return 0
+}
 
-	ln := len(srcImg.Pix)
-	if len(r.data)+ln/4 > ln {
-		fatal("message is to large")
+// DecodeAuto tries every layout the decoder supports, not just the one
+// Encode writes, and returns the payload together with a description of the
+// layout it was found with. It fails if no layout or more than one layout
+// yields a valid payload.
+func DecodeAuto(img image.Image, opt *Options) ([]byte, string, error) {
+	var (
+		samples = carrierOf(img)
+		found   []layout
+		seen    = make(map[string]bool)
+		msg     []byte
+		h       *Header
+		damaged error
+	)
+	samples.legacy = opt.legacy()
+
+	n := 3
+	if hasStraightAlpha(img) {
+		n = 4
 	}
+	for _, l := range layouts(n) {
+		// The layouts that differ only in the channels a gray pixel does
+		// not have are the same.
+		if l = *l.restrict(samples.gray); seen[l.String()] {
+			continue
+		}
+		seen[l.String()] = true
 
-	for i, b := range srcImg.Pix {
-		if (i+1)%4 == 0 {
-			destImg.Pix[i] = b
+		m, mh, err := extractLayout(samples, &l, opt.passphrase())
+		if err == nil {
+			found = append(found, l)
+			msg, h = m, mh
 			continue
 		}
 
-		if bit, err := r.next(); err != nil {
-			destImg.Pix[i] = b
-		} else {
-			if b%2 != 0 {
-				b--
+		switch err.(type) {
+		case *ChecksumError, *TruncatedError, UnsupportedIntegrityError:
+			if damaged == nil {
+				damaged = err
 			}
-			destImg.Pix[i] = b + bit
 		}
 	}
 
-	fpo, err := os.Create(fout)
+	switch len(found) {
+	case 0:
+		if damaged != nil {
+			return nil, "", damaged
+		}
+		return nil, "", ErrNoHiddenMessage
+	case 1:
+		desc := found[0].String()
+		if l, _ := headerDepth(h); l != nil {
+			desc = l.String()
+		}
+		if err := h.checkSeal(samples, opt.passphrase()); err != nil {
+			return nil, desc, err
+		}
+		msg, err := h.open(msg, opt)
+		return msg, desc, err
+	}
+
+	desc := make([]string, len(found))
+	for i := range found {
+		desc[i] = found[i].String()
+	}
+	return nil, "", fmt.Errorf("found valid messages with %d different layouts:\n%s", len(found), strings.Join(desc, "\n"))
+}
+
+// toRGBA returns img as an *image.RGBA, converting it if needed.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgbaImg, ok := img.(*image.RGBA); ok {
+		return rgbaImg
+	}
+	rgbaImg := image.NewRGBA(img.Bounds())
+	draw.Draw(rgbaImg, rgbaImg.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgbaImg
+}
+
+// extractLayout reads a message stored with layout l. Only the header and the
+// claimed number of message bytes are read. Resync blocks are removed from
+// the payload. key is the passphrase, which a Keyed placement needs.
+func extractLayout(img *carrierImage, l *layout, key []byte) ([]byte, *Header, error) {
+	msg, h, err := extractStored(img, l, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.Flags&FlagResync != 0 {
+		if msg, err = unframe(msg); err != nil {
+			return nil, nil, err
+		}
+	}
+	return msg, h, nil
+}
+
+// extractStored is extractLayout returning the payload as it is stored,
+// with its resync blocks, but repaired and without its parity.
+func extractStored(img *carrierImage, l *layout, key []byte) ([]byte, *Header, error) {
+	return readStored(storedReader(img, l), key)
+}
+
+// storedReader returns a reader of img in layout l at the header: at the
+// first slot, or further down for an Exclude placement whose first rows are
+// excluded.
+func storedReader(img *carrierImage, l *layout) *lsbReader {
+	if _, err := readHeader(newLSBReader(img, l), nil); err == ErrNoHiddenMessage {
+		if r := excludedHeader(img, l); r != nil {
+			return r
+		}
+	}
+	return newLSBReader(img, l)
+}
+
+// readStored is extractStored for the message from the next carrier bit of
+// r on.
+func readStored(r *lsbReader, key []byte) ([]byte, *Header, error) {
+	h, err := readHeader(r, key)
 	if err != nil {
-		fatal(err)
+		return nil, nil, err
+	}
+	keyed := isKeyed(r.carrier)
+	if keyed && len(key) == 0 {
+		return nil, nil, ErrPassphraseRequired
+	}
+
+	msg := make([]byte, h.Length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, nil, ErrNoHiddenMessage
+	}
+	if msg, h.repaired, err = h.repair(msg); err != nil {
+		return nil, nil, err
 	}
-	defer fpo.Close()
 
-	if bmp.Encode(fpo, destImg) != nil {
-		fatal(err)
+	if sum := h.sum(msg); !bytes.Equal(sum, h.Checksum) {
+		// The payload of a Keyed placement is read in the order of a
+		// wrong passphrase as likely as it is damaged. A legacy header
+		// has no magic to tell a damaged message from noise.
+		if keyed {
+			return nil, nil, ErrDecryptionFailed
+		} else if h.Version == 0 {
+			return nil, nil, ErrNoHiddenMessage
+		}
+		return nil, nil, &ChecksumError{msg, h.Length + r.remaining(), h.Checksum, sum}
 	}
+	return msg, h, nil
 }
 
-type bitReader struct {
-	ptr  int
-	data []byte
+// Container is a message as Encode stores it: the header, and the payload
+// after encryption, padding and resync framing. It can be moved to another
+// image without knowing the passphrase or the pad.
+type Container struct {
+	Header  *Header
+	Payload []byte
 }
 
-func newBitReader(file string) bitReader {
-	msg, err := ioutil.ReadFile(file)
+// ExtractContainer returns the container hidden in img, validated against
+// its checksum but not decrypted.
+func ExtractContainer(img image.Image) (*Container, error) {
+	samples := carrierOf(img)
+	payload, h, err := extractStored(samples, storedLayout(samples), nil)
 	if err != nil {
-		fatal(err)
+		return nil, err
+	}
+	if c, _ := h.code(); c != nil {
+		payload = c.encode(payload)
 	}
+	return &Container{h, payload}, nil
+}
 
-	var buf bytes.Buffer
-	binary.Write(&buf, binary.BigEndian, uint32(len(msg)))
-	binary.Write(&buf, binary.BigEndian, adler32.Checksum(msg))
-	buf.Write(msg)
+// EncodeContainer is Encode for a container from ExtractContainer, which is
+// stored exactly as it is, in the placement its header names. A sealed
+// container is sealed again for cover.
+func EncodeContainer(cover image.Image, c *Container) (image.Image, error) {
+	if c.Header.Length != len(c.Payload) {
+		return nil, fmt.Errorf("header claims %d bytes of payload, the container holds %d", c.Header.Length, len(c.Payload))
+	}
+	header, err := c.Header.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	p, err := headerPlacement(c.Header)
+	if err != nil {
+		return nil, err
+	}
+	switch p.(type) {
+	case Keyed, Deniable:
+		return nil, errors.New("a container with a keyed placement can not be moved, encode the message again")
+	}
+	l, err := headerDepth(c.Header)
+	if err != nil {
+		return nil, err
+	}
 
-	return bitReader{0, buf.Bytes()}
+	if err := checkAlpha(cover, l); err != nil {
+		return nil, err
+	}
+	dest, samples, err := copyCarrier(cover)
+	if err != nil {
+		return nil, err
+	}
+	if err := embed(samples, header, c.Payload, p, l, nil); err != nil {
+		return nil, err
+	}
+	if _, ok := c.Header.Field(FieldSeal); ok {
+		if err := sealImage(samples, header, c.Payload, p, l); err != nil {
+			return nil, err
+		}
+	}
+	return dest, nil
+}
+
+// ChecksumError is returned when an image has a plausible header with the
+// container magic but the payload does not match its checksum. That is a lot
+// more likely to be a damaged message than random noise, so it carries what
+// was read. A legacy header that fails its checksum is ErrNoHiddenMessage.
+type ChecksumError struct {
+	Payload          []byte
+	Capacity         int
+	Stored, Computed []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return "image contains a damaged message, the checksum does not match"
 }
 
-func (br *bitReader) next() (byte, error) {
-	i := br.ptr / 8
-	if i >= len(br.data) {
-		return 0, io.EOF
+// Printable returns the fraction of payload bytes that are printable ASCII or
+// common whitespace.
+func (e *ChecksumError) Printable() float64 {
+	if len(e.Payload) == 0 {
+		return 0
+	}
+	var n int
+	for _, b := range e.Payload {
+		if (b >= 0x20 && b < 0x7F) || b == '\t' || b == '\n' || b == '\r' {
+			n++
+		}
 	}
+	return float64(n) / float64(len(e.Payload))
+}
 
-	bit := uint8(br.ptr % 8)
-	b := br.data[i]
-	br.ptr++
+// TruncatedError is returned when an image has a container header that
+// claims a longer payload than the rest of the image holds, like an image
+// that was cropped or scaled down after encoding.
+type TruncatedError struct {
+	Length, Available int
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("image contains a truncated message, %d bytes of %d are left", e.Available, e.Length)
+}
 
-	return (b & (0x80 >> bit)) >> (7 - bit), nil
+// embed stores the header sequentially in the LSBs of img, followed by the
+// payload placed by p. The header of an Exclude placement starts in the
+// first row it fits in. With a layout l the header goes in its bootstrap
+// layout and the payload in l. With match the samples are changed by LSB
+// matching, see Options.Matching.
+func embed(img *carrierImage, header, payload []byte, p Placement, l *layout, match *rand.Rand) error {
+	boot := &defaultLayout
+	if l != nil {
+		boot = l.bootstrap()
+	}
+	w := newLSBWriter(img, boot)
+	w.match = match
+	if err := w.seekHeader(p, len(header)); err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if l != nil {
+		w.relayout(l)
+	}
+	if p != nil {
+		w.place(p)
+	}
+	_, err := w.Write(payload)
+	return err
 }
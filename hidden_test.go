@@ -0,0 +1,164 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"math/rand"
+	"testing"
+)
+
+// testCover returns a w by h opaque cover of random pixels drawn from seed.
+func testCover(w, h int, seed int64) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	rand.New(rand.NewSource(seed)).Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	return img
+}
+
+// testPayload returns n random bytes drawn from seed.
+func testPayload(n int, seed int64) []byte {
+	p := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(p)
+	return p
+}
+
+// pixels returns the pixels of an image Encode returned.
+func pixels(t testing.TB, img image.Image) []byte {
+	t.Helper()
+	switch m := img.(type) {
+	case *image.RGBA:
+		return m.Pix
+	case *image.NRGBA:
+		return m.Pix
+	case *image.RGBA64:
+		return m.Pix
+	case *image.NRGBA64:
+		return m.Pix
+	case *image.Gray:
+		return m.Pix
+	case *image.Gray16:
+		return m.Pix
+	}
+	t.Fatalf("unexpected image type %T", img)
+	return nil
+}
+
+// roundTrip encodes payload into cover with opt and decodes it with dec,
+// failing t unless it comes back unchanged. It returns the encoded image.
+func roundTrip(t *testing.T, cover image.Image, payload []byte, opt, dec *Options) image.Image {
+	t.Helper()
+	stego, err := Encode(cover, payload, opt)
+	if err != nil {
+		t.Fatalf("encoding: %v", err)
+	}
+	got, err := Decode(stego, dec)
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("decoded %d bytes that differ from the %d byte payload", len(got), len(payload))
+	}
+	return stego
+}
+
+func TestEncodeDeterministic(t *testing.T) {
+	cover := testCover(160, 120, 1)
+	payload := testPayload(2000, 1)
+	seeded := func() *rand.Rand { return rand.New(rand.NewSource(7)) }
+
+	for _, c := range []struct {
+		name string
+		opt  func() *Options
+	}{
+		{"defaults", func() *Options { return nil }},
+		{"matching", func() *Options { return &Options{Matching: true} }},
+		{"seeded matching", func() *Options { return &Options{Matching: true, Random: seeded()} }},
+		{"permuted", func() *Options { return &Options{Placement: Permuted{Seed: 7}} }},
+		{"compressed", func() *Options { return &Options{Compression: Deflate} }},
+		{"ecc", func() *Options { return &Options{ECC: 16} }},
+		{"sealed", func() *Options { return &Options{Seal: true} }},
+		{"passphrase", func() *Options {
+			return &Options{Passphrase: []byte("pass"), Deterministic: true, Random: seeded()}
+		}},
+		{"passphrase without seed", func() *Options { return &Options{Passphrase: []byte("pass"), Deterministic: true} }},
+		{"chunked", func() *Options {
+			return &Options{Passphrase: []byte("pass"), ChunkSize: 256, Deterministic: true, Random: seeded()}
+		}},
+		{"fill", func() *Options { return &Options{Fill: true, Deterministic: true, Random: seeded()} }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var sums [2][sha256.Size]byte
+			for i := range sums {
+				stego, err := Encode(cover, payload, c.opt())
+				if err != nil {
+					t.Fatal(err)
+				}
+				sums[i] = sha256.Sum256(pixels(t, stego))
+			}
+			if sums[0] != sums[1] {
+				t.Errorf("two encodes differ: %x and %x", sums[0], sums[1])
+			}
+		})
+	}
+}
+
+// TestEncodeGolden pins the images a fixed seed gives, so the salt, nonce and
+// other random choices drawn from it stay the same from version to version.
+func TestEncodeGolden(t *testing.T) {
+	seeded := func() *rand.Rand { return rand.New(rand.NewSource(137)) }
+	for _, c := range []struct {
+		name string
+		opt  *Options
+		want string
+	}{
+		{"passphrase", &Options{Passphrase: []byte("pass"), Deterministic: true, Random: seeded()}, "6c2ab61c8db538256c6e30ff5893f501942a34b6415efa42bf714de17ff3eb78"},
+		{"matching", &Options{Matching: true, Random: seeded()}, "f3eb560eca99e05eac20c31e22f41a1402015f72d202ea2f04c5a82eaba4926e"},
+		{"fill", &Options{Fill: true, Deterministic: true, Random: seeded()}, "a09a80ee6b1d83392f2c562a1c1440a1982a2be87cbee4edd44c5eed67748ef7"},
+	} {
+		stego := roundTrip(t, testCover(64, 48, 137), testPayload(300, 137), c.opt, &Options{Passphrase: c.opt.Passphrase})
+		if sum := sha256.Sum256(pixels(t, stego)); hex.EncodeToString(sum[:]) != c.want {
+			t.Errorf("%s: pixels hash to %x, want %s", c.name, sum, c.want)
+		}
+	}
+}
+
+// TestEncodeRandomized checks that what reads fresh randomness without
+// Deterministic does, as the doc of Encode says.
+func TestEncodeRandomized(t *testing.T) {
+	cover := testCover(160, 120, 1)
+	payload := testPayload(2000, 1)
+	for _, c := range []struct {
+		name string
+		opt  func() *Options
+	}{
+		{"passphrase", func() *Options { return &Options{Passphrase: []byte("pass")} }},
+		{"fill", func() *Options { return &Options{Fill: true} }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			a := roundTrip(t, cover, payload, c.opt(), c.opt())
+			b := roundTrip(t, cover, payload, c.opt(), c.opt())
+			if bytes.Equal(pixels(t, a), pixels(t, b)) {
+				t.Error("two encodes are identical")
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import "errors"
+
+// ErrHistogramUnsupported is returned for the PreserveHistogram option when
+// encoding anything but the pixels of an image.
+var ErrHistogramUnsupported = errors.New("preserving the histogram is only supported in the pixels of an image")
+
+// histogram counts the values of the samples of the carrier channels of an
+// image, by channel, before the message is stored in it. The lowest bit of
+// a sample only moves it between the two values of a pair, 2k and 2k+1, so
+// only the split of every pair can change.
+type histogram struct {
+	channels []int
+	counts   [][]int
+}
+
+// newHistogram counts the values of the channels of l in img, and starts
+// marking the samples the message is stored in, see restore.
+func newHistogram(img *carrierImage, l *layout) *histogram {
+	l = l.restrict(img.gray)
+	h := &histogram{channels: l.channels}
+	h.counts = h.count(img, nil)
+	img.used = make([]bool, len(img.Pix))
+	return h
+}
+
+// values returns the number of values a sample of img can have.
+func values(img *carrierImage) int {
+	if img.wide {
+		return 1 << 16
+	}
+	return 1 << 8
+}
+
+// value returns the sample at Pix offset o.
+func (m *carrierImage) value(o int) int {
+	if m.wide {
+		return int(m.Pix[o-1])<<8 | int(m.Pix[o])
+	}
+	return int(m.Pix[o])
+}
+
+// count returns the histogram of every channel of h in img, of the samples
+// f returns true for, all of them if f is nil.
+func (h *histogram) count(img *carrierImage, f func(o int) bool) [][]int {
+	counts := make([][]int, len(h.channels))
+	for k := range counts {
+		counts[k] = make([]int, values(img))
+	}
+	h.each(img, func(k, o int) {
+		if f == nil || f(o) {
+			counts[k][img.value(o)]++
+		}
+	})
+	return counts
+}
+
+// each calls f with the index in h.channels and the Pix offset of every
+// sample of the channels of h, row by row.
+func (h *histogram) each(img *carrierImage, f func(k, o int)) {
+	for y := 0; y < img.Rect.Dy(); y++ {
+		for x := 0; x < img.Rect.Dx(); x++ {
+			for k, c := range h.channels {
+				f(k, img.sample(x, y, c))
+			}
+		}
+	}
+}
+
+// restore flips the lowest bit of samples the message left alone, within
+// their pair of values, until every value occurs as often as before the
+// message was stored, as far as there are such samples. The flips of every
+// value are spread evenly over the samples that can take them, row by row,
+// so the result only depends on the image and the message.
+func (h *histogram) restore(img *carrierImage) {
+	var (
+		now  = h.count(img, nil)
+		free = h.count(img, func(o int) bool { return !img.used[o] })
+		need = make([][]int, len(h.channels))
+		acc  = make([][]int, len(h.channels))
+	)
+	for k := range h.channels {
+		need[k], acc[k] = make([]int, values(img)), make([]int, values(img))
+		for v := 0; v < values(img); v += 2 {
+			// Moving a sample from v to v+1 restores both counts.
+			d, from := now[k][v]-h.counts[k][v], v
+			if d < 0 {
+				d, from = -d, v+1
+			}
+			if d > free[k][from] {
+				d = free[k][from]
+			}
+			need[k][from] = d
+		}
+	}
+
+	h.each(img, func(k, o int) {
+		v := img.value(o)
+		if img.used[o] || need[k][v] == 0 {
+			return
+		}
+		if acc[k][v] += need[k][v]; acc[k][v] >= free[k][v] {
+			acc[k][v] -= free[k][v]
+			img.Pix[o] ^= 1
+		}
+	})
+	img.used = nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"image"
+	"testing"
+)
+
+// channelHistograms returns the histogram of the red, green and blue
+// samples of img.
+func channelHistograms(t *testing.T, img image.Image) [3][256]int {
+	t.Helper()
+	var h [3][256]int
+	pix := pixels(t, img)
+	for i := 0; i < len(pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			h[c][pix[i+c]]++
+		}
+	}
+	return h
+}
+
+// histogramDistance returns the number of samples a and b differ by, the
+// sum of the differences of the counts of every value, halved.
+func histogramDistance(a, b [3][256]int) int {
+	var d int
+	for c := range a {
+		for v := range a[c] {
+			if n := a[c][v] - b[c][v]; n > 0 {
+				d += n
+			} else {
+				d -= n
+			}
+		}
+	}
+	return d / 2
+}
+
+// TestPreserveHistogram checks that a payload of up to about half of
+// Capacity, as documented, leaves the histogram of every channel as it was,
+// and that a larger one still changes it far less than without
+// PreserveHistogram.
+func TestPreserveHistogram(t *testing.T) {
+	cover := testCover(256, 192, 302)
+	want := channelHistograms(t, cover)
+	capacity := Capacity(cover, &Options{PreserveHistogram: true})
+
+	for _, c := range []struct {
+		name string
+		opt  *Options
+	}{
+		{"plain", &Options{PreserveHistogram: true}},
+		{"encrypted", &Options{PreserveHistogram: true, Passphrase: []byte("pass")}},
+		{"strided", &Options{PreserveHistogram: true, Placement: Strided{Stride: 2}}},
+	} {
+		for _, size := range []int{capacity / 10, capacity / 4, capacity * 2 / 5} {
+			stego := roundTrip(t, cover, testPayload(size, 302), c.opt, &Options{Passphrase: c.opt.Passphrase})
+			if d := histogramDistance(channelHistograms(t, stego), want); d != 0 {
+				t.Errorf("%s, %d bytes: %d samples moved in the histogram", c.name, size, d)
+			}
+		}
+	}
+
+	payload := testPayload(capacity*9/10, 302)
+	plain := roundTrip(t, cover, payload, nil, nil)
+	preserved := roundTrip(t, cover, payload, &Options{PreserveHistogram: true}, nil)
+	dp, dh := histogramDistance(channelHistograms(t, plain), want), histogramDistance(channelHistograms(t, preserved), want)
+	if dh*3 > dp*2 {
+		t.Errorf("%d bytes: %d samples moved in the histogram, %d without preserving it", len(payload), dh, dp)
+	}
+}
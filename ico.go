@@ -0,0 +1,370 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+)
+
+// EncodeICO and DecodeICO store a message in one of the images of an ICO,
+// the format of favicon.ico, as the same container Encode writes. Entries
+// are PNG images or BMPs without their file header; only those with 32 bit
+// pixels, 8 bit RGBA PNGs and uncompressed 32 bit BMPs, can carry a message.
+//
+// The samples are used as they are stored, without premultiplying by
+// alpha, so the colour of fully transparent pixels carries bits too. The ICO
+// is written back with every other entry unchanged, and a BMP entry keeps
+// its headers and AND mask.
+
+// AutoEntry is the entry of the ICO functions that picks the 32 bit image
+// with the most capacity, the first of them if several are as large.
+const AutoEntry = -1
+
+const (
+	icoHeaderLen = 6
+	icoEntryLen  = 16
+	dibHeaderLen = 40
+)
+
+var pngMagic = []byte("\x89PNG\r\n\x1a\n")
+
+// icoFile is an ICO split into its directory entries.
+type icoFile struct {
+	header []byte
+	dir    [][]byte
+	images [][]byte
+}
+
+// readICO reads the ICO from r and finds its entries, returning what is
+// wrong with it as a *MalformedImageError.
+func readICO(r io.Reader) (*icoFile, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &icoFile{}
+	if err := t.parse(data); err != nil {
+		return nil, &MalformedImageError{"ico", err}
+	}
+	return t, nil
+}
+
+func (t *icoFile) parse(data []byte) error {
+	if len(data) < icoHeaderLen {
+		return io.ErrUnexpectedEOF
+	}
+	if !isICO(data) {
+		return errors.New("not an ICO")
+	}
+
+	t.header = data[:icoHeaderLen]
+	n := int(binary.LittleEndian.Uint16(data[4:]))
+	if n == 0 {
+		return errors.New("no images")
+	}
+	if len(data) < icoHeaderLen+n*icoEntryLen {
+		return io.ErrUnexpectedEOF
+	}
+
+	for i := 0; i < n; i++ {
+		e := data[icoHeaderLen+i*icoEntryLen:][:icoEntryLen]
+		size := int64(binary.LittleEndian.Uint32(e[8:]))
+		offset := int64(binary.LittleEndian.Uint32(e[12:]))
+		if offset+size > int64(len(data)) {
+			return fmt.Errorf("entry %d is outside the file", i+1)
+		}
+		t.dir = append(t.dir, e)
+		t.images = append(t.images, data[offset:offset+size])
+	}
+	return nil
+}
+
+// isICO reports whether data starts with the header of an icon or cursor.
+func isICO(data []byte) bool {
+	return len(data) >= 4 && data[0] == 0 && data[1] == 0 && (data[2] == 1 || data[2] == 2) && data[3] == 0
+}
+
+func isPNGEntry(data []byte) bool {
+	return bytes.HasPrefix(data, pngMagic)
+}
+
+// config returns the dimensions of entry i, or an error if it does not
+// have 32 bit pixels.
+func (t *icoFile) config(i int) (image.Config, error) {
+	data := t.images[i]
+	if isPNGEntry(data) {
+		cfg, err := png.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return cfg, &MalformedImageError{"ico", fmt.Errorf("entry %d: %v", i+1, err)}
+		}
+		if cfg.ColorModel != color.NRGBAModel {
+			return cfg, fmt.Errorf("entry %d is not a 32 bit image", i+1)
+		}
+		return cfg, malformed("ico", checkDimensions(cfg.Width, cfg.Height))
+	}
+
+	cfg, _, err := t.dib(i)
+	return cfg, err
+}
+
+// dib returns the dimensions of the BMP in entry i and the offset of its
+// pixels.
+func (t *icoFile) dib(i int) (image.Config, int, error) {
+	data := t.images[i]
+	if len(data) < dibHeaderLen {
+		return image.Config{}, 0, &MalformedImageError{"ico", fmt.Errorf("entry %d: %v", i+1, io.ErrUnexpectedEOF)}
+	}
+
+	var (
+		headerLen   = int(binary.LittleEndian.Uint32(data))
+		width       = int(int32(binary.LittleEndian.Uint32(data[4:])))
+		height      = int(int32(binary.LittleEndian.Uint32(data[8:]))) / 2
+		bpp         = binary.LittleEndian.Uint16(data[14:])
+		compression = binary.LittleEndian.Uint32(data[16:])
+	)
+	if bpp != 32 || compression != 0 {
+		return image.Config{}, 0, fmt.Errorf("entry %d is not a 32 bit image", i+1)
+	}
+	if headerLen < dibHeaderLen || width <= 0 || height <= 0 {
+		return image.Config{}, 0, &MalformedImageError{"ico", fmt.Errorf("entry %d: invalid BMP header", i+1)}
+	}
+	if err := checkDimensions(width, height); err != nil {
+		return image.Config{}, 0, malformed("ico", err)
+	}
+	if int64(headerLen)+int64(width)*int64(height)*4 > int64(len(data)) {
+		return image.Config{}, 0, &MalformedImageError{"ico", fmt.Errorf("entry %d: %v", i+1, io.ErrUnexpectedEOF)}
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: width, Height: height}, headerLen, nil
+}
+
+// image decodes entry i into an *image.RGBA that holds its samples as they
+// are stored, not premultiplied.
+func (t *icoFile) image(i int) (*image.RGBA, error) {
+	data := t.images[i]
+	if isPNGEntry(data) {
+		if _, err := t.config(i); err != nil {
+			return nil, err
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, &MalformedImageError{"ico", fmt.Errorf("entry %d: %v", i+1, err)}
+		}
+		m, ok := img.(*image.NRGBA)
+		if !ok {
+			return nil, fmt.Errorf("entry %d is not a 32 bit image", i+1)
+		}
+		return &image.RGBA{Pix: m.Pix, Stride: m.Stride, Rect: m.Rect}, nil
+	}
+
+	cfg, offset, err := t.dib(i)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+	for y := 0; y < cfg.Height; y++ {
+		src := data[offset+(cfg.Height-1-y)*cfg.Width*4:][:cfg.Width*4]
+		dst := img.Pix[y*img.Stride:][:cfg.Width*4]
+		for x := 0; x < len(src); x += 4 {
+			dst[x], dst[x+1], dst[x+2], dst[x+3] = src[x+2], src[x+1], src[x], src[x+3]
+		}
+	}
+	return img, nil
+}
+
+// set returns entry i with the samples of img, in the format it was stored
+// in.
+func (t *icoFile) set(i int, img *image.RGBA) ([]byte, error) {
+	data := t.images[i]
+	if isPNGEntry(data) {
+		var buf bytes.Buffer
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		if err := enc.Encode(&buf, &image.NRGBA{Pix: img.Pix, Stride: img.Stride, Rect: img.Rect}); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	cfg, offset, err := t.dib(i)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte(nil), data...)
+	for y := 0; y < cfg.Height; y++ {
+		src := img.Pix[y*img.Stride:][:cfg.Width*4]
+		dst := out[offset+(cfg.Height-1-y)*cfg.Width*4:][:cfg.Width*4]
+		for x := 0; x < len(src); x += 4 {
+			dst[x], dst[x+1], dst[x+2], dst[x+3] = src[x+2], src[x+1], src[x], src[x+3]
+		}
+	}
+	return out, nil
+}
+
+// write writes the ICO to w with entry i replaced by data.
+func (t *icoFile) write(w io.Writer, i int, data []byte) error {
+	images := append([][]byte(nil), t.images...)
+	images[i] = data
+
+	out := append([]byte(nil), t.header...)
+	offset := icoHeaderLen + len(t.dir)*icoEntryLen
+	for j, e := range t.dir {
+		e = append([]byte(nil), e...)
+		binary.LittleEndian.PutUint32(e[8:], uint32(len(images[j])))
+		binary.LittleEndian.PutUint32(e[12:], uint32(offset))
+		out = append(out, e...)
+		offset += len(images[j])
+	}
+	for _, img := range images {
+		out = append(out, img...)
+	}
+	_, err := w.Write(out)
+	return err
+}
+
+// entry resolves entry, counting from 0 or AutoEntry, to the entry that
+// carries the message.
+func (t *icoFile) entry(entry int) (int, error) {
+	if entry != AutoEntry {
+		if entry < 0 || entry >= len(t.images) {
+			return 0, fmt.Errorf("entry %d is not in the ICO, it has %d entries", entry+1, len(t.images))
+		}
+		_, err := t.config(entry)
+		return entry, err
+	}
+
+	best, pixels := -1, 0
+	for i := range t.images {
+		cfg, err := t.config(i)
+		if err != nil {
+			continue
+		}
+		if n := cfg.Width * cfg.Height; n > pixels {
+			best, pixels = i, n
+		}
+	}
+	if best < 0 {
+		return 0, errors.New("the ICO has no 32 bit images")
+	}
+	return best, nil
+}
+
+// ICOEntries returns the number of images in the ICO read from r.
+func ICOEntries(r io.Reader) (int, error) {
+	t, err := readICO(r)
+	if err != nil {
+		return 0, err
+	}
+	return len(t.images), nil
+}
+
+// EncodeICO writes the ICO read from r to w, with payload hidden in entry,
+// counting from 0, or in the one AutoEntry picks.
+func EncodeICO(w io.Writer, r io.Reader, entry int, payload []byte, opt *Options) error {
+	if opt.seal() {
+		return ErrSealUnsupported
+	}
+	t, err := readICO(r)
+	if err != nil {
+		return err
+	}
+	if entry, err = t.entry(entry); err != nil {
+		return err
+	}
+
+	img, err := t.image(entry)
+	if err != nil {
+		return err
+	}
+	stego, err := Encode(img, payload, opt)
+	if err != nil {
+		return err
+	}
+	data, err := t.set(entry, stego.(*image.RGBA))
+	if err != nil {
+		return err
+	}
+	return t.write(w, entry, data)
+}
+
+// DecodeICO extracts the payload EncodeICO hid in entry of the ICO read
+// from r, and validates it like Decode.
+func DecodeICO(r io.Reader, entry int, opt *Options) ([]byte, error) {
+	msg, h, err := extractICO(r, entry, opt.passphrase())
+	if err != nil {
+		return nil, err
+	}
+	return h.open(msg, opt)
+}
+
+// DetectICO is Detect for entry of the ICO read from r, the format is
+// prefixed with "ico/".
+func DetectICO(r io.Reader, entry int) (int, string, error) {
+	msg, h, err := extractICO(r, entry, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	return len(msg), "ico/" + detectFormat(msg, h), nil
+}
+
+// DecodeHeaderICO is DecodeHeader for entry of the ICO read from r.
+func DecodeHeaderICO(r io.Reader, entry int) (*Header, error) {
+	_, h, err := extractICO(r, entry, nil)
+	return h, err
+}
+
+func extractICO(r io.Reader, entry int, key []byte) ([]byte, *Header, error) {
+	t, err := readICO(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry, err = t.entry(entry); err != nil {
+		return nil, nil, err
+	}
+	img, err := t.image(entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	samples := carrierOf(img)
+	return extractLayout(samples, storedLayout(samples), key)
+}
+
+// CapacityICO returns the largest payload, in bytes, that EncodeICO can
+// hide in entry of the ICO read from r with the given options.
+func CapacityICO(r io.Reader, entry int, opt *Options) (int, error) {
+	if opt.seal() {
+		return 0, ErrSealUnsupported
+	}
+	t, err := readICO(r)
+	if err != nil {
+		return 0, err
+	}
+	if entry, err = t.entry(entry); err != nil {
+		return 0, err
+	}
+	cfg, err := t.config(entry)
+	if err != nil {
+		return 0, err
+	}
+	return Capacity(&image.RGBA{Rect: image.Rect(0, 0, cfg.Width, cfg.Height)}, opt), nil
+}
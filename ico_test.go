@@ -0,0 +1,233 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color/palette"
+	"image/png"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// dibEntry returns a BMP without its file header, as ICOs store them, of
+// w x h pixels of bpp bits drawn from seed, followed by the AND mask.
+func dibEntry(w, h, bpp int, seed int64) []byte {
+	stride := (w*bpp + 31) / 32 * 4
+	mask := (w + 31) / 32 * 4
+	data := make([]byte, dibHeaderLen, dibHeaderLen+(stride+mask)*h)
+	binary.LittleEndian.PutUint32(data, dibHeaderLen)
+	binary.LittleEndian.PutUint32(data[4:], uint32(w))
+	binary.LittleEndian.PutUint32(data[8:], uint32(2*h))
+	binary.LittleEndian.PutUint16(data[12:], 1)
+	binary.LittleEndian.PutUint16(data[14:], uint16(bpp))
+	pix := make([]byte, (stride+mask)*h)
+	rand.New(rand.NewSource(seed)).Read(pix)
+	return append(data, pix...)
+}
+
+// testICO returns an ICO of four entries: a paletted PNG, a 32 bit PNG, a
+// 32 bit BMP, the largest, and a 24 bit BMP.
+func testICO(t testing.TB, seed int64) []byte {
+	t.Helper()
+	encode := func(img image.Image) []byte {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	paletted := image.NewPaletted(image.Rect(0, 0, 16, 16), palette.WebSafe)
+	rand.New(rand.NewSource(seed)).Read(paletted.Pix)
+	for i := range paletted.Pix {
+		paletted.Pix[i] %= byte(len(palette.WebSafe))
+	}
+	rgba := testCover(32, 32, seed)
+	rgba.Pix[3], rgba.Pix[7] = 0, 0x80
+	nrgba := &image.NRGBA{Pix: rgba.Pix, Stride: rgba.Stride, Rect: rgba.Rect}
+
+	entries := []struct {
+		w, h, bpp int
+		data      []byte
+	}{
+		{16, 16, 8, encode(paletted)},
+		{32, 32, 32, encode(nrgba)},
+		{48, 40, 32, dibEntry(48, 40, 32, seed)},
+		{24, 24, 24, dibEntry(24, 24, 24, seed)},
+	}
+
+	out := []byte{0, 0, 1, 0, byte(len(entries)), 0}
+	offset := icoHeaderLen + len(entries)*icoEntryLen
+	for _, e := range entries {
+		out = append(out, byte(e.w), byte(e.h), 0, 0, 1, 0, byte(e.bpp), 0)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(e.data)))
+		out = binary.LittleEndian.AppendUint32(out, uint32(offset))
+		offset += len(e.data)
+	}
+	for _, e := range entries {
+		out = append(out, e.data...)
+	}
+	return out
+}
+
+// TestICO hides messages in the PNG and the BMP entry of an ICO, and in the
+// one AutoEntry picks, and checks every other entry is unchanged.
+func TestICO(t *testing.T) {
+	cover := testICO(t, 159)
+	orig, err := readICO(bytes.NewReader(cover))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ICOEntries(bytes.NewReader(cover)); err != nil || n != 4 {
+		t.Fatalf("%d entries, %v", n, err)
+	}
+
+	for _, c := range []struct {
+		name  string
+		entry int
+		used  int
+	}{
+		{"png", 1, 1},
+		{"bmp", 2, 2},
+		{"auto", AutoEntry, 2},
+	} {
+		capacity, err := CapacityICO(bytes.NewReader(cover), c.entry, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, _ := orig.config(c.used)
+		if want := Capacity(image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height)), nil); capacity != want {
+			t.Errorf("%s: capacity %d, want %d", c.name, capacity, want)
+		}
+		if err := EncodeICO(new(bytes.Buffer), bytes.NewReader(cover), c.entry, testPayload(capacity+1, 159), nil); err != ErrMessageTooLarge {
+			t.Errorf("%s: %d bytes, one more than the capacity: got %v", c.name, capacity+1, err)
+		}
+
+		for _, size := range []int{0, 20, capacity} {
+			payload := testPayload(size, 159)
+			var buf bytes.Buffer
+			if err := EncodeICO(&buf, bytes.NewReader(cover), c.entry, payload, nil); err != nil {
+				t.Fatalf("%s: %d bytes: %v", c.name, size, err)
+			}
+			stego := buf.Bytes()
+			got, err := DecodeICO(bytes.NewReader(stego), c.entry, nil)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Fatalf("%s: %d bytes: decoded %d bytes, %v", c.name, size, len(got), err)
+			}
+			if n, format, err := DetectICO(bytes.NewReader(stego), c.used); err != nil || n != size || !strings.HasPrefix(format, "ico/") {
+				t.Errorf("%s: detected %d bytes of %q, %v", c.name, n, format, err)
+			}
+			if _, err := DecodeICO(bytes.NewReader(stego), 3-c.used, nil); err == nil {
+				t.Errorf("%s: decoded a message from entry %d", c.name, 3-c.used)
+			}
+
+			enc, err := readICO(bytes.NewReader(stego))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(enc.header, orig.header) || len(enc.images) != len(orig.images) {
+				t.Fatalf("%s: header % x, %d entries", c.name, enc.header, len(enc.images))
+			}
+			for i := range orig.images {
+				// Only the size and offset of an entry may change.
+				if !bytes.Equal(enc.dir[i][:8], orig.dir[i][:8]) {
+					t.Errorf("%s: directory entry %d changed from % x to % x", c.name, i, orig.dir[i], enc.dir[i])
+				}
+				if i != c.used && !bytes.Equal(enc.images[i], orig.images[i]) {
+					t.Errorf("%s: entry %d changed", c.name, i)
+				}
+			}
+			checkICOEntry(t, c.name, orig, enc, c.used)
+		}
+	}
+}
+
+// checkICOEntry checks that entry i of enc differs from orig in nothing but
+// the lowest bit of its samples, transparent ones included, and that a BMP
+// keeps its header and AND mask.
+func checkICOEntry(t *testing.T, name string, orig, enc *icoFile, i int) {
+	t.Helper()
+	before, err := orig.image(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := enc.image(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j := range before.Pix {
+		if d := before.Pix[j] ^ after.Pix[j]; d > 1 || j%4 == 3 && d != 0 {
+			t.Fatalf("%s: sample %d changed from %#x to %#x", name, j, before.Pix[j], after.Pix[j])
+		}
+	}
+
+	if isPNGEntry(orig.images[i]) {
+		return
+	}
+	cfg, offset, err := orig.dib(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pix := offset + cfg.Width*cfg.Height*4
+	if a, b := orig.images[i], enc.images[i]; len(a) != len(b) || !bytes.Equal(a[:offset], b[:offset]) || !bytes.Equal(a[pix:], b[pix:]) {
+		t.Errorf("%s: the header or AND mask of the BMP entry changed", name)
+	}
+}
+
+func TestICORejected(t *testing.T) {
+	cover := testICO(t, 159)
+
+	// An ICO of only the paletted entry.
+	size, offset := binary.LittleEndian.Uint32(cover[icoHeaderLen+8:]), binary.LittleEndian.Uint32(cover[icoHeaderLen+12:])
+	paletted := append([]byte{0, 0, 1, 0, 1, 0}, cover[icoHeaderLen:][:icoEntryLen]...)
+	binary.LittleEndian.PutUint32(paletted[icoHeaderLen+12:], icoHeaderLen+icoEntryLen)
+	paletted = append(paletted, cover[offset:][:size]...)
+
+	for _, c := range []struct {
+		name  string
+		data  []byte
+		entry int
+		err   string
+	}{
+		{"paletted png", cover, 0, "entry 1 is not a 32 bit image"},
+		{"24 bit bmp", cover, 3, "entry 4 is not a 32 bit image"},
+		{"out of range", cover, 4, "entry 5 is not in the ICO, it has 4 entries"},
+		{"negative", cover, -2, "entry -1 is not in the ICO"},
+		{"no 32 bit entries", paletted, AutoEntry, "no 32 bit images"},
+		{"truncated", cover[:icoHeaderLen+3*icoEntryLen], AutoEntry, "malformed ico image"},
+		{"outside the file", cover[:len(cover)-1], AutoEntry, "entry 4 is outside the file"},
+		{"no images", []byte{0, 0, 1, 0, 0, 0}, AutoEntry, "no images"},
+		{"not an ico", []byte("GIF89a"), AutoEntry, "not an ICO"},
+	} {
+		err := EncodeICO(new(bytes.Buffer), bytes.NewReader(c.data), c.entry, []byte("x"), nil)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got %v, want %q", c.name, err, c.err)
+		}
+	}
+
+	if err := EncodeICO(new(bytes.Buffer), bytes.NewReader(cover), AutoEntry, []byte("x"), &Options{Seal: true}); err != ErrSealUnsupported {
+		t.Errorf("seal: got %v, want ErrSealUnsupported", err)
+	}
+	_, err := DecodeICO(bytes.NewReader(cover[:10]), AutoEntry, nil)
+	if !errors.As(err, new(*MalformedImageError)) {
+		t.Errorf("truncated: got %v, want a *MalformedImageError", err)
+	}
+}
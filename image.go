@@ -0,0 +1,195 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+)
+
+// MaxImagePixels is the largest number of pixels DecodeImage, and the JPEG
+// decoder, accept. Decoded as RGBA that is a gigabyte.
+const MaxImagePixels = 1 << 28
+
+// ErrImageTooLarge is returned, wrapped with the details, for an image that
+// declares more pixels or is more bytes than the limits allow. It is checked
+// before anything is allocated for the pixels.
+var ErrImageTooLarge = errors.New("image is too large")
+
+// Limits bound the images DecodeImageLimits accepts, for files from
+// untrusted sources.
+type Limits struct {
+	// MaxPixels is the largest number of pixels, width times height. 0 and
+	// anything above MaxImagePixels mean MaxImagePixels.
+	MaxPixels int
+
+	// MaxFileSize is the largest file in bytes, 0 for no limit.
+	MaxFileSize int64
+}
+
+func (l *Limits) maxPixels() int {
+	if l == nil || l.MaxPixels <= 0 || l.MaxPixels > MaxImagePixels {
+		return MaxImagePixels
+	}
+	return l.MaxPixels
+}
+
+// read reads all of r, failing with ErrImageTooLarge as soon as it is more
+// than MaxFileSize.
+func (l *Limits) read(r io.Reader) ([]byte, error) {
+	if l == nil || l.MaxFileSize <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, l.MaxFileSize+1))
+	if err == nil && int64(len(data)) > l.MaxFileSize {
+		err = fmt.Errorf("%w, it is more than %d bytes", ErrImageTooLarge, l.MaxFileSize)
+	}
+	return data, err
+}
+
+// Check validates the size of the image file in data and the dimensions
+// its header declares against l, without decoding it. Data that is not in
+// a registered format passes, the decoder reports that.
+func (l *Limits) Check(data []byte) error {
+	if l != nil && l.MaxFileSize > 0 && int64(len(data)) > l.MaxFileSize {
+		return fmt.Errorf("%w, it is %d bytes, more than %d", ErrImageTooLarge, len(data), l.MaxFileSize)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	return malformed(format, checkPixels(cfg.Width, cfg.Height, l.maxPixels()))
+}
+
+// MalformedImageError is returned by DecodeImage for an image file that
+// claims to be in a supported format but can not be decoded.
+type MalformedImageError struct {
+	// Format is the name the format was registered with, like "bmp".
+	Format string
+	Err    error
+}
+
+func (e *MalformedImageError) Error() string {
+	return fmt.Sprintf("malformed %s image: %v", e.Format, e.Err)
+}
+
+func (e *MalformedImageError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeImage is image.Decode for files that may be damaged or hostile. It
+// checks the declared dimensions against MaxImagePixels before decoding, and
+// that a BMP holds as much pixel data as its header claims. Errors and panics
+// of the decoder are returned as a *MalformedImageError. An unknown format
+// is still image.ErrFormat. Like image.Decode it only knows the formats
+// registered with image.RegisterFormat.
+func DecodeImage(r io.Reader) (image.Image, string, error) {
+	return DecodeImageLimits(r, nil)
+}
+
+// DecodeImageLimits is DecodeImage with the file size and pixel count
+// bounded by l, nil for the defaults of DecodeImage. An image beyond them
+// fails with ErrImageTooLarge before it is decoded.
+func DecodeImageLimits(r io.Reader, l *Limits) (image.Image, string, error) {
+	data, err := l.read(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == image.ErrFormat {
+		return nil, "", err
+	} else if err != nil {
+		return nil, format, &MalformedImageError{format, err}
+	}
+	if err := checkPixels(cfg.Width, cfg.Height, l.maxPixels()); err != nil {
+		return nil, format, malformed(format, err)
+	}
+	if format == "bmp" {
+		if err := checkBMP(data, cfg.Width, cfg.Height); err != nil {
+			return nil, format, &MalformedImageError{format, err}
+		}
+	}
+
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, format, &MalformedImageError{format, err}
+	}
+	return img, format, nil
+}
+
+// decodeImage calls image.Decode, and returns a panic in the decoder as an
+// error.
+func decodeImage(data []byte) (img image.Image, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			img, err = nil, fmt.Errorf("decoder panic: %v", r)
+		}
+	}()
+	img, _, err = image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+func checkDimensions(width, height int) error {
+	return checkPixels(width, height, MaxImagePixels)
+}
+
+// checkPixels validates declared dimensions against a limit of max pixels.
+// Too many pixels is an ErrImageTooLarge, see malformed.
+func checkPixels(width, height, max int) error {
+	if width < 0 || height < 0 {
+		return fmt.Errorf("dimensions %dx%d are negative", width, height)
+	}
+	if height > 0 && width > max/height {
+		return fmt.Errorf("%w, %dx%d is more than %d pixels", ErrImageTooLarge, width, height, max)
+	}
+	return nil
+}
+
+// malformed returns err as a *MalformedImageError of format, except for
+// ErrImageTooLarge, which is not a fault in the file. It returns nil for a
+// nil err.
+func malformed(format string, err error) error {
+	if err == nil || errors.Is(err, ErrImageTooLarge) {
+		return err
+	}
+	return &MalformedImageError{format, err}
+}
+
+// checkBMP validates that an uncompressed BMP holds the pixel data its
+// header claims.
+func checkBMP(data []byte, width, height int) error {
+	if len(data) < 34 {
+		return io.ErrUnexpectedEOF
+	}
+	offset := int64(binary.LittleEndian.Uint32(data[10:14]))
+	bpp := int64(binary.LittleEndian.Uint16(data[28:30]))
+	if binary.LittleEndian.Uint32(data[30:34]) != 0 {
+		// Compressed, or bit fields, the decoder checks those.
+		return nil
+	}
+
+	stride := (int64(width)*bpp + 31) / 32 * 4
+	if need := offset + stride*int64(height); int64(len(data)) < need {
+		return fmt.Errorf("pixel data ends at byte %d, the header claims %d", len(data), need)
+	}
+	return nil
+}
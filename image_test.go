@@ -0,0 +1,173 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image/png"
+	"io"
+	"runtime"
+	"testing"
+)
+
+// bombs returns image files of each format whose headers declare w x h
+// pixels, with no pixel data behind them.
+func bombs(w, h int) map[string][]byte {
+	le, be := binary.LittleEndian, binary.BigEndian
+
+	bmp := make([]byte, 54)
+	copy(bmp, "BM")
+	le.PutUint32(bmp[2:], 54)
+	le.PutUint32(bmp[10:], 54)
+	le.PutUint32(bmp[14:], 40)
+	le.PutUint32(bmp[18:], uint32(w))
+	le.PutUint32(bmp[22:], uint32(h))
+	le.PutUint16(bmp[26:], 1)
+	le.PutUint16(bmp[28:], 24)
+
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	be.PutUint32(ihdr[4:], uint32(w))
+	be.PutUint32(ihdr[8:], uint32(h))
+	ihdr[12], ihdr[13] = 8, 2
+	pngFile := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d")
+	pngFile = append(pngFile, ihdr...)
+	pngFile = be.AppendUint32(pngFile, crc32.ChecksumIEEE(ihdr))
+	pngFile = append(pngFile, "\x00\x00\x00\x00IEND\xae\x42\x60\x82"...)
+
+	gif := []byte("GIF89a")
+	gif = le.AppendUint16(gif, uint16(w))
+	gif = le.AppendUint16(gif, uint16(h))
+	gif = append(gif, 0, 0, 0, ';')
+
+	// Without the JFIF marker DecodeConfig reads on to the scan.
+	jpeg := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	jpeg = append(jpeg, 0xff, 0xc0, 0, 11, 8)
+	jpeg = be.AppendUint16(jpeg, uint16(h))
+	jpeg = be.AppendUint16(jpeg, uint16(w))
+	jpeg = append(jpeg, 1, 1, 0x11, 0, 0xff, 0xd9)
+
+	// ImageWidth, ImageLength, BitsPerSample, Compression, Photometric,
+	// StripOffsets, SamplesPerPixel and StripByteCounts.
+	tags := [][3]uint32{{256, 4, uint32(w)}, {257, 4, uint32(h)}, {258, 3, 8}, {259, 3, 1}, {262, 3, 1}, {273, 4, 8}, {277, 3, 1}, {279, 4, 0}}
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	tiff = le.AppendUint16(tiff, uint16(len(tags)))
+	for _, tag := range tags {
+		tiff = le.AppendUint16(tiff, uint16(tag[0]))
+		tiff = le.AppendUint16(tiff, uint16(tag[1]))
+		tiff = le.AppendUint32(tiff, 1)
+		tiff = le.AppendUint32(tiff, tag[2])
+	}
+	tiff = le.AppendUint32(tiff, 0)
+
+	return map[string][]byte{"bmp": bmp, "png": pngFile, "gif": gif, "jpeg": jpeg, "tiff": tiff}
+}
+
+// TestImageBombs feeds every format a header that declares more pixels than
+// the limit. It must fail with ErrImageTooLarge before allocating for them.
+func TestImageBombs(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		w, h   int
+		limits *Limits
+	}{
+		{"default", 60000, 60000, nil},
+		{"max pixels", 1000, 1000, &Limits{MaxPixels: 999999}},
+	} {
+		for format, data := range bombs(c.w, c.h) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, got, err := DecodeImageLimits(bytes.NewReader(data), c.limits)
+			runtime.ReadMemStats(&after)
+
+			if !errors.Is(err, ErrImageTooLarge) || errors.As(err, new(*MalformedImageError)) {
+				t.Errorf("%s %s: got %v, want ErrImageTooLarge", c.name, format, err)
+			}
+			if got != format {
+				t.Errorf("%s %s: detected as %q", c.name, format, got)
+			}
+			if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+				t.Errorf("%s %s: allocated %d bytes", c.name, format, n)
+			}
+			if err := c.limits.Check(data); !errors.Is(err, ErrImageTooLarge) {
+				t.Errorf("%s %s: Check got %v, want ErrImageTooLarge", c.name, format, err)
+			}
+		}
+	}
+
+	// The headers are sound, below the limit they fail for the missing pixels.
+	for format, data := range bombs(1000, 1000) {
+		if _, _, err := DecodeImage(bytes.NewReader(data)); err == nil || errors.Is(err, ErrImageTooLarge) {
+			t.Errorf("%s: got %v below the limit", format, err)
+		}
+	}
+}
+
+// TestImageLimits checks that an image exactly at the limits is accepted
+// and one pixel or byte more is not.
+func TestImageLimits(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testCover(64, 48, 155)); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	size := int64(len(data))
+
+	for _, c := range []struct {
+		name   string
+		limits Limits
+		ok     bool
+	}{
+		{"none", Limits{}, true},
+		{"pixels at limit", Limits{MaxPixels: 64 * 48}, true},
+		{"pixels over limit", Limits{MaxPixels: 64*48 - 1}, false},
+		{"size at limit", Limits{MaxFileSize: size}, true},
+		{"size over limit", Limits{MaxFileSize: size - 1}, false},
+	} {
+		_, _, err := DecodeImageLimits(bytes.NewReader(data), &c.limits)
+		if c.ok && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !c.ok && !errors.Is(err, ErrImageTooLarge) {
+			t.Errorf("%s: got %v, want ErrImageTooLarge", c.name, err)
+		}
+		if err := c.limits.Check(data); (err == nil) != c.ok || !c.ok && !errors.Is(err, ErrImageTooLarge) {
+			t.Errorf("%s: Check got %v", c.name, err)
+		}
+	}
+}
+
+// endless is an io.Reader that never ends, counting what is read from it.
+type endless struct{ n int64 }
+
+func (r *endless) Read(p []byte) (int, error) {
+	r.n += int64(len(p))
+	return len(p), nil
+}
+
+// TestImageLimitsStream checks that MaxFileSize stops reading a stream that
+// never ends.
+func TestImageLimitsStream(t *testing.T) {
+	r := &endless{}
+	if _, _, err := DecodeImageLimits(io.MultiReader(bytes.NewReader(bombs(10, 10)["png"]), r), &Limits{MaxFileSize: 1 << 20}); !errors.Is(err, ErrImageTooLarge) {
+		t.Fatalf("got %v, want ErrImageTooLarge", err)
+	}
+	if r.n > 2<<20 {
+		t.Errorf("read %d bytes with a limit of %d", r.n, 1<<20)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Integrity computes the checksum that validates a payload. The ID is stored
+// in the header, so decoding picks the same algorithm the image was encoded
+// with as long as it is registered.
+type Integrity interface {
+	// ID identifies the algorithm in the header. Zero is reserved.
+	ID() byte
+
+	// Name is how users select the algorithm, like "sha256".
+	Name() string
+
+	// Size is the length of a checksum in bytes.
+	Size() int
+
+	// Sum returns the checksum of data.
+	Sum(data []byte) []byte
+}
+
+// The built-in integrity algorithms. BLAKE2b128 is the default, a
+// cryptographic digest at half the size of SHA256, which was the default of
+// older versions. Adler32 is the only one the legacy header supports, and
+// the smallest, but random damage slips past it more often, all the more
+// for short payloads.
+var (
+	Adler32    Integrity = &hashIntegrity{1, "adler32", func() hash.Hash { return adler32.New() }}
+	CRC32      Integrity = &hashIntegrity{2, "crc32", func() hash.Hash { return crc32.NewIEEE() }}
+	SHA256     Integrity = &hashIntegrity{3, "sha256", sha256.New}
+	BLAKE2b128 Integrity = &hashIntegrity{4, "blake2b-128", newBLAKE2b128}
+)
+
+// newBLAKE2b128 returns an unkeyed BLAKE2b with a 128 bit digest, which can
+// not fail.
+func newBLAKE2b128() hash.Hash {
+	d, err := blake2b.New(16, nil)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+var (
+	integrityMu sync.RWMutex
+	integrities = map[byte]Integrity{}
+)
+
+func init() {
+	RegisterIntegrity(Adler32)
+	RegisterIntegrity(CRC32)
+	RegisterIntegrity(SHA256)
+	RegisterIntegrity(BLAKE2b128)
+}
+
+// RegisterIntegrity makes an integrity algorithm available for decoding and
+// to LookupIntegrity. It panics if the ID is zero or already taken.
+func RegisterIntegrity(i Integrity) {
+	integrityMu.Lock()
+	defer integrityMu.Unlock()
+
+	if i.ID() == 0 {
+		panic("hidden: integrity ID 0 is reserved")
+	}
+	if prev, ok := integrities[i.ID()]; ok {
+		panic(fmt.Sprintf("hidden: integrity ID 0x%02x registered twice, by %s and %s", i.ID(), prev.Name(), i.Name()))
+	}
+	integrities[i.ID()] = i
+}
+
+// LookupIntegrity returns the registered integrity algorithm with the given
+// name.
+func LookupIntegrity(name string) (Integrity, bool) {
+	integrityMu.RLock()
+	defer integrityMu.RUnlock()
+
+	for _, i := range integrities {
+		if i.Name() == name {
+			return i, true
+		}
+	}
+	return nil, false
+}
+
+// Integrities returns the registered integrity algorithms ordered by ID.
+func Integrities() []Integrity {
+	integrityMu.RLock()
+	defer integrityMu.RUnlock()
+
+	all := make([]Integrity, 0, len(integrities))
+	for _, i := range integrities {
+		all = append(all, i)
+	}
+	sort.Slice(all, func(a, b int) bool { return all[a].ID() < all[b].ID() })
+	return all
+}
+
+func integrityByID(id byte) (Integrity, error) {
+	integrityMu.RLock()
+	defer integrityMu.RUnlock()
+
+	if i, ok := integrities[id]; ok {
+		return i, nil
+	}
+	return nil, UnsupportedIntegrityError(id)
+}
+
+// UnsupportedIntegrityError is returned when an image was encoded with an
+// integrity algorithm that is not registered.
+type UnsupportedIntegrityError byte
+
+func (e UnsupportedIntegrityError) Error() string {
+	return fmt.Sprintf("unsupported integrity algorithm 0x%02x", byte(e))
+}
+
+// hashIntegrity adapts a hash.Hash to Integrity.
+type hashIntegrity struct {
+	id   byte
+	name string
+	new  func() hash.Hash
+}
+
+func (h *hashIntegrity) ID() byte     { return h.id }
+func (h *hashIntegrity) Name() string { return h.name }
+func (h *hashIntegrity) Size() int    { return h.new().Size() }
+
+func (h *hashIntegrity) Sum(data []byte) []byte {
+	d := h.new()
+	d.Write(data)
+	return d.Sum(nil)
+}
@@ -0,0 +1,884 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// This is the part of a baseline JPEG codec that operates on quantized DCT
+// coefficients, which image/jpeg does not expose. The reader handles any
+// baseline Huffman coded JPEG, the writer produces 4:4:4 YCbCr images with
+// the standard tables, like image/jpeg does.
+
+var errJPEGFormat = errors.New("invalid JPEG")
+
+// zigzag maps the position of a coefficient in the entropy coded order to
+// its index in the 8x8 block.
+var zigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10, 17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34, 27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36, 29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46, 53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// baseQuant are the example quantization tables of the JPEG standard, for
+// luminance and chrominance, in natural order.
+var baseQuant = [2][64]int{
+	{
+		16, 11, 10, 16, 24, 40, 51, 61,
+		12, 12, 14, 19, 26, 58, 60, 55,
+		14, 13, 16, 24, 40, 57, 69, 56,
+		14, 17, 22, 29, 51, 87, 80, 62,
+		18, 22, 37, 56, 68, 109, 103, 77,
+		24, 35, 55, 64, 81, 104, 113, 92,
+		49, 64, 78, 87, 103, 121, 120, 101,
+		72, 92, 95, 98, 112, 100, 103, 99,
+	},
+	{
+		17, 18, 24, 47, 99, 99, 99, 99,
+		18, 21, 26, 66, 99, 99, 99, 99,
+		24, 26, 56, 99, 99, 99, 99, 99,
+		47, 66, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// quantTables returns the quantization tables for quality 1 to 100, in
+// zigzag order, scaled the way libjpeg and image/jpeg do.
+func quantTables(quality int) [2][64]uint16 {
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+
+	var q [2][64]uint16
+	for t := range q {
+		for k := range q[t] {
+			v := (baseQuant[t][zigzag[k]]*scale + 50) / 100
+			if v < 1 {
+				v = 1
+			} else if v > 255 {
+				v = 255
+			}
+			q[t][k] = uint16(v)
+		}
+	}
+	return q
+}
+
+// huffmanSpec is a Huffman table as stored in a DHT segment: the number of
+// codes of every length from 1 to 16 and the symbols in code order.
+type huffmanSpec struct {
+	counts [16]byte
+	values []byte
+}
+
+// The standard Huffman tables: luminance DC, luminance AC, chrominance DC and
+// chrominance AC.
+var standardHuffman = [4]huffmanSpec{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 0x7d},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 0x77},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// jpegBlock holds the quantized coefficients of a block in zigzag order.
+type jpegBlock [64]int32
+
+type jpegComponent struct {
+	id         byte
+	h, v       int
+	quant      byte
+	dcTable    byte
+	acTable    byte
+	blocksWide int
+	blocksHigh int
+	blocks     []jpegBlock
+}
+
+// block returns the block in column x and row y of the component.
+func (c *jpegComponent) block(x, y int) *jpegBlock {
+	return &c.blocks[y*c.blocksWide+x]
+}
+
+// jpegImage is a JPEG as quantized DCT coefficients.
+type jpegImage struct {
+	width, height int
+	quant         [4][64]uint16
+	comps         []jpegComponent
+}
+
+// newJPEG returns the coefficients image/jpeg would encode img with at
+// quality, but in 4:4:4. If quantize is non-nil it rounds the quantized
+// coefficients of the luminance blocks instead of math.Round, it is given
+// the block position, the zigzag position and the exact value.
+func newJPEG(img image.Image, quality int, quantize func(bx, by, k int, v float64) int32) *jpegImage {
+	b := img.Bounds()
+	j := &jpegImage{width: b.Dx(), height: b.Dy()}
+	q := quantTables(clampQuality(quality))
+	j.quant[0], j.quant[1] = q[0], q[1]
+
+	bw, bh := (b.Dx()+7)/8, (b.Dy()+7)/8
+	for i := 0; i < 3; i++ {
+		t := byte(0)
+		if i > 0 {
+			t = 1
+		}
+		j.comps = append(j.comps, jpegComponent{
+			id: byte(i + 1), h: 1, v: 1, quant: t, dcTable: t, acTable: t,
+			blocksWide: bw, blocksHigh: bh, blocks: make([]jpegBlock, bw*bh),
+		})
+	}
+
+	rgbaImg := toRGBA(img)
+	var samples [3][64]float64
+	for by := 0; by < bh; by++ {
+		for bx := 0; bx < bw; bx++ {
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 8; x++ {
+					// Pad with the edge pixels, like image/jpeg.
+					px, py := bx*8+x, by*8+y
+					if px >= b.Dx() {
+						px = b.Dx() - 1
+					}
+					if py >= b.Dy() {
+						py = b.Dy() - 1
+					}
+					o := rgbaImg.PixOffset(b.Min.X+px, b.Min.Y+py)
+					yy, cb, cr := color.RGBToYCbCr(rgbaImg.Pix[o], rgbaImg.Pix[o+1], rgbaImg.Pix[o+2])
+					samples[0][y*8+x] = float64(yy) - 128
+					samples[1][y*8+x] = float64(cb) - 128
+					samples[2][y*8+x] = float64(cr) - 128
+				}
+			}
+
+			for i := range j.comps {
+				c := &j.comps[i]
+				coef := fdct(&samples[i])
+				blk := c.block(bx, by)
+				for k := 0; k < 64; k++ {
+					v := coef[zigzag[k]] / float64(j.quant[c.quant][k])
+					if i == 0 && quantize != nil {
+						blk[k] = quantize(bx, by, k, v)
+					} else {
+						blk[k] = int32(math.Round(v))
+					}
+					// Baseline codes AC coefficients in at most 10 bits.
+					if k > 0 && blk[k] > 1023 {
+						blk[k] = 1023
+					} else if k > 0 && blk[k] < -1023 {
+						blk[k] = -1023
+					}
+				}
+			}
+		}
+	}
+	return j
+}
+
+// cosTable[x][u] is cos((2x+1)uπ/16), scaled by the DCT normalization.
+var cosTable = func() (t [8][8]float64) {
+	for x := 0; x < 8; x++ {
+		for u := 0; u < 8; u++ {
+			c := 0.5
+			if u == 0 {
+				c = 0.5 / math.Sqrt2
+			}
+			t[x][u] = c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return
+}()
+
+// fdct returns the 2D DCT of a block of level shifted samples, in natural
+// order.
+func fdct(s *[64]float64) (out [64]float64) {
+	var tmp [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for x := 0; x < 8; x++ {
+				sum += s[y*8+x] * cosTable[x][u]
+			}
+			tmp[y*8+u] = sum
+		}
+	}
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			var sum float64
+			for y := 0; y < 8; y++ {
+				sum += tmp[y*8+u] * cosTable[y][v]
+			}
+			out[v*8+u] = sum
+		}
+	}
+	return
+}
+
+// readJPEG reads the coefficients of a baseline JPEG. Errors in the file are
+// returned as a *MalformedImageError.
+func readJPEG(r io.Reader) (*jpegImage, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	j, err := parseJPEG(data)
+	if err != nil {
+		return nil, malformed("jpeg", err)
+	}
+	return j, nil
+}
+
+func parseJPEG(data []byte) (*jpegImage, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errJPEGFormat
+	}
+
+	var (
+		j        = &jpegImage{}
+		tables   [2][4]*huffmanDecoder
+		restarts int
+		frame    bool
+		pos      = 2
+	)
+
+	for {
+		// Skip fill bytes in front of the marker.
+		for pos < len(data) && data[pos] == 0xFF && pos+1 < len(data) && data[pos+1] == 0xFF {
+			pos++
+		}
+		if pos+2 > len(data) || data[pos] != 0xFF {
+			return nil, errJPEGFormat
+		}
+		marker := data[pos+1]
+		if marker == 0xD9 {
+			break
+		}
+		if pos+4 > len(data) {
+			return nil, errJPEGFormat
+		}
+
+		n := int(data[pos+2])<<8 | int(data[pos+3])
+		if n < 2 || pos+2+n > len(data) {
+			return nil, errJPEGFormat
+		}
+		seg := data[pos+4 : pos+2+n]
+		pos += 2 + n
+
+		switch marker {
+		case 0xC0, 0xC1:
+			if frame {
+				return nil, errJPEGFormat
+			}
+			if err := j.readFrame(seg, len(data)-pos); err != nil {
+				return nil, err
+			}
+			frame = true
+		case 0xC2, 0xC3, 0xC5, 0xC6, 0xC7, 0xC9, 0xCA, 0xCB, 0xCD, 0xCE, 0xCF:
+			return nil, errors.New("only baseline JPEG images are supported")
+		case 0xC4:
+			if err := readHuffmanTables(seg, &tables); err != nil {
+				return nil, err
+			}
+		case 0xDB:
+			if err := j.readQuant(seg); err != nil {
+				return nil, err
+			}
+		case 0xDD:
+			if len(seg) != 2 {
+				return nil, errJPEGFormat
+			}
+			restarts = int(seg[0])<<8 | int(seg[1])
+		case 0xDA:
+			if !frame {
+				return nil, errJPEGFormat
+			}
+			n, err := j.readScan(seg, data[pos:], &tables, restarts)
+			if err != nil {
+				return nil, err
+			}
+			pos += n
+		}
+	}
+
+	if !frame {
+		return nil, errJPEGFormat
+	}
+	return j, nil
+}
+
+// readFrame reads a frame header, followed by at most size bytes.
+func (j *jpegImage) readFrame(seg []byte, size int) error {
+	if len(seg) < 6 || seg[0] != 8 {
+		return errJPEGFormat
+	}
+	j.height = int(seg[1])<<8 | int(seg[2])
+	j.width = int(seg[3])<<8 | int(seg[4])
+	n := int(seg[5])
+	if j.width == 0 || j.height == 0 || n == 0 || len(seg) != 6+3*n {
+		return errJPEGFormat
+	}
+	if err := checkDimensions(j.width, j.height); err != nil {
+		return err
+	}
+
+	var hmax, vmax int
+	for i := 0; i < n; i++ {
+		c := jpegComponent{id: seg[6+3*i], h: int(seg[7+3*i] >> 4), v: int(seg[7+3*i] & 15), quant: seg[8+3*i]}
+		if c.h < 1 || c.h > 4 || c.v < 1 || c.v > 4 || c.quant > 3 {
+			return errJPEGFormat
+		}
+		if c.h > hmax {
+			hmax = c.h
+		}
+		if c.v > vmax {
+			vmax = c.v
+		}
+		j.comps = append(j.comps, c)
+	}
+
+	// Every block takes at least two bits, so a file can not claim more
+	// blocks than that before they are allocated.
+	mcusWide, mcusHigh := (j.width+8*hmax-1)/(8*hmax), (j.height+8*vmax-1)/(8*vmax)
+	var blocks int
+	for i := range j.comps {
+		c := &j.comps[i]
+		c.blocksWide, c.blocksHigh = mcusWide*c.h, mcusHigh*c.v
+		blocks += c.blocksWide * c.blocksHigh
+	}
+	if blocks > 4*size {
+		return errJPEGFormat
+	}
+	for i := range j.comps {
+		c := &j.comps[i]
+		c.blocks = make([]jpegBlock, c.blocksWide*c.blocksHigh)
+	}
+	return nil
+}
+
+func (j *jpegImage) readQuant(seg []byte) error {
+	for len(seg) > 0 {
+		precision, t := seg[0]>>4, seg[0]&15
+		size := 1 + 64*(1+int(precision))
+		if precision > 1 || t > 3 || len(seg) < size {
+			return errJPEGFormat
+		}
+		for k := 0; k < 64; k++ {
+			if precision == 0 {
+				j.quant[t][k] = uint16(seg[1+k])
+			} else {
+				j.quant[t][k] = uint16(seg[1+2*k])<<8 | uint16(seg[2+2*k])
+			}
+		}
+		seg = seg[size:]
+	}
+	return nil
+}
+
+// readScan decodes the entropy coded data of a scan, and returns its length.
+func (j *jpegImage) readScan(seg, data []byte, tables *[2][4]*huffmanDecoder, restarts int) (int, error) {
+	if len(seg) < 1 || seg[0] == 0 || len(seg) != 4+2*int(seg[0]) {
+		return 0, errJPEGFormat
+	}
+
+	var comps []*jpegComponent
+	for i := 0; i < int(seg[0]); i++ {
+		var c *jpegComponent
+		for k := range j.comps {
+			if j.comps[k].id == seg[1+2*i] {
+				c = &j.comps[k]
+			}
+		}
+		if c == nil {
+			return 0, errJPEGFormat
+		}
+		c.dcTable, c.acTable = seg[2+2*i]>>4, seg[2+2*i]&15
+		if c.dcTable > 3 || c.acTable > 3 || tables[0][c.dcTable] == nil || tables[1][c.acTable] == nil {
+			return 0, errJPEGFormat
+		}
+		comps = append(comps, c)
+	}
+
+	// A scan of one component codes its blocks in raster order, and only
+	// those that cover the image.
+	mcusWide, mcusHigh := comps[0].blocksWide/comps[0].h, comps[0].blocksHigh/comps[0].v
+	if len(comps) == 1 {
+		var hmax, vmax int
+		for _, c := range j.comps {
+			if c.h > hmax {
+				hmax = c.h
+			}
+			if c.v > vmax {
+				vmax = c.v
+			}
+		}
+		c := comps[0]
+		mcusWide = ((j.width*c.h+hmax-1)/hmax + 7) / 8
+		mcusHigh = ((j.height*c.v+vmax-1)/vmax + 7) / 8
+	}
+
+	var (
+		br   = &bitReader{data: data}
+		pred = make([]int32, len(comps))
+	)
+	for mcu := 0; mcu < mcusWide*mcusHigh; mcu++ {
+		if restarts > 0 && mcu > 0 && mcu%restarts == 0 {
+			if !br.restart() {
+				return 0, errJPEGFormat
+			}
+			for i := range pred {
+				pred[i] = 0
+			}
+		}
+
+		mx, my := mcu%mcusWide, mcu/mcusWide
+		for i, c := range comps {
+			h, v := c.h, c.v
+			if len(comps) == 1 {
+				h, v = 1, 1
+			}
+			for y := 0; y < v; y++ {
+				for x := 0; x < h; x++ {
+					blk := c.block(mx*h+x, my*v+y)
+					if err := br.decodeBlock(blk, &pred[i], tables[0][c.dcTable], tables[1][c.acTable]); err != nil {
+						return 0, err
+					}
+				}
+			}
+		}
+	}
+	return br.end(), nil
+}
+
+// huffmanDecoder decodes the canonical codes of a huffmanSpec.
+type huffmanDecoder struct {
+	maxCode [17]int32
+	offset  [17]int32
+	values  []byte
+}
+
+func newHuffmanDecoder(spec *huffmanSpec) *huffmanDecoder {
+	d := &huffmanDecoder{values: spec.values}
+	var code, index int32
+	for l := 1; l <= 16; l++ {
+		n := int32(spec.counts[l-1])
+		d.offset[l] = index - code
+		code += n
+		index += n
+		d.maxCode[l] = code - 1
+		if n == 0 {
+			d.maxCode[l] = -1
+		}
+		code <<= 1
+	}
+	return d
+}
+
+func readHuffmanTables(seg []byte, tables *[2][4]*huffmanDecoder) error {
+	for len(seg) > 0 {
+		if len(seg) < 17 {
+			return errJPEGFormat
+		}
+		class, t := seg[0]>>4, seg[0]&15
+		if class > 1 || t > 3 {
+			return errJPEGFormat
+		}
+
+		spec := &huffmanSpec{}
+		copy(spec.counts[:], seg[1:17])
+		var n int
+		for _, c := range spec.counts {
+			n += int(c)
+		}
+		if n > 256 || len(seg) < 17+n {
+			return errJPEGFormat
+		}
+		spec.values = seg[17 : 17+n]
+		tables[class][t] = newHuffmanDecoder(spec)
+		seg = seg[17+n:]
+	}
+	return nil
+}
+
+// bitReader reads entropy coded data, removing stuffed zero bytes.
+type bitReader struct {
+	data   []byte
+	pos    int
+	bits   uint32
+	n      uint
+	marker bool
+}
+
+func (br *bitReader) bit() (uint32, error) {
+	if br.n == 0 {
+		if br.marker || br.pos >= len(br.data) {
+			return 0, errJPEGFormat
+		}
+		b := br.data[br.pos]
+		if b == 0xFF {
+			if br.pos+1 >= len(br.data) || br.data[br.pos+1] != 0 {
+				br.marker = true
+				return 0, errJPEGFormat
+			}
+			br.pos++
+		}
+		br.pos++
+		br.bits, br.n = uint32(b), 8
+	}
+	br.n--
+	return br.bits >> br.n & 1, nil
+}
+
+func (br *bitReader) receive(n uint) (int32, error) {
+	var v int32
+	for i := uint(0); i < n; i++ {
+		b, err := br.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | int32(b)
+	}
+	return v, nil
+}
+
+// extend returns the signed value of the n bit magnitude v.
+func extend(v int32, n uint) int32 {
+	if n > 0 && v < 1<<(n-1) {
+		return v - 1<<n + 1
+	}
+	return v
+}
+
+func (br *bitReader) decode(d *huffmanDecoder) (byte, error) {
+	var code int32
+	for l := 1; l <= 16; l++ {
+		b, err := br.bit()
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | int32(b)
+		if code <= d.maxCode[l] {
+			return d.values[code+d.offset[l]], nil
+		}
+	}
+	return 0, errJPEGFormat
+}
+
+func (br *bitReader) decodeBlock(blk *jpegBlock, pred *int32, dc, ac *huffmanDecoder) error {
+	s, err := br.decode(dc)
+	if err != nil {
+		return err
+	}
+	if s > 11 {
+		return errJPEGFormat
+	}
+	v, err := br.receive(uint(s))
+	if err != nil {
+		return err
+	}
+	*pred += extend(v, uint(s))
+	blk[0] = *pred
+
+	for k := 1; k < 64; k++ {
+		rs, err := br.decode(ac)
+		if err != nil {
+			return err
+		}
+		r, s := int(rs>>4), uint(rs&15)
+		if s == 0 {
+			if r != 15 {
+				break
+			}
+			k += 15
+			continue
+		}
+		if k += r; k > 63 {
+			return errJPEGFormat
+		}
+		v, err := br.receive(s)
+		if err != nil {
+			return err
+		}
+		blk[k] = extend(v, s)
+	}
+	return nil
+}
+
+// restart skips to the byte after the next RST marker.
+func (br *bitReader) restart() bool {
+	br.n, br.marker = 0, false
+	if br.pos+1 < len(br.data) && br.data[br.pos] == 0xFF && br.data[br.pos+1] >= 0xD0 && br.data[br.pos+1] <= 0xD7 {
+		br.pos += 2
+		return true
+	}
+	return false
+}
+
+// end returns the offset of the marker after the entropy coded data.
+func (br *bitReader) end() int {
+	for br.pos+1 < len(br.data) {
+		if br.data[br.pos] == 0xFF && br.data[br.pos+1] != 0 && (br.data[br.pos+1] < 0xD0 || br.data[br.pos+1] > 0xD7) {
+			break
+		}
+		br.pos++
+	}
+	return br.pos
+}
+
+// write encodes the image as a baseline JPEG with the standard Huffman
+// tables. It only supports what newJPEG produces.
+func (j *jpegImage) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.Write([]byte{0xFF, 0xD8})
+
+	var seg bytes.Buffer
+	for t := 0; t < 2; t++ {
+		seg.WriteByte(byte(t))
+		for _, q := range j.quant[t] {
+			seg.WriteByte(byte(q))
+		}
+	}
+	writeSegment(bw, 0xDB, seg.Bytes())
+
+	seg.Reset()
+	seg.Write([]byte{8, byte(j.height >> 8), byte(j.height), byte(j.width >> 8), byte(j.width), byte(len(j.comps))})
+	for _, c := range j.comps {
+		seg.Write([]byte{c.id, byte(c.h<<4 | c.v), c.quant})
+	}
+	writeSegment(bw, 0xC0, seg.Bytes())
+
+	seg.Reset()
+	for i, spec := range standardHuffman {
+		seg.WriteByte(byte(i&1<<4 | i>>1))
+		seg.Write(spec.counts[:])
+		seg.Write(spec.values)
+	}
+	writeSegment(bw, 0xC4, seg.Bytes())
+
+	seg.Reset()
+	seg.WriteByte(byte(len(j.comps)))
+	for _, c := range j.comps {
+		seg.Write([]byte{c.id, c.dcTable<<4 | c.acTable})
+	}
+	seg.Write([]byte{0, 63, 0})
+	writeSegment(bw, 0xDA, seg.Bytes())
+
+	var encoders [4]*huffmanEncoder
+	for i := range encoders {
+		encoders[i] = newHuffmanEncoder(&standardHuffman[i])
+	}
+
+	var (
+		bits = &bitWriter{w: bw}
+		pred = make([]int32, len(j.comps))
+		c0   = &j.comps[0]
+	)
+	for by := 0; by < c0.blocksHigh; by++ {
+		for bx := 0; bx < c0.blocksWide; bx++ {
+			for i := range j.comps {
+				c := &j.comps[i]
+				dc, ac := encoders[2*c.dcTable], encoders[2*c.acTable+1]
+				if err := bits.encodeBlock(c.block(bx, by), &pred[i], dc, ac); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	bits.flush()
+
+	bw.Write([]byte{0xFF, 0xD9})
+	return bw.Flush()
+}
+
+func writeSegment(w *bufio.Writer, marker byte, data []byte) {
+	w.Write([]byte{0xFF, marker, byte((len(data) + 2) >> 8), byte(len(data) + 2)})
+	w.Write(data)
+}
+
+// huffmanEncoder holds the code and length of every symbol of a huffmanSpec.
+type huffmanEncoder struct {
+	codes   [256]uint16
+	lengths [256]uint
+}
+
+func newHuffmanEncoder(spec *huffmanSpec) *huffmanEncoder {
+	e := &huffmanEncoder{}
+	var code uint16
+	k := 0
+	for l := uint(1); l <= 16; l++ {
+		for i := 0; i < int(spec.counts[l-1]); i++ {
+			e.codes[spec.values[k]], e.lengths[spec.values[k]] = code, l
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return e
+}
+
+// bitWriter writes entropy coded data, stuffing a zero after every 0xFF.
+type bitWriter struct {
+	w    *bufio.Writer
+	bits uint32
+	n    uint
+}
+
+func (bw *bitWriter) emit(v uint32, n uint) {
+	for i := n; i > 0; i-- {
+		bw.bits = bw.bits<<1 | v>>(i-1)&1
+		if bw.n++; bw.n == 8 {
+			bw.w.WriteByte(byte(bw.bits))
+			if byte(bw.bits) == 0xFF {
+				bw.w.WriteByte(0)
+			}
+			bw.bits, bw.n = 0, 0
+		}
+	}
+}
+
+// flush pads the last byte with ones.
+func (bw *bitWriter) flush() {
+	if bw.n > 0 {
+		bw.emit(0x7F, 8-bw.n)
+	}
+}
+
+func (bw *bitWriter) symbol(e *huffmanEncoder, s byte) error {
+	if e.lengths[s] == 0 {
+		return fmt.Errorf("no Huffman code for symbol 0x%02x", s)
+	}
+	bw.emit(uint32(e.codes[s]), e.lengths[s])
+	return nil
+}
+
+// magnitude returns the number of bits and the bits that code v.
+func magnitude(v int32) (uint, uint32) {
+	a := v
+	if a < 0 {
+		a = -a
+		v--
+	}
+	var n uint
+	for a > 0 {
+		n++
+		a >>= 1
+	}
+	return n, uint32(v) & (1<<n - 1)
+}
+
+func (bw *bitWriter) encodeBlock(blk *jpegBlock, pred *int32, dc, ac *huffmanEncoder) error {
+	n, bits := magnitude(blk[0] - *pred)
+	*pred = blk[0]
+	if n > 11 {
+		return errors.New("DC coefficient out of range")
+	}
+	if err := bw.symbol(dc, byte(n)); err != nil {
+		return err
+	}
+	bw.emit(bits, n)
+
+	run := 0
+	for k := 1; k < 64; k++ {
+		if blk[k] == 0 {
+			run++
+			continue
+		}
+		for ; run > 15; run -= 16 {
+			bw.symbol(ac, 0xF0)
+		}
+		n, bits := magnitude(blk[k])
+		if n > 10 {
+			return errors.New("AC coefficient out of range")
+		}
+		if err := bw.symbol(ac, byte(run<<4)|byte(n)); err != nil {
+			return err
+		}
+		bw.emit(bits, n)
+		run = 0
+	}
+	if run > 0 {
+		bw.symbol(ac, 0x00)
+	}
+	return nil
+}
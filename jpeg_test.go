@@ -0,0 +1,118 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// photoCover returns an opaque w by h cover of smooth gradients with a
+// little noise, closer to what a photo compresses like than random pixels.
+func photoCover(w, h int, seed int64) *image.RGBA {
+	img := testCover(w, h, seed)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := img.RGBAAt(x, y)
+			img.SetRGBA(x, y, color.RGBA{
+				uint8(x*200/w + int(c.R)%16),
+				uint8(y*200/h + int(c.G)%16),
+				uint8((x+y)*100/(w+h) + int(c.B)%16),
+				0xff,
+			})
+		}
+	}
+	return img
+}
+
+// resaveJPEG decodes data and saves it again at quality with image/jpeg, as
+// any other program re-saving the image would.
+func resaveJPEG(t *testing.T, data []byte, quality int) []byte {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestJPEGResaved encodes into a JPEG, which is decoded and saved again at
+// the same quality, twice, and still decodes.
+func TestJPEGResaved(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		cover image.Image
+	}{
+		{"photo", photoCover(400, 304, 1)},
+		{"noise", testCover(400, 304, 2)},
+	} {
+		for _, quality := range []int{50, 75, 90} {
+			capacity := CapacityJPEG(c.cover, quality, nil)
+			if capacity <= 0 {
+				t.Fatalf("%s at quality %d: no capacity", c.name, quality)
+			}
+			payload := testPayload(capacity, int64(quality))
+
+			var buf bytes.Buffer
+			if err := EncodeJPEG(&buf, c.cover, payload, quality, nil); err != nil {
+				t.Fatalf("%s at quality %d: %v", c.name, quality, err)
+			}
+			data := buf.Bytes()
+			for pass := 0; pass <= 2; pass++ {
+				got, err := DecodeJPEG(bytes.NewReader(data), nil)
+				if err != nil {
+					t.Errorf("%s at quality %d, saved %d more times: %v", c.name, quality, pass, err)
+					break
+				}
+				if !bytes.Equal(got, payload) {
+					t.Errorf("%s at quality %d, saved %d more times: payload differs", c.name, quality, pass)
+					break
+				}
+				data = resaveJPEG(t, data, quality)
+			}
+		}
+	}
+}
+
+func TestJPEGCapacity(t *testing.T) {
+	cover := photoCover(400, 304, 1)
+	prev := CapacityJPEG(cover, 10, nil)
+	for _, quality := range []int{30, 50, 75, 90} {
+		n := CapacityJPEG(cover, quality, nil)
+		if n > prev {
+			t.Errorf("quality %d holds %d bytes, more than %d at a lower quality", quality, n, prev)
+		}
+		prev = n
+	}
+	if n := CapacityJPEG(cover, 100, nil); n != 0 {
+		t.Errorf("quality 100 holds %d bytes, want none", n)
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeJPEG(&buf, cover, testPayload(CapacityJPEG(cover, 75, nil)+1, 1), 75, nil); err != ErrMessageTooLarge {
+		t.Errorf("encoding a byte over capacity: got %v, want %v", err, ErrMessageTooLarge)
+	}
+	if err := EncodeJPEG(&buf, cover, []byte("x"), 75, &Options{Placement: Permuted{Seed: 1}}); err != ErrJPEGPlacement {
+		t.Errorf("encoding with a placement: got %v, want %v", err, ErrJPEGPlacement)
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"math"
+)
+
+// EncodeJPEG and DecodeJPEG store a message in the parity of the quantized
+// DCT coefficients of the luminance of a JPEG, instead of in pixels. Only
+// the first jpegCoefficients AC coefficients of the blocks inside the image
+// are used, and only those with a quantization step of at least
+// jpegMinStep, since finer steps do not survive decoding and re-encoding.
+// Every bit is stored jpegRepeat times, the copies spread evenly over the
+// image, and decoded by majority.
+const (
+	jpegCoefficients = 20
+	jpegMinStep      = 2
+	jpegRepeat       = 3
+)
+
+// ErrJPEGPlacement is returned for options with a Placement other than
+// Sequential, they only apply to pixels.
+var ErrJPEGPlacement = errors.New("placements are not supported in JPEG images")
+
+// jpegSlots numbers the coefficients that carry message bits.
+type jpegSlots struct {
+	blocksWide, blocks int
+	coefficients       []int
+}
+
+func newJPEGSlots(width, height int, quant *[64]uint16) *jpegSlots {
+	s := &jpegSlots{blocksWide: width / 8, blocks: width / 8 * (height / 8)}
+	for k := 1; k <= jpegCoefficients; k++ {
+		if quant[k] >= jpegMinStep {
+			s.coefficients = append(s.coefficients, k)
+		}
+	}
+	return s
+}
+
+// stride returns the number of message bits that fit, which is also the
+// distance between copies of a bit.
+func (s *jpegSlots) stride() int {
+	return s.blocks * len(s.coefficients) / jpegRepeat
+}
+
+// bit returns the message bit stored in coefficient k of the block in column
+// bx and row by, if any.
+func (s *jpegSlots) bit(bx, by, k int) (int, bool) {
+	if bx >= s.blocksWide || by*s.blocksWide+bx >= s.blocks {
+		return 0, false
+	}
+	for n, c := range s.coefficients {
+		if c == k {
+			i := (by*s.blocksWide+bx)*len(s.coefficients) + n
+			return i % s.stride(), i/s.stride() < jpegRepeat
+		}
+	}
+	return 0, false
+}
+
+// EncodeJPEG writes cover to w as a JPEG at quality 1 to 100, with payload
+// hidden in its DCT coefficients. The message survives the image being
+// decoded and saved again as JPEG at the same quality. Higher qualities have
+// less capacity, see CapacityJPEG, and at 100 there is none.
+func EncodeJPEG(w io.Writer, cover image.Image, payload []byte, quality int, opt *Options) error {
+	if opt.placement() != nil {
+		return ErrJPEGPlacement
+	}
+	if opt.lsbFirst() {
+		return ErrBitOrderUnsupported
+	}
+	if opt.layout() != nil {
+		return ErrDepthUnsupported
+	}
+	if opt.seal() {
+		return ErrSealUnsupported
+	}
+	if opt.copies() > 1 {
+		return ErrCopiesUnsupported
+	}
+	if opt.matching() {
+		return ErrMatchingUnsupported
+	}
+	if opt.preserveHistogram() {
+		return ErrHistogramUnsupported
+	}
+	if opt.fill() {
+		return ErrFillUnsupported
+	}
+	header, payload, err := container(payload, opt)
+	if err != nil {
+		return err
+	}
+
+	var (
+		data  = append(header, payload...)
+		bits  = unpackBits(data)
+		b     = cover.Bounds()
+		q     = quantTables(clampQuality(quality))
+		slots = newJPEGSlots(b.Dx(), b.Dy(), &q[0])
+	)
+	defer Wipe(data, bits)
+	if len(bits) > slots.stride() {
+		return ErrMessageTooLarge
+	}
+
+	j := newJPEG(cover, quality, func(bx, by, k int, v float64) int32 {
+		m := math.Round(v)
+		i, ok := slots.bit(bx, by, k)
+		if !ok || i >= len(bits) || int32(m)&1 == int32(bits[i]) {
+			return int32(m)
+		}
+		// Round the other way, to the nearest value with the right
+		// parity.
+		if v > m {
+			return int32(m) + 1
+		}
+		return int32(m) - 1
+	})
+	return j.write(w)
+}
+
+// DecodeJPEG extracts the payload EncodeJPEG hid in the JPEG read from r. It
+// has to be a baseline JPEG, and it is not decoded to pixels.
+func DecodeJPEG(r io.Reader, opt *Options) ([]byte, error) {
+	msg, h, err := extractJPEG(r)
+	if err != nil {
+		return nil, err
+	}
+	return h.open(msg, opt)
+}
+
+// DetectJPEG is Detect for the JPEG read from r, see DecodeJPEG.
+func DetectJPEG(r io.Reader) (int, string, error) {
+	msg, h, err := extractJPEG(r)
+	if err != nil {
+		return 0, "", err
+	}
+	return len(msg), "jpeg/" + detectFormat(msg, h), nil
+}
+
+// DecodeHeaderJPEG is DecodeHeader for the JPEG read from r, see DecodeJPEG.
+func DecodeHeaderJPEG(r io.Reader) (*Header, error) {
+	_, h, err := extractJPEG(r)
+	return h, err
+}
+
+func extractJPEG(r io.Reader) ([]byte, *Header, error) {
+	j, err := readJPEG(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// EncodeJPEG writes the luminance at full resolution.
+	c := &j.comps[0]
+	slots := newJPEGSlots(j.width, j.height, &j.quant[c.quant])
+	if slots.stride() < 8 || c.blocksWide < j.width/8 || c.blocksHigh < j.height/8 {
+		return nil, nil, ErrNoHiddenMessage
+	}
+
+	votes := make([]int, slots.stride())
+	for by := 0; by < j.height/8; by++ {
+		for bx := 0; bx < j.width/8; bx++ {
+			blk := c.block(bx, by)
+			for _, k := range slots.coefficients {
+				if i, ok := slots.bit(bx, by, k); ok {
+					votes[i] += int(blk[k]&1)*2 - 1
+				}
+			}
+		}
+	}
+
+	bits := make([]byte, len(votes))
+	for i, v := range votes {
+		if v > 0 {
+			bits[i] = 1
+		}
+	}
+	defer Wipe(bits)
+	return readContainer(packBits(bits))
+}
+
+// CapacityJPEG returns the largest payload, in bytes, that EncodeJPEG can
+// hide in img at quality with the given options.
+func CapacityJPEG(img image.Image, quality int, opt *Options) int {
+	h, err := opt.header()
+	if err != nil || opt.placement() != nil {
+		return 0
+	}
+
+	b := img.Bounds()
+	q := quantTables(clampQuality(quality))
+	return opt.payloadCapacity(&h, newJPEGSlots(b.Dx(), b.Dy(), &q[0]).stride()/8-h.Len())
+}
+
+// readContainer reads a header and the payload it describes from data, and
+// validates the payload.
+func readContainer(data []byte) ([]byte, *Header, error) {
+	r := bytes.NewReader(data)
+	h := &Header{}
+	switch err := h.read(r); err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		return nil, nil, ErrNoHiddenMessage
+	default:
+		return nil, nil, err
+	}
+
+	// None of these carriers was ever written with the legacy header.
+	if p, err := headerPlacement(h); err != nil || p != nil || h.Version == 0 {
+		return nil, nil, ErrNoHiddenMessage
+	}
+	if err := h.checkLength(r.Len()); err != nil {
+		return nil, nil, err
+	}
+
+	msg, repaired, err := h.repair(data[len(data)-r.Len():][:h.Length])
+	if err != nil {
+		return nil, nil, err
+	}
+	h.repaired = repaired
+	if sum := h.sum(msg); !bytes.Equal(sum, h.Checksum) {
+		return nil, nil, &ChecksumError{msg, r.Len(), h.Checksum, sum}
+	}
+	if h.Flags&FlagResync != 0 {
+		if msg, err = unframe(msg); err != nil {
+			return nil, nil, err
+		}
+	}
+	return msg, h, nil
+}
+
+func clampQuality(quality int) int {
+	if quality < 1 {
+		return 1
+	} else if quality > 100 {
+		return 100
+	}
+	return quality
+}
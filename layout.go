@@ -0,0 +1,891 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// layout describes where message bits are stored in an image. The encoder
+// writes defaultLayout: one bit in every color sample, row by row, with the
+// most significant bit of every message byte first.
+type layout struct {
+	// depth is the number of low bits used in every sample, 1 to 4. The
+	// low bits of a sample hold consecutive message bits, the most
+	// significant of them first.
+	depth uint
+
+	// channels lists the sample offsets within a pixel (0 = R, 1 = G,
+	// 2 = B and 3 = A) that carry bits, in embedding order.
+	channels []int
+
+	// lsbFirst stores the least significant bit of every message byte first.
+	lsbFirst bool
+
+	// columns walks the image column by column instead of row by row.
+	columns bool
+
+	// planes walks the image once for every channel, the first of them
+	// first, instead of walking the channels of every pixel in turn. Only
+	// Search reads it.
+	planes bool
+
+	// depths, if set, replaces depth with the number of low bits of each
+	// of channels. They need not be the same, see ChannelDepth.
+	depths []uint
+}
+
+var defaultLayout = layout{depth: 1, channels: []int{0, 1, 2}}
+
+// ErrDepthUnsupported is returned for ChannelDepth options when encoding
+// anything but the pixels of an image.
+var ErrDepthUnsupported = errors.New("channel depths are only supported in the pixels of an image")
+
+// ErrMatchingUnsupported is returned for the Matching option when encoding
+// anything but the pixels of an image.
+var ErrMatchingUnsupported = errors.New("LSB matching is only supported in the pixels of an image")
+
+// ErrBitOrderUnsupported is returned for LSBFirst when encoding anything but
+// the pixels of an image.
+var ErrBitOrderUnsupported = errors.New("the bit order can only be changed in the pixels of an image")
+
+// BitOrder is the order the bits of every byte of the container are stored
+// in, see Options.BitOrder.
+type BitOrder byte
+
+const (
+	// MSBFirst stores the most significant bit of every byte first, the
+	// default.
+	MSBFirst BitOrder = iota
+
+	// LSBFirst stores the least significant bit of every byte first, as
+	// some other tools do.
+	LSBFirst
+)
+
+func (o BitOrder) String() string {
+	switch o {
+	case MSBFirst:
+		return "msb-first"
+	case LSBFirst:
+		return "lsb-first"
+	}
+	return fmt.Sprintf("bit-order-0x%02x", byte(o))
+}
+
+// ChannelDepth is the number of low bits, 0 to 4, of the R, G, B and A
+// samples that carry the payload, see Options.Depth. The header is always
+// stored in one bit of every channel with a depth above 0, and records the
+// depths, so channels of depth 0 are left exactly as they are. Only covers
+// with straight alpha, an *image.NRGBA or *image.NRGBA64, can use the alpha
+// channel; in an opaque one its low bits change nothing that can be seen.
+type ChannelDepth [4]int
+
+// MaxDepth is the most low bits of a sample a ChannelDepth can use.
+const MaxDepth = 4
+
+// ParseChannelDepth parses a ChannelDepth written like "r:1,g:1,b:3,a:1",
+// where missing channels get depth 0, or a single depth for the three color
+// channels like "2".
+func ParseChannelDepth(s string) (ChannelDepth, error) {
+	var d ChannelDepth
+	if n, err := strconv.Atoi(s); err == nil {
+		d = ChannelDepth{n, n, n}
+		return d, d.validate()
+	}
+
+	var seen [4]bool
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		c := strings.Index(channelLetters, strings.ToLower(kv[0]))
+		if len(kv) != 2 || len(kv[0]) != 1 || c < 0 {
+			return d, fmt.Errorf("invalid channel depth %q, expected a channel letter and a depth like b:3", part)
+		}
+		if seen[c] {
+			return d, fmt.Errorf("channel %s is given twice", kv[0])
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return d, fmt.Errorf("invalid depth %q of channel %s", kv[1], kv[0])
+		}
+		d[c], seen[c] = n, true
+	}
+	return d, d.validate()
+}
+
+// ParseChannels parses a set of channels written as their letters, like
+// "b", "gb" or "rgba", as a ChannelDepth of one bit of each of them.
+func ParseChannels(s string) (ChannelDepth, error) {
+	var d ChannelDepth
+	for _, r := range strings.ToLower(s) {
+		c := strings.IndexRune(channelLetters, r)
+		if c < 0 {
+			return d, fmt.Errorf("invalid channel %q, expected r, g, b or a", r)
+		}
+		if d[c] > 0 {
+			return d, fmt.Errorf("channel %c is given twice", r)
+		}
+		d[c] = 1
+	}
+	return d, d.validate()
+}
+
+// depthLadder lists the depths AutoDepth tries, from the stealthiest up, one
+// more bit at a time: blue first, which the eye is least sensitive to, then
+// red, then green.
+var depthLadder = []ChannelDepth{
+	{1, 1, 1}, {1, 1, 2}, {2, 1, 2}, {2, 2, 2},
+	{2, 2, 3}, {3, 2, 3}, {3, 3, 3},
+	{3, 3, 4}, {4, 3, 4}, {4, 4, 4},
+}
+
+// AutoDepth returns the least depth at which cover holds payload with opt,
+// whose Depth it ignores, after any Compression and with the cost of ECC,
+// resync blocks and encryption. One bit of every channel is returned as the
+// zero ChannelDepth, the default, which stores no depth in the header.
+// Options that need the default depth, like Matching or Copies, only try
+// that. A gray cover, whose one sample stands in for red, only tries the
+// same depth in every channel. It fails with ErrMessageTooLarge if not even
+// MaxDepth bits of every channel hold it.
+func AutoDepth(cover image.Image, payload []byte, opt *Options) (ChannelDepth, error) {
+	size := len(payload)
+	if opt != nil && opt.Compression != nil {
+		compressed, _, ok, err := compress(opt.Compression, payload)
+		if err != nil {
+			return ChannelDepth{}, err
+		}
+		if ok {
+			size = len(compressed)
+		}
+	}
+
+	var o Options
+	if opt != nil {
+		o = *opt
+	}
+	gray := isGray(cover)
+	for _, d := range depthLadder {
+		if gray && (d[1] != d[0] || d[2] != d[0]) {
+			continue
+		}
+		o.Depth = d
+		if d == (ChannelDepth{1, 1, 1}) {
+			o.Depth = ChannelDepth{}
+		}
+		if o.Validate() != nil {
+			continue
+		}
+		if Capacity(cover, &o) >= size {
+			return o.Depth, nil
+		}
+	}
+	return ChannelDepth{}, ErrMessageTooLarge
+}
+
+func (d ChannelDepth) String() string {
+	var s []string
+	for c, n := range d {
+		if c == alphaChannel && n == 0 {
+			break
+		}
+		s = append(s, fmt.Sprintf("%c:%d", channelLetters[c], n))
+	}
+	return strings.Join(s, ",")
+}
+
+func (d ChannelDepth) validate() error {
+	for c, n := range d {
+		if n < 0 || n > MaxDepth {
+			return fmt.Errorf("depth %d of channel %c is not between 0 and %d", n, channelLetters[c], MaxDepth)
+		}
+	}
+	if d == (ChannelDepth{}) {
+		return errors.New("every channel has depth 0, there is nowhere to store the message")
+	}
+	return nil
+}
+
+// layout returns the layout of the payload, the channels of depth 0 left
+// out.
+func (d ChannelDepth) layout() *layout {
+	l := &layout{depth: 1}
+	for c, n := range d {
+		if n > 0 {
+			l.channels = append(l.channels, c)
+			l.depths = append(l.depths, uint(n))
+		}
+	}
+	return l
+}
+
+// depthField returns d as the value of a FieldDepth field: the depths of the
+// color channels, and of the alpha channel only if it carries any bits, so
+// that headers without it read as they always have.
+func (d ChannelDepth) depthField() Field {
+	v := []byte{byte(d[0]), byte(d[1]), byte(d[2])}
+	if d[alphaChannel] > 0 {
+		v = append(v, byte(d[alphaChannel]))
+	}
+	return Field{FieldDepth, v}
+}
+
+// parseDepthField parses the value of a FieldDepth field.
+func parseDepthField(v []byte) (ChannelDepth, error) {
+	var d ChannelDepth
+	if len(v) != 3 && len(v) != 4 {
+		return d, fmt.Errorf("depth field is %d bytes, expected 3 or 4", len(v))
+	}
+	for c, n := range v {
+		d[c] = int(n)
+	}
+	return d, nil
+}
+
+// headerDepth returns the payload layout in the FieldDepth field of h, or
+// nil if it has none.
+func headerDepth(h *Header) (*layout, error) {
+	v, ok := h.Field(FieldDepth)
+	if !ok {
+		return nil, nil
+	}
+	d, err := parseDepthField(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.validate(); err != nil {
+		return nil, err
+	}
+	return d.layout(), nil
+}
+
+// Depth returns the channel depths the payload is stored in, or false for
+// the default of one bit of every channel.
+func (h *Header) Depth() (ChannelDepth, bool) {
+	v, ok := h.Field(FieldDepth)
+	if !ok {
+		return ChannelDepth{}, false
+	}
+	d, err := parseDepthField(v)
+	return d, err == nil
+}
+
+// bootstrap returns the layout the header is stored in when the payload is
+// stored in l: one bit of every channel of l, row by row, in the bit order
+// of l.
+func (l *layout) bootstrap() *layout {
+	return &layout{depth: 1, channels: l.channels, lsbFirst: l.lsbFirst}
+}
+
+// channelLetters names the channels by sample offset within a pixel.
+const channelLetters = "rgba"
+
+// alphaChannel is the sample offset of the alpha channel within a pixel.
+const alphaChannel = 3
+
+// ErrAlphaUnsupported is returned for a ChannelDepth that uses the alpha
+// channel with a cover that has no straight alpha samples to change.
+var ErrAlphaUnsupported = errors.New("the alpha channel only carries the message in an *image.NRGBA or *image.NRGBA64 cover")
+
+// checkAlpha returns ErrAlphaUnsupported if l stores bits in the alpha
+// channel of cover and cover has none to change. The samples of a
+// premultiplied image can not be more than its alpha, so its alpha can not
+// change on its own.
+func checkAlpha(cover image.Image, l *layout) error {
+	if l == nil || l.channelDepth(alphaChannel) == 0 || hasStraightAlpha(cover) {
+		return nil
+	}
+	return ErrAlphaUnsupported
+}
+
+// hasStraightAlpha reports whether img has alpha samples that are not
+// premultiplied into its colors, which a message can be stored in.
+func hasStraightAlpha(img image.Image) bool {
+	switch img.(type) {
+	case *image.NRGBA, *image.NRGBA64:
+		return true
+	}
+	return false
+}
+
+func (l *layout) String() string {
+	var ch []string
+	for i, c := range l.channels {
+		if l.depths != nil {
+			ch = append(ch, fmt.Sprintf("%c:%d", channelLetters[c], l.depths[i]))
+			continue
+		}
+		ch = append(ch, channelLetters[c:c+1])
+	}
+
+	order, scan := MSBFirst, "rows"
+	if l.lsbFirst {
+		order = LSBFirst
+	}
+	if l.columns {
+		scan = "columns"
+	}
+	if l.planes {
+		scan = "planes"
+	}
+	if l.depths != nil {
+		return fmt.Sprintf("depth=%s order=%s scan=%s", strings.Join(ch, ","), order, scan)
+	}
+	return fmt.Sprintf("depth=%d channels=%s order=%s scan=%s", l.depth, strings.Join(ch, ""), order, scan)
+}
+
+// layouts returns every layout the decoder knows how to read in the first
+// n channels, 3 or with the alpha channel 4, starting with the default.
+func layouts(n int) []layout {
+	all := []layout{defaultLayout}
+	for depth := uint(1); depth <= 4; depth++ {
+		for _, ch := range channelSets(n) {
+			for _, lsbFirst := range []bool{false, true} {
+				for _, columns := range []bool{false, true} {
+					l := layout{depth: depth, channels: ch, lsbFirst: lsbFirst, columns: columns}
+					if l.String() != defaultLayout.String() {
+						all = append(all, l)
+					}
+				}
+			}
+		}
+	}
+	return all
+}
+
+// searchLayouts returns the layouts of layouts(n) and more for Search:
+// every order of the channels, and the channels a plane at a time.
+func searchLayouts(n int) []layout {
+	all := []layout{defaultLayout}
+	for depth := uint(1); depth <= 4; depth++ {
+		for _, ch := range channelOrders(n) {
+			for _, lsbFirst := range []bool{false, true} {
+				for scan := 0; scan < 3; scan++ {
+					l := layout{depth: depth, channels: ch, lsbFirst: lsbFirst, columns: scan == 1, planes: scan == 2}
+					if l.planes && len(ch) == 1 || l.String() == defaultLayout.String() {
+						continue
+					}
+					all = append(all, l)
+				}
+			}
+		}
+	}
+	return all
+}
+
+// channelOrders returns every order of every set of channelSets(n).
+func channelOrders(n int) [][]int {
+	var orders [][]int
+	var permute func(ch []int, k int)
+	permute = func(ch []int, k int) {
+		if k == len(ch) {
+			orders = append(orders, append([]int(nil), ch...))
+			return
+		}
+		for i := k; i < len(ch); i++ {
+			ch[k], ch[i] = ch[i], ch[k]
+			permute(ch, k+1)
+			ch[k], ch[i] = ch[i], ch[k]
+		}
+	}
+	for _, ch := range channelSets(n) {
+		permute(ch, 0)
+	}
+	return orders
+}
+
+// channelSets returns every non-empty set of the first n channels, all of
+// them first.
+func channelSets(n int) [][]int {
+	var sets [][]int
+	for mask := 1<<uint(n) - 1; mask > 0; mask-- {
+		var ch []int
+		for c := 0; c < n; c++ {
+			if mask&(1<<uint(c)) != 0 {
+				ch = append(ch, c)
+			}
+		}
+		sets = append(sets, ch)
+	}
+	return sets
+}
+
+// storedLayout returns the layout Encode stored the header of img in: the
+// default, or the bootstrap layout of a ChannelDepth that leaves channels
+// out or adds the alpha channel, most significant bit first and then least.
+// The header of an Exclude placement may start further down, in the red,
+// green and blue channels either way. The default is returned if none
+// holds a header.
+func storedLayout(img *carrierImage) *layout {
+	if _, err := readHeader(newLSBReader(img, &defaultLayout), nil); err == nil {
+		return &defaultLayout
+	}
+	for _, l := range bootstrapLayouts() {
+		if h, err := readHeader(newLSBReader(img, l), nil); err == nil {
+			if _, ok := h.Field(FieldDepth); ok {
+				return l
+			}
+		}
+	}
+	lsb := &layout{depth: 1, channels: defaultLayout.channels, lsbFirst: true}
+	if excludedHeader(img, &defaultLayout) == nil && excludedHeader(img, lsb) != nil {
+		return lsb
+	}
+	return &defaultLayout
+}
+
+// bootstrapLayouts returns the layouts other than the default a header can
+// be stored in, those of a ChannelDepth that leaves channels out or adds
+// the alpha channel, most significant bit first and then least.
+func bootstrapLayouts() []*layout {
+	var ls []*layout
+	for _, lsbFirst := range []bool{false, true} {
+		for _, ch := range channelSets(4) {
+			if len(ch) == 3 && ch[2] == 2 && !lsbFirst {
+				continue // the default
+			}
+			ls = append(ls, &layout{depth: 1, channels: ch, lsbFirst: lsbFirst})
+		}
+	}
+	return ls
+}
+
+// slots returns the numbering of the carrier slots of an image with bounds
+// b, see Slots.
+func (l *layout) slots(b image.Rectangle, start int) Slots {
+	return Slots{Width: b.Dx(), Height: b.Dy(), PerPixel: l.perPixel(), Columns: l.columns, Start: start}
+}
+
+// channelDepth returns the number of low bits of channel c that hold the
+// payload in l, 0 if c is not one of its channels.
+func (l *layout) channelDepth(c int) uint {
+	for k, ch := range l.channels {
+		if ch == c {
+			if l.depths != nil {
+				return l.depths[k]
+			}
+			return l.depth
+		}
+	}
+	return 0
+}
+
+// perPixel returns the number of carrier bits in a pixel.
+func (l *layout) perPixel() int {
+	if l.depths == nil {
+		return len(l.channels) * int(l.depth)
+	}
+	var n int
+	for _, d := range l.depths {
+		n += int(d)
+	}
+	return n
+}
+
+// slot returns the Pix offset of the sample holding slot i and the bit plane
+// within it. The low bits of a sample hold consecutive slots, the most
+// significant of them first.
+func (l *layout) slot(img *carrierImage, s *Slots, i int) (int, uint) {
+	if l.planes {
+		n := s.Width * s.Height * int(l.depth)
+		p := s.Pixel(i % n / int(l.depth) * s.PerPixel)
+		return img.sample(p.X, p.Y, l.channels[i/n]), l.depth - 1 - uint(i%n)%l.depth
+	}
+
+	p := s.Pixel(i)
+	within := i % s.PerPixel
+	if l.depths == nil {
+		return img.sample(p.X, p.Y, l.channels[within/int(l.depth)]), l.depth - 1 - uint(within)%l.depth
+	}
+
+	k := 0
+	for within >= int(l.depths[k]) {
+		within -= int(l.depths[k])
+		k++
+	}
+	return img.sample(p.X, p.Y, l.channels[k]), l.depths[k] - 1 - uint(within)
+}
+
+// carrierImage holds the samples of an image that carry a message. They are
+// bytes in RGBA order, or with wide set big-endian 16 bit samples in RGBA
+// order, whose low byte carries the message bits. With gray set a pixel is a
+// single sample of either width. Pix starts at Rect.Min.
+type carrierImage struct {
+	Pix    []byte
+	Stride int
+	Rect   image.Rectangle
+	wide   bool
+	gray   bool
+
+	// used, if not nil, marks the Pix offsets of the samples that hold a
+	// message bit in any of their low bits, see histogram and fill.
+	used []bool
+
+	// legacy accepts a legacy header when decoding, see Options.Legacy.
+	legacy bool
+
+	// deniable reads a Keyed placement as the Deniable one that stores the
+	// same header.
+	deniable bool
+}
+
+// carrierOf returns the samples of img. A 16 bit or gray image is used as it
+// is, anything else is converted to RGBA.
+func carrierOf(img image.Image) *carrierImage {
+	switch m := img.(type) {
+	case *image.RGBA64:
+		return &carrierImage{m.Pix, m.Stride, m.Rect, true, false, nil, false, false}
+	case *image.NRGBA64:
+		return &carrierImage{m.Pix, m.Stride, m.Rect, true, false, nil, false, false}
+	case *image.NRGBA:
+		return &carrierImage{m.Pix, m.Stride, m.Rect, false, false, nil, false, false}
+	case *image.Gray16:
+		return &carrierImage{m.Pix, m.Stride, m.Rect, true, true, nil, false, false}
+	case *image.Gray:
+		return &carrierImage{m.Pix, m.Stride, m.Rect, false, true, nil, false, false}
+	}
+	m := toRGBA(img)
+	return &carrierImage{m.Pix, m.Stride, m.Rect, false, false, nil, false, false}
+}
+
+// copyCarrier returns a copy of cover, in the same image type, and its
+// samples. Only the image types Encode accepts can be copied.
+func copyCarrier(cover image.Image) (image.Image, *carrierImage, error) {
+	var src *carrierImage
+	switch cover.(type) {
+	case *image.RGBA, *image.NRGBA, *image.RGBA64, *image.NRGBA64, *image.Gray, *image.Gray16:
+		src = carrierOf(cover)
+	default:
+		return nil, nil, ErrUnsupportedImage
+	}
+
+	r, bpp := src.Rect, src.pixelSize()
+	dst := &carrierImage{make([]byte, r.Dx()*r.Dy()*bpp), r.Dx() * bpp, r, src.wide, src.gray, nil, false, false}
+	for y := 0; y < r.Dy(); y++ {
+		copy(dst.Pix[y*dst.Stride:(y+1)*dst.Stride], src.Pix[y*src.Stride:])
+	}
+
+	switch cover.(type) {
+	case *image.RGBA64:
+		return &image.RGBA64{Pix: dst.Pix, Stride: dst.Stride, Rect: r}, dst, nil
+	case *image.NRGBA64:
+		return &image.NRGBA64{Pix: dst.Pix, Stride: dst.Stride, Rect: r}, dst, nil
+	case *image.NRGBA:
+		return &image.NRGBA{Pix: dst.Pix, Stride: dst.Stride, Rect: r}, dst, nil
+	case *image.Gray16:
+		return &image.Gray16{Pix: dst.Pix, Stride: dst.Stride, Rect: r}, dst, nil
+	case *image.Gray:
+		return &image.Gray{Pix: dst.Pix, Stride: dst.Stride, Rect: r}, dst, nil
+	}
+	return &image.RGBA{Pix: dst.Pix, Stride: dst.Stride, Rect: r}, dst, nil
+}
+
+// isGray reports whether img is a gray image the carrier uses as it is, with
+// a single sample per pixel.
+func isGray(img image.Image) bool {
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+// pixelSize returns the number of Pix bytes of a pixel.
+func (m *carrierImage) pixelSize() int {
+	n := 4
+	if m.gray {
+		n = 1
+	}
+	if m.wide {
+		n *= 2
+	}
+	return n
+}
+
+// colors returns the number of color samples of a pixel.
+func (m *carrierImage) colors() int {
+	if m.gray {
+		return 1
+	}
+	return 3
+}
+
+// sample returns the Pix offset of the byte holding the low bits of channel
+// c of the pixel at x, y, relative to the image origin. A gray pixel has
+// only channel 0.
+func (m *carrierImage) sample(x, y, c int) int {
+	switch {
+	case m.gray && m.wide:
+		return y*m.Stride + x*2 + 1
+	case m.gray:
+		return y*m.Stride + x
+	case m.wide:
+		return y*m.Stride + x*8 + c*2 + 1
+	}
+	return y*m.Stride + x*4 + c
+}
+
+// restrict returns l for a carrier with a single gray sample per pixel if
+// gray is set: the sample stands in for the first channel of l, at its
+// depth, and the other channels are left out. Otherwise l is returned as it
+// is.
+func (l *layout) restrict(gray bool) *layout {
+	if !gray || len(l.channels) == 1 && l.channels[0] == 0 {
+		return l
+	}
+	g := *l
+	g.channels = []int{0}
+	if l.depths != nil {
+		g.depths = l.depths[:1]
+	}
+	return &g
+}
+
+// carrierBits walks the carrier bits of an image. The header is always
+// stored sequentially, the payload can then be placed elsewhere.
+type carrierBits struct {
+	img     *carrierImage
+	layout  *layout
+	slots   Slots
+	carrier Carrier
+	used    int
+}
+
+func newCarrierBits(img *carrierImage, l *layout) carrierBits {
+	l = l.restrict(img.gray)
+	s := l.slots(img.Rect, 0)
+	s.img, s.layout = img, l
+	return carrierBits{img: img, layout: l, slots: s, carrier: Sequential{}.Carrier(s)}
+}
+
+// next returns the Pix offset and bit plane of the next carrier bit.
+func (c *carrierBits) next() (int, uint, bool) {
+	i, ok := c.carrier.Next()
+	if !ok || i < 0 || i >= c.slots.Len() {
+		return 0, 0, false
+	}
+	c.used++
+	offset, plane := c.layout.slot(c.img, &c.slots, i)
+	return offset, plane, true
+}
+
+// place continues with the slots of p, starting after those used so far.
+func (c *carrierBits) place(p Placement) {
+	c.slots.Start = c.used
+	c.carrier = p.Carrier(c.slots)
+}
+
+// seek continues sequentially from slot i, as if the slots before it were
+// used. The header of an Exclude placement starts there.
+func (c *carrierBits) seek(i int) {
+	c.used = i
+	c.carrier = &stridedCarrier{i, c.slots.Len(), 1}
+}
+
+// relayout continues in layout l, from the first pixel after the carrier
+// bits used so far. The header is stored in the bootstrap layout of l, the
+// payload in l.
+func (c *carrierBits) relayout(l *layout) {
+	l = l.restrict(c.img.gray)
+	c.layout = l
+	c.slots = l.payloadSlots(c.img.Rect, c.used)
+	c.slots.img, c.slots.layout = c.img, l
+	c.used = c.slots.Start
+	c.carrier = Sequential{}.Carrier(c.slots)
+}
+
+// payloadSlots returns the slots of an image with bounds b that are left for
+// the payload when the payload is stored in l after a header of n bits, see
+// relayout.
+func (l *layout) payloadSlots(b image.Rectangle, n int) Slots {
+	boot := l.bootstrap().perPixel()
+	s := l.slots(b, 0)
+	s.Start = (n + boot - 1) / boot * s.PerPixel
+	return s
+}
+
+// remaining returns the number of carrier bits left.
+func (c *carrierBits) remaining() int {
+	if r, ok := c.carrier.(interface{ Remaining() int }); ok {
+		return r.Remaining()
+	}
+	return c.slots.Len() - c.used
+}
+
+// lsbReader reads message bytes from the carrier bits of an image.
+type lsbReader struct {
+	carrierBits
+}
+
+func newLSBReader(img *carrierImage, l *layout) *lsbReader {
+	return &lsbReader{newCarrierBits(img, l)}
+}
+
+// read is Read on the calling goroutine.
+func (lr *lsbReader) read(p []byte) (int, error) {
+	var n int
+	for n < len(p) {
+		if n += lr.readRow(p[n:]); n == len(p) {
+			break
+		}
+
+		b, ok := lr.readByte()
+		if !ok {
+			return n, io.EOF
+		}
+		p[n] = b
+		n++
+	}
+	return n, nil
+}
+
+// readByte reads the next message byte one carrier bit at a time.
+func (lr *lsbReader) readByte() (byte, bool) {
+	var (
+		pix = lr.img.Pix
+		res byte
+	)
+	for j := uint(0); j < 8; j++ {
+		offset, plane, ok := lr.next()
+		if !ok {
+			return 0, false
+		}
+
+		bit := (pix[offset] >> plane) & 1
+		if lr.layout.lsbFirst {
+			res |= bit << j
+		} else {
+			res |= bit << (7 - j)
+		}
+	}
+	return res, true
+}
+
+// rowOffsets holds the Pix offsets, relative to the pixel of the first one,
+// of eight consecutive 8 bit samples of defaultLayout starting in channel c.
+var rowOffsets = func() (t [3][8]int) {
+	for c := range t {
+		for j := range t[c] {
+			t[c][j] = (c+j)/3*4 + (c+j)%3
+		}
+	}
+	return
+}()
+
+// readRow is the fast path of Read for sequential slots in the default
+// layout and 8 bit samples. It reads bytes into p as long as their eight
+// carrier bits are in the same row, and returns how many it read.
+func (lr *lsbReader) readRow(p []byte) int {
+	c, ok := lr.carrier.(*stridedCarrier)
+	l := lr.layout
+	if !ok || c.stride != 1 || lr.img.wide || l.depth != 1 || l.depths != nil || l.lsbFirst || l.columns || l.planes || len(l.channels) != 3 ||
+		l.channels[0] != 0 || l.channels[1] != 1 || l.channels[2] != 2 {
+		return 0
+	}
+
+	var (
+		img      = lr.img
+		pix      = img.Pix
+		rowSlots = lr.slots.Width * 3
+		n        int
+	)
+	for ; n < len(p) && c.next+8 <= c.end; n++ {
+		x, y := c.next%rowSlots, c.next/rowSlots
+		if x+8 > rowSlots {
+			break
+		}
+
+		i, d := img.sample(x/3, y, 0), &rowOffsets[x%3]
+		p[n] = pix[i+d[0]]&1<<7 | pix[i+d[1]]&1<<6 | pix[i+d[2]]&1<<5 | pix[i+d[3]]&1<<4 |
+			pix[i+d[4]]&1<<3 | pix[i+d[5]]&1<<2 | pix[i+d[6]]&1<<1 | pix[i+d[7]]&1
+		c.next += 8
+		lr.used += 8
+	}
+	return n
+}
+
+// remaining returns the number of whole bytes left to read.
+func (lr *lsbReader) remaining() int {
+	return lr.carrierBits.remaining() / 8
+}
+
+// lsbWriter stores message bytes in the carrier bits of an image. With
+// match set it changes a sample whose bit is wrong by one up or down, as
+// match picks, instead of replacing the bit, see Options.Matching.
+type lsbWriter struct {
+	carrierBits
+	match *rand.Rand
+}
+
+func newLSBWriter(img *carrierImage, l *layout) *lsbWriter {
+	return &lsbWriter{carrierBits: newCarrierBits(img, l)}
+}
+
+// write is Write on the calling goroutine.
+func (lw *lsbWriter) write(p []byte) (int, error) {
+	pix := lw.img.Pix
+	for n, b := range p {
+		for j := uint(0); j < 8; j++ {
+			offset, plane, ok := lw.next()
+			if !ok {
+				return n, ErrMessageTooLarge
+			}
+			if lw.img.used != nil {
+				lw.img.used[offset] = true
+			}
+
+			bit := b >> (7 - j) & 1
+			if lw.layout.lsbFirst {
+				bit = b >> j & 1
+			}
+			if lw.match != nil && plane == 0 {
+				if pix[offset]&1 != bit {
+					lw.step(offset)
+				}
+				continue
+			}
+			pix[offset] = pix[offset]&^(1<<plane) | bit<<plane
+		}
+	}
+	return len(p), nil
+}
+
+// step adds or subtracts one from the sample at offset, which flips its
+// lowest bit, staying in its range.
+func (lw *lsbWriter) step(offset int) {
+	pix := lw.img.Pix
+	v, max := int(pix[offset]), 0xFF
+	if lw.img.wide {
+		v, max = int(pix[offset-1])<<8|v, 0xFFFF
+	}
+	switch {
+	case v == 0:
+		v++
+	case v == max || lw.match.Intn(2) == 0:
+		v--
+	default:
+		v++
+	}
+	pix[offset] = byte(v)
+	if lw.img.wide {
+		pix[offset-1] = byte(v >> 8)
+	}
+}
@@ -0,0 +1,263 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"strings"
+	"testing"
+)
+
+// bitByBit reads what is left of r one carrier bit at a time, the way Read
+// did before it had a fast path.
+func bitByBit(r *lsbReader) []byte {
+	var p []byte
+	for {
+		b, ok := r.readByte()
+		if !ok {
+			return p
+		}
+		p = append(p, b)
+	}
+}
+
+// TestLSBReaderFastPath reads images in chunks of several sizes, from several
+// carrier bits on, and compares with reading them bit by bit. Rows of 111
+// slots make bytes cross rows at every possible bit.
+func TestLSBReaderFastPath(t *testing.T) {
+	wide := image.NewRGBA64(image.Rect(0, 0, 37, 11))
+	copy(wide.Pix, testCover(37, 22, 135).Pix)
+	gray := image.NewGray(image.Rect(0, 0, 37, 11))
+	copy(gray.Pix, testCover(37, 11, 135).Pix)
+
+	images := map[string]image.Image{
+		"rgba":     testCover(37, 11, 135),
+		"subimage": testCover(64, 40, 135).SubImage(image.Rect(3, 5, 50, 33)),
+		"wide":     wide,
+		"gray":     gray,
+	}
+	layouts := map[string]*layout{
+		"default":   &defaultLayout,
+		"lsb-first": {depth: 1, channels: []int{0, 1, 2}, lsbFirst: true},
+		"columns":   {depth: 1, channels: []int{0, 1, 2}, columns: true},
+		"depth-2":   {depth: 2, channels: []int{0, 1, 2}},
+		"bgr":       {depth: 1, channels: []int{2, 1, 0}},
+	}
+
+	for in, img := range images {
+		for ln, l := range layouts {
+			for _, start := range []int{0, 1, 5, 107, 300} {
+				for _, chunk := range []int{1, 7, 4096} {
+					name := fmt.Sprintf("%s/%s/start-%d/chunk-%d", in, ln, start, chunk)
+					want, got := newLSBReader(carrierOf(img), l), newLSBReader(carrierOf(img), l)
+					for i := 0; i < start; i++ {
+						want.next()
+						got.next()
+					}
+
+					var p []byte
+					for {
+						b := make([]byte, chunk)
+						n, err := got.Read(b)
+						p = append(p, b[:n]...)
+						if err != nil {
+							break
+						}
+					}
+					if w := bitByBit(want); !bytes.Equal(p, w) {
+						t.Errorf("%s: read %d bytes that differ from the %d read bit by bit", name, len(p), len(w))
+					}
+				}
+			}
+		}
+	}
+
+	// Make sure the comparison is not between two slow paths.
+	r := newLSBReader(carrierOf(images["rgba"]), &defaultLayout)
+	if n := r.readRow(make([]byte, 8)); n == 0 {
+		t.Error("the default layout did not take the fast path")
+	}
+}
+
+// BenchmarkDecode decodes a synthetic 50 MP image that is full.
+func BenchmarkDecode(b *testing.B) {
+	cover := testCover(8660, 5774, 135)
+	stego, err := Encode(cover, testPayload(Capacity(cover, nil), 135), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(stego, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestChannelDepth fills covers to capacity with asymmetric schedules and
+// checks that only the low bits of each channel the schedule gives change,
+// and that channels of depth 0 are exactly as they were.
+func TestChannelDepth(t *testing.T) {
+	for _, d := range []ChannelDepth{
+		{1, 1, 3, 0},
+		{0, 0, 1, 0},
+		{0, 2, 0, 0},
+		{2, 0, 4, 0},
+		{3, 1, 2, 0},
+		{4, 4, 4, 0},
+		{0, 1, 1, 2},
+		{1, 0, 0, 4},
+	} {
+		t.Run(d.String(), func(t *testing.T) {
+			rgba := testCover(90, 70, 156)
+			var cover image.Image = rgba
+			if d[alphaChannel] > 0 {
+				cover = &image.NRGBA{Pix: rgba.Pix, Stride: rgba.Stride, Rect: rgba.Rect}
+			}
+			opt := &Options{Depth: d}
+			n := Capacity(cover, opt)
+			if n <= 0 {
+				t.Fatalf("capacity %d", n)
+			}
+			if _, err := Encode(cover, testPayload(n+1, 156), opt); err != ErrMessageTooLarge {
+				t.Errorf("%d bytes, one more than the capacity: got %v, want ErrMessageTooLarge", n+1, err)
+			}
+
+			stego := roundTrip(t, cover, testPayload(n, 156), opt, nil)
+			if got, _, err := DecodeAuto(stego, nil); err != nil || !bytes.Equal(got, testPayload(n, 156)) {
+				t.Errorf("DecodeAuto: %v", err)
+			}
+			h, err := DecodeHeader(stego)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := h.Depth(); !ok || got != d {
+				t.Errorf("header records depth %v, %v", got, ok)
+			}
+
+			var changed [4]int
+			before, after := pixels(t, cover), pixels(t, stego)
+			for i := range before {
+				c := i % 4
+				diff := before[i] ^ after[i]
+				if diff>>uint(d[c]) != 0 {
+					t.Fatalf("sample %d of channel %c changed by %08b, beyond depth %d", i/4, channelLetters[c], diff, d[c])
+				}
+				if diff != 0 {
+					changed[c]++
+				}
+			}
+			for c, n := range d {
+				if n > 0 && changed[c] == 0 {
+					t.Errorf("nothing stored in channel %c of depth %d", channelLetters[c], n)
+				}
+			}
+		})
+	}
+}
+
+// TestChannelDepthCapacity checks that capacity grows with the depths.
+func TestChannelDepthCapacity(t *testing.T) {
+	cover := testCover(90, 70, 156)
+	prev := 0
+	for _, d := range depthLadder {
+		n := Capacity(cover, &Options{Depth: d})
+		if n <= prev {
+			t.Errorf("%v holds %d bytes, %d with one bit less", d, n, prev)
+		}
+		prev = n
+	}
+	if n, want := Capacity(cover, &Options{Depth: ChannelDepth{1, 1, 1, 0}}), Capacity(cover, nil); n > want || n < want-8 {
+		t.Errorf("one bit of every channel holds %d bytes, the default %d", n, want)
+	}
+}
+
+// TestAutoDepth checks that AutoDepth picks the first depth of the ladder
+// that holds the payload.
+func TestAutoDepth(t *testing.T) {
+	cover := testCover(90, 70, 298)
+	for i, d := range depthLadder[1:] {
+		size := Capacity(cover, &Options{Depth: depthLadder[i]}) + 1
+		got, err := AutoDepth(cover, testPayload(size, 298), nil)
+		if err != nil || got != d {
+			t.Errorf("%d bytes: got %v, %v, want %v", size, got, err, d)
+		}
+	}
+	if d, err := AutoDepth(cover, []byte("x"), nil); err != nil || d != (ChannelDepth{}) {
+		t.Errorf("one byte: got %v, %v, want the default depth", d, err)
+	}
+	if _, err := AutoDepth(cover, testPayload(Capacity(cover, nil)+1, 298), &Options{Matching: true}); err != ErrMessageTooLarge {
+		t.Errorf("matching: got %v, want ErrMessageTooLarge", err)
+	}
+	size := Capacity(cover, &Options{Depth: ChannelDepth{MaxDepth, MaxDepth, MaxDepth, 0}}) + 1
+	if _, err := AutoDepth(cover, testPayload(size, 298), nil); err != ErrMessageTooLarge {
+		t.Errorf("%d bytes: got %v, want ErrMessageTooLarge", size, err)
+	}
+}
+
+func TestChannelDepthRejected(t *testing.T) {
+	cover := testCover(40, 30, 156)
+	if _, err := Encode(cover, []byte("x"), &Options{Depth: ChannelDepth{1, 1, 1, 1}}); err != ErrAlphaUnsupported {
+		t.Errorf("alpha of an RGBA cover: got %v, want ErrAlphaUnsupported", err)
+	}
+	var buf bytes.Buffer
+	err := EncodeGIF(&buf, bytes.NewReader(testGIF(t, 156)), []byte("x"), &Options{Depth: ChannelDepth{1, 1, 2, 0}})
+	if !errors.Is(err, ErrDepthUnsupported) {
+		t.Errorf("GIF: got %v, want ErrDepthUnsupported", err)
+	}
+}
+
+func TestParseChannelDepth(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want ChannelDepth
+		err  string
+	}{
+		{"r:1,g:1,b:3", ChannelDepth{1, 1, 3, 0}, ""},
+		{"b:3", ChannelDepth{0, 0, 3, 0}, ""},
+		{" B:2 , r:1", ChannelDepth{1, 0, 2, 0}, ""},
+		{"r:1,a:2", ChannelDepth{1, 0, 0, 2}, ""},
+		{"2", ChannelDepth{2, 2, 2, 0}, ""},
+		{"r:5", ChannelDepth{}, "depth 5 of channel r"},
+		{"r:-1", ChannelDepth{}, "depth -1 of channel r"},
+		{"r:1,r:2", ChannelDepth{}, "given twice"},
+		{"x:1", ChannelDepth{}, "invalid channel depth"},
+		{"rg:1", ChannelDepth{}, "invalid channel depth"},
+		{"r", ChannelDepth{}, "invalid channel depth"},
+		{"r:x", ChannelDepth{}, "invalid depth"},
+		{"r:0,g:0", ChannelDepth{}, "every channel has depth 0"},
+		{"0", ChannelDepth{}, "every channel has depth 0"},
+	} {
+		got, err := ParseChannelDepth(c.s)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%q: got %v, want an error with %q", c.s, err, c.err)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("%q: got %v, %v, want %v", c.s, got, err, c.want)
+		}
+		if again, err := ParseChannelDepth(got.String()); err != nil || again != got {
+			t.Errorf("%q: %q parses as %v, %v", c.s, got.String(), again, err)
+		}
+	}
+}
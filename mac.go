@@ -0,0 +1,125 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// An encrypted message carries a FieldMAC with an HMAC-SHA256 of the flags,
+// the metadata and the payload as stored, keyed with the passphrase. The
+// checksum only catches damage, anyone can compute it again for a modified
+// message. The AEAD of the cipher authenticates the ciphertext but not the
+// metadata next to it, like the expiry, which the MAC covers too. It is not
+// over FieldSeal, which is written after the rest, FieldSignature, which is
+// written after the payload even when it is streamed, and FlagLength64,
+// which depends on where the message is stored.
+//
+// The field holds a salt of saltSize bytes followed by the MAC. The key is
+// derived from the passphrase and the salt with scrypt.
+func macField() Field {
+	return Field{FieldMAC, make([]byte, saltSize+sha256.Size)}
+}
+
+// setMAC fills in the FieldMAC of h for payload, drawing the salt from rnd,
+// crypto/rand if nil.
+func (h *Header) setMAC(passphrase, payload []byte, rnd io.Reader) error {
+	salt, err := macSalt(rnd)
+	if err != nil {
+		return err
+	}
+	m, err := h.newMAC(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	m.Write(payload)
+	h.putMAC(salt, m.Sum(nil))
+	return nil
+}
+
+func macSalt(rnd io.Reader) ([]byte, error) {
+	if rnd == nil {
+		rnd = rand.Reader
+	}
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rnd, salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// putMAC stores salt and mac in the FieldMAC of h.
+func (h *Header) putMAC(salt, mac []byte) {
+	for i := range h.Metadata {
+		if h.Metadata[i].Type == FieldMAC {
+			h.Metadata[i].Value = append(append([]byte{}, salt...), mac...)
+		}
+	}
+}
+
+// checkMAC returns ErrDecryptionFailed if payload does not match the
+// FieldMAC of h, which is a wrong passphrase or a modified message. An
+// encrypted message without the field had it stripped, to modify the
+// metadata it covers, and fails too.
+func (h *Header) checkMAC(passphrase, payload []byte) error {
+	v, ok := h.Field(FieldMAC)
+	if !ok {
+		if h.Flags&FlagEncrypted != 0 {
+			return ErrDecryptionFailed
+		}
+		return nil
+	}
+	if len(passphrase) == 0 {
+		return ErrPassphraseRequired
+	}
+	if len(v) != saltSize+sha256.Size {
+		return ErrDecryptionFailed
+	}
+	m, err := h.newMAC(passphrase, v[:saltSize])
+	if err != nil {
+		return err
+	}
+	m.Write(payload)
+	if !hmac.Equal(m.Sum(nil), v[saltSize:]) {
+		return ErrDecryptionFailed
+	}
+	return nil
+}
+
+// newMAC returns the HMAC-SHA256 of h, keyed with passphrase and salt,
+// ready for the payload.
+func (h *Header) newMAC(passphrase, salt []byte) (hash.Hash, error) {
+	key, err := scrypt.Key(passphrase, append([]byte("hidden/mac"), salt...), scryptN, scryptR, scryptP, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte{h.Flags &^ FlagLength64})
+	for _, f := range h.Metadata {
+		if f.Type != FieldMAC && f.Type != FieldSeal && f.Type != FieldSignature {
+			m.Write((&Header{Metadata: []Field{f}}).metadata())
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+	"time"
+)
+
+// reencode moves the message in img to a new cover after edit changed its
+// header, with the checksum computed again as anyone can.
+func reencode(t *testing.T, img image.Image, edit func(h *Header)) image.Image {
+	t.Helper()
+	c, err := ExtractContainer(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit(c.Header)
+	c.Header.Checksum = c.Header.sum(c.Payload)
+	stego, err := EncodeContainer(testCover(64, 64, 2), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stego
+}
+
+// extendExpiry moves the expiry of h a year on.
+func extendExpiry(h *Header) {
+	for i, f := range h.Metadata {
+		if f.Type == FieldExpiry {
+			t := int64(binary.BigEndian.Uint64(f.Value))
+			v := make([]byte, 8)
+			binary.BigEndian.PutUint64(v, uint64(t+365*24*60*60))
+			h.Metadata[i].Value = v
+		}
+	}
+}
+
+// stripMAC removes the MAC from h.
+func stripMAC(h *Header) {
+	meta := h.Metadata[:0]
+	for _, f := range h.Metadata {
+		if f.Type != FieldMAC {
+			meta = append(meta, f)
+		}
+	}
+	h.Metadata = meta
+}
+
+func TestMAC(t *testing.T) {
+	msg, pass := []byte("expires soon"), []byte("passphrase")
+	stego, err := Encode(testCover(64, 64, 1), msg, &Options{Passphrase: pass, Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode(reencode(t, stego, func(*Header) {}), &Options{Passphrase: pass})
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("moved: got %q, %v", got, err)
+	}
+
+	for name, edit := range map[string]func(h *Header){
+		"expiry extended":               extendExpiry,
+		"MAC stripped":                  stripMAC,
+		"MAC stripped, expiry extended": func(h *Header) { stripMAC(h); extendExpiry(h) },
+	} {
+		if _, err := Decode(reencode(t, stego, edit), &Options{Passphrase: pass}); err != ErrDecryptionFailed {
+			t.Errorf("%s: got %v, want ErrDecryptionFailed", name, err)
+		}
+	}
+}
+
+func TestMACChunked(t *testing.T) {
+	pass := []byte("passphrase")
+	stego, err := Encode(testCover(64, 64, 1), bytes.Repeat([]byte("chunk"), 100), &Options{Passphrase: pass, ChunkSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decode(reencode(t, stego, stripMAC), &Options{Passphrase: pass}); err != ErrDecryptionFailed {
+		t.Errorf("MAC stripped: got %v, want ErrDecryptionFailed", err)
+	}
+}
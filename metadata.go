@@ -0,0 +1,468 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// ErrMetadataPlacement is returned when a placement is given for a payload
+// in metadata, which has no pixels to place it in.
+var ErrMetadataPlacement = errors.New("placements are not supported in metadata")
+
+// ErrMetadataFormat is returned by EncodeMetadata for a file that is not a
+// PNG or JPEG.
+var ErrMetadataFormat = errors.New("only a PNG or JPEG carries a message in its metadata")
+
+const (
+	pngSignature = "\x89PNG\r\n\x1a\n"
+
+	// metadataChunk is the PNG chunk that holds the container: ancillary,
+	// private and safe to copy, so editors that do not know it keep it
+	// when they change the pixels.
+	metadataChunk = "hiDn"
+
+	// The EXIF tags of the Exif IFD pointer in IFD0 and of the maker note
+	// in the Exif IFD, which holds the container in a JPEG.
+	exifIFDTag   = 0x8769
+	makerNoteTag = 0x927C
+)
+
+var exifPrefix = []byte("Exif\x00\x00")
+
+// EncodeMetadata writes the PNG or JPEG read from r to w with payload in
+// its metadata instead of its pixels: a PNG in an ancillary chunk before
+// IEND, a JPEG in the maker note of its EXIF data, which is added if there
+// is none and keeps every other tag if there is. The pixels are written as
+// they are, so the message survives anything done to them by a program that
+// keeps the metadata, and nothing that strips it. A message already stored
+// this way is replaced. A JPEG holds up to about 64 KiB, less its other EXIF
+// data.
+func EncodeMetadata(w io.Writer, r io.Reader, payload []byte, opt *Options) error {
+	if err := checkMetadataOptions(opt); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	header, payload, err := container(payload, opt)
+	if err != nil {
+		return err
+	}
+	msg := append(header, payload...)
+	defer Wipe(msg)
+
+	switch {
+	case bytes.HasPrefix(data, []byte(pngSignature)):
+		data, err = pngWithChunk(data, msg)
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		data, err = jpegWithMakerNote(data, msg)
+	default:
+		err = ErrMetadataFormat
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// DecodeMetadata extracts the payload EncodeMetadata stored in the PNG or
+// JPEG read from r, and validates it like Decode. It returns
+// ErrNoHiddenMessage for a file without one, whatever its pixels hold.
+func DecodeMetadata(r io.Reader, opt *Options) ([]byte, error) {
+	msg, h, err := extractMetadata(r)
+	if err != nil {
+		return nil, err
+	}
+	return h.open(msg, opt)
+}
+
+// DetectMetadata is Detect for the PNG or JPEG read from r, see
+// DecodeMetadata.
+func DetectMetadata(r io.Reader) (int, string, error) {
+	msg, h, err := extractMetadata(r)
+	if err != nil {
+		return 0, "", err
+	}
+	return len(msg), "metadata/" + detectFormat(msg, h), nil
+}
+
+func checkMetadataOptions(opt *Options) error {
+	switch {
+	case opt.placement() != nil:
+		return ErrMetadataPlacement
+	case opt.lsbFirst():
+		return ErrBitOrderUnsupported
+	case opt.layout() != nil:
+		return ErrDepthUnsupported
+	case opt.seal():
+		return ErrSealUnsupported
+	case opt.copies() > 1:
+		return ErrCopiesUnsupported
+	case opt.matching():
+		return ErrMatchingUnsupported
+	case opt.preserveHistogram():
+		return ErrHistogramUnsupported
+	case opt.fill():
+		return ErrFillUnsupported
+	}
+	return nil
+}
+
+func extractMetadata(r io.Reader) ([]byte, *Header, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var msg []byte
+	switch {
+	case bytes.HasPrefix(data, []byte(pngSignature)):
+		msg, err = pngChunk(data)
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		msg, err = jpegMakerNote(data)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// EncodeMetadata never writes the legacy header, which any maker note
+	// would pass for.
+	if !bytes.HasPrefix(msg, []byte(containerMagic)) {
+		return nil, nil, ErrNoHiddenMessage
+	}
+	return readContainer(msg)
+}
+
+// pngChunks calls f with the type and data of every chunk of the PNG data,
+// and the offsets of the chunk in data.
+func pngChunks(data []byte, f func(typ string, chunk []byte, start, end int)) error {
+	for i := len(pngSignature); i < len(data); {
+		if len(data)-i < 12 {
+			return &MalformedImageError{"png", errors.New("truncated chunk")}
+		}
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		if n < 0 || n > len(data)-i-12 {
+			return &MalformedImageError{"png", errors.New("truncated chunk")}
+		}
+		f(string(data[i+4:i+8]), data[i+8:i+8+n], i, i+12+n)
+		i += 12 + n
+	}
+	return nil
+}
+
+// pngWithChunk returns the PNG data with msg in the metadata chunk before
+// IEND, in place of one it already has.
+func pngWithChunk(data, msg []byte) ([]byte, error) {
+	if uint64(len(msg)) > 1<<31-1 {
+		return nil, ErrMessageTooLarge
+	}
+
+	out := append([]byte{}, data[:len(pngSignature)]...)
+	err := pngChunks(data, func(typ string, chunk []byte, start, end int) {
+		switch typ {
+		case metadataChunk:
+			return
+		case "IEND":
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], uint32(len(msg)))
+			out = append(append(out, b[:]...), metadataChunk...)
+			out = append(out, msg...)
+			binary.BigEndian.PutUint32(b[:], crc32.ChecksumIEEE(out[len(out)-len(msg)-4:]))
+			out = append(out, b[:]...)
+		}
+		out = append(out, data[start:end]...)
+	})
+	return out, err
+}
+
+// pngChunk returns the data of the metadata chunk of the PNG data.
+func pngChunk(data []byte) ([]byte, error) {
+	var msg []byte
+	err := pngChunks(data, func(typ string, chunk []byte, start, end int) {
+		if typ == metadataChunk && msg == nil {
+			msg = chunk
+		}
+	})
+	if err == nil && msg == nil {
+		err = ErrNoHiddenMessage
+	}
+	return msg, err
+}
+
+// jpegSegments returns the offsets of the marker segments of the JPEG data
+// before its first scan, each from its marker to its end.
+func jpegSegments(data []byte) ([][2]int, error) {
+	var segs [][2]int
+	for i := 2; ; {
+		if len(data)-i < 4 || data[i] != 0xFF {
+			return nil, &MalformedImageError{"jpeg", errors.New("truncated marker segment")}
+		}
+		if marker := data[i+1]; marker == 0xDA || marker == 0xD9 {
+			return segs, nil
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return nil, &MalformedImageError{"jpeg", errors.New("truncated marker segment")}
+		}
+		segs = append(segs, [2]int{i, i + 2 + n})
+		i += 2 + n
+	}
+}
+
+// jpegExif returns the offsets of the EXIF APP1 segment of the JPEG data,
+// if it has one.
+func jpegExif(data []byte) ([2]int, bool, error) {
+	segs, err := jpegSegments(data)
+	if err != nil {
+		return [2]int{}, false, err
+	}
+	for _, s := range segs {
+		if data[s[0]+1] == 0xE1 && bytes.HasPrefix(data[s[0]+4:s[1]], exifPrefix) {
+			return s, true, nil
+		}
+	}
+	return [2]int{}, false, nil
+}
+
+// jpegWithMakerNote returns the JPEG data with msg as the maker note of its
+// EXIF data. A new EXIF segment goes after the JFIF one or else the SOI.
+func jpegWithMakerNote(data, msg []byte) ([]byte, error) {
+	seg, ok, err := jpegExif(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var t []byte
+	if ok {
+		if t, err = exifWithMakerNote(data[seg[0]+4+len(exifPrefix):seg[1]], msg); err != nil {
+			return nil, err
+		}
+	} else {
+		t = newExif(msg)
+		seg = [2]int{2, 2}
+		if segs, _ := jpegSegments(data); len(segs) > 0 && data[segs[0][0]+1] == 0xE0 {
+			seg = [2]int{segs[0][1], segs[0][1]}
+		}
+	}
+	n := 2 + len(exifPrefix) + len(t)
+	if n > 0xFFFF {
+		return nil, ErrMessageTooLarge
+	}
+
+	out := append([]byte{}, data[:seg[0]]...)
+	out = append(out, 0xFF, 0xE1, byte(n>>8), byte(n))
+	out = append(append(out, exifPrefix...), t...)
+	return append(out, data[seg[1]:]...), nil
+}
+
+// jpegMakerNote returns the maker note of the EXIF data of the JPEG data.
+func jpegMakerNote(data []byte) ([]byte, error) {
+	seg, ok, err := jpegExif(data)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNoHiddenMessage
+	}
+	t := data[seg[0]+4+len(exifPrefix) : seg[1]]
+	x, err := parseTIFFHeader(t)
+	if err != nil {
+		return nil, err
+	}
+	ifd0, err := x.ifd(x.first)
+	if err != nil {
+		return nil, err
+	}
+	e, ok := x.entry(ifd0, exifIFDTag)
+	if !ok {
+		return nil, ErrNoHiddenMessage
+	}
+	exif, err := x.ifd(x.order.Uint32(e[8:]))
+	if err != nil {
+		return nil, err
+	}
+	if e, ok = x.entry(exif, makerNoteTag); !ok {
+		return nil, ErrNoHiddenMessage
+	}
+	n, off := x.order.Uint32(e[4:]), x.order.Uint32(e[8:])
+	if n <= 4 {
+		return e[8 : 8+n], nil
+	}
+	if uint64(off)+uint64(n) > uint64(len(t)) {
+		return nil, &MalformedImageError{"jpeg", errors.New("maker note is out of bounds")}
+	}
+	return t[off : off+n], nil
+}
+
+// exifTIFF is the TIFF structure that holds EXIF data.
+type exifTIFF struct {
+	data  []byte
+	order binary.ByteOrder
+	first uint32
+}
+
+// exifIFD is an image file directory, its 12 byte entries and the offset
+// of the next one.
+type exifIFD struct {
+	entries [][]byte
+	next    uint32
+}
+
+// entry returns the entry of d with the tag.
+func (x *exifTIFF) entry(d *exifIFD, tag uint16) ([]byte, bool) {
+	for _, e := range d.entries {
+		if x.order.Uint16(e) == tag {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+func parseTIFFHeader(t []byte) (*exifTIFF, error) {
+	if len(t) < 8 {
+		return nil, &MalformedImageError{"jpeg", errors.New("truncated EXIF data")}
+	}
+	x := &exifTIFF{data: t}
+	switch string(t[:4]) {
+	case "MM\x00*":
+		x.order = binary.BigEndian
+	case "II*\x00":
+		x.order = binary.LittleEndian
+	default:
+		return nil, &MalformedImageError{"jpeg", errors.New("EXIF data is not a TIFF")}
+	}
+	x.first = x.order.Uint32(t[4:])
+	return x, nil
+}
+
+func (x *exifTIFF) ifd(off uint32) (*exifIFD, error) {
+	t := x.data
+	if uint64(off)+2 > uint64(len(t)) {
+		return nil, &MalformedImageError{"jpeg", errors.New("EXIF directory is out of bounds")}
+	}
+	n := int(x.order.Uint16(t[off:]))
+	end := int(off) + 2 + n*12
+	if end+4 > len(t) {
+		return nil, &MalformedImageError{"jpeg", errors.New("EXIF directory is out of bounds")}
+	}
+	d := &exifIFD{next: x.order.Uint32(t[end:])}
+	for i := 0; i < n; i++ {
+		d.entries = append(d.entries, t[int(off)+2+i*12:][:12])
+	}
+	return d, nil
+}
+
+// exifEntry returns an entry of the EXIF type LONG (4) or UNDEFINED (7).
+func exifEntry(order binary.ByteOrder, tag, typ uint16, count, value uint32) []byte {
+	e := make([]byte, 12)
+	order.PutUint16(e, tag)
+	order.PutUint16(e[2:], typ)
+	order.PutUint32(e[4:], count)
+	order.PutUint32(e[8:], value)
+	return e
+}
+
+// appendIFD appends the directory with entries sorted by tag to t, at an
+// even offset, and returns t and the offset.
+func appendIFD(t []byte, order binary.ByteOrder, entries [][]byte, next uint32) ([]byte, uint32) {
+	if len(t)%2 != 0 {
+		t = append(t, 0)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return order.Uint16(entries[i]) < order.Uint16(entries[j]) })
+	off := uint32(len(t))
+	var b [4]byte
+	order.PutUint16(b[:], uint16(len(entries)))
+	t = append(t, b[:2]...)
+	for _, e := range entries {
+		t = append(t, e...)
+	}
+	order.PutUint32(b[:], next)
+	return append(t, b[:]...), off
+}
+
+// newExif returns EXIF data that holds only a maker note with msg.
+func newExif(msg []byte) []byte {
+	t := []byte("MM\x00*\x00\x00\x00\x08")
+	return appendMakerNote(t, binary.BigEndian, nil, nil, 0, msg)
+}
+
+// exifWithMakerNote returns the EXIF data t with msg as its maker note. The
+// original data is kept where it is, since the entries of its directories
+// point into it, and the directories that change are appended as copies
+// that IFD0 then starts at. A maker note it had is zeroed.
+func exifWithMakerNote(t, msg []byte) ([]byte, error) {
+	x, err := parseTIFFHeader(t)
+	if err != nil {
+		return nil, err
+	}
+	ifd0, err := x.ifd(x.first)
+	if err != nil {
+		return nil, err
+	}
+
+	var exif, rest [][]byte
+	t = append([]byte{}, t...)
+	if e, ok := x.entry(ifd0, exifIFDTag); ok {
+		d, err := x.ifd(x.order.Uint32(e[8:]))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range d.entries {
+			if x.order.Uint16(e) != makerNoteTag {
+				exif = append(exif, e)
+				continue
+			}
+			// The maker note it replaces may be a message, which must
+			// not linger unreferenced.
+			n, off := x.order.Uint32(e[4:]), x.order.Uint32(e[8:])
+			if n > 4 && uint64(off)+uint64(n) <= uint64(len(t)) {
+				Wipe(t[off : off+n])
+			}
+		}
+	}
+	for _, e := range ifd0.entries {
+		if x.order.Uint16(e) != exifIFDTag {
+			rest = append(rest, e)
+		}
+	}
+	return appendMakerNote(t, x.order, rest, exif, ifd0.next, msg), nil
+}
+
+// appendMakerNote appends msg, an Exif IFD of exif and the maker note, and
+// an IFD0 of ifd0 and the pointer to the Exif IFD to t, and points the
+// header of t at the new IFD0.
+func appendMakerNote(t []byte, order binary.ByteOrder, ifd0, exif [][]byte, next uint32, msg []byte) []byte {
+	if len(t)%2 != 0 {
+		t = append(t, 0)
+	}
+	note := uint32(len(t))
+	t = append(t, msg...)
+
+	exif = append(exif, exifEntry(order, makerNoteTag, 7, uint32(len(msg)), note))
+	t, exifOff := appendIFD(t, order, exif, 0)
+	ifd0 = append(ifd0, exifEntry(order, exifIFDTag, 4, 1, exifOff))
+	t, first := appendIFD(t, order, ifd0, next)
+	order.PutUint32(t[4:], first)
+	return t
+}
@@ -0,0 +1,180 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// ErrKeyLocked is returned by ReadPGPIdentities for a private key protected
+// by a passphrase when none, or the wrong one, is given.
+var ErrKeyLocked = errors.New("the OpenPGP private key is protected by a passphrase")
+
+// pgpSlack is how much more than an empty payload the framing of an OpenPGP
+// message of any size can take: the partial lengths of the literal and the
+// encrypted packet, and an RSA or ECDH session key a few bytes longer.
+const pgpSlack = 80
+
+// PGPRecipient is an OpenPGP public key with an encryption subkey, or whose
+// primary key can encrypt.
+type PGPRecipient struct {
+	Entity *openpgp.Entity
+}
+
+// String returns the fingerprint of the primary key in hex.
+func (r *PGPRecipient) String() string {
+	return fmt.Sprintf("%X", r.Entity.PrimaryKey.Fingerprint)
+}
+
+func (r *PGPRecipient) scheme() recipientScheme { return pgpScheme{} }
+
+// PGPIdentity is an OpenPGP private key, decrypted if it was protected.
+type PGPIdentity struct {
+	Entity *openpgp.Entity
+}
+
+func (id *PGPIdentity) Recipient() Recipient {
+	return &PGPRecipient{id.Entity}
+}
+
+func (id *PGPIdentity) scheme() recipientScheme { return pgpScheme{} }
+
+// ReadPGPRecipients reads the public keys of an OpenPGP key ring, armored or
+// binary, as gpg --export writes it.
+func ReadPGPRecipients(r io.Reader) ([]Recipient, error) {
+	entities, err := readKeyRing(r)
+	if err != nil {
+		return nil, err
+	}
+	recipients := make([]Recipient, len(entities))
+	for i, e := range entities {
+		recipients[i] = &PGPRecipient{e}
+	}
+	return recipients, nil
+}
+
+// ReadPGPIdentities reads the private keys of an OpenPGP key ring, armored
+// or binary, as gpg --export-secret-keys writes it. Protected keys are
+// decrypted with passphrase, and it fails with ErrKeyLocked if that is
+// empty or wrong.
+func ReadPGPIdentities(r io.Reader, passphrase []byte) ([]Identity, error) {
+	entities, err := readKeyRing(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []Identity
+	for _, e := range entities {
+		if e.PrivateKey == nil {
+			continue
+		}
+		keys := []*packet.PrivateKey{e.PrivateKey}
+		for _, s := range e.Subkeys {
+			if s.PrivateKey != nil {
+				keys = append(keys, s.PrivateKey)
+			}
+		}
+		for _, k := range keys {
+			if !k.Encrypted {
+				continue
+			}
+			if len(passphrase) == 0 || k.Decrypt(passphrase) != nil {
+				return nil, fmt.Errorf("%X: %w", e.PrimaryKey.Fingerprint, ErrKeyLocked)
+			}
+		}
+		ids = append(ids, &PGPIdentity{e})
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("the OpenPGP key ring holds no private keys")
+	}
+	return ids, nil
+}
+
+func readKeyRing(r io.Reader) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+// pgpScheme stores payloads as OpenPGP messages, which gpg decrypts too.
+type pgpScheme struct{}
+
+func (pgpScheme) id() byte     { return 2 }
+func (pgpScheme) name() string { return "openpgp" }
+
+func (pgpScheme) encrypt(recipients []Recipient, payload []byte, rnd io.Reader) ([]byte, error) {
+	to := make([]*openpgp.Entity, len(recipients))
+	for i, r := range recipients {
+		to[i] = r.(*PGPRecipient).Entity
+	}
+
+	var buf bytes.Buffer
+	w, err := openpgp.Encrypt(&buf, to, nil, &openpgp.FileHints{IsBinary: true}, &packet.Config{Rand: rnd})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (pgpScheme) decrypt(identities []Identity, payload []byte) ([]byte, error) {
+	keyring := make(openpgp.EntityList, len(identities))
+	for i, id := range identities {
+		keyring[i] = id.(*PGPIdentity).Entity
+	}
+
+	md, err := openpgp.ReadMessage(bytes.NewReader(payload), keyring, nil, nil)
+	if err == pgperrors.ErrKeyIncorrect {
+		return nil, ErrNoIdentity
+	} else if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	plain, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		Wipe(plain)
+		return nil, ErrDecryptionFailed
+	}
+	return plain, nil
+}
+
+func (s pgpScheme) capacity(recipients []Recipient, n int) int {
+	empty, err := s.encrypt(recipients, nil, nil)
+	if err != nil {
+		return 0
+	}
+	if n -= len(empty) + pgpSlack; n > 0 {
+		return n
+	}
+	return 0
+}
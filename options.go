@@ -0,0 +1,575 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// An Option sets a field of Options, see NewOptions.
+type Option func(*Options) error
+
+// NewOptions returns Options with opts applied in order, after validating
+// the combination. Anything not set keeps its default:
+//
+//	integrity  BLAKE2b128, and an HMAC-SHA256 once there is a passphrase
+//	encryption none, AESGCM once there is a passphrase
+//	rand       crypto/rand
+//	random     none
+//	placement  Sequential
+//	hidden     none
+//	depth      one bit of every channel
+//	resync     none
+//	copies     one
+//	chunks     none
+//	ecc        none
+//	compress   none
+//	expiry     none
+//	file       none
+//	signature  none
+//	pad        none
+//	seal       none
+//	embedding  LSB replacement
+func NewOptions(opts ...Option) (*Options, error) {
+	o := &Options{}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Validate returns an error if the options can not be used together. Encode
+// validates its options too, so struct literals get the same checks.
+func (o *Options) Validate() error {
+	if o == nil {
+		return nil
+	}
+
+	if o.Cipher != nil && len(o.Passphrase) == 0 {
+		return fmt.Errorf("cipher %s needs a passphrase", o.Cipher.Name())
+	}
+	if o.Deterministic && o.Rand != nil {
+		return errors.New("deterministic encryption derives salts and nonces, it can not use a random source for them")
+	}
+	if p := o.Pad; p != nil {
+		switch {
+		case len(o.Passphrase) > 0:
+			return errors.New("a one-time pad can not be combined with a passphrase")
+		case p.IDSize < 0 || p.IDSize > sha256.Size:
+			return fmt.Errorf("pad ID size %d is not between 1 and %d", p.IDSize, sha256.Size)
+		case p.Offset < 0:
+			return fmt.Errorf("pad offset %d is negative", p.Offset)
+		}
+	}
+	if len(o.Recipients) > 0 {
+		switch {
+		case len(o.Passphrase) > 0 || o.Pad != nil:
+			return errors.New("a message encrypted to recipients can not also be encrypted with a passphrase or a one-time pad")
+		case o.ChunkSize > 0:
+			return errors.New("a message encrypted to recipients can not be chunked")
+		}
+		if err := checkRecipients(o.Recipients); err != nil {
+			return err
+		}
+		if o.Deterministic && o.recipientScheme() == (ageScheme{}) {
+			return errors.New("age draws its own randomness, a message encrypted to age recipients can not be deterministic")
+		}
+	}
+	if o.BlockSize < 0 || o.BlockSize > 0xFFFF {
+		return fmt.Errorf("block size %d is not between 1 and 65535", o.BlockSize)
+	}
+	if o.ChunkSize < 0 || o.ChunkSize > MaxChunkSize {
+		return fmt.Errorf("chunk size %d is not between 1 and %d", o.ChunkSize, MaxChunkSize)
+	}
+	if _, ok := presetNames[o.Preset]; o.Preset != 0 && !ok {
+		return fmt.Errorf("unknown %v", o.Preset)
+	}
+	if o.Copies < 0 {
+		return fmt.Errorf("%d copies is negative", o.Copies)
+	}
+	if o.Copies > 1 {
+		switch _, sequential := o.Placement.(Sequential); {
+		case o.BlockSize == 0:
+			return errors.New("copies of the payload need resync blocks to be found")
+		case o.Placement != nil && !sequential, o.Depth != (ChannelDepth{}), o.BitOrder != MSBFirst:
+			return errors.New("copies of the payload need the default placement, depth and bit order")
+		}
+	}
+	if o.ChunkSize > 0 && o.BlockSize > 0 {
+		return errors.New("a chunked payload can not also be split into resync blocks")
+	}
+	if o.ChunkSize > 0 && o.Seal {
+		return errors.New("a chunked payload can not be sealed")
+	}
+	if _, ok := o.Placement.(Spread); ok && o.ChunkSize > 0 {
+		return errors.New("a chunked payload can not be spread, its size is not known when it starts")
+	}
+	if o.BitOrder != MSBFirst && o.BitOrder != LSBFirst {
+		return fmt.Errorf("unknown %v", o.BitOrder)
+	}
+	if o.Raw {
+		if err := o.checkRaw(); err != nil {
+			return err
+		}
+	}
+	if o.ECC < 0 || o.ECC >= eccBlock {
+		return fmt.Errorf("%d parity bytes is not between 1 and %d", o.ECC, eccBlock-1)
+	}
+	if o.Compression != nil && o.ChunkSize > 0 {
+		return errors.New("a chunked payload can not be compressed")
+	}
+	if o.ECCScheme != ReedSolomon && o.ECCScheme != Hamming {
+		return fmt.Errorf("unknown %v", o.ECCScheme)
+	}
+	if o.ECCScheme == Hamming && o.ECC > 0 {
+		return errors.New("a Hamming code has no parity bytes to choose")
+	}
+	if o.code() != nil && (o.BlockSize > 0 || o.ChunkSize > 0) {
+		return errors.New("error correction can not be combined with resync blocks or chunks")
+	}
+	if _, _, err := placementField(o.Placement); err != nil {
+		return err
+	}
+	if _, ok := o.Placement.(Keyed); ok && len(o.Passphrase) == 0 {
+		return errors.New("a keyed placement needs a passphrase")
+	}
+	if o.PreserveHistogram {
+		switch {
+		case o.Matching:
+			return errors.New("LSB matching leaves no pairs of values to even out, it can not be combined with preserving the histogram")
+		case o.ChunkSize > 0 || o.Hidden != nil:
+			return errors.New("a chunked or hidden payload can not preserve the histogram")
+		}
+	}
+	if o.Fill {
+		switch {
+		case o.PreserveHistogram:
+			return errors.New("filling the unused capacity leaves no samples to preserve the histogram with")
+		case o.ChunkSize > 0:
+			return errors.New("a chunked payload can not fill the unused capacity")
+		}
+	}
+	if _, ok := o.Placement.(Exclude); ok {
+		if o.ChunkSize > 0 {
+			return errors.New("a chunked payload can not exclude regions")
+		}
+		if err := checkExclude(o.Depth); err != nil {
+			return err
+		}
+	}
+	if _, ok := o.Placement.(Adaptive); ok && o.Matching {
+		return errors.New("LSB matching can change the bits an adaptive placement measures the texture in")
+	}
+	if _, ok := o.Placement.(Deniable); ok {
+		switch {
+		case len(o.Passphrase) == 0:
+			return errors.New("a deniable placement needs a passphrase")
+		case o.ChunkSize > 0 || o.Seal || o.shard != nil:
+			return errors.New("a deniable placement can not be chunked, sealed or split into shards")
+		case o.Deterministic:
+			return errors.New("a deniable placement fills its free slots with random bytes, it can not be deterministic")
+		}
+	}
+	if h := o.Hidden; h != nil {
+		switch _, ok := o.Placement.(Deniable); {
+		case !ok:
+			return errors.New("a hidden payload needs a deniable placement")
+		case len(h.Passphrase) == 0:
+			return errors.New("a hidden payload needs a passphrase")
+		case bytes.Equal(h.Passphrase, o.Passphrase):
+			return errors.New("the hidden payload needs a passphrase of its own")
+		}
+	}
+	if o.Depth != (ChannelDepth{}) {
+		if err := o.Depth.validate(); err != nil {
+			return err
+		}
+		if o.Matching && (o.Depth[0] > 1 || o.Depth[1] > 1 || o.Depth[2] > 1 || o.Depth[3] > 1) {
+			return errors.New("LSB matching changes the bits above the lowest one, it needs a depth of 1")
+		}
+	}
+	if o.File != nil {
+		if err := o.File.validate(); err != nil {
+			return err
+		}
+	}
+	if o.SigningKey != nil && len(o.SigningKey) != ed25519.PrivateKeySize {
+		return fmt.Errorf("an Ed25519 private key is %d bytes, not %d", ed25519.PrivateKeySize, len(o.SigningKey))
+	}
+	if o.VerifyKey != nil && len(o.VerifyKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("an Ed25519 public key is %d bytes, not %d", ed25519.PublicKeySize, len(o.VerifyKey))
+	}
+
+	keys := make(map[string]bool)
+	for _, f := range o.Metadata {
+		switch f.Type {
+		case FieldPlacement, FieldExpiry, FieldPad, FieldDepth, FieldSeal, FieldECC, FieldCompression, FieldMAC, FieldFile, FieldShard, FieldSignature, FieldSlots, FieldPreset, FieldRecipients, FieldBundle:
+			return fmt.Errorf("metadata field 0x%02x is reserved, use the option for it", f.Type)
+		case FieldUser:
+			e, ok := userEntry(f.Value)
+			if !ok {
+				return errors.New("user metadata field is malformed, use UserField")
+			}
+			if err := checkUserKey(e.Key); err != nil {
+				return err
+			}
+			if keys[e.Key] {
+				return fmt.Errorf("metadata key %q is given more than once", e.Key)
+			}
+			keys[e.Key] = true
+		}
+		if len(f.Value) > 0xFFFF {
+			return fmt.Errorf("metadata field 0x%02x is %d bytes, at most 65535 fit", f.Type, len(f.Value))
+		}
+	}
+	return nil
+}
+
+// WithIntegrity selects the algorithm that validates the payload.
+func WithIntegrity(i Integrity) Option {
+	return func(o *Options) error {
+		if i == nil {
+			return errors.New("integrity algorithm is nil")
+		}
+		o.Integrity = i
+		return nil
+	}
+}
+
+// WithPassphrase encrypts the payload when encoding and decrypts it when
+// decoding.
+func WithPassphrase(passphrase []byte) Option {
+	return func(o *Options) error {
+		if len(passphrase) == 0 {
+			return errors.New("the passphrase is empty")
+		}
+		o.Passphrase = passphrase
+		return nil
+	}
+}
+
+// WithCipher selects the cipher that encrypts the payload. It needs a
+// passphrase.
+func WithCipher(c Cipher) Option {
+	return func(o *Options) error {
+		o.Cipher = c
+		return nil
+	}
+}
+
+// WithRand sets the source of salts and nonces.
+func WithRand(r io.Reader) Option {
+	return func(o *Options) error {
+		o.Rand = r
+		return nil
+	}
+}
+
+// WithRandom sets the source of the random choices that need not be secret,
+// like a *rand.Rand with a fixed seed.
+func WithRandom(r io.Reader) Option {
+	return func(o *Options) error {
+		o.Random = r
+		return nil
+	}
+}
+
+// WithDeterministic derives salts and nonces from the payload and Random, so
+// encrypted encoding is reproducible.
+func WithDeterministic() Option {
+	return func(o *Options) error {
+		o.Deterministic = true
+		return nil
+	}
+}
+
+// WithSeal seals the image against changes after encoding, see
+// Options.Seal.
+func WithSeal() Option {
+	return func(o *Options) error {
+		o.Seal = true
+		return nil
+	}
+}
+
+// WithPreset records the threat model the options were chosen for, see
+// Options.Preset.
+func WithPreset(p Preset) Option {
+	return func(o *Options) error {
+		o.Preset = p
+		return nil
+	}
+}
+
+// WithMatching embeds with LSB matching instead of replacing the bits, see
+// Options.Matching.
+func WithMatching() Option {
+	return func(o *Options) error {
+		o.Matching = true
+		return nil
+	}
+}
+
+// WithBitOrder stores every byte of the container in bit order o, see
+// Options.BitOrder.
+func WithBitOrder(o BitOrder) Option {
+	return func(opt *Options) error {
+		if o != MSBFirst && o != LSBFirst {
+			return fmt.Errorf("unknown %v", o)
+		}
+		opt.BitOrder = o
+		return nil
+	}
+}
+
+// WithLittleEndian stores the lengths of the header little endian, see
+// Options.LittleEndian.
+func WithLittleEndian() Option {
+	return func(o *Options) error {
+		o.LittleEndian = true
+		return nil
+	}
+}
+
+// WithRaw stores the payload behind nothing but its length, see
+// Options.Raw.
+func WithRaw() Option {
+	return func(o *Options) error {
+		o.Raw = true
+		return nil
+	}
+}
+
+// WithPreserveHistogram keeps the histogram of the cover, see
+// Options.PreserveHistogram.
+func WithPreserveHistogram() Option {
+	return func(o *Options) error {
+		o.PreserveHistogram = true
+		return nil
+	}
+}
+
+// WithFill fills the capacity the payload leaves unused with random bits,
+// see Options.Fill.
+func WithFill() Option {
+	return func(o *Options) error {
+		o.Fill = true
+		return nil
+	}
+}
+
+// WithPad XORs the payload with a one-time pad instead of encrypting it.
+func WithPad(p *Pad) Option {
+	return func(o *Options) error {
+		if p == nil || len(p.Data) == 0 {
+			return errors.New("the pad is empty")
+		}
+		o.Pad = p
+		return nil
+	}
+}
+
+// WithRecipients encrypts the payload to the public keys of recipients
+// instead of with a passphrase, see Options.Recipients.
+func WithRecipients(recipients ...Recipient) Option {
+	return func(o *Options) error {
+		if len(recipients) == 0 {
+			return errors.New("no recipients")
+		}
+		o.Recipients = append(o.Recipients, recipients...)
+		return nil
+	}
+}
+
+// WithIdentities decrypts a payload encrypted to recipients with the private
+// keys of identities.
+func WithIdentities(identities ...Identity) Option {
+	return func(o *Options) error {
+		o.Identities = append(o.Identities, identities...)
+		return nil
+	}
+}
+
+// WithMetadata adds fields to the header.
+func WithMetadata(fields ...Field) Option {
+	return func(o *Options) error {
+		o.Metadata = append(o.Metadata, fields...)
+		return nil
+	}
+}
+
+// WithPlacement selects which carrier bits hold the payload.
+func WithPlacement(p Placement) Option {
+	return func(o *Options) error {
+		o.Placement = p
+		return nil
+	}
+}
+
+// WithHidden stores a second payload, found with its own passphrase, with a
+// Deniable placement.
+func WithHidden(passphrase, payload []byte) Option {
+	return func(o *Options) error {
+		o.Hidden = &HiddenPayload{passphrase, payload}
+		return nil
+	}
+}
+
+// WithDepth stores the payload in the low bits of every channel given by d.
+func WithDepth(d ChannelDepth) Option {
+	return func(o *Options) error {
+		if err := d.validate(); err != nil {
+			return err
+		}
+		o.Depth = d
+		return nil
+	}
+}
+
+// WithCopies stores n copies of the resync blocks of the payload, see
+// Options.Copies.
+func WithCopies(n int) Option {
+	return func(o *Options) error {
+		if n < 1 {
+			return fmt.Errorf("%d copies is not at least one", n)
+		}
+		o.Copies = n
+		return nil
+	}
+}
+
+// WithBlockSize stores the payload in blocks of size bytes behind resync
+// markers.
+func WithBlockSize(size int) Option {
+	return func(o *Options) error {
+		if size < 1 {
+			return fmt.Errorf("block size %d is not between 1 and 65535", size)
+		}
+		o.BlockSize = size
+		return nil
+	}
+}
+
+// WithChunkSize stores the payload in chunks of size bytes, each encrypted
+// on its own, so Encode works through it a chunk at a time.
+func WithChunkSize(size int) Option {
+	return func(o *Options) error {
+		if size < 1 {
+			return fmt.Errorf("chunk size %d is not between 1 and %d", size, MaxChunkSize)
+		}
+		o.ChunkSize = size
+		return nil
+	}
+}
+
+// WithCompression compresses the payload with c before it is encrypted.
+func WithCompression(c Compression) Option {
+	return func(o *Options) error {
+		o.Compression = c
+		return nil
+	}
+}
+
+// WithECC adds parity bytes of Reed-Solomon error correction to every
+// codeword of the payload, see Options.ECC.
+func WithECC(parity int) Option {
+	return func(o *Options) error {
+		if parity < 1 || parity >= eccBlock {
+			return fmt.Errorf("%d parity bytes is not between 1 and %d", parity, eccBlock-1)
+		}
+		o.ECC = parity
+		return nil
+	}
+}
+
+// WithHamming stores the payload in Hamming codes instead of Reed-Solomon,
+// see Options.ECCScheme.
+func WithHamming() Option {
+	return func(o *Options) error {
+		o.ECCScheme, o.ECC = Hamming, 0
+		return nil
+	}
+}
+
+// WithExpiry stores an expiry in the header.
+func WithExpiry(t time.Time) Option {
+	return func(o *Options) error {
+		o.Expires = t
+		return nil
+	}
+}
+
+// WithFile stores the attributes of the file the payload came from in the
+// header.
+func WithFile(f FileInfo) Option {
+	return func(o *Options) error {
+		o.File = &f
+		return nil
+	}
+}
+
+// WithBundle marks the payload as a tar archive of several files, see
+// Options.Bundle.
+func WithBundle() Option {
+	return func(o *Options) error {
+		o.Bundle = true
+		return nil
+	}
+}
+
+// WithSigningKey signs the payload and the metadata with key.
+func WithSigningKey(key ed25519.PrivateKey) Option {
+	return func(o *Options) error {
+		o.SigningKey = key
+		return nil
+	}
+}
+
+// WithVerifyKey only decodes payloads signed with the private key of key.
+func WithVerifyKey(key ed25519.PublicKey) Option {
+	return func(o *Options) error {
+		o.VerifyKey = key
+		return nil
+	}
+}
+
+// WithIgnoreExpiry decodes expired payloads if ignore is set.
+func WithIgnoreExpiry(ignore bool) Option {
+	return func(o *Options) error {
+		o.IgnoreExpiry = ignore
+		return nil
+	}
+}
+
+// WithLegacy also decodes payloads behind the legacy header if legacy is
+// set, see Options.Legacy.
+func WithLegacy(legacy bool) Option {
+	return func(o *Options) error {
+		o.Legacy = legacy
+		return nil
+	}
+}
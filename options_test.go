@@ -0,0 +1,215 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"crypto/ed25519"
+	"image"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestValidate covers every combination Validate rejects, each next to a
+// valid one that differs as little as possible.
+func TestValidate(t *testing.T) {
+	id, err := GenerateAgeIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		pass       = []byte("pass")
+		recipients = []Recipient{id.Recipient()}
+		pad        = &Pad{Data: make([]byte, 1024), IDSize: 8}
+		exclude    = Exclude{Rects: []image.Rectangle{image.Rect(0, 0, 8, 8)}}
+		hidden     = &HiddenPayload{Passphrase: []byte("other"), Payload: []byte("hidden")}
+		user, _    = UserField("key", []byte("value"))
+		seed       = []byte("0123456789abcdef0123456789abcdef")
+	)
+
+	for _, c := range []struct {
+		name string
+		opt  *Options
+		err  string
+	}{
+		{"nil", nil, ""},
+		{"defaults", &Options{}, ""},
+		{"everything compatible", &Options{Passphrase: pass, Cipher: ChaCha20Poly1305, Compression: Deflate, ECC: 16, Seal: true, Fill: true,
+			Placement: Permuted{Seed: 1}, Metadata: []Field{user}, Expires: time.Now().Add(time.Hour), File: &FileInfo{Name: "a.txt"},
+			SigningKey: ed25519.NewKeyFromSeed(seed)}, ""},
+
+		{"cipher", &Options{Passphrase: pass, Cipher: AESGCM}, ""},
+		{"cipher without passphrase", &Options{Cipher: AESGCM}, "needs a passphrase"},
+		{"deterministic", &Options{Passphrase: pass, Deterministic: true}, ""},
+		{"deterministic with rand", &Options{Passphrase: pass, Deterministic: true, Rand: strings.NewReader("")}, "can not use a random source"},
+
+		{"pad", &Options{Pad: pad}, ""},
+		{"pad with passphrase", &Options{Pad: pad, Passphrase: pass}, "one-time pad can not be combined with a passphrase"},
+		{"pad id size", &Options{Pad: &Pad{Data: pad.Data, IDSize: 33}}, "pad ID size 33"},
+		{"pad offset", &Options{Pad: &Pad{Data: pad.Data, IDSize: 8, Offset: -1}}, "pad offset -1 is negative"},
+
+		{"recipients", &Options{Recipients: recipients}, ""},
+		{"recipients with passphrase", &Options{Recipients: recipients, Passphrase: pass}, "can not also be encrypted"},
+		{"recipients with pad", &Options{Recipients: recipients, Pad: pad}, "can not also be encrypted"},
+		{"recipients chunked", &Options{Recipients: recipients, ChunkSize: 1024}, "recipients can not be chunked"},
+
+		{"block size", &Options{BlockSize: 0xFFFF}, ""},
+		{"block size negative", &Options{BlockSize: -1}, "block size -1"},
+		{"block size too large", &Options{BlockSize: 0x10000}, "block size 65536"},
+		{"chunk size", &Options{ChunkSize: MaxChunkSize}, ""},
+		{"chunk size negative", &Options{ChunkSize: -1}, "chunk size -1"},
+		{"chunk size too large", &Options{ChunkSize: MaxChunkSize + 1}, "chunk size"},
+		{"preset", &Options{Preset: PresetRobust}, ""},
+		{"unknown preset", &Options{Preset: 99}, "unknown"},
+
+		{"copies", &Options{Copies: 3, BlockSize: 64}, ""},
+		{"copies negative", &Options{Copies: -1}, "-1 copies is negative"},
+		{"copies without blocks", &Options{Copies: 3}, "need resync blocks"},
+		{"copies placed", &Options{Copies: 3, BlockSize: 64, Placement: Permuted{Seed: 1}}, "need the default placement"},
+		{"copies sequential", &Options{Copies: 3, BlockSize: 64, Placement: Sequential{}}, ""},
+		{"copies with depth", &Options{Copies: 3, BlockSize: 64, Depth: ChannelDepth{2, 2, 2, 0}}, "need the default placement, depth"},
+		{"copies lsb first", &Options{Copies: 3, BlockSize: 64, BitOrder: LSBFirst}, "need the default placement, depth and bit order"},
+
+		{"chunks with blocks", &Options{ChunkSize: 1024, BlockSize: 64}, "can not also be split into resync blocks"},
+		{"chunks sealed", &Options{ChunkSize: 1024, Seal: true}, "chunked payload can not be sealed"},
+		{"chunks spread", &Options{ChunkSize: 1024, Placement: Spread{}}, "chunked payload can not be spread"},
+		{"spread", &Options{Placement: Spread{}}, ""},
+		{"chunks compressed", &Options{ChunkSize: 1024, Compression: Gzip}, "chunked payload can not be compressed"},
+		{"chunks with ecc", &Options{ChunkSize: 1024, ECC: 16}, "error correction can not be combined"},
+		{"chunks with hamming", &Options{ChunkSize: 1024, ECCScheme: Hamming}, "error correction can not be combined"},
+		{"blocks with ecc", &Options{BlockSize: 64, ECC: 16}, "error correction can not be combined"},
+		{"chunks fill", &Options{ChunkSize: 1024, Fill: true}, "chunked payload can not fill"},
+		{"chunks exclude", &Options{ChunkSize: 1024, Placement: exclude}, "chunked payload can not exclude regions"},
+		{"chunks deniable", &Options{ChunkSize: 1024, Passphrase: pass, Placement: Deniable{}}, "deniable placement can not be chunked"},
+		{"chunks", &Options{ChunkSize: 1024, Passphrase: pass}, ""},
+
+		{"unknown bit order", &Options{BitOrder: 7}, "unknown"},
+		{"ecc", &Options{ECC: eccBlock - 1}, ""},
+		{"ecc negative", &Options{ECC: -1}, "-1 parity bytes"},
+		{"ecc too large", &Options{ECC: eccBlock}, "255 parity bytes"},
+		{"hamming", &Options{ECCScheme: Hamming}, ""},
+		{"hamming with parity", &Options{ECCScheme: Hamming, ECC: 8}, "Hamming code has no parity bytes"},
+		{"unknown ecc scheme", &Options{ECCScheme: 9}, "unknown"},
+
+		{"invalid placement", &Options{Placement: Adaptive{Threshold: 0}}, "adaptive threshold 0"},
+		{"keyed", &Options{Placement: Keyed{}, Passphrase: pass}, ""},
+		{"keyed without passphrase", &Options{Placement: Keyed{}}, "keyed placement needs a passphrase"},
+
+		{"preserve histogram", &Options{PreserveHistogram: true}, ""},
+		{"preserve histogram matching", &Options{PreserveHistogram: true, Matching: true}, "can not be combined with preserving the histogram"},
+		{"preserve histogram chunked", &Options{PreserveHistogram: true, ChunkSize: 1024}, "chunked or hidden payload can not preserve"},
+		{"preserve histogram hidden", &Options{PreserveHistogram: true, Passphrase: pass, Placement: Deniable{}, Hidden: hidden}, "chunked or hidden payload can not preserve"},
+		{"fill preserving histogram", &Options{Fill: true, PreserveHistogram: true}, "leaves no samples to preserve the histogram"},
+
+		{"exclude", &Options{Placement: exclude}, ""},
+		{"exclude depth", &Options{Placement: exclude, Depth: ChannelDepth{2, 2, 2, 0}}, ""},
+		{"exclude without red", &Options{Placement: exclude, Depth: ChannelDepth{0, 1, 1, 0}}, "excluded region needs the header"},
+		{"exclude with alpha", &Options{Placement: exclude, Depth: ChannelDepth{1, 1, 1, 1}}, "excluded region needs the header"},
+		{"adaptive", &Options{Placement: Adaptive{Threshold: 16}}, ""},
+		{"adaptive matching", &Options{Placement: Adaptive{Threshold: 16}, Matching: true}, "adaptive placement measures the texture"},
+
+		{"deniable", &Options{Placement: Deniable{}, Passphrase: pass}, ""},
+		{"deniable without passphrase", &Options{Placement: Deniable{}}, "deniable placement needs a passphrase"},
+		{"deniable sealed", &Options{Placement: Deniable{}, Passphrase: pass, Seal: true}, "deniable placement can not be chunked, sealed"},
+		{"deniable sharded", &Options{Placement: Deniable{}, Passphrase: pass, shard: &Shard{}}, "split into shards"},
+		{"deniable deterministic", &Options{Placement: Deniable{}, Passphrase: pass, Deterministic: true}, "can not be deterministic"},
+		{"hidden", &Options{Placement: Deniable{}, Passphrase: pass, Hidden: hidden}, ""},
+		{"hidden not deniable", &Options{Passphrase: pass, Hidden: hidden}, "hidden payload needs a deniable placement"},
+		{"hidden excluded", &Options{Passphrase: pass, Placement: exclude, Hidden: hidden}, "hidden payload needs a deniable placement"},
+		{"hidden without passphrase", &Options{Placement: Deniable{}, Passphrase: pass, Hidden: &HiddenPayload{Payload: []byte("x")}}, "hidden payload needs a passphrase"},
+		{"hidden same passphrase", &Options{Placement: Deniable{}, Passphrase: pass, Hidden: &HiddenPayload{Passphrase: pass}}, "passphrase of its own"},
+
+		{"depth", &Options{Depth: ChannelDepth{2, 1, 3, 0}}, ""},
+		{"depth too deep", &Options{Depth: ChannelDepth{MaxDepth + 1, 1, 1, 0}}, "depth 5 of channel r"},
+		{"matching depth", &Options{Depth: ChannelDepth{1, 1, 1, 0}, Matching: true}, ""},
+		{"matching deeper", &Options{Depth: ChannelDepth{2, 1, 1, 0}, Matching: true}, "needs a depth of 1"},
+		{"matching deeper alpha", &Options{Depth: ChannelDepth{1, 1, 1, 2}, Matching: true}, "needs a depth of 1"},
+
+		{"file name", &Options{File: &FileInfo{Name: "../a.txt"}}, "not the name of a file"},
+		{"file content type", &Options{File: &FileInfo{Name: "a", ContentType: "not a type"}}, "content type"},
+		{"signing key", &Options{SigningKey: make([]byte, 10)}, "an Ed25519 private key is 64 bytes, not 10"},
+		{"verify key", &Options{VerifyKey: make([]byte, 10)}, "an Ed25519 public key is 32 bytes, not 10"},
+
+		{"reserved metadata", &Options{Metadata: []Field{{FieldSeal, nil}}}, "is reserved"},
+		{"reserved slots metadata", &Options{Metadata: []Field{{FieldSlots, nil}}}, "is reserved"},
+		{"reserved preset metadata", &Options{Metadata: []Field{{FieldPreset, []byte{1}}}}, "is reserved"},
+		{"reserved recipients metadata", &Options{Metadata: []Field{{FieldRecipients, []byte{1}}}}, "is reserved"},
+		{"malformed user metadata", &Options{Metadata: []Field{{FieldUser, []byte{9}}}}, "malformed"},
+		{"empty user key", &Options{Metadata: []Field{{FieldUser, []byte{0}}}}, "metadata key is empty"},
+		{"repeated user key", &Options{Metadata: []Field{user, user}}, "given more than once"},
+		{"large metadata", &Options{Metadata: []Field{{0x70, make([]byte, 0x10000)}}}, "at most 65535 fit"},
+		{"other metadata", &Options{Metadata: []Field{{0x70, []byte("x")}}}, ""},
+
+		{"raw", &Options{Raw: true, LittleEndian: true, Depth: ChannelDepth{2, 2, 2, 0}}, ""},
+		{"raw encrypted", &Options{Raw: true, Passphrase: pass}, "no header to record its encryption in"},
+		{"raw to recipients", &Options{Raw: true, Recipients: recipients}, "no header to record its encryption in"},
+		{"raw compressed", &Options{Raw: true, Compression: Deflate}, "no header to record resync blocks"},
+		{"raw with ecc", &Options{Raw: true, ECC: 8}, "no header to record resync blocks"},
+		{"raw placed", &Options{Raw: true, Placement: Permuted{Seed: 1}}, "can not be placed elsewhere"},
+		{"raw with metadata", &Options{Raw: true, Metadata: []Field{user}}, "no header to store metadata in"},
+		{"raw sealed", &Options{Raw: true, Seal: true}, "no header to store metadata in"},
+		{"raw filled", &Options{Raw: true, Fill: true}, "can not preserve the histogram or fill"},
+		{"raw slots", &Options{Raw: true, slotTable: true}, ErrRawUnsupported.Error()},
+		{"raw shard", &Options{Raw: true, shard: &Shard{}}, ErrRawUnsupported.Error()},
+	} {
+		err := c.opt.Validate()
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: got %v, want it valid", c.name, err)
+		case c.err != "" && err == nil:
+			t.Errorf("%s: valid, want an error containing %q", c.name, c.err)
+		case c.err != "" && !strings.Contains(err.Error(), c.err):
+			t.Errorf("%s: got %v, want an error containing %q", c.name, err, c.err)
+		}
+
+		// Encode validates struct literals too.
+		if c.err != "" {
+			if _, err := Encode(testCover(16, 16, 1), []byte("x"), c.opt); err == nil {
+				t.Errorf("%s: Encode accepted the options", c.name)
+			}
+		}
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	o, err := NewOptions(WithPassphrase([]byte("pass")), WithCipher(ChaCha20Poly1305), WithCompression(Gzip), WithECC(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(o.Passphrase) != "pass" || o.Cipher != ChaCha20Poly1305 || o.Compression != Gzip || o.ECC != 8 {
+		t.Errorf("got %+v", o)
+	}
+
+	for _, c := range []struct {
+		name string
+		opts []Option
+	}{
+		{"empty passphrase", []Option{WithPassphrase(nil)}},
+		{"nil integrity", []Option{WithIntegrity(nil)}},
+		{"cipher without passphrase", []Option{WithCipher(AESGCM)}},
+		{"block size", []Option{WithBlockSize(0)}},
+		{"chunk size", []Option{WithChunkSize(0)}},
+		{"copies", []Option{WithCopies(0)}},
+		{"no recipients", []Option{WithRecipients()}},
+		{"ecc", []Option{WithECC(0)}},
+		{"raw encrypted", []Option{WithRaw(), WithPassphrase([]byte("pass"))}},
+		{"chunks with ecc", []Option{WithChunkSize(1024), WithECC(8)}},
+	} {
+		if o, err := NewOptions(c.opts...); err == nil {
+			t.Errorf("%s: got %+v, want an error", c.name, o)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrPadRequired = errors.New("message is XORed with a one-time pad, the pad is required")
+	ErrWrongPad    = errors.New("the pad is not the one the message was encoded with")
+)
+
+// Pad is a one-time pad the payload is XORed with instead of encrypting it,
+// see Options.Pad. The offset into the pad and a prefix of the SHA-256 of it
+// are stored in the header, so decoding finds its place in the pad and can
+// tell the wrong pad from a damaged message. The checksum covers the payload
+// as stored, XORed, so it reveals nothing about the plaintext and images can
+// be validated without the pad.
+type Pad struct {
+	// Data is the whole pad.
+	Data []byte
+
+	// Offset is where in Data encoding starts taking bytes. No part of a
+	// pad must ever be used twice. Decoding uses the offset in the header.
+	Offset int
+
+	// IDSize is how many bytes of the SHA-256 of Data identify the pad,
+	// defaultPadIDSize if zero.
+	IDSize int
+}
+
+const defaultPadIDSize = 8
+
+// ID returns the identifier of the pad stored in the header.
+func (p *Pad) ID() []byte {
+	n := p.IDSize
+	if n == 0 {
+		n = defaultPadIDSize
+	}
+	sum := sha256.Sum256(p.Data)
+	return sum[:n]
+}
+
+// field returns the FieldPad metadata field for p.
+func (p *Pad) field() Field {
+	v := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(v, uint64(p.Offset))
+	return Field{FieldPad, append(v, p.ID()...)}
+}
+
+// xor returns payload XORed with the pad from offset.
+func (p *Pad) xor(payload []byte, offset int) ([]byte, error) {
+	if offset < 0 || offset > len(p.Data) || len(p.Data)-offset < len(payload) {
+		return nil, fmt.Errorf("the pad has %d bytes from offset %d, the message needs %d", len(p.Data)-offset, offset, len(payload))
+	}
+	out := make([]byte, len(payload))
+	for i, b := range payload {
+		out[i] = b ^ p.Data[offset+i]
+	}
+	return out, nil
+}
+
+// openPad reverses the pad of a payload with a FieldPad field v.
+func openPad(pad *Pad, v, payload []byte) ([]byte, error) {
+	if len(v) < 9 || len(v) > 8+sha256.Size {
+		return nil, errors.New("invalid pad field")
+	}
+	if pad == nil {
+		return nil, ErrPadRequired
+	}
+
+	id := v[8:]
+	if sum := sha256.Sum256(pad.Data); !bytes.Equal(sum[:len(id)], id) {
+		return nil, ErrWrongPad
+	}
+	offset := binary.BigEndian.Uint64(v)
+	if offset > uint64(len(pad.Data)) {
+		return nil, ErrWrongPad
+	}
+	return pad.xor(payload, int(offset))
+}
@@ -0,0 +1,88 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"image"
+	"math/rand"
+	"testing"
+)
+
+func testPad(size int, seed int64) *Pad {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return &Pad{Data: data}
+}
+
+func TestPadRoundTrip(t *testing.T) {
+	msg := []byte("attack at dawn")
+	pad := testPad(64, 1)
+	pad.Offset = 10
+	stego, err := Encode(testCover(32, 32, 1), msg, &Options{Pad: pad})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Decode(stego, &Options{Pad: &Pad{Data: pad.Data}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("got %q, want %q", got, msg)
+	}
+	if _, err := Decode(stego, nil); err != ErrPadRequired {
+		t.Errorf("without the pad: got %v, want ErrPadRequired", err)
+	}
+	if _, err := Decode(stego, &Options{Pad: testPad(64, 2)}); err != ErrWrongPad {
+		t.Errorf("with another pad: got %v, want ErrWrongPad", err)
+	}
+}
+
+// padImage returns an image with a padded message whose FieldPad holds id
+// as the pad ID, as a hostile encoder could store it.
+func padImage(t testing.TB, pad *Pad, id []byte) image.Image {
+	t.Helper()
+	stego, err := Encode(testCover(32, 32, 1), []byte("message"), &Options{Pad: pad})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ExtractContainer(stego)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range c.Header.Metadata {
+		if f.Type == FieldPad {
+			c.Header.Metadata[i].Value = append(f.Value[:8:8], id...)
+		}
+	}
+	c.Header.Checksum = c.Header.sum(c.Payload)
+	stego, err = EncodeContainer(testCover(32, 32, 1), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stego
+}
+
+func TestPadHostileID(t *testing.T) {
+	pad := testPad(64, 1)
+	for _, size := range []int{33, 54, 200} {
+		stego := padImage(t, pad, make([]byte, size))
+		if _, err := Decode(stego, &Options{Pad: pad}); err == nil || err == ErrWrongPad {
+			t.Errorf("pad ID of %d bytes: got %v, want an invalid field", size, err)
+		}
+	}
+}
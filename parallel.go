@@ -0,0 +1,125 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+)
+
+// parallelChunk is the number of message bytes a goroutine stores or loads
+// at a time. The chunks are cut at the same bytes however many cores there
+// are, so the encoded image does not depend on them.
+const parallelChunk = 64 << 10
+
+// chunked returns the carrier of c if the carrier bits of n bytes can be
+// split into chunks that are processed concurrently. That takes more than
+// one chunk, in consecutive or strided slots that are all left, and a
+// layout where no sample holds more than one bit, so no two chunks share a
+// byte of Pix.
+func (c *carrierBits) chunked(n int) (*stridedCarrier, bool) {
+	sc, ok := c.carrier.(*stridedCarrier)
+	if !ok || n <= parallelChunk || n*8 > sc.Remaining() {
+		return nil, false
+	}
+	if c.layout.depths == nil {
+		return sc, c.layout.depth == 1
+	}
+	for _, d := range c.layout.depths {
+		if d > 1 {
+			return nil, false
+		}
+	}
+	return sc, true
+}
+
+// split calls f for every chunk of the n bytes from the next carrier bit of
+// c on, with a carrierBits starting at the chunk, on as many goroutines as
+// there are cores. Then c continues after the n bytes.
+func (c *carrierBits) split(sc *stridedCarrier, n int, f func(i int, bits carrierBits)) {
+	var (
+		chunks = (n + parallelChunk - 1) / parallelChunk
+		next   = make(chan int)
+		wg     sync.WaitGroup
+	)
+	for w := 0; w < runtime.GOMAXPROCS(0) && w < chunks; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				bits := *c
+				bits.carrier = &stridedCarrier{sc.next + i*parallelChunk*8*sc.stride, sc.end, sc.stride}
+				f(i, bits)
+			}
+		}()
+	}
+	for i := 0; i < chunks; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	sc.next += n * 8 * sc.stride
+	c.used += n * 8
+}
+
+// chunk returns chunk i of p.
+func chunk(p []byte, i int) []byte {
+	p = p[i*parallelChunk:]
+	if len(p) > parallelChunk {
+		p = p[:parallelChunk]
+	}
+	return p
+}
+
+// Read loads p, in chunks on all cores if it is large enough.
+func (lr *lsbReader) Read(p []byte) (int, error) {
+	sc, ok := lr.chunked(len(p))
+	if !ok {
+		return lr.read(p)
+	}
+	lr.split(sc, len(p), func(i int, bits carrierBits) {
+		(&lsbReader{bits}).read(chunk(p, i))
+	})
+	return len(p), nil
+}
+
+// Write stores p, in chunks on all cores if it is large enough. LSB
+// matching then draws the choices of every chunk from a source seeded by
+// match in turn.
+func (lw *lsbWriter) Write(p []byte) (int, error) {
+	sc, ok := lw.chunked(len(p))
+	if !ok {
+		return lw.write(p)
+	}
+
+	var seeds []int64
+	if lw.match != nil {
+		seeds = make([]int64, (len(p)+parallelChunk-1)/parallelChunk)
+		for i := range seeds {
+			seeds[i] = lw.match.Int63()
+		}
+	}
+	lw.split(sc, len(p), func(i int, bits carrierBits) {
+		w := &lsbWriter{carrierBits: bits}
+		if seeds != nil {
+			w.match = rand.New(rand.NewSource(seeds[i]))
+		}
+		w.write(chunk(p, i))
+	})
+	return len(p), nil
+}
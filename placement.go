@@ -0,0 +1,530 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Carrier yields the carrier slots, numbered as described by Slots, that the
+// payload is stored in, in order. A Carrier can also have a Remaining() int
+// method returning how many slots it has left; without one every slot after
+// the header is assumed to be used.
+type Carrier interface {
+	Next() (index int, ok bool)
+}
+
+// Slots describes the carrier slots of an image: every bit that can hold a
+// message bit, numbered the way Sequential visits them. The header always
+// takes the first slots, Start is the first one left for the payload.
+type Slots struct {
+	Width, Height int
+
+	// PerPixel is the number of slots in a pixel, consecutive slots of a
+	// pixel have consecutive indices.
+	PerPixel int
+
+	// Columns is set if pixels are numbered column by column, not row by
+	// row.
+	Columns bool
+
+	Start int
+
+	// img and layout are the image and the layout the slots are in, for
+	// placements that look at the image, see Adaptive. img is nil when
+	// there are no pixels yet.
+	img    *carrierImage
+	layout *layout
+}
+
+// Len returns the number of slots in the image.
+func (s Slots) Len() int {
+	return s.Width * s.Height * s.PerPixel
+}
+
+// Pixel returns the pixel slot i is in, relative to the image origin.
+func (s Slots) Pixel(i int) image.Point {
+	p := i / s.PerPixel
+	if s.Columns {
+		return image.Pt(p/s.Height, p%s.Height)
+	}
+	return image.Pt(p%s.Width, p/s.Width)
+}
+
+// Slot returns the first slot of the pixel at p, relative to the image
+// origin.
+func (s Slots) Slot(p image.Point) int {
+	if s.Columns {
+		return (p.X*s.Height + p.Y) * s.PerPixel
+	}
+	return (p.Y*s.Width + p.X) * s.PerPixel
+}
+
+// Placement decides where in an image the payload goes. Anything but
+// Sequential is stored in the header as a FieldPlacement metadata field
+// holding the ID followed by MarshalBinary, so the decoder can create the
+// same Carrier.
+type Placement interface {
+	// ID identifies the placement in the header. Zero is reserved.
+	ID() byte
+
+	// MarshalBinary returns the parameters of the placement.
+	MarshalBinary() ([]byte, error)
+
+	// Carrier returns the slots of the payload, all of them from s.Start or
+	// after.
+	Carrier(s Slots) Carrier
+}
+
+var (
+	placementMu sync.RWMutex
+	placements  = map[byte]func(params []byte) (Placement, error){}
+)
+
+func init() {
+	RegisterPlacement(Sequential{}.ID(), func(params []byte) (Placement, error) {
+		return Sequential{}, nil
+	})
+	RegisterPlacement(Strided{}.ID(), func(params []byte) (Placement, error) {
+		if len(params) != 4 || binary.BigEndian.Uint32(params) == 0 {
+			return nil, errors.New("invalid strided placement")
+		}
+		return Strided{int(binary.BigEndian.Uint32(params))}, nil
+	})
+	RegisterPlacement(Region{}.ID(), func(params []byte) (Placement, error) {
+		if len(params) != 16 {
+			return nil, errors.New("invalid region placement")
+		}
+		var c [4]int
+		for i := range c {
+			c[i] = int(int32(binary.BigEndian.Uint32(params[i*4:])))
+		}
+		return Region{image.Rect(c[0], c[1], c[2], c[3])}, nil
+	})
+	RegisterPlacement(Permuted{}.ID(), func(params []byte) (Placement, error) {
+		if len(params) != 8 {
+			return nil, errors.New("invalid permuted placement")
+		}
+		return Permuted{binary.BigEndian.Uint64(params)}, nil
+	})
+	RegisterPlacement(Keyed{}.ID(), func(params []byte) (Placement, error) {
+		var p Keyed
+		if len(params) != len(p.Salt) {
+			return nil, errors.New("invalid keyed placement")
+		}
+		copy(p.Salt[:], params)
+		return p, nil
+	})
+	RegisterPlacement(Adaptive{}.ID(), func(params []byte) (Placement, error) {
+		if len(params) != 1 || params[0] == 0 {
+			return nil, errors.New("invalid adaptive placement")
+		}
+		return Adaptive{int(params[0])}, nil
+	})
+	RegisterPlacement(Exclude{}.ID(), unmarshalExclude)
+}
+
+// RegisterPlacement makes a placement available for decoding. unmarshal
+// recreates it from the parameters returned by its MarshalBinary. It panics
+// if the ID is zero or already taken.
+func RegisterPlacement(id byte, unmarshal func(params []byte) (Placement, error)) {
+	placementMu.Lock()
+	defer placementMu.Unlock()
+
+	if id == 0 {
+		panic("hidden: placement ID 0 is reserved")
+	}
+	if _, ok := placements[id]; ok {
+		panic(fmt.Sprintf("hidden: placement ID 0x%02x registered twice", id))
+	}
+	placements[id] = unmarshal
+}
+
+// UnsupportedPlacementError is returned when an image was encoded with a
+// placement that is not registered.
+type UnsupportedPlacementError byte
+
+func (e UnsupportedPlacementError) Error() string {
+	return fmt.Sprintf("unsupported placement 0x%02x", byte(e))
+}
+
+// placementField returns the metadata field describing p, or false for the
+// default.
+func placementField(p Placement) (Field, bool, error) {
+	if p == nil || p.ID() == (Sequential{}).ID() {
+		return Field{}, false, nil
+	}
+	params, err := p.MarshalBinary()
+	if err != nil {
+		return Field{}, false, err
+	}
+	return Field{FieldPlacement, append([]byte{p.ID()}, params...)}, true, nil
+}
+
+// Placement returns the placement stored in the FieldPlacement metadata
+// field, or nil for Sequential.
+func (h *Header) Placement() (Placement, error) {
+	return headerPlacement(h)
+}
+
+// headerPlacement returns the placement stored in h, or nil for the
+// default.
+func headerPlacement(h *Header) (Placement, error) {
+	v, ok := h.Field(FieldPlacement)
+	if !ok {
+		return nil, nil
+	}
+	if len(v) == 0 {
+		return nil, errors.New("empty placement field")
+	}
+
+	placementMu.RLock()
+	unmarshal, ok := placements[v[0]]
+	placementMu.RUnlock()
+
+	if !ok {
+		return nil, UnsupportedPlacementError(v[0])
+	}
+	return unmarshal(v[1:])
+}
+
+// Sequential stores the payload in the slots right after the header. It is
+// the default.
+type Sequential struct{}
+
+func (Sequential) ID() byte                       { return 1 }
+func (Sequential) MarshalBinary() ([]byte, error) { return nil, nil }
+
+func (Sequential) Carrier(s Slots) Carrier {
+	return &stridedCarrier{s.Start, s.Len(), 1}
+}
+
+// Strided stores the payload in every Stride'th slot after the header,
+// spreading it over the image at the cost of capacity.
+type Strided struct {
+	Stride int
+}
+
+func (Strided) ID() byte { return 2 }
+
+func (p Strided) MarshalBinary() ([]byte, error) {
+	if p.Stride < 1 || int64(p.Stride) > 1<<32-1 {
+		return nil, fmt.Errorf("invalid stride %d", p.Stride)
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(p.Stride))
+	return b[:], nil
+}
+
+func (p Strided) Carrier(s Slots) Carrier {
+	return &stridedCarrier{s.Start, s.Len(), p.Stride}
+}
+
+type stridedCarrier struct {
+	next, end, stride int
+}
+
+func (c *stridedCarrier) Next() (int, bool) {
+	if c.next >= c.end {
+		return 0, false
+	}
+	i := c.next
+	c.next += c.stride
+	return i, true
+}
+
+func (c *stridedCarrier) Remaining() int {
+	if c.next >= c.end {
+		return 0
+	}
+	return (c.end - c.next + c.stride - 1) / c.stride
+}
+
+// Spread stores the payload in the Strided placement with the largest stride
+// it fits in, so it is spread evenly over the whole image instead of filling
+// a band at the top of one it only partly fills. Encode picks the stride
+// from the size of the stored payload and records it in the header as a
+// Strided placement, so decoding needs nothing. Until then MarshalBinary
+// returns a placeholder of the same size.
+type Spread struct{}
+
+func (Spread) ID() byte                       { return Strided{}.ID() }
+func (Spread) MarshalBinary() ([]byte, error) { return make([]byte, 4), nil }
+
+func (Spread) Carrier(s Slots) Carrier {
+	return Sequential{}.Carrier(s)
+}
+
+// spread returns the stride that spreads bits payload bits evenly over the
+// slots of s after the header.
+func spread(s Slots, bits int) int {
+	if bits == 0 {
+		return 1
+	}
+	if stride := (s.Len() - s.Start) / bits; stride > 1 {
+		return stride
+	}
+	return 1
+}
+
+// Region stores the payload in the pixels within Rect, relative to the image
+// origin, leaving the rest of the image untouched apart from the header.
+type Region struct {
+	Rect image.Rectangle
+}
+
+func (Region) ID() byte { return 3 }
+
+func (p Region) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 16)
+	for i, v := range []int{p.Rect.Min.X, p.Rect.Min.Y, p.Rect.Max.X, p.Rect.Max.Y} {
+		if int64(v) != int64(int32(v)) {
+			return nil, fmt.Errorf("region %v out of range", p.Rect)
+		}
+		binary.BigEndian.PutUint32(b[i*4:], uint32(int32(v)))
+	}
+	return b, nil
+}
+
+func (p Region) Carrier(s Slots) Carrier {
+	c := &regionCarrier{s: s, rect: p.Rect.Intersect(image.Rect(0, 0, s.Width, s.Height)), next: s.Start}
+	for y := c.rect.Min.Y; y < c.rect.Max.Y; y++ {
+		for x := c.rect.Min.X; x < c.rect.Max.X; x++ {
+			if n := s.Slot(image.Pt(x, y)) + s.PerPixel - s.Start; n > s.PerPixel {
+				c.remaining += s.PerPixel
+			} else if n > 0 {
+				c.remaining += n
+			}
+		}
+	}
+	return c
+}
+
+type regionCarrier struct {
+	s               Slots
+	rect            image.Rectangle
+	next, remaining int
+}
+
+func (c *regionCarrier) Next() (int, bool) {
+	for ; c.next < c.s.Len(); c.next++ {
+		if c.s.Pixel(c.next).In(c.rect) {
+			c.remaining--
+			c.next++
+			return c.next - 1, true
+		}
+	}
+	return 0, false
+}
+
+func (c *regionCarrier) Remaining() int {
+	return c.remaining
+}
+
+// Permuted scatters the payload over all slots after the header in an order
+// given by Seed. The seed is stored in the header, so this spreads the
+// payload but does not hide where it is, see Keyed for that.
+type Permuted struct {
+	Seed uint64
+}
+
+func (Permuted) ID() byte { return 4 }
+
+func (p Permuted) MarshalBinary() ([]byte, error) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], p.Seed)
+	return b[:], nil
+}
+
+func (p Permuted) Carrier(s Slots) Carrier {
+	n := s.Len() - s.Start
+	if n < 0 {
+		n = 0
+	}
+
+	var half uint
+	for 1<<(2*half) < n {
+		half++
+	}
+	return &permutedCarrier{seed: p.Seed, start: s.Start, n: n, half: half}
+}
+
+// permutedCarrier walks a Feistel network over the smallest power of four
+// covering the slots, skipping values outside them, which gives a
+// permutation without having to store it.
+type permutedCarrier struct {
+	seed            uint64
+	start, n        int
+	half            uint
+	counter, yields int
+}
+
+func (c *permutedCarrier) Next() (int, bool) {
+	for c.yields < c.n {
+		v := c.permute(uint64(c.counter))
+		c.counter++
+		if v < uint64(c.n) {
+			c.yields++
+			return c.start + int(v), true
+		}
+	}
+	return 0, false
+}
+
+func (c *permutedCarrier) Remaining() int {
+	return c.n - c.yields
+}
+
+func (c *permutedCarrier) permute(v uint64) uint64 {
+	mask := uint64(1)<<c.half - 1
+	l, r := v>>c.half, v&mask
+	for round := uint64(0); round < 4; round++ {
+		l, r = r, l^(splitmix(c.seed^round<<56^r)&mask)
+	}
+	return l<<c.half | r
+}
+
+// Keyed scatters the payload over all slots after the header like Permuted,
+// in an order derived with scrypt from the passphrase and Salt. Only Salt is
+// stored in the header, so finding the payload takes the passphrase, and
+// the LSB plane shows no trace of where it starts. It needs
+// Options.Passphrase when encoding and decoding.
+type Keyed struct {
+	Salt [16]byte
+
+	// key is the passphrase, filled in from Options.
+	key []byte
+}
+
+func (Keyed) ID() byte { return 5 }
+
+func (p Keyed) MarshalBinary() ([]byte, error) {
+	return append([]byte(nil), p.Salt[:]...), nil
+}
+
+func (p Keyed) Carrier(s Slots) Carrier {
+	c := Permuted{}.Carrier(s).(*permutedCarrier)
+	return &keyedCarrier{permutedCarrier: c, key: p.key, salt: p.Salt, label: "hidden/keyed"}
+}
+
+// Deniable is Keyed in every other slot after the header, and leaves the
+// slots in between to a second payload, Options.Hidden, which is found with
+// a passphrase of its own. Encoding always fills those slots, with random
+// bytes if there is no second payload, so revealing the passphrase of the
+// first shows a message but not whether there is another. It stores the
+// same header as Keyed, so only the passphrase of the first payload tells
+// the two apart: decoding reads the Keyed order first, and every other
+// slot when that fails.
+type Deniable struct {
+	Salt [16]byte
+
+	// key is the passphrase, filled in from Options.
+	key []byte
+}
+
+func (Deniable) ID() byte { return Keyed{}.ID() }
+
+func (p Deniable) MarshalBinary() ([]byte, error) {
+	return append([]byte(nil), p.Salt[:]...), nil
+}
+
+func (p Deniable) Carrier(s Slots) Carrier {
+	return interleaved(s, 0, p.key, p.Salt, "hidden/keyed")
+}
+
+// interleaved returns a keyed carrier over every other slot from s.Start,
+// the ones at an odd distance from it if odd is 1.
+func interleaved(s Slots, odd int, key []byte, salt [16]byte, label string) *interleavedCarrier {
+	n := s.Len() - s.Start - odd
+	if n < 0 {
+		n = 0
+	}
+	c := Permuted{}.Carrier(Slots{Width: (n + 1) / 2, Height: 1, PerPixel: 1}).(*permutedCarrier)
+	return &interleavedCarrier{&keyedCarrier{permutedCarrier: c, key: key, salt: salt, label: label}, s.Start, odd}
+}
+
+// interleavedCarrier maps the slots of a keyedCarrier over half of the
+// slots after start to every other one of them.
+type interleavedCarrier struct {
+	*keyedCarrier
+	start, odd int
+}
+
+func (c *interleavedCarrier) Next() (int, bool) {
+	i, ok := c.keyedCarrier.Next()
+	return c.start + 2*i + c.odd, ok
+}
+
+// withKey returns p with key if it is Keyed or Deniable, and p otherwise.
+func withKey(p Placement, key []byte) Placement {
+	switch k := p.(type) {
+	case Keyed:
+		k.key = key
+		return k
+	case Deniable:
+		k.key = key
+		return k
+	}
+	return p
+}
+
+// isKeyed reports whether c needs a passphrase to find the payload.
+func isKeyed(c Carrier) bool {
+	switch c.(type) {
+	case *keyedCarrier, *interleavedCarrier:
+		return true
+	}
+	return false
+}
+
+// keyedCarrier is a permutedCarrier that derives its seed when the first
+// slot is asked for, so counting the slots, as Capacity does, does not run
+// scrypt.
+type keyedCarrier struct {
+	*permutedCarrier
+	key    []byte
+	salt   [16]byte
+	label  string
+	seeded bool
+}
+
+func (c *keyedCarrier) Next() (int, bool) {
+	if !c.seeded {
+		if len(c.key) == 0 {
+			return 0, false
+		}
+		seed, err := scrypt.Key(c.key, append([]byte(c.label), c.salt[:]...), scryptN, scryptR, scryptP, 8)
+		if err != nil {
+			return 0, false
+		}
+		c.seed, c.seeded = binary.BigEndian.Uint64(seed), true
+		Wipe(seed)
+	}
+	return c.permutedCarrier.Next()
+}
+
+func splitmix(x uint64) uint64 {
+	x += 0x9E3779B97F4A7C15
+	x = (x ^ x>>30) * 0xBF58476D1CE4E5B9
+	x = (x ^ x>>27) * 0x94D049BB133111EB
+	return x ^ x>>31
+}
@@ -0,0 +1,85 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// TestSequentialGolden encodes a fixed payload into a fixed cover and checks
+// the pixels against hashes taken before placements were pluggable, so the
+// default sequential order stays bit-identical. Images of the first kind
+// are still read by every version, the second is the default since the
+// checksum became BLAKE2b-128.
+func TestSequentialGolden(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		opt  *Options
+		want string
+	}{
+		{"adler32", &Options{Integrity: Adler32}, "ae4cea874632c8042a8e11cc301d48658877464659e2e2addc38a1a410ca5690"},
+		{"adler32 sequential", &Options{Integrity: Adler32, Placement: Sequential{}}, "ae4cea874632c8042a8e11cc301d48658877464659e2e2addc38a1a410ca5690"},
+		{"default", nil, "fe316bc51c5724dcfca59e906353faf275d450d6a0816b7d4f47930f71e0b437"},
+		{"default sequential", &Options{Placement: Sequential{}}, "fe316bc51c5724dcfca59e906353faf275d450d6a0816b7d4f47930f71e0b437"},
+	} {
+		stego := roundTrip(t, testCover(64, 48, 126), testPayload(500, 126), c.opt, nil)
+		if sum := sha256.Sum256(pixels(t, stego)); hex.EncodeToString(sum[:]) != c.want {
+			t.Errorf("%s: pixels hash to %x, want %s", c.name, sum, c.want)
+		}
+	}
+}
+
+// TestSpread checks that a spread payload is stored in the Strided placement
+// with the largest stride it fits in, so its last bits are near the end of
+// the image, and that one filling the image is stored in a stride of 1.
+func TestSpread(t *testing.T) {
+	cover := testCover(64, 48, 305)
+	for _, c := range []struct {
+		name    string
+		size    int
+		opt     *Options
+		minimum int
+	}{
+		{"small", 100, &Options{Placement: Spread{}}, 10},
+		{"encrypted", 100, &Options{Placement: Spread{}, Passphrase: []byte("pass")}, 5},
+		{"depth", 100, &Options{Placement: Spread{}, Depth: ChannelDepth{2, 2, 2, 0}}, 20},
+		{"full", Capacity(cover, &Options{Placement: Spread{}}), &Options{Placement: Spread{}}, 1},
+	} {
+		stego := roundTrip(t, cover, testPayload(c.size, 305), c.opt, &Options{Passphrase: c.opt.Passphrase})
+		h, err := DecodeHeader(stego)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := h.Placement()
+		s, ok := p.(Strided)
+		if err != nil || !ok || s.Stride < c.minimum || c.minimum == 1 && s.Stride != 1 {
+			t.Errorf("%s: stored in %#v, %v, want a stride of at least %d", c.name, p, err, c.minimum)
+		}
+
+		// The last rows hold bits of the payload.
+		got, last := pixels(t, stego), -1
+		for i := range got {
+			if got[i] != cover.Pix[i] {
+				last = i
+			}
+		}
+		if last < len(got)*9/10 {
+			t.Errorf("%s: the last change is at byte %d of %d", c.name, last, len(got))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import "fmt"
+
+// Preset names the threat model a combination of options was chosen for.
+// Options.Preset records it in the header, so whoever decodes the image can
+// tell what the message was made to withstand. It changes no other option,
+// choosing those is up to the caller.
+type Preset byte
+
+// The presets. Zero is no preset.
+const (
+	// PresetStealth hides the message from steganalysis.
+	PresetStealth Preset = 1 + iota
+
+	// PresetCapacity fits as large a message as possible.
+	PresetCapacity
+
+	// PresetRobust keeps the message through damage to the image.
+	PresetRobust
+)
+
+var presetNames = map[Preset]string{
+	PresetStealth:  "stealth",
+	PresetCapacity: "capacity",
+	PresetRobust:   "robust",
+}
+
+func (p Preset) String() string {
+	if name, ok := presetNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("preset-0x%02x", byte(p))
+}
+
+// LookupPreset returns the preset with the given name, like "stealth".
+func LookupPreset(name string) (Preset, bool) {
+	for p, n := range presetNames {
+		if n == name {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
+// Preset returns the preset stored in the FieldPreset metadata field.
+func (h *Header) Preset() (Preset, bool) {
+	v, ok := h.Field(FieldPreset)
+	if !ok || len(v) != 1 {
+		return 0, false
+	}
+	return Preset(v[0]), true
+}
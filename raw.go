@@ -0,0 +1,137 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+)
+
+// ErrRawUnsupported is returned for Options.Raw by anything but Encode,
+// Decode and Capacity.
+var ErrRawUnsupported = errors.New("a raw payload is only supported in the pixels of an image")
+
+// rawLength is the size of the length in front of a raw payload.
+const rawLength = 4
+
+func (o *Options) raw() bool {
+	return o != nil && o.Raw
+}
+
+// checkRaw rejects the options that need a header, which a raw payload does
+// not have.
+func (o *Options) checkRaw() error {
+	switch {
+	case len(o.Passphrase) > 0 || o.Pad != nil || len(o.Recipients) > 0:
+		return errors.New("a raw payload has no header to record its encryption in")
+	case o.BlockSize > 0 || o.ChunkSize > 0 || o.code() != nil || o.Compression != nil:
+		return errors.New("a raw payload has no header to record resync blocks, chunks, parity or compression in")
+	case o.Placement != nil || o.Hidden != nil || o.Copies > 1:
+		return errors.New("a raw payload is stored from the first carrier bit on, it can not be placed elsewhere")
+	case len(o.Metadata) > 0 || o.File != nil || !o.Expires.IsZero() || o.Preset != 0 || o.SigningKey != nil || o.Seal:
+		return errors.New("a raw payload has no header to store metadata in")
+	case o.PreserveHistogram || o.Fill:
+		return errors.New("a raw payload can not preserve the histogram or fill the unused capacity")
+	case o.shard != nil || o.slotTable:
+		return ErrRawUnsupported
+	}
+	return nil
+}
+
+// byteOrder returns the byte order of the length of a raw payload.
+func (o *Options) byteOrder() binary.ByteOrder {
+	if o.LittleEndian {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// rawLayout returns the layout a raw payload and its length are stored in.
+func (o *Options) rawLayout() *layout {
+	if l := o.layout(); l != nil {
+		return l
+	}
+	return &defaultLayout
+}
+
+// encodeRaw is Encode for Options.Raw.
+func encodeRaw(cover image.Image, payload []byte, opt *Options) (image.Image, error) {
+	if err := opt.Validate(); err != nil {
+		return nil, err
+	}
+	if int64(len(payload)) > 1<<32-1 {
+		return nil, ErrMessageTooLarge
+	}
+	l := opt.rawLayout()
+	if err := checkAlpha(cover, l); err != nil {
+		return nil, err
+	}
+	dest, samples, err := copyCarrier(cover)
+	if err != nil {
+		return nil, err
+	}
+
+	length := make([]byte, rawLength)
+	opt.byteOrder().PutUint32(length, uint32(len(payload)))
+	w := newLSBWriter(samples, l)
+	if (len(length)+len(payload))*8 > w.remaining() {
+		return nil, ErrMessageTooLarge
+	}
+	if w.match, err = opt.matchRand(payload); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(length); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	return dest, nil
+}
+
+// decodeRaw is decode for Options.Raw. It fails with ErrNoHiddenMessage if
+// the length is more than img can hold.
+func decodeRaw(img *carrierImage, opt *Options) ([]byte, *Header, error) {
+	r := newLSBReader(img, opt.rawLayout())
+	length := make([]byte, rawLength)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, nil, ErrNoHiddenMessage
+	}
+	n := opt.byteOrder().Uint32(length)
+	if int64(n) > int64(r.remaining()) {
+		return nil, nil, ErrNoHiddenMessage
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, ErrNoHiddenMessage
+	}
+	return payload, &Header{Length: len(payload)}, nil
+}
+
+// capacityRaw is Capacity for Options.Raw.
+func capacityRaw(img image.Image, opt *Options) int {
+	l := opt.rawLayout()
+	if opt.Validate() != nil || checkAlpha(img, l) != nil {
+		return 0
+	}
+	n := l.restrict(isGray(img)).slots(img.Bounds(), 0).Len()/8 - rawLength
+	if n < 0 {
+		return 0
+	}
+	return n
+}
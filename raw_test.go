@@ -0,0 +1,117 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+)
+
+// lsbToolEncode hides data in cover the way the first hidden.go did, before
+// it had a header: one bit in the low bit of every red, green and blue
+// sample, the most significant bit of every byte first, the pixels in rows.
+// Its data was a 32 bit big endian length and an Adler-32 checksum in front
+// of the message, Raw leaves out the checksum.
+func lsbToolEncode(cover *image.RGBA, data []byte) *image.RGBA {
+	dest := image.NewRGBA(cover.Bounds())
+	ptr := 0
+	for i, b := range cover.Pix {
+		if (i+1)%4 == 0 || ptr/8 >= len(data) {
+			dest.Pix[i] = b
+			continue
+		}
+		bit := data[ptr/8] >> (7 - uint(ptr%8)) & 1
+		ptr++
+		dest.Pix[i] = b&^1 | bit
+	}
+	return dest
+}
+
+// TestRawGolden checks that a raw payload is stored bit for bit the way
+// the first hidden.go stored its data, and that what it stored decodes.
+func TestRawGolden(t *testing.T) {
+	msg := testPayload(500, 322)
+	cover := testCover(64, 48, 322)
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(msg)))
+	want := lsbToolEncode(cover, append(data, msg...))
+
+	stego, err := Encode(cover, msg, &Options{Raw: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pixels(t, stego), want.Pix) {
+		t.Error("a raw payload is not stored in the layout of the first hidden.go")
+	}
+
+	got, err := Decode(want, &Options{Raw: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Error("decoded payload differs")
+	}
+	if _, err := Decode(want, nil); err == nil {
+		t.Error("decoded a raw payload without Raw")
+	}
+}
+
+// TestRawGoldenBits pins the stored bits of a small cover with every
+// sample 0x80: the length 2 and "hi" fill the 48 color samples of 4 by 4
+// pixels exactly.
+func TestRawGoldenBits(t *testing.T) {
+	cover := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range cover.Pix {
+		cover.Pix[i] = 0x80
+	}
+	for _, c := range []struct {
+		name string
+		opt  *Options
+		bits string
+	}{
+		{"msb first, big endian", &Options{Raw: true},
+			"00000000" + "00000000" + "00000000" + "00000010" + "01101000" + "01101001"},
+		{"lsb first, big endian", &Options{Raw: true, BitOrder: LSBFirst},
+			"00000000" + "00000000" + "00000000" + "01000000" + "00010110" + "10010110"},
+		{"msb first, little endian", &Options{Raw: true, LittleEndian: true},
+			"00000010" + "00000000" + "00000000" + "00000000" + "01101000" + "01101001"},
+	} {
+		stego, err := Encode(cover, []byte("hi"), c.opt)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		var bits []byte
+		for i, b := range pixels(t, stego) {
+			if i%4 == 3 {
+				if b != 0x80 {
+					t.Errorf("%s: alpha of pixel %d changed to %#02x", c.name, i/4, b)
+				}
+				continue
+			}
+			if b&^1 != 0x80 {
+				t.Errorf("%s: sample %d changed to %#02x", c.name, i, b)
+			}
+			bits = append(bits, '0'+b&1)
+		}
+		if string(bits) != c.bits {
+			t.Errorf("%s: stored %s, want %s", c.name, bits, c.bits)
+		}
+		if got, err := Decode(stego, c.opt); err != nil || string(got) != "hi" {
+			t.Errorf("%s: decoded %q, %v", c.name, got, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrIdentityRequired = errors.New("message is encrypted to recipients, a private key is required")
+	ErrNoIdentity       = errors.New("message is not encrypted to any of the private keys")
+)
+
+// Recipient is a public key the payload is encrypted to, see
+// Options.Recipients. It is an *AgeRecipient or a *PGPRecipient.
+type Recipient interface {
+	// String is the key as users know it, the age1 public key or the
+	// fingerprint of the OpenPGP key.
+	String() string
+
+	scheme() recipientScheme
+}
+
+// Identity is a private key that decrypts a payload encrypted to its
+// Recipient, see Options.Identities. It is an *AgeIdentity or a
+// *PGPIdentity.
+type Identity interface {
+	Recipient() Recipient
+
+	scheme() recipientScheme
+}
+
+// recipientScheme is a format a payload encrypted to recipients is stored
+// in. Its ID is the value of the FieldRecipients field.
+type recipientScheme interface {
+	id() byte
+	name() string
+
+	encrypt(recipients []Recipient, payload []byte, rnd io.Reader) ([]byte, error)
+
+	// decrypt returns ErrNoIdentity if payload is not encrypted to any of
+	// identities, and ErrDecryptionFailed if it is damaged.
+	decrypt(identities []Identity, payload []byte) ([]byte, error)
+
+	// capacity returns the largest payload that is at most n bytes once
+	// encrypted to recipients.
+	capacity(recipients []Recipient, n int) int
+}
+
+var recipientSchemes = map[byte]recipientScheme{
+	ageScheme{}.id(): ageScheme{},
+	pgpScheme{}.id(): pgpScheme{},
+}
+
+// recipientScheme returns the scheme of the recipients, or nil if there are
+// none. Validate makes sure they all have the same one.
+func (o *Options) recipientScheme() recipientScheme {
+	if o == nil || len(o.Recipients) == 0 {
+		return nil
+	}
+	return o.Recipients[0].scheme()
+}
+
+func (o *Options) identities() []Identity {
+	if o == nil {
+		return nil
+	}
+	return o.Identities
+}
+
+// checkRecipients rejects recipients that are not all of one scheme.
+func checkRecipients(recipients []Recipient) error {
+	for _, r := range recipients {
+		if r == nil {
+			return errors.New("a recipient is nil")
+		}
+		if s := r.scheme(); s != recipients[0].scheme() {
+			return fmt.Errorf("a message is encrypted to %s or %s recipients, not both", recipients[0].scheme().name(), s.name())
+		}
+	}
+	return nil
+}
+
+// openRecipients decrypts a payload with a FieldRecipients field v with the
+// first of identities of its scheme it is encrypted to.
+func openRecipients(identities []Identity, v, payload []byte) ([]byte, error) {
+	if len(v) != 1 {
+		return nil, errors.New("invalid recipients field")
+	}
+	s, ok := recipientSchemes[v[0]]
+	if !ok {
+		return nil, fmt.Errorf("message is encrypted to recipients in unsupported format 0x%02x", v[0])
+	}
+
+	var ids []Identity
+	for _, id := range identities {
+		if id.scheme() == s {
+			ids = append(ids, id)
+		}
+	}
+	switch {
+	case len(identities) == 0:
+		return nil, ErrIdentityRequired
+	case len(ids) == 0:
+		return nil, ErrNoIdentity
+	}
+	return s.decrypt(ids, payload)
+}
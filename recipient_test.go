@@ -0,0 +1,182 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+func testAgeIdentity(t *testing.T) *AgeIdentity {
+	t.Helper()
+	id, err := GenerateAgeIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func testPGPEntity(t *testing.T, name string) *openpgp.Entity {
+	t.Helper()
+	e, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// testRecipients encodes msg to to and decodes it with each of the
+// identities in ids, comparing the errors with want.
+func testRecipients(t *testing.T, to []Recipient, ids map[string][]Identity, want map[string]error) {
+	t.Helper()
+	msg := []byte("attack at dawn")
+	stego, err := Encode(testCover(64, 64, 1), msg, &Options{Recipients: to})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, id := range ids {
+		got, err := Decode(stego, &Options{Identities: id})
+		if err != want[name] {
+			t.Errorf("%s: got %v, want %v", name, err, want[name])
+		} else if err == nil && !bytes.Equal(got, msg) {
+			t.Errorf("%s: got %q, want %q", name, got, msg)
+		}
+	}
+}
+
+func TestAgeRecipients(t *testing.T) {
+	alice, bob, eve := testAgeIdentity(t), testAgeIdentity(t), testAgeIdentity(t)
+	testRecipients(t, []Recipient{alice.Recipient(), bob.Recipient()}, map[string][]Identity{
+		"alice":       {alice},
+		"bob":         {bob},
+		"eve and bob": {eve, bob},
+		"eve":         {eve},
+		"nobody":      nil,
+	}, map[string]error{
+		"eve":    ErrNoIdentity,
+		"nobody": ErrIdentityRequired,
+	})
+}
+
+// TestAgeFile checks that the payload is an age file the age tool reads.
+func TestAgeFile(t *testing.T) {
+	id := testAgeIdentity(t)
+	msg := []byte("attack at dawn")
+	stego, err := Encode(testCover(64, 64, 1), msg, &Options{Recipients: []Recipient{id.Recipient()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ExtractContainer(stego)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := age.Decrypt(bytes.NewReader(c.Payload), id.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("got %q, %v, want %q", got, err, msg)
+	}
+
+	parsed, err := ParseAgeIdentity(id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := parsed.Recipient().String(), id.Recipient().String(); got != want {
+		t.Errorf("parsed identity has recipient %s, want %s", got, want)
+	}
+}
+
+func TestAgeDeterministic(t *testing.T) {
+	opt := &Options{Recipients: []Recipient{testAgeIdentity(t).Recipient()}, Deterministic: true}
+	if _, err := Encode(testCover(64, 64, 1), []byte("message"), opt); err == nil {
+		t.Error("a deterministic message to age recipients was encoded")
+	}
+}
+
+func TestPGPRecipients(t *testing.T) {
+	alice, bob, eve := testPGPEntity(t, "alice"), testPGPEntity(t, "bob"), testPGPEntity(t, "eve")
+	testRecipients(t, []Recipient{&PGPRecipient{alice}, &PGPRecipient{bob}}, map[string][]Identity{
+		"alice":       {&PGPIdentity{alice}},
+		"bob":         {&PGPIdentity{bob}},
+		"eve and bob": {&PGPIdentity{eve}, &PGPIdentity{bob}},
+		"eve":         {&PGPIdentity{eve}},
+		"nobody":      nil,
+	}, map[string]error{
+		"eve":    ErrNoIdentity,
+		"nobody": ErrIdentityRequired,
+	})
+}
+
+func TestPGPLockedKey(t *testing.T) {
+	passphrase := []byte("key passphrase")
+	e := testPGPEntity(t, "alice")
+	if err := e.EncryptPrivateKeys(passphrase, nil); err != nil {
+		t.Fatal(err)
+	}
+	var ring bytes.Buffer
+	if err := e.SerializePrivateWithoutSigning(&ring, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range [][]byte{nil, []byte("wrong")} {
+		if _, err := ReadPGPIdentities(bytes.NewReader(ring.Bytes()), p); !errors.Is(err, ErrKeyLocked) {
+			t.Errorf("passphrase %q: got %v, want ErrKeyLocked", p, err)
+		}
+	}
+	ids, err := ReadPGPIdentities(bytes.NewReader(ring.Bytes()), passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRecipients(t, []Recipient{ids[0].Recipient()}, map[string][]Identity{"unlocked": ids}, nil)
+}
+
+// TestRecipientsCapacity checks that a payload of the capacity Capacity
+// reports fits. It is exact for age, and one byte more does not fit, while
+// the framing of OpenPGP varies and its capacity leaves some slack.
+func TestRecipientsCapacity(t *testing.T) {
+	for name, c := range map[string]struct {
+		to    Recipient
+		exact bool
+	}{
+		"age":     {testAgeIdentity(t).Recipient(), true},
+		"openpgp": {&PGPRecipient{testPGPEntity(t, "alice")}, false},
+	} {
+		cover := testCover(64, 64, 1)
+		opt := &Options{Recipients: []Recipient{c.to}}
+		n := Capacity(cover, opt)
+		payload := make([]byte, n+pgpSlack+1)
+		rand.New(rand.NewSource(1)).Read(payload)
+
+		if _, err := Encode(cover, payload[:n], opt); err != nil {
+			t.Errorf("%s: %d bytes: %v", name, n, err)
+		}
+		over := n + 1
+		if !c.exact {
+			over += pgpSlack
+		}
+		if _, err := Encode(cover, payload[:over], opt); err != ErrMessageTooLarge {
+			t.Errorf("%s: %d bytes: got %v, want ErrMessageTooLarge", name, over, err)
+		}
+	}
+}
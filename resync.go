@@ -0,0 +1,321 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"math/rand"
+)
+
+// With Options.BlockSize the payload, after encryption, is stored as blocks
+// that each start with a resync marker, so they can be found at any bit
+// offset when the start of the image is lost. Every block is, big endian:
+//
+//	marker  2 bytes, resyncMarker
+//	flags   1 byte, the header flags
+//	size    2 bytes, the block size
+//	seq     4 bytes, the sequence number of the block
+//	total   4 bytes, the size of the payload
+//	data    size bytes, less for the last block
+//	crc     4 bytes, CRC-32 of flags through data
+const resyncOverhead = 17
+
+var (
+	resyncMarker     = []byte{0xb7, 0x3e}
+	resyncMarkerBits = unpackBits(resyncMarker)
+)
+
+// ErrCopiesUnsupported is returned for the Copies option when encoding
+// anything but the pixels of an image.
+var ErrCopiesUnsupported = errors.New("copies are only supported in the pixels of an image")
+
+// Range is a half-open range of payload bytes.
+type Range struct {
+	Start, End int
+}
+
+// Recovery is what Recover found of a message.
+type Recovery struct {
+	// Payload has the size of the original payload, bytes that were not
+	// recovered are zero.
+	Payload []byte
+
+	// Missing lists the ranges of Payload that were not recovered.
+	Missing []Range
+
+	// BlockSize is the size of the resync blocks the payload was read
+	// from, zero if it was intact.
+	BlockSize int
+}
+
+// Recover extracts what is left of a message stored with Options.BlockSize,
+// from an image that may be cropped or damaged. An intact message is decoded
+// as with Decode, with or without resync markers. Otherwise the image is
+// scanned for blocks in the order of the default layout and Sequential
+// placement. An encrypted payload can only be decrypted if it is complete,
+// and one XORed with a pad only with its header.
+func Recover(img image.Image, opt *Options) (*Recovery, error) {
+	samples := carrierOf(img)
+	samples.legacy = opt.legacy()
+	if msg, h, err := extractLayout(samples, storedLayout(samples), opt.passphrase()); err == nil {
+		msg, err := h.open(msg, opt)
+		// Damaged blocks may be intact in another copy.
+		if _, damaged := err.(*ChecksumError); !damaged || h.Flags&FlagResync == 0 {
+			if err != nil {
+				return nil, err
+			}
+			return &Recovery{Payload: msg}, nil
+		}
+	}
+
+	blocks := scanBlocks(resyncBits(samples))
+	if len(blocks) == 0 {
+		return nil, ErrNoHiddenMessage
+	}
+
+	// Blocks from different messages can not be combined, the key with
+	// the most blocks wins.
+	count := map[resyncKey]int{}
+	var key resyncKey
+	for _, b := range blocks {
+		if count[b.resyncKey]++; count[b.resyncKey] > count[key] {
+			key = b.resyncKey
+		}
+	}
+
+	rec := &Recovery{Payload: make([]byte, key.total), BlockSize: key.size}
+	found := make([]bool, (key.total+key.size-1)/key.size)
+	for _, b := range blocks {
+		if b.resyncKey == key {
+			copy(rec.Payload[b.seq*key.size:], b.data)
+			found[b.seq] = true
+		}
+	}
+
+	for seq, ok := range found {
+		if ok {
+			continue
+		}
+		start, end := seq*key.size, (seq+1)*key.size
+		if end > key.total {
+			end = key.total
+		}
+		if n := len(rec.Missing); n > 0 && rec.Missing[n-1].End == start {
+			rec.Missing[n-1].End = end
+		} else {
+			rec.Missing = append(rec.Missing, Range{start, end})
+		}
+	}
+
+	if key.flags&FlagPad != 0 {
+		return nil, errors.New("message is XORed with a one-time pad, its place in the pad was lost with the header")
+	}
+	if key.flags&FlagEncrypted != 0 {
+		if len(rec.Missing) > 0 {
+			return nil, fmt.Errorf("encrypted message is incomplete, %d bytes are missing", rec.missing())
+		}
+		msg, err := open(opt.passphrase(), rec.Payload)
+		if err != nil {
+			return nil, err
+		}
+		rec.Payload = msg
+	}
+	return rec, nil
+}
+
+// embedCopies writes the copies of payload after the first one, which embed
+// wrote behind the header, each at the start of its part of the carrier
+// bits of img, in the default layout. The first copy and the header have to
+// fit in the first part.
+func embedCopies(img *carrierImage, header, payload []byte, copies int, match *rand.Rand) error {
+	if copies < 2 {
+		return nil
+	}
+	part := defaultLayout.restrict(img.gray).slots(img.Rect, 0).Len() / copies
+	if (len(header)+len(payload))*8 > part {
+		return ErrMessageTooLarge
+	}
+
+	for k := 1; k < copies; k++ {
+		w := newLSBWriter(img, &defaultLayout)
+		w.match = match
+		w.used = k * part
+		w.place(Sequential{})
+		if _, err := w.Write(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Blocks returns the number of resync blocks of the payload, and those of
+// them that were not recovered, counting from 0.
+func (rec *Recovery) Blocks() (total int, missing []int) {
+	if rec.BlockSize == 0 {
+		return 0, nil
+	}
+	for _, r := range rec.Missing {
+		for seq := r.Start / rec.BlockSize; seq*rec.BlockSize < r.End; seq++ {
+			missing = append(missing, seq)
+		}
+	}
+	return (len(rec.Payload) + rec.BlockSize - 1) / rec.BlockSize, missing
+}
+
+// missing returns the number of bytes that were not recovered.
+func (rec *Recovery) missing() int {
+	var n int
+	for _, r := range rec.Missing {
+		n += r.End - r.Start
+	}
+	return n
+}
+
+// resyncKey identifies the message a block belongs to.
+type resyncKey struct {
+	flags       byte
+	size, total int
+}
+
+type resyncBlock struct {
+	resyncKey
+	seq  int
+	data []byte
+}
+
+// frame splits payload into blocks of size bytes behind resync markers.
+func frame(payload []byte, size int, flags byte) []byte {
+	var buf bytes.Buffer
+	for seq := 0; seq*size < len(payload); seq++ {
+		data := payload[seq*size:]
+		if len(data) > size {
+			data = data[:size]
+		}
+
+		start := buf.Len()
+		buf.Write(resyncMarker)
+		buf.WriteByte(flags)
+		binary.Write(&buf, binary.BigEndian, uint16(size))
+		binary.Write(&buf, binary.BigEndian, uint32(seq))
+		binary.Write(&buf, binary.BigEndian, uint32(len(payload)))
+		buf.Write(data)
+		binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()[start+len(resyncMarker):]))
+	}
+	return buf.Bytes()
+}
+
+// unframe returns the payload stored in the blocks of stream.
+func unframe(stream []byte) ([]byte, error) {
+	var payload []byte
+	for len(stream) > 0 {
+		b, n, ok := parseBlock(stream)
+		if !ok || b.seq*b.size != len(payload) {
+			return nil, errors.New("damaged resync block")
+		}
+		payload = append(payload, b.data...)
+		stream = stream[n:]
+	}
+	return payload, nil
+}
+
+// unframedLen returns the largest payload that fits in n bytes when split
+// into blocks of size bytes.
+func unframedLen(n, size int) int {
+	full, rest := n/(size+resyncOverhead), n%(size+resyncOverhead)-resyncOverhead
+	if rest < 0 {
+		rest = 0
+	}
+	return full*size + rest
+}
+
+// parseHead parses the fields in front of the data of the block at the start
+// of data, and returns the block without data and its length.
+func parseHead(data []byte) (*resyncBlock, int, bool) {
+	m := len(resyncMarker)
+	if len(data) < resyncOverhead-4 || !bytes.Equal(data[:m], resyncMarker) {
+		return nil, 0, false
+	}
+
+	b := &resyncBlock{
+		resyncKey: resyncKey{
+			flags: data[m],
+			size:  int(binary.BigEndian.Uint16(data[m+1:])),
+			total: int(binary.BigEndian.Uint32(data[m+7:])),
+		},
+		seq: int(binary.BigEndian.Uint32(data[m+3:])),
+	}
+	if b.size == 0 || b.total == 0 || b.seq >= (b.total+b.size-1)/b.size {
+		return nil, 0, false
+	}
+
+	size := b.total - b.seq*b.size
+	if size > b.size {
+		size = b.size
+	}
+	return b, resyncOverhead + size, true
+}
+
+// parseBlock parses the block at the start of data and returns it with its
+// length.
+func parseBlock(data []byte) (*resyncBlock, int, bool) {
+	b, n, ok := parseHead(data)
+	if !ok || len(data) < n {
+		return nil, 0, false
+	}
+	m := len(resyncMarker)
+	if crc32.ChecksumIEEE(data[m:n-4]) != binary.BigEndian.Uint32(data[n-4:]) {
+		return nil, 0, false
+	}
+	b.data = data[resyncOverhead-4 : n-4]
+	return b, n, true
+}
+
+// resyncBits returns the carrier bits of img in the order of the default
+// layout, one per byte.
+func resyncBits(img *carrierImage) []byte {
+	b, n := img.Rect, img.colors()
+	bits := make([]byte, 0, b.Dx()*b.Dy()*n)
+	for y := 0; y < b.Dy(); y++ {
+		for i := 0; i < b.Dx()*n; i++ {
+			bits = append(bits, img.Pix[img.sample(i/n, y, i%n)]&1)
+		}
+	}
+	return bits
+}
+
+// scanBlocks returns the valid blocks that start at any offset in bits.
+func scanBlocks(bits []byte) []*resyncBlock {
+	var blocks []*resyncBlock
+	for i := 0; i+resyncOverhead*8 <= len(bits); i++ {
+		if !bytes.Equal(bits[i:i+len(resyncMarkerBits)], resyncMarkerBits) {
+			continue
+		}
+		_, n, ok := parseHead(packBits(bits[i : i+(resyncOverhead-4)*8]))
+		if !ok || i+n*8 > len(bits) {
+			continue
+		}
+		if b, _, ok := parseBlock(packBits(bits[i : i+n*8])); ok {
+			blocks = append(blocks, b)
+			i += n*8 - 1
+		}
+	}
+	return blocks
+}
@@ -0,0 +1,173 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"image"
+)
+
+// A sealed image stores a SHA-256 of itself in a FieldSeal field, so Decode
+// can tell whether it was changed after encoding, even where it holds no
+// payload. The hash can not cover the carrier bits of the container, which
+// hold the seal, so it covers everything else:
+//
+//	- the width and height of the image as 32 bits each, followed by a byte
+//	  that is 1 for 16 bit samples and 0 for 8 bit ones,
+//	- then every sample row by row from the top, alpha included, as the
+//	  bytes of carrierImage.Pix, with the bits embed writes the header and
+//	  payload to set to 0.
+//
+// Those bits are found by walking the carrier bits exactly like embed does
+// for a header and payload of the stored sizes, in the stored placement and
+// depths. Carrier bits after the payload keep the values of the cover, and
+// are hashed like any other bit.
+//
+// Encoding takes two passes. The container is embedded with a seal of
+// zeros, the image is hashed, and the header is written again with the
+// hash and the checksum over it. That only changes bits of the header,
+// which the hash leaves out, and the header keeps its size.
+
+var (
+	// ErrModified is returned when decoding a sealed image that was
+	// changed after encoding, see Options.Seal.
+	ErrModified = errors.New("image modified after encoding")
+
+	// ErrNotSealed is returned by CheckSeal for a message without a seal.
+	ErrNotSealed = errors.New("message is not sealed")
+
+	// ErrSealUnsupported is returned for the Seal option when encoding
+	// anything but the pixels of an image.
+	ErrSealUnsupported = errors.New("sealing is only supported in the pixels of an image")
+)
+
+// sealField returns the FieldSeal field Encode writes first, with a seal of
+// zeros.
+func sealField() Field {
+	return Field{FieldSeal, make([]byte, sha256.Size)}
+}
+
+// sealSum returns the seal of img holding a header and payload of the given
+// sizes, in placement p and layout l as embed stores them.
+func sealSum(img *carrierImage, header, payload int, p Placement, l *layout) ([]byte, error) {
+	r := img.Rect
+	row := r.Dx() * img.pixelSize()
+	mask := &carrierImage{bytes.Repeat([]byte{0xFF}, row*r.Dy()), row, r, img.wide, img.gray, nil, false, false}
+	if err := embed(mask, make([]byte, header), make([]byte, payload), p, l, nil); err != nil {
+		return nil, err
+	}
+
+	s := sha256.New()
+	var dims [9]byte
+	binary.BigEndian.PutUint32(dims[0:], uint32(r.Dx()))
+	binary.BigEndian.PutUint32(dims[4:], uint32(r.Dy()))
+	if img.wide {
+		dims[8] = 1
+	}
+	s.Write(dims[:])
+
+	buf := make([]byte, row)
+	for y := 0; y < r.Dy(); y++ {
+		pix, m := img.Pix[y*img.Stride:][:row], mask.Pix[y*row:][:row]
+		for i := range buf {
+			buf[i] = pix[i] & m[i]
+		}
+		s.Write(buf)
+	}
+	return s.Sum(nil), nil
+}
+
+// sealImage is the second pass of encoding a sealed image: it hashes img,
+// which holds header and payload as embed stored them, and writes header
+// again with the seal.
+func sealImage(img *carrierImage, header, payload []byte, p Placement, l *layout) error {
+	h := &Header{}
+	if err := h.UnmarshalBinary(header); err != nil {
+		return err
+	}
+	sum, err := sealSum(img, len(header), len(payload), p, l)
+	if err != nil {
+		return err
+	}
+	for i := range h.Metadata {
+		if h.Metadata[i].Type == FieldSeal {
+			h.Metadata[i].Value = sum
+		}
+	}
+
+	data, _, err := h.repair(payload)
+	if err != nil {
+		return err
+	}
+	h.Checksum = h.sum(data)
+	if data, err = h.MarshalBinary(); err != nil {
+		return err
+	}
+	boot := &defaultLayout
+	if l != nil {
+		boot = l.bootstrap()
+	}
+	w := newLSBWriter(img, boot)
+	if err := w.seekHeader(p, len(data)); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// checkSeal returns ErrModified if h is sealed and img, which holds the
+// message of h, does not match the seal. key is the passphrase of a Keyed
+// placement.
+func (h *Header) checkSeal(img *carrierImage, key []byte) error {
+	v, ok := h.Field(FieldSeal)
+	if !ok {
+		return nil
+	}
+	p, err := headerPlacement(h)
+	if err != nil {
+		return err
+	}
+	l, err := headerDepth(h)
+	if err != nil {
+		return err
+	}
+	sum, err := sealSum(img, h.Len(), h.Length, withKey(p, key), l)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, v) {
+		return ErrModified
+	}
+	return nil
+}
+
+// CheckSeal validates the seal of the message hidden in img without
+// decoding it. It returns ErrModified if img was changed after encoding,
+// and ErrNotSealed if the message has no seal.
+func CheckSeal(img image.Image) error {
+	samples := carrierOf(img)
+	_, h, err := extractLayout(samples, storedLayout(samples), nil)
+	if err != nil {
+		return err
+	}
+	if _, ok := h.Field(FieldSeal); !ok {
+		return ErrNotSealed
+	}
+	return h.checkSeal(samples, nil)
+}
@@ -0,0 +1,143 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"image"
+	"math/rand"
+	"testing"
+)
+
+// testSeal computes the seal of img, an *image.RGBA holding a message in
+// the default, sequential layout, from the definition in seal.go: the
+// dimensions, then every sample with the low bits of the first bits color
+// samples cleared.
+func testSeal(t *testing.T, img image.Image, bits int) []byte {
+	t.Helper()
+	m := img.(*image.RGBA)
+	s := sha256.New()
+	var dims [9]byte
+	binary.BigEndian.PutUint32(dims[0:], uint32(m.Rect.Dx()))
+	binary.BigEndian.PutUint32(dims[4:], uint32(m.Rect.Dy()))
+	s.Write(dims[:])
+
+	pix := append([]byte(nil), m.Pix...)
+	for i := 0; bits > 0; i++ {
+		if i%4 != 3 {
+			pix[i] &^= 1
+			bits--
+		}
+	}
+	s.Write(pix)
+	return s.Sum(nil)
+}
+
+// TestSealGolden locks the seal of fixed covers and payloads, encrypted with
+// a fixed key and nonce drawn from a seeded source, and checks it against a
+// seal computed from its definition.
+func TestSealGolden(t *testing.T) {
+	seeded := func() *rand.Rand { return rand.New(rand.NewSource(163)) }
+	for _, c := range []struct {
+		name   string
+		opt    *Options
+		seal   string
+		pixels string
+	}{
+		{"plain", &Options{Seal: true}, "7624f5821262a3aa481fbb91628933ccfcc6d4f797814ee139c18f3ea4eef124", "6a7f3f3a4983938dc44d1fe9c4b1e5e7cb2feb972753cebb7d1ea58f2cd6e295"},
+		{"passphrase", &Options{Seal: true, Passphrase: []byte("pass"), Deterministic: true, Random: seeded()}, "ffcbb749568d86546ee86d9d8a2c2f13dc642d031577871d6f654fae85e63b3e", "1ab6b98e37491baf9fbf777c4c9396e982e215eeb6ed3161cf5ccda356b102ab"},
+		{"ecc", &Options{Seal: true, ECC: 16}, "1affa4e4d5a1b387fcfd304aa9c04fbf7bd3c5ba5289cd1bbf7eaa1a7cae8566", "819be871b8c55227dd353a1d564e5e7ce09ad4d0da0bf14306204f54f926bf8e"},
+	} {
+		stego := roundTrip(t, testCover(64, 48, 163), testPayload(300, 163), c.opt, &Options{Passphrase: c.opt.Passphrase})
+		h, err := DecodeHeader(stego)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		seal, ok := h.Field(FieldSeal)
+		if !ok {
+			t.Fatalf("%s: no seal", c.name)
+		}
+		if want := testSeal(t, stego, (h.Len()+h.Length)*8); hex.EncodeToString(seal) != hex.EncodeToString(want) {
+			t.Errorf("%s: seal %x, computed %x", c.name, seal, want)
+		}
+		if got := hex.EncodeToString(seal); got != c.seal {
+			t.Errorf("%s: seal %s, want %s", c.name, got, c.seal)
+		}
+		if sum := sha256.Sum256(pixels(t, stego)); hex.EncodeToString(sum[:]) != c.pixels {
+			t.Errorf("%s: pixels hash to %x, want %s", c.name, sum, c.pixels)
+		}
+		if err := CheckSeal(stego); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+// TestSealTampered changes a sealed image where it holds no message bits,
+// which the seal has to tell, and in a bit of the payload, which only the
+// checksum can.
+func TestSealTampered(t *testing.T) {
+	cover := testCover(64, 48, 163)
+	stego := roundTrip(t, cover, testPayload(300, 163), &Options{Seal: true}, nil).(*image.RGBA)
+	h, err := DecodeHeader(stego)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The color samples of the message take the first rows, the last row
+	// holds none of it.
+	used := (h.Len() + h.Length) * 8
+	last := len(stego.Pix) - stego.Stride
+
+	for _, c := range []struct {
+		name   string
+		change func(m *image.RGBA) image.Image
+		err    error
+	}{
+		{"unchanged", func(m *image.RGBA) image.Image { return m }, nil},
+		{"high bit", func(m *image.RGBA) image.Image { m.Pix[last+5] ^= 0x80; return m }, ErrModified},
+		{"unused low bit", func(m *image.RGBA) image.Image { m.Pix[last+5] ^= 1; return m }, ErrModified},
+		{"alpha", func(m *image.RGBA) image.Image { m.Pix[3] ^= 1; return m }, ErrModified},
+		{"payload bit", func(m *image.RGBA) image.Image { m.Pix[(used-10)/3*4] ^= 1; return m }, &ChecksumError{}},
+		{"high bit of a payload sample", func(m *image.RGBA) image.Image { m.Pix[(used-10)/3*4] ^= 0x10; return m }, ErrModified},
+		{"cropped", func(m *image.RGBA) image.Image { return m.SubImage(image.Rect(0, 0, 64, 47)) }, ErrModified},
+	} {
+		m := *stego
+		m.Pix = append([]byte(nil), stego.Pix...)
+		img := c.change(&m)
+
+		_, err := Decode(img, nil)
+		if !sameError(err, c.err) {
+			t.Errorf("%s: Decode got %v, want %v", c.name, err, c.err)
+		}
+		if err := CheckSeal(img); !sameError(err, c.err) {
+			t.Errorf("%s: CheckSeal got %v, want %v", c.name, err, c.err)
+		}
+	}
+
+	if err := CheckSeal(roundTrip(t, cover, testPayload(300, 163), nil, nil)); err != ErrNotSealed {
+		t.Errorf("unsealed: got %v, want ErrNotSealed", err)
+	}
+}
+
+// sameError reports whether err is want, or like it a *ChecksumError.
+func sameError(err, want error) bool {
+	if _, ok := want.(*ChecksumError); ok {
+		return errors.As(err, new(*ChecksumError))
+	}
+	return err == want
+}
@@ -0,0 +1,102 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"image"
+	"sort"
+)
+
+// Candidate is a layout Search found a message header in.
+type Candidate struct {
+	// Layout describes the layout like DecodeAuto does, for example
+	// "depth=2 channels=bgr order=lsb-first scan=rows".
+	Layout string
+
+	// Header is the header found, nil if it claims a longer payload than
+	// the image holds.
+	Header *Header
+
+	// Valid is set if the payload matched its checksum, even if it could
+	// not be opened.
+	Valid bool
+
+	// Payload is the message, decrypted and decompressed, if it could be
+	// opened with the options.
+	Payload []byte
+
+	// Err is nil if Payload is set, and otherwise why not, like a
+	// *ChecksumError or a *TruncatedError of a damaged message, or
+	// ErrPassphraseRequired.
+	Err error
+}
+
+// Search tries many more layouts than DecodeAuto, for an image whose
+// encoding settings were lost or that was made by another tool: depths 1 to
+// 4, every set of the channels in every order, both bit orders, and the
+// pixels walked in rows, in columns or once for every channel. It returns
+// every layout that holds a container header, those whose payload matched
+// its checksum first. A legacy header, which has no magic to tell it from
+// noise, is only returned with Options.Legacy and if its payload matched.
+func Search(img image.Image, opt *Options) []Candidate {
+	var (
+		samples = carrierOf(img)
+		found   []Candidate
+		seen    = make(map[string]bool)
+	)
+	samples.legacy = opt.legacy()
+
+	n := 3
+	if hasStraightAlpha(img) {
+		n = 4
+	}
+	for _, l := range searchLayouts(n) {
+		if l = *l.restrict(samples.gray); seen[l.String()] {
+			continue
+		}
+		seen[l.String()] = true
+
+		c := Candidate{Layout: l.String()}
+		h, err := readHeader(newLSBReader(samples, &l), opt.passphrase())
+		if _, ok := err.(*TruncatedError); ok {
+			c.Err = err
+			found = append(found, c)
+			continue
+		} else if err != nil {
+			continue
+		}
+		if d, _ := headerDepth(h); d != nil {
+			c.Layout = d.String()
+		}
+
+		msg, stored, err := extractLayout(samples, &l, opt.passphrase())
+		switch {
+		case err == nil:
+			c.Header, c.Valid = stored, true
+			c.Payload, c.Err = stored.open(msg, opt)
+		case h.Version == 0:
+			continue
+		default:
+			c.Header, c.Err = h, err
+		}
+		found = append(found, c)
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Valid && !found[j].Valid
+	})
+	return found
+}
@@ -0,0 +1,108 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"testing"
+)
+
+// foreignImage returns cover with msg stored in l from the first pixel, header
+// and all, like another tool could store it.
+func foreignImage(t *testing.T, cover image.Image, msg []byte, l layout) image.Image {
+	t.Helper()
+	header, payload, err := container(msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, samples, err := copyCarrier(cover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newLSBWriter(samples, &l)
+	if _, err := w.Write(append(header, payload...)); err != nil {
+		t.Fatal(err)
+	}
+	return dest
+}
+
+// searchFor returns the candidate Search finds in img in l, and fails the
+// test if there is none or its payload did not match its checksum.
+func searchFor(t *testing.T, img image.Image, l layout) Candidate {
+	t.Helper()
+	for _, c := range Search(img, nil) {
+		if c.Layout == l.String() && c.Valid {
+			return c
+		}
+	}
+	t.Fatalf("found no valid candidate in %s", l.String())
+	return Candidate{}
+}
+
+func TestSearchLayouts(t *testing.T) {
+	msg := testPayload(300, 1)
+	for _, l := range []layout{
+		defaultLayout,
+		{depth: 2, channels: []int{2, 1, 0}},
+		{depth: 1, channels: []int{1}, lsbFirst: true},
+		{depth: 3, channels: []int{0, 2}, columns: true},
+		{depth: 1, channels: []int{0, 1, 2}, planes: true},
+	} {
+		c := searchFor(t, foreignImage(t, testCover(64, 64, 1), msg, l), l)
+		if c.Err != nil || !bytes.Equal(c.Payload, msg) {
+			t.Errorf("%s: got %d bytes, %v", l.String(), len(c.Payload), c.Err)
+		}
+	}
+}
+
+// TestSearchCropped searches an image cropped to its left half, with
+// bounds that do not start at the origin, and one cropped to its top rows,
+// which cuts the payload short.
+func TestSearchCropped(t *testing.T) {
+	msg := testPayload(300, 1)
+	l := layout{depth: 2, channels: []int{0, 1, 2}, columns: true}
+	img := foreignImage(t, testCover(64, 64, 1), msg, l)
+
+	left := image.NewRGBA(image.Rect(10, 20, 42, 84))
+	draw.Draw(left, left.Rect, img, image.Point{}, draw.Src)
+	if c := searchFor(t, left, l); c.Err != nil || !bytes.Equal(c.Payload, msg) {
+		t.Errorf("left half: got %d bytes, %v", len(c.Payload), c.Err)
+	}
+
+	l.columns = false
+	img = foreignImage(t, testCover(64, 64, 1), msg, l)
+	top := image.NewRGBA(image.Rect(0, 0, 64, 4))
+	draw.Draw(top, top.Rect, img, image.Point{}, draw.Src)
+	for _, c := range Search(top, nil) {
+		if c.Layout == l.String() {
+			if _, ok := c.Err.(*TruncatedError); c.Valid || !ok {
+				t.Errorf("top rows: got %v, want a TruncatedError", c.Err)
+			}
+			return
+		}
+	}
+	t.Errorf("top rows: found nothing in %s", l.String())
+}
+
+func TestSearchClean(t *testing.T) {
+	for _, seed := range []int64{1, 2, 3} {
+		if found := Search(testCover(64, 64, seed), nil); len(found) != 0 {
+			t.Errorf("cover %d: found %d candidates, first in %s", seed, len(found), found[0].Layout)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// MaxShards is the largest number of images EncodeShards stores a payload
+// across.
+const MaxShards = 0xFFFF
+
+// ErrShardSet is returned by DecodeShards for images that do not hold the
+// shards of one payload.
+var ErrShardSet = errors.New("the images hold shards of different payloads")
+
+// Shard is the place of a part of a payload stored across several images by
+// EncodeShards, as stored in the FieldShard field.
+type Shard struct {
+	// Set identifies the payload, it is the same in all of its shards.
+	Set uint64
+
+	// Index is the position of the part in the payload, from 0, of Count
+	// parts.
+	Index, Count int
+}
+
+// field returns the FieldShard field holding s.
+func (s *Shard) field() Field {
+	v := make([]byte, 12)
+	binary.BigEndian.PutUint64(v, s.Set)
+	binary.BigEndian.PutUint16(v[8:], uint16(s.Index))
+	binary.BigEndian.PutUint16(v[10:], uint16(s.Count))
+	return Field{FieldShard, v}
+}
+
+// Shard returns the place of the payload in a set of shards stored in the
+// FieldShard metadata field.
+func (h *Header) Shard() (Shard, bool) {
+	v, ok := h.Field(FieldShard)
+	if !ok || len(v) != 12 {
+		return Shard{}, false
+	}
+	s := Shard{binary.BigEndian.Uint64(v), int(binary.BigEndian.Uint16(v[8:])), int(binary.BigEndian.Uint16(v[10:]))}
+	if s.Index >= s.Count {
+		return Shard{}, false
+	}
+	return s, true
+}
+
+// EncodeShards is Encode for a payload that may not fit in one image. It
+// splits payload across covers, in proportion to what each of them holds,
+// and returns the encoded images in the same order. Every part is stored as
+// a message of its own, encrypted and checksummed by opt, with its Shard in
+// the header. The set is identified by 8 bytes of Random, or of crypto/rand
+// without it. It fails with ErrMessageTooLarge if the covers do not hold
+// all of the payload together, before any Compression, which compresses
+// every part on its own.
+func EncodeShards(covers []image.Image, payload []byte, opt *Options) ([]image.Image, error) {
+	if len(covers) == 0 || len(covers) > MaxShards {
+		return nil, fmt.Errorf("a payload is stored across 1 to %d images, not %d", MaxShards, len(covers))
+	}
+	if err := opt.Validate(); err != nil {
+		return nil, err
+	}
+
+	var id [8]byte
+	random := io.Reader(rand.Reader)
+	if opt != nil && opt.Random != nil {
+		random = opt.Random
+	}
+	if _, err := io.ReadFull(random, id[:]); err != nil {
+		return nil, err
+	}
+
+	var (
+		opts  = make([]Options, len(covers))
+		caps  = make([]int, len(covers))
+		sizes = make([]int, len(covers))
+		total int
+	)
+	for i, cover := range covers {
+		if opt != nil {
+			opts[i] = *opt
+		}
+		opts[i].shard = &Shard{binary.BigEndian.Uint64(id[:]), i, len(covers)}
+		caps[i] = Capacity(cover, &opts[i])
+		total += caps[i]
+	}
+	if len(payload) > total {
+		return nil, ErrMessageTooLarge
+	}
+
+	// Every image gets its share of the payload, rounded down, and what
+	// is left goes to the first ones that have room for another byte.
+	left := len(payload)
+	for i, n := range caps {
+		sizes[i] = int(int64(len(payload)) * int64(n) / int64(total))
+		left -= sizes[i]
+	}
+	for i := range sizes {
+		if left > 0 && sizes[i] < caps[i] {
+			sizes[i]++
+			left--
+		}
+	}
+
+	imgs := make([]image.Image, len(covers))
+	for i, cover := range covers {
+		var err error
+		if imgs[i], err = Encode(cover, payload[:sizes[i]], &opts[i]); err != nil {
+			return nil, fmt.Errorf("shard %d: %w", i+1, err)
+		}
+		payload = payload[sizes[i]:]
+	}
+	return imgs, nil
+}
+
+// DecodeShards is Decode for the images EncodeShards returned, in any order,
+// and returns the payload put back together. It fails with ErrShardSet for
+// images of different payloads, and if a shard is missing or given twice.
+func DecodeShards(imgs []image.Image, opt *Options) ([]byte, error) {
+	var (
+		parts [][]byte
+		set   Shard
+	)
+	for i, img := range imgs {
+		part, h, err := decode(img, opt)
+		if err != nil {
+			return nil, fmt.Errorf("image %d: %w", i+1, err)
+		}
+		s, ok := h.Shard()
+		if !ok {
+			return nil, fmt.Errorf("image %d does not hold a shard", i+1)
+		}
+
+		if parts == nil {
+			set, parts = s, make([][]byte, s.Count)
+		} else if s.Set != set.Set || s.Count != set.Count {
+			return nil, ErrShardSet
+		}
+		if parts[s.Index] != nil {
+			return nil, fmt.Errorf("image %d holds shard %d of %d again", i+1, s.Index+1, s.Count)
+		}
+		parts[s.Index] = append([]byte{}, part...)
+	}
+
+	var payload []byte
+	for i, part := range parts {
+		if part == nil {
+			return nil, fmt.Errorf("shard %d of %d is missing", i+1, len(parts))
+		}
+		payload = append(payload, part...)
+	}
+	return payload, nil
+}
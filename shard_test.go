@@ -0,0 +1,100 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"image"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// testShards stores payload across three covers of different sizes, the
+// set identified by seed.
+func testShards(t *testing.T, payload []byte, seed int64) []image.Image {
+	t.Helper()
+	covers := []image.Image{testCover(48, 48, 1), testCover(32, 64, 2), testCover(64, 32, 3)}
+	imgs, err := EncodeShards(covers, payload, &Options{Random: rand.New(rand.NewSource(seed))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return imgs
+}
+
+func TestShardsRoundTrip(t *testing.T) {
+	payload := testPayload(2000, 1)
+	imgs := testShards(t, payload, 1)
+	if n := Capacity(imgs[0], nil); n >= len(payload) {
+		t.Fatalf("a shard holds %d bytes, the test needs a payload that does not fit in one", n)
+	}
+
+	for name, order := range map[string][]int{
+		"in order": {0, 1, 2},
+		"reversed": {2, 1, 0},
+		"shuffled": {1, 2, 0},
+	} {
+		shuffled := make([]image.Image, len(order))
+		for i, j := range order {
+			shuffled[i] = imgs[j]
+		}
+		got, err := DecodeShards(shuffled, nil)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !bytes.Equal(got, payload) {
+			t.Errorf("%s: decoded %d bytes that are not the payload", name, len(got))
+		}
+	}
+
+	for i, img := range imgs {
+		if _, err := Decode(img, nil); err != nil {
+			t.Errorf("shard %d does not decode on its own: %v", i, err)
+		}
+	}
+}
+
+func TestShardsIncomplete(t *testing.T) {
+	imgs := testShards(t, testPayload(2000, 1), 1)
+	for _, c := range []struct {
+		name string
+		imgs []image.Image
+		want string
+	}{
+		{"missing", []image.Image{imgs[0], imgs[2]}, "shard 2 of 3 is missing"},
+		{"twice", []image.Image{imgs[0], imgs[1], imgs[1], imgs[2]}, "image 3 holds shard 2 of 3 again"},
+	} {
+		if _, err := DecodeShards(c.imgs, nil); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want %q", c.name, err, c.want)
+		}
+	}
+}
+
+// TestShardsMixed decodes shards of two payloads stored in the same covers,
+// which only differ in their set.
+func TestShardsMixed(t *testing.T) {
+	a := testShards(t, testPayload(2000, 1), 1)
+	b := testShards(t, testPayload(2000, 2), 2)
+	if _, err := DecodeShards([]image.Image{a[0], b[1], a[2]}, nil); err != ErrShardSet {
+		t.Errorf("got %v, want ErrShardSet", err)
+	}
+}
+
+func TestShardsTooLarge(t *testing.T) {
+	covers := []image.Image{testCover(16, 16, 1), testCover(16, 16, 2)}
+	if _, err := EncodeShards(covers, testPayload(1000, 1), nil); err != ErrMessageTooLarge {
+		t.Errorf("got %v, want ErrMessageTooLarge", err)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"hash"
+)
+
+var (
+	ErrBadSignature = errors.New("the signature does not match, the message was modified or signed with another key")
+	ErrNotSigned    = errors.New("the message is not signed")
+)
+
+// A signed message carries a FieldSignature with an Ed25519 signature of a
+// SHA-256 hash of the same flags, metadata and stored payload as the MAC,
+// see macField, so anyone with the public key can tell who encoded the
+// message and that it was not modified, without the passphrase. It is not
+// over FieldMAC, which does not cover it either.
+func signatureField() Field {
+	return Field{FieldSignature, make([]byte, ed25519.SignatureSize)}
+}
+
+// newSignedHash returns the hash of h that is signed, ready for the
+// payload.
+func (h *Header) newSignedHash() hash.Hash {
+	s := sha256.New()
+	s.Write([]byte("hidden/signature"))
+	s.Write([]byte{h.Flags &^ FlagLength64})
+	for _, f := range h.Metadata {
+		switch f.Type {
+		case FieldMAC, FieldSeal, FieldSignature:
+		default:
+			s.Write((&Header{Metadata: []Field{f}}).metadata())
+		}
+	}
+	return s
+}
+
+// sign fills in the FieldSignature of h for payload.
+func (h *Header) sign(key ed25519.PrivateKey, payload []byte) {
+	s := h.newSignedHash()
+	s.Write(payload)
+	h.putSignature(ed25519.Sign(key, s.Sum(nil)))
+}
+
+// putSignature stores sig in the FieldSignature of h.
+func (h *Header) putSignature(sig []byte) {
+	for i := range h.Metadata {
+		if h.Metadata[i].Type == FieldSignature {
+			h.Metadata[i].Value = sig
+		}
+	}
+}
+
+// checkSignature returns ErrBadSignature if payload was not signed in h by
+// the private key of key, and ErrNotSigned if h has no signature. Without
+// a key there is nothing to check.
+func (h *Header) checkSignature(key ed25519.PublicKey, payload []byte) error {
+	if key == nil {
+		return nil
+	}
+	v, ok := h.Field(FieldSignature)
+	if !ok {
+		return ErrNotSigned
+	}
+	s := h.newSignedHash()
+	s.Write(payload)
+	if len(v) != ed25519.SignatureSize || !ed25519.Verify(key, s.Sum(nil), v) {
+		return ErrBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"image"
+	"testing"
+	"time"
+)
+
+func testSigningKey(seed byte) ed25519.PrivateKey {
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+}
+
+// tamperPayload moves the message in img to a new cover with the last byte
+// of its stored payload flipped, and the checksum computed again.
+func tamperPayload(t *testing.T, img image.Image) image.Image {
+	t.Helper()
+	c, err := ExtractContainer(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Payload[len(c.Payload)-1] ^= 1
+	c.Header.Checksum = c.Header.sum(c.Payload)
+	stego, err := EncodeContainer(testCover(64, 64, 2), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stego
+}
+
+func TestSignature(t *testing.T) {
+	key, other := testSigningKey(1), testSigningKey(2)
+	public := key.Public().(ed25519.PublicKey)
+	msg := []byte("signed message")
+
+	for name, opt := range map[string]*Options{
+		"plain":      {SigningKey: key, Expires: time.Now().Add(time.Hour)},
+		"encrypted":  {SigningKey: key, Expires: time.Now().Add(time.Hour), Passphrase: []byte("pass")},
+		"compressed": {SigningKey: key, Expires: time.Now().Add(time.Hour), Compression: Deflate},
+	} {
+		stego, err := Encode(testCover(64, 64, 1), msg, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec := func(key ed25519.PublicKey) *Options {
+			return &Options{VerifyKey: key, Passphrase: opt.Passphrase}
+		}
+
+		if got, err := Decode(stego, dec(public)); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+		if got, err := Decode(stego, dec(nil)); err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("%s without a key: got %q, %v", name, got, err)
+		}
+		if _, err := Decode(stego, dec(other.Public().(ed25519.PublicKey))); err != ErrBadSignature {
+			t.Errorf("%s with another key: got %v, want ErrBadSignature", name, err)
+		}
+		if _, err := Decode(tamperPayload(t, stego), dec(public)); err != ErrBadSignature {
+			t.Errorf("%s, payload tampered with: got %v, want ErrBadSignature", name, err)
+		}
+		if _, err := Decode(reencode(t, stego, extendExpiry), dec(public)); err != ErrBadSignature {
+			t.Errorf("%s, expiry extended: got %v, want ErrBadSignature", name, err)
+		}
+	}
+
+	unsigned, err := Encode(testCover(64, 64, 1), msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decode(unsigned, &Options{VerifyKey: public}); err != ErrNotSigned {
+		t.Errorf("unsigned: got %v, want ErrNotSigned", err)
+	}
+}
@@ -0,0 +1,284 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+	"unicode/utf8"
+)
+
+// MaxSlotLabel is the size in bytes of the longest label of a slot.
+const MaxSlotLabel = 64
+
+// slotTableVersion starts the payload of a slot table.
+const slotTableVersion = 1
+
+var (
+	// ErrNoSlots is returned for an image whose message is not a table of
+	// named slots.
+	ErrNoSlots = errors.New("image does not hold named slots")
+
+	// ErrNoSlot is returned by DecodeSlot for a label that is not in the
+	// table.
+	ErrNoSlot = errors.New("image holds no slot with that label")
+
+	// ErrSlotted is returned by Decode for an image that holds named
+	// slots, which DecodeSlot extracts one at a time.
+	ErrSlotted = errors.New("image holds named slots, decode one of them by its label")
+
+	// ErrSlotsUnsupported is returned by EncodeSlot for options a slot can
+	// not be stored with.
+	ErrSlotsUnsupported = errors.New("a slot needs the default placement and depth, and can not be stored in copies, chunked, sealed, matched, with the histogram preserved or with a hidden payload")
+)
+
+// SlotInfo is an entry of the table of the named slots of an image, see
+// EncodeSlot.
+type SlotInfo struct {
+	Label string
+
+	// Offset and Length are the carrier bytes of the slot, its header and
+	// its payload as they are stored.
+	Offset, Length int
+}
+
+// EncodeSlot returns a copy of cover with payload hidden in the slot named
+// label, next to the other slots of cover, which keep their place and
+// bits. A slot with the same label is replaced. Every slot is a message of
+// its own, checksummed, compressed and encrypted by the opt it was stored
+// with, so it can have a passphrase of its own. The table of the slots is
+// stored like a message at the start of the image and the slots are
+// allocated from its end, so the table grows without moving them. The
+// table is not encrypted, anyone who finds it can read the labels and
+// sizes. A message in cover that is not a slot table is replaced. It fails
+// with ErrMessageTooLarge if there is no room for the slot between the
+// others and the table.
+func EncodeSlot(cover image.Image, label string, payload []byte, opt *Options) (image.Image, error) {
+	if err := checkSlotLabel(label); err != nil {
+		return nil, err
+	}
+	if err := checkSlotOptions(opt); err != nil {
+		return nil, err
+	}
+
+	dest, samples, err := copyCarrier(cover)
+	if err != nil {
+		return nil, err
+	}
+	slots, err := readSlotTable(samples)
+	if err != nil {
+		slots = nil
+	}
+
+	data, stored, err := container(payload, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	// A replaced slot keeps its place in the table, not in the carrier.
+	var (
+		others []SlotInfo
+		table  = slots
+		i      = len(slots)
+	)
+	for j, s := range slots {
+		if s.Label == label {
+			i = j
+		} else {
+			others = append(others, s)
+		}
+	}
+	if i == len(slots) {
+		table = append(table, SlotInfo{Label: label})
+	}
+	table[i].Length = len(data) + len(stored)
+
+	// The offsets do not change the size of the table.
+	theader, tpayload, err := slotTableContainer(table)
+	if err != nil {
+		return nil, err
+	}
+	if table[i].Offset, err = allocateSlot(others, len(theader)+len(tpayload), carrierBytes(samples), table[i].Length); err != nil {
+		return nil, err
+	}
+	if theader, tpayload, err = slotTableContainer(table); err != nil {
+		return nil, err
+	}
+
+	w := newLSBWriter(samples, &defaultLayout)
+	w.used = table[i].Offset * 8
+	w.place(Sequential{})
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(stored); err != nil {
+		return nil, err
+	}
+	if err := embed(samples, theader, tpayload, nil, nil, nil); err != nil {
+		return nil, err
+	}
+	return dest, nil
+}
+
+// ListSlots returns the table of the named slots in img, in the order they
+// were first stored. It fails with ErrNoSlots if the message in img is not
+// a slot table.
+func ListSlots(img image.Image) ([]SlotInfo, error) {
+	return readSlotTable(carrierOf(img))
+}
+
+// DecodeSlot is Decode for the slot named label in img, see EncodeSlot. It
+// fails with ErrNoSlot if there is none.
+func DecodeSlot(img image.Image, label string, opt *Options) ([]byte, error) {
+	samples := carrierOf(img)
+	slots, err := readSlotTable(samples)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range slots {
+		if s.Label != label {
+			continue
+		}
+
+		r := newLSBReader(samples, &defaultLayout)
+		r.used = s.Offset * 8
+		r.place(Sequential{})
+		msg, h, err := readStored(r, opt.passphrase())
+		if err != nil {
+			return nil, err
+		}
+		if h.Len()+h.Length > s.Length {
+			return nil, fmt.Errorf("slot %q holds more than the %d bytes of its table entry", label, s.Length)
+		}
+		if h.Flags&FlagResync != 0 {
+			if msg, err = unframe(msg); err != nil {
+				return nil, err
+			}
+		}
+		return h.open(msg, opt)
+	}
+	return nil, ErrNoSlot
+}
+
+// checkSlotLabel returns an error if label can not name a slot.
+func checkSlotLabel(label string) error {
+	switch {
+	case label == "":
+		return errors.New("slot label is empty")
+	case len(label) > MaxSlotLabel:
+		return fmt.Errorf("slot label is %d bytes, at most %d fit", len(label), MaxSlotLabel)
+	case !utf8.ValidString(label):
+		return errors.New("slot label is not valid UTF-8")
+	}
+	return nil
+}
+
+// checkSlotOptions returns an error if a slot can not be stored with opt.
+// A slot is written sequentially from its offset, in one bit of every
+// channel.
+func checkSlotOptions(opt *Options) error {
+	if err := opt.Validate(); err != nil {
+		return err
+	}
+	if opt == nil {
+		return nil
+	}
+	if _, sequential := opt.Placement.(Sequential); opt.Placement != nil && !sequential {
+		return ErrSlotsUnsupported
+	}
+	if opt.Depth != (ChannelDepth{}) || opt.copies() > 1 || opt.ChunkSize > 0 || opt.Seal || opt.Matching || opt.PreserveHistogram || opt.Fill || opt.Hidden != nil {
+		return ErrSlotsUnsupported
+	}
+	return nil
+}
+
+// carrierBytes returns the number of bytes img holds in the default layout.
+func carrierBytes(img *carrierImage) int {
+	return defaultLayout.restrict(img.gray).slots(img.Rect, 0).Len() / 8
+}
+
+// allocateSlot returns the offset of n carrier bytes between the end of a
+// table of tableLen bytes and the end of the carrier at total bytes, as
+// close to the end as there is room around slots.
+func allocateSlot(slots []SlotInfo, tableLen, total, n int) (int, error) {
+	sorted := append([]SlotInfo(nil), slots...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset > sorted[j].Offset })
+
+	top := total
+	for _, s := range sorted {
+		if top-(s.Offset+s.Length) >= n {
+			return top - n, nil
+		}
+		if s.Offset < top {
+			top = s.Offset
+		}
+	}
+	if top-tableLen >= n {
+		return top - n, nil
+	}
+	return 0, ErrMessageTooLarge
+}
+
+// slotTableContainer returns the header and payload of the message that
+// holds the table of slots.
+func slotTableContainer(slots []SlotInfo) ([]byte, []byte, error) {
+	table := []byte{slotTableVersion}
+	for _, s := range slots {
+		table = append(table, byte(len(s.Label)))
+		table = append(table, s.Label...)
+		table = binary.BigEndian.AppendUint32(table, uint32(s.Offset))
+		table = binary.BigEndian.AppendUint32(table, uint32(s.Length))
+	}
+	return container(table, &Options{slotTable: true})
+}
+
+// readSlotTable returns the table of slots in img.
+func readSlotTable(img *carrierImage) ([]SlotInfo, error) {
+	msg, h, err := extractLayout(img, &defaultLayout, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := h.Field(FieldSlots); !ok {
+		return nil, ErrNoSlots
+	}
+
+	malformed := errors.New("slot table is malformed")
+	if len(msg) == 0 || msg[0] != slotTableVersion {
+		return nil, malformed
+	}
+	var (
+		slots  []SlotInfo
+		labels = make(map[string]bool)
+		total  = carrierBytes(img)
+	)
+	for p := msg[1:]; len(p) > 0; {
+		n := int(p[0])
+		if len(p) < 1+n+8 {
+			return nil, malformed
+		}
+		s := SlotInfo{string(p[1 : 1+n]), int(binary.BigEndian.Uint32(p[1+n:])), int(binary.BigEndian.Uint32(p[5+n:]))}
+		if checkSlotLabel(s.Label) != nil || labels[s.Label] || s.Length == 0 || int64(s.Offset)+int64(s.Length) > int64(total) {
+			return nil, malformed
+		}
+		labels[s.Label] = true
+		slots = append(slots, s)
+		p = p[1+n+8:]
+	}
+	return slots, nil
+}
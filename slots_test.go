@@ -0,0 +1,149 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+// encodeSlots stores every payload of slots in its slot of cover, in order.
+func encodeSlots(t *testing.T, cover image.Image, slots []struct {
+	label   string
+	payload []byte
+	opt     *Options
+}) image.Image {
+	t.Helper()
+	img := cover
+	for _, s := range slots {
+		var err error
+		if img, err = EncodeSlot(img, s.label, s.payload, s.opt); err != nil {
+			t.Fatalf("%s: %v", s.label, err)
+		}
+	}
+	return img
+}
+
+func TestSlotsRoundTrip(t *testing.T) {
+	slots := []struct {
+		label   string
+		payload []byte
+		opt     *Options
+	}{
+		{"public", []byte("nothing to see here"), nil},
+		{"alice", []byte("for alice only"), &Options{Passphrase: []byte("alice")}},
+		{"bob", bytes.Repeat([]byte("for bob only. "), 20), &Options{Passphrase: []byte("bob"), Compression: Deflate}},
+	}
+	img := encodeSlots(t, testCover(64, 64, 1), slots)
+
+	for _, s := range slots {
+		got, err := DecodeSlot(img, s.label, s.opt)
+		if err != nil {
+			t.Errorf("%s: %v", s.label, err)
+		} else if !bytes.Equal(got, s.payload) {
+			t.Errorf("%s: got %q, want %q", s.label, got, s.payload)
+		}
+	}
+	if _, err := DecodeSlot(img, "alice", &Options{Passphrase: []byte("bob")}); err != ErrDecryptionFailed {
+		t.Errorf("alice with the passphrase of bob: got %v, want ErrDecryptionFailed", err)
+	}
+	if _, err := DecodeSlot(img, "carol", nil); err != ErrNoSlot {
+		t.Errorf("missing slot: got %v, want ErrNoSlot", err)
+	}
+	if _, err := Decode(img, nil); err != ErrSlotted {
+		t.Errorf("Decode: got %v, want ErrSlotted", err)
+	}
+
+	list, err := ListSlots(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != len(slots) {
+		t.Fatalf("listed %d slots, want %d", len(list), len(slots))
+	}
+	for i, s := range list {
+		if s.Label != slots[i].label {
+			t.Errorf("slot %d is %q, want %q", i, s.Label, slots[i].label)
+		}
+	}
+}
+
+// TestSlotsOverwrite replaces a slot, which keeps its place in the table
+// and leaves the other slots as they were.
+func TestSlotsOverwrite(t *testing.T) {
+	img := encodeSlots(t, testCover(64, 64, 1), []struct {
+		label   string
+		payload []byte
+		opt     *Options
+	}{
+		{"first", []byte("the first message"), nil},
+		{"second", []byte("the second message"), nil},
+		{"first", []byte("a longer message that replaces the first"), nil},
+	})
+
+	list, err := ListSlots(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Label != "first" || list[1].Label != "second" {
+		t.Fatalf("got slots %v, want first and second", list)
+	}
+	for label, want := range map[string]string{
+		"first":  "a longer message that replaces the first",
+		"second": "the second message",
+	} {
+		got, err := DecodeSlot(img, label, nil)
+		if err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v, want %q", label, got, err, want)
+		}
+	}
+}
+
+func TestSlotsPlainMessage(t *testing.T) {
+	img, err := Encode(testCover(64, 64, 1), []byte("message"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListSlots(img); err != ErrNoSlots {
+		t.Errorf("ListSlots: got %v, want ErrNoSlots", err)
+	}
+	if _, err := DecodeSlot(img, "first", nil); err != ErrNoSlots {
+		t.Errorf("DecodeSlot: got %v, want ErrNoSlots", err)
+	}
+
+	// Storing a slot replaces the message.
+	if img, err = EncodeSlot(img, "first", []byte("slot"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := DecodeSlot(img, "first", nil); err != nil || string(got) != "slot" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestSlotsFull(t *testing.T) {
+	cover := testCover(32, 32, 1)
+	img, err := EncodeSlot(cover, "first", make([]byte, 200), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EncodeSlot(img, "second", make([]byte, 200), nil); err != ErrMessageTooLarge {
+		t.Errorf("got %v, want ErrMessageTooLarge", err)
+	}
+	if _, err := EncodeSlot(cover, "first", nil, &Options{Placement: Strided{Stride: 3}}); err != ErrSlotsUnsupported {
+		t.Errorf("strided: got %v, want ErrSlotsUnsupported", err)
+	}
+}
@@ -0,0 +1,718 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"golang.org/x/image/tiff"
+)
+
+// EncodeTIFF and DecodeTIFF store a message in the pixels of a TIFF with any
+// number of pages. A message goes either in one page, where it is the same
+// container Encode writes, or with SpanPages across all of them, used as one
+// carrier in page order. A spanning message records the carrier size of
+// every page in a FieldSpan field, so a document whose pages were removed or
+// replaced is reported as such rather than as a damaged message.
+//
+// The TIFF is written back with every page and tag it had. A page that
+// carries message bits gets a new, uncompressed RGB directory appended to
+// the file, which replaces the old one in the chain of pages and refers to
+// the same tags except those describing the pixels; the old pixel data is
+// left in place but unused. Pages that carry nothing are not touched.
+
+// SpanPages is the page of the TIFF functions that stores a message across
+// all the pages of a TIFF.
+const SpanPages = -1
+
+// MaxTIFFPages is the largest number of pages the TIFF functions accept.
+const MaxTIFFPages = 4096
+
+// ErrTIFFPlacement is returned for options with a Placement other than
+// Sequential when spanning pages, they only apply to a single image.
+var ErrTIFFPlacement = errors.New("placements are not supported across TIFF pages")
+
+// Tags of the directory of a page that describe its pixels, and are
+// replaced when the page is rewritten.
+var tiffPixelTags = map[uint16]bool{
+	256: true, // ImageWidth
+	257: true, // ImageLength
+	258: true, // BitsPerSample
+	259: true, // Compression
+	262: true, // PhotometricInterpretation
+	266: true, // FillOrder
+	273: true, // StripOffsets
+	277: true, // SamplesPerPixel
+	278: true, // RowsPerStrip
+	279: true, // StripByteCounts
+	284: true, // PlanarConfiguration
+	292: true, // T4Options
+	293: true, // T6Options
+	317: true, // Predictor
+	320: true, // ColorMap
+	322: true, // TileWidth
+	323: true, // TileLength
+	324: true, // TileOffsets
+	325: true, // TileByteCounts
+	338: true, // ExtraSamples
+	339: true, // SampleFormat
+	347: true, // JPEGTables
+	530: true, // YCbCrSubSampling
+	531: true, // YCbCrPositioning
+	532: true, // YCbCrCoefficients
+}
+
+const (
+	tiffPhotometric = 262
+	tiffICCProfile  = 34675
+	tiffRGB         = 2
+)
+
+// tiffFile is a classic TIFF split into the directories of its pages.
+type tiffFile struct {
+	data  []byte
+	order binary.ByteOrder
+
+	// ifds holds the offset of the directory of every page.
+	ifds []uint32
+}
+
+// readTIFF reads the TIFF from r and finds its pages, returning what is
+// wrong with it as a *MalformedImageError.
+func readTIFF(r io.Reader) (*tiffFile, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tiffFile{data: data}
+	if err := t.parse(); err != nil {
+		return nil, &MalformedImageError{"tiff", err}
+	}
+	return t, nil
+}
+
+func (t *tiffFile) parse() error {
+	if len(t.data) < 8 {
+		return io.ErrUnexpectedEOF
+	}
+	switch string(t.data[:4]) {
+	case "II*\x00":
+		t.order = binary.LittleEndian
+	case "MM\x00*":
+		t.order = binary.BigEndian
+	case "II+\x00", "MM\x00+":
+		return errors.New("BigTIFF is not supported")
+	default:
+		return errors.New("not a TIFF")
+	}
+
+	seen := make(map[uint32]bool)
+	for next := t.order.Uint32(t.data[4:]); next != 0; {
+		if seen[next] {
+			return errors.New("the pages form a loop")
+		}
+		if len(t.ifds) == MaxTIFFPages {
+			return fmt.Errorf("more than %d pages", MaxTIFFPages)
+		}
+		seen[next] = true
+		t.ifds = append(t.ifds, next)
+
+		entries, err := t.entries(len(t.ifds) - 1)
+		if err != nil {
+			return err
+		}
+		next = t.order.Uint32(t.data[t.nextPointer(len(t.ifds)-1, len(entries)):])
+	}
+	if len(t.ifds) == 0 {
+		return errors.New("no pages")
+	}
+	return nil
+}
+
+// entries returns the 12 byte entries of the directory of page i.
+func (t *tiffFile) entries(i int) ([][]byte, error) {
+	off := int64(t.ifds[i])
+	if off+2 > int64(len(t.data)) {
+		return nil, fmt.Errorf("directory of page %d is outside the file", i+1)
+	}
+	n := int(t.order.Uint16(t.data[off:]))
+	if off+2+int64(n)*12+4 > int64(len(t.data)) {
+		return nil, fmt.Errorf("directory of page %d is truncated", i+1)
+	}
+
+	entries := make([][]byte, n)
+	for j := range entries {
+		entries[j] = t.data[off+2+int64(j)*12:][:12]
+	}
+	return entries, nil
+}
+
+// nextPointer returns the offset of the pointer to the page after page i,
+// which has n directory entries.
+func (t *tiffFile) nextPointer(i, n int) int {
+	return int(t.ifds[i]) + 2 + n*12
+}
+
+// config returns the dimensions of page i.
+func (t *tiffFile) config(i int) (image.Config, error) {
+	cfg, err := tiff.DecodeConfig(t.pageReader(i))
+	if err != nil {
+		return cfg, &MalformedImageError{"tiff", fmt.Errorf("page %d: %v", i+1, err)}
+	}
+	if err := checkDimensions(cfg.Width, cfg.Height); err != nil {
+		return cfg, malformed("tiff", fmt.Errorf("page %d: %w", i+1, err))
+	}
+	return cfg, nil
+}
+
+// page decodes page i, as an image Encode accepts.
+func (t *tiffFile) page(i int) (img image.Image, err error) {
+	if _, err := t.config(i); err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			img, err = nil, &MalformedImageError{"tiff", fmt.Errorf("page %d: decoder panic: %v", i+1, r)}
+		}
+	}()
+	if img, err = tiff.Decode(t.pageReader(i)); err != nil {
+		return nil, &MalformedImageError{"tiff", fmt.Errorf("page %d: %v", i+1, err)}
+	}
+
+	switch img.(type) {
+	case *image.RGBA, *image.RGBA64, *image.NRGBA64:
+		return img, nil
+	}
+	return toRGBA(img), nil
+}
+
+// pageReader returns the file as a reader that starts at page i, which is
+// all a decoder that only reads the first page needs.
+func (t *tiffFile) pageReader(i int) *io.SectionReader {
+	r := &firstPageReader{data: t.data}
+	copy(r.head[:], t.data)
+	t.order.PutUint32(r.head[4:], t.ifds[i])
+	return io.NewSectionReader(r, 0, int64(len(t.data)))
+}
+
+// firstPageReader reads data with its first eight bytes replaced by head.
+type firstPageReader struct {
+	data []byte
+	head [8]byte
+}
+
+func (r *firstPageReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[off:])
+	if off < int64(len(r.head)) {
+		copy(p, r.head[off:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// write writes the file to w with the pages in pages, by index, replacing
+// the pixels of the pages they are for.
+func (t *tiffFile) write(w io.Writer, pages map[int]image.Image) error {
+	var (
+		out     = append([]byte(nil), t.data...)
+		pointer = 4
+	)
+	for i := range t.ifds {
+		entries, err := t.entries(i)
+		if err != nil {
+			return err
+		}
+		next := t.nextPointer(i, len(entries))
+
+		img, ok := pages[i]
+		if !ok {
+			pointer = next
+			continue
+		}
+
+		var ifd int
+		out, ifd, next = t.appendPage(out, entries, img, t.order.Uint32(t.data[next:]))
+		t.order.PutUint32(out[pointer:], uint32(ifd))
+		pointer = next
+	}
+	if int64(len(out)) > 1<<32-1 {
+		return errors.New("the TIFF would be larger than 4 GiB")
+	}
+	_, err := w.Write(out)
+	return err
+}
+
+// TIFF field types.
+const (
+	tiffShort = 3
+	tiffLong  = 4
+)
+
+// appendPage appends the pixels of img to out, followed by a directory with
+// the entries of old that do not describe pixels and a pointer to the page
+// at next. It returns the offsets of the directory and of that pointer.
+func (t *tiffFile) appendPage(out []byte, old [][]byte, img image.Image, next uint32) ([]byte, int, int) {
+	pix, samples, bits, extra := t.pixels(img)
+	b := img.Bounds()
+
+	out = alignWord(out)
+	strip := len(out)
+	out = append(out, pix...)
+	out = alignWord(out)
+	bitsPerSample := len(out)
+	for j := 0; j < samples; j++ {
+		out = t.appendUint16(out, uint16(bits))
+	}
+	out = alignWord(out)
+
+	rgb := t.photometric(old) == tiffRGB
+	var entries [][]byte
+	for _, e := range old {
+		if tag := t.order.Uint16(e); !tiffPixelTags[tag] && (rgb || tag != tiffICCProfile) {
+			entries = append(entries, e)
+		}
+	}
+	entries = append(entries,
+		t.entry(256, tiffLong, 1, uint32(b.Dx())),
+		t.entry(257, tiffLong, 1, uint32(b.Dy())),
+		t.entry(258, tiffShort, samples, uint32(bitsPerSample)),
+		t.entry(259, tiffShort, 1, 1),
+		t.entry(tiffPhotometric, tiffShort, 1, tiffRGB),
+		t.entry(273, tiffLong, 1, uint32(strip)),
+		t.entry(277, tiffShort, 1, uint32(samples)),
+		t.entry(278, tiffLong, 1, uint32(b.Dy())),
+		t.entry(279, tiffLong, 1, uint32(len(pix))),
+		t.entry(284, tiffShort, 1, 1),
+	)
+	if extra != 0 {
+		entries = append(entries, t.entry(338, tiffShort, 1, extra))
+	}
+	sort.Slice(entries, func(i, j int) bool { return t.order.Uint16(entries[i]) < t.order.Uint16(entries[j]) })
+
+	ifd := len(out)
+	out = t.appendUint16(out, uint16(len(entries)))
+	for _, e := range entries {
+		out = append(out, e...)
+	}
+	out = t.appendUint32(out, next)
+	return out, ifd, ifd + 2 + len(entries)*12
+}
+
+// pixels returns the samples of img as uncompressed chunky RGB, or RGBA
+// unless it is opaque, with the number of samples per pixel, their bits and
+// the ExtraSamples value for the alpha, or 0 without one.
+func (t *tiffFile) pixels(img image.Image) (pix []byte, samples, bits int, extra uint32) {
+	m, b := carrierOf(img), img.Bounds()
+	samples, bits = 4, 8
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		samples = 3
+	} else if _, ok := img.(*image.NRGBA64); ok {
+		extra = 2
+	} else {
+		extra = 1
+	}
+
+	size := 1
+	if m.wide {
+		size, bits = 2, 16
+	}
+	pix = make([]byte, 0, b.Dx()*b.Dy()*samples*size)
+	for y := 0; y < b.Dy(); y++ {
+		row := m.Pix[y*m.Stride:]
+		for x := 0; x < b.Dx(); x++ {
+			p := row[x*4*size:][:samples*size]
+			if !m.wide {
+				pix = append(pix, p...)
+				continue
+			}
+			for c := 0; c < samples; c++ {
+				pix = t.appendUint16(pix, uint16(p[c*2])<<8|uint16(p[c*2+1]))
+			}
+		}
+	}
+	return pix, samples, bits, extra
+}
+
+// photometric returns the PhotometricInterpretation in the directory
+// entries, or 0 without one.
+func (t *tiffFile) photometric(entries [][]byte) uint16 {
+	for _, e := range entries {
+		if t.order.Uint16(e) == tiffPhotometric && t.order.Uint16(e[2:]) == tiffShort {
+			return t.order.Uint16(e[8:])
+		}
+	}
+	return 0
+}
+
+// entry returns a directory entry. A single SHORT is stored in the entry,
+// anything else is value as 32 bits, which is the offset of the values if
+// they do not fit in four bytes.
+func (t *tiffFile) entry(tag, typ uint16, count int, value uint32) []byte {
+	e := make([]byte, 12)
+	t.order.PutUint16(e, tag)
+	t.order.PutUint16(e[2:], typ)
+	t.order.PutUint32(e[4:], uint32(count))
+	if typ == tiffShort && count == 1 {
+		t.order.PutUint16(e[8:], uint16(value))
+	} else {
+		t.order.PutUint32(e[8:], value)
+	}
+	return e
+}
+
+func (t *tiffFile) appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	t.order.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func (t *tiffFile) appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	t.order.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// alignWord pads b to an even length, where TIFF offsets have to start.
+func alignWord(b []byte) []byte {
+	if len(b)%2 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// span returns the FieldSpan field for the pages of t, and the number of
+// carrier bits of every page.
+func (t *tiffFile) span() (Field, []int, error) {
+	var (
+		v     = make([]byte, 4*len(t.ifds))
+		sizes = make([]int, len(t.ifds))
+	)
+	for i := range t.ifds {
+		cfg, err := t.config(i)
+		if err != nil {
+			return Field{}, nil, err
+		}
+		sizes[i] = cfg.Width * cfg.Height * 3
+		binary.BigEndian.PutUint32(v[i*4:], uint32(sizes[i]))
+	}
+	return Field{FieldSpan, v}, sizes, nil
+}
+
+// checkSpan returns an error if the pages a spanning message with header h
+// was stored in do not have the carrier sizes of the document, in sizes.
+func checkSpan(h *Header, sizes []int) error {
+	v, ok := h.Field(FieldSpan)
+	if !ok {
+		return nil
+	}
+	if len(v)%4 != 0 {
+		return errors.New("malformed page span field")
+	}
+
+	need := (h.Len() + h.Length) * 8
+	for i := 0; need > 0 && i < len(v)/4; i++ {
+		n := int(binary.BigEndian.Uint32(v[i*4:]))
+		if i >= len(sizes) {
+			return fmt.Errorf("the message spans more pages than the %d of the document", len(sizes))
+		} else if sizes[i] != n {
+			return fmt.Errorf("page %d is not the one the message was stored in, it has a different size", i+1)
+		}
+		need -= n
+	}
+	return nil
+}
+
+// spanOptions returns opt with field added to its metadata.
+func spanOptions(opt *Options, field Field) *Options {
+	var o Options
+	if opt != nil {
+		o = *opt
+	}
+	o.Metadata = append(o.Metadata[:len(o.Metadata):len(o.Metadata)], field)
+	return &o
+}
+
+// samples calls f with the low byte of every carrier sample of img, in the
+// order of the default layout, until f returns false.
+func samples(img image.Image, f func(*uint8) bool) bool {
+	m, b := carrierOf(img), img.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			for c := 0; c < m.colors(); c++ {
+				if !f(&m.Pix[m.sample(x, y, c)]) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// TIFFPages returns the number of pages of the TIFF read from r.
+func TIFFPages(r io.Reader) (int, error) {
+	t, err := readTIFF(r)
+	if err != nil {
+		return 0, err
+	}
+	return len(t.ifds), nil
+}
+
+// TIFFPage decodes page of the TIFF read from r, counting from 0, as the
+// image EncodeTIFF hides a message in.
+func TIFFPage(r io.Reader, page int) (image.Image, error) {
+	t, err := readTIFF(r)
+	if err != nil {
+		return nil, err
+	}
+	if page == SpanPages {
+		return nil, errors.New("TIFFPage decodes a single page, not SpanPages")
+	}
+	if err := t.checkPage(page); err != nil {
+		return nil, err
+	}
+	return t.page(page)
+}
+
+// checkPage returns an error unless page is SpanPages or one of the pages
+// of t, which count from 0.
+func (t *tiffFile) checkPage(page int) error {
+	if page != SpanPages && (page < 0 || page >= len(t.ifds)) {
+		return fmt.Errorf("page %d is not in the TIFF, it has %d pages", page+1, len(t.ifds))
+	}
+	return nil
+}
+
+// EncodeTIFF writes the TIFF read from r to w, with payload hidden in page,
+// counting from 0, or across all pages with SpanPages.
+func EncodeTIFF(w io.Writer, r io.Reader, page int, payload []byte, opt *Options) error {
+	if opt.seal() {
+		return ErrSealUnsupported
+	}
+	t, err := readTIFF(r)
+	if err != nil {
+		return err
+	}
+	if err := t.checkPage(page); err != nil {
+		return err
+	}
+
+	if page != SpanPages {
+		img, err := t.page(page)
+		if err != nil {
+			return err
+		}
+		if img, err = Encode(img, payload, opt); err != nil {
+			return err
+		}
+		return t.write(w, map[int]image.Image{page: img})
+	}
+
+	if opt.placement() != nil {
+		return ErrTIFFPlacement
+	}
+	if opt.lsbFirst() {
+		return ErrBitOrderUnsupported
+	}
+	if opt.layout() != nil {
+		return ErrDepthUnsupported
+	}
+	if opt.matching() {
+		return ErrMatchingUnsupported
+	}
+	if opt.preserveHistogram() {
+		return ErrHistogramUnsupported
+	}
+	if opt.fill() {
+		return ErrFillUnsupported
+	}
+	if opt.copies() > 1 {
+		return ErrCopiesUnsupported
+	}
+	field, sizes, err := t.span()
+	if err != nil {
+		return err
+	}
+	header, payload, err := container(payload, spanOptions(opt, field))
+	if err != nil {
+		return err
+	}
+
+	data := append(header, payload...)
+	bits := unpackBits(data)
+	defer Wipe(data, bits)
+
+	var total int
+	for _, n := range sizes {
+		total += n
+	}
+	if total < len(bits) {
+		return ErrMessageTooLarge
+	}
+
+	var (
+		pages = make(map[int]image.Image)
+		n     int
+	)
+	for i := 0; n < len(bits); i++ {
+		img, err := t.page(i)
+		if err != nil {
+			return err
+		}
+		samples(img, func(s *uint8) bool {
+			*s = *s&^1 | bits[n]
+			n++
+			return n < len(bits)
+		})
+		pages[i] = img
+	}
+	return t.write(w, pages)
+}
+
+// DecodeTIFF extracts the payload EncodeTIFF hid in page of the TIFF read
+// from r, and validates it like Decode.
+func DecodeTIFF(r io.Reader, page int, opt *Options) ([]byte, error) {
+	msg, h, err := extractTIFF(r, page, opt.passphrase())
+	if err != nil {
+		return nil, err
+	}
+	return h.open(msg, opt)
+}
+
+// DetectTIFF is Detect for page of the TIFF read from r, the format is
+// prefixed with "tiff/".
+func DetectTIFF(r io.Reader, page int) (int, string, error) {
+	msg, h, err := extractTIFF(r, page, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	return len(msg), "tiff/" + detectFormat(msg, h), nil
+}
+
+// DecodeHeaderTIFF is DecodeHeader for page of the TIFF read from r.
+func DecodeHeaderTIFF(r io.Reader, page int) (*Header, error) {
+	_, h, err := extractTIFF(r, page, nil)
+	return h, err
+}
+
+func extractTIFF(r io.Reader, page int, key []byte) ([]byte, *Header, error) {
+	t, err := readTIFF(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := t.checkPage(page); err != nil {
+		return nil, nil, err
+	}
+
+	if page != SpanPages {
+		img, err := t.page(page)
+		if err != nil {
+			return nil, nil, err
+		}
+		samples := carrierOf(img)
+		return extractLayout(samples, storedLayout(samples), key)
+	}
+
+	_, sizes, err := t.span()
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		data []byte
+		b    byte
+		n    uint
+	)
+	for i := range t.ifds {
+		img, err := t.page(i)
+		if err != nil {
+			return nil, nil, err
+		}
+		samples(img, func(s *uint8) bool {
+			if b, n = b<<1|*s&1, n+1; n == 8 {
+				data, b, n = append(data, b), 0, 0
+			}
+			return true
+		})
+	}
+
+	h := &Header{}
+	if err := h.read(bytes.NewReader(data)); err == nil {
+		if err := checkSpan(h, sizes); err != nil {
+			return nil, nil, err
+		}
+	}
+	return readContainer(data)
+}
+
+// CapacityTIFF returns the largest payload, in bytes, that EncodeTIFF can
+// hide in page of the TIFF read from r with the given options.
+func CapacityTIFF(r io.Reader, page int, opt *Options) (int, error) {
+	if opt.seal() {
+		return 0, ErrSealUnsupported
+	}
+	t, err := readTIFF(r)
+	if err != nil {
+		return 0, err
+	}
+	if err := t.checkPage(page); err != nil {
+		return 0, err
+	}
+
+	if page != SpanPages {
+		cfg, err := t.config(page)
+		if err != nil {
+			return 0, err
+		}
+		return Capacity(&image.RGBA{Rect: image.Rect(0, 0, cfg.Width, cfg.Height)}, opt), nil
+	}
+
+	if opt.placement() != nil {
+		return 0, ErrTIFFPlacement
+	}
+	if opt.lsbFirst() {
+		return 0, ErrBitOrderUnsupported
+	}
+	if opt.layout() != nil {
+		return 0, ErrDepthUnsupported
+	}
+	field, sizes, err := t.span()
+	if err != nil {
+		return 0, err
+	}
+	h, err := spanOptions(opt, field).header()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int
+	for _, n := range sizes {
+		total += n
+	}
+	return opt.payloadCapacity(&h, total/8-h.Len()), nil
+}
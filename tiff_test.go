@@ -0,0 +1,340 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testSoftware is the value of the Software tag of every page of testTIFF.
+const testSoftware = "hidden test\x00"
+
+// testTIFF returns a little-endian TIFF of pages, which are opaque RGBA, Gray
+// or Gray16 images, with the gray ones deflated if deflate is set.
+func testTIFF(t testing.TB, deflate bool, pages ...image.Image) []byte {
+	t.Helper()
+	tf := &tiffFile{order: binary.LittleEndian}
+	out := []byte("II*\x00\x00\x00\x00\x00")
+	pointer := 4
+
+	for _, img := range pages {
+		var (
+			pix         []byte
+			samples     = 1
+			bits        = 8
+			photometric = uint32(1)
+			compression = uint32(1)
+		)
+		switch m := img.(type) {
+		case *image.RGBA:
+			samples, photometric = 3, tiffRGB
+			for i := 0; i < len(m.Pix); i += 4 {
+				pix = append(pix, m.Pix[i:i+3]...)
+			}
+		case *image.Gray:
+			pix = m.Pix
+		case *image.Gray16:
+			bits = 16
+			for i := 0; i < len(m.Pix); i += 2 {
+				pix = append(pix, m.Pix[i+1], m.Pix[i])
+			}
+		default:
+			t.Fatalf("no TIFF page for a %T", img)
+		}
+		if deflate && samples == 1 {
+			var buf bytes.Buffer
+			zw := zlib.NewWriter(&buf)
+			zw.Write(pix)
+			zw.Close()
+			pix, compression = buf.Bytes(), 8
+		}
+
+		out = alignWord(out)
+		strip := len(out)
+		out = append(out, pix...)
+		out = alignWord(out)
+		software := len(out)
+		out = append(out, testSoftware...)
+		out = alignWord(out)
+		bitsPerSample := uint32(bits)
+		if samples > 2 {
+			bitsPerSample = uint32(len(out))
+			for j := 0; j < samples; j++ {
+				out = tf.appendUint16(out, uint16(bits))
+			}
+		}
+
+		b := img.Bounds()
+		entries := [][]byte{
+			tf.entry(256, tiffLong, 1, uint32(b.Dx())),
+			tf.entry(257, tiffLong, 1, uint32(b.Dy())),
+			tf.entry(258, tiffShort, samples, bitsPerSample),
+			tf.entry(259, tiffShort, 1, compression),
+			tf.entry(tiffPhotometric, tiffShort, 1, photometric),
+			tf.entry(273, tiffLong, 1, uint32(strip)),
+			tf.entry(277, tiffShort, 1, uint32(samples)),
+			tf.entry(278, tiffLong, 1, uint32(b.Dy())),
+			tf.entry(279, tiffLong, 1, uint32(len(pix))),
+			tf.entry(305, 2, len(testSoftware), uint32(software)),
+		}
+		out = alignWord(out)
+		tf.order.PutUint32(out[pointer:], uint32(len(out)))
+		out = tf.appendUint16(out, uint16(len(entries)))
+		for _, e := range entries {
+			out = append(out, e...)
+		}
+		pointer = len(out)
+		out = tf.appendUint32(out, 0)
+	}
+	return out
+}
+
+// testPages returns a 40x30 RGB page, a 30x20 gray one and a 20x20 16 bit
+// gray one, filled from seed.
+func testPages(seed int64) []image.Image {
+	gray := image.NewGray(image.Rect(0, 0, 30, 20))
+	copy(gray.Pix, testPayload(len(gray.Pix), seed))
+	gray16 := image.NewGray16(image.Rect(0, 0, 20, 20))
+	copy(gray16.Pix, testPayload(len(gray16.Pix), seed))
+	return []image.Image{testCover(40, 30, seed), gray, gray16}
+}
+
+// relink returns the TIFF in data with its pages chained in order, which
+// counts from 0 and may leave pages out.
+func relink(t testing.TB, data []byte, order ...int) []byte {
+	t.Helper()
+	tf, err := readTIFF(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := append([]byte{}, data...)
+	pointer := 4
+	for _, i := range order {
+		entries, err := tf.entries(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tf.order.PutUint32(out[pointer:], tf.ifds[i])
+		pointer = tf.nextPointer(i, len(entries))
+	}
+	tf.order.PutUint32(out[pointer:], 0)
+	return out
+}
+
+// software returns the Software tag of page i of the TIFF in data.
+func software(t testing.TB, data []byte, i int) string {
+	t.Helper()
+	tf, err := readTIFF(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := tf.entries(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if tf.order.Uint16(e) == 305 {
+			off, n := tf.order.Uint32(e[8:]), tf.order.Uint32(e[4:])
+			return string(data[off : off+n])
+		}
+	}
+	return ""
+}
+
+// TestTIFFPage encodes into each page of a TIFF, which leaves the other pages
+// and every byte of the file but a pointer to the page as they were, and
+// keeps the tags of the page.
+func TestTIFFPage(t *testing.T) {
+	for _, deflate := range []bool{false, true} {
+		data := testTIFF(t, deflate, testPages(149)...)
+		if n, err := TIFFPages(bytes.NewReader(data)); err != nil || n != 3 {
+			t.Fatalf("got %d pages, %v, want 3", n, err)
+		}
+
+		for page := 0; page < 3; page++ {
+			capacity, err := CapacityTIFF(bytes.NewReader(data), page, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload := testPayload(capacity, int64(page))
+
+			var buf bytes.Buffer
+			if err := EncodeTIFF(&buf, bytes.NewReader(data), page, payload, nil); err != nil {
+				t.Fatalf("page %d: %v", page, err)
+			}
+			out := buf.Bytes()
+			if got, err := DecodeTIFF(bytes.NewReader(out), page, nil); err != nil || !bytes.Equal(got, payload) {
+				t.Errorf("page %d: decoded %d bytes that are not the payload, %v", page, len(got), err)
+			}
+			if n, format, err := DetectTIFF(bytes.NewReader(out), page); err != nil || n != capacity || !strings.HasPrefix(format, "tiff/") {
+				t.Errorf("page %d: detected %d bytes as %q, %v", page, n, format, err)
+			}
+
+			var changed int
+			for i := range data {
+				if out[i] != data[i] {
+					changed++
+				}
+			}
+			if changed > 4 {
+				t.Errorf("page %d: changed %d bytes of the file, want only the pointer to the page", page, changed)
+			}
+			if s := software(t, out, page); s != testSoftware {
+				t.Errorf("page %d: the Software tag is %q, want %q", page, s, testSoftware)
+			}
+			for other := 0; other < 3; other++ {
+				if other == page {
+					continue
+				}
+				a, err := TIFFPage(bytes.NewReader(data), other)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := TIFFPage(bytes.NewReader(out), other)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(pixels(t, a), pixels(t, b)) {
+					t.Errorf("page %d: changed page %d", page, other)
+				}
+			}
+		}
+	}
+}
+
+// TestTIFFPages stores two messages in different pages of the same TIFF.
+func TestTIFFPages(t *testing.T) {
+	data := testTIFF(t, true, testPages(149)...)
+	var first, second bytes.Buffer
+	if err := EncodeTIFF(&first, bytes.NewReader(data), 0, []byte("first"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncodeTIFF(&second, bytes.NewReader(first.Bytes()), 2, []byte("second"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for page, want := range map[int]string{0: "first", 2: "second"} {
+		if got, err := DecodeTIFF(bytes.NewReader(second.Bytes()), page, nil); err != nil || string(got) != want {
+			t.Errorf("page %d: got %q, %v, want %q", page, got, err, want)
+		}
+	}
+	if _, err := DecodeTIFF(bytes.NewReader(second.Bytes()), 1, nil); err != ErrNoHiddenMessage {
+		t.Errorf("page 1: got %v, want %v", err, ErrNoHiddenMessage)
+	}
+}
+
+// TestTIFFSpan stores a message larger than any page across all of them, and
+// decodes it from the document only while it has the same pages.
+func TestTIFFSpan(t *testing.T) {
+	data := testTIFF(t, true, testPages(149)...)
+	capacity, err := CapacityTIFF(bytes.NewReader(data), SpanPages, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	largest := Capacity(testCover(40, 30, 149), nil)
+	if capacity <= largest {
+		t.Fatalf("capacity %d, want more than the %d of the largest page", capacity, largest)
+	}
+
+	payload := testPayload(capacity, 149)
+	var buf bytes.Buffer
+	if err := EncodeTIFF(&buf, bytes.NewReader(data), SpanPages, payload, nil); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.Bytes()
+	if got, err := DecodeTIFF(bytes.NewReader(out), SpanPages, nil); err != nil || !bytes.Equal(got, payload) {
+		t.Errorf("decoded %d bytes that are not the payload, %v", len(got), err)
+	}
+	for page := 0; page < 3; page++ {
+		if s := software(t, out, page); s != testSoftware {
+			t.Errorf("page %d: the Software tag is %q, want %q", page, s, testSoftware)
+		}
+	}
+
+	for _, c := range []struct {
+		name  string
+		order []int
+		want  string
+	}{
+		{"last page removed", []int{0, 1}, "spans more pages than the 2 of the document"},
+		{"pages swapped", []int{0, 2, 1}, "page 2 is not the one the message was stored in"},
+	} {
+		if _, err := DecodeTIFF(bytes.NewReader(relink(t, out, c.order...)), SpanPages, nil); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want an error with %q", c.name, err, c.want)
+		}
+	}
+
+	if err := EncodeTIFF(&buf, bytes.NewReader(data), SpanPages, testPayload(capacity+1, 149), nil); err != ErrMessageTooLarge {
+		t.Errorf("one byte too many: got %v, want %v", err, ErrMessageTooLarge)
+	}
+}
+
+func TestTIFFRejected(t *testing.T) {
+	data := testTIFF(t, false, testPages(149)...)
+	var buf bytes.Buffer
+	for _, c := range []struct {
+		name string
+		page int
+		opt  *Options
+		want string
+	}{
+		{"page out of range", 3, nil, "page 4 is not in the TIFF, it has 3 pages"},
+		{"negative page", -2, nil, "page -1 is not in the TIFF"},
+		{"span placement", SpanPages, &Options{Placement: Permuted{}}, ErrTIFFPlacement.Error()},
+		{"span matching", SpanPages, &Options{Matching: true}, ErrMatchingUnsupported.Error()},
+		{"seal", 0, &Options{Seal: true}, ErrSealUnsupported.Error()},
+	} {
+		if err := EncodeTIFF(&buf, bytes.NewReader(data), c.page, []byte("x"), c.opt); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want an error with %q", c.name, err, c.want)
+		}
+	}
+	if _, err := TIFFPage(bytes.NewReader(data), SpanPages); err == nil {
+		t.Error("TIFFPage decoded SpanPages")
+	}
+
+	looped := relink(t, data, 0, 1)
+	tf, _ := readTIFF(bytes.NewReader(data))
+	entries, _ := tf.entries(1)
+	tf.order.PutUint32(looped[tf.nextPointer(1, len(entries)):], tf.ifds[0])
+	if _, err := TIFFPages(bytes.NewReader(looped)); err == nil || !strings.Contains(err.Error(), "loop") {
+		t.Errorf("looped pages: got %v", err)
+	}
+}
+
+// TestTIFFSorted checks that rewritten directories keep their entries
+// sorted by tag, as TIFF readers expect.
+func TestTIFFSorted(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeTIFF(&buf, bytes.NewReader(testTIFF(t, false, testPages(149)...)), SpanPages, []byte("x"), nil); err != nil {
+		t.Fatal(err)
+	}
+	tf, err := readTIFF(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := tf.entries(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sort.SliceIsSorted(entries, func(i, j int) bool { return tf.order.Uint16(entries[i]) < tf.order.Uint16(entries[j]) }) {
+		t.Error("the entries of the rewritten page are not sorted")
+	}
+}
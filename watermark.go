@@ -0,0 +1,169 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"sort"
+)
+
+// ErrWatermarkTooLong is returned when a watermark copy does not fit in a
+// single row of the cover.
+var ErrWatermarkTooLong = errors.New("watermark does not fit in a row of the image")
+
+// watermarkSync starts every copy of a watermark, so copies can be found at
+// any bit offset.
+var (
+	watermarkSync     = []byte{0x9d, 0x2c}
+	watermarkSyncBits = unpackBits(watermarkSync)
+)
+
+// WatermarkMatch is an identifier recovered from a watermarked image, with
+// the number of valid copies it was found in.
+type WatermarkMatch struct {
+	ID     []byte
+	Copies int
+}
+
+// Watermark returns a copy of cover with id repeated over every carrier bit.
+// Every copy is a sync prefix, the length of id, id and a CRC-32, and every
+// row repeats the copies from its left edge. A crop of the image keeps full
+// copies as long as it is at least two copies wide. Unlike Encode there is
+// no header, so the watermark is read with ExtractWatermark and not Decode.
+func Watermark(cover image.Image, id []byte) (image.Image, error) {
+	if len(id) == 0 || len(id) > 0xFF {
+		return nil, errors.New("watermark identifier must be 1 to 255 bytes")
+	}
+
+	b := cover.Bounds()
+	img := image.NewRGBA(b)
+	draw.Draw(img, b, cover, b.Min, draw.Src)
+
+	bits := unpackBits(watermarkCopy(id))
+	if len(bits) > b.Dx()*3 {
+		return nil, ErrWatermarkTooLong
+	}
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):]
+		// One bit in the LSB of R, G and B of every pixel.
+		for i := 0; i < b.Dx()*3; i++ {
+			offset := i/3*4 + i%3
+			row[offset] = row[offset]&^1 | bits[i%len(bits)]
+		}
+	}
+	return img, nil
+}
+
+// ExtractWatermark scans every row of img for watermark copies. Matches are
+// sorted by the number of copies, most first. It returns ErrNoHiddenMessage
+// if there are no valid copies.
+func ExtractWatermark(img image.Image) ([]WatermarkMatch, error) {
+	var (
+		rgbaImg = toRGBA(img)
+		b       = rgbaImg.Bounds()
+		bits    = make([]byte, b.Dx()*3)
+		index   = map[string]int{}
+		matches []WatermarkMatch
+	)
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := rgbaImg.Pix[rgbaImg.PixOffset(b.Min.X, y):]
+		for i := range bits {
+			bits[i] = row[i/3*4+i%3] & 1
+		}
+
+		for i := 0; i < len(bits); i++ {
+			id, ok := watermarkAt(bits[i:])
+			if !ok {
+				continue
+			}
+			n, ok := index[string(id)]
+			if !ok {
+				n = len(matches)
+				index[string(id)] = n
+				matches = append(matches, WatermarkMatch{ID: id})
+			}
+			matches[n].Copies++
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, ErrNoHiddenMessage
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Copies > matches[j].Copies
+	})
+	return matches, nil
+}
+
+// watermarkCopy returns a single copy of the watermark id.
+func watermarkCopy(id []byte) []byte {
+	buf := append([]byte{}, watermarkSync...)
+	buf = append(buf, byte(len(id)))
+	buf = append(buf, id...)
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(buf[len(watermarkSync):]))
+	return append(buf, sum[:]...)
+}
+
+// watermarkAt returns the identifier if a valid copy starts at the first of
+// bits.
+func watermarkAt(bits []byte) ([]byte, bool) {
+	n := len(watermarkSync)
+	if len(bits) < (n+1)*8 || !bytes.Equal(bits[:n*8], watermarkSyncBits) {
+		return nil, false
+	}
+
+	size := int(packBits(bits[n*8 : (n+1)*8])[0])
+	total := (n + 1 + size + 4) * 8
+	if size == 0 || len(bits) < total {
+		return nil, false
+	}
+
+	buf := packBits(bits[:total])
+	if !bytes.Equal(buf, watermarkCopy(buf[n+1:n+1+size])) {
+		return nil, false
+	}
+	return buf[n+1 : n+1+size], true
+}
+
+// unpackBits returns the bits of data, one per byte and most significant
+// first, as the default layout stores them.
+func unpackBits(data []byte) []byte {
+	bits := make([]byte, 0, len(data)*8)
+	for _, b := range data {
+		for j := uint(0); j < 8; j++ {
+			bits = append(bits, b>>(7-j)&1)
+		}
+	}
+	return bits
+}
+
+// packBits is the inverse of unpackBits.
+func packBits(bits []byte) []byte {
+	data := make([]byte, len(bits)/8)
+	for i, bit := range bits[:len(data)*8] {
+		data[i/8] |= bit << (7 - uint(i)%8)
+	}
+	return data
+}
@@ -0,0 +1,90 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"testing"
+)
+
+// crop returns the r part of img as a new image with its origin at 0, 0,
+// like a screenshot of that region.
+func crop(img image.Image, r image.Rectangle) *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(m, m.Bounds(), img, r.Min, draw.Src)
+	return m
+}
+
+// TestWatermarkCropped crops a watermarked image to a quarter of its area in
+// a number of places, all of which still hold the identifier.
+func TestWatermarkCropped(t *testing.T) {
+	for _, id := range [][]byte{testPayload(16, 1), testPayload(32, 2)} {
+		marked, err := Watermark(testCover(640, 480, 1), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, r := range []image.Rectangle{
+			image.Rect(0, 0, 320, 240),
+			image.Rect(320, 240, 640, 480),
+			image.Rect(160, 120, 480, 360),
+			image.Rect(157, 31, 477, 271),
+			image.Rect(0, 0, 160, 480),
+			image.Rect(0, 360, 640, 480),
+		} {
+			matches, err := ExtractWatermark(crop(marked, r))
+			if err != nil {
+				t.Errorf("%d byte identifier cropped to %v: %v", len(id), r, err)
+				continue
+			}
+			if len(matches) != 1 || !bytes.Equal(matches[0].ID, id) {
+				t.Errorf("%d byte identifier cropped to %v: got %v", len(id), r, matches)
+				continue
+			}
+			perRow := r.Dx() * 3 / (8 * len(watermarkCopy(id)))
+			if want := (perRow - 1) * r.Dy(); matches[0].Copies < want {
+				t.Errorf("%d byte identifier cropped to %v: %d copies, want at least %d", len(id), r, matches[0].Copies, want)
+			}
+		}
+	}
+}
+
+func TestWatermarkMissing(t *testing.T) {
+	if _, err := ExtractWatermark(testCover(320, 240, 1)); err != ErrNoHiddenMessage {
+		t.Errorf("clean cover: got %v, want %v", err, ErrNoHiddenMessage)
+	}
+
+	id := testPayload(32, 1)
+	marked, err := Watermark(testCover(640, 480, 1), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One copy is 39 bytes, 104 pixels, a crop of 100 can not hold it.
+	if _, err := ExtractWatermark(crop(marked, image.Rect(10, 10, 110, 480))); err != ErrNoHiddenMessage {
+		t.Errorf("crop narrower than a copy: got %v, want %v", err, ErrNoHiddenMessage)
+	}
+
+	if _, err := Watermark(testCover(100, 10, 1), id); err != ErrWatermarkTooLong {
+		t.Errorf("cover narrower than a copy: got %v, want %v", err, ErrWatermarkTooLong)
+	}
+	for _, id := range [][]byte{nil, make([]byte, 256)} {
+		if _, err := Watermark(testCover(640, 10, 1), id); err == nil {
+			t.Errorf("watermarked a %d byte identifier", len(id))
+		}
+	}
+}
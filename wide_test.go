@@ -0,0 +1,111 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// wideCovers returns 16 bit covers of random samples; the RGBA64 one opaque,
+// since it is premultiplied.
+func wideCovers(w, h int, seed int64) map[string]image.Image {
+	r := image.Rect(0, 0, w, h)
+	rgba, nrgba, gray := image.NewRGBA64(r), image.NewNRGBA64(r), image.NewGray16(r)
+	copy(rgba.Pix, testPayload(len(rgba.Pix), seed))
+	copy(nrgba.Pix, testPayload(len(nrgba.Pix), seed))
+	copy(gray.Pix, testPayload(len(gray.Pix), seed))
+	for i := 6; i < len(rgba.Pix); i += 8 {
+		rgba.Pix[i], rgba.Pix[i+1] = 0xff, 0xff
+	}
+	return map[string]image.Image{"rgba64": rgba, "nrgba64": nrgba, "gray16": gray}
+}
+
+// TestWide encodes into 16 bit covers, which stay 16 bit and only change in
+// the lowest bit of the low byte of their color samples, and decodes the
+// message from them after a round trip through PNG.
+func TestWide(t *testing.T) {
+	payload := testPayload(1000, 147)
+	for name, cover := range wideCovers(120, 80, 147) {
+		for _, c := range []struct {
+			name string
+			opt  *Options
+		}{
+			{"default", nil},
+			{"resync", &Options{BlockSize: 128}},
+			{"matching", &Options{Matching: true}},
+		} {
+			name := name + " " + c.name
+			stego, err := Encode(cover, payload, c.opt)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if stego.Bounds() != cover.Bounds() || fmt.Sprintf("%T", stego) != fmt.Sprintf("%T", cover) {
+				t.Fatalf("%s: encoded a %T into a %T", name, cover, stego)
+			}
+
+			before, after := pixels(t, cover), pixels(t, stego)
+			_, gray := cover.(*image.Gray16)
+			for i := range after {
+				alpha := !gray && i/2%4 == 3
+				v, w := int(before[i&^1])<<8|int(before[i|1]), int(after[i&^1])<<8|int(after[i|1])
+				switch {
+				case alpha && v != w:
+					t.Fatalf("%s: changed the alpha sample at %d", name, i)
+				case (c.opt == nil || !c.opt.Matching) && v^w > 1:
+					t.Fatalf("%s: changed sample %d from 0x%04x to 0x%04x", name, i/2, v, w)
+				case v-w > 1 || w-v > 1:
+					t.Fatalf("%s: changed sample %d by more than one, from 0x%04x to 0x%04x", name, i/2, v, w)
+				}
+			}
+
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, stego); err != nil {
+				t.Fatal(err)
+			}
+			img, err := png.Decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := Decode(img, nil); err != nil || !bytes.Equal(got, payload) {
+				t.Errorf("%s: Decode read %d bytes that are not the payload, %v", name, len(got), err)
+			}
+			if got, _, err := DecodeAuto(img, nil); err != nil || !bytes.Equal(got, payload) {
+				t.Errorf("%s: DecodeAuto read %d bytes that are not the payload, %v", name, len(got), err)
+			}
+			if rec, err := Recover(img, nil); err != nil || !bytes.Equal(rec.Payload, payload) {
+				t.Errorf("%s: Recover failed, %v", name, err)
+			}
+		}
+	}
+}
+
+// TestWideCapacity checks that a 16 bit cover holds as much as an 8 bit one
+// of the same size.
+func TestWideCapacity(t *testing.T) {
+	want := Capacity(testCover(120, 80, 147), nil)
+	for name, cover := range wideCovers(120, 80, 147) {
+		if name == "gray16" {
+			continue
+		}
+		if got := Capacity(cover, nil); got != want {
+			t.Errorf("%s: holds %d bytes, want %d", name, got, want)
+		}
+	}
+}
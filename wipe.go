@@ -0,0 +1,28 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+// Wipe overwrites every byte of bufs with zeros. It is for passphrases, keys
+// and plaintext once they are no longer needed. Go may still have copied
+// them elsewhere, when a slice grew or a string was made of it, so this
+// narrows the window they are in memory rather than closing it.
+func Wipe(bufs ...[]byte) {
+	for _, b := range bufs {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/image/bmp"
+)
+
+// zeroed reports whether every byte of b is zero.
+func zeroed(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestWipe(t *testing.T) {
+	a, b := []byte("passphrase"), []byte("key")
+	spare := make([]byte, 4, 8)
+	copy(spare[:8], "abcdefgh")
+	Wipe(a, nil, b, []byte{}, spare)
+	if !zeroed(a) || !zeroed(b) || !zeroed(spare) {
+		t.Errorf("got %q, %q and %q, want zeros", a, b, spare)
+	}
+	if string(spare[4:8]) != "efgh" {
+		t.Errorf("wiped %q beyond the length of the slice", spare[4:8])
+	}
+}
+
+// TestWipeStream wipes the key of the salts and nonces of Deterministic.
+func TestWipeStream(t *testing.T) {
+	s, err := derivedRand(nil, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(&io.LimitedReader{R: s, N: 100})
+	key := s.key
+	if zeroed(key) {
+		t.Fatal("the key is zero before it is wiped")
+	}
+	s.wipe()
+	if !zeroed(key) {
+		t.Error("wipe left the key")
+	}
+}
+
+// TestWipeKeepsInputs encodes into every format, which wipes what it staged
+// but must leave the payload and passphrase of the caller alone.
+func TestWipeKeepsInputs(t *testing.T) {
+	cover := testCover(120, 80, 154)
+	var bmpData bytes.Buffer
+	if err := bmp.Encode(&bmpData, cover); err != nil {
+		t.Fatal(err)
+	}
+	tiffData := testTIFF(t, false, testPages(154)...)
+	gifData := testGIF(t, 154)
+
+	for name, encode := range map[string]func(payload []byte, opt *Options) error{
+		"pixels": func(p []byte, opt *Options) error { _, err := Encode(cover, p, opt); return err },
+		"bmp": func(p []byte, opt *Options) error {
+			return EncodeBMP(ioutil.Discard, bytes.NewReader(bmpData.Bytes()), p, opt)
+		},
+		"jpeg": func(p []byte, opt *Options) error {
+			return EncodeJPEG(ioutil.Discard, photoCover(160, 120, 154), p, 75, opt)
+		},
+		"gif": func(p []byte, opt *Options) error { return EncodeGIF(ioutil.Discard, bytes.NewReader(gifData), p, opt) },
+		"tiff page": func(p []byte, opt *Options) error {
+			return EncodeTIFF(ioutil.Discard, bytes.NewReader(tiffData), 0, p, opt)
+		},
+		"tiff span": func(p []byte, opt *Options) error {
+			return EncodeTIFF(ioutil.Discard, bytes.NewReader(tiffData), SpanPages, p, opt)
+		},
+	} {
+		for _, opt := range []*Options{
+			nil,
+			{Passphrase: []byte("pass")},
+			{Passphrase: []byte("pass"), Deterministic: true},
+		} {
+			payload := testPayload(100, 154)
+			if err := encode(payload, opt); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(payload, testPayload(100, 154)) {
+				t.Errorf("%s: the payload was changed", name)
+			}
+			if opt != nil && string(opt.Passphrase) != "pass" {
+				t.Errorf("%s: the passphrase was changed to %q", name, opt.Passphrase)
+			}
+		}
+	}
+}
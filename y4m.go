@@ -0,0 +1,436 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// EncodeY4M and DecodeY4M store a message in the least significant bits of
+// the luma samples of a YUV4MPEG2 stream, frame after frame, the way Encode
+// uses the color samples of an image. The stream is processed one frame at a
+// time, so it never has to fit in memory, and everything but those bits is
+// copied unchanged.
+//
+// Every frame that holds part of the message starts with a sync marker,
+// y4mSync and the number of the frame from the first one of the message,
+// so a frame a player or editor repeated is skipped and frames it dropped
+// are reported as such rather than as a damaged message. Streams encoded
+// before the markers start with the container header instead, and decode
+// as they did.
+const y4mMagic = "YUV4MPEG2 "
+
+// y4mSync starts the sync marker of a frame, followed by its number as a
+// big endian uint32.
+const y4mSync = "HIDF"
+
+// y4mSyncBits is the number of luma samples the sync marker takes.
+const y4mSyncBits = (len(y4mSync) + 4) * 8
+
+// FramesMissingError is returned when a YUV4MPEG2 stream lost frames that
+// held part of the message, from frame First to Last of the message,
+// counting from 0.
+type FramesMissingError struct {
+	First, Last int
+}
+
+func (e *FramesMissingError) Error() string {
+	if e.First == e.Last {
+		return fmt.Sprintf("frame %d of the message is missing from the stream", e.First)
+	}
+	return fmt.Sprintf("frames %d to %d of the message are missing from the stream", e.First, e.Last)
+}
+
+// ErrVideoPlacement is returned for options with a Placement other than
+// Sequential, they only apply to images.
+var ErrVideoPlacement = errors.New("placements are not supported in video streams")
+
+// y4mStream reads a YUV4MPEG2 stream a frame at a time, and writes every
+// frame it is done with to w, if any.
+type y4mStream struct {
+	r     *bufio.Reader
+	w     *bufio.Writer
+	luma  int
+	frame []byte
+	pos   int
+	read  bool
+
+	// sync is set for a stream with sync markers, frames counts the
+	// frames of the message so far.
+	sync   bool
+	frames uint32
+}
+
+// maxY4MLine limits the stream and frame header lines.
+const maxY4MLine = 4096
+
+// newY4MStream reads the stream header from r, and copies it to w if it is
+// not nil.
+func newY4MStream(r io.Reader, w io.Writer) (*y4mStream, error) {
+	s := &y4mStream{r: bufio.NewReaderSize(r, maxY4MLine)}
+	if w != nil {
+		s.w = bufio.NewWriter(w)
+	}
+
+	line, err := s.line()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, y4mMagic) {
+		return nil, &MalformedImageError{"y4m", errors.New("missing YUV4MPEG2 signature")}
+	}
+
+	var width, height int
+	colorspace := "420"
+	for _, p := range strings.Fields(line[len(y4mMagic):]) {
+		switch p[0] {
+		case 'W':
+			width, err = strconv.Atoi(p[1:])
+		case 'H':
+			height, err = strconv.Atoi(p[1:])
+		case 'C':
+			colorspace = p[1:]
+		}
+		if err != nil {
+			return nil, &MalformedImageError{"y4m", fmt.Errorf("invalid parameter %q", p)}
+		}
+	}
+	if width <= 0 || height <= 0 {
+		return nil, &MalformedImageError{"y4m", errors.New("missing frame dimensions")}
+	}
+	if err := checkDimensions(width, height); err != nil {
+		return nil, malformed("y4m", err)
+	}
+
+	// The chroma planes follow the luma plane, rounded up when subsampled.
+	cw, ch := (width+1)/2, (height+1)/2
+	var chroma int
+	switch colorspace {
+	case "420", "420jpeg", "420paldv", "420mpeg2":
+		chroma = 2 * cw * ch
+	case "411":
+		chroma = 2 * ((width + 3) / 4) * height
+	case "422":
+		chroma = 2 * cw * height
+	case "444":
+		chroma = 2 * width * height
+	case "444alpha":
+		chroma = 3 * width * height
+	case "mono":
+	default:
+		return nil, &MalformedImageError{"y4m", fmt.Errorf("unsupported colorspace %q, only 8 bit samples are", colorspace)}
+	}
+
+	s.luma = width * height
+	s.frame = make([]byte, s.luma+chroma)
+	return s, s.write(line)
+}
+
+// line reads a header line, without the newline.
+func (s *y4mStream) line() (string, error) {
+	line, err := s.r.ReadSlice('\n')
+	switch {
+	case err == bufio.ErrBufferFull:
+		return "", &MalformedImageError{"y4m", errors.New("header line is too long")}
+	case err == io.EOF && len(line) == 0:
+		return "", io.EOF
+	case err == io.EOF:
+		return "", &MalformedImageError{"y4m", io.ErrUnexpectedEOF}
+	case err != nil:
+		return "", err
+	}
+	return string(line[:len(line)-1]), nil
+}
+
+func (s *y4mStream) write(line string) error {
+	if s.w == nil {
+		return nil
+	}
+	s.w.WriteString(line)
+	return s.w.WriteByte('\n')
+}
+
+// next writes the current frame, if encoding, and reads the next one. It
+// returns io.EOF at the end of the stream.
+func (s *y4mStream) next() error {
+	if s.read && s.w != nil {
+		if _, err := s.w.Write(s.frame); err != nil {
+			return err
+		}
+	}
+	s.read = false
+
+	line, err := s.line()
+	if err != nil {
+		return err
+	}
+	if line != "FRAME" && !strings.HasPrefix(line, "FRAME ") {
+		return &MalformedImageError{"y4m", fmt.Errorf("expected a frame header, found %q", line)}
+	}
+	if err := s.write(line); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(s.r, s.frame); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = &MalformedImageError{"y4m", errors.New("truncated frame")}
+		}
+		return err
+	}
+	s.pos, s.read = 0, true
+	return nil
+}
+
+// sample returns the next luma sample.
+func (s *y4mStream) sample() (*byte, error) {
+	if !s.read || s.pos == s.luma {
+		if err := s.next(); err != nil {
+			return nil, err
+		}
+		if s.sync {
+			if err := s.syncFrame(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	s.pos++
+	return &s.frame[s.pos-1], nil
+}
+
+// marker returns the sync marker the current frame would start with.
+func (s *y4mStream) marker() []byte {
+	m := make([]byte, y4mSyncBits/8)
+	for i := range m {
+		for j := uint(0); j < 8; j++ {
+			m[i] |= s.frame[i*8+int(j)] & 1 << (7 - j)
+		}
+	}
+	return m
+}
+
+// syncFrame writes the sync marker of the frame just read when encoding,
+// and checks it when decoding, where a frame that repeats one before it is
+// skipped for the next.
+func (s *y4mStream) syncFrame() error {
+	for s.w == nil {
+		m := s.marker()
+		if string(m[:len(y4mSync)]) != y4mSync {
+			return &MalformedImageError{"y4m", fmt.Errorf("frame %d of the message has no sync marker", s.frames)}
+		}
+		n := binary.BigEndian.Uint32(m[len(y4mSync):])
+		if n > s.frames {
+			return &FramesMissingError{int(s.frames), int(n) - 1}
+		} else if n == s.frames {
+			break
+		}
+		if err := s.next(); err != nil {
+			return err
+		}
+	}
+
+	if s.w != nil {
+		m := append([]byte(y4mSync), 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(m[len(y4mSync):], s.frames)
+		for i, b := range m {
+			for j := uint(0); j < 8; j++ {
+				v := &s.frame[i*8+int(j)]
+				*v = *v&^1 | b>>(7-j)&1
+			}
+		}
+	}
+	s.frames++
+	s.pos = y4mSyncBits
+	return nil
+}
+
+func (s *y4mStream) Read(p []byte) (int, error) {
+	for n := range p {
+		var res byte
+		for j := uint(0); j < 8; j++ {
+			v, err := s.sample()
+			if err != nil {
+				return n, err
+			}
+			res |= *v & 1 << (7 - j)
+		}
+		p[n] = res
+	}
+	return len(p), nil
+}
+
+func (s *y4mStream) Write(p []byte) (int, error) {
+	for n, b := range p {
+		for j := uint(0); j < 8; j++ {
+			v, err := s.sample()
+			if err == io.EOF {
+				return n, ErrMessageTooLarge
+			} else if err != nil {
+				return n, err
+			}
+			*v = *v&^1 | b>>(7-j)&1
+		}
+	}
+	return len(p), nil
+}
+
+// finish writes the current frame and copies the rest of the stream.
+func (s *y4mStream) finish() error {
+	if s.read {
+		if _, err := s.w.Write(s.frame); err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(s.w, s.r); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// EncodeY4M copies the YUV4MPEG2 stream r to w with payload hidden in the
+// luma samples of its frames. Every frame of w by h pixels holds w*h bits
+// less its sync marker, the stream fails with ErrMessageTooLarge if it ends
+// before the payload does, after writing what it has.
+func EncodeY4M(w io.Writer, r io.Reader, payload []byte, opt *Options) error {
+	if opt.placement() != nil {
+		return ErrVideoPlacement
+	}
+	if opt.lsbFirst() {
+		return ErrBitOrderUnsupported
+	}
+	if opt.layout() != nil {
+		return ErrDepthUnsupported
+	}
+	if opt.seal() {
+		return ErrSealUnsupported
+	}
+	if opt.copies() > 1 {
+		return ErrCopiesUnsupported
+	}
+	if opt.matching() {
+		return ErrMatchingUnsupported
+	}
+	if opt.preserveHistogram() {
+		return ErrHistogramUnsupported
+	}
+	if opt.fill() {
+		return ErrFillUnsupported
+	}
+	data, payload, err := container(payload, opt)
+	if err != nil {
+		return err
+	}
+
+	s, err := newY4MStream(r, w)
+	if err != nil {
+		return err
+	}
+	if s.luma <= y4mSyncBits {
+		return &MalformedImageError{"y4m", fmt.Errorf("frames of %d luma samples leave no room for the message after the sync marker", s.luma)}
+	}
+	s.sync = true
+	if _, err := s.Write(data); err != nil {
+		return err
+	}
+	if _, err := s.Write(payload); err != nil {
+		return err
+	}
+	return s.finish()
+}
+
+// DecodeY4M extracts the payload hidden in the YUV4MPEG2 stream r, reading
+// only the frames that hold it, and validates it like Decode. It fails
+// with a *FramesMissingError if frames of the message were dropped.
+func DecodeY4M(r io.Reader, opt *Options) ([]byte, error) {
+	msg, h, err := extractY4M(r)
+	if err != nil {
+		return nil, err
+	}
+	return h.open(msg, opt)
+}
+
+// DetectY4M is Detect for a YUV4MPEG2 stream, the format is prefixed with
+// "y4m/".
+func DetectY4M(r io.Reader) (int, string, error) {
+	msg, h, err := extractY4M(r)
+	if err != nil {
+		return 0, "", err
+	}
+	return len(msg), "y4m/" + detectFormat(msg, h), nil
+}
+
+func extractY4M(r io.Reader) ([]byte, *Header, error) {
+	s, err := newY4MStream(r, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch err := s.next(); err {
+	case nil:
+	case io.EOF:
+		return nil, nil, ErrNoHiddenMessage
+	default:
+		return nil, nil, err
+	}
+	if s.luma > y4mSyncBits && string(s.marker()[:len(y4mSync)]) == y4mSync {
+		s.sync = true
+		if err := s.syncFrame(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	h := &Header{}
+	switch err := h.read(s); err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		return nil, nil, ErrNoHiddenMessage
+	default:
+		return nil, nil, err
+	}
+	// EncodeY4M never writes the legacy header, and its length is too
+	// likely to be noise claiming most of the stream.
+	if p, err := headerPlacement(h); err != nil || p != nil || h.Length == 0 || h.Version == 0 {
+		return nil, nil, ErrNoHiddenMessage
+	}
+
+	// The buffer only grows with what the stream holds, whatever length
+	// the header claims.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, s, int64(h.Length)); err == io.EOF {
+		return nil, nil, &TruncatedError{h.Length, buf.Len()}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	msg, repaired, err := h.repair(buf.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	h.repaired = repaired
+	if sum := h.sum(msg); !bytes.Equal(sum, h.Checksum) {
+		return nil, nil, &ChecksumError{msg, h.Length, h.Checksum, sum}
+	}
+	if h.Flags&FlagResync != 0 {
+		if msg, err = unframe(msg); err != nil {
+			return nil, nil, err
+		}
+	}
+	return msg, h, nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright (C) 2017 Andreas T Jonsson
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package hidden
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// y4mTestHeader is the stream header of the test streams, 32 by 16 pixels
+// with 4:2:0 chroma, so a frame is 768 bytes of which 512 are luma.
+const (
+	y4mTestHeader = "YUV4MPEG2 W32 H16 F25:1 Ip A1:1 C420jpeg\n"
+	y4mTestFrame  = len("FRAME\n") + 768
+)
+
+// testY4M returns a stream of n frames of random samples.
+func testY4M(n int, seed int64) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+	stream := []byte(y4mTestHeader)
+	for i := 0; i < n; i++ {
+		frame := make([]byte, 768)
+		rnd.Read(frame)
+		stream = append(append(stream, "FRAME\n"...), frame...)
+	}
+	return stream
+}
+
+// y4mFrames splits a test stream into its frames, header lines included.
+func y4mFrames(stream []byte) [][]byte {
+	var frames [][]byte
+	for p := stream[len(y4mTestHeader):]; len(p) > 0; p = p[y4mTestFrame:] {
+		frames = append(frames, p[:y4mTestFrame])
+	}
+	return frames
+}
+
+// y4mStreamOf joins frames into a test stream.
+func y4mStreamOf(frames ...[]byte) []byte {
+	return append([]byte(y4mTestHeader), bytes.Join(frames, nil)...)
+}
+
+func encodeTestY4M(t *testing.T, cover, payload []byte, opt *Options) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := EncodeY4M(&buf, bytes.NewReader(cover), payload, opt); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestY4MRoundTrip(t *testing.T) {
+	cover := testY4M(8, 1)
+	payload := testPayload(150, 1)
+	stream := encodeTestY4M(t, cover, payload, &Options{Passphrase: []byte("pass")})
+	if len(stream) != len(cover) {
+		t.Fatalf("encoded %d bytes of a %d byte stream", len(stream), len(cover))
+	}
+
+	// Only the low bits of the luma samples of the first frames change.
+	for i, frame := range y4mFrames(stream) {
+		orig := y4mFrames(cover)[i]
+		luma := len("FRAME\n") + 512
+		if !bytes.Equal(frame[luma:], orig[luma:]) {
+			t.Errorf("frame %d: the chroma samples changed", i)
+		}
+		for j := range frame[:luma] {
+			if frame[j]|1 != orig[j]|1 {
+				t.Fatalf("frame %d: byte %d changed from %#02x to %#02x", i, j, orig[j], frame[j])
+			}
+		}
+		if i > 4 && !bytes.Equal(frame, orig) {
+			t.Errorf("frame %d past the message changed", i)
+		}
+	}
+
+	got, err := DecodeY4M(bytes.NewReader(stream), &Options{Passphrase: []byte("pass")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Error("decoded payload differs")
+	}
+	if _, err := DecodeY4M(bytes.NewReader(cover), nil); err != ErrNoHiddenMessage {
+		t.Errorf("cover: got %v, want ErrNoHiddenMessage", err)
+	}
+}
+
+// TestY4MFrames decodes streams that repeat or lose frames of the message.
+func TestY4MFrames(t *testing.T) {
+	payload := testPayload(150, 2)
+	frames := y4mFrames(encodeTestY4M(t, testY4M(8, 2), payload, nil))
+
+	repeated := y4mStreamOf(frames[0], frames[1], frames[1], frames[2], frames[3], frames[3], frames[4])
+	if got, err := DecodeY4M(bytes.NewReader(repeated), nil); err != nil || !bytes.Equal(got, payload) {
+		t.Errorf("repeated frames: got %d bytes, %v", len(got), err)
+	}
+
+	dropped := y4mStreamOf(frames[0], frames[3], frames[4])
+	var missing *FramesMissingError
+	if _, err := DecodeY4M(bytes.NewReader(dropped), nil); !errors.As(err, &missing) || missing.First != 1 || missing.Last != 2 {
+		t.Errorf("dropped frames: got %v, want frames 1 to 2 missing", err)
+	}
+
+	short := y4mStreamOf(frames[:2]...)
+	if _, err := DecodeY4M(bytes.NewReader(short), nil); !errors.As(err, new(*TruncatedError)) {
+		t.Errorf("short stream: got %v, want a TruncatedError", err)
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeY4M(&buf, bytes.NewReader(testY4M(2, 2)), payload, nil); err != ErrMessageTooLarge {
+		t.Errorf("encoding into 2 frames: got %v, want ErrMessageTooLarge", err)
+	}
+}
+
+// TestY4MMalformed checks that malformed stream and frame headers and
+// truncated frames are errors of the stream, whether encoding or decoding.
+func TestY4MMalformed(t *testing.T) {
+	stream := testY4M(3, 3)
+	frame := stream[len(y4mTestHeader):]
+	for _, c := range []struct {
+		name   string
+		stream []byte
+	}{
+		{"no signature", append([]byte("YUV4MPEG3 W32 H16\n"), frame...)},
+		{"no dimensions", append([]byte("YUV4MPEG2 F25:1\n"), frame...)},
+		{"negative width", append([]byte("YUV4MPEG2 W-32 H16\n"), frame...)},
+		{"invalid height", append([]byte("YUV4MPEG2 W32 Hx\n"), frame...)},
+		{"unsupported colorspace", append([]byte("YUV4MPEG2 W32 H16 C420p10\n"), frame...)},
+		{"stream header too long", []byte("YUV4MPEG2 W32 H16 X" + strings.Repeat("x", maxY4MLine) + "\n")},
+		{"stream header cut short", []byte("YUV4MPEG2 W32 H16")},
+		{"frame header", append([]byte(y4mTestHeader), bytes.Replace(frame, []byte("FRAME"), []byte("FRAMX"), 1)...)},
+		{"frame header too long", append([]byte(y4mTestHeader+"FRAME "+strings.Repeat("x", maxY4MLine)+"\n"), frame...)},
+		{"frame header cut short", []byte(y4mTestHeader + "FRA")},
+		{"truncated frame", stream[:len(y4mTestHeader)+y4mTestFrame/2]},
+	} {
+		var malformed *MalformedImageError
+		if _, err := DecodeY4M(bytes.NewReader(c.stream), nil); !errors.As(err, &malformed) {
+			t.Errorf("%s: decoding got %v, want a MalformedImageError", c.name, err)
+		}
+		var buf bytes.Buffer
+		if err := EncodeY4M(&buf, bytes.NewReader(c.stream), []byte("message"), nil); !errors.As(err, &malformed) {
+			t.Errorf("%s: encoding got %v, want a MalformedImageError", c.name, err)
+		}
+	}
+}